@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/multipass"
+)
+
+// TestAgentExecutorRefusesOptionNames checks that the agent's typed VM
+// endpoints never hand multipass a VM name it would read as an option, such
+// as --all on /api/vm/delete
+func TestAgentExecutorRefusesOptionNames(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "multipass"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	ctx := context.Background()
+	e := &AgentExecutor{runner: multipass.NewRunner(nil)}
+	for _, name := range []string{"--all", "-h"} {
+		operations := map[string]func() *models.OperationResult{
+			"delete":  func() *models.OperationResult { return e.DeleteVM(ctx, name, false) },
+			"purge":   func() *models.OperationResult { return e.PurgeVM(ctx, name) },
+			"stop":    func() *models.OperationResult { return e.StopVM(ctx, name, 0) },
+			"start":   func() *models.OperationResult { return e.StartVM(ctx, name) },
+			"restart": func() *models.OperationResult { return e.RestartVM(ctx, name, true) },
+		}
+		for operation, run := range operations {
+			if result := run(); result.Success {
+				t.Errorf("%s %q succeeded; want it refused", operation, name)
+			}
+		}
+	}
+
+	if data, _ := os.ReadFile(calls); len(data) > 0 {
+		t.Errorf("multipass was run with an option as the VM name:\n%s", data)
+	}
+}
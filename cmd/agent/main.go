@@ -2,221 +2,643 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-	"unsafe"
 
-	"github.com/creack/pty"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/websocket/v2"
+	gorillaws "github.com/gorilla/websocket"
+	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/apierror"
+	"github.com/prashah/batwa/pkg/cloudinit"
+	"github.com/prashah/batwa/pkg/forward"
+	"github.com/prashah/batwa/pkg/jobs"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/metrics"
+	"github.com/prashah/batwa/pkg/middleware"
 	"github.com/prashah/batwa/pkg/models"
 	"github.com/prashah/batwa/pkg/multipass"
+	"github.com/prashah/batwa/pkg/requestid"
+	"github.com/prashah/batwa/pkg/secrets"
+	"github.com/prashah/batwa/pkg/shutdown"
+	"github.com/prashah/batwa/pkg/sse"
+	"github.com/prashah/batwa/pkg/tlsconfig"
+	"github.com/prashah/batwa/pkg/tracing"
+	"github.com/prashah/batwa/pkg/tunnel"
+	wshandler "github.com/prashah/batwa/pkg/websocket"
 )
 
+var logger = logging.For("main")
+
 // Config holds the agent configuration
-var Config struct {
+type Config struct {
 	AgentID           string
-	APIKey            string
+	APIKeyFile        string
 	MasterURL         string
+	RegistrationToken *secrets.Secret
+	Tunnel            bool
+	LocalURL          string
+	// APIKey is the key given with --api-key, which a key rotated by the
+	// master and saved to APIKeyFile takes precedence over
+	APIKey *secrets.Secret
+	// Cipher encrypts the rotated key in APIKeyFile, when SECRETS_KEY_FILE
+	// is set
+	Cipher *secrets.Cipher
+	// MetricsToken, when set, is the bearer token /metrics requires
+	MetricsToken *secrets.Secret
+	// LocalTLS verifies the agent's own certificate when the tunnel relays
+	// requests to its HTTPS API
+	LocalTLS *tls.Config
+	// Scheme and ServerName give the URL the master reaches the agent at
+	Scheme            string
+	ServerName        string
 	HeartbeatInterval int
+	HeartbeatVMs      bool
+	Tags              map[string]string
+	Zone              string
+	WatchInterval     int
 	Port              int
 }
 
+// Agent is the running agent: its configuration and the state its handlers
+// and its reports to the master share. main builds the one the process runs.
+type Agent struct {
+	Config Config
+	// keys holds the agent's API key and the key it replaced
+	keys     apiKeys
+	runner   *multipass.Runner
+	executor *AgentExecutor
+	// jobs runs the long operations the master submits as jobs
+	jobs *jobs.Queue
+	// health watches multipassd so heartbeats can report when it is down
+	health    *multipass.HealthMonitor
+	forwards  *forward.Manager
+	terminals *wshandler.Sessions
+	// heartbeats counts the heartbeats sent to the master, by whether it
+	// took them
+	heartbeats *metrics.Counter
+	// stopping is set once the agent has signed off from the master as it
+	// shuts down, so no heartbeat or VM report brings it back online
+	stopping atomic.Bool
+}
+
 // AgentExecutor executes multipass commands on the agent machine
-type AgentExecutor struct{}
+type AgentExecutor struct {
+	runner *multipass.Runner
+}
 
 // ListVMs lists all VMs on this agent
-func (e *AgentExecutor) ListVMs() map[string]interface{} {
-	result := multipass.RunMultipassCommand([]string{"list", "--format", "json"})
-	if !result.Success {
-		return map[string]interface{}{"error": result.Error}
+func (e *AgentExecutor) ListVMs(ctx context.Context) (*models.VMList, error) {
+	return e.runner.List(ctx)
+}
+
+// GetVMInfo gets information about a specific VM
+func (e *AgentExecutor) GetVMInfo(ctx context.Context, vmName string) (*models.VMDetail, error) {
+	return e.runner.Info(ctx, vmName)
+}
+
+// CreateVM creates a new VM
+func (e *AgentExecutor) CreateVM(ctx context.Context, req models.VMCreateRequest, progress func(models.LaunchProgress)) *models.OperationResult {
+	// The master validates too, but the agent must not trust it blindly
+	extraArgs, err := multipass.ValidateExtraArgs(req.ExtraArgs)
+	if err != nil {
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
+		}
 	}
+	req.ExtraArgs = extraArgs
 
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(result.Output), &data); err != nil {
-		return map[string]interface{}{"error": fmt.Sprintf("Failed to parse JSON: %s", err)}
+	cloudInitPath := ""
+	if req.CloudInit != "" {
+		path, cleanup, err := cloudinit.WriteTempFile(req.CloudInit)
+		if err != nil {
+			return &models.OperationResult{
+				Success: false,
+				Message: fmt.Sprintf("Failed to write cloud-init file: %s", err),
+			}
+		}
+		defer cleanup()
+		cloudInitPath = path
 	}
 
-	return data
+	return e.runner.Launch(ctx, req, cloudInitPath, progress).Operation("")
 }
 
-// GetVMInfo gets information about a specific VM
-func (e *AgentExecutor) GetVMInfo(vmName string) map[string]interface{} {
-	result := multipass.RunMultipassCommand([]string{"info", vmName, "--format", "json"})
-	if !result.Success {
-		return map[string]interface{}{"error": result.Error}
-	}
+// StartVM starts a VM
+func (e *AgentExecutor) StartVM(ctx context.Context, vmName string) *models.OperationResult {
+	return e.runner.RunVMCommand(ctx, vmName, []string{"start", vmName}).Operation("")
+}
 
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(result.Output), &data); err != nil {
-		return map[string]interface{}{"error": fmt.Sprintf("Failed to parse JSON: %s", err)}
+// StopVM stops a VM, or schedules the stop delayMinutes from now
+func (e *AgentExecutor) StopVM(ctx context.Context, vmName string, delayMinutes int) *models.OperationResult {
+	if delayMinutes > 0 {
+		args := []string{"stop", "--time", strconv.Itoa(delayMinutes), vmName}
+		return e.runner.RunVMCommand(ctx, vmName, args).Operation(fmt.Sprintf("VM will stop in %d minutes", delayMinutes))
 	}
+	return e.runner.RunVMCommand(ctx, vmName, []string{"stop", vmName}).Operation("")
+}
 
-	return data
+// CancelStopVM cancels a delayed stop
+func (e *AgentExecutor) CancelStopVM(ctx context.Context, vmName string) *models.OperationResult {
+	return e.runner.RunVMCommand(ctx, vmName, []string{"stop", "--cancel", vmName}).Operation("Scheduled stop cancelled")
 }
 
-// CreateVM creates a new VM
-func (e *AgentExecutor) CreateVM(req models.VMCreateRequest) map[string]interface{} {
-	args := []string{
-		"launch",
-		req.Image,
-		"--name", req.Name,
-		"--cpus", fmt.Sprintf("%d", req.CPUs),
-		"--memory", req.Memory,
-		"--disk", req.Disk,
-	}
-
-	result := multipass.RunMultipassCommand(args)
-	message := result.Output
-	if !result.Success {
-		message = result.Error
+// SuspendVM suspends a VM
+func (e *AgentExecutor) SuspendVM(ctx context.Context, vmName string) *models.OperationResult {
+	return e.runner.RunVMCommand(ctx, vmName, []string{"suspend", vmName}).Operation("")
+}
+
+// ResumeVM resumes a suspended VM
+func (e *AgentExecutor) ResumeVM(ctx context.Context, vmName string) *models.OperationResult {
+	// multipass resumes suspended instances through start
+	return e.runner.RunVMCommand(ctx, vmName, []string{"start", vmName}).Operation("")
+}
+
+// RestartVM restarts a VM, forcing a stop and start if the guest is unresponsive and force is set
+func (e *AgentExecutor) RestartVM(ctx context.Context, vmName string, force bool) *models.OperationResult {
+	result := e.runner.RunVMCommand(ctx, vmName, []string{"restart", vmName})
+	if result.Success || !force {
+		return result.Operation("")
 	}
 
-	return map[string]interface{}{
-		"success": result.Success,
-		"message": message,
+	logger.WarnContext(ctx, "Graceful restart failed, forcing stop and start", "vm", vmName, "error", result.Error)
+	stopResult := e.runner.RunVMCommand(ctx, vmName, []string{"stop", "--force", vmName})
+	if !stopResult.Success {
+		return stopResult.Operation("")
 	}
+
+	return e.runner.RunVMCommand(ctx, vmName, []string{"start", vmName}).Operation("VM force restarted")
 }
 
-// StartVM starts a VM
-func (e *AgentExecutor) StartVM(vmName string) map[string]interface{} {
-	result := multipass.RunMultipassCommand([]string{"start", vmName})
-	message := result.Output
+// DeleteVM deletes a VM. A soft delete leaves the VM recoverable until it is purged.
+func (e *AgentExecutor) DeleteVM(ctx context.Context, vmName string, softDelete bool) *models.OperationResult {
+	result := e.runner.RunVMCommand(ctx, vmName, []string{"delete", vmName})
 	if !result.Success {
-		message = result.Error
+		return result.Operation("")
 	}
 
-	return map[string]interface{}{
-		"success": result.Success,
-		"message": message,
+	if softDelete {
+		return &models.OperationResult{
+			Success: true,
+			Message: "VM deleted; it can be recovered until purged",
+		}
 	}
+
+	return e.runner.RunMultipassCommand(ctx, []string{"purge"}).Operation("VM deleted and purged")
 }
 
-// StopVM stops a VM
-func (e *AgentExecutor) StopVM(vmName string) map[string]interface{} {
-	result := multipass.RunMultipassCommand([]string{"stop", vmName})
-	message := result.Output
-	if !result.Success {
-		message = result.Error
-	}
+// RecoverVM recovers a soft-deleted VM
+func (e *AgentExecutor) RecoverVM(ctx context.Context, vmName string) *models.OperationResult {
+	return e.runner.RunVMCommand(ctx, vmName, []string{"recover", vmName}).Operation("")
+}
 
-	return map[string]interface{}{
-		"success": result.Success,
-		"message": message,
+// PurgeVM permanently removes a soft-deleted VM
+func (e *AgentExecutor) PurgeVM(ctx context.Context, vmName string) *models.OperationResult {
+	return e.runner.RunVMCommand(ctx, vmName, []string{"delete", "--purge", vmName}).Operation("VM purged")
+}
+
+// MountVM mounts a directory of this host into a VM
+func (e *AgentExecutor) MountVM(ctx context.Context, vmName, source, target string) *models.OperationResult {
+	return e.runner.RunVMCommand(ctx, vmName, multipass.BuildMountArgs(vmName, source, target)).Operation("Directory mounted")
+}
+
+// UnmountVM removes a mount from a VM, or all of its mounts when target is empty
+func (e *AgentExecutor) UnmountVM(ctx context.Context, vmName, target string) *models.OperationResult {
+	return e.runner.RunVMCommand(ctx, vmName, multipass.BuildUnmountArgs(vmName, target)).Operation("Directory unmounted")
+}
+
+// ListMounts lists the mounts of a VM
+func (e *AgentExecutor) ListMounts(ctx context.Context, vmName string) ([]models.VMMount, error) {
+	return e.runner.ListMounts(ctx, vmName)
+}
+
+// keyRotationGrace is how long a rotated-out API key keeps working, so that
+// requests the master sent before swapping keys still succeed
+const keyRotationGrace = time.Minute
+
+// apiKeys holds an API key and the key it replaced
+type apiKeys struct {
+	sync.RWMutex
+	current       string
+	previous      string
+	previousUntil time.Time
+}
+
+// currentAPIKey gets the agent's API key, or "" when none is configured
+func (a *Agent) currentAPIKey() string {
+	a.keys.RLock()
+	defer a.keys.RUnlock()
+	return a.keys.current
+}
+
+// acceptsAPIKey reports whether key is the agent's API key, or the key it
+// replaced less than keyRotationGrace ago
+func (a *Agent) acceptsAPIKey(key string) bool {
+	a.keys.RLock()
+	defer a.keys.RUnlock()
+	if key == "" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(a.keys.current)) == 1 {
+		return true
 	}
+	return a.keys.previous != "" && time.Now().Before(a.keys.previousUntil) &&
+		subtle.ConstantTimeCompare([]byte(key), []byte(a.keys.previous)) == 1
 }
 
-// DeleteVM deletes a VM
-func (e *AgentExecutor) DeleteVM(vmName string) map[string]interface{} {
-	result := multipass.RunMultipassCommand([]string{"delete", vmName})
-	if !result.Success {
-		return map[string]interface{}{
-			"success": false,
-			"message": result.Error,
+// rotateAPIKey replaces the agent's API key, saving it to --api-key-file
+// first when one is set so the new key survives restarts
+func (a *Agent) rotateAPIKey(key string) error {
+	a.keys.Lock()
+	defer a.keys.Unlock()
+
+	if a.Config.APIKeyFile != "" {
+		saved := key
+		if a.Config.Cipher != nil {
+			sealed, err := a.Config.Cipher.Seal(key)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt API key: %w", err)
+			}
+			saved = sealed
+		}
+		if err := os.WriteFile(a.Config.APIKeyFile, []byte(saved+"\n"), 0o600); err != nil {
+			return fmt.Errorf("failed to save API key: %w", err)
 		}
+	} else {
+		logger.Warn("--api-key-file is not set; the rotated API key is lost on restart")
 	}
+	a.replaceAPIKey(key)
+	return nil
+}
 
-	purgeResult := multipass.RunMultipassCommand([]string{"purge"})
-	message := "VM deleted and purged"
-	if !purgeResult.Success {
-		message = purgeResult.Error
-	}
+// replaceAPIKey makes key the agent's API key, accepting the one it replaces
+// for keyRotationGrace; the caller must hold the lock
+func (a *Agent) replaceAPIKey(key string) {
+	a.keys.previous = a.keys.current
+	a.keys.previousUntil = time.Now().Add(keyRotationGrace)
+	a.keys.current = key
+}
 
-	return map[string]interface{}{
-		"success": purgeResult.Success,
-		"message": message,
+// loadAPIKey gets the API key saved in file by an earlier rotation, falling
+// back to flagKey when there is none
+func (a *Agent) loadAPIKey(file, flagKey string) (string, error) {
+	if file == "" {
+		return flagKey, nil
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return flagKey, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(data))
+	if secrets.IsSealed(key) {
+		if a.Config.Cipher == nil {
+			return "", errors.New("the saved API key is encrypted; set SECRETS_KEY_FILE to decrypt it")
+		}
+		return a.Config.Cipher.Open(key)
+	}
+	if key != "" {
+		return key, nil
 	}
+	return flagKey, nil
 }
 
-var executor = &AgentExecutor{}
+// reloadSecrets loads the API key and registration token again, as on
+// SIGHUP. When the API key changed, the agent registers again so the master
+// calls it with the new key.
+func (a *Agent) reloadSecrets(resolver *secrets.Resolver) {
+	resolver.Reload()
+	key, err := a.loadAPIKey(a.Config.APIKeyFile, a.Config.APIKey.Value())
+	if err != nil {
+		logger.Error("Failed to reload the API key", "error", err)
+		return
+	}
+	a.keys.Lock()
+	changed := key != a.keys.current
+	if changed {
+		a.replaceAPIKey(key)
+	}
+	a.keys.Unlock()
+	if changed && a.Config.MasterURL != "" {
+		logger.Info("API key changed; registering again so the master uses it")
+		a.registerWithMaster()
+	}
+}
 
 // verifyAPIKey middleware to verify API key
-func verifyAPIKey(c *fiber.Ctx) error {
-	if Config.APIKey == "" {
+func (a *Agent) verifyAPIKey(c *fiber.Ctx) error {
+	if a.currentAPIKey() == "" {
 		return c.Next()
 	}
 
-	apiKey := c.Get("X-API-Key")
-	if apiKey == "" || apiKey != Config.APIKey {
-		return c.Status(403).JSON(fiber.Map{"detail": "Invalid or missing API key"})
+	if !a.acceptsAPIKey(c.Get("X-API-Key")) {
+		return apierror.Respond(c, 403, "Invalid or missing API key")
 	}
 
 	return c.Next()
 }
 
-// ResizeMessage represents a terminal resize message
-type ResizeMessage struct {
-	Type string `json:"type"`
-	Cols uint16 `json:"cols"`
-	Rows uint16 `json:"rows"`
+// submitJob queues a long operation and answers 202 with the queued job.
+// JSON requests carry a models.AgentJobRequest; uploads are multipart forms
+// with kind "upload", the VM name, the destination path and the file.
+func (a *Agent) submitJob(c *fiber.Ctx) error {
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		return a.submitUploadJob(c)
+	}
+
+	var req models.AgentJobRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	var run jobs.Runner
+	switch req.Kind {
+	case "create":
+		var payload models.VMCreateRequest
+		if err := json.Unmarshal(req.Payload, &payload); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+		run = func(ctx context.Context, progress func(models.LaunchProgress)) *models.OperationResult {
+			return a.executor.CreateVM(ctx, payload, progress)
+		}
+	case "clone":
+		var payload models.VMCloneRequest
+		if err := json.Unmarshal(req.Payload, &payload); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+		run = func(ctx context.Context, _ func(models.LaunchProgress)) *models.OperationResult {
+			return a.runner.CloneResponse(ctx, a.runner.Clone(ctx, payload))
+		}
+	case "resize":
+		var payload models.VMResizeRequest
+		if err := json.Unmarshal(req.Payload, &payload); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+		run = func(ctx context.Context, _ func(models.LaunchProgress)) *models.OperationResult {
+			phases, success := a.runner.Resize(ctx, payload)
+			return &models.OperationResult{Success: success, Phases: phases}
+		}
+	default:
+		return apierror.Respond(c, 400, fmt.Sprintf("Unsupported job kind: %q", req.Kind))
+	}
+
+	return c.Status(202).JSON(a.jobs.Submit(c.UserContext(), req.Kind, run))
+}
+
+// submitUploadJob stages an uploaded file and queues copying it into the VM
+func (a *Agent) submitUploadJob(c *fiber.Ctx) error {
+	if c.FormValue("kind") != "upload" {
+		return apierror.Respond(c, 400, "multipart jobs must be uploads")
+	}
+	name := c.FormValue("name")
+	path := c.FormValue("path")
+	if name == "" || path == "" {
+		return apierror.Respond(c, 400, "name and path are required")
+	}
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return apierror.Respond(c, 400, "file is required for uploads")
+	}
+	src, err := fileHeader.Open()
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+	defer src.Close()
+
+	staged, err := multipass.StageUpload(src)
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	destPath := multipass.ResolveUploadPath(path, fileHeader.Filename)
+	filename := fileHeader.Filename
+	job := a.jobs.Submit(c.UserContext(), "upload", func(ctx context.Context, _ func(models.LaunchProgress)) *models.OperationResult {
+		defer os.Remove(staged)
+		if err := a.runner.UploadStaged(ctx, name, destPath, staged, nil); err != nil {
+			return &models.OperationResult{Success: false, Message: err.Error()}
+		}
+		return &models.OperationResult{Success: true, Message: fmt.Sprintf("Uploaded %s to %s", filename, destPath)}
+	})
+	return c.Status(202).JSON(job)
 }
 
 func main() {
 	// Parse command-line flags
 	agentID := flag.String("agent-id", "", "Unique identifier for this agent (required)")
-	apiKey := flag.String("api-key", "", "API key for authentication (optional)")
+	apiKey := flag.String("api-key", "", "API key for authentication (optional); may be a vault:<path>#<field> or file:<path> reference")
+	apiKeyFile := flag.String("api-key-file", "", "File the API key is saved to when the master rotates it; a key saved there takes precedence over --api-key")
 	masterURL := flag.String("master-url", "", "URL of the master server (e.g., http://master:8000)")
+	registrationToken := flag.String("registration-token", os.Getenv("AGENT_REGISTRATION_TOKEN"), "Token the master requires to register (defaults to $AGENT_REGISTRATION_TOKEN); may be a vault: or file: reference")
 	port := flag.Int("port", 8001, "Port to listen on")
 	host := flag.String("host", "0.0.0.0", "Host to bind to")
 	heartbeatInterval := flag.Int("heartbeat-interval", 30, "Heartbeat interval in seconds")
+	heartbeatVMs := flag.Bool("heartbeat-vms", true, "Include the VM listing and usage in heartbeats")
+	watchInterval := flag.Int("watch-interval", 5, "Seconds between checks for VM state changes to push to the master (0 disables)")
+	tunnelMode := flag.Bool("tunnel", false, "Open a tunnel to the master and take its requests over it, for agents the master cannot connect to")
+	tags := flag.String("tags", "", "Comma separated key=value tags that VM placement constraints match (e.g. gpu=true,arch=arm64)")
+	zone := flag.String("zone", "", "Zone this agent belongs to (e.g. office, dc1)")
+	jobConcurrency := flag.Int("job-concurrency", jobs.DefaultConcurrency, "Number of long operations (launches, clones, resizes, uploads) the job queue runs at once")
+	corsMode := flag.String("cors-mode", middleware.SameOriginMode, "CORS mode: same-origin or cross-origin")
+	corsOrigins := flag.String("cors-origins", "", "Comma separated origins allowed in cross-origin mode")
+	executeCommands := flag.String("execute-commands", strings.Join(multipass.DefaultCommands, ","), "Comma separated multipass subcommands /api/execute may run")
+	disableExecute := flag.Bool("disable-execute", false, "Refuse every /api/execute request")
+	mountRoots := flag.String("mount-roots", os.Getenv("MOUNT_ROOTS"), "Comma separated directories whose contents may be mounted into VMs (defaults to $MOUNT_ROOTS; any directory when empty)")
+	logFormat := flag.String("log-format", os.Getenv("LOG_FORMAT"), "Log output format: text or json (defaults to $LOG_FORMAT, else text)")
+	logLevel := flag.String("log-level", os.Getenv("LOG_LEVEL"), "Log level, optionally with per-package levels such as warn,multipass=debug (defaults to $LOG_LEVEL, else info)")
+	metricsToken := flag.String("metrics-token", os.Getenv("METRICS_TOKEN"), "Bearer token /metrics requires (defaults to $METRICS_TOKEN; open when empty); may be a vault: or file: reference")
+	shutdownTimeout := flag.Duration("shutdown-timeout", shutdown.DefaultTimeout, "How long shutting down on SIGTERM or SIGINT waits for requests, jobs and terminal sessions to finish")
+	allowedCIDRs := flag.String("allowed-cidrs", "", "Comma separated CIDRs or addresses allowed to call the agent, such as the master's address (default: any)")
+	tlsFlags := tlsconfig.RegisterFlags("data/acme")
 
 	flag.Parse()
 
+	if err := logging.Configure(*logFormat, *logLevel); err != nil {
+		logging.Fatal(logger, "Invalid logging configuration", "error", err)
+	}
 	if *agentID == "" {
-		log.Fatal("--agent-id is required")
+		logging.Fatal(logger, "--agent-id is required")
+	}
+
+	// Build the agent from its flags
+	agent := &Agent{}
+	agent.Config.AgentID = *agentID
+	agent.Config.APIKeyFile = *apiKeyFile
+	secretResolver, err := secrets.NewResolverFromEnv()
+	if err != nil {
+		logging.Fatal(logger, "Failed to set up secrets", "error", err)
+	}
+	agent.Config.Cipher = secretResolver.Cipher()
+	if agent.Config.APIKey, err = secretResolver.Secret("--api-key", *apiKey); err != nil {
+		logging.Fatal(logger, "Invalid --api-key", "error", err)
+	}
+	if agent.Config.RegistrationToken, err = secretResolver.Secret("--registration-token", *registrationToken); err != nil {
+		logging.Fatal(logger, "Invalid --registration-token", "error", err)
+	}
+	if agent.Config.MetricsToken, err = secretResolver.Secret("--metrics-token", *metricsToken); err != nil {
+		logging.Fatal(logger, "Invalid --metrics-token", "error", err)
+	}
+	key, err := agent.loadAPIKey(*apiKeyFile, agent.Config.APIKey.Value())
+	if err != nil {
+		logging.Fatal(logger, "Failed to read --api-key-file", "error", err)
+	}
+	agent.keys.current = key
+	agent.Config.MasterURL = *masterURL
+	agent.Config.Port = *port
+	agent.Config.Tunnel = *tunnelMode
+	tlsConfig, err := tlsFlags.Config()
+	if err != nil {
+		logging.Fatal(logger, "Invalid TLS configuration", "error", err)
+	}
+	agent.Config.Scheme = tlsConfig.Scheme()
+	agent.Config.ServerName = tlsConfig.ServerName()
+	if tlsConfig.Enabled() {
+		agent.Config.LocalTLS = &tls.Config{ServerName: agent.Config.ServerName}
+	}
+	agent.Config.LocalURL = agent.localURL(*host, *port)
+	agent.Config.HeartbeatInterval = *heartbeatInterval
+	agent.Config.HeartbeatVMs = *heartbeatVMs
+	agentTags, err := parseTags(*tags)
+	if err != nil {
+		logging.Fatal(logger, "Invalid --tags", "error", err)
+	}
+	agent.Config.Tags = agentTags
+	if err := agents.ValidateZone(*zone); err != nil {
+		logging.Fatal(logger, "Invalid --zone", "error", err)
+	}
+	agent.Config.Zone = *zone
+	// Measure multipass commands, terminal sessions and heartbeats for
+	// /metrics
+	metricsRegistry := metrics.NewRegistry()
+	agent.runner = multipass.NewRunner(metricsRegistry)
+	agent.executor = &AgentExecutor{runner: agent.runner}
+	agent.jobs = jobs.NewQueue(*jobConcurrency)
+	agent.forwards = forward.NewManagerFromEnv(agent.runner)
+	agent.health = multipass.NewHealthMonitor(agent.runner)
+	agent.terminals = wshandler.NewSessions(metricsRegistry)
+	agent.heartbeats = metricsRegistry.Counter(metrics.Namespace+"agent_heartbeats_total",
+		"Heartbeats sent to the master, by result", "result")
+	commandPolicy, err := multipass.NewCommandPolicy(*executeCommands, *disableExecute)
+	if err != nil {
+		logging.Fatal(logger, "Invalid --execute-commands", "error", err)
+	}
+	mountPolicy, err := multipass.NewMountPolicy(*mountRoots)
+	if err != nil {
+		logging.Fatal(logger, "Invalid --mount-roots", "error", err)
 	}
+	agent.Config.WatchInterval = *watchInterval
 
-	// Update config
-	Config.AgentID = *agentID
-	Config.APIKey = *apiKey
-	Config.MasterURL = *masterURL
-	Config.Port = *port
-	Config.HeartbeatInterval = *heartbeatInterval
+	// Export traces over OTLP when an endpoint is configured
+	tracer, err := tracing.NewTracerFromEnv("batwa-agent")
+	if err != nil {
+		logging.Fatal(logger, "Invalid tracing configuration", "error", err)
+	}
+	logger.Info("Tracing", "exporter", tracer.String())
 
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
-		AppName: "Batwa Agent",
+		AppName:           "Batwa Agent",
+		BodyLimit:         multipass.TransferBodyLimit(),
+		StreamRequestBody: true,
+		ErrorHandler:      apierror.Handler,
 	})
 
-	// Add CORS middleware
-	app.Use(cors.New(cors.Config{
-		AllowOrigins:     "*",
-		AllowCredentials: true,
-		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders:     "*",
-	}))
+	// Give every request an ID first, so even rejected ones can be traced
+	app.Use(requestid.New())
+
+	// Add CORS or same-origin middleware
+	corsConfig, err := middleware.NewCORSConfig(*corsMode, *corsOrigins)
+	if err != nil {
+		logging.Fatal(logger, "Invalid CORS configuration", "error", err)
+	}
+	// The agent serves no UI, so lock down everything it returns
+	corsConfig.ContentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'"
+	middleware.ApplyCORS(app, corsConfig)
+
+	// Only accept requests from the allowed networks, such as the master's.
+	// The tunnel passes the master's requests on from the loopback address.
+	allowlist, err := middleware.NewAllowlist(*allowedCIDRs)
+	if err != nil {
+		logging.Fatal(logger, "Invalid --allowed-cidrs", "error", err)
+	}
+	if allowlist != nil && agent.Config.Tunnel {
+		allowlist, _ = middleware.NewAllowlist(*allowedCIDRs + ",127.0.0.1,::1")
+	}
+	app.Use(allowlist.Handler())
+
+	// Log each request with its ID, trace and outcome
+	app.Use(logging.Middleware())
+
+	// Count and time requests for /metrics
+	app.Use(metrics.Middleware(metricsRegistry))
 
-	// Add logger middleware
-	app.Use(logger.New())
+	// Serve each request in a span, joining the master's trace
+	app.Use(tracing.Middleware(tracer))
 
-	// Health check endpoint
+	// Prometheus metrics: requests, multipass commands and heartbeats
+	app.Get("/metrics", metrics.Handler(metricsRegistry, agent.Config.MetricsToken))
+
+	// Health check endpoint, for the master, load balancers and probes. It
+	// answers 503 while multipassd does not answer, as the agent can then
+	// manage no VMs.
+	startedAt := time.Now()
 	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{
-			"status":    "ok",
-			"agent_id":  Config.AgentID,
-			"timestamp": time.Now().Format(time.RFC3339),
+		health := agent.health.Health()
+		status, code := "ok", fiber.StatusOK
+		if health.Status == multipass.HealthDegraded || health.Status == multipass.HealthUnavailable {
+			status, code = "degraded", fiber.StatusServiceUnavailable
+		}
+		return c.Status(code).JSON(fiber.Map{
+			"status":               status,
+			"agent_id":             agent.Config.AgentID,
+			"timestamp":            time.Now().Format(time.RFC3339),
+			"started_at":           startedAt.Format(time.RFC3339),
+			"uptime_seconds":       int64(time.Since(startedAt).Seconds()),
+			"multipassd_reachable": health.DaemonReachable,
+			"multipass":            health,
 		})
 	})
 
-	// Execute command endpoint
-	app.Post("/api/execute", verifyAPIKey, func(c *fiber.Ctx) error {
+	// Execute command endpoint, for the multipass commands the policy allows
+	app.Post("/api/execute", agent.verifyAPIKey, func(c *fiber.Ctx) error {
 		var req models.RemoteCommandRequest
 		if err := c.BodyParser(&req); err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+		if err := commandPolicy.Validate(req); err != nil {
+			logger.WarnContext(c.UserContext(), "Refused to execute multipass command", "args", strings.Join(req.Args, " "), "error", err)
+			return apierror.RespondCode(c, 403, models.ErrCodeCommandNotAllowed, err.Error())
 		}
 
-		result := multipass.RunMultipassCommand(req.Args)
+		// The master's timeout, when given, tightens the command's own limit
+		ctx := c.UserContext()
+		if req.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Second)
+			defer cancel()
+		}
+		result := agent.runner.RunMultipassCommand(ctx, req.Args)
 		stdout := result.Output
 		stderr := result.Error
 		returnCode := 0
@@ -233,211 +655,622 @@ func main() {
 	})
 
 	// VM list endpoint
-	app.Get("/api/vm/list", verifyAPIKey, func(c *fiber.Ctx) error {
-		result := executor.ListVMs()
-		if err, ok := result["error"]; ok {
-			return c.Status(500).JSON(fiber.Map{"detail": err})
+	app.Get("/api/vm/list", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		list, err := agent.executor.ListVMs(c.UserContext())
+		if err != nil {
+			return apierror.RespondErr(c, 500, err)
 		}
-		return c.JSON(result)
+		return c.JSON(list)
 	})
 
 	// VM info endpoint
-	app.Get("/api/vm/info/:vm_name", verifyAPIKey, func(c *fiber.Ctx) error {
+	app.Get("/api/vm/usage", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		usage, err := agent.runner.ListUsage(c.UserContext())
+		if err != nil {
+			return apierror.RespondErr(c, 500, err)
+		}
+		return c.JSON(fiber.Map{"usage": usage})
+	})
+
+	app.Get("/api/vm/info/:vm_name", agent.verifyAPIKey, func(c *fiber.Ctx) error {
 		vmName := c.Params("vm_name")
-		result := executor.GetVMInfo(vmName)
-		if err, ok := result["error"]; ok {
-			return c.Status(404).JSON(fiber.Map{"detail": err})
+		detail, err := agent.executor.GetVMInfo(c.UserContext(), vmName)
+		if err != nil {
+			return apierror.RespondErr(c, 500, err)
 		}
-		return c.JSON(result)
+		return c.JSON(detail)
+	})
+
+	// Blueprint list endpoint
+	app.Get("/api/blueprints", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		blueprints, err := agent.runner.ListBlueprints(c.UserContext())
+		if err != nil {
+			return apierror.RespondErr(c, 500, err)
+		}
+		return c.JSON(fiber.Map{"blueprints": blueprints})
+	})
+
+	// Networks endpoint
+	app.Get("/api/networks", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		networks, err := agent.runner.ListNetworks(c.UserContext())
+		if err != nil {
+			return apierror.RespondErr(c, 500, err)
+		}
+		return c.JSON(fiber.Map{"networks": networks})
+	})
+
+	// Host version endpoint
+	app.Get("/api/host/version", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		version, err := agent.runner.LocalVersion(c.UserContext())
+		if err != nil {
+			return apierror.RespondErr(c, 500, err)
+		}
+		return c.JSON(fiber.Map{"version": version})
+	})
+
+	// Host storage endpoints
+	app.Get("/api/host/storage", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		storage, err := agent.runner.Storage(c.UserContext())
+		if err != nil {
+			return apierror.RespondErr(c, 500, err)
+		}
+		return c.JSON(fiber.Map{"storage": storage})
+	})
+
+	app.Post("/api/host/prune", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		result, err := agent.runner.Prune(c.UserContext())
+		if err != nil {
+			return apierror.RespondErr(c, 500, err)
+		}
+		return c.JSON(fiber.Map{"prune": result})
+	})
+
+	// API key rotation endpoint, called by the master with the current key
+	app.Post("/api/agent/rotate-key", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.AgentKeyRotation
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+		if len(req.APIKey) < 32 {
+			return apierror.Respond(c, 400, "API key must be at least 32 characters")
+		}
+		if err := agent.rotateAPIKey(req.APIKey); err != nil {
+			return apierror.RespondErr(c, 500, err)
+		}
+		logger.InfoContext(c.UserContext(), "API key rotated by master")
+		return c.JSON(fiber.Map{"success": true})
+	})
+
+	// Host settings endpoints
+	app.Get("/api/host/settings", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var keys []string
+		if value := c.Query("keys"); value != "" {
+			keys = strings.Split(value, ",")
+		}
+		settings, err := agent.runner.GetSettings(c.UserContext(), keys)
+		if err != nil {
+			return apierror.RespondErr(c, 500, err)
+		}
+		return c.JSON(fiber.Map{"settings": settings})
+	})
+
+	app.Put("/api/host/settings", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req struct {
+			Settings map[string]string `json:"settings"`
+		}
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+		if err := multipass.ValidateSettings(req.Settings); err != nil {
+			return apierror.RespondErr(c, 400, err)
+		}
+		if err := agent.runner.SetSettings(c.UserContext(), req.Settings); err != nil {
+			return apierror.RespondErr(c, 500, err)
+		}
+		return c.JSON(fiber.Map{"success": true})
 	})
 
 	// VM create endpoint
-	app.Post("/api/vm/create", verifyAPIKey, func(c *fiber.Ctx) error {
+	app.Post("/api/vm/create", agent.verifyAPIKey, func(c *fiber.Ctx) error {
 		var req models.VMCreateRequest
 		if err := c.BodyParser(&req); err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+			return apierror.Respond(c, 400, "Invalid request")
 		}
 
-		result := executor.CreateVM(req)
-		if success, ok := result["success"].(bool); !ok || !success {
-			return c.Status(500).JSON(fiber.Map{"detail": result["message"]})
+		result := agent.executor.CreateVM(c.UserContext(), req, nil)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
 		}
 		return c.JSON(result)
 	})
 
+	// VM create endpoint streaming launch progress as server-sent events,
+	// ending with a "result" event
+	app.Post("/api/vm/create/stream", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMCreateRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+
+		ctx := c.UserContext()
+		return sse.Stream(c, func(w *sse.Writer) {
+			result := agent.executor.CreateVM(ctx, req, func(progress models.LaunchProgress) {
+				w.Event("progress", progress)
+			})
+			w.Event("result", result)
+		})
+	})
+
 	// VM start endpoint
-	app.Post("/api/vm/start", verifyAPIKey, func(c *fiber.Ctx) error {
+	app.Post("/api/vm/start", agent.verifyAPIKey, func(c *fiber.Ctx) error {
 		var req models.VMActionRequest
 		if err := c.BodyParser(&req); err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+			return apierror.Respond(c, 400, "Invalid request")
 		}
 
-		result := executor.StartVM(req.Name)
-		if success, ok := result["success"].(bool); !ok || !success {
-			return c.Status(500).JSON(fiber.Map{"detail": result["message"]})
+		result := agent.executor.StartVM(c.UserContext(), req.Name)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
 		}
 		return c.JSON(result)
 	})
 
 	// VM stop endpoint
-	app.Post("/api/vm/stop", verifyAPIKey, func(c *fiber.Ctx) error {
+	app.Post("/api/vm/stop", agent.verifyAPIKey, func(c *fiber.Ctx) error {
 		var req models.VMActionRequest
 		if err := c.BodyParser(&req); err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+			return apierror.Respond(c, 400, "Invalid request")
 		}
 
-		result := executor.StopVM(req.Name)
-		if success, ok := result["success"].(bool); !ok || !success {
-			return c.Status(500).JSON(fiber.Map{"detail": result["message"]})
+		result := agent.executor.StopVM(c.UserContext(), req.Name, 0)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
+		}
+		return c.JSON(result)
+	})
+
+	// VM delayed stop endpoint
+	app.Post("/api/vm/stop/delayed", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMActionRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+		if req.DelayMinutes < 1 {
+			return apierror.Respond(c, 400, "delay_minutes must be at least 1")
+		}
+
+		result := agent.executor.StopVM(c.UserContext(), req.Name, req.DelayMinutes)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
+		}
+		return c.JSON(result)
+	})
+
+	// VM stop cancel endpoint
+	app.Post("/api/vm/stop/cancel", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMActionRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+
+		result := agent.executor.CancelStopVM(c.UserContext(), req.Name)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
+		}
+		return c.JSON(result)
+	})
+
+	// VM suspend endpoint
+	app.Post("/api/vm/suspend", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMActionRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+
+		result := agent.executor.SuspendVM(c.UserContext(), req.Name)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
+		}
+		return c.JSON(result)
+	})
+
+	// VM resume endpoint
+	app.Post("/api/vm/resume", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMActionRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+
+		result := agent.executor.ResumeVM(c.UserContext(), req.Name)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
+		}
+		return c.JSON(result)
+	})
+
+	// VM restart endpoint
+	app.Post("/api/vm/restart", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMActionRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+
+		result := agent.executor.RestartVM(c.UserContext(), req.Name, req.Force)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
 		}
 		return c.JSON(result)
 	})
 
 	// VM delete endpoint
-	app.Post("/api/vm/delete", verifyAPIKey, func(c *fiber.Ctx) error {
+	app.Post("/api/vm/delete", agent.verifyAPIKey, func(c *fiber.Ctx) error {
 		var req models.VMActionRequest
 		if err := c.BodyParser(&req); err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+			return apierror.Respond(c, 400, "Invalid request")
 		}
 
-		result := executor.DeleteVM(req.Name)
-		if success, ok := result["success"].(bool); !ok || !success {
-			return c.Status(500).JSON(fiber.Map{"detail": result["message"]})
+		result := agent.executor.DeleteVM(c.UserContext(), req.Name, req.SoftDelete)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
 		}
+		agent.forwards.RemoveVM(req.Name)
 		return c.JSON(result)
 	})
 
-	// WebSocket endpoint for terminal connections
-	app.Get("/ws", websocket.New(func(c *websocket.Conn) {
-		vmName := c.Query("vm_name")
-		log.Printf("[WebSocket] Connection request for VM: %s", vmName)
+	// VM recover endpoint
+	app.Post("/api/vm/recover", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMActionRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
 
-		if vmName == "" {
-			log.Println("[WebSocket] Error: No VM name provided")
-			c.WriteMessage(websocket.TextMessage, []byte("Error: VM name is required\r\n"))
-			c.Close()
-			return
+		result := agent.executor.RecoverVM(c.UserContext(), req.Name)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
 		}
+		return c.JSON(result)
+	})
 
-		log.Printf("[WebSocket] Creating PTY for %s", vmName)
+	// VM purge endpoint
+	app.Post("/api/vm/purge", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMActionRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
 
-		// Start multipass shell with PTY
-		cmd := exec.Command("multipass", "shell", vmName)
-		ptmx, err := pty.Start(cmd)
+		result := agent.executor.PurgeVM(c.UserContext(), req.Name)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
+		}
+		return c.JSON(result)
+	})
+
+	// VM resize endpoint
+	app.Post("/api/vm/resize", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMResizeRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+
+		phases, success := agent.runner.Resize(c.UserContext(), req)
+		status := 200
+		if !success {
+			status = 500
+		}
+		return c.Status(status).JSON(models.OperationResult{
+			Success: success,
+			Phases:  phases,
+		})
+	})
+
+	// VM clone endpoint
+	app.Post("/api/vm/clone", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMCloneRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+
+		clone := agent.runner.Clone(c.UserContext(), req)
+		status := 200
+		if !clone.Success {
+			status = 500
+		}
+		return c.Status(status).JSON(agent.runner.CloneResponse(c.UserContext(), clone))
+	})
+
+	// VM mount endpoint
+	app.Post("/api/vm/mount", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMMountRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+		source, err := mountPolicy.Source(req.Source)
 		if err != nil {
-			log.Printf("[WebSocket] Error creating PTY: %v", err)
-			c.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("\r\n[Connection Error] %s\r\nMake sure the VM '%s' is running.\r\n", err, vmName)))
-			c.Close()
-			return
+			return apierror.RespondErr(c, 400, err)
 		}
-		defer ptmx.Close()
 
-		log.Printf("[WebSocket] Process started with PID: %d", cmd.Process.Pid)
+		result := agent.executor.MountVM(c.UserContext(), req.Name, source, req.Target)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
+		}
+		return c.JSON(result)
+	})
 
-		done := make(chan bool, 2)
+	// VM umount endpoint
+	app.Post("/api/vm/umount", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMMountRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
 
-		// Read from PTY and forward to websocket
-		go func() {
-			defer func() { done <- true }()
-			buf := make([]byte, 4096)
-			for {
-				n, err := ptmx.Read(buf)
-				if err != nil {
-					if err != io.EOF {
-						log.Printf("PTY read error: %v", err)
-					}
-					return
-				}
-				if n > 0 {
-					if err := c.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-						log.Printf("WebSocket write error: %v", err)
-						return
-					}
-				}
-			}
-		}()
+		result := agent.executor.UnmountVM(c.UserContext(), req.Name, req.Target)
+		if !result.Success {
+			return apierror.Respond(c, 500, result.Message)
+		}
+		return c.JSON(result)
+	})
 
-		// Read from websocket and forward to PTY
-		go func() {
-			defer func() { done <- true }()
-			for {
-				msgType, msg, err := c.ReadMessage()
-				if err != nil {
-					log.Printf("WebSocket read error: %v", err)
-					return
-				}
+	// VM mounts endpoint
+	app.Get("/api/vm/:vm_name/mounts", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		mounts, err := agent.executor.ListMounts(c.UserContext(), c.Params("vm_name"))
+		if err != nil {
+			return apierror.RespondErr(c, 500, err)
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"mounts":  mounts,
+		})
+	})
 
-				if msgType == websocket.TextMessage {
-					// Check if it's a resize command
-					var resizeMsg ResizeMessage
-					if err := json.Unmarshal(msg, &resizeMsg); err == nil && resizeMsg.Type == "resize" {
-						// Set terminal size
-						setWinSize(ptmx, resizeMsg.Rows, resizeMsg.Cols)
-						continue
-					}
-
-					// Send keystrokes to the shell
-					if _, err := ptmx.Write(msg); err != nil {
-						log.Printf("PTY write error: %v", err)
-						return
-					}
+	// Port forward endpoints
+	app.Post("/api/forwards", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.PortForwardRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+
+		forwarded, err := agent.forwards.Forward(c.UserContext(), req)
+		if err != nil {
+			return apierror.RespondErr(c, 400, err)
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"forward": forwarded,
+		})
+	})
+
+	app.Get("/api/forwards", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"forwards": agent.forwards.List(),
+		})
+	})
+
+	app.Delete("/api/forwards/:id", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		id := c.Params("id")
+		if !agent.forwards.Remove(id) {
+			return apierror.Respond(c, 404, fmt.Sprintf("port forward '%s' not found", id))
+		}
+		return c.JSON(fiber.Map{"success": true})
+	})
+
+	// VM exec endpoint
+	app.Post("/api/vm/exec", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMExecRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+		if err := multipass.ValidateExecRequest(req); err != nil {
+			return apierror.RespondErr(c, 400, err)
+		}
+
+		return c.JSON(agent.runner.Exec(c.UserContext(), req, nil))
+	})
+
+	// VM exec endpoint streaming output lines as server-sent "output" events,
+	// ending with a "result" event. The command is stopped if the client
+	// goes away.
+	app.Post("/api/vm/exec/stream", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMExecRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+		if err := multipass.ValidateExecRequest(req); err != nil {
+			return apierror.RespondErr(c, 400, err)
+		}
+
+		ctx, cancel := context.WithCancel(c.UserContext())
+		return sse.Stream(c, func(w *sse.Writer) {
+			defer cancel()
+			go func() {
+				select {
+				case <-w.Done():
+					cancel()
+				case <-ctx.Done():
 				}
+			}()
+
+			output := multipass.NewLineWriter(func(line string) {
+				w.Event("output", fiber.Map{"line": line})
+			})
+			result := agent.runner.Exec(ctx, req, output)
+			w.Event("result", result)
+		})
+	})
+
+	// VM file transfer endpoint
+	app.Post("/api/vm/transfer", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		var req models.VMTransferRequest
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+		if req.Name == "" || req.Path == "" {
+			return apierror.Respond(c, 400, "name and path are required")
+		}
+
+		switch req.Direction {
+		case multipass.TransferUpload:
+			fileHeader, err := c.FormFile("file")
+			if err != nil {
+				return apierror.Respond(c, 400, "file is required for uploads")
 			}
-		}()
+			src, err := fileHeader.Open()
+			if err != nil {
+				return apierror.RespondErr(c, 500, err)
+			}
+			defer src.Close()
 
-		// Wait for either direction to close
-		<-done
+			destPath := multipass.ResolveUploadPath(req.Path, fileHeader.Filename)
+			if err := agent.runner.UploadFile(c.UserContext(), req.Name, destPath, src, nil); err != nil {
+				return apierror.RespondErr(c, 500, err)
+			}
+			return c.JSON(fiber.Map{
+				"success": true,
+				"message": fmt.Sprintf("Uploaded %s to %s", fileHeader.Filename, destPath),
+			})
+		case multipass.TransferDownload:
+			file, err := agent.runner.DownloadFile(c.UserContext(), req.Name, req.Path, nil)
+			if err != nil {
+				return apierror.RespondErr(c, 500, err)
+			}
+			c.Attachment(filepath.Base(req.Path))
+			return c.SendStream(file)
+		default:
+			return apierror.Respond(c, 400, "direction must be upload or download")
+		}
+	})
 
-		// Cleanup
-		cmd.Process.Kill()
-		cmd.Wait()
-		c.Close()
-	}))
+	// Job queue endpoints: long operations run in the background and the
+	// master polls for their result
+	app.Post("/api/jobs", agent.verifyAPIKey, agent.submitJob)
+	app.Get("/api/jobs/:id", agent.verifyAPIKey, func(c *fiber.Ctx) error {
+		job, ok := agent.jobs.Get(c.Params("id"))
+		if !ok {
+			return apierror.Respond(c, 404, fmt.Sprintf("Job '%s' not found", c.Params("id")))
+		}
+		return c.JSON(job)
+	})
+
+	// WebSocket endpoint for terminal connections, which the master opens
+	// with the agent's API key
+	app.Get("/ws", agent.verifyAPIKey, websocket.New(func(c *websocket.Conn) {
+		vmName := c.Query("vm_name")
+		logger.Info("Terminal connection requested", "vm", vmName)
+
+		if vmName == "" {
+			logger.Warn("Terminal connection refused: no VM name provided")
+			c.WriteMessage(websocket.BinaryMessage, []byte("Error: VM name is required\r\n"))
+			c.Close()
+			return
+		}
+
+		agent.terminals.ServeLocalTerminal(c, vmName)
+	}, wshandler.UpgradeConfig))
+
+	// Reload secrets kept in Vault or files on SIGHUP
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			agent.reloadSecrets(secretResolver)
+		}
+	}()
+
+	// Watch multipassd so heartbeats can report when it is down
+	agent.health.Start()
 
 	// Register with master if configured
-	if Config.MasterURL != "" {
+	if agent.Config.MasterURL != "" {
 		go func() {
 			time.Sleep(2 * time.Second) // Wait for server to start
-			registerWithMaster()
-			startHeartbeatLoop()
+			agent.registerWithMaster()
+			if agent.Config.Tunnel {
+				agent.startTunnel()
+			}
+			agent.startHeartbeatLoop()
+			agent.startStateWatcher()
 		}()
 	}
 
+	// On SIGTERM or SIGINT, sign off from the master so it stops sending
+	// work here, then let requests, jobs and terminal sessions finish
+	stopped := shutdown.OnSignal(*shutdownTimeout,
+		shutdown.Step{Name: "deregister", Run: agent.deregisterFromMaster},
+		shutdown.Step{Name: "http", Run: app.ShutdownWithContext},
+		shutdown.Step{Name: "jobs", Run: func(ctx context.Context) error {
+			if unfinished := agent.jobs.Drain(ctx); unfinished > 0 {
+				return fmt.Errorf("%d jobs still running", unfinished)
+			}
+			return nil
+		}},
+		shutdown.Step{Name: "terminals", Run: func(ctx context.Context) error {
+			agent.terminals.Shutdown(ctx)
+			return nil
+		}},
+	)
+
 	// Start server
-	log.Printf("Starting agent server on %s:%d", *host, *port)
-	log.Printf("Agent ID: %s", Config.AgentID)
-	log.Printf("API key configured: %t", Config.APIKey != "")
-	log.Printf("Master URL: %s", Config.MasterURL)
+	executeAllowed := strings.Join(commandPolicy.Allowed(), ", ")
+	if *disableExecute {
+		executeAllowed = "none (disabled)"
+	}
+	logger.Info("Starting agent server",
+		"address", fmt.Sprintf("%s://%s:%d", agent.Config.Scheme, *host, *port),
+		"agent_id", agent.Config.AgentID,
+		"api_key_configured", agent.currentAPIKey() != "",
+		"clients_allowed", allowlist.String(),
+		"execute_commands", executeAllowed,
+		"master_url", agent.Config.MasterURL)
+
+	if err := tlsConfig.Listen(app, fmt.Sprintf("%s:%d", *host, *port)); err != nil {
+		logging.Fatal(logger, "Failed to start server", "error", err)
+	}
+	<-stopped
+	agent.health.Stop()
+	flush, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tracer.Flush(flush)
+	logger.Info("Agent stopped")
+}
 
-	if err := app.Listen(fmt.Sprintf("%s:%d", *host, *port)); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+// parseTags parses comma separated key=value pairs
+func parseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, tagValue, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("tag %q is not key=value", pair)
+		}
+		tags[strings.TrimSpace(key)] = strings.TrimSpace(tagValue)
 	}
+	return tags, nil
 }
 
-// setWinSize sets the terminal window size
-func setWinSize(ptmx *os.File, rows, cols uint16) {
-	ws := &struct {
-		Row uint16
-		Col uint16
-		X   uint16
-		Y   uint16
-	}{
-		Row: rows,
-		Col: cols,
+// setMasterHeaders adds this agent's API key and the master's registration
+// token to a request to the master
+func (a *Agent) setMasterHeaders(req *http.Request) {
+	if key := a.currentAPIKey(); key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	if token := a.Config.RegistrationToken.Value(); token != "" {
+		req.Header.Set("X-Registration-Token", token)
 	}
-	syscall.Syscall(syscall.SYS_IOCTL, ptmx.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(ws)))
 }
 
 // registerWithMaster registers this agent with the master server
-func registerWithMaster() {
-	if Config.MasterURL == "" {
-		log.Println("Master URL not configured, skipping registration")
+func (a *Agent) registerWithMaster() {
+	if a.Config.MasterURL == "" {
+		logger.Info("Master URL not configured, skipping registration")
 		return
 	}
 
 	hostname, err := os.Hostname()
 	if err != nil {
-		log.Printf("Failed to get hostname: %v", err)
+		logger.Error("Failed to get hostname", "error", err)
 		hostname = "unknown"
 	}
 
@@ -450,106 +1283,319 @@ func registerWithMaster() {
 		localIP = localAddr.IP.String()
 	}
 
-	apiURL := fmt.Sprintf("http://%s:%d", localIP, Config.Port)
+	// A certificate is only valid for its name, so the master must use it
+	apiHost := localIP
+	if a.Config.ServerName != "" {
+		apiHost = a.Config.ServerName
+	}
+	apiURL := fmt.Sprintf("%s://%s", a.Config.Scheme, net.JoinHostPort(apiHost, strconv.Itoa(a.Config.Port)))
 
 	registration := models.AgentRegisterRequest{
-		AgentID:  Config.AgentID,
+		AgentID:  a.Config.AgentID,
 		Hostname: hostname,
 		APIURL:   apiURL,
+		Tags:     a.Config.Tags,
+		Tunnel:   a.Config.Tunnel,
+		Zone:     a.Config.Zone,
+		Jobs:     true,
 	}
 
-	if Config.APIKey != "" {
-		registration.APIKey = &Config.APIKey
+	if key := a.currentAPIKey(); key != "" {
+		registration.APIKey = &key
+	}
+	if version, err := a.runner.LocalVersion(context.Background()); err == nil {
+		registration.Version = version
 	}
 
 	body, err := json.Marshal(registration)
 	if err != nil {
-		log.Printf("Failed to marshal registration: %v", err)
+		logger.Error("Failed to marshal registration", "error", err)
 		return
 	}
 
-	req, err := http.NewRequest("POST", Config.MasterURL+"/api/agent/register", bytes.NewBuffer(body))
+	req, err := http.NewRequest("POST", a.Config.MasterURL+"/api/agent/register", bytes.NewBuffer(body))
 	if err != nil {
-		log.Printf("Failed to create request: %v", err)
+		logger.Error("Failed to create request", "error", err)
 		return
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	if Config.APIKey != "" {
-		req.Header.Set("X-API-Key", Config.APIKey)
-	}
+	a.setMasterHeaders(req)
 
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Error registering with master: %v", err)
+		logger.Error("Error registering with master", "error", err)
 		return
 	}
 	defer resp.Body.Close()
-	io.Copy(io.Discard, resp.Body)
 
-	if resp.StatusCode == 200 {
-		log.Printf("Successfully registered with master at %s", Config.MasterURL)
+	var result struct {
+		Agent models.AgentInfo `json:"agent"`
+	}
+	if resp.StatusCode == 200 && json.NewDecoder(resp.Body).Decode(&result) == nil && result.Agent.Status == "pending" {
+		logger.Info("Registered with master; waiting for an admin to approve this agent", "master_url", a.Config.MasterURL)
+	} else if resp.StatusCode == 200 {
+		logger.Info("Registered with master", "master_url", a.Config.MasterURL)
+	} else if resp.StatusCode == http.StatusForbidden {
+		logger.Error("Master rejected this agent", "master_url", a.Config.MasterURL)
 	} else {
-		log.Printf("Failed to register with master, status code: %d", resp.StatusCode)
+		logger.Error("Failed to register with master", "status", resp.StatusCode)
 	}
 }
 
+// deregisterFromMaster tells the master this agent is shutting down, so it
+// is marked offline at once rather than once its heartbeats stop
+func (a *Agent) deregisterFromMaster(ctx context.Context) error {
+	if a.Config.MasterURL == "" {
+		return nil
+	}
+	a.stopping.Store(true)
+
+	body, err := json.Marshal(models.AgentDeregisterRequest{AgentID: a.Config.AgentID})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.Config.MasterURL+"/api/agent/deregister", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	a.setMasterHeaders(req)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("master answered with status %d", resp.StatusCode)
+	}
+	logger.Info("Signed off from master", "master_url", a.Config.MasterURL)
+	return nil
+}
+
 // sendHeartbeat sends heartbeat to master server
-func sendHeartbeat() {
-	if Config.MasterURL == "" {
+func (a *Agent) sendHeartbeat() {
+	if a.Config.MasterURL == "" || a.stopping.Load() {
 		return
 	}
 
-	// Get VM count
-	vmList := executor.ListVMs()
+	// Get VM count, and the listing itself unless disabled
 	vmCount := 0
-	if list, ok := vmList["list"].([]interface{}); ok {
-		vmCount = len(list)
+	var vms []models.VMInfoExtended
+	if list, err := a.executor.ListVMs(context.Background()); err == nil {
+		vmCount = len(list.VMs)
+		if a.Config.HeartbeatVMs {
+			vms = a.withUsage(context.Background(), list.VMs)
+		}
+	}
+
+	// The agent still answers while multipassd is down, but the master should
+	// not send it VM work
+	health := a.health.Health()
+	status := "online"
+	if health.Status == multipass.HealthDegraded || health.Status == multipass.HealthUnavailable {
+		status = "degraded"
 	}
 
 	heartbeat := models.AgentHeartbeat{
-		AgentID:   Config.AgentID,
+		AgentID:   a.Config.AgentID,
 		Timestamp: time.Now(),
-		Status:    "online",
+		Status:    status,
 		VMCount:   vmCount,
+		VMs:       vms,
+		Health:    &health,
+	}
+	if version, err := a.runner.LocalVersion(context.Background()); err == nil {
+		heartbeat.Version = version
+	}
+	if resources, err := multipass.HostResources(context.Background()); err == nil {
+		heartbeat.Resources = resources
+	} else {
+		logger.Error("Failed to read host resources", "error", err)
 	}
 
-	body, err := json.Marshal(heartbeat)
-	if err != nil {
-		log.Printf("Failed to marshal heartbeat: %v", err)
+	// Listings can be large, so heartbeats are sent gzip-compressed
+	var body bytes.Buffer
+	compressor := gzip.NewWriter(&body)
+	if err := json.NewEncoder(compressor).Encode(heartbeat); err != nil {
+		logger.Error("Failed to marshal heartbeat", "error", err)
+		return
+	}
+	if err := compressor.Close(); err != nil {
+		logger.Error("Failed to compress heartbeat", "error", err)
 		return
 	}
 
-	req, err := http.NewRequest("POST", Config.MasterURL+"/api/agent/heartbeat", bytes.NewBuffer(body))
+	req, err := http.NewRequest("POST", a.Config.MasterURL+"/api/agent/heartbeat", &body)
 	if err != nil {
-		log.Printf("Failed to create heartbeat request: %v", err)
+		logger.Error("Failed to create heartbeat request", "error", err)
 		return
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	if Config.APIKey != "" {
-		req.Header.Set("X-API-Key", Config.APIKey)
-	}
+	req.Header.Set("Content-Encoding", "gzip")
+	a.setMasterHeaders(req)
 
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Error sending heartbeat: %v", err)
+		a.heartbeats.Inc("failed")
+		logger.Error("Error sending heartbeat", "error", err)
 		return
 	}
 	defer resp.Body.Close()
 	io.Copy(io.Discard, resp.Body)
 
-	log.Printf("Heartbeat sent successfully")
+	if resp.StatusCode == http.StatusNotFound {
+		// The master no longer knows this agent, such as after it was
+		// unregistered; register again
+		a.heartbeats.Inc("rejected")
+		logger.Warn("Master does not know this agent; registering again")
+		a.registerWithMaster()
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		a.heartbeats.Inc("rejected")
+		logger.Warn("Master rejected heartbeat", "status", resp.StatusCode)
+		return
+	}
+	a.heartbeats.Inc("sent")
+	logger.Debug("Heartbeat sent")
+}
+
+// withUsage adds the CPU, load, disk and memory usage of each VM to a listing.
+// The listing is returned unchanged if usage cannot be read.
+func (a *Agent) withUsage(ctx context.Context, vms []models.VMInfoExtended) []models.VMInfoExtended {
+	usage, err := a.runner.ListUsage(ctx)
+	if err != nil {
+		return vms
+	}
+	for i, vm := range vms {
+		if vmUsage, ok := usage[vm.Name]; ok {
+			vms[i].CPUCount = vmUsage.CPUCount
+			vms[i].Load = vmUsage.Load
+			vms[i].DiskUsage = vmUsage.DiskUsage
+			vms[i].MemoryUsage = vmUsage.MemoryUsage
+		}
+	}
+	return vms
+}
+
+// localURL is the URL the agent reaches its own API at
+func (a *Agent) localURL(host string, port int) string {
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return fmt.Sprintf("%s://%s", a.Config.Scheme, net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// startTunnel keeps a tunnel to the master open, reopening it with backoff
+// whenever it drops, so the master can reach this agent without connecting
+// to it
+func (a *Agent) startTunnel() {
+	go func() {
+		backoff := time.Second
+		for {
+			opened := time.Now()
+			err := a.openTunnel()
+			logger.Warn("Tunnel to master closed", "error", err)
+			if time.Since(opened) > time.Minute {
+				backoff = time.Second
+			}
+			time.Sleep(backoff)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+	}()
+}
+
+// openTunnel opens a tunnel to the master and serves it until it closes
+func (a *Agent) openTunnel() error {
+	tunnelURL := "ws" + strings.TrimPrefix(a.Config.MasterURL, "http") +
+		"/api/agent/tunnel?agent_id=" + url.QueryEscape(a.Config.AgentID)
+	header := http.Header{}
+	if key := a.currentAPIKey(); key != "" {
+		header.Set("X-API-Key", key)
+	}
+	if token := a.Config.RegistrationToken.Value(); token != "" {
+		header.Set("X-Registration-Token", token)
+	}
+
+	conn, resp, err := gorillaws.DefaultDialer.Dial(tunnelURL, header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%v (status %d)", err, resp.StatusCode)
+		}
+		return err
+	}
+	defer conn.Close()
+
+	logger.Info("Opened tunnel to master", "master_url", a.Config.MasterURL)
+	return tunnel.Serve(conn, a.Config.LocalURL, a.Config.LocalTLS)
 }
 
 // startHeartbeatLoop starts the periodic heartbeat loop
-func startHeartbeatLoop() {
-	ticker := time.NewTicker(time.Duration(Config.HeartbeatInterval) * time.Second)
+func (a *Agent) startHeartbeatLoop() {
+	ticker := time.NewTicker(time.Duration(a.Config.HeartbeatInterval) * time.Second)
 	go func() {
 		for range ticker.C {
-			sendHeartbeat()
+			a.sendHeartbeat()
 		}
 	}()
 }
+
+// startStateWatcher pushes VM state changes to the master as the agent sees
+// them, so the master's inventory stays current without polling
+func (a *Agent) startStateWatcher() {
+	if a.Config.WatchInterval <= 0 {
+		return
+	}
+	interval := time.Duration(a.Config.WatchInterval) * time.Second
+	multipass.NewStateWatcher(a.runner, interval, a.sendVMReport).Start()
+}
+
+// sendVMReport posts the agent's VM listing and the state changes that led to
+// it to the master
+func (a *Agent) sendVMReport(list *models.VMList, changes []models.VMStateChange) error {
+	if a.stopping.Load() {
+		return nil
+	}
+	report := models.AgentVMReport{
+		AgentID: a.Config.AgentID,
+		Changes: changes,
+		VMs:     list.VMs,
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", a.Config.MasterURL+"/api/agent/vm-state", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	a.setMasterHeaders(req)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("master answered with status %d", resp.StatusCode)
+	}
+	if len(changes) > 0 {
+		logger.Debug("Pushed VM state changes to master", "changes", len(changes))
+	}
+	return nil
+}
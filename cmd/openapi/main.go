@@ -0,0 +1,53 @@
+// Command openapi writes the master's OpenAPI document and generates the Go
+// client in pkg/client from the same operations:
+//
+//	openapi -spec docs/openapi.json
+//	openapi -client pkg/client/client_gen.go
+//
+// Run `make generate` after changing routes or models.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/prashah/batwa/pkg/openapi"
+	"github.com/prashah/batwa/pkg/routes"
+)
+
+func main() {
+	specPath := flag.String("spec", "", "write the OpenAPI document to this file")
+	clientPath := flag.String("client", "", "write the generated Go client to this file")
+	flag.Parse()
+	if *specPath == "" && *clientPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: openapi [-spec file] [-client file]")
+		os.Exit(2)
+	}
+
+	if *specPath != "" {
+		spec, err := json.MarshalIndent(routes.Spec(), "", "  ")
+		if err != nil {
+			fatal(err.Error())
+		}
+		if err := os.WriteFile(*specPath, append(spec, '\n'), 0644); err != nil {
+			fatal(err.Error())
+		}
+	}
+	if *clientPath != "" {
+		source, err := openapi.GenerateClient(routes.Operations())
+		if err != nil {
+			fatal(err.Error())
+		}
+		if err := os.WriteFile(*clientPath, source, 0644); err != nil {
+			fatal(err.Error())
+		}
+	}
+}
+
+// fatal reports an error and exits
+func fatal(message string) {
+	fmt.Fprintln(os.Stderr, "openapi:", message)
+	os.Exit(1)
+}
@@ -0,0 +1,53 @@
+// Command secret encrypts secrets for storage at rest with the key in
+// SECRETS_KEY_FILE, so the master and agents can load them from file:
+// references, and decrypts them again:
+//
+//	secret seal < plaintext > /etc/batwa/registration-token
+//	secret open < /etc/batwa/registration-token
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/secrets"
+)
+
+func main() {
+	if len(os.Args) != 2 || (os.Args[1] != "seal" && os.Args[1] != "open") {
+		fmt.Fprintln(os.Stderr, "usage: secret seal|open < input > output")
+		fmt.Fprintln(os.Stderr, "The key is read from SECRETS_KEY_FILE; make one with: openssl rand -base64 32")
+		os.Exit(2)
+	}
+	path := os.Getenv("SECRETS_KEY_FILE")
+	if path == "" {
+		fatal("SECRETS_KEY_FILE is not set")
+	}
+	cipher, err := secrets.LoadCipher(path)
+	if err != nil {
+		fatal(err.Error())
+	}
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	var output string
+	if os.Args[1] == "seal" {
+		output, err = cipher.Seal(strings.TrimSpace(string(input)))
+	} else {
+		output, err = cipher.Open(strings.TrimSpace(string(input)))
+	}
+	if err != nil {
+		fatal(err.Error())
+	}
+	fmt.Println(output)
+}
+
+// fatal reports an error and exits
+func fatal(message string) {
+	fmt.Fprintln(os.Stderr, "secret:", message)
+	os.Exit(1)
+}
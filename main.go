@@ -1,78 +1,448 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/websocket/v2"
+	"github.com/prashah/batwa/pkg/accesslog"
 	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/apierror"
+	"github.com/prashah/batwa/pkg/apiversion"
+	"github.com/prashah/batwa/pkg/artifacts"
 	"github.com/prashah/batwa/pkg/auth"
+	"github.com/prashah/batwa/pkg/backup"
+	"github.com/prashah/batwa/pkg/bus"
+	"github.com/prashah/batwa/pkg/cluster"
+	"github.com/prashah/batwa/pkg/communication"
+	"github.com/prashah/batwa/pkg/config"
+	"github.com/prashah/batwa/pkg/defaults"
+	"github.com/prashah/batwa/pkg/digest"
+	"github.com/prashah/batwa/pkg/events"
+	"github.com/prashah/batwa/pkg/executor"
+	"github.com/prashah/batwa/pkg/expiry"
+	"github.com/prashah/batwa/pkg/forward"
+	"github.com/prashah/batwa/pkg/inventory"
+	"github.com/prashah/batwa/pkg/locks"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/maintenance"
+	"github.com/prashah/batwa/pkg/metadata"
+	"github.com/prashah/batwa/pkg/metrics"
+	"github.com/prashah/batwa/pkg/middleware"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/multipass"
+	"github.com/prashah/batwa/pkg/notifications"
+	"github.com/prashah/batwa/pkg/oidc"
+	"github.com/prashah/batwa/pkg/policy"
+	"github.com/prashah/batwa/pkg/quotas"
+	"github.com/prashah/batwa/pkg/requestid"
+	"github.com/prashah/batwa/pkg/retention"
 	"github.com/prashah/batwa/pkg/routes"
+	"github.com/prashah/batwa/pkg/scheduler"
+	"github.com/prashah/batwa/pkg/schedules"
+	"github.com/prashah/batwa/pkg/secrets"
+	"github.com/prashah/batwa/pkg/shutdown"
+	"github.com/prashah/batwa/pkg/stacks"
+	"github.com/prashah/batwa/pkg/storage"
+	"github.com/prashah/batwa/pkg/tasks"
+	"github.com/prashah/batwa/pkg/templates"
+	"github.com/prashah/batwa/pkg/tlsconfig"
+	"github.com/prashah/batwa/pkg/tokens"
+	"github.com/prashah/batwa/pkg/tracing"
+	"github.com/prashah/batwa/pkg/tunnel"
 	wshandler "github.com/prashah/batwa/pkg/websocket"
 )
 
+var logger = logging.For("main")
+
 func main() {
+	// Load the configuration file into the environment before anything reads
+	// it, flag defaults included
+	cfg, err := config.Load(config.Path())
+	if err != nil {
+		logging.Fatal(logger, "Invalid configuration", "error", err)
+	}
+
+	// Configure logging before anything else logs
+	if err := logging.ConfigureFromEnv(); err != nil {
+		logging.Fatal(logger, "Invalid logging configuration", "error", err)
+	}
+	if cfg.Path != "" {
+		logger.Info("Loaded configuration", "file", cfg.Path, "settings", len(cfg.FromFile), "overridden_by_env", cfg.Overridden)
+	}
+	for _, warning := range cfg.Warnings {
+		logger.Warn(warning)
+	}
+
+	// Parse command-line flags
+	tlsFlags := tlsconfig.RegisterFlags("data/acme")
+	restorePath := flag.String("restore", "", "Restore a backup archive from POST /api/v1/admin/backup into this fresh master, then exit")
+	flag.Parse()
+	tlsConfig, err := tlsFlags.Config()
+	if err != nil {
+		logging.Fatal(logger, "Invalid TLS configuration", "error", err)
+	}
+	shutdownTimeout, err := shutdown.TimeoutFromEnv()
+	if err != nil {
+		logging.Fatal(logger, "Invalid shutdown timeout", "error", err)
+	}
+
+	// Export traces over OTLP when an endpoint is configured
+	tracer, err := tracing.NewTracerFromEnv("batwa-master")
+	if err != nil {
+		logging.Fatal(logger, "Invalid tracing configuration", "error", err)
+	}
+	logger.Info("Tracing", "exporter", tracer.String())
+
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
-		AppName: "Multipass VM Manager",
+		AppName:           "Multipass VM Manager",
+		BodyLimit:         multipass.TransferBodyLimit(),
+		StreamRequestBody: true,
+		ErrorHandler:      apierror.Handler,
 	})
 
-	// Add CORS middleware
-	app.Use(cors.New(cors.Config{
-		AllowOrigins:     "*",
-		AllowCredentials: true,
-		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders:     "*",
-	}))
+	// Give every request an ID first, so even rejected ones can be traced
+	app.Use(requestid.New())
+
+	// Serve the unversioned /api paths by the current API version
+	app.Use(apiversion.Shim())
 
-	// Add logger middleware
-	app.Use(logger.New())
+	// Add CORS or same-origin middleware
+	corsConfig, err := middleware.CORSConfigFromEnv()
+	if err != nil {
+		logging.Fatal(logger, "Invalid CORS configuration", "error", err)
+	}
+	middleware.ApplyCORS(app, corsConfig)
+	logger.Info("CORS configured", "mode", corsConfig.Mode)
+
+	// Limit who may use the API and the agent endpoints
+	apiAllowlist, err := middleware.AllowlistFromEnv("API_ALLOWED_CIDRS")
+	if err != nil {
+		logging.Fatal(logger, "Invalid allowlist", "error", err)
+	}
+	agentAllowlist, err := middleware.AllowlistFromEnv("AGENT_ALLOWED_CIDRS")
+	if err != nil {
+		logging.Fatal(logger, "Invalid allowlist", "error", err)
+	}
+	logger.Info("Allowlists configured", "api", apiAllowlist.String(), "agents", agentAllowlist.String())
+
+	// Wire up the server's dependencies
+	eventLog, err := events.NewLogFromEnv()
+	if err != nil {
+		logging.Fatal(logger, "Failed to open event log", "error", err)
+	}
+	eventBus := bus.New()
+	eventBus.Subscribe("*", func(event models.Event) { eventLog.Append(event) })
+	secretResolver, err := secrets.NewResolverFromEnv()
+	if err != nil {
+		logging.Fatal(logger, "Failed to set up secrets", "error", err)
+	}
+	registrationToken, err := secretResolver.Getenv("AGENT_REGISTRATION_TOKEN")
+	if err != nil {
+		logging.Fatal(logger, "Failed to set up secrets", "error", err)
+	}
+	metricsToken, err := secretResolver.Getenv("METRICS_TOKEN")
+	if err != nil {
+		logging.Fatal(logger, "Failed to set up secrets", "error", err)
+	}
+	db, err := storage.OpenFromEnv()
+	if err != nil {
+		logging.Fatal(logger, "Failed to open the database", "error", err)
+	}
+	if db != nil {
+		defer db.Close()
+		logger.Info("Storage", "driver", db.Driver(), "database", db.String())
+	} else {
+		logger.Info("Storage", "driver", storage.DriverFiles)
+	}
+	replicas, err := cluster.NewFromEnv(db)
+	if err != nil {
+		logging.Fatal(logger, "Invalid cluster settings", "error", err)
+	}
+	metadataStore, err := metadata.NewStoreFromEnv(db)
+	if err != nil {
+		logging.Fatal(logger, "Failed to load VM metadata", "error", err)
+	}
+	accessLog, err := accesslog.NewStoreFromEnv(db)
+	if err != nil {
+		logging.Fatal(logger, "Failed to open the access log", "error", err)
+	}
+	authService, err := auth.NewServiceFromEnv(secretResolver, db)
+	if err != nil {
+		logging.Fatal(logger, "Failed to set up authentication", "error", err)
+	}
+	defer authService.Close()
+	registry, err := agents.NewAgentRegistryFromEnv()
+	if err != nil {
+		logging.Fatal(logger, "Invalid agent settings", "error", err)
+	}
+	registry.PublishTo(eventBus)
+	approvals, err := agents.NewApprovalsFromEnv(db)
+	if err != nil {
+		logging.Fatal(logger, "Failed to load agent approvals", "error", err)
+	}
+	registry.RequireApproval(approvals)
+	if replicas.Enabled() {
+		registry.ShareStore()
+	}
+	agentStore, err := agents.NewStoreFromEnv(secretResolver.Cipher(), db)
+	if err != nil {
+		logging.Fatal(logger, "Failed to restore registered agents", "error", err)
+	}
+	if err := registry.UseStore(agentStore); err != nil {
+		logging.Fatal(logger, "Failed to restore registered agents", "error", err)
+	}
+	communicator, err := communication.NewHTTPCommunicatorFromEnv(registry)
+	if err != nil {
+		logging.Fatal(logger, "Invalid agent settings", "error", err)
+	}
+	tunnels := tunnel.NewHub()
+	communicator.UseTunnels(tunnels)
+	inventoryCache := inventory.NewCacheFromEnv()
+	vmLocks := locks.NewVMLockManager()
+	notifier := notifications.NewNotifierFromEnv()
+	// Measure the multipass commands and terminal sessions on this host for
+	// /metrics
+	metricsRegistry := metrics.NewRegistry()
+	runner := multipass.NewRunner(metricsRegistry)
+	terminalSessions := wshandler.NewSessions(metricsRegistry)
+	forwards := forward.NewManagerFromEnv(runner)
+	executors := executor.NewExecutorFactory(registry, communicator, eventBus, inventoryCache, runner, forwards)
+	windows := maintenance.NewSchedulerFromEnv(registry, eventBus)
+	eventBus.Subscribe("agent.offline", windows.OfflineAlerts(authService.Admins, notifier))
+	eventBus.Subscribe("maintenance.upcoming", maintenance.RemindOwners(metadataStore, notifier))
+	defaultsStore, err := defaults.NewStoreFromEnv()
+	if err != nil {
+		logging.Fatal(logger, "Invalid VM defaults", "error", err)
+	}
+	eventBus.Subscribe("agent.unregistered", func(event models.Event) {
+		inventoryCache.Invalidate(event.AgentID)
+		defaultsStore.ForgetAgent(event.AgentID)
+	})
+	tokenStore, err := tokens.NewStoreFromEnv(db)
+	if err != nil {
+		logging.Fatal(logger, "Failed to load API tokens", "error", err)
+	}
+	eventBus.Subscribe("user.deleted", func(event models.Event) {
+		tokenStore.DeleteUser(event.Data["username"])
+	})
+	oidcProvider, err := oidc.NewProviderFromEnv(secretResolver)
+	if err != nil {
+		logging.Fatal(logger, "Failed to configure OIDC", "error", err)
+	}
+	templateStore, err := templates.NewStoreFromEnv(db)
+	if err != nil {
+		logging.Fatal(logger, "Failed to load templates", "error", err)
+	}
+	quotaStore, err := quotas.NewStoreFromEnv(db)
+	if err != nil {
+		logging.Fatal(logger, "Failed to load quotas", "error", err)
+	}
+	taskStore, err := tasks.NewStoreFromEnv(db)
+	if err != nil {
+		logging.Fatal(logger, "Failed to load tasks", "error", err)
+	}
+	stackStore, err := stacks.NewStoreFromEnv(db)
+	if err != nil {
+		logging.Fatal(logger, "Failed to load stacks", "error", err)
+	}
+	mountPolicy, err := multipass.NewMountPolicyFromEnv()
+	if err != nil {
+		logging.Fatal(logger, "Invalid MOUNT_ROOTS", "error", err)
+	}
+	backups := &backup.Stores{
+		Auth:      authService,
+		Registry:  registry,
+		Approvals: approvals,
+		Templates: templateStore,
+		Metadata:  metadataStore,
+		Tasks:     taskStore,
+		Cipher:    secretResolver.Cipher(),
+	}
+	if *restorePath != "" {
+		if _, err := backups.RestoreFile(*restorePath); err != nil {
+			logging.Fatal(logger, "Failed to restore backup", "file", *restorePath, "error", err)
+		}
+		logger.Info("Restored backup; start the master again without --restore", "file", *restorePath)
+		return
+	}
+	eventBus.Start()
+	server := &routes.Server{
+		Auth:         authService,
+		Registry:     registry,
+		Communicator: communicator,
+		Executors:    executors,
+		Scheduler:    scheduler.New(registry, windows),
+		Maintenance:  windows,
+		Schedules:    schedules.NewSchedulerFromEnv(registry, executors, windows, authService, metadataStore, vmLocks),
+		Stacks:       stackStore,
+		Templates:    templateStore,
+		Defaults:     defaultsStore,
+		Quotas:       quotaStore,
+		Digest:       digest.NewReporterFromEnv(executors, authService, metadataStore, notifier),
+		Bus:          eventBus,
+		Events:       eventLog,
+		Tunnels:      tunnels,
+		History:      retention.NewHistoryFromEnv(),
+		Tasks:        taskStore,
+		Tokens:       tokenStore,
+		Metadata:     metadataStore,
+		Inventory:    inventoryCache,
+		Locks:        vmLocks,
+		Notifier:     notifier,
+		Artifacts:    artifacts.NewStoreFromEnv(),
+		AccessLog:    accessLog,
+		Health:       multipass.NewHealthMonitor(runner),
+		Mounts:       mountPolicy,
+		Policy:       policy.NewAuthorizerFromEnv(authService, metadataStore),
+		Cluster:      replicas,
+		Backups:      backups,
+		OIDC:         oidcProvider,
+		Secrets:      secretResolver,
+
+		APIAllowlist:   apiAllowlist,
+		AgentAllowlist: agentAllowlist,
+
+		RegistrationToken: registrationToken,
+	}
+	if server.RegistrationToken == nil {
+		logger.Warn("AGENT_REGISTRATION_TOKEN is not set; any host can register as an agent")
+	}
+
+	reaper := expiry.NewReaper(registry, executors, windows, eventBus, metadataStore, vmLocks, notifier)
+	collector := retention.NewCollectorFromEnv(registry, server.History, eventBus, inventoryCache, metadataStore)
+	server.Digest.RegisterCollector(reaper.CollectExpiring)
+
+	// Log each request with its ID, trace and outcome
+	app.Use(logging.Middleware())
+
+	// Persist attributed access logs for API and websocket requests. The
+	// replays running asynchronous tasks were logged and counted when they
+	// were answered 202, so neither is done again for them.
+	app.Use(routes.UnlessTaskReplay(accesslog.New(accessLog, authService)))
+	accessLog.StartRetention()
+
+	// Count and time requests, and export the fleet's state, for /metrics.
+	// This runs inside the access log so it sees the router's errors first.
+	app.Use(routes.UnlessTaskReplay(metrics.Middleware(metricsRegistry)))
+	registry.RegisterMetrics(metricsRegistry)
+	inventoryCache.RegisterMetrics(metricsRegistry)
+
+	// Serve each request in a span, joining the caller's trace if it sent one
+	app.Use(tracing.Middleware(tracer))
+
+	// Authenticate API requests carrying a bearer token
+	app.Use(tokens.New(tokenStore, authService))
+
+	// Disable the local executor if multipass is not installed on this host
+	if executors.DetectLocal() {
+		server.Health.Start()
+	}
 
 	// Mount static files
+	apiAllowed := apiAllowlist.Handler()
+	app.Use("/static", apiAllowed)
 	app.Static("/static", "./static")
 
 	// Setup API routes
-	routes.SetupRoutes(app)
+	server.SetupRoutes(app)
 
 	// Page routes
-	app.Get("/", func(c *fiber.Ctx) error {
-		sessionID := c.Cookies("session_id")
-		if !auth.CheckAuth(sessionID) {
+	app.Get("/", apiAllowed, func(c *fiber.Ctx) error {
+		sessionID := auth.SessionID(c)
+		session, exists := authService.GetSession(sessionID)
+		if !exists || authService.MustChangePassword(session.Username) {
 			return c.Redirect("/login")
 		}
 
 		return c.SendFile("./templates/index.html")
 	})
 
-	app.Get("/login", func(c *fiber.Ctx) error {
+	app.Get("/login", apiAllowed, func(c *fiber.Ctx) error {
 		return c.SendFile("./templates/login.html")
 	})
 
-	// WebSocket route
-	app.Get("/ws", websocket.New(func(c *websocket.Conn) {
-		wshandler.HandleTerminalConnection(c)
-	}))
+	// Prometheus metrics, for scrapers in the API allowlist
+	app.Get("/metrics", apiAllowed, metrics.Handler(metricsRegistry, metricsToken))
+
+	// WebSocket route, for users allowed a terminal on the VM
+	terminals := wshandler.NewTerminalHandler(registry, executors, defaultsStore, tunnels, terminalSessions)
+	app.Get("/ws", apiAllowed, server.AuthorizeTerminal, websocket.New(func(c *websocket.Conn) {
+		terminals.HandleTerminalConnection(c)
+	}, wshandler.UpgradeConfig))
+
+	// Reload secrets kept in Vault or files on SIGHUP
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			secretResolver.Reload()
+		}
+	}()
 
-	// Start heartbeat monitor
-	agents.GlobalRegistry.StartHeartbeatMonitor()
+	// Start the jobs that run once for the fleet: at once when the master
+	// runs alone, or while it leads a cluster of replicas, which meanwhile
+	// pick up the agents, users, API tokens and stacks the others change
+	replicas.Lead(
+		cluster.Job{Name: "heartbeat monitor", Start: registry.StartHeartbeatMonitor, Stop: registry.StopHeartbeatMonitor},
+		cluster.Job{Name: "maintenance reminders", Start: windows.StartReminders, Stop: windows.StopReminders},
+		cluster.Job{Name: "digest reports", Start: server.Digest.Start, Stop: server.Digest.Stop},
+		cluster.Job{Name: "VM expiry", Start: reaper.Start, Stop: reaper.Stop},
+		cluster.Job{Name: "power schedules", Start: server.Schedules.Start, Stop: server.Schedules.Stop},
+		cluster.Job{Name: "stale agent collector", Start: collector.Start, Stop: collector.Stop},
+	)
+	if replicas.Enabled() {
+		replicas.Sync("agents", registry.Sync)
+		replicas.Sync("users", authService.Reload)
+		replicas.Sync("API tokens", tokenStore.Reload)
+		replicas.Sync("stacks", stackStore.Reload)
+	}
+	replicas.Start()
 
 	// Cleanup on exit
 	defer func() {
-		log.Println("Shutting down...")
-		agents.GlobalRegistry.StopHeartbeatMonitor()
+		logger.Info("Shutting down")
+		replicas.Stop()
+		server.Health.Stop()
+		accessLog.StopRetention()
+		eventBus.Stop()
+		eventLog.Close()
+		flush, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		tracer.Flush(flush)
 	}()
 
-	// Start server
+	// On SIGTERM or SIGINT, stop accepting connections and let requests,
+	// tasks and terminal sessions finish before the cleanup above runs
+	stopped := shutdown.OnSignal(shutdownTimeout,
+		shutdown.Step{Name: "http", Run: app.ShutdownWithContext},
+		shutdown.Step{Name: "tasks", Run: func(ctx context.Context) error {
+			server.Tasks.Shutdown(ctx)
+			return nil
+		}},
+		shutdown.Step{Name: "terminals", Run: func(ctx context.Context) error {
+			terminalSessions.Shutdown(ctx)
+			return nil
+		}},
+	)
+
+	// Start server on HOST (default: every address) and PORT
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8000"
 	}
+	address := net.JoinHostPort(os.Getenv("HOST"), port)
 
-	log.Printf("Starting server on port %s", port)
-	if err := app.Listen(":" + port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	logger.Info("Starting server", "address", address, "scheme", tlsConfig.Scheme())
+	if err := tlsConfig.Listen(app, address); err != nil {
+		logging.Fatal(logger, "Failed to start server", "error", err)
 	}
+	<-stopped
 }
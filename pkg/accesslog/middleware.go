@@ -0,0 +1,104 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prashah/batwa/pkg/auth"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/requestid"
+)
+
+// LocalsToken is the fiber.Ctx local under which token-based authentication
+// records the name of the API token or service account that made the request
+const LocalsToken = "access_token"
+
+// LocalsUser is the fiber.Ctx local under which authentication that leaves no
+// session, such as a terminal ticket, records the user making the request
+const LocalsUser = "access_user"
+
+// target is the part of a JSON request body that identifies the VM and agent
+type target struct {
+	Name    string  `json:"name"`
+	AgentID *string `json:"agent_id"`
+}
+
+// New returns middleware that records API and websocket requests in store,
+// attributing them to the users of authService's sessions
+func New(store *Store, authService *auth.Service) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		path := c.Path()
+		if !strings.HasPrefix(path, "/api/") && path != "/ws" {
+			return c.Next()
+		}
+
+		// Look the user up before the handler runs so logouts are attributed
+		user := ""
+		if session, exists := authService.GetSession(auth.SessionID(c)); exists {
+			user = session.Username
+		}
+
+		start := time.Now()
+		err := c.Next()
+		if err != nil {
+			// Let the error handler set the status before it is recorded
+			if handlerErr := c.App().ErrorHandler(c, err); handlerErr != nil {
+				c.Status(fiber.StatusInternalServerError)
+			}
+			err = nil
+		}
+
+		// Token authentication runs after this middleware and sets up the
+		// request's session itself
+		if user == "" {
+			if session, exists := authService.GetSession(auth.SessionID(c)); exists {
+				user = session.Username
+			} else if ticketUser, ok := c.Locals(LocalsUser).(string); ok {
+				user = ticketUser
+			}
+		}
+
+		entry := &models.AccessLogEntry{
+			Time:      start,
+			User:      user,
+			Method:    c.Method(),
+			Route:     c.Route().Path,
+			Path:      path,
+			Status:    c.Response().StatusCode(),
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			IP:        c.IP(),
+			RequestID: requestid.Get(c),
+		}
+
+		if token, ok := c.Locals(LocalsToken).(string); ok {
+			entry.Token = token
+		}
+
+		entry.AgentID, entry.VMName = RequestTarget(c)
+		store.Record(entry)
+		return err
+	}
+}
+
+// RequestTarget finds the agent and VM a request addressed, from route params,
+// the query string or a JSON body
+func RequestTarget(c *fiber.Ctx) (agentID, vmName string) {
+	agentID = c.Params("agent_id", c.Query("agent_id"))
+	vmName = c.Params("vm_name", c.Query("vm_name"))
+
+	// Only JSON bodies are inspected; uploads may be far too large to buffer
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		var body target
+		if json.Unmarshal(c.Body(), &body) == nil {
+			if agentID == "" && body.AgentID != nil {
+				agentID = *body.AgentID
+			}
+			if vmName == "" {
+				vmName = body.Name
+			}
+		}
+	}
+	return agentID, vmName
+}
@@ -0,0 +1,316 @@
+package accesslog
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+// Repository persists access log entries
+type Repository interface {
+	Append(entry *models.AccessLogEntry) error
+	// Search returns entries matching the query, newest first
+	Search(q Query) ([]*models.AccessLogEntry, error)
+	// Prune deletes entries recorded before cutoff and returns how many
+	Prune(cutoff time.Time) (int, error)
+	Close() error
+}
+
+// FileRepository appends access log entries to a JSON lines file
+type FileRepository struct {
+	path  string
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// NewFileRepository writes to path. The file is opened lazily on the first
+// write.
+func NewFileRepository(path string) *FileRepository {
+	return &FileRepository{path: path}
+}
+
+// open opens the log file for appending; the caller must hold the mutex
+func (r *FileRepository) open() error {
+	if r.file != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	return nil
+}
+
+// Append appends an entry to the file
+func (r *FileRepository) Append(entry *models.AccessLogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.open(); err != nil {
+		return err
+	}
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+// Search scans the file for entries matching the query
+func (r *FileRepository) Search(q Query) ([]*models.AccessLogEntry, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entries := []*models.AccessLogEntry{}
+	err := r.scan(func(entry *models.AccessLogEntry) {
+		if q.matches(entry) {
+			entries = append(entries, entry)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The file is in chronological order
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+	return entries, nil
+}
+
+// scan calls fn for every readable entry in the log; the caller must hold the mutex
+func (r *FileRepository) scan(fn func(entry *models.AccessLogEntry)) error {
+	file, err := os.Open(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry models.AccessLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		fn(&entry)
+	}
+	return scanner.Err()
+}
+
+// Prune rewrites the file without entries recorded before cutoff
+func (r *FileRepository) Prune(cutoff time.Time) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	kept := []*models.AccessLogEntry{}
+	removed := 0
+	err := r.scan(func(entry *models.AccessLogEntry) {
+		if entry.Time.Before(cutoff) {
+			removed++
+			return
+		}
+		kept = append(kept, entry)
+	})
+	if err != nil || removed == 0 {
+		return 0, err
+	}
+
+	tmpPath := r.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range kept {
+		if err := encoder.Encode(entry); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return 0, err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	if err := os.Rename(tmpPath, r.path); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// Close closes the file until the next write
+func (r *FileRepository) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// DatabaseRepository keeps access log entries in the master's database, with
+// the fields searched on in columns of their own
+type DatabaseRepository struct {
+	db *storage.DB
+}
+
+// NewDatabaseRepository keeps access log entries in db
+func NewDatabaseRepository(db *storage.DB) *DatabaseRepository {
+	return &DatabaseRepository{db: db}
+}
+
+// execer runs statements on the database or in a transaction
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// insert inserts an entry
+func insert(db execer, entry *models.AccessLogEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO audit_log (time, username, token, agent_id, vm_name, route, status, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.Time.UnixNano(), entry.User, entry.Token, entry.AgentID, entry.VMName, entry.Route, entry.Status, string(data))
+	return err
+}
+
+// Append inserts an entry
+func (r *DatabaseRepository) Append(entry *models.AccessLogEntry) error {
+	return insert(r.db, entry)
+}
+
+// Search queries the entries matching the query
+func (r *DatabaseRepository) Search(q Query) ([]*models.AccessLogEntry, error) {
+	var conditions []string
+	var args []any
+	where := func(condition string, arg any) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+	if q.User != "" {
+		where("username = ?", q.User)
+	}
+	if q.Token != "" {
+		where("token = ?", q.Token)
+	}
+	if q.AgentID != "" {
+		where("agent_id = ?", q.AgentID)
+	}
+	if q.VMName != "" {
+		where("vm_name = ?", q.VMName)
+	}
+	if q.Route != "" {
+		where("route = ?", q.Route)
+	}
+	if q.Status != 0 {
+		where("status = ?", q.Status)
+	}
+	if !q.Since.IsZero() {
+		where("time >= ?", q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where("time <= ?", q.Until.UnixNano())
+	}
+
+	query := `SELECT data FROM audit_log`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+	query += ` ORDER BY time DESC, id DESC`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []*models.AccessLogEntry{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var entry models.AccessLogEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+// Prune deletes entries recorded before cutoff
+func (r *DatabaseRepository) Prune(cutoff time.Time) (int, error) {
+	result, err := r.db.Exec(`DELETE FROM audit_log WHERE time < ?`, cutoff.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+// Close does nothing; the database is shared and closed by its owner
+func (r *DatabaseRepository) Close() error {
+	return nil
+}
+
+// importFile copies the entries of a log file into the database in one
+// transaction
+func (r *DatabaseRepository) importFile(file *FileRepository) (int, error) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+
+	imported := 0
+	err := r.db.Transaction(func(tx *storage.Tx) error {
+		var failed error
+		err := file.scan(func(entry *models.AccessLogEntry) {
+			if failed == nil {
+				failed = insert(tx, entry)
+				imported++
+			}
+		})
+		if failed != nil {
+			return failed
+		}
+		return err
+	})
+	return imported, err
+}
@@ -0,0 +1,143 @@
+package accesslog
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+var logger = logging.For("accesslog")
+
+// Query filters access log entries. Zero values match everything.
+type Query struct {
+	User    string
+	Token   string
+	AgentID string
+	VMName  string
+	Route   string
+	Status  int
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// matches reports whether an entry satisfies the query
+func (q Query) matches(entry *models.AccessLogEntry) bool {
+	switch {
+	case q.User != "" && entry.User != q.User,
+		q.Token != "" && entry.Token != q.Token,
+		q.AgentID != "" && entry.AgentID != q.AgentID,
+		q.VMName != "" && entry.VMName != q.VMName,
+		q.Route != "" && entry.Route != q.Route,
+		q.Status != 0 && entry.Status != q.Status,
+		!q.Since.IsZero() && entry.Time.Before(q.Since),
+		!q.Until.IsZero() && entry.Time.After(q.Until):
+		return false
+	}
+	return true
+}
+
+// Store records access log entries in a Repository and prunes entries older
+// than the retention period
+type Store struct {
+	repository Repository
+	retention  time.Duration
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+}
+
+// NewStore creates a store recording to repository
+func NewStore(repository Repository, retention time.Duration) *Store {
+	return &Store{
+		repository: repository,
+		retention:  retention,
+	}
+}
+
+// NewStoreFromEnv creates a store recording to db, or appending to
+// ACCESS_LOG_PATH (default ./data/access.log) when db is nil, and keeping
+// entries for ACCESS_LOG_RETENTION_DAYS (default 30) days. The first time a
+// database is used, the entries in the file are copied into it.
+func NewStoreFromEnv(db *storage.DB) (*Store, error) {
+	path := os.Getenv("ACCESS_LOG_PATH")
+	if path == "" {
+		path = filepath.Join("data", "access.log")
+	}
+	if db == nil {
+		return NewStore(NewFileRepository(path), retentionPeriod()), nil
+	}
+
+	repository := NewDatabaseRepository(db)
+	err := db.ImportOnce("access_log", func() (int, error) {
+		return repository.importFile(NewFileRepository(path))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(repository, retentionPeriod()), nil
+}
+
+// Record appends an entry to the log
+func (s *Store) Record(entry *models.AccessLogEntry) {
+	if err := s.repository.Append(entry); err != nil {
+		logger.Error("Failed to write access log", "error", err)
+	}
+}
+
+// Search returns entries matching the query, newest first
+func (s *Store) Search(q Query) ([]*models.AccessLogEntry, error) {
+	return s.repository.Search(q)
+}
+
+// Prune deletes entries older than the retention period
+func (s *Store) Prune(now time.Time) (int, error) {
+	return s.repository.Prune(now.Add(-s.retention))
+}
+
+// StartRetention prunes the log once an hour
+func (s *Store) StartRetention() {
+	s.ctx, s.cancelFunc = context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			if removed, err := s.Prune(time.Now()); err != nil {
+				logger.Error("Failed to prune access log", "error", err)
+			} else if removed > 0 {
+				logger.Info("Pruned access log entries", "count", removed)
+			}
+
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	logger.Info("Access log retention started", "retention", s.retention)
+}
+
+// StopRetention stops pruning and closes the log file
+func (s *Store) StopRetention() {
+	if s.cancelFunc != nil {
+		s.cancelFunc()
+	}
+	if err := s.repository.Close(); err != nil {
+		logger.Error("Failed to close access log", "error", err)
+	}
+}
+
+// retentionPeriod reads ACCESS_LOG_RETENTION_DAYS, defaulting to 30 days
+func retentionPeriod() time.Duration {
+	if days, err := strconv.Atoi(os.Getenv("ACCESS_LOG_RETENTION_DAYS")); err == nil && days > 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return 30 * 24 * time.Hour
+}
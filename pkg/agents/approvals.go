@@ -0,0 +1,243 @@
+package agents
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+// ErrAgentRejected is returned when a rejected agent registers or sends a
+// heartbeat
+var ErrAgentRejected = errors.New("agent registration was rejected")
+
+// Approvals keeps the admin decisions on which agents may join the fleet,
+// saved to the database or a JSON file after every change so approved agents
+// stay approved across master restarts
+type Approvals struct {
+	path string
+	// db keeps the decisions instead of the file when it is set
+	db          *storage.DB
+	autoApprove bool
+	decisions   map[string]models.AgentApproval
+	mutex       sync.RWMutex
+}
+
+// NewApprovals creates an approval store persisted at path, loading the
+// decisions already saved there. With autoApprove, agents that have no
+// decision yet are approved when they first register.
+func NewApprovals(path string, autoApprove bool) *Approvals {
+	a := &Approvals{
+		path:        path,
+		autoApprove: autoApprove,
+		decisions:   make(map[string]models.AgentApproval),
+	}
+	if err := a.load(); err != nil {
+		logger.Error("Failed to load agent approvals", "path", path, "error", err)
+	}
+	return a
+}
+
+// NewDatabaseApprovals creates an approval store in db, loading the
+// decisions already saved there
+func NewDatabaseApprovals(db *storage.DB, autoApprove bool) (*Approvals, error) {
+	a := &Approvals{db: db, autoApprove: autoApprove}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// NewApprovalsFromEnv creates an approval store in db, or persisted at
+// AGENT_APPROVALS_PATH (default ./data/agent_approvals.json) when db is nil.
+// Setting AGENT_AUTO_APPROVE=true approves new agents without an admin. The
+// first time a database is used, the decisions in the file are copied into
+// it.
+func NewApprovalsFromEnv(db *storage.DB) (*Approvals, error) {
+	path := os.Getenv("AGENT_APPROVALS_PATH")
+	if path == "" {
+		path = filepath.Join("data", "agent_approvals.json")
+	}
+	autoApprove := strings.EqualFold(os.Getenv("AGENT_AUTO_APPROVE"), "true")
+	if autoApprove {
+		logger.Warn("AGENT_AUTO_APPROVE is set; new agents join the fleet without approval")
+	}
+	if db == nil {
+		return NewApprovals(path, autoApprove), nil
+	}
+
+	err := db.ImportOnce("agent_approvals", func() (int, error) {
+		file := &Approvals{path: path, decisions: make(map[string]models.AgentApproval)}
+		if err := file.load(); err != nil {
+			return 0, err
+		}
+		imported := &Approvals{db: db, decisions: file.decisions}
+		for agentID := range file.decisions {
+			if err := imported.write(agentID); err != nil {
+				return 0, err
+			}
+		}
+		return len(file.decisions), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewDatabaseApprovals(db, autoApprove)
+}
+
+// load reads the saved decisions
+func (a *Approvals) load() error {
+	if a.db != nil {
+		return a.loadDatabase()
+	}
+	data, err := os.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &a.decisions)
+}
+
+// loadDatabase reads the decisions saved in the database
+func (a *Approvals) loadDatabase() error {
+	rows, err := a.db.Query(`SELECT agent_id, data FROM agent_approvals`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var agentID, data string
+		if err := rows.Scan(&agentID, &data); err != nil {
+			return err
+		}
+		var approval models.AgentApproval
+		if err := json.Unmarshal([]byte(data), &approval); err != nil {
+			return err
+		}
+		a.decisions[agentID] = approval
+	}
+	return rows.Err()
+}
+
+// Reload reads the saved decisions again, picking up those another master
+// sharing the database made
+func (a *Approvals) Reload() error {
+	reloaded := &Approvals{path: a.path, db: a.db, decisions: make(map[string]models.AgentApproval)}
+	if err := reloaded.load(); err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.decisions = reloaded.decisions
+	return nil
+}
+
+// save saves the decision on an agent; the caller must hold the lock
+func (a *Approvals) save(agentID string) {
+	if err := a.write(agentID); err != nil {
+		logger.Error("Failed to save agent approvals", "agent_id", agentID, "error", err)
+	}
+}
+
+// write writes the decision on an agent to the database, or every decision
+// to the file
+func (a *Approvals) write(agentID string) error {
+	if a.db != nil {
+		data, err := json.Marshal(a.decisions[agentID])
+		if err != nil {
+			return err
+		}
+		_, err = a.db.Exec(`INSERT INTO agent_approvals (agent_id, data) VALUES (?, ?)
+			ON CONFLICT (agent_id) DO UPDATE SET data = excluded.data`,
+			agentID, string(data))
+		return err
+	}
+
+	data, err := json.MarshalIndent(a.decisions, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o755); err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// Decision gets the decision on an agent: "approved", "rejected", or
+// "pending" if no admin has decided yet. An undecided agent is approved on
+// the spot when auto-approval is on.
+func (a *Approvals) Decision(agentID string) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if decision, exists := a.decisions[agentID]; exists {
+		return decision.Decision
+	}
+	if a.autoApprove {
+		a.decide(agentID, "approved", "auto-approve")
+		return "approved"
+	}
+	return "pending"
+}
+
+// List gets every decision, by agent ID
+func (a *Approvals) List() map[string]models.AgentApproval {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	decisions := make(map[string]models.AgentApproval, len(a.decisions))
+	for agentID, approval := range a.decisions {
+		decisions[agentID] = approval
+	}
+	return decisions
+}
+
+// Restore records a decision as a backup saved it, reporting whether it could
+// be saved
+func (a *Approvals) Restore(agentID string, approval models.AgentApproval) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	previous, existed := a.decisions[agentID]
+	a.decisions[agentID] = approval
+	if err := a.write(agentID); err != nil {
+		if existed {
+			a.decisions[agentID] = previous
+		} else {
+			delete(a.decisions, agentID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Set records an admin's decision on an agent
+func (a *Approvals) Set(agentID, decision, by string) models.AgentApproval {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.decide(agentID, decision, by)
+}
+
+// decide stores a decision; the caller must hold the lock
+func (a *Approvals) decide(agentID, decision, by string) models.AgentApproval {
+	approval := models.AgentApproval{
+		Decision:  decision,
+		DecidedBy: by,
+		DecidedAt: time.Now(),
+	}
+	a.decisions[agentID] = approval
+	a.save(agentID)
+	return approval
+}
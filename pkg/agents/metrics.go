@@ -0,0 +1,37 @@
+package agents
+
+import (
+	"time"
+
+	"github.com/prashah/batwa/pkg/metrics"
+)
+
+// RegisterMetrics exports the registry's state to a metrics registry: how
+// many agents are in each status, how many are online, and how long ago each
+// agent's last heartbeat arrived
+func (r *AgentRegistry) RegisterMetrics(registry *metrics.Registry) {
+	registry.GaugeFunc(metrics.Namespace+"agents", "Registered agents, by status", []string{"status"}, func() []metrics.Sample {
+		r.mutex.RLock()
+		defer r.mutex.RUnlock()
+		samples := []metrics.Sample{}
+		for _, agent := range r.agents {
+			samples = append(samples, metrics.Sample{Labels: []string{agent.Status}, Value: 1})
+		}
+		return samples
+	})
+	registry.GaugeFunc(metrics.Namespace+"agents_online", "Agents online", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(len(r.GetOnlineAgents()))}}
+	})
+	registry.GaugeFunc(metrics.Namespace+"agent_heartbeat_lag_seconds", "Seconds since each agent's last heartbeat",
+		[]string{"agent_id"}, func() []metrics.Sample {
+			r.mutex.RLock()
+			defer r.mutex.RUnlock()
+			samples := []metrics.Sample{}
+			for _, agent := range r.agents {
+				if agent.LastSeen != nil {
+					samples = append(samples, metrics.Sample{Labels: []string{agent.AgentID}, Value: time.Since(*agent.LastSeen).Seconds()})
+				}
+			}
+			return samples
+		})
+}
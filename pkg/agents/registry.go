@@ -2,14 +2,41 @@ package agents
 
 import (
 	"context"
-	"log"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prashah/batwa/pkg/bus"
+	"github.com/prashah/batwa/pkg/logging"
 	"github.com/prashah/batwa/pkg/models"
 )
 
+var logger = logging.For("agents")
+
+// Errors of agent registrations and heartbeats
+var (
+	// ErrAgentNotRegistered is returned when an agent that is not registered
+	// sends a heartbeat
+	ErrAgentNotRegistered = errors.New("agent is not registered")
+	// ErrAgentKeyMismatch is returned when an agent registers again without
+	// the API key it registered and either approval is off or the
+	// registration would change the key
+	ErrAgentKeyMismatch = errors.New("agent did not present its API key")
+)
+
+// Defaults of the heartbeat monitor: how often it checks the agents, and how
+// long an agent may go without a heartbeat before it is marked offline
+const (
+	DefaultCheckInterval    = 30 * time.Second
+	DefaultOfflineThreshold = 60 * time.Second
+)
+
 // AgentRegistry manages remote agents
 type AgentRegistry struct {
 	agents            map[string]*models.AgentInfo
@@ -18,7 +45,229 @@ type AgentRegistry struct {
 	heartbeatInterval time.Duration
 	offlineThreshold  time.Duration
 	cancelFunc        context.CancelFunc
-	ctx               context.Context
+	events            *bus.Bus
+	approvals         *Approvals
+	store             Store
+	// shared saves every heartbeat and status change to the store, which
+	// other masters read too
+	shared bool
+	// lastCheck is when the heartbeat monitor last ran, in Unix nanoseconds,
+	// or 0 while it is stopped
+	lastCheck atomic.Int64
+	// signedOff holds the agents that went offline by shutting down, which
+	// stay offline until they next register or send a heartbeat
+	signedOff map[string]bool
+	// proposed holds the registrations made without an agent's API key,
+	// whose hostname and address take effect only once an admin approves
+	proposed map[string]models.AgentInfo
+}
+
+// PublishTo makes the registry publish agent status changes to events:
+// agent.registered for a new agent, agent.unregistered for a removed one and
+// agent.<status>, such as agent.offline, for the others
+func (r *AgentRegistry) PublishTo(events *bus.Bus) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = events
+}
+
+// notify publishes a status change. previous is empty for a newly registered
+// agent and current is empty for a removed one. The caller must hold the
+// lock.
+func (r *AgentRegistry) notify(agent *models.AgentInfo, previous, current string) {
+	if previous == current || r.events == nil {
+		return
+	}
+
+	event := models.Event{
+		Type:    "agent." + current,
+		AgentID: agent.AgentID,
+		Data:    map[string]string{"previous": previous, "status": current},
+	}
+	switch {
+	case previous == "":
+		event.Type = "agent.registered"
+		event.Data = map[string]string{"status": current}
+	case current == "":
+		event.Type = "agent.unregistered"
+		event.Data = map[string]string{"previous": previous}
+	}
+	r.events.Publish(event)
+}
+
+// RequireApproval makes new agents wait in "pending" until an admin approves
+// them in approvals. Pending agents are not online, so nothing is sent to
+// them or placed on them.
+func (r *AgentRegistry) RequireApproval(approvals *Approvals) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.approvals = approvals
+}
+
+// ShareStore makes the registry save every heartbeat and status change to its
+// store, for masters sharing a database to run as replicas. Call it before
+// UseStore. Each replica then picks up the others' changes with Sync, and
+// only the leader's heartbeat monitor marks agents offline.
+func (r *AgentRegistry) ShareStore() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.shared = true
+}
+
+// UseStore restores the agents saved in store and saves every later change
+// to it. Restored agents are offline, or still pending, until they next send
+// a heartbeat, unless the store is shared: other replicas keep their status
+// current then.
+func (r *AgentRegistry) UseStore(store Store) error {
+	saved, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.store = store
+	for _, entry := range saved {
+		agent := entry.Agent
+		if !r.shared {
+			if agent.Status != "pending" {
+				agent.Status = "offline"
+			}
+			agent.Health = nil
+		}
+		r.agents[agent.AgentID] = &agent
+		if entry.APIKey != "" {
+			r.apiKeys[agent.AgentID] = entry.APIKey
+		}
+	}
+	if len(saved) > 0 {
+		logger.Info("Restored registered agents", "count", len(saved))
+	}
+	return nil
+}
+
+// Sync picks up the agents other replicas sharing the store registered,
+// updated or removed, and their approvals. A saved agent replaces the one
+// held here unless this one was seen more recently. No events are published:
+// the replica where a change happened has published them.
+func (r *AgentRegistry) Sync() error {
+	if r.store == nil {
+		return nil
+	}
+	if r.approvals != nil {
+		if err := r.approvals.Reload(); err != nil {
+			return err
+		}
+	}
+	saved, err := r.store.Load()
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	current := make(map[string]bool, len(saved))
+	for _, entry := range saved {
+		agent := entry.Agent
+		current[agent.AgentID] = true
+		if existing, exists := r.agents[agent.AgentID]; exists && newerThan(existing.LastSeen, agent.LastSeen) {
+			continue
+		}
+		r.agents[agent.AgentID] = &agent
+		if entry.APIKey != "" {
+			r.apiKeys[agent.AgentID] = entry.APIKey
+		}
+	}
+	for agentID := range r.agents {
+		if !current[agentID] {
+			delete(r.agents, agentID)
+			delete(r.apiKeys, agentID)
+			delete(r.signedOff, agentID)
+		}
+	}
+	return nil
+}
+
+// newerThan reports whether a was seen after b
+func newerThan(a, b *time.Time) bool {
+	return a != nil && (b == nil || a.After(*b))
+}
+
+// Saved gets every registered agent with its API key, as the store saves
+// them, for backups
+func (r *AgentRegistry) Saved() []StoredAgent {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	saved := make([]StoredAgent, 0, len(r.agents))
+	for agentID, agent := range r.agents {
+		saved = append(saved, StoredAgent{Agent: *agent, APIKey: r.apiKeys[agentID]})
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].Agent.AgentID < saved[j].Agent.AgentID
+	})
+	return saved
+}
+
+// Restore registers an agent as a backup saved it, reporting whether it
+// could be saved. It is offline, or still pending, until it next sends a
+// heartbeat. No event is published.
+func (r *AgentRegistry) Restore(entry StoredAgent) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	agent := entry.Agent
+	if agent.Status != "pending" {
+		agent.Status = "offline"
+	}
+	agent.Health = nil
+	if r.store != nil {
+		if err := r.store.Save(StoredAgent{Agent: agent, APIKey: entry.APIKey}); err != nil {
+			return err
+		}
+	}
+	r.agents[agent.AgentID] = &agent
+	if entry.APIKey != "" {
+		r.apiKeys[agent.AgentID] = entry.APIKey
+	}
+	return nil
+}
+
+// persist saves an agent to the store; the caller must hold the lock
+func (r *AgentRegistry) persist(agent *models.AgentInfo) {
+	if r.store == nil {
+		return
+	}
+	entry := StoredAgent{Agent: *agent, APIKey: r.apiKeys[agent.AgentID]}
+	if err := r.store.Save(entry); err != nil {
+		logger.Error("Failed to save agent", "agent_id", agent.AgentID, "error", err)
+	}
+}
+
+// forget removes an agent from the store; the caller must hold the lock
+func (r *AgentRegistry) forget(agentID string) {
+	if r.store == nil {
+		return
+	}
+	if err := r.store.Delete(agentID); err != nil {
+		logger.Error("Failed to remove saved agent", "agent_id", agentID, "error", err)
+	}
+}
+
+// admit gets the status an agent joins with: "online" once approved and
+// "pending" before that. It fails with ErrAgentRejected for rejected agents.
+func (r *AgentRegistry) admit(agentID string) (string, error) {
+	if r.approvals == nil {
+		return "online", nil
+	}
+	switch r.approvals.Decision(agentID) {
+	case "approved":
+		return "online", nil
+	case "rejected":
+		return "", ErrAgentRejected
+	default:
+		return "pending", nil
+	}
 }
 
 // NewAgentRegistry creates a new agent registry
@@ -26,35 +275,192 @@ func NewAgentRegistry() *AgentRegistry {
 	return &AgentRegistry{
 		agents:            make(map[string]*models.AgentInfo),
 		apiKeys:           make(map[string]string),
-		heartbeatInterval: 30 * time.Second,
-		offlineThreshold:  60 * time.Second,
+		signedOff:         make(map[string]bool),
+		proposed:          make(map[string]models.AgentInfo),
+		heartbeatInterval: DefaultCheckInterval,
+		offlineThreshold:  DefaultOfflineThreshold,
+	}
+}
+
+// NewAgentRegistryFromEnv creates a registry whose heartbeat monitor checks
+// the agents every AGENT_CHECK_INTERVAL (default 30s) and marks those silent
+// for AGENT_OFFLINE_THRESHOLD (default 60s) offline
+func NewAgentRegistryFromEnv() (*AgentRegistry, error) {
+	r := NewAgentRegistry()
+	var err error
+	if r.heartbeatInterval, err = durationFromEnv("AGENT_CHECK_INTERVAL", DefaultCheckInterval); err != nil {
+		return nil, err
+	}
+	if r.offlineThreshold, err = durationFromEnv("AGENT_OFFLINE_THRESHOLD", DefaultOfflineThreshold); err != nil {
+		return nil, err
+	}
+	if r.offlineThreshold < r.heartbeatInterval {
+		return nil, fmt.Errorf("AGENT_OFFLINE_THRESHOLD (%s) must not be shorter than AGENT_CHECK_INTERVAL (%s)", r.offlineThreshold, r.heartbeatInterval)
 	}
+	return r, nil
 }
 
-// RegisterAgent registers a new agent or updates an existing one
-func (r *AgentRegistry) RegisterAgent(req models.AgentRegisterRequest) *models.AgentInfo {
+// durationFromEnv reads a positive duration such as 30s from an environment
+// variable, falling back to fallback when it is unset
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s': use a positive duration such as 30s or 2m", name, value)
+	}
+	return duration, nil
+}
+
+// keyMatches reports whether key is the API key an agent registered, or the
+// agent has none; the caller must hold the lock
+func (r *AgentRegistry) keyMatches(agentID, key string) bool {
+	current, exists := r.apiKeys[agentID]
+	return !exists || subtle.ConstantTimeCompare([]byte(key), []byte(current)) == 1
+}
+
+// RegisterAgent registers a new agent or updates an existing one. Agents that
+// still need approval are registered as "pending". An agent that registered
+// an API key must present it as key to register again: without it, another
+// host may be claiming the agent's ID, so the registration goes back to
+// "pending" for an admin to approve, or fails with ErrAgentKeyMismatch when
+// approval is off. Nor can it change the key, which would undo a rotation.
+// Until an admin approves, the agent keeps the hostname and address it had,
+// so the master does not send its requests and key to the other host.
+func (r *AgentRegistry) RegisterAgent(req models.AgentRegisterRequest, key string) (*models.AgentInfo, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	status, err := r.admit(req.AgentID)
+	if err != nil {
+		return nil, err
+	}
+	authenticated := r.keyMatches(req.AgentID, key)
+	if !authenticated {
+		if r.approvals == nil || (req.APIKey != nil && !r.keyMatches(req.AgentID, *req.APIKey)) {
+			return nil, ErrAgentKeyMismatch
+		}
+		logger.Warn("Agent registered again without its API key; it needs approval again", "agent_id", req.AgentID, "hostname", req.Hostname)
+		r.approvals.Set(req.AgentID, "pending", "re-registration")
+		status = "pending"
+	}
+
 	now := time.Now()
 	agentInfo := &models.AgentInfo{
-		AgentID:  req.AgentID,
-		Hostname: req.Hostname,
-		APIURL:   strings.TrimSuffix(req.APIURL, "/"),
-		Status:   "online",
-		LastSeen: &now,
-		Tags:     req.Tags,
-		VMCount:  0,
+		AgentID:   req.AgentID,
+		Hostname:  req.Hostname,
+		APIURL:    strings.TrimSuffix(req.APIURL, "/"),
+		Status:    status,
+		LastSeen:  &now,
+		Tags:      req.Tags,
+		VMCount:   0,
+		Version:   req.Version,
+		Tunnel:    req.Tunnel,
+		Transport: req.Transport,
+		Zone:      req.Zone,
+		Jobs:      req.Jobs,
 	}
 
+	previous := ""
+	if existing, exists := r.agents[req.AgentID]; exists {
+		previous = existing.Status
+		// Re-registering does not end a drain
+		agentInfo.Draining = existing.Draining
+		agentInfo.DrainedAt = existing.DrainedAt
+		// Agents registering without a zone stay in the one they had
+		if agentInfo.Zone == "" {
+			agentInfo.Zone = existing.Zone
+		}
+		if !authenticated {
+			r.proposed[req.AgentID] = *agentInfo
+			agentInfo.Hostname = existing.Hostname
+			agentInfo.APIURL = existing.APIURL
+			agentInfo.Tunnel = existing.Tunnel
+			agentInfo.Transport = existing.Transport
+		}
+	}
+	if authenticated {
+		delete(r.proposed, req.AgentID)
+	}
 	r.agents[req.AgentID] = agentInfo
+	delete(r.signedOff, req.AgentID)
+	r.notify(agentInfo, previous, agentInfo.Status)
 
 	if req.APIKey != nil {
 		r.apiKeys[req.AgentID] = *req.APIKey
 	}
+	r.persist(agentInfo)
+
+	if status == "pending" {
+		logger.Info("Registered agent, awaiting approval", "agent_id", req.AgentID, "hostname", req.Hostname)
+	} else {
+		logger.Info("Registered agent", "agent_id", req.AgentID, "hostname", req.Hostname)
+	}
+	return agentInfo, nil
+}
+
+// Approve lets an agent join the fleet on behalf of by. A pending agent
+// becomes online, or offline if it has stopped sending heartbeats. Agents
+// may be approved before they register; the agent is nil then.
+func (r *AgentRegistry) Approve(agentID, by string) (*models.AgentInfo, models.AgentApproval) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	approval := r.approvals.Set(agentID, "approved", by)
+	agent, exists := r.agents[agentID]
+	if !exists {
+		return nil, approval
+	}
+	// A registration made without the agent's key changes where it is
+	// reached only now
+	if proposed, exists := r.proposed[agentID]; exists {
+		delete(r.proposed, agentID)
+		agent.Hostname = proposed.Hostname
+		agent.APIURL = proposed.APIURL
+		agent.Tunnel = proposed.Tunnel
+		agent.Transport = proposed.Transport
+		r.persist(agent)
+	}
+	if agent.Status == "pending" {
+		status := "online"
+		if agent.LastSeen != nil && time.Since(*agent.LastSeen) > r.offlineThreshold {
+			status = "offline"
+		}
+		r.notify(agent, agent.Status, status)
+		agent.Status = status
+		r.persist(agent)
+	}
+	logger.Info("Agent approved", "agent_id", agentID, "by", by)
+	return agent, approval
+}
 
-	log.Printf("Registered agent: %s (%s)", req.AgentID, req.Hostname)
-	return agentInfo
+// Reject keeps an agent out of the fleet on behalf of by, unregistering it
+// if it is registered. Its registrations and heartbeats fail from then on.
+func (r *AgentRegistry) Reject(agentID, by string) (bool, models.AgentApproval) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	approval := r.approvals.Set(agentID, "rejected", by)
+	agent, exists := r.agents[agentID]
+	delete(r.proposed, agentID)
+	if exists {
+		delete(r.agents, agentID)
+		delete(r.signedOff, agentID)
+		r.notify(agent, agent.Status, "")
+		delete(r.apiKeys, agentID)
+		r.forget(agentID)
+	}
+	logger.Info("Agent rejected", "agent_id", agentID, "by", by)
+	return exists, approval
+}
+
+// ApprovalRequired reports whether new agents need an admin's approval
+func (r *AgentRegistry) ApprovalRequired() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.approvals != nil
 }
 
 // UnregisterAgent unregisters an agent
@@ -62,15 +468,51 @@ func (r *AgentRegistry) UnregisterAgent(agentID string) bool {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if _, exists := r.agents[agentID]; exists {
+	if agent, exists := r.agents[agentID]; exists {
 		delete(r.agents, agentID)
+		delete(r.proposed, agentID)
+		r.notify(agent, agent.Status, "")
 		delete(r.apiKeys, agentID)
-		log.Printf("Unregistered agent: %s", agentID)
+		r.forget(agentID)
+		logger.Info("Unregistered agent", "agent_id", agentID)
 		return true
 	}
 	return false
 }
 
+// SignOff marks an agent that is shutting down offline at once, rather than
+// once it misses its heartbeats, so nothing more is sent to it. It keeps its
+// registration and comes back online when it next registers or sends a
+// heartbeat. Pending agents stay pending.
+func (r *AgentRegistry) SignOff(agentID string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	agent, exists := r.agents[agentID]
+	if !exists {
+		return false
+	}
+	if agent.Status == "pending" {
+		return true
+	}
+	r.signedOff[agentID] = true
+	if previous := agent.Status; previous != "offline" {
+		agent.Status = "offline"
+		if r.shared {
+			r.persist(agent)
+		}
+		if r.events != nil {
+			r.events.Publish(models.Event{
+				Type:    "agent.offline",
+				AgentID: agentID,
+				Data:    map[string]string{"previous": previous, "status": "offline", "reason": "shutdown"},
+			})
+		}
+	}
+	logger.Info("Agent signed off", "agent_id", agentID)
+	return true
+}
+
 // GetAgent gets agent information by ID
 func (r *AgentRegistry) GetAgent(agentID string) *models.AgentInfo {
 	r.mutex.RLock()
@@ -104,6 +546,42 @@ func (r *AgentRegistry) GetOnlineAgents() []*models.AgentInfo {
 	return agents
 }
 
+// GetSchedulableAgents gets the online agents that are not draining, which
+// are the ones new VMs may be placed on
+func (r *AgentRegistry) GetSchedulableAgents() []*models.AgentInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	agents := make([]*models.AgentInfo, 0)
+	for _, agent := range r.agents {
+		if agent.Status == "online" && !agent.Draining {
+			agents = append(agents, agent)
+		}
+	}
+	return agents
+}
+
+// SetDraining starts or ends draining an agent. It returns the agent, or nil
+// if it is not registered.
+func (r *AgentRegistry) SetDraining(agentID string, draining bool) *models.AgentInfo {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	agent, exists := r.agents[agentID]
+	if !exists {
+		return nil
+	}
+	if draining && !agent.Draining {
+		now := time.Now()
+		agent.DrainedAt = &now
+	} else if !draining {
+		agent.DrainedAt = nil
+	}
+	agent.Draining = draining
+	r.persist(agent)
+	return agent
+}
+
 // GetAgentAPIKey gets API key for an agent
 func (r *AgentRegistry) GetAgentAPIKey(agentID string) *string {
 	r.mutex.RLock()
@@ -115,42 +593,65 @@ func (r *AgentRegistry) GetAgentAPIKey(agentID string) *string {
 	return nil
 }
 
-// UpdateHeartbeat updates agent heartbeat
-func (r *AgentRegistry) UpdateHeartbeat(heartbeat models.AgentHeartbeat) {
-	r.UpdateHeartbeatWithIP(heartbeat, "")
+// SetAgentAPIKey replaces the API key used to call an agent, reporting
+// whether the agent is registered
+func (r *AgentRegistry) SetAgentAPIKey(agentID, apiKey string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	agent, exists := r.agents[agentID]
+	if !exists {
+		return false
+	}
+	r.apiKeys[agentID] = apiKey
+	r.persist(agent)
+	return true
 }
 
-// UpdateHeartbeatWithIP updates agent heartbeat with client IP for auto-registration
-func (r *AgentRegistry) UpdateHeartbeatWithIP(heartbeat models.AgentHeartbeat, clientIP string) {
+// UpdateHeartbeat records a registered agent's heartbeat, failing with
+// ErrAgentNotRegistered for agents that have not registered. A heartbeat
+// means the agent is up: it is online unless it reports being degraded, and
+// agents awaiting approval stay "pending".
+func (r *AgentRegistry) UpdateHeartbeat(heartbeat models.AgentHeartbeat) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if agent, exists := r.agents[heartbeat.AgentID]; exists {
-		agent.LastSeen = &heartbeat.Timestamp
-		agent.Status = heartbeat.Status
-		agent.VMCount = heartbeat.VMCount
-		log.Printf("Heartbeat updated for agent: %s", heartbeat.AgentID)
-	} else {
-		// Auto-register agent if it doesn't exist
-		log.Printf("Auto-registering agent from heartbeat: %s (IP: %s)", heartbeat.AgentID, clientIP)
-
-		// Construct API URL from client IP
-		apiURL := ""
-		if clientIP != "" {
-			// Default agent port is 8001
-			apiURL = "http://" + clientIP + ":8001"
-		}
+	agent, exists := r.agents[heartbeat.AgentID]
+	if !exists {
+		return ErrAgentNotRegistered
+	}
+	status, err := r.admit(heartbeat.AgentID)
+	if err != nil {
+		return err
+	}
+	if status != "pending" && heartbeat.Status == "degraded" {
+		status = "degraded"
+	}
 
-		agentInfo := &models.AgentInfo{
-			AgentID:  heartbeat.AgentID,
-			Hostname: heartbeat.AgentID, // Use AgentID as hostname for now
-			APIURL:   apiURL,
-			Status:   heartbeat.Status,
-			LastSeen: &heartbeat.Timestamp,
-			VMCount:  heartbeat.VMCount,
-		}
-		r.agents[heartbeat.AgentID] = agentInfo
+	delete(r.signedOff, heartbeat.AgentID)
+	previous := agent.Status
+	agent.LastSeen = &heartbeat.Timestamp
+	agent.Status = status
+	r.notify(agent, previous, agent.Status)
+	agent.VMCount = heartbeat.VMCount
+	// Other replicas need every heartbeat; alone, only version changes
+	// are worth saving
+	save := r.shared
+	if heartbeat.Version != nil {
+		changed := agent.Version == nil || agent.Version.Multipass != heartbeat.Version.Multipass ||
+			agent.Version.Multipassd != heartbeat.Version.Multipassd || agent.Version.Driver != heartbeat.Version.Driver
+		agent.Version = heartbeat.Version
+		save = save || changed
+	}
+	agent.Health = heartbeat.Health
+	if heartbeat.Resources != nil {
+		agent.Resources = heartbeat.Resources
 	}
+	if save {
+		r.persist(agent)
+	}
+	logger.Debug("Heartbeat updated", "agent_id", heartbeat.AgentID)
+	return nil
 }
 
 // UpdateVMCount updates VM count for an agent
@@ -170,17 +671,27 @@ func (r *AgentRegistry) CheckAgentStatus() {
 
 	now := time.Now()
 	for _, agent := range r.agents {
+		if agent.Status == "pending" || r.signedOff[agent.AgentID] {
+			continue
+		}
 		if agent.LastSeen != nil {
 			timeSinceLastSeen := now.Sub(*agent.LastSeen)
 			if timeSinceLastSeen > r.offlineThreshold {
 				if agent.Status != "offline" {
+					r.notify(agent, agent.Status, "offline")
 					agent.Status = "offline"
-					log.Printf("Agent %s is now offline", agent.AgentID)
+					if r.shared {
+						r.persist(agent)
+					}
+					logger.Warn("Agent is now offline", "agent_id", agent.AgentID)
 				}
-			} else {
+			} else if !r.shared {
+				// Shared agents come back online with the heartbeat itself,
+				// wherever it was received
 				if agent.Status == "offline" {
+					r.notify(agent, agent.Status, "online")
 					agent.Status = "online"
-					log.Printf("Agent %s is back online", agent.AgentID)
+					logger.Info("Agent is back online", "agent_id", agent.AgentID)
 				}
 			}
 		}
@@ -190,35 +701,46 @@ func (r *AgentRegistry) CheckAgentStatus() {
 // StartHeartbeatMonitor starts the heartbeat monitoring task
 func (r *AgentRegistry) StartHeartbeatMonitor() {
 	ctx, cancel := context.WithCancel(context.Background())
-	r.ctx = ctx
 	r.cancelFunc = cancel
 
-	go r.heartbeatLoop()
-	log.Println("Started agent heartbeat monitor")
+	r.lastCheck.Store(time.Now().UnixNano())
+	go r.heartbeatLoop(ctx)
+	logger.Info("Started agent heartbeat monitor")
 }
 
 // StopHeartbeatMonitor stops the heartbeat monitoring task
 func (r *AgentRegistry) StopHeartbeatMonitor() {
 	if r.cancelFunc != nil {
 		r.cancelFunc()
-		log.Println("Stopped agent heartbeat monitor")
+		r.lastCheck.Store(0)
+		logger.Info("Stopped agent heartbeat monitor")
 	}
 }
 
 // heartbeatLoop is the periodic heartbeat monitoring loop
-func (r *AgentRegistry) heartbeatLoop() {
+func (r *AgentRegistry) heartbeatLoop(ctx context.Context) {
 	ticker := time.NewTicker(r.heartbeatInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-r.ctx.Done():
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
 			r.CheckAgentStatus()
+			r.lastCheck.Store(time.Now().UnixNano())
 		}
 	}
 }
 
-// Global agent registry instance
-var GlobalRegistry = NewAgentRegistry()
+// HeartbeatMonitorRunning reports whether the heartbeat monitor is started
+// and has checked the agents within two of its intervals, so a stuck monitor
+// counts as stopped, and when it last did
+func (r *AgentRegistry) HeartbeatMonitorRunning() (bool, time.Time) {
+	last := r.lastCheck.Load()
+	if last == 0 {
+		return false, time.Time{}
+	}
+	checked := time.Unix(0, last)
+	return time.Since(checked) <= 2*r.heartbeatInterval, checked
+}
@@ -0,0 +1,58 @@
+package agents
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// TestReRegistrationWithoutKeyKeepsAddress checks that a registration made
+// without an agent's API key cannot point the master at another host: the
+// agent keeps its address until an admin approves, and the legitimate agent
+// registering with its key discards the proposed one
+func TestReRegistrationWithoutKeyKeepsAddress(t *testing.T) {
+	r := NewAgentRegistry()
+	r.RequireApproval(NewApprovals(filepath.Join(t.TempDir(), "approvals.json"), true))
+
+	key := "agent-key"
+	original := models.AgentRegisterRequest{AgentID: "a1", Hostname: "office", APIURL: "http://office:8001", APIKey: &key}
+	if _, err := r.RegisterAgent(original, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	claim := models.AgentRegisterRequest{AgentID: "a1", Hostname: "attacker", APIURL: "http://attacker:8001", Tunnel: true}
+	agent, err := r.RegisterAgent(claim, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.Status != "pending" {
+		t.Errorf("status after a registration without the key = %q, want pending", agent.Status)
+	}
+	agent = r.GetAgent("a1")
+	if agent.APIURL != original.APIURL || agent.Hostname != original.Hostname || agent.Tunnel {
+		t.Errorf("a registration without the key moved the agent to %s (%s, tunnel %v)", agent.APIURL, agent.Hostname, agent.Tunnel)
+	}
+
+	// The agent registering with its key discards the other host's address
+	if _, err := r.RegisterAgent(original, key); err != nil {
+		t.Fatal(err)
+	}
+	agent, _ = r.Approve("a1", "admin")
+	if agent.APIURL != original.APIURL || agent.Hostname != original.Hostname {
+		t.Errorf("approving after the agent registered with its key moved it to %s (%s)", agent.APIURL, agent.Hostname)
+	}
+
+	// An admin approving the registration itself takes the new address
+	moved := models.AgentRegisterRequest{AgentID: "a1", Hostname: "office-2", APIURL: "http://office-2:8001"}
+	if _, err := r.RegisterAgent(moved, ""); err != nil {
+		t.Fatal(err)
+	}
+	if agent := r.GetAgent("a1"); agent.APIURL != original.APIURL {
+		t.Errorf("a registration without the key moved the agent to %s before approval", agent.APIURL)
+	}
+	agent, _ = r.Approve("a1", "admin")
+	if agent.APIURL != moved.APIURL || agent.Hostname != moved.Hostname || agent.Status == "pending" {
+		t.Errorf("approved agent = %s (%s, %s), want %s (%s)", agent.APIURL, agent.Hostname, agent.Status, moved.APIURL, moved.Hostname)
+	}
+}
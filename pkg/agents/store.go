@@ -0,0 +1,248 @@
+package agents
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/secrets"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+// StoredAgent is a registered agent as persisted, with the API key the master
+// calls it with
+type StoredAgent struct {
+	Agent  models.AgentInfo `json:"agent"`
+	APIKey string           `json:"api_key,omitempty"`
+}
+
+// Store persists the registered agents so a master restart does not forget
+// the fleet. FileStore is the default; database backed stores implement the
+// same methods.
+type Store interface {
+	Load() ([]StoredAgent, error)
+	Save(agent StoredAgent) error
+	Delete(agentID string) error
+}
+
+// FileStore keeps the registered agents in a JSON file, rewritten after every
+// change. With a cipher, the API keys in the file are encrypted.
+type FileStore struct {
+	path   string
+	agents map[string]StoredAgent
+	cipher *secrets.Cipher
+	mutex  sync.Mutex
+}
+
+// NewFileStore creates an agent store persisted at path
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path, agents: make(map[string]StoredAgent)}
+}
+
+// NewStoreFromEnv creates an agent store in db, or persisted at
+// AGENT_REGISTRY_PATH (default ./data/agents.json) when db is nil, encrypting
+// API keys with cipher unless it is nil. The first time a database is used,
+// the agents in the file are copied into it.
+func NewStoreFromEnv(cipher *secrets.Cipher, db *storage.DB) (Store, error) {
+	path := os.Getenv("AGENT_REGISTRY_PATH")
+	if path == "" {
+		path = filepath.Join("data", "agents.json")
+	}
+	file := NewFileStore(path)
+	file.cipher = cipher
+	if db == nil {
+		return file, nil
+	}
+
+	store := NewDatabaseStore(db, cipher)
+	err := db.ImportOnce("agents", func() (int, error) {
+		agents, err := file.Load()
+		if err != nil {
+			return 0, err
+		}
+		for _, agent := range agents {
+			if err := store.Save(agent); err != nil {
+				return 0, err
+			}
+		}
+		return len(agents), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Load reads the saved agents
+func (s *FileStore) Load() ([]StoredAgent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.agents); err != nil {
+		return nil, err
+	}
+
+	agents := make([]StoredAgent, 0, len(s.agents))
+	plaintext := false
+	for id, agent := range s.agents {
+		plaintext = plaintext || (agent.APIKey != "" && !secrets.IsSealed(agent.APIKey))
+		if secrets.IsSealed(agent.APIKey) {
+			if s.cipher == nil {
+				return nil, fmt.Errorf("the API key of agent %s is encrypted; set SECRETS_KEY_FILE to decrypt it", id)
+			}
+			if agent.APIKey, err = s.cipher.Open(agent.APIKey); err != nil {
+				return nil, fmt.Errorf("agent %s: %w", id, err)
+			}
+			s.agents[id] = agent
+		}
+		agents = append(agents, agent)
+	}
+	if plaintext && s.cipher != nil {
+		// Encrypt the keys saved before a key was configured
+		if err := s.write(); err != nil {
+			return nil, err
+		}
+	}
+	return agents, nil
+}
+
+// Save stores an agent, replacing any saved before under its ID
+func (s *FileStore) Save(agent StoredAgent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.agents[agent.Agent.AgentID] = agent
+	return s.write()
+}
+
+// Delete removes a saved agent
+func (s *FileStore) Delete(agentID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.agents[agentID]; !exists {
+		return nil
+	}
+	delete(s.agents, agentID)
+	return s.write()
+}
+
+// write saves every agent to the file; the caller must hold the lock. The
+// file holds API keys, so only the master's user may read it, and they are
+// encrypted when there is a cipher.
+func (s *FileStore) write() error {
+	saved := s.agents
+	if s.cipher != nil {
+		saved = make(map[string]StoredAgent, len(s.agents))
+		for id, agent := range s.agents {
+			if agent.APIKey != "" {
+				sealed, err := s.cipher.Seal(agent.APIKey)
+				if err != nil {
+					return err
+				}
+				agent.APIKey = sealed
+			}
+			saved[id] = agent
+		}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// DatabaseStore keeps the registered agents in the master's database. With a
+// cipher, the API keys are encrypted.
+type DatabaseStore struct {
+	db     *storage.DB
+	cipher *secrets.Cipher
+}
+
+// NewDatabaseStore creates an agent store in db, encrypting API keys with
+// cipher unless it is nil
+func NewDatabaseStore(db *storage.DB, cipher *secrets.Cipher) *DatabaseStore {
+	return &DatabaseStore{db: db, cipher: cipher}
+}
+
+// Load reads the saved agents, encrypting keys saved before a cipher was
+// configured
+func (s *DatabaseStore) Load() ([]StoredAgent, error) {
+	rows, err := s.db.Query(`SELECT agent_id, data, api_key FROM agents`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var agents []StoredAgent
+	var plaintext []StoredAgent
+	for rows.Next() {
+		var id, data, apiKey string
+		if err := rows.Scan(&id, &data, &apiKey); err != nil {
+			return nil, err
+		}
+		agent := StoredAgent{APIKey: apiKey}
+		if err := json.Unmarshal([]byte(data), &agent.Agent); err != nil {
+			return nil, fmt.Errorf("agent %s: %w", id, err)
+		}
+		if secrets.IsSealed(apiKey) {
+			if s.cipher == nil {
+				return nil, fmt.Errorf("the API key of agent %s is encrypted; set SECRETS_KEY_FILE to decrypt it", id)
+			}
+			if agent.APIKey, err = s.cipher.Open(apiKey); err != nil {
+				return nil, fmt.Errorf("agent %s: %w", id, err)
+			}
+		} else if apiKey != "" && s.cipher != nil {
+			plaintext = append(plaintext, agent)
+		}
+		agents = append(agents, agent)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, agent := range plaintext {
+		if err := s.Save(agent); err != nil {
+			return nil, err
+		}
+	}
+	return agents, nil
+}
+
+// Save stores an agent, replacing any saved before under its ID
+func (s *DatabaseStore) Save(agent StoredAgent) error {
+	data, err := json.Marshal(agent.Agent)
+	if err != nil {
+		return err
+	}
+	apiKey := agent.APIKey
+	if apiKey != "" && s.cipher != nil {
+		if apiKey, err = s.cipher.Seal(apiKey); err != nil {
+			return err
+		}
+	}
+	_, err = s.db.Exec(`INSERT INTO agents (agent_id, data, api_key) VALUES (?, ?, ?)
+		ON CONFLICT (agent_id) DO UPDATE SET data = excluded.data, api_key = excluded.api_key`,
+		agent.Agent.AgentID, string(data), apiKey)
+	return err
+}
+
+// Delete removes a saved agent
+func (s *DatabaseStore) Delete(agentID string) error {
+	_, err := s.db.Exec(`DELETE FROM agents WHERE agent_id = ?`, agentID)
+	return err
+}
@@ -0,0 +1,91 @@
+package agents
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+var validZone = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// ValidateZone checks that a zone name is letters, digits, dots, dashes and
+// underscores, starting with a letter or digit. The empty zone is valid and
+// means no zone.
+func ValidateZone(zone string) error {
+	if zone != "" && !validZone.MatchString(zone) {
+		return fmt.Errorf("invalid zone name %q", zone)
+	}
+	return nil
+}
+
+// Zone gets the zone an agent belongs to. Agents registered before zones
+// were first-class may carry it as their "zone" tag instead.
+func Zone(agent *models.AgentInfo) string {
+	if agent.Zone != "" {
+		return agent.Zone
+	}
+	return agent.Tags["zone"]
+}
+
+// SetZone moves an agent to a zone, or out of its zone when zone is empty.
+// It returns the agent, or nil if it is not registered.
+func (r *AgentRegistry) SetZone(agentID, zone string) *models.AgentInfo {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	agent, exists := r.agents[agentID]
+	if !exists {
+		return nil
+	}
+	agent.Zone = zone
+	r.persist(agent)
+	return agent
+}
+
+// GetZoneAgents gets the agents in a zone
+func (r *AgentRegistry) GetZoneAgents(zone string) []*models.AgentInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	agents := make([]*models.AgentInfo, 0)
+	for _, agent := range r.agents {
+		if Zone(agent) == zone {
+			agents = append(agents, agent)
+		}
+	}
+	return agents
+}
+
+// Zones summarizes every zone that has agents, sorted by name. Agents outside
+// any zone are not counted.
+func (r *AgentRegistry) Zones() []models.ZoneInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	zones := make(map[string]*models.ZoneInfo)
+	for _, agent := range r.agents {
+		name := Zone(agent)
+		if name == "" {
+			continue
+		}
+		zone, exists := zones[name]
+		if !exists {
+			zone = &models.ZoneInfo{Name: name}
+			zones[name] = zone
+		}
+		zone.Agents++
+		zone.VMs += agent.VMCount
+		if agent.Status == "online" {
+			zone.Online++
+		}
+	}
+
+	list := make([]models.ZoneInfo, 0, len(zones))
+	for _, zone := range zones {
+		list = append(list, *zone)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,115 @@
+// Package apierror writes the error responses of the master and agents as a
+// models.ErrorResponse envelope: a stable code clients can switch on, a
+// message for people, optional details and the request's ID.
+package apierror
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/multipass"
+	"github.com/prashah/batwa/pkg/requestid"
+)
+
+// statusCodes are the generic codes of HTTP statuses
+var statusCodes = map[int]string{
+	400: models.ErrCodeInvalidRequest,
+	401: models.ErrCodeUnauthorized,
+	403: models.ErrCodeForbidden,
+	404: models.ErrCodeNotFound,
+	405: models.ErrCodeNotFound,
+	409: models.ErrCodeConflict,
+	413: models.ErrCodeRequestTooLarge,
+	426: models.ErrCodeUpgradeRequired,
+	500: models.ErrCodeInternal,
+	501: models.ErrCodeNotImplemented,
+	502: models.ErrCodeUpstream,
+	503: models.ErrCodeUnavailable,
+	504: models.ErrCodeTimeout,
+}
+
+// codeStatuses are the statuses of the codes multipass failures map to
+var codeStatuses = map[string]int{
+	models.ErrCodeVMNotFound:           404,
+	models.ErrCodeVMAlreadyExists:      409,
+	models.ErrCodeVMAlreadyRunning:     409,
+	models.ErrCodeTimeout:              504,
+	models.ErrCodeMultipassUnavailable: 503,
+}
+
+// Code picks the code of a failure answered with status. Server side failures
+// are classified by the multipass failure the message describes, if any;
+// everything else gets the generic code of its status.
+func Code(status int, message string) string {
+	if status >= 500 {
+		if code := multipass.ErrorCode(message); code != "" {
+			return code
+		}
+	}
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return models.ErrCodeInternal
+	}
+	return models.ErrCodeInvalidRequest
+}
+
+// Status picks the status of a server side failure with code, so a VM that
+// does not exist is a 404 rather than a 500
+func Status(status int, code string) int {
+	if mapped, ok := codeStatuses[code]; ok && status >= 500 {
+		return mapped
+	}
+	return status
+}
+
+// New builds the error for a failure answered with status, coded as Code
+// does, without a request ID; it is for failures reported inside a larger
+// response, such as one VM of a batch
+func New(status int, message string) *models.ErrorResponse {
+	return &models.ErrorResponse{Code: Code(status, message), Message: message}
+}
+
+// Respond writes an error response with the code Code picks
+func Respond(c *fiber.Ctx, status int, message string) error {
+	code := Code(status, message)
+	return RespondDetails(c, Status(status, code), code, message, nil)
+}
+
+// RespondErr writes an error response for err. An error an agent answered
+// with keeps the agent's code.
+func RespondErr(c *fiber.Ctx, status int, err error) error {
+	var response *models.ErrorResponse
+	if errors.As(err, &response) && response.Code != "" {
+		return RespondDetails(c, Status(status, response.Code), response.Code, response.Message, response.Details)
+	}
+	return Respond(c, status, err.Error())
+}
+
+// RespondCode writes an error response with a specific code
+func RespondCode(c *fiber.Ctx, status int, code, message string) error {
+	return RespondDetails(c, status, code, message, nil)
+}
+
+// RespondDetails writes an error response with a specific code and details
+func RespondDetails(c *fiber.Ctx, status int, code, message string, details interface{}) error {
+	return c.Status(status).JSON(models.ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: requestid.Get(c),
+	})
+}
+
+// Handler is the Fiber error handler, answering errors handlers return, such
+// as unknown routes and oversized bodies, with the envelope too
+func Handler(c *fiber.Ctx, err error) error {
+	status := fiber.StatusInternalServerError
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		status = fiberErr.Code
+	}
+	return RespondErr(c, status, err)
+}
@@ -0,0 +1,78 @@
+// Package apiversion versions the master's API. Its routes live under
+// Prefix; requests to the unversioned /api paths they had before are served
+// by the current version through Shim, which marks their answers deprecated
+// and points to the versioned path, so existing UIs and scripts keep working
+// while they move over.
+package apiversion
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Current is the version of the API the master serves
+const Current = "v1"
+
+// Prefix is the path prefix of the current version's routes
+const Prefix = "/api/" + Current
+
+// legacyPrefix is the prefix of the unversioned paths
+const legacyPrefix = "/api/"
+
+// LocalsLegacy is the fiber.Ctx local set to the path a request was sent to
+// when Shim rewrote it
+const LocalsLegacy = "legacy_path"
+
+// Path gives the versioned path of an API path relative to /api, such as
+// /tasks/abc for /api/v1/tasks/abc
+func Path(path string) string {
+	return Prefix + path
+}
+
+// IsVersioned reports whether a path is under a version prefix, such as
+// /api/v1 or /api/v2/vm/list
+func IsVersioned(path string) bool {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, legacyPrefix), "/")
+	if !strings.HasPrefix(path, legacyPrefix) || len(segment) < 2 || segment[0] != 'v' {
+		return false
+	}
+	for _, r := range segment[1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Trim gives an API path without its /api or /api/v1 prefix, such as
+// /vm/list for both /api/vm/list and /api/v1/vm/list
+func Trim(path string) string {
+	if IsVersioned(path) {
+		_, rest, _ := strings.Cut(strings.TrimPrefix(path, legacyPrefix), "/")
+		return "/" + rest
+	}
+	return "/" + strings.TrimPrefix(path, legacyPrefix)
+}
+
+// Shim returns middleware serving requests to unversioned /api paths by the
+// current version. It rewrites the path before routing, so the rest of the
+// stack only ever sees versioned paths, and answers with a Deprecation
+// header and a Link to the versioned path.
+func Shim() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		path := c.Path()
+		if !strings.HasPrefix(path, legacyPrefix) || IsVersioned(path) {
+			return c.Next()
+		}
+		// Fiber's strings point into buffers the rewrite overwrites
+		legacy := utils.CopyString(path)
+		versioned := Path(Trim(legacy))
+		c.Path(versioned)
+		c.Locals(LocalsLegacy, legacy)
+		c.Set("Deprecation", "true")
+		c.Append(fiber.HeaderLink, "<"+versioned+">; rel=\"successor-version\"")
+		return c.Next()
+	}
+}
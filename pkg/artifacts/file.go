@@ -0,0 +1,66 @@
+package artifacts
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FileBackend stores artifact contents as files in a directory
+type FileBackend struct {
+	dir string
+}
+
+// NewFileBackend creates a backend storing files in dir
+func NewFileBackend(dir string) *FileBackend {
+	return &FileBackend{dir: dir}
+}
+
+// Name identifies the backend
+func (b *FileBackend) Name() string {
+	return "filesystem"
+}
+
+// Put writes the contents to a temp file and renames it into place, so a
+// failed write never leaves a partial artifact behind
+func (b *FileBackend) Put(key string, r io.Reader, size int64) error {
+	if err := os.MkdirAll(b.dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(b.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path(key))
+}
+
+// Get opens the file stored under key
+func (b *FileBackend) Get(key string) (io.ReadCloser, error) {
+	file, err := os.Open(b.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+// Delete removes the file stored under key; a missing file is not an error
+func (b *FileBackend) Delete(key string) error {
+	if err := os.Remove(b.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// path gets the file path for key
+func (b *FileBackend) path(key string) string {
+	return filepath.Join(b.dir, filepath.Base(key))
+}
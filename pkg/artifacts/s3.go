@@ -0,0 +1,206 @@
+package artifacts
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// unsignedPayload lets uploads stream without hashing the body up front
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3Backend stores artifact contents as objects in an S3 (or S3-compatible)
+// bucket. Requests are signed with AWS Signature Version 4.
+type S3Backend struct {
+	bucket       string
+	prefix       string
+	region       string
+	endpoint     *url.URL
+	pathStyle    bool
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+// NewS3BackendFromEnv configures an S3 backend for bucket from the environment:
+// ARTIFACT_S3_REGION (default us-east-1), ARTIFACT_S3_PREFIX, and
+// ARTIFACT_S3_ENDPOINT for S3-compatible stores such as MinIO, which are
+// addressed path-style. Credentials come from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and optionally AWS_SESSION_TOKEN.
+func NewS3BackendFromEnv(bucket string) (*S3Backend, error) {
+	backend := &S3Backend{
+		bucket:       bucket,
+		prefix:       strings.Trim(os.Getenv("ARTIFACT_S3_PREFIX"), "/"),
+		region:       os.Getenv("ARTIFACT_S3_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if backend.region == "" {
+		backend.region = "us-east-1"
+	}
+	if backend.accessKey == "" || backend.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+
+	if endpoint := os.Getenv("ARTIFACT_S3_ENDPOINT"); endpoint != "" {
+		parsed, err := url.Parse(endpoint)
+		if err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid ARTIFACT_S3_ENDPOINT %q", endpoint)
+		}
+		backend.endpoint = parsed
+		backend.pathStyle = true
+	} else {
+		backend.endpoint = &url.URL{
+			Scheme: "https",
+			Host:   fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket, backend.region),
+		}
+	}
+
+	return backend, nil
+}
+
+// Name identifies the backend
+func (b *S3Backend) Name() string {
+	return "s3"
+}
+
+// Put uploads the contents as a single object
+func (b *S3Backend) Put(key string, r io.Reader, size int64) error {
+	req, err := b.request(http.MethodPut, key, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	_, err = b.do(req)
+	return err
+}
+
+// Get opens the object stored under key
+func (b *S3Backend) Get(key string) (io.ReadCloser, error) {
+	req, err := b.request(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return b.do(req)
+}
+
+// Delete removes the object stored under key
+func (b *S3Backend) Delete(key string) error {
+	req, err := b.request(http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	body, err := b.do(req)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+// request builds an unsigned request for the object stored under key
+func (b *S3Backend) request(method, key string, body io.Reader) (*http.Request, error) {
+	objectKey := key
+	if b.prefix != "" {
+		objectKey = b.prefix + "/" + key
+	}
+
+	objectURL := *b.endpoint
+	if b.pathStyle {
+		objectURL.Path = strings.TrimSuffix(objectURL.Path, "/") + "/" + b.bucket + "/" + objectKey
+	} else {
+		objectURL.Path = "/" + objectKey
+	}
+
+	return http.NewRequest(method, objectURL.String(), body)
+}
+
+// do signs and sends a request, returning the response body on success
+func (b *S3Backend) do(req *http.Request) (io.ReadCloser, error) {
+	b.sign(req, time.Now().UTC())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp.Body, nil
+}
+
+// sign adds AWS Signature Version 4 headers to the request
+func (b *S3Backend) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	if b.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.sessionToken)
+	}
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if b.sessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		unsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+b.secretKey), date)
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, strings.Join(signedHeaders, ";"), signature,
+	))
+}
+
+// hmacSHA256 computes HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
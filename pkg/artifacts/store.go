@@ -0,0 +1,241 @@
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+var logger = logging.For("artifacts")
+
+// ErrNotFound is returned for artifacts that are not in the store
+var ErrNotFound = errors.New("artifact not found")
+
+// Backend stores artifact contents by key
+type Backend interface {
+	// Name identifies the backend in artifact metadata
+	Name() string
+	// Put stores size bytes read from r under key
+	Put(key string, r io.Reader, size int64) error
+	// Get opens the contents stored under key
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the contents stored under key
+	Delete(key string) error
+}
+
+// Store keeps artifact contents in a backend and their metadata in a JSON
+// index file, so both survive restarts and the VMs they came from
+type Store struct {
+	backend   Backend
+	indexPath string
+	artifacts map[string]*models.Artifact
+	loaded    bool
+	mutex     sync.RWMutex
+}
+
+// NewStore creates a store for the given backend and index file. The index is
+// read lazily on first use.
+func NewStore(backend Backend, indexPath string) *Store {
+	return &Store{
+		backend:   backend,
+		indexPath: indexPath,
+		artifacts: make(map[string]*models.Artifact),
+	}
+}
+
+// load reads the index file once; the caller must hold the write lock
+func (s *Store) load() error {
+	if s.loaded {
+		return nil
+	}
+	data, err := os.ReadFile(s.indexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		var artifacts []*models.Artifact
+		if err := json.Unmarshal(data, &artifacts); err != nil {
+			return fmt.Errorf("invalid artifact index %s: %w", s.indexPath, err)
+		}
+		for _, artifact := range artifacts {
+			s.artifacts[artifact.ID] = artifact
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+// persist rewrites the index file; the caller must hold the write lock
+func (s *Store) persist() error {
+	artifacts := make([]*models.Artifact, 0, len(s.artifacts))
+	for _, artifact := range s.artifacts {
+		artifacts = append(artifacts, artifact)
+	}
+	data, err := json.MarshalIndent(artifacts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.indexPath), 0o755); err != nil {
+		return err
+	}
+	tmp := s.indexPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.indexPath)
+}
+
+// Save stores the contents of r as a new artifact described by meta and
+// returns the completed metadata. The contents are spooled to a temp file first
+// to learn their size and checksum before handing them to the backend.
+func (s *Store) Save(meta models.Artifact, r io.Reader) (*models.Artifact, error) {
+	spool, err := os.CreateTemp("", "batwa-artifact-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	artifact := meta
+	artifact.ID = uuid.New().String()
+	artifact.Size = size
+	artifact.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	artifact.Backend = s.backend.Name()
+	artifact.CreatedAt = time.Now()
+	if artifact.Name == "" {
+		artifact.Name = filepath.Base(artifact.Path)
+	}
+
+	if err := s.backend.Put(artifact.ID, spool, size); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.artifacts[artifact.ID] = &artifact
+	if err := s.persist(); err != nil {
+		delete(s.artifacts, artifact.ID)
+		s.backend.Delete(artifact.ID)
+		return nil, err
+	}
+
+	return &artifact, nil
+}
+
+// Get gets an artifact's metadata
+func (s *Store) Get(id string) (*models.Artifact, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	artifact, exists := s.artifacts[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return artifact, nil
+}
+
+// List lists artifacts accepted by filter, newest first. A nil filter
+// accepts every artifact.
+func (s *Store) List(filter func(*models.Artifact) bool) ([]*models.Artifact, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	artifacts := []*models.Artifact{}
+	for _, artifact := range s.artifacts {
+		if filter == nil || filter(artifact) {
+			artifacts = append(artifacts, artifact)
+		}
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].CreatedAt.After(artifacts[j].CreatedAt)
+	})
+	return artifacts, nil
+}
+
+// Open opens an artifact's contents for reading
+func (s *Store) Open(id string) (io.ReadCloser, error) {
+	if _, err := s.Get(id); err != nil {
+		return nil, err
+	}
+	return s.backend.Get(id)
+}
+
+// Delete removes an artifact and its contents
+func (s *Store) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	artifact, exists := s.artifacts[id]
+	if !exists {
+		return ErrNotFound
+	}
+
+	if err := s.backend.Delete(id); err != nil {
+		return err
+	}
+	delete(s.artifacts, id)
+	if err := s.persist(); err != nil {
+		s.artifacts[id] = artifact
+		return err
+	}
+	return nil
+}
+
+// storeDir reads ARTIFACT_DIR, defaulting to ./data/artifacts
+func storeDir() string {
+	if dir := os.Getenv("ARTIFACT_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join("data", "artifacts")
+}
+
+// backendFromEnv selects the S3 backend when ARTIFACT_S3_BUCKET is set and the
+// filesystem backend otherwise
+func backendFromEnv() Backend {
+	if bucket := os.Getenv("ARTIFACT_S3_BUCKET"); bucket != "" {
+		backend, err := NewS3BackendFromEnv(bucket)
+		if err == nil {
+			return backend
+		}
+		logger.Warn("Artifact S3 backend disabled, storing artifacts on disk", "error", err)
+	}
+	return NewFileBackend(filepath.Join(storeDir(), "blobs"))
+}
+
+// NewStoreFromEnv creates an artifact store indexed in ARTIFACT_DIR (default
+// ./data/artifacts), keeping artifacts in the S3 bucket ARTIFACT_S3_BUCKET
+// when it is set and in the directory otherwise
+func NewStoreFromEnv() *Store {
+	return NewStore(backendFromEnv(), filepath.Join(storeDir(), "index.json"))
+}
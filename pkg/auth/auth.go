@@ -1,50 +1,701 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/prashah/batwa/pkg/logging"
 	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/secrets"
+	"github.com/prashah/batwa/pkg/storage"
+	"golang.org/x/crypto/bcrypt"
 )
 
-// Simple in-memory session and user storage
-// In production, use Redis or a database
+var logger = logging.For("auth")
+
+// MinPasswordLength is the shortest password accepted
+const MinPasswordLength = 8
+
+// maxPasswordLength is the longest password bcrypt can hash
+const maxPasswordLength = 72
+
 var (
-	Sessions = make(map[string]*models.Session)
-	Users    = map[string]string{
-		"admin": "admin123", // username: password
-	}
-	sessionMutex sync.RWMutex
+	// ErrUserExists is returned when creating a user whose name is taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrUserNotFound is returned for an unknown username
+	ErrUserNotFound = errors.New("user not found")
+	// ErrLastAdmin is returned when deleting the only admin
+	ErrLastAdmin = errors.New("cannot delete the last admin")
+	// ErrWrongPassword is returned when the current password does not match
+	ErrWrongPassword = errors.New("current password is incorrect")
+	// ErrExternalUser is returned when changing the password of a user who
+	// signs in through an identity provider
+	ErrExternalUser = errors.New("password is managed by the identity provider")
+	// ErrLocalUser is returned when an identity provider signs in a user
+	// whose name belongs to a local account
+	ErrLocalUser = errors.New("a local account with this username already exists")
 )
 
-// CheckAuth checks if a session ID is valid
-func CheckAuth(sessionID string) bool {
-	if sessionID == "" {
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._@-]{0,63}$`)
+
+// Service keeps users, saved to a UserRepository after every change, and
+// their sessions, held in a SessionStore. A session expires after sessionTTL
+// without use, and sessionMaxAge after it was created however much it is
+// used.
+type Service struct {
+	repository    UserRepository
+	users         map[string]*models.User
+	sessions      SessionStore
+	sessionTTL    time.Duration
+	sessionMaxAge time.Duration
+	// jwt signs and verifies JWTs, or is nil when they are disabled
+	jwt *JWTSigner
+	// tickets signs terminal tickets
+	tickets   *tickets
+	userMutex sync.RWMutex
+	// dummyHash is compared against for unknown users, so a login takes as
+	// long whether or not the username exists
+	dummyHash []byte
+}
+
+// NewService creates an auth service persisting users to repository, loading
+// the users already saved there, and keeping sessions in sessions
+func NewService(repository UserRepository, sessions SessionStore, sessionTTL, sessionMaxAge time.Duration) (*Service, error) {
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	ticketSigner, err := newTickets(nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{
+		repository:    repository,
+		users:         make(map[string]*models.User),
+		sessions:      sessions,
+		sessionTTL:    sessionTTL,
+		sessionMaxAge: sessionMaxAge,
+		tickets:       ticketSigner,
+		dummyHash:     dummyHash,
+	}
+	users, err := repository.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load users: %w", err)
+	}
+	s.users = users
+	return s, nil
+}
+
+// NewServiceFromEnv creates an auth service persisting users in db, or at
+// USERS_PATH (default ./data/users.json) when db is nil, with sessions in the
+// store chosen by SESSION_STORE that expire after SESSION_TTL (default 24h) without use or
+// SESSION_MAX_AGE (default 168h) after login. When no users exist yet, it creates an admin
+// named ADMIN_USERNAME (default admin) with the password ADMIN_PASSWORD, or a
+// random one written to initial_admin_password beside USERS_PATH; either must
+// be changed at first login.
+func NewServiceFromEnv(resolver *secrets.Resolver, db *storage.DB) (*Service, error) {
+	path := os.Getenv("USERS_PATH")
+	if path == "" {
+		path = filepath.Join("data", "users.json")
+	}
+	var repository UserRepository = NewFileUserRepository(path)
+	if db != nil {
+		repository = NewDatabaseUserRepository(db)
+		if err := importUsers(db, path, repository); err != nil {
+			return nil, err
+		}
+	}
+	ttl, maxAge, err := sessionLifetimesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := NewSessionStoreFromEnv(db)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := NewJWTSignerFromEnv(resolver)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewService(repository, sessions, ttl, maxAge)
+	if err != nil {
+		sessions.Close()
+		return nil, err
+	}
+	if signer != nil {
+		// Replicas sharing JWT_SECRET accept each other's terminal tickets
+		s.jwt = signer
+		s.tickets.key = signer.deriveKey("terminal-tickets")
+	}
+
+	if len(s.ListUsers()) > 0 {
+		return s, nil
+	}
+	username := os.Getenv("ADMIN_USERNAME")
+	if username == "" {
+		username = "admin"
+	}
+	password := os.Getenv("ADMIN_PASSWORD")
+	generated := password == ""
+	if generated {
+		password, err = randomPassword()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.CreateUser(username, password, true); err != nil {
+		return nil, fmt.Errorf("failed to create the initial admin: %w", err)
+	}
+	if generated {
+		// Logs are often shipped and indexed, so the password stays out of them
+		passwordPath := filepath.Join(filepath.Dir(path), "initial_admin_password")
+		if err := writePasswordFile(passwordPath, password); err != nil {
+			logger.Error("Failed to write the generated admin password; printing it to stderr instead", "path", passwordPath, "error", err)
+			fmt.Fprintf(os.Stderr, "Initial password of admin user %s: %s\n", username, password)
+		} else {
+			logger.Warn("Created admin user with a generated password; it must be changed at first login", "user", username, "password_file", passwordPath)
+		}
+	} else {
+		logger.Info("Created admin user from ADMIN_PASSWORD; it must be changed at first login", "user", username)
+	}
+	return s, nil
+}
+
+// writePasswordFile saves the initial admin's generated password to path,
+// readable by the master's user only
+func writePasswordFile(path, password string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(password+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// randomPassword generates a password for the initial admin
+func randomPassword() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ValidateUsername checks that a username is 1-64 letters, digits, dots,
+// underscores, at signs or hyphens, starting with a letter or digit
+func ValidateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("invalid username %q: use up to 64 letters, digits, '.', '_', '@' or '-', starting with a letter or digit", username)
+	}
+	return nil
+}
+
+// ValidatePassword checks that a password is long enough and short enough
+// to hash
+func ValidatePassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordLength)
+	}
+	return nil
+}
+
+// userInfo describes a user without the password hash
+func userInfo(user *models.User) models.UserInfo {
+	return models.UserInfo{
+		Username:           user.Username,
+		Admin:              user.Admin,
+		MustChangePassword: user.MustChangePassword,
+		CreatedAt:          user.CreatedAt,
+		PasswordChangedAt:  user.PasswordChangedAt,
+		ServiceAccount:     user.ServiceAccount,
+		Identity:           user.Identity,
+		Roles:              append([]string(nil), user.Roles...),
+	}
+}
+
+// CreateUser adds a user, who must change the password on first login
+func (s *Service) CreateUser(username, password string, admin bool) (models.UserInfo, error) {
+	if err := ValidateUsername(username); err != nil {
+		return models.UserInfo{}, err
+	}
+	if err := ValidatePassword(password); err != nil {
+		return models.UserInfo{}, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return models.UserInfo{}, err
+	}
+
+	s.userMutex.Lock()
+	defer s.userMutex.Unlock()
+	if _, exists := s.users[username]; exists {
+		return models.UserInfo{}, ErrUserExists
+	}
+	now := time.Now()
+	user := &models.User{
+		Username:           username,
+		PasswordHash:       string(hash),
+		Admin:              admin,
+		MustChangePassword: true,
+		CreatedAt:          now,
+		PasswordChangedAt:  now,
+	}
+	if err := s.repository.Save(user); err != nil {
+		return models.UserInfo{}, err
+	}
+	s.users[username] = user
+	logger.Info("Created user", "user", username, "admin", admin)
+	return userInfo(user), nil
+}
+
+// CreateServiceAccount adds an account for automation. It has no password,
+// so it cannot log in, and acts through API tokens issued to it by an admin.
+func (s *Service) CreateServiceAccount(username string, admin bool) (models.UserInfo, error) {
+	if err := ValidateUsername(username); err != nil {
+		return models.UserInfo{}, err
+	}
+
+	s.userMutex.Lock()
+	defer s.userMutex.Unlock()
+	if _, exists := s.users[username]; exists {
+		return models.UserInfo{}, ErrUserExists
+	}
+	user := &models.User{
+		Username:       username,
+		Admin:          admin,
+		CreatedAt:      time.Now(),
+		ServiceAccount: true,
+	}
+	if err := s.repository.Save(user); err != nil {
+		return models.UserInfo{}, err
+	}
+	s.users[username] = user
+	logger.Info("Created service account", "user", username, "admin", admin)
+	return userInfo(user), nil
+}
+
+// SyncExternalUser creates or updates a user signed in by an identity
+// provider, setting their admin flag and roles from the provider's groups.
+// It reports whether the user was created. A local account of the same name
+// is never taken over, and the last admin keeps admin rights.
+func (s *Service) SyncExternalUser(identity, username string, admin bool, roles []string) (models.UserInfo, bool, error) {
+	if err := ValidateUsername(username); err != nil {
+		return models.UserInfo{}, false, err
+	}
+
+	s.userMutex.Lock()
+	defer s.userMutex.Unlock()
+	user, exists := s.users[username]
+	if exists && user.Identity != identity {
+		return models.UserInfo{}, false, ErrLocalUser
+	}
+	if !exists {
+		now := time.Now()
+		user = &models.User{
+			Username:          username,
+			Admin:             admin,
+			CreatedAt:         now,
+			PasswordChangedAt: now,
+			Identity:          identity,
+			Roles:             append([]string(nil), roles...),
+		}
+		if err := s.repository.Save(user); err != nil {
+			return models.UserInfo{}, false, err
+		}
+		s.users[username] = user
+		logger.Info("Created user", "identity", identity, "user", username, "admin", admin, "roles", roles)
+		return userInfo(user), true, nil
+	}
+
+	if user.Admin && !admin && s.adminCount() == 1 {
+		logger.Warn("Keeping admin rights of the last admin", "identity", identity, "user", username)
+		admin = true
+	}
+	if user.Admin == admin && equalStrings(user.Roles, roles) {
+		return userInfo(user), false, nil
+	}
+	previous := *user
+	user.Admin = admin
+	user.Roles = append([]string(nil), roles...)
+	if err := s.repository.Save(user); err != nil {
+		*user = previous
+		return models.UserInfo{}, false, err
+	}
+	logger.Info("Updated user", "identity", identity, "user", username, "admin", admin, "roles", roles)
+	return userInfo(user), false, nil
+}
+
+// IsExternalUser reports whether a user signs in through an identity provider
+func (s *Service) IsExternalUser(username string) bool {
+	s.userMutex.RLock()
+	defer s.userMutex.RUnlock()
+	user, exists := s.users[username]
+	return exists && user.Identity != ""
+}
+
+// containsString reports whether list includes value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// equalStrings reports whether two lists hold the same strings in order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
 		return false
 	}
-	sessionMutex.RLock()
-	defer sessionMutex.RUnlock()
-	_, exists := Sessions[sessionID]
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// DeleteUser removes a user and ends their sessions. The last admin cannot
+// be deleted.
+func (s *Service) DeleteUser(username string) error {
+	s.userMutex.Lock()
+	user, exists := s.users[username]
+	if !exists {
+		s.userMutex.Unlock()
+		return ErrUserNotFound
+	}
+	if user.Admin && s.adminCount() == 1 {
+		s.userMutex.Unlock()
+		return ErrLastAdmin
+	}
+	if err := s.repository.Delete(username); err != nil {
+		s.userMutex.Unlock()
+		return err
+	}
+	delete(s.users, username)
+	s.userMutex.Unlock()
+
+	if err := s.sessions.DeleteUser(username); err != nil {
+		logger.Error("Failed to end the sessions of deleted user", "user", username, "error", err)
+	}
+	logger.Info("Deleted user", "user", username)
+	return nil
+}
+
+// adminCount counts the admins; the caller must hold the user lock
+func (s *Service) adminCount() int {
+	count := 0
+	for _, user := range s.users {
+		if user.Admin {
+			count++
+		}
+	}
+	return count
+}
+
+// ListUsers lists the users ordered by username
+func (s *Service) ListUsers() []models.UserInfo {
+	s.userMutex.RLock()
+	defer s.userMutex.RUnlock()
+
+	users := make([]models.UserInfo, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, userInfo(user))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+// Users gets every user with their password hash, for backups, ordered by
+// username
+func (s *Service) Users() []models.User {
+	s.userMutex.RLock()
+	defer s.userMutex.RUnlock()
+
+	users := make([]models.User, 0, len(s.users))
+	for _, user := range s.users {
+		copied := *user
+		copied.Roles = append([]string(nil), user.Roles...)
+		users = append(users, copied)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+// RestoreUsers replaces every user with those a backup saved, password
+// hashes included. It fails unless they include an admin.
+func (s *Service) RestoreUsers(users []models.User) error {
+	restored := make(map[string]*models.User, len(users))
+	admin := false
+	for i := range users {
+		user := users[i]
+		if err := ValidateUsername(user.Username); err != nil {
+			return fmt.Errorf("user '%s': %w", user.Username, err)
+		}
+		restored[user.Username] = &user
+		admin = admin || user.Admin
+	}
+	if !admin {
+		return errors.New("the users include no admin")
+	}
+
+	s.userMutex.Lock()
+	defer s.userMutex.Unlock()
+	for _, user := range restored {
+		if err := s.repository.Save(user); err != nil {
+			return err
+		}
+	}
+	for username := range s.users {
+		if _, kept := restored[username]; kept {
+			continue
+		}
+		if err := s.repository.Delete(username); err != nil {
+			return err
+		}
+	}
+	s.users = restored
+	return nil
+}
+
+// ChangePassword replaces a user's password after checking the current one,
+// lifting a required password change
+func (s *Service) ChangePassword(username, current, password string) error {
+	if s.IsExternalUser(username) {
+		return ErrExternalUser
+	}
+	if !s.VerifyPassword(username, current) {
+		return ErrWrongPassword
+	}
+	if err := ValidatePassword(password); err != nil {
+		return err
+	}
+	if password == current {
+		return errors.New("new password must differ from the current one")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	s.userMutex.Lock()
+	defer s.userMutex.Unlock()
+	user, exists := s.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	previous := *user
+	user.PasswordHash = string(hash)
+	user.MustChangePassword = false
+	user.PasswordChangedAt = time.Now()
+	if err := s.repository.Save(user); err != nil {
+		*user = previous
+		return err
+	}
+	logger.Info("User changed their password", "user", username)
+	return nil
+}
+
+// HasUser reports whether a user exists
+func (s *Service) HasUser(username string) bool {
+	s.userMutex.RLock()
+	defer s.userMutex.RUnlock()
+	_, exists := s.users[username]
+	return exists
+}
+
+// IsServiceAccount reports whether a username belongs to a service account
+func (s *Service) IsServiceAccount(username string) bool {
+	s.userMutex.RLock()
+	defer s.userMutex.RUnlock()
+	user, exists := s.users[username]
+	return exists && user.ServiceAccount
+}
+
+// MustChangePassword reports whether a user has to change their password
+// before using the API
+func (s *Service) MustChangePassword(username string) bool {
+	s.userMutex.RLock()
+	defer s.userMutex.RUnlock()
+	user, exists := s.users[username]
+	return exists && user.MustChangePassword
+}
+
+// VerifyPassword checks a username and password. Service accounts have no
+// password and never match.
+func (s *Service) VerifyPassword(username, password string) bool {
+	s.userMutex.RLock()
+	user, exists := s.users[username]
+	valid := exists && !user.ServiceAccount && user.Identity == ""
+	hash := s.dummyHash
+	if valid {
+		hash = []byte(user.PasswordHash)
+	}
+	s.userMutex.RUnlock()
+
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && valid
+}
+
+// CheckAuth checks if a session ID is valid
+func (s *Service) CheckAuth(sessionID string) bool {
+	_, exists := s.GetSession(sessionID)
 	return exists
 }
 
-// GetSession gets a session by ID
-func GetSession(sessionID string) (*models.Session, bool) {
-	sessionMutex.RLock()
-	defer sessionMutex.RUnlock()
-	session, exists := Sessions[sessionID]
-	return session, exists
+// GetSession gets a live session by ID. Once half of its TTL has passed
+// unused, the session is renewed for another TTL, up to its max age, so
+// active users stay logged in without every request writing to the store.
+func (s *Service) GetSession(sessionID string) (*models.Session, bool) {
+	if sessionID == "" {
+		return nil, false
+	}
+	if token, found := strings.CutPrefix(sessionID, JWTSessionPrefix); found {
+		return s.jwtSession(token)
+	}
+	session, err := s.sessions.Get(sessionID)
+	if err != nil {
+		logger.Error("Failed to load session", "error", err)
+		return nil, false
+	}
+	if session == nil {
+		return nil, false
+	}
+
+	now := time.Now()
+	renewed := now.Add(s.sessionTTL)
+	if limit := session.CreatedAt.Add(s.sessionMaxAge); renewed.After(limit) {
+		renewed = limit
+	}
+	if renewed.Sub(session.ExpiresAt) > s.sessionTTL/2 {
+		session.ExpiresAt = renewed
+		if err := s.sessions.Save(sessionID, session); err != nil {
+			logger.Error("Failed to renew session", "error", err)
+		}
+	}
+	return session, true
 }
 
-// SetSession sets a session
-func SetSession(sessionID string, session *models.Session) {
-	sessionMutex.Lock()
-	defer sessionMutex.Unlock()
-	Sessions[sessionID] = session
+// SetSession starts a session, which expires after the session TTL unless it
+// is used
+func (s *Service) SetSession(sessionID string, session *models.Session) {
+	session.CreatedAt = time.Now()
+	session.ExpiresAt = session.CreatedAt.Add(s.sessionTTL)
+	if err := s.sessions.Save(sessionID, session); err != nil {
+		logger.Error("Failed to save session", "error", err)
+	}
 }
 
 // DeleteSession deletes a session
-func DeleteSession(sessionID string) {
-	sessionMutex.Lock()
-	defer sessionMutex.Unlock()
-	delete(Sessions, sessionID)
+func (s *Service) DeleteSession(sessionID string) {
+	if err := s.sessions.Delete(sessionID); err != nil {
+		logger.Error("Failed to delete session", "error", err)
+	}
+}
+
+// SessionMaxAge is the longest a session can last, for the lifetime of
+// session cookies
+func (s *Service) SessionMaxAge() time.Duration {
+	return s.sessionMaxAge
+}
+
+// Reload loads the users again from the repository, picking up the changes
+// other masters sharing it made
+func (s *Service) Reload() error {
+	s.userMutex.Lock()
+	defer s.userMutex.Unlock()
+	users, err := s.repository.Load()
+	if err != nil {
+		return err
+	}
+	s.users = users
+	return nil
+}
+
+// Close closes the session store
+func (s *Service) Close() error {
+	return s.sessions.Close()
+}
+
+// CheckStorage checks that users can still be saved and that the session
+// store can be reached
+func (s *Service) CheckStorage() error {
+	if err := s.repository.Ping(); err != nil {
+		return fmt.Errorf("users: %w", err)
+	}
+	if err := s.sessions.Ping(); err != nil {
+		return fmt.Errorf("session store: %w", err)
+	}
+	return nil
+}
+
+// IsAdmin checks if a session belongs to an administrator
+func (s *Service) IsAdmin(sessionID string) bool {
+	session, exists := s.GetSession(sessionID)
+	if !exists {
+		return false
+	}
+	return s.isAdminUser(session.Username)
+}
+
+// isAdminUser reports whether a username belongs to an administrator
+func (s *Service) isAdminUser(username string) bool {
+	s.userMutex.RLock()
+	defer s.userMutex.RUnlock()
+	user, exists := s.users[username]
+	return exists && user.Admin
+}
+
+// Admins lists the administrator usernames
+func (s *Service) Admins() []string {
+	s.userMutex.RLock()
+	defer s.userMutex.RUnlock()
+
+	admins := []string{}
+	for username, user := range s.users {
+		if user.Admin {
+			admins = append(admins, username)
+		}
+	}
+	sort.Strings(admins)
+	return admins
+}
+
+// Roles gets the roles of a user, as exposed to authorization policies
+func (s *Service) Roles(username string) []string {
+	roles := []string{"user"}
+	if s.isAdminUser(username) {
+		roles = append(roles, "admin")
+	}
+	if s.IsServiceAccount(username) {
+		roles = append(roles, "service_account")
+	}
+	s.userMutex.RLock()
+	defer s.userMutex.RUnlock()
+	if user, exists := s.users[username]; exists {
+		for _, role := range user.Roles {
+			if !containsString(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
 }
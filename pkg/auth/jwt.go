@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/secrets"
+)
+
+// DefaultAccessTTL is how long a JWT access token is valid
+const DefaultAccessTTL = 15 * time.Minute
+
+// DefaultRefreshTTL is how long a JWT refresh token is valid
+const DefaultRefreshTTL = 7 * 24 * time.Hour
+
+// minJWTSecretLength is the shortest JWT_SECRET accepted, in bytes
+const minJWTSecretLength = 32
+
+// jwtIssuer is the iss claim of every token this master signs
+const jwtIssuer = "batwa"
+
+// Kinds of JWT, kept in the typ claim so a refresh token cannot be used as an
+// access token or the other way round
+const (
+	accessKind  = "access"
+	refreshKind = "refresh"
+)
+
+// jwtHeader is the encoded header of every token: HS256 is the only
+// algorithm signed or accepted
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// ErrInvalidToken is returned for a JWT that is malformed, wrongly signed,
+// expired or of the wrong kind
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// ErrJWTDisabled is returned when issuing JWTs without JWT_SECRET set
+var ErrJWTDisabled = errors.New("JWT authentication is not enabled; set JWT_SECRET")
+
+// jwtClaims are the claims of the tokens this master signs
+type jwtClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+	Kind      string `json:"typ"`
+}
+
+// JWTSigner signs and verifies HS256 JWTs. Every master replica configured
+// with the same secret accepts the tokens of the others, so requests carrying
+// them need no shared session state.
+type JWTSigner struct {
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// NewJWTSigner creates a signer with a secret of at least 32 bytes
+func NewJWTSigner(secret []byte, accessTTL, refreshTTL time.Duration) (*JWTSigner, error) {
+	if len(secret) < minJWTSecretLength {
+		return nil, fmt.Errorf("JWT secret must be at least %d bytes", minJWTSecretLength)
+	}
+	return &JWTSigner{secret: secret, accessTTL: accessTTL, refreshTTL: refreshTTL}, nil
+}
+
+// NewJWTSignerFromEnv creates a signer from JWT_SECRET, with access tokens
+// valid for JWT_ACCESS_TTL (default 15m) and refresh tokens for
+// JWT_REFRESH_TTL (default 168h). JWT_SECRET may reference a secret in Vault
+// or a file, resolved by resolver at startup only, as changing it signs out
+// every JWT user. It returns nil when JWT_SECRET is unset, leaving JWTs
+// disabled.
+func NewJWTSignerFromEnv(resolver *secrets.Resolver) (*JWTSigner, error) {
+	secret, err := resolver.ResolveEnv("JWT_SECRET")
+	if err != nil || secret == "" {
+		return nil, err
+	}
+	accessTTL, err := durationFromEnv("JWT_ACCESS_TTL", DefaultAccessTTL)
+	if err != nil {
+		return nil, err
+	}
+	refreshTTL, err := durationFromEnv("JWT_REFRESH_TTL", DefaultRefreshTTL)
+	if err != nil {
+		return nil, err
+	}
+	return NewJWTSigner([]byte(secret), accessTTL, refreshTTL)
+}
+
+// durationFromEnv reads a positive duration such as 15m from an environment
+// variable, falling back to fallback when it is unset
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s': use a positive duration such as 15m or 12h", name, value)
+	}
+	return duration, nil
+}
+
+// Issue signs a new access and refresh token pair for username
+func (j *JWTSigner) Issue(username string) (models.TokenPair, error) {
+	now := time.Now()
+	access, err := j.sign(username, accessKind, now, j.accessTTL)
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	refresh, err := j.sign(username, refreshKind, now, j.refreshTTL)
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	return models.TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(j.accessTTL.Seconds()),
+	}, nil
+}
+
+// sign signs a token of kind for username, valid for ttl from now
+func (j *JWTSigner) sign(username, kind string, now time.Time, ttl time.Duration) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(jwtClaims{
+		Issuer:    jwtIssuer,
+		Subject:   username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		ID:        base64.RawURLEncoding.EncodeToString(id),
+		Kind:      kind,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return unsigned + "." + j.signature(unsigned), nil
+}
+
+// signature computes the encoded HMAC-SHA256 of the header and claims
+func (j *JWTSigner) signature(unsigned string) string {
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// deriveKey derives a key for another purpose from the signing secret
+func (j *JWTSigner) deriveKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// verify checks a token's signature, issuer, expiry and kind and returns its
+// claims
+func (j *JWTSigner) verify(token, kind string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	expected := j.signature(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return jwtClaims{}, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	if claims.Issuer != jwtIssuer || claims.Kind != kind || claims.Subject == "" ||
+		time.Now().Unix() >= claims.ExpiresAt {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// IsJWT reports whether a bearer credential is a JWT in the form this master
+// signs, rather than an API token
+func IsJWT(credential string) bool {
+	return strings.HasPrefix(credential, jwtHeader+".")
+}
+
+// JWTEnabled reports whether JWT_SECRET is set, so JWTs can be issued
+func (s *Service) JWTEnabled() bool {
+	return s.jwt != nil
+}
+
+// IssueTokens issues a JWT pair for a user whose password has been verified
+func (s *Service) IssueTokens(username string) (models.TokenPair, error) {
+	if s.jwt == nil {
+		return models.TokenPair{}, ErrJWTDisabled
+	}
+	return s.jwt.Issue(username)
+}
+
+// RefreshTokens exchanges a refresh token for a new JWT pair. The old refresh
+// token stays valid until it expires, since no state is kept to revoke it;
+// changing the password or deleting the user does revoke it.
+func (s *Service) RefreshTokens(refreshToken string) (models.TokenPair, error) {
+	if s.jwt == nil {
+		return models.TokenPair{}, ErrJWTDisabled
+	}
+	claims, err := s.jwt.verify(refreshToken, refreshKind)
+	if err != nil || !s.tokenUserValid(claims) {
+		return models.TokenPair{}, ErrInvalidToken
+	}
+	return s.jwt.Issue(claims.Subject)
+}
+
+// jwtSession gets the session an access token acts as, without any stored
+// state
+func (s *Service) jwtSession(token string) (*models.Session, bool) {
+	if s.jwt == nil {
+		return nil, false
+	}
+	claims, err := s.jwt.verify(token, accessKind)
+	if err != nil || !s.tokenUserValid(claims) {
+		return nil, false
+	}
+	return &models.Session{
+		Username:  claims.Subject,
+		CreatedAt: time.Unix(claims.IssuedAt, 0),
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}, true
+}
+
+// tokenUserValid reports whether the user of a JWT still exists and has not
+// changed their password since it was issued
+func (s *Service) tokenUserValid(claims jwtClaims) bool {
+	s.userMutex.RLock()
+	defer s.userMutex.RUnlock()
+	user, exists := s.users[claims.Subject]
+	return exists && claims.IssuedAt >= user.PasswordChangedAt.Unix()
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/prashah/batwa/pkg/apierror"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// Level is what a route demands of the session a request is made under
+type Level int
+
+const (
+	// Public routes need no session
+	Public Level = iota
+	// Pending routes need a session, even one whose user must still change
+	// their password
+	Pending
+	// User routes need the session of a user who has a password of their own
+	User
+	// Admin routes need an administrator's session
+	Admin
+)
+
+// Require returns middleware that lets a request through only if its session
+// meets level. It answers 401 without a valid session, and 403 while the user
+// must change their password or, for Admin routes, is not an administrator.
+func (s *Service) Require(level Level) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if level == Public {
+			return c.Next()
+		}
+
+		session, exists := s.GetSession(SessionID(c))
+		if !exists {
+			return apierror.Respond(c, 401, "Not authenticated")
+		}
+		if level >= User && s.MustChangePassword(session.Username) {
+			return apierror.RespondDetails(c, 403, models.ErrCodePasswordChangeRequired, "Password change required", fiber.Map{"must_change_password": true})
+		}
+		if level == Admin && !s.isAdminUser(session.Username) {
+			return apierror.Respond(c, 403, "Admin privileges required")
+		}
+		return c.Next()
+	}
+}
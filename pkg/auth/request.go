@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// LocalsSession is the fiber.Ctx local holding the session of a request
+// authenticated by other means than the session cookie, such as an API token
+const LocalsSession = "session_id"
+
+// TokenSessionPrefix starts the IDs of the sessions API tokens act under.
+// They are never accepted from a cookie, so a token's ID alone cannot be used
+// to impersonate it.
+const TokenSessionPrefix = "token:"
+
+// JWTSessionPrefix starts the session IDs of requests carrying a JWT access
+// token, followed by the token itself. Such sessions are never stored; the
+// token is verified each time the session is looked up.
+const JWTSessionPrefix = "jwt:"
+
+// SessionID gets the ID of the session a request is made under: the one set
+// by token authentication, one for a JWT bearer token, or else the session
+// cookie's
+func SessionID(c *fiber.Ctx) string {
+	if id, ok := c.Locals(LocalsSession).(string); ok {
+		return id
+	}
+	if token, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); found && IsJWT(token) {
+		return JWTSessionPrefix + token
+	}
+	id := c.Cookies("session_id")
+	if strings.HasPrefix(id, TokenSessionPrefix) || strings.HasPrefix(id, JWTSessionPrefix) {
+		return ""
+	}
+	return id
+}
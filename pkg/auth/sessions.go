@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+// DefaultSessionTTL is how long a session lasts without being used
+const DefaultSessionTTL = 24 * time.Hour
+
+// DefaultSessionMaxAge is how long a session lasts however often it is used
+const DefaultSessionMaxAge = 7 * 24 * time.Hour
+
+// sweepInterval is how often stores drop expired sessions
+const sweepInterval = time.Minute
+
+// SessionStore keeps sessions by ID. Stores never return a session past its
+// ExpiresAt; a missing or expired session is returned as nil without an
+// error.
+type SessionStore interface {
+	Get(id string) (*models.Session, error)
+	Save(id string, session *models.Session) error
+	Delete(id string) error
+	// DeleteUser deletes every session of a user
+	DeleteUser(username string) error
+	// Ping checks that the store can be reached
+	Ping() error
+	Close() error
+}
+
+// NewSessionStoreFromEnv creates the session store named by SESSION_STORE:
+// database, keeping sessions in db (the default when there is one), memory
+// (the default otherwise), redis at REDIS_URL (default
+// redis://localhost:6379/0) or sqlite at SESSION_DB_PATH (default
+// ./data/sessions.db)
+func NewSessionStoreFromEnv(db *storage.DB) (SessionStore, error) {
+	backend := os.Getenv("SESSION_STORE")
+	if backend == "" && db != nil {
+		backend = "database"
+	}
+	switch backend {
+	case "", "memory":
+		return NewMemorySessionStore(), nil
+	case "database":
+		if db == nil {
+			return nil, fmt.Errorf("SESSION_STORE=database needs a database: set STORAGE_DRIVER to sqlite or postgres")
+		}
+		return NewDatabaseSessionStore(db), nil
+	case "redis":
+		url := os.Getenv("REDIS_URL")
+		if url == "" {
+			url = "redis://localhost:6379/0"
+		}
+		return NewRedisSessionStore(url)
+	case "sqlite":
+		path := os.Getenv("SESSION_DB_PATH")
+		if path == "" {
+			path = filepath.Join("data", "sessions.db")
+		}
+		return NewSQLiteSessionStore(path)
+	default:
+		return nil, fmt.Errorf("unknown SESSION_STORE '%s': use database, memory, redis or sqlite", backend)
+	}
+}
+
+// sessionLifetimesFromEnv reads SESSION_TTL and SESSION_MAX_AGE, durations
+// such as 12h, falling back to the defaults
+func sessionLifetimesFromEnv() (ttl, maxAge time.Duration, err error) {
+	if ttl, err = durationFromEnv("SESSION_TTL", DefaultSessionTTL); err != nil {
+		return 0, 0, err
+	}
+	if maxAge, err = durationFromEnv("SESSION_MAX_AGE", DefaultSessionMaxAge); err != nil {
+		return 0, 0, err
+	}
+	if maxAge < ttl {
+		maxAge = ttl
+	}
+	return ttl, maxAge, nil
+}
+
+// MemorySessionStore keeps sessions in memory, so they end when the master
+// restarts
+type MemorySessionStore struct {
+	sessions  map[string]models.Session
+	lastSweep time.Time
+	mutex     sync.RWMutex
+}
+
+// NewMemorySessionStore creates an empty in-memory session store
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]models.Session)}
+}
+
+// Get gets a session by ID
+func (m *MemorySessionStore) Get(id string) (*models.Session, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	session, exists := m.sessions[id]
+	if !exists || !time.Now().Before(session.ExpiresAt) {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+// Save saves a session, dropping expired ones at most once a sweepInterval
+func (m *MemorySessionStore) Save(id string, session *models.Session) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sessions[id] = *session
+
+	now := time.Now()
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return nil
+	}
+	m.lastSweep = now
+	for id, session := range m.sessions {
+		if !now.Before(session.ExpiresAt) {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// Delete deletes a session
+func (m *MemorySessionStore) Delete(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// DeleteUser deletes every session of a user
+func (m *MemorySessionStore) DeleteUser(username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id, session := range m.sessions {
+		if session.Username == username {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// Ping always succeeds; memory is always there
+func (m *MemorySessionStore) Ping() error {
+	return nil
+}
+
+// Close does nothing; the sessions are dropped with the store
+func (m *MemorySessionStore) Close() error {
+	return nil
+}
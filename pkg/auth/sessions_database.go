@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+// DatabaseSessionStore keeps sessions in the master's database, so they
+// survive restarts and, on Postgres, are shared by every master using it
+type DatabaseSessionStore struct {
+	db        *storage.DB
+	lastSweep time.Time
+	sweepLock sync.Mutex
+}
+
+// NewDatabaseSessionStore keeps sessions in db
+func NewDatabaseSessionStore(db *storage.DB) *DatabaseSessionStore {
+	return &DatabaseSessionStore{db: db}
+}
+
+// Get gets a session by ID
+func (s *DatabaseSessionStore) Get(id string) (*models.Session, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM sessions WHERE id = ? AND expires_at > ?`,
+		id, time.Now().UnixNano()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session models.Session
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Save saves a session, dropping expired ones at most once a sweepInterval
+func (s *DatabaseSessionStore) Save(id string, session *models.Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO sessions (id, username, data, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET username = excluded.username, data = excluded.data, expires_at = excluded.expires_at`,
+		id, session.Username, string(data), session.ExpiresAt.UnixNano())
+	if err != nil {
+		return err
+	}
+
+	s.sweepLock.Lock()
+	defer s.sweepLock.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return nil
+	}
+	s.lastSweep = now
+	_, err = s.db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now.UnixNano())
+	return err
+}
+
+// Delete deletes a session
+func (s *DatabaseSessionStore) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+// DeleteUser deletes every session of a user
+func (s *DatabaseSessionStore) DeleteUser(username string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE username = ?`, username)
+	return err
+}
+
+// Ping checks that the database can be reached
+func (s *DatabaseSessionStore) Ping() error {
+	return s.db.Ping()
+}
+
+// Close does nothing; the database is shared and closed by its owner
+func (s *DatabaseSessionStore) Close() error {
+	return nil
+}
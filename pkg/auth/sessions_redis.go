@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeout bounds each Redis call, so a slow Redis fails requests rather
+// than hanging them
+const redisTimeout = 3 * time.Second
+
+// redisKeyPrefix starts every key the session store writes
+const redisKeyPrefix = "batwa:"
+
+// RedisSessionStore keeps sessions in Redis, so they survive restarts and are
+// shared by every master using the same Redis. Each session key expires with
+// its session; a set per user lists the user's session IDs.
+type RedisSessionStore struct {
+	client *redis.Client
+}
+
+// NewRedisSessionStore connects to the Redis at url, such as
+// redis://:password@host:6379/0
+func NewRedisSessionStore(url string) (*RedisSessionStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	client := redis.NewClient(options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis at %s: %w", options.Addr, err)
+	}
+	return &RedisSessionStore{client: client}, nil
+}
+
+// sessionKey gets the key of a session
+func sessionKey(id string) string {
+	return redisKeyPrefix + "session:" + id
+}
+
+// userSessionsKey gets the key of the set of a user's session IDs
+func userSessionsKey(username string) string {
+	return redisKeyPrefix + "user-sessions:" + username
+}
+
+// Get gets a session by ID
+func (r *RedisSessionStore) Get(id string) (*models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	data, err := r.client.Get(ctx, sessionKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session models.Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(session.ExpiresAt) {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+// Save saves a session, expiring its key along with it
+func (r *RedisSessionStore) Save(id string, session *models.Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	userKey := userSessionsKey(session.Username)
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionKey(id), data, 0)
+		pipe.ExpireAt(ctx, sessionKey(id), session.ExpiresAt)
+		pipe.SAdd(ctx, userKey, id)
+		// The set lives as long as the user's longest session; IDs of
+		// expired sessions left in it are harmless
+		pipe.ExpireNX(ctx, userKey, time.Until(session.ExpiresAt))
+		pipe.ExpireGT(ctx, userKey, time.Until(session.ExpiresAt))
+		return nil
+	})
+	return err
+}
+
+// Delete deletes a session
+func (r *RedisSessionStore) Delete(id string) error {
+	session, err := r.Get(id)
+	if err != nil || session == nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(id))
+		pipe.SRem(ctx, userSessionsKey(session.Username), id)
+		return nil
+	})
+	return err
+}
+
+// DeleteUser deletes every session of a user
+func (r *RedisSessionStore) DeleteUser(username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	userKey := userSessionsKey(username)
+	ids, err := r.client.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{userKey}
+	for _, id := range ids {
+		keys = append(keys, sessionKey(id))
+	}
+	return r.client.Del(ctx, keys...).Err()
+}
+
+// Ping checks that Redis answers
+func (r *RedisSessionStore) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return r.client.Ping(ctx).Err()
+}
+
+// Close closes the connection to Redis
+func (r *RedisSessionStore) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteSessionStore keeps sessions in a SQLite database file, so they
+// survive restarts of a single master
+type SQLiteSessionStore struct {
+	db        *sql.DB
+	lastSweep time.Time
+	sweepLock sync.Mutex
+}
+
+// NewSQLiteSessionStore opens, creating if needed, the session database at
+// path
+func NewSQLiteSessionStore(path string) (*SQLiteSessionStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	// Create the file first, so it and SQLite's journal files are private
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite takes one writer at a time
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		id         TEXT PRIMARY KEY,
+		username   TEXT NOT NULL,
+		data       TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS sessions_username ON sessions (username);
+	CREATE INDEX IF NOT EXISTS sessions_expires_at ON sessions (expires_at)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set up session database %s: %w", path, err)
+	}
+	return &SQLiteSessionStore{db: db}, nil
+}
+
+// Get gets a session by ID
+func (s *SQLiteSessionStore) Get(id string) (*models.Session, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM sessions WHERE id = ? AND expires_at > ?`,
+		id, time.Now().UnixNano()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session models.Session
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Save saves a session, dropping expired ones at most once a sweepInterval
+func (s *SQLiteSessionStore) Save(id string, session *models.Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO sessions (id, username, data, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET username = excluded.username, data = excluded.data, expires_at = excluded.expires_at`,
+		id, session.Username, string(data), session.ExpiresAt.UnixNano())
+	if err != nil {
+		return err
+	}
+
+	s.sweepLock.Lock()
+	defer s.sweepLock.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return nil
+	}
+	s.lastSweep = now
+	_, err = s.db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now.UnixNano())
+	return err
+}
+
+// Delete deletes a session
+func (s *SQLiteSessionStore) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+// DeleteUser deletes every session of a user
+func (s *SQLiteSessionStore) DeleteUser(username string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE username = ?`, username)
+	return err
+}
+
+// Ping checks that the database can be read
+func (s *SQLiteSessionStore) Ping() error {
+	var count int
+	return s.db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE 0`).Scan(&count)
+}
+
+// Close closes the database
+func (s *SQLiteSessionStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TicketTTL is how long a terminal ticket can be redeemed
+const TicketTTL = 30 * time.Second
+
+// ErrInvalidTicket is returned for a terminal ticket that is malformed,
+// wrongly signed, expired, already used or for another VM
+var ErrInvalidTicket = errors.New("invalid or expired terminal ticket")
+
+// ticketClaims are what a terminal ticket grants: one terminal on one VM for
+// one user
+type ticketClaims struct {
+	Username  string `json:"u"`
+	AgentID   string `json:"a,omitempty"`
+	VMName    string `json:"v"`
+	ExpiresAt int64  `json:"e"`
+	Nonce     string `json:"n"`
+}
+
+// tickets signs terminal tickets and remembers the redeemed ones until they
+// expire, so each is used once
+type tickets struct {
+	key      []byte
+	redeemed map[string]time.Time
+	mutex    sync.Mutex
+}
+
+// newTickets creates a ticket signer keyed by key, or by a random key when
+// key is nil
+func newTickets(key []byte) (*tickets, error) {
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &tickets{key: key, redeemed: make(map[string]time.Time)}, nil
+}
+
+// sign computes the encoded HMAC of a ticket's payload
+func (t *tickets) sign(payload string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IssueTicket issues a ticket that lets username open one terminal websocket
+// on a VM within TicketTTL, for clients that cannot send a session cookie or
+// Authorization header with the websocket request
+func (s *Service) IssueTicket(username, agentID, vmName string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(ticketClaims{
+		Username:  username,
+		AgentID:   agentID,
+		VMName:    vmName,
+		ExpiresAt: time.Now().Add(TicketTTL).Unix(),
+		Nonce:     base64.RawURLEncoding.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + s.tickets.sign(payload), nil
+}
+
+// RedeemTicket checks a ticket is valid for the VM and unused, marks it used
+// and returns the user it was issued to
+func (s *Service) RedeemTicket(ticket, agentID, vmName string) (string, error) {
+	payload, signature, found := strings.Cut(ticket, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(s.tickets.sign(payload))) {
+		return "", ErrInvalidTicket
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrInvalidTicket
+	}
+	var claims ticketClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return "", ErrInvalidTicket
+	}
+	now := time.Now()
+	if now.Unix() >= claims.ExpiresAt || claims.AgentID != agentID || claims.VMName != vmName || !s.HasUser(claims.Username) {
+		return "", ErrInvalidTicket
+	}
+
+	s.tickets.mutex.Lock()
+	defer s.tickets.mutex.Unlock()
+	for nonce, expiry := range s.tickets.redeemed {
+		if now.After(expiry) {
+			delete(s.tickets.redeemed, nonce)
+		}
+	}
+	if _, used := s.tickets.redeemed[claims.Nonce]; used {
+		return "", ErrInvalidTicket
+	}
+	s.tickets.redeemed[claims.Nonce] = time.Unix(claims.ExpiresAt, 0)
+	return claims.Username, nil
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+// UserRepository persists users. The service keeps every user in memory and
+// writes each change through to the repository.
+type UserRepository interface {
+	// Load loads every user, keyed by username
+	Load() (map[string]*models.User, error)
+	// Save saves a user, replacing any of the same name
+	Save(user *models.User) error
+	Delete(username string) error
+	// Ping checks that users can still be saved
+	Ping() error
+}
+
+// FileUserRepository keeps users in a JSON file, rewritten on every change
+type FileUserRepository struct {
+	path  string
+	users map[string]*models.User
+}
+
+// NewFileUserRepository keeps users in the JSON file at path
+func NewFileUserRepository(path string) *FileUserRepository {
+	return &FileUserRepository{path: path, users: make(map[string]*models.User)}
+}
+
+// Load reads the users saved in the file
+func (r *FileUserRepository) Load() (map[string]*models.User, error) {
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return map[string]*models.User{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]*models.User)
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+	r.users = make(map[string]*models.User, len(users))
+	for username, user := range users {
+		copied := *user
+		r.users[username] = &copied
+	}
+	return users, nil
+}
+
+// Save saves a user by rewriting the file
+func (r *FileUserRepository) Save(user *models.User) error {
+	previous, existed := r.users[user.Username]
+	copied := *user
+	r.users[user.Username] = &copied
+	if err := r.write(); err != nil {
+		if existed {
+			r.users[user.Username] = previous
+		} else {
+			delete(r.users, user.Username)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete deletes a user by rewriting the file
+func (r *FileUserRepository) Delete(username string) error {
+	previous, existed := r.users[username]
+	if !existed {
+		return nil
+	}
+	delete(r.users, username)
+	if err := r.write(); err != nil {
+		r.users[username] = previous
+		return err
+	}
+	return nil
+}
+
+// write writes the users to the file
+func (r *FileUserRepository) write() error {
+	data, err := json.MarshalIndent(r.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// Ping checks that the users directory is writable, by writing a file in it
+func (r *FileUserRepository) Ping() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("users directory: %w", err)
+	}
+	probe, err := os.CreateTemp(filepath.Dir(r.path), ".readyz-*")
+	if err != nil {
+		return fmt.Errorf("users directory is not writable: %w", err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
+
+// DatabaseUserRepository keeps users in the master's database
+type DatabaseUserRepository struct {
+	db *storage.DB
+}
+
+// NewDatabaseUserRepository keeps users in db
+func NewDatabaseUserRepository(db *storage.DB) *DatabaseUserRepository {
+	return &DatabaseUserRepository{db: db}
+}
+
+// Load loads every user from the database
+func (r *DatabaseUserRepository) Load() (map[string]*models.User, error) {
+	rows, err := r.db.Query(`SELECT data FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[string]*models.User)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var user models.User
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			return nil, err
+		}
+		users[user.Username] = &user
+	}
+	return users, rows.Err()
+}
+
+// Save saves a user to the database
+func (r *DatabaseUserRepository) Save(user *models.User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`INSERT INTO users (username, data) VALUES (?, ?)
+		ON CONFLICT (username) DO UPDATE SET data = excluded.data`,
+		user.Username, string(data))
+	return err
+}
+
+// Delete deletes a user from the database
+func (r *DatabaseUserRepository) Delete(username string) error {
+	_, err := r.db.Exec(`DELETE FROM users WHERE username = ?`, username)
+	return err
+}
+
+// Ping checks that the database can be reached
+func (r *DatabaseUserRepository) Ping() error {
+	return r.db.Ping()
+}
+
+// importUsers copies the users of the JSON file at path into the database
+// the first time the master starts with one
+func importUsers(db *storage.DB, path string, repository UserRepository) error {
+	return db.ImportOnce("users", func() (int, error) {
+		users, err := NewFileUserRepository(path).Load()
+		if err != nil {
+			return 0, err
+		}
+		for _, user := range users {
+			if err := repository.Save(user); err != nil {
+				return 0, err
+			}
+		}
+		return len(users), nil
+	})
+}
@@ -0,0 +1,304 @@
+// Package backup writes the master's state to an archive and restores it on
+// a fresh master, for disaster recovery and for moving to another host or
+// database. An archive is a gzipped tar of JSON files, one per kind of state:
+// users with their password hashes, agents with their API keys and
+// approvals, templates, VM metadata and finished tasks. Sessions are left
+// out, so users sign in again on the restored master.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/auth"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/metadata"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/secrets"
+	"github.com/prashah/batwa/pkg/tasks"
+	"github.com/prashah/batwa/pkg/templates"
+)
+
+var logger = logging.For("backup")
+
+// Format is the version of the archive layout written, bumped when it
+// changes in a way older masters cannot read
+const Format = 1
+
+// The files of an archive
+const (
+	manifestFile  = "manifest.json"
+	usersFile     = "users.json"
+	agentsFile    = "agents.json"
+	approvalsFile = "agent_approvals.json"
+	templatesFile = "templates.json"
+	metadataFile  = "vm_metadata.json"
+	tasksFile     = "tasks.json"
+)
+
+// ErrNotFresh is returned when restoring onto a master that already has
+// state of its own
+var ErrNotFresh = errors.New("a backup can only be restored on a fresh master")
+
+// Manifest describes an archive
+type Manifest struct {
+	Format    int       `json:"format"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	// Counts holds how many records of each kind the archive has, by file
+	Counts map[string]int `json:"counts"`
+}
+
+// Stores are the stores a backup is taken from and restored to. With a
+// cipher, agent API keys are encrypted in the archive, and it is needed to
+// restore them.
+type Stores struct {
+	Auth      *auth.Service
+	Registry  *agents.AgentRegistry
+	Approvals *agents.Approvals
+	Templates *templates.Store
+	Metadata  *metadata.Store
+	Tasks     *tasks.Store
+	Cipher    *secrets.Cipher
+}
+
+// Write writes an archive of the stores to w on behalf of by
+func (s *Stores) Write(w io.Writer, by string) (Manifest, error) {
+	saved := s.Registry.Saved()
+	for i := range saved {
+		if saved[i].APIKey == "" || s.Cipher == nil {
+			continue
+		}
+		sealed, err := s.Cipher.Seal(saved[i].APIKey)
+		if err != nil {
+			return Manifest{}, err
+		}
+		saved[i].APIKey = sealed
+	}
+	finished := []models.Task{}
+	all, _ := s.Tasks.Search(tasks.Query{})
+	for _, task := range all {
+		if task.FinishedAt != nil {
+			finished = append(finished, task)
+		}
+	}
+	approvals := s.Approvals.List()
+	users := s.Auth.Users()
+	templateList := s.Templates.List()
+	metadataList := s.Metadata.List(nil)
+
+	manifest := Manifest{
+		Format:    Format,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: by,
+		Counts: map[string]int{
+			usersFile:     len(users),
+			agentsFile:    len(saved),
+			approvalsFile: len(approvals),
+			templatesFile: len(templateList),
+			metadataFile:  len(metadataList),
+			tasksFile:     len(finished),
+		},
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	files := []struct {
+		name    string
+		content any
+	}{
+		{manifestFile, manifest},
+		{usersFile, users},
+		{agentsFile, saved},
+		{approvalsFile, approvals},
+		{templatesFile, templateList},
+		{metadataFile, metadataList},
+		{tasksFile, finished},
+	}
+	for _, file := range files {
+		data, err := json.MarshalIndent(file.content, "", "  ")
+		if err != nil {
+			return Manifest{}, err
+		}
+		header := &tar.Header{Name: file.name, Mode: 0o600, Size: int64(len(data)), ModTime: manifest.CreatedAt}
+		if err := archive.WriteHeader(header); err != nil {
+			return Manifest{}, err
+		}
+		if _, err := archive.Write(data); err != nil {
+			return Manifest{}, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return Manifest{}, err
+	}
+	return manifest, gz.Close()
+}
+
+// contents are the files of an archive, read but not yet decoded
+type contents map[string][]byte
+
+// decode decodes a file of the archive into v, failing if it is missing
+func (c contents) decode(name string, v any) error {
+	data, exists := c[name]
+	if !exists {
+		return fmt.Errorf("the archive has no %s", name)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// read reads the files of an archive
+func read(r io.Reader) (contents, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	defer gz.Close()
+
+	files := contents{}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("not a backup archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+		files[header.Name] = data
+	}
+}
+
+// fresh reports what state the master already has, or "" if it has none
+// beyond the admin created at its first start, who has not signed in yet
+func (s *Stores) fresh() string {
+	var found []string
+	users := s.Auth.Users()
+	if len(users) > 1 || (len(users) == 1 && !users[0].MustChangePassword) {
+		found = append(found, "users")
+	}
+	if len(s.Registry.GetAllAgents()) > 0 {
+		found = append(found, "agents")
+	}
+	if len(s.Templates.List()) > 0 {
+		found = append(found, "templates")
+	}
+	if len(s.Metadata.List(nil)) > 0 {
+		found = append(found, "VM metadata")
+	}
+	if _, total := s.Tasks.Search(tasks.Query{Limit: 1}); total > 0 {
+		found = append(found, "tasks")
+	}
+	return strings.Join(found, ", ")
+}
+
+// Restore restores the archive read from r into the stores. The master must
+// be fresh: it refuses to merge a backup into state of the master's own. The
+// admin created at first start is replaced by the archive's users.
+func (s *Stores) Restore(r io.Reader) (Manifest, error) {
+	files, err := read(r)
+	if err != nil {
+		return Manifest{}, err
+	}
+	var manifest Manifest
+	if err := files.decode(manifestFile, &manifest); err != nil {
+		return Manifest{}, err
+	}
+	if manifest.Format != Format {
+		return Manifest{}, fmt.Errorf("the archive has format %d; this master reads format %d", manifest.Format, Format)
+	}
+	var (
+		users        []models.User
+		saved        []agents.StoredAgent
+		approvals    map[string]models.AgentApproval
+		templateList []*models.VMTemplate
+		metadataList []*models.VMMetadata
+		finished     []models.Task
+	)
+	for name, v := range map[string]any{
+		usersFile:     &users,
+		agentsFile:    &saved,
+		approvalsFile: &approvals,
+		templatesFile: &templateList,
+		metadataFile:  &metadataList,
+		tasksFile:     &finished,
+	} {
+		if err := files.decode(name, v); err != nil {
+			return Manifest{}, err
+		}
+	}
+	for i := range saved {
+		if !secrets.IsSealed(saved[i].APIKey) {
+			continue
+		}
+		if s.Cipher == nil {
+			return Manifest{}, fmt.Errorf("the API key of agent %s is encrypted; set SECRETS_KEY_FILE to the key of the master that took the backup", saved[i].Agent.AgentID)
+		}
+		if saved[i].APIKey, err = s.Cipher.Open(saved[i].APIKey); err != nil {
+			return Manifest{}, fmt.Errorf("agent %s: %w", saved[i].Agent.AgentID, err)
+		}
+	}
+
+	if found := s.fresh(); found != "" {
+		return Manifest{}, fmt.Errorf("%w; this one has %s", ErrNotFresh, found)
+	}
+
+	if err := s.Auth.RestoreUsers(users); err != nil {
+		return Manifest{}, fmt.Errorf("users: %w", err)
+	}
+	for agentID, approval := range approvals {
+		if err := s.Approvals.Restore(agentID, approval); err != nil {
+			return Manifest{}, fmt.Errorf("approval of agent %s: %w", agentID, err)
+		}
+	}
+	for _, agent := range saved {
+		if err := s.Registry.Restore(agent); err != nil {
+			return Manifest{}, fmt.Errorf("agent %s: %w", agent.Agent.AgentID, err)
+		}
+	}
+	for _, template := range templateList {
+		if err := s.Templates.Restore(template); err != nil {
+			return Manifest{}, fmt.Errorf("template %s: %w", template.Name, err)
+		}
+	}
+	for _, meta := range metadataList {
+		if err := s.Metadata.Restore(meta); err != nil {
+			return Manifest{}, fmt.Errorf("metadata of VM %s/%s: %w", meta.AgentID, meta.Name, err)
+		}
+	}
+	for _, task := range finished {
+		if err := s.Tasks.Restore(task); err != nil {
+			return Manifest{}, fmt.Errorf("task %s: %w", task.ID, err)
+		}
+	}
+	logger.Info("Restored backup", "created_at", manifest.CreatedAt, "created_by", manifest.CreatedBy,
+		"users", len(users), "agents", len(saved), "templates", len(templateList), "vm_metadata", len(metadataList), "tasks", len(finished))
+	return manifest, nil
+}
+
+// RestoreFile restores the archive at path into the stores
+func (s *Stores) RestoreFile(path string) (Manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer file.Close()
+	return s.Restore(file)
+}
@@ -0,0 +1,136 @@
+// Package bus is the master's internal publish/subscribe event bus. Routes,
+// the agent registry and the schedulers publish what happened; the event log,
+// alerts, notifications and cache invalidation subscribe to the events they
+// care about instead of being called from every place that causes them.
+package bus
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+var logger = logging.For("bus")
+
+// Handler is called with each event matching its subscription
+type Handler func(event models.Event)
+
+// subscription is a handler and the event types it receives
+type subscription struct {
+	pattern string
+	handler Handler
+}
+
+// Bus delivers published events to subscribers in publish order, one at a
+// time, on its own goroutine. Publishing never blocks on subscribers, so it is
+// safe while holding locks that a subscriber may also take.
+type Bus struct {
+	subscriptions []subscription
+	queue         []models.Event
+	// wake is signalled when events are queued or the bus stops
+	wake    *sync.Cond
+	stopped bool
+	done    chan struct{}
+	mutex   sync.Mutex
+}
+
+// New creates a bus; call Start to begin delivering events
+func New() *Bus {
+	b := &Bus{done: make(chan struct{})}
+	b.wake = sync.NewCond(&b.mutex)
+	return b
+}
+
+// Subscribe adds a handler for events whose type matches pattern: an exact
+// type such as "agent.offline", a prefix ending in ".*" such as "vm.*", or
+// "*" for every event
+func (b *Bus) Subscribe(pattern string, handler Handler) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscriptions = append(b.subscriptions, subscription{pattern: pattern, handler: handler})
+}
+
+// Publish queues an event for the subscribers, stamping its time if unset
+func (b *Bus) Publish(event models.Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.stopped {
+		logger.Warn("Event bus stopped; dropping event", "type", event.Type)
+		return
+	}
+	b.queue = append(b.queue, event)
+	b.wake.Signal()
+}
+
+// Start starts delivering events
+func (b *Bus) Start() {
+	go b.deliverLoop()
+	logger.Info("Started event bus")
+}
+
+// Stop delivers the events already published and stops the bus
+func (b *Bus) Stop() {
+	b.mutex.Lock()
+	b.stopped = true
+	b.wake.Signal()
+	b.mutex.Unlock()
+
+	<-b.done
+	logger.Info("Stopped event bus")
+}
+
+// deliverLoop hands queued events to the subscribers until the bus stops and
+// its queue is empty
+func (b *Bus) deliverLoop() {
+	defer close(b.done)
+	for {
+		b.mutex.Lock()
+		for len(b.queue) == 0 && !b.stopped {
+			b.wake.Wait()
+		}
+		if len(b.queue) == 0 {
+			b.mutex.Unlock()
+			return
+		}
+		event := b.queue[0]
+		b.queue[0] = models.Event{}
+		b.queue = b.queue[1:]
+		subscriptions := b.subscriptions
+		b.mutex.Unlock()
+
+		for _, sub := range subscriptions {
+			if matches(sub.pattern, event.Type) {
+				deliver(sub.handler, event)
+			}
+		}
+	}
+}
+
+// deliver calls a handler, logging rather than propagating a panic so one
+// faulty subscriber does not stop the others
+func deliver(handler Handler, event models.Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Event subscriber panicked", "type", event.Type, "panic", r)
+		}
+	}()
+	handler(event)
+}
+
+// matches reports whether an event type matches a subscription pattern
+func matches(pattern, eventType string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(eventType, prefix)
+	}
+	return pattern == eventType
+}
@@ -0,0 +1,229 @@
+// Package client is a Go client of the master's API. Its methods, one per
+// operation of the OpenAPI document, are generated into client_gen.go from
+// the routes package's operations; this file holds what they share.
+//
+//	c := client.New("https://batwa.example.com", os.Getenv("BATWA_TOKEN"))
+//	vms, err := c.ListVMs(ctx, nil)
+//
+// Errors the master answers with are returned as *Error, carrying the
+// models.ErrorResponse envelope with its code.
+package client
+
+//go:generate go run ../../cmd/openapi -client client_gen.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/apierror"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/requestid"
+)
+
+// Client calls the master's API
+type Client struct {
+	// BaseURL is the master's URL, such as https://batwa.example.com
+	BaseURL string
+	// Token is an API token or JWT access token sent as a bearer token.
+	// Without one, give HTTPClient a cookie jar and call Login instead.
+	Token string
+	// Header holds headers sent with every request, such as
+	// X-Registration-Token for the agent operations
+	Header http.Header
+	// HTTPClient sends the requests; http.DefaultClient when nil
+	HTTPClient *http.Client
+}
+
+// New creates a client of the master at baseURL authenticating with token
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), Token: token}
+}
+
+// Error is an error the master answered with
+type Error struct {
+	StatusCode int
+	*models.ErrorResponse
+}
+
+// Error describes the error with its status and code
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Unwrap gives the error's envelope
+func (e *Error) Unwrap() error {
+	return e.ErrorResponse
+}
+
+// do sends a request with a JSON body, if any, and decodes the JSON answer
+// into out
+func (c *Client) do(ctx context.Context, method, path string, params, body, out interface{}) error {
+	resp, err := c.send(ctx, method, path, params, body, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// doAsync sends a request asking for it to run as a task, decoding the 202
+// answer into out
+func (c *Client) doAsync(ctx context.Context, method, path string, params, body, out interface{}) error {
+	resp, err := c.send(ctx, method, path, params, body, http.Header{"Prefer": {"respond-async"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// stream sends a request and returns the response for the caller to read
+func (c *Client) stream(ctx context.Context, method, path string, params, body interface{}) (*http.Response, error) {
+	return c.send(ctx, method, path, params, body, nil)
+}
+
+// upload sends a multipart form of body's form fields and a file, decoding
+// the JSON answer into out
+func (c *Client) upload(ctx context.Context, method, path string, params, body interface{}, field, filename string, file io.Reader, out interface{}) error {
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	for name, value := range formValues(body) {
+		if err := writer.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	part, err := writer.CreateFormFile(field, filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	resp, err := c.send(ctx, method, path, params, &form, http.Header{"Content-Type": {writer.FormDataContentType()}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send sends a request, returning an *Error for answers other than 2xx. A
+// *bytes.Buffer body is sent as it is, anything else as JSON.
+func (c *Client) send(ctx context.Context, method, path string, params, body interface{}, header http.Header) (*http.Response, error) {
+	target := c.BaseURL + path
+	if query := queryValues(params); len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case *bytes.Buffer:
+		reader = b
+	default:
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for _, extra := range []http.Header{c.Header, header} {
+		for name, values := range extra {
+			req.Header[name] = values
+		}
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+	return resp, nil
+}
+
+// decodeError reads the error envelope of an answer
+func decodeError(resp *http.Response) error {
+	response := &models.ErrorResponse{}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(response)
+	if response.Message == "" {
+		response.Message = http.StatusText(resp.StatusCode)
+	}
+	if response.Code == "" {
+		response.Code = apierror.Code(resp.StatusCode, response.Message)
+	}
+	if response.RequestID == "" {
+		response.RequestID = resp.Header.Get(requestid.Header)
+	}
+	return &Error{StatusCode: resp.StatusCode, ErrorResponse: response}
+}
+
+// queryValues encodes the fields of a generated Params struct that are set,
+// by their query tags
+func queryValues(params interface{}) url.Values {
+	query := url.Values{}
+	value := reflect.ValueOf(params)
+	if params == nil || (value.Kind() == reflect.Ptr && value.IsNil()) {
+		return query
+	}
+	value = reflect.Indirect(value)
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Tag.Get("query")
+		if field := value.Field(i); name != "" && !field.IsZero() {
+			query.Set(name, fmt.Sprint(field.Interface()))
+		}
+	}
+	return query
+}
+
+// formValues encodes the fields of a request that are set, by their form
+// tags
+func formValues(body interface{}) map[string]string {
+	values := make(map[string]string)
+	value := reflect.Indirect(reflect.ValueOf(body))
+	if !value.IsValid() || value.Kind() != reflect.Struct {
+		return values
+	}
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Tag.Get("form")
+		field := reflect.Indirect(value.Field(i))
+		if name != "" && field.IsValid() && !field.IsZero() {
+			values[name] = fmt.Sprint(field.Interface())
+		}
+	}
+	return values
+}
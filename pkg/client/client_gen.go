@@ -0,0 +1,2225 @@
+// Code generated by cmd/openapi from the master's operations; DO NOT EDIT.
+
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// AsyncResponse is the 202 answer of an operation run as a task
+type AsyncResponse struct {
+	Success bool        `json:"success"`
+	Task    models.Task `json:"task"`
+	TaskID  string      `json:"task_id"`
+}
+
+// HealthzResponse is the answer of Healthz
+type HealthzResponse struct {
+	LocalExecutor bool   `json:"local_executor"`
+	Mode          string `json:"mode"`
+	OnlineAgents  int    `json:"online_agents"`
+	Status        string `json:"status"`
+}
+
+// ReadyzResponse is the answer of Readyz
+type ReadyzResponse struct {
+	Checks map[string]models.ReadinessCheck `json:"checks"`
+	Status string                           `json:"status"`
+}
+
+// AdminStatusResponse is the answer of AdminStatus
+type AdminStatusResponse struct {
+	Agents []struct {
+		AgentID  string `json:"agent_id"`
+		Hostname string `json:"hostname"`
+		InFlight int    `json:"in_flight"`
+		Status   string `json:"status"`
+	} `json:"agents"`
+	LocalExecutor bool `json:"local_executor"`
+	MaxInFlight   int  `json:"max_in_flight"`
+	Success       bool `json:"success"`
+}
+
+// ReloadSecretsResponse is the answer of ReloadSecrets
+type ReloadSecretsResponse struct {
+	Failed   map[string]string `json:"failed"`
+	Reloaded []string          `json:"reloaded"`
+	Success  bool              `json:"success"`
+}
+
+// LoginResponse is the answer of Login
+type LoginResponse struct {
+	Message            string `json:"message"`
+	MustChangePassword bool   `json:"must_change_password"`
+	Success            bool   `json:"success"`
+}
+
+// LogoutResponse is the answer of Logout
+type LogoutResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// IssueJWTResponse is the answer of IssueJWT
+type IssueJWTResponse struct {
+	AccessToken        string `json:"access_token"`
+	ExpiresIn          int    `json:"expires_in"`
+	MustChangePassword bool   `json:"must_change_password"`
+	RefreshToken       string `json:"refresh_token"`
+	Success            bool   `json:"success"`
+	TokenType          string `json:"token_type"`
+}
+
+// RefreshJWTResponse is the answer of RefreshJWT
+type RefreshJWTResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Success      bool   `json:"success"`
+	TokenType    string `json:"token_type"`
+}
+
+// CheckAuthResponse is the answer of CheckAuth
+type CheckAuthResponse struct {
+	Admin              bool   `json:"admin"`
+	Authenticated      bool   `json:"authenticated"`
+	MustChangePassword bool   `json:"must_change_password"`
+	OIDC               bool   `json:"oidc"`
+	Username           string `json:"username"`
+}
+
+// ChangePasswordResponse is the answer of ChangePassword
+type ChangePasswordResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// CreateUserResponse is the answer of CreateUser
+type CreateUserResponse struct {
+	Success bool            `json:"success"`
+	User    models.UserInfo `json:"user"`
+}
+
+// ListUsersResponse is the answer of ListUsers
+type ListUsersResponse struct {
+	Success bool              `json:"success"`
+	Users   []models.UserInfo `json:"users"`
+}
+
+// DeleteUserResponse is the answer of DeleteUser
+type DeleteUserResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// CreateTokenResponse is the answer of CreateToken
+type CreateTokenResponse struct {
+	Message string          `json:"message"`
+	Secret  string          `json:"secret"`
+	Success bool            `json:"success"`
+	Token   models.APIToken `json:"token"`
+}
+
+// ListTokensParams are the query parameters of ListTokens
+type ListTokensParams struct {
+	// Only tokens of this user (admins)
+	User string `query:"user"`
+}
+
+// ListTokensResponse is the answer of ListTokens
+type ListTokensResponse struct {
+	Success bool              `json:"success"`
+	Tokens  []models.APIToken `json:"tokens"`
+}
+
+// DeleteTokenResponse is the answer of DeleteToken
+type DeleteTokenResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// RegisterAgentResponse is the answer of RegisterAgent
+type RegisterAgentResponse struct {
+	Agent   *models.AgentInfo `json:"agent"`
+	Message string            `json:"message"`
+	Success bool              `json:"success"`
+}
+
+// UnregisterAgentResponse is the answer of UnregisterAgent
+type UnregisterAgentResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// ListAgentsParams are the query parameters of ListAgents
+type ListAgentsParams struct {
+	// Only entries in one of these comma separated states
+	State string `query:"state"`
+	// Only entries of these comma separated agents; local for the master
+	AgentID string `query:"agent_id"`
+	// Only entries with this key=value label, or with the key set
+	Label string `query:"label"`
+	// Sort by agent_id, hostname, status, zone, vm_count, last_seen; prefix - for descending
+	Sort string `query:"sort"`
+	// Entries per page, at most 1000; every entry when 0
+	Limit int `query:"limit"`
+	// Entries to skip
+	Offset int `query:"offset"`
+}
+
+// AgentHistoryResponse is the answer of AgentHistory
+type AgentHistoryResponse struct {
+	Agents []models.DepartedAgent `json:"agents"`
+}
+
+// GetAgentInfoResponse is the answer of GetAgentInfo
+type GetAgentInfoResponse struct {
+	Agent   *models.AgentInfo `json:"agent"`
+	Success bool              `json:"success"`
+}
+
+// AgentHeartbeatResponse is the answer of AgentHeartbeat
+type AgentHeartbeatResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// AgentVMStateResponse is the answer of AgentVMState
+type AgentVMStateResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// DeregisterAgentResponse is the answer of DeregisterAgent
+type DeregisterAgentResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// ImportAgentResponse is the answer of ImportAgent
+type ImportAgentResponse struct {
+	Imported []*models.VMMetadata `json:"imported"`
+	Message  string               `json:"message"`
+	Skipped  []string             `json:"skipped"`
+	Success  bool                 `json:"success"`
+}
+
+// DrainAgentResponse is the answer of DrainAgent
+type DrainAgentResponse struct {
+	Agent   *models.AgentInfo `json:"agent"`
+	Failed  int               `json:"failed"`
+	Message string            `json:"message"`
+	Results []struct {
+		AgentID string                `json:"agent_id"`
+		Error   *models.ErrorResponse `json:"error"`
+		Message string                `json:"message"`
+		Name    string                `json:"name"`
+		Success bool                  `json:"success"`
+	} `json:"results"`
+	Stopped int  `json:"stopped"`
+	Success bool `json:"success"`
+}
+
+// UndrainAgentResponse is the answer of UndrainAgent
+type UndrainAgentResponse struct {
+	Agent   *models.AgentInfo `json:"agent"`
+	Message string            `json:"message"`
+	Success bool              `json:"success"`
+}
+
+// RotateAgentKeyResponse is the answer of RotateAgentKey
+type RotateAgentKeyResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// SetAgentZoneResponse is the answer of SetAgentZone
+type SetAgentZoneResponse struct {
+	Agent   *models.AgentInfo `json:"agent"`
+	Message string            `json:"message"`
+	Success bool              `json:"success"`
+}
+
+// ApproveAgentResponse is the answer of ApproveAgent
+type ApproveAgentResponse struct {
+	Agent    *models.AgentInfo     `json:"agent"`
+	Approval *models.AgentApproval `json:"approval"`
+	Message  string                `json:"message"`
+	Success  bool                  `json:"success"`
+}
+
+// RejectAgentResponse is the answer of RejectAgent
+type RejectAgentResponse struct {
+	Approval *models.AgentApproval `json:"approval"`
+	Message  string                `json:"message"`
+	Success  bool                  `json:"success"`
+}
+
+// IssueTerminalTicketResponse is the answer of IssueTerminalTicket
+type IssueTerminalTicketResponse struct {
+	AgentID   string `json:"agent_id"`
+	ExpiresIn int    `json:"expires_in"`
+	Success   bool   `json:"success"`
+	Ticket    string `json:"ticket"`
+	VMName    string `json:"vm_name"`
+}
+
+// ListTasksParams are the query parameters of ListTasks
+type ListTasksParams struct {
+	User  string `query:"user"`
+	Agent string `query:"agent"`
+	VM    string `query:"vm"`
+	State string `query:"state"`
+	// Only tasks created since this RFC 3339 time
+	Since string `query:"since"`
+	// Tasks per page: 100 by default, at most 1000
+	Limit  int `query:"limit"`
+	Offset int `query:"offset"`
+}
+
+// ListTasksResponse is the answer of ListTasks
+type ListTasksResponse struct {
+	Limit   int           `json:"limit"`
+	Offset  int           `json:"offset"`
+	Success bool          `json:"success"`
+	Tasks   []models.Task `json:"tasks"`
+	Total   int           `json:"total"`
+}
+
+// GetTaskResponse is the answer of GetTask
+type GetTaskResponse struct {
+	Success bool        `json:"success"`
+	Task    models.Task `json:"task"`
+}
+
+// ListZonesResponse is the answer of ListZones
+type ListZonesResponse struct {
+	Zones []models.ZoneInfo `json:"zones"`
+}
+
+// ListZoneAgentsResponse is the answer of ListZoneAgents
+type ListZoneAgentsResponse struct {
+	Agents []*models.AgentInfo `json:"agents"`
+	Zone   string              `json:"zone"`
+}
+
+// CreateZoneVMResponse is the answer of CreateZoneVM
+type CreateZoneVMResponse struct {
+	AgentHostname   *string                       `json:"agent_hostname"`
+	AgentID         *string                       `json:"agent_id"`
+	Blueprint       string                        `json:"blueprint"`
+	BlueprintOutput []string                      `json:"blueprint_output"`
+	ExpiresAt       *time.Time                    `json:"expires_at"`
+	ExpiryAction    string                        `json:"expiry_action"`
+	Message         string                        `json:"message"`
+	Provision       *models.RemoteCommandResponse `json:"provision"`
+	State           string                        `json:"state"`
+	Success         bool                          `json:"success"`
+	VMName          string                        `json:"vm_name"`
+	Warnings        []string                      `json:"warnings"`
+}
+
+// GetDefaultsResponse is the answer of GetDefaults
+type GetDefaultsResponse struct {
+	Defaults models.Defaults `json:"defaults"`
+	Success  bool            `json:"success"`
+}
+
+// SetDefaultsResponse is the answer of SetDefaults
+type SetDefaultsResponse struct {
+	Defaults models.Defaults `json:"defaults"`
+	Success  bool            `json:"success"`
+}
+
+// SetDefaultSSHKeysRequest is the body of SetDefaultSSHKeys
+type SetDefaultSSHKeysRequest struct {
+	SSHKeys []string `json:"ssh_keys"`
+}
+
+// SetDefaultSSHKeysResponse is the answer of SetDefaultSSHKeys
+type SetDefaultSSHKeysResponse struct {
+	Defaults models.Defaults `json:"defaults"`
+	Success  bool            `json:"success"`
+}
+
+// ListQuotasResponse is the answer of ListQuotas
+type ListQuotasResponse struct {
+	Quotas  models.Quotas `json:"quotas"`
+	Success bool          `json:"success"`
+	Usage   struct {
+		Agents map[string]models.QuotaUsage `json:"agents"`
+		Users  map[string]models.QuotaUsage `json:"users"`
+	} `json:"usage"`
+}
+
+// SetUserQuotaResponse is the answer of SetUserQuota
+type SetUserQuotaResponse struct {
+	Quota   models.Quota `json:"quota"`
+	Success bool         `json:"success"`
+}
+
+// DeleteUserQuotaResponse is the answer of DeleteUserQuota
+type DeleteUserQuotaResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// SetAgentQuotaResponse is the answer of SetAgentQuota
+type SetAgentQuotaResponse struct {
+	Quota   models.Quota `json:"quota"`
+	Success bool         `json:"success"`
+}
+
+// DeleteAgentQuotaResponse is the answer of DeleteAgentQuota
+type DeleteAgentQuotaResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// CreateMaintenanceWindowResponse is the answer of CreateMaintenanceWindow
+type CreateMaintenanceWindowResponse struct {
+	Success bool                     `json:"success"`
+	Window  models.MaintenanceWindow `json:"window"`
+}
+
+// ListMaintenanceWindowsParams are the query parameters of ListMaintenanceWindows
+type ListMaintenanceWindowsParams struct {
+	// Only windows covering this agent
+	AgentID string `query:"agent_id"`
+}
+
+// ListMaintenanceWindowsResponse is the answer of ListMaintenanceWindows
+type ListMaintenanceWindowsResponse struct {
+	Success bool `json:"success"`
+	Windows []struct {
+		Active       bool                      `json:"active"`
+		CurrentEnd   time.Time                 `json:"current_end"`
+		CurrentStart time.Time                 `json:"current_start"`
+		NextEnd      time.Time                 `json:"next_end"`
+		NextStart    time.Time                 `json:"next_start"`
+		Window       *models.MaintenanceWindow `json:"window"`
+	} `json:"windows"`
+}
+
+// DeleteMaintenanceWindowResponse is the answer of DeleteMaintenanceWindow
+type DeleteMaintenanceWindowResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// CreateScheduleResponse is the answer of CreateSchedule
+type CreateScheduleResponse struct {
+	Schedule models.PowerSchedule `json:"schedule"`
+	Success  bool                 `json:"success"`
+}
+
+// ListSchedulesResponse is the answer of ListSchedules
+type ListSchedulesResponse struct {
+	Schedules []struct {
+		NextAction string                `json:"next_action"`
+		NextRun    time.Time             `json:"next_run"`
+		Schedule   *models.PowerSchedule `json:"schedule"`
+	} `json:"schedules"`
+	Success bool `json:"success"`
+}
+
+// DeleteScheduleResponse is the answer of DeleteSchedule
+type DeleteScheduleResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// RunScheduleRequest is the body of RunSchedule
+type RunScheduleRequest struct {
+	Action string `json:"action"`
+}
+
+// RunScheduleResponse is the answer of RunSchedule
+type RunScheduleResponse struct {
+	Run     *models.ScheduleRun `json:"run"`
+	Success bool                `json:"success"`
+}
+
+// CreateStackResponse is the answer of CreateStack
+type CreateStackResponse struct {
+	Failed  int `json:"failed"`
+	Results []struct {
+		AgentHostname   *string                       `json:"agent_hostname"`
+		AgentID         *string                       `json:"agent_id"`
+		Blueprint       string                        `json:"blueprint"`
+		BlueprintOutput []string                      `json:"blueprint_output"`
+		Error           *models.ErrorResponse         `json:"error"`
+		ExpiresAt       *time.Time                    `json:"expires_at"`
+		ExpiryAction    string                        `json:"expiry_action"`
+		Message         string                        `json:"message"`
+		Name            string                        `json:"name"`
+		Provision       *models.RemoteCommandResponse `json:"provision"`
+		State           string                        `json:"state"`
+		Status          int                           `json:"status"`
+		Success         bool                          `json:"success"`
+		VMName          string                        `json:"vm_name"`
+		Warnings        []string                      `json:"warnings"`
+	} `json:"results"`
+	Stack     *models.Stack `json:"stack"`
+	Succeeded int           `json:"succeeded"`
+	Success   bool          `json:"success"`
+}
+
+// ListStacksResponse is the answer of ListStacks
+type ListStacksResponse struct {
+	Stacks  []*models.Stack `json:"stacks"`
+	Success bool            `json:"success"`
+}
+
+// GetStackResponse is the answer of GetStack
+type GetStackResponse struct {
+	CreatedAt   time.Time `json:"created_at"`
+	CreatedBy   string    `json:"created_by"`
+	Description string    `json:"description"`
+	Members     []struct {
+		AgentHostname *string `json:"agent_hostname"`
+		AgentID       string  `json:"agent_id"`
+		Role          string  `json:"role"`
+		State         string  `json:"state"`
+		VMName        string  `json:"vm_name"`
+	} `json:"members"`
+	Name    string         `json:"name"`
+	States  map[string]int `json:"states"`
+	Success bool           `json:"success"`
+}
+
+// StackActionResponse is the answer of StackAction
+type StackActionResponse struct {
+	Action  string `json:"action"`
+	Failed  int    `json:"failed"`
+	Results []struct {
+		AgentID string                `json:"agent_id"`
+		Error   *models.ErrorResponse `json:"error"`
+		Message string                `json:"message"`
+		Name    string                `json:"name"`
+		Success bool                  `json:"success"`
+	} `json:"results"`
+	Succeeded int  `json:"succeeded"`
+	Success   bool `json:"success"`
+}
+
+// DeleteStackResponse is the answer of DeleteStack
+type DeleteStackResponse struct {
+	Failed  int `json:"failed"`
+	Results []struct {
+		AgentID string                `json:"agent_id"`
+		Error   *models.ErrorResponse `json:"error"`
+		Message string                `json:"message"`
+		Name    string                `json:"name"`
+		Success bool                  `json:"success"`
+	} `json:"results"`
+	Succeeded int  `json:"succeeded"`
+	Success   bool `json:"success"`
+}
+
+// CreateTemplateResponse is the answer of CreateTemplate
+type CreateTemplateResponse struct {
+	Success  bool              `json:"success"`
+	Template models.VMTemplate `json:"template"`
+}
+
+// ListTemplatesResponse is the answer of ListTemplates
+type ListTemplatesResponse struct {
+	Success   bool                 `json:"success"`
+	Templates []*models.VMTemplate `json:"templates"`
+}
+
+// GetTemplateResponse is the answer of GetTemplate
+type GetTemplateResponse struct {
+	Success  bool               `json:"success"`
+	Template *models.VMTemplate `json:"template"`
+}
+
+// UpdateTemplateResponse is the answer of UpdateTemplate
+type UpdateTemplateResponse struct {
+	Success  bool              `json:"success"`
+	Template models.VMTemplate `json:"template"`
+}
+
+// DeleteTemplateResponse is the answer of DeleteTemplate
+type DeleteTemplateResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// ListNotificationsResponse is the answer of ListNotifications
+type ListNotificationsResponse struct {
+	Notifications []*models.Notification `json:"notifications"`
+	Success       bool                   `json:"success"`
+}
+
+// PollEventsParams are the query parameters of PollEvents
+type PollEventsParams struct {
+	// The cursor of the previous poll; empty starts from now
+	Cursor string `query:"cursor"`
+	Limit  int    `query:"limit"`
+	// Seconds to wait for an event
+	Timeout int `query:"timeout"`
+}
+
+// PollEventsResponse is the answer of PollEvents
+type PollEventsResponse struct {
+	Cursor    string          `json:"cursor"`
+	Events    []*models.Event `json:"events"`
+	Success   bool            `json:"success"`
+	Truncated bool            `json:"truncated"`
+}
+
+// StreamEventsParams are the query parameters of StreamEvents
+type StreamEventsParams struct {
+	// Resume after this event ID
+	Cursor string `query:"cursor"`
+	// Comma separated event types to stream
+	Types string `query:"types"`
+}
+
+// ListAccessLogsParams are the query parameters of ListAccessLogs
+type ListAccessLogsParams struct {
+	User  string `query:"user"`
+	Token string `query:"token"`
+	Route string `query:"route"`
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+	// Only entries of this VM
+	VMName string `query:"vm_name"`
+	Status int    `query:"status"`
+	Limit  int    `query:"limit"`
+}
+
+// ListAccessLogsResponse is the answer of ListAccessLogs
+type ListAccessLogsResponse struct {
+	Entries []*models.AccessLogEntry `json:"entries"`
+	Success bool                     `json:"success"`
+}
+
+// GetLatestDigestResponse is the answer of GetLatestDigest
+type GetLatestDigestResponse struct {
+	Digest      *models.Digest      `json:"digest"`
+	GeneratedAt time.Time           `json:"generated_at"`
+	Items       []models.DigestItem `json:"items"`
+	Success     bool                `json:"success"`
+}
+
+// GenerateDigestResponse is the answer of GenerateDigest
+type GenerateDigestResponse struct {
+	Digest  *models.Digest `json:"digest"`
+	Success bool           `json:"success"`
+}
+
+// ListArtifactsParams are the query parameters of ListArtifacts
+type ListArtifactsParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+	// Only entries of this VM
+	VMName string `query:"vm_name"`
+}
+
+// ListArtifactsResponse is the answer of ListArtifacts
+type ListArtifactsResponse struct {
+	Artifacts []*models.Artifact `json:"artifacts"`
+	Success   bool               `json:"success"`
+}
+
+// GetArtifactResponse is the answer of GetArtifact
+type GetArtifactResponse struct {
+	Artifact *models.Artifact `json:"artifact"`
+	Success  bool             `json:"success"`
+}
+
+// DeleteArtifactResponse is the answer of DeleteArtifact
+type DeleteArtifactResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// ListBlueprintsParams are the query parameters of ListBlueprints
+type ListBlueprintsParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+}
+
+// ListBlueprintsResponse is the answer of ListBlueprints
+type ListBlueprintsResponse struct {
+	Blueprints []models.Blueprint `json:"blueprints"`
+	Success    bool               `json:"success"`
+}
+
+// ListNetworksParams are the query parameters of ListNetworks
+type ListNetworksParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+}
+
+// ListNetworksResponse is the answer of ListNetworks
+type ListNetworksResponse struct {
+	Networks []models.Network `json:"networks"`
+	Success  bool             `json:"success"`
+}
+
+// GetHostHealthResponse is the answer of GetHostHealth
+type GetHostHealthResponse struct {
+	Hosts []struct {
+		AgentID  *string            `json:"agent_id"`
+		Health   *models.HostHealth `json:"health"`
+		Hostname string             `json:"hostname"`
+		Status   string             `json:"status"`
+	} `json:"hosts"`
+	Success bool `json:"success"`
+}
+
+// GetHostVersionParams are the query parameters of GetHostVersion
+type GetHostVersionParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+}
+
+// GetHostVersionResponse is the answer of GetHostVersion
+type GetHostVersionResponse struct {
+	Success bool                `json:"success"`
+	Version *models.HostVersion `json:"version"`
+}
+
+// GetHostSettingsParams are the query parameters of GetHostSettings
+type GetHostSettingsParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+	// Comma separated settings to read
+	Keys string `query:"keys"`
+}
+
+// GetHostSettingsResponse is the answer of GetHostSettings
+type GetHostSettingsResponse struct {
+	Settings map[string]string `json:"settings"`
+	Success  bool              `json:"success"`
+}
+
+// SetHostSettingsResponse is the answer of SetHostSettings
+type SetHostSettingsResponse struct {
+	Settings map[string]string `json:"settings"`
+	Success  bool              `json:"success"`
+	Warning  string            `json:"warning"`
+}
+
+// GetHostStorageParams are the query parameters of GetHostStorage
+type GetHostStorageParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+}
+
+// GetHostStorageResponse is the answer of GetHostStorage
+type GetHostStorageResponse struct {
+	Storage *models.HostStorage `json:"storage"`
+	Success bool                `json:"success"`
+}
+
+// PruneHostResponse is the answer of PruneHost
+type PruneHostResponse struct {
+	Prune   *models.HostPruneResult `json:"prune"`
+	Success bool                    `json:"success"`
+}
+
+// CreateVMResponse is the answer of CreateVM
+type CreateVMResponse struct {
+	AgentHostname   *string                       `json:"agent_hostname"`
+	AgentID         *string                       `json:"agent_id"`
+	Blueprint       string                        `json:"blueprint"`
+	BlueprintOutput []string                      `json:"blueprint_output"`
+	ExpiresAt       *time.Time                    `json:"expires_at"`
+	ExpiryAction    string                        `json:"expiry_action"`
+	Message         string                        `json:"message"`
+	Provision       *models.RemoteCommandResponse `json:"provision"`
+	State           string                        `json:"state"`
+	Success         bool                          `json:"success"`
+	VMName          string                        `json:"vm_name"`
+	Warnings        []string                      `json:"warnings"`
+}
+
+// CreateVMBatchResponse is the answer of CreateVMBatch
+type CreateVMBatchResponse struct {
+	Failed  int `json:"failed"`
+	Results []struct {
+		AgentHostname   *string                       `json:"agent_hostname"`
+		AgentID         *string                       `json:"agent_id"`
+		Blueprint       string                        `json:"blueprint"`
+		BlueprintOutput []string                      `json:"blueprint_output"`
+		Error           *models.ErrorResponse         `json:"error"`
+		ExpiresAt       *time.Time                    `json:"expires_at"`
+		ExpiryAction    string                        `json:"expiry_action"`
+		Message         string                        `json:"message"`
+		Name            string                        `json:"name"`
+		Provision       *models.RemoteCommandResponse `json:"provision"`
+		State           string                        `json:"state"`
+		Status          int                           `json:"status"`
+		Success         bool                          `json:"success"`
+		VMName          string                        `json:"vm_name"`
+		Warnings        []string                      `json:"warnings"`
+	} `json:"results"`
+	Succeeded int  `json:"succeeded"`
+	Success   bool `json:"success"`
+}
+
+// ListVMsParams are the query parameters of ListVMs
+type ListVMsParams struct {
+	// Ask every host instead of the inventory cache
+	Refresh bool `query:"refresh"`
+	// Include disk and memory usage
+	Usage bool `query:"usage"`
+	// Only entries in one of these comma separated states
+	State string `query:"state"`
+	// Only entries of these comma separated agents; local for the master
+	AgentID string `query:"agent_id"`
+	// Only entries with this key=value label, or with the key set
+	Label string `query:"label"`
+	// Sort by name, state, agent_id, owner, project, created_at, expires_at; prefix - for descending
+	Sort string `query:"sort"`
+	// Entries per page, at most 1000; every entry when 0
+	Limit int `query:"limit"`
+	// Entries to skip
+	Offset int `query:"offset"`
+}
+
+// ListVMsResponse is the answer of ListVMs
+type ListVMsResponse struct {
+	Hosts   []models.HostListing `json:"hosts"`
+	Limit   int                  `json:"limit"`
+	Offset  int                  `json:"offset"`
+	Success bool                 `json:"success"`
+	Total   int                  `json:"total"`
+	VMs     []models.VMListing   `json:"vms"`
+}
+
+// GetVMInfoParams are the query parameters of GetVMInfo
+type GetVMInfoParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+}
+
+// UpdateVMMetadataResponse is the answer of UpdateVMMetadata
+type UpdateVMMetadataResponse struct {
+	Metadata *models.VMMetadata `json:"metadata"`
+	Success  bool               `json:"success"`
+}
+
+// StartVMResponse is the answer of StartVM
+type StartVMResponse struct {
+	Message  string   `json:"message"`
+	State    string   `json:"state"`
+	Success  bool     `json:"success"`
+	Warnings []string `json:"warnings"`
+}
+
+// StopVMResponse is the answer of StopVM
+type StopVMResponse struct {
+	DelayMinutes int    `json:"delay_minutes"`
+	Message      string `json:"message"`
+	Success      bool   `json:"success"`
+}
+
+// CancelStopVMResponse is the answer of CancelStopVM
+type CancelStopVMResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// SuspendVMResponse is the answer of SuspendVM
+type SuspendVMResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// ResumeVMResponse is the answer of ResumeVM
+type ResumeVMResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// RestartVMResponse is the answer of RestartVM
+type RestartVMResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// DeleteVMResponse is the answer of DeleteVM
+type DeleteVMResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// RecoverVMResponse is the answer of RecoverVM
+type RecoverVMResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// PurgeVMResponse is the answer of PurgeVM
+type PurgeVMResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// BulkVMActionResponse is the answer of BulkVMAction
+type BulkVMActionResponse struct {
+	Action  string `json:"action"`
+	Failed  int    `json:"failed"`
+	Results []struct {
+		AgentID string                `json:"agent_id"`
+		Error   *models.ErrorResponse `json:"error"`
+		Message string                `json:"message"`
+		Name    string                `json:"name"`
+		Success bool                  `json:"success"`
+	} `json:"results"`
+	Succeeded int  `json:"succeeded"`
+	Success   bool `json:"success"`
+}
+
+// ResizeVMResponse is the answer of ResizeVM
+type ResizeVMResponse struct {
+	Message string                  `json:"message"`
+	Phases  []models.OperationPhase `json:"phases"`
+	Success bool                    `json:"success"`
+}
+
+// CloneVMResponse is the answer of CloneVM
+type CloneVMResponse struct {
+	AgentHostname *string                 `json:"agent_hostname"`
+	AgentID       *string                 `json:"agent_id"`
+	Message       string                  `json:"message"`
+	Method        string                  `json:"method"`
+	Phases        []models.OperationPhase `json:"phases"`
+	State         string                  `json:"state"`
+	Success       bool                    `json:"success"`
+	VMName        string                  `json:"vm_name"`
+	Warnings      []string                `json:"warnings"`
+}
+
+// MountVMResponse is the answer of MountVM
+type MountVMResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// UnmountVMResponse is the answer of UnmountVM
+type UnmountVMResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// ListVMMountsParams are the query parameters of ListVMMounts
+type ListVMMountsParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+}
+
+// ListVMMountsResponse is the answer of ListVMMounts
+type ListVMMountsResponse struct {
+	Mounts  []models.VMMount `json:"mounts"`
+	Success bool             `json:"success"`
+	VMName  string           `json:"vm_name"`
+}
+
+// TransferFileResponse is the answer of TransferFile
+type TransferFileResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// GetVMLogsParams are the query parameters of GetVMLogs
+type GetVMLogsParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+	// The log to read; cloud-init's output by default
+	Source string `query:"source"`
+	// How many lines to read
+	Tail string `query:"tail"`
+	// Stream lines as they are written
+	Follow bool `query:"follow"`
+}
+
+// GetVMLogsResponse is the answer of GetVMLogs
+type GetVMLogsResponse struct {
+	Log     string `json:"log"`
+	Path    string `json:"path"`
+	Source  string `json:"source"`
+	Success bool   `json:"success"`
+	VMName  string `json:"vm_name"`
+}
+
+// GetVMConnectionParams are the query parameters of GetVMConnection
+type GetVMConnectionParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+	// The user to ssh in as
+	User string `query:"user"`
+}
+
+// GetVMConnectionResponse is the answer of GetVMConnection
+type GetVMConnectionResponse struct {
+	Connection models.VMConnection `json:"connection"`
+	Success    bool                `json:"success"`
+}
+
+// ForwardPortResponse is the answer of ForwardPort
+type ForwardPortResponse struct {
+	Address string              `json:"address"`
+	Forward *models.PortForward `json:"forward"`
+	Success bool                `json:"success"`
+}
+
+// AuthorizeKeyResponse is the answer of AuthorizeKey
+type AuthorizeKeyResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+	User    string `json:"user"`
+}
+
+// ShareVMResponse is the answer of ShareVM
+type ShareVMResponse struct {
+	Message  string             `json:"message"`
+	Metadata *models.VMMetadata `json:"metadata"`
+	Success  bool               `json:"success"`
+}
+
+// UnshareVMParams are the query parameters of UnshareVM
+type UnshareVMParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+}
+
+// UnshareVMResponse is the answer of UnshareVM
+type UnshareVMResponse struct {
+	Message  string             `json:"message"`
+	Metadata *models.VMMetadata `json:"metadata"`
+	Success  bool               `json:"success"`
+}
+
+// ListForwardsParams are the query parameters of ListForwards
+type ListForwardsParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+}
+
+// ListForwardsResponse is the answer of ListForwards
+type ListForwardsResponse struct {
+	Errors   map[string]string    `json:"errors"`
+	Forwards []models.PortForward `json:"forwards"`
+	Success  bool                 `json:"success"`
+}
+
+// RemoveForwardParams are the query parameters of RemoveForward
+type RemoveForwardParams struct {
+	// The agent to ask; the master when empty
+	AgentID string `query:"agent_id"`
+}
+
+// RemoveForwardResponse is the answer of RemoveForward
+type RemoveForwardResponse struct {
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+}
+
+// Healthz calls GET /healthz: Report liveness and whether VMs can be managed on the master itself
+func (c *Client) Healthz(ctx context.Context) (*HealthzResponse, error) {
+	var out HealthzResponse
+	if err := c.do(ctx, "GET", "/healthz", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Readyz calls GET /readyz: Report whether the master is ready to serve; answers 503 with the failed checks when not
+func (c *Client) Readyz(ctx context.Context) (*ReadyzResponse, error) {
+	var out ReadyzResponse
+	if err := c.do(ctx, "GET", "/readyz", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetOpenAPI calls GET /api/v1/openapi.json: Get this OpenAPI document
+func (c *Client) GetOpenAPI(ctx context.Context) (map[string]interface{}, error) {
+	var out map[string]interface{}
+	err := c.do(ctx, "GET", "/api/v1/openapi.json", nil, nil, &out)
+	return out, err
+}
+
+// AdminStatus calls GET /api/v1/admin/status: Report the master's executors and each agent's requests in flight
+func (c *Client) AdminStatus(ctx context.Context) (*AdminStatusResponse, error) {
+	var out AdminStatusResponse
+	if err := c.do(ctx, "GET", "/api/v1/admin/status", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ReloadSecrets calls POST /api/v1/admin/secrets/reload: Reload secrets from Vault or their files
+func (c *Client) ReloadSecrets(ctx context.Context) (*ReloadSecretsResponse, error) {
+	var out ReloadSecretsResponse
+	if err := c.do(ctx, "POST", "/api/v1/admin/secrets/reload", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateBackup calls POST /api/v1/admin/backup: Download an archive of the users, agents, templates, VM metadata and finished tasks, returning the application/octet-stream response for the caller to read and close
+func (c *Client) CreateBackup(ctx context.Context) (*http.Response, error) {
+	return c.stream(ctx, "POST", "/api/v1/admin/backup", nil, nil)
+}
+
+// Login calls POST /api/v1/auth/login: Log in, setting the session cookie
+func (c *Client) Login(ctx context.Context, body models.LoginRequest) (*LoginResponse, error) {
+	var out LoginResponse
+	if err := c.do(ctx, "POST", "/api/v1/auth/login", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Logout calls POST /api/v1/auth/logout: Log out, ending the session
+func (c *Client) Logout(ctx context.Context) (*LogoutResponse, error) {
+	var out LogoutResponse
+	if err := c.do(ctx, "POST", "/api/v1/auth/logout", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// IssueJWT calls POST /api/v1/auth/token: Exchange a username and password for a JWT pair
+func (c *Client) IssueJWT(ctx context.Context, body models.LoginRequest) (*IssueJWTResponse, error) {
+	var out IssueJWTResponse
+	if err := c.do(ctx, "POST", "/api/v1/auth/token", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RefreshJWT calls POST /api/v1/auth/refresh: Exchange a refresh token for a new JWT pair
+func (c *Client) RefreshJWT(ctx context.Context, body models.RefreshRequest) (*RefreshJWTResponse, error) {
+	var out RefreshJWTResponse
+	if err := c.do(ctx, "POST", "/api/v1/auth/refresh", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CheckAuth calls GET /api/v1/auth/check: Report whether the request is logged in, and as whom
+func (c *Client) CheckAuth(ctx context.Context) (*CheckAuthResponse, error) {
+	var out CheckAuthResponse
+	if err := c.do(ctx, "GET", "/api/v1/auth/check", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ChangePassword calls POST /api/v1/auth/change-password: Change the current user's password
+func (c *Client) ChangePassword(ctx context.Context, body models.PasswordChangeRequest) (*ChangePasswordResponse, error) {
+	var out ChangePasswordResponse
+	if err := c.do(ctx, "POST", "/api/v1/auth/change-password", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateUser calls POST /api/v1/users: Create a user or service account
+func (c *Client) CreateUser(ctx context.Context, body models.UserCreateRequest) (*CreateUserResponse, error) {
+	var out CreateUserResponse
+	if err := c.do(ctx, "POST", "/api/v1/users", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListUsers calls GET /api/v1/users: List the users
+func (c *Client) ListUsers(ctx context.Context) (*ListUsersResponse, error) {
+	var out ListUsersResponse
+	if err := c.do(ctx, "GET", "/api/v1/users", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteUser calls DELETE /api/v1/users/:username: Delete a user
+func (c *Client) DeleteUser(ctx context.Context, username string) (*DeleteUserResponse, error) {
+	var out DeleteUserResponse
+	if err := c.do(ctx, "DELETE", "/api/v1/users/"+url.PathEscape(username), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateToken calls POST /api/v1/tokens: Create an API token; its secret is only answered now
+func (c *Client) CreateToken(ctx context.Context, body models.TokenCreateRequest) (*CreateTokenResponse, error) {
+	var out CreateTokenResponse
+	if err := c.do(ctx, "POST", "/api/v1/tokens", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListTokens calls GET /api/v1/tokens: List API tokens: the user's own, or for admins every token
+func (c *Client) ListTokens(ctx context.Context, params *ListTokensParams) (*ListTokensResponse, error) {
+	var out ListTokensResponse
+	if err := c.do(ctx, "GET", "/api/v1/tokens", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteToken calls DELETE /api/v1/tokens/:id: Revoke an API token
+func (c *Client) DeleteToken(ctx context.Context, id string) (*DeleteTokenResponse, error) {
+	var out DeleteTokenResponse
+	if err := c.do(ctx, "DELETE", "/api/v1/tokens/"+url.PathEscape(id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RegisterAgent calls POST /api/v1/agent/register: Register an agent with the master
+func (c *Client) RegisterAgent(ctx context.Context, body models.AgentRegisterRequest) (*RegisterAgentResponse, error) {
+	var out RegisterAgentResponse
+	if err := c.do(ctx, "POST", "/api/v1/agent/register", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UnregisterAgent calls DELETE /api/v1/agent/unregister/:agent_id: Unregister an agent
+func (c *Client) UnregisterAgent(ctx context.Context, agentID string) (*UnregisterAgentResponse, error) {
+	var out UnregisterAgentResponse
+	if err := c.do(ctx, "DELETE", "/api/v1/agent/unregister/"+url.PathEscape(agentID), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListAgents calls GET /api/v1/agent/list: List the registered agents; X-Total-Count has how many matched
+func (c *Client) ListAgents(ctx context.Context, params *ListAgentsParams) ([]*models.AgentInfo, error) {
+	var out []*models.AgentInfo
+	err := c.do(ctx, "GET", "/api/v1/agent/list", params, nil, &out)
+	return out, err
+}
+
+// AgentHistory calls GET /api/v1/agent/history: List agents archived after staying offline past the retention period
+func (c *Client) AgentHistory(ctx context.Context) (*AgentHistoryResponse, error) {
+	var out AgentHistoryResponse
+	if err := c.do(ctx, "GET", "/api/v1/agent/history", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetAgentInfo calls GET /api/v1/agent/info/:agent_id: Get an agent
+func (c *Client) GetAgentInfo(ctx context.Context, agentID string) (*GetAgentInfoResponse, error) {
+	var out GetAgentInfoResponse
+	if err := c.do(ctx, "GET", "/api/v1/agent/info/"+url.PathEscape(agentID), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// AgentHeartbeat calls POST /api/v1/agent/heartbeat: Report an agent is alive, with its health
+func (c *Client) AgentHeartbeat(ctx context.Context, body models.AgentHeartbeat) (*AgentHeartbeatResponse, error) {
+	var out AgentHeartbeatResponse
+	if err := c.do(ctx, "POST", "/api/v1/agent/heartbeat", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// AgentVMState calls POST /api/v1/agent/vm-state: Report changes to an agent's VMs
+func (c *Client) AgentVMState(ctx context.Context, body models.AgentVMReport) (*AgentVMStateResponse, error) {
+	var out AgentVMStateResponse
+	if err := c.do(ctx, "POST", "/api/v1/agent/vm-state", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeregisterAgent calls POST /api/v1/agent/deregister: Mark an agent that is shutting down offline
+func (c *Client) DeregisterAgent(ctx context.Context, body models.AgentDeregisterRequest) (*DeregisterAgentResponse, error) {
+	var out DeregisterAgentResponse
+	if err := c.do(ctx, "POST", "/api/v1/agent/deregister", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ImportAgent calls POST /api/v1/agent/import/:agent_id: Import an agent's existing VMs into the metadata store
+func (c *Client) ImportAgent(ctx context.Context, agentID string, body models.AgentImportRequest) (*ImportAgentResponse, error) {
+	var out ImportAgentResponse
+	if err := c.do(ctx, "POST", "/api/v1/agent/import/"+url.PathEscape(agentID), nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DrainAgent calls POST /api/v1/agent/:agent_id/drain: Stop placing new VMs on an agent, optionally stopping its VMs
+func (c *Client) DrainAgent(ctx context.Context, agentID string, body models.AgentDrainRequest) (*DrainAgentResponse, error) {
+	var out DrainAgentResponse
+	if err := c.do(ctx, "POST", "/api/v1/agent/"+url.PathEscape(agentID)+"/drain", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UndrainAgent calls POST /api/v1/agent/:agent_id/undrain: Place new VMs on a drained agent again
+func (c *Client) UndrainAgent(ctx context.Context, agentID string) (*UndrainAgentResponse, error) {
+	var out UndrainAgentResponse
+	if err := c.do(ctx, "POST", "/api/v1/agent/"+url.PathEscape(agentID)+"/undrain", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RotateAgentKey calls POST /api/v1/agent/:agent_id/rotate-key: Rotate the API key the master calls an agent with
+func (c *Client) RotateAgentKey(ctx context.Context, agentID string) (*RotateAgentKeyResponse, error) {
+	var out RotateAgentKeyResponse
+	if err := c.do(ctx, "POST", "/api/v1/agent/"+url.PathEscape(agentID)+"/rotate-key", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetAgentZone calls PUT /api/v1/agent/:agent_id/zone: Move an agent to a zone
+func (c *Client) SetAgentZone(ctx context.Context, agentID string, body models.AgentZoneRequest) (*SetAgentZoneResponse, error) {
+	var out SetAgentZoneResponse
+	if err := c.do(ctx, "PUT", "/api/v1/agent/"+url.PathEscape(agentID)+"/zone", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ApproveAgent calls POST /api/v1/agent/approve/:agent_id: Approve an agent awaiting approval
+func (c *Client) ApproveAgent(ctx context.Context, agentID string) (*ApproveAgentResponse, error) {
+	var out ApproveAgentResponse
+	if err := c.do(ctx, "POST", "/api/v1/agent/approve/"+url.PathEscape(agentID), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RejectAgent calls POST /api/v1/agent/reject/:agent_id: Reject an agent awaiting approval
+func (c *Client) RejectAgent(ctx context.Context, agentID string) (*RejectAgentResponse, error) {
+	var out RejectAgentResponse
+	if err := c.do(ctx, "POST", "/api/v1/agent/reject/"+url.PathEscape(agentID), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// IssueTerminalTicket calls POST /api/v1/terminal/ticket: Issue a one-time ticket to open a VM's terminal
+func (c *Client) IssueTerminalTicket(ctx context.Context, body models.TerminalTicketRequest) (*IssueTerminalTicketResponse, error) {
+	var out IssueTerminalTicketResponse
+	if err := c.do(ctx, "POST", "/api/v1/terminal/ticket", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListTasks calls GET /api/v1/tasks: Search the task history, newest first
+func (c *Client) ListTasks(ctx context.Context, params *ListTasksParams) (*ListTasksResponse, error) {
+	var out ListTasksResponse
+	if err := c.do(ctx, "GET", "/api/v1/tasks", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetTask calls GET /api/v1/tasks/:id: Get a task with its logs and outcome
+func (c *Client) GetTask(ctx context.Context, id string) (*GetTaskResponse, error) {
+	var out GetTaskResponse
+	if err := c.do(ctx, "GET", "/api/v1/tasks/"+url.PathEscape(id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListZones calls GET /api/v1/zones: List the zones that have agents
+func (c *Client) ListZones(ctx context.Context) (*ListZonesResponse, error) {
+	var out ListZonesResponse
+	if err := c.do(ctx, "GET", "/api/v1/zones", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListZoneAgents calls GET /api/v1/zones/:zone/agents: List the agents in a zone
+func (c *Client) ListZoneAgents(ctx context.Context, zone string) (*ListZoneAgentsResponse, error) {
+	var out ListZoneAgentsResponse
+	if err := c.do(ctx, "GET", "/api/v1/zones/"+url.PathEscape(zone)+"/agents", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateZoneVM calls POST /api/v1/zones/:zone/vm/create: Create a VM on the best agent of a zone
+func (c *Client) CreateZoneVM(ctx context.Context, zone string, body models.VMCreateRequest) (*CreateZoneVMResponse, error) {
+	var out CreateZoneVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/zones/"+url.PathEscape(zone)+"/vm/create", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateZoneVMAsync calls POST /api/v1/zones/:zone/vm/create: Create a VM on the best agent of a zone, asking for a task to be answered at once
+func (c *Client) CreateZoneVMAsync(ctx context.Context, zone string, body models.VMCreateRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/zones/"+url.PathEscape(zone)+"/vm/create", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetDefaults calls GET /api/v1/defaults: Get the primary VM and the default agent
+func (c *Client) GetDefaults(ctx context.Context) (*GetDefaultsResponse, error) {
+	var out GetDefaultsResponse
+	if err := c.do(ctx, "GET", "/api/v1/defaults", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetDefaults calls PUT /api/v1/defaults: Set the primary VM and the default agent
+func (c *Client) SetDefaults(ctx context.Context, body models.Defaults) (*SetDefaultsResponse, error) {
+	var out SetDefaultsResponse
+	if err := c.do(ctx, "PUT", "/api/v1/defaults", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetDefaultSSHKeys calls PUT /api/v1/defaults/ssh-keys: Set the SSH keys authorized in every new VM
+func (c *Client) SetDefaultSSHKeys(ctx context.Context, body SetDefaultSSHKeysRequest) (*SetDefaultSSHKeysResponse, error) {
+	var out SetDefaultSSHKeysResponse
+	if err := c.do(ctx, "PUT", "/api/v1/defaults/ssh-keys", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListQuotas calls GET /api/v1/quotas: List the quotas with what each user and agent uses
+func (c *Client) ListQuotas(ctx context.Context) (*ListQuotasResponse, error) {
+	var out ListQuotasResponse
+	if err := c.do(ctx, "GET", "/api/v1/quotas", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetUserQuota calls PUT /api/v1/quotas/users/:username: Set the quota of a user
+func (c *Client) SetUserQuota(ctx context.Context, username string, body models.Quota) (*SetUserQuotaResponse, error) {
+	var out SetUserQuotaResponse
+	if err := c.do(ctx, "PUT", "/api/v1/quotas/users/"+url.PathEscape(username), nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteUserQuota calls DELETE /api/v1/quotas/users/:username: Remove the quota of a user
+func (c *Client) DeleteUserQuota(ctx context.Context, username string) (*DeleteUserQuotaResponse, error) {
+	var out DeleteUserQuotaResponse
+	if err := c.do(ctx, "DELETE", "/api/v1/quotas/users/"+url.PathEscape(username), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetAgentQuota calls PUT /api/v1/quotas/agents/:agent_id: Set the quota of an agent
+func (c *Client) SetAgentQuota(ctx context.Context, agentID string, body models.Quota) (*SetAgentQuotaResponse, error) {
+	var out SetAgentQuotaResponse
+	if err := c.do(ctx, "PUT", "/api/v1/quotas/agents/"+url.PathEscape(agentID), nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteAgentQuota calls DELETE /api/v1/quotas/agents/:agent_id: Remove the quota of an agent
+func (c *Client) DeleteAgentQuota(ctx context.Context, agentID string) (*DeleteAgentQuotaResponse, error) {
+	var out DeleteAgentQuotaResponse
+	if err := c.do(ctx, "DELETE", "/api/v1/quotas/agents/"+url.PathEscape(agentID), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateMaintenanceWindow calls POST /api/v1/maintenance/windows: Schedule a recurring maintenance window for an agent or zone
+func (c *Client) CreateMaintenanceWindow(ctx context.Context, body models.MaintenanceWindow) (*CreateMaintenanceWindowResponse, error) {
+	var out CreateMaintenanceWindowResponse
+	if err := c.do(ctx, "POST", "/api/v1/maintenance/windows", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListMaintenanceWindows calls GET /api/v1/maintenance/windows: List maintenance windows with their current or next occurrence
+func (c *Client) ListMaintenanceWindows(ctx context.Context, params *ListMaintenanceWindowsParams) (*ListMaintenanceWindowsResponse, error) {
+	var out ListMaintenanceWindowsResponse
+	if err := c.do(ctx, "GET", "/api/v1/maintenance/windows", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteMaintenanceWindow calls DELETE /api/v1/maintenance/windows/:id: Remove a maintenance window
+func (c *Client) DeleteMaintenanceWindow(ctx context.Context, id string) (*DeleteMaintenanceWindowResponse, error) {
+	var out DeleteMaintenanceWindowResponse
+	if err := c.do(ctx, "DELETE", "/api/v1/maintenance/windows/"+url.PathEscape(id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateSchedule calls POST /api/v1/schedules: Create a power schedule
+func (c *Client) CreateSchedule(ctx context.Context, body models.PowerSchedule) (*CreateScheduleResponse, error) {
+	var out CreateScheduleResponse
+	if err := c.do(ctx, "POST", "/api/v1/schedules", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListSchedules calls GET /api/v1/schedules: List power schedules with their next run
+func (c *Client) ListSchedules(ctx context.Context) (*ListSchedulesResponse, error) {
+	var out ListSchedulesResponse
+	if err := c.do(ctx, "GET", "/api/v1/schedules", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteSchedule calls DELETE /api/v1/schedules/:id: Remove a power schedule
+func (c *Client) DeleteSchedule(ctx context.Context, id string) (*DeleteScheduleResponse, error) {
+	var out DeleteScheduleResponse
+	if err := c.do(ctx, "DELETE", "/api/v1/schedules/"+url.PathEscape(id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RunSchedule calls POST /api/v1/schedules/:id/run: Run one of a schedule's actions now
+func (c *Client) RunSchedule(ctx context.Context, id string, body RunScheduleRequest) (*RunScheduleResponse, error) {
+	var out RunScheduleResponse
+	if err := c.do(ctx, "POST", "/api/v1/schedules/"+url.PathEscape(id)+"/run", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateStack calls POST /api/v1/stacks: Create a stack of VMs
+func (c *Client) CreateStack(ctx context.Context, body models.StackCreateRequest) (*CreateStackResponse, error) {
+	var out CreateStackResponse
+	if err := c.do(ctx, "POST", "/api/v1/stacks", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListStacks calls GET /api/v1/stacks: List stacks
+func (c *Client) ListStacks(ctx context.Context) (*ListStacksResponse, error) {
+	var out ListStacksResponse
+	if err := c.do(ctx, "GET", "/api/v1/stacks", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetStack calls GET /api/v1/stacks/:name: Get a stack's members with their current state
+func (c *Client) GetStack(ctx context.Context, name string) (*GetStackResponse, error) {
+	var out GetStackResponse
+	if err := c.do(ctx, "GET", "/api/v1/stacks/"+url.PathEscape(name), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StackAction calls POST /api/v1/stacks/:name/:action: Start, stop, suspend, restart or resume every VM of a stack
+func (c *Client) StackAction(ctx context.Context, name string, action string) (*StackActionResponse, error) {
+	var out StackActionResponse
+	if err := c.do(ctx, "POST", "/api/v1/stacks/"+url.PathEscape(name)+"/"+url.PathEscape(action), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteStack calls DELETE /api/v1/stacks/:name: Delete a stack and its VMs
+func (c *Client) DeleteStack(ctx context.Context, name string) (*DeleteStackResponse, error) {
+	var out DeleteStackResponse
+	if err := c.do(ctx, "DELETE", "/api/v1/stacks/"+url.PathEscape(name), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateTemplate calls POST /api/v1/templates: Define a VM template
+func (c *Client) CreateTemplate(ctx context.Context, body models.VMTemplate) (*CreateTemplateResponse, error) {
+	var out CreateTemplateResponse
+	if err := c.do(ctx, "POST", "/api/v1/templates", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListTemplates calls GET /api/v1/templates: List the VM templates
+func (c *Client) ListTemplates(ctx context.Context) (*ListTemplatesResponse, error) {
+	var out ListTemplatesResponse
+	if err := c.do(ctx, "GET", "/api/v1/templates", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetTemplate calls GET /api/v1/templates/:name: Get a VM template
+func (c *Client) GetTemplate(ctx context.Context, name string) (*GetTemplateResponse, error) {
+	var out GetTemplateResponse
+	if err := c.do(ctx, "GET", "/api/v1/templates/"+url.PathEscape(name), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateTemplate calls PUT /api/v1/templates/:name: Replace a VM template
+func (c *Client) UpdateTemplate(ctx context.Context, name string, body models.VMTemplate) (*UpdateTemplateResponse, error) {
+	var out UpdateTemplateResponse
+	if err := c.do(ctx, "PUT", "/api/v1/templates/"+url.PathEscape(name), nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteTemplate calls DELETE /api/v1/templates/:name: Remove a VM template
+func (c *Client) DeleteTemplate(ctx context.Context, name string) (*DeleteTemplateResponse, error) {
+	var out DeleteTemplateResponse
+	if err := c.do(ctx, "DELETE", "/api/v1/templates/"+url.PathEscape(name), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListNotifications calls GET /api/v1/notifications: List the current user's notifications
+func (c *Client) ListNotifications(ctx context.Context) (*ListNotificationsResponse, error) {
+	var out ListNotificationsResponse
+	if err := c.do(ctx, "GET", "/api/v1/notifications", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PollEvents calls GET /api/v1/events/poll: Long-poll for the events after a cursor
+func (c *Client) PollEvents(ctx context.Context, params *PollEventsParams) (*PollEventsResponse, error) {
+	var out PollEventsResponse
+	if err := c.do(ctx, "GET", "/api/v1/events/poll", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StreamEvents calls GET /api/v1/events/stream: Stream events as server-sent events, returning the text/event-stream response for the caller to read and close
+func (c *Client) StreamEvents(ctx context.Context, params *StreamEventsParams) (*http.Response, error) {
+	return c.stream(ctx, "GET", "/api/v1/events/stream", params, nil)
+}
+
+// ListAccessLogs calls GET /api/v1/access-logs: Search the access log, newest first
+func (c *Client) ListAccessLogs(ctx context.Context, params *ListAccessLogsParams) (*ListAccessLogsResponse, error) {
+	var out ListAccessLogsResponse
+	if err := c.do(ctx, "GET", "/api/v1/access-logs", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetLatestDigest calls GET /api/v1/digest/latest: Get the latest digest: all of it for admins, the user's items for others
+func (c *Client) GetLatestDigest(ctx context.Context) (*GetLatestDigestResponse, error) {
+	var out GetLatestDigestResponse
+	if err := c.do(ctx, "GET", "/api/v1/digest/latest", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GenerateDigest calls POST /api/v1/digest/generate: Compile and deliver a digest now
+func (c *Client) GenerateDigest(ctx context.Context) (*GenerateDigestResponse, error) {
+	var out GenerateDigestResponse
+	if err := c.do(ctx, "POST", "/api/v1/digest/generate", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListArtifacts calls GET /api/v1/artifacts: List the artifacts collected from VMs
+func (c *Client) ListArtifacts(ctx context.Context, params *ListArtifactsParams) (*ListArtifactsResponse, error) {
+	var out ListArtifactsResponse
+	if err := c.do(ctx, "GET", "/api/v1/artifacts", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetArtifact calls GET /api/v1/artifacts/:id: Get an artifact's metadata
+func (c *Client) GetArtifact(ctx context.Context, id string) (*GetArtifactResponse, error) {
+	var out GetArtifactResponse
+	if err := c.do(ctx, "GET", "/api/v1/artifacts/"+url.PathEscape(id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DownloadArtifact calls GET /api/v1/artifacts/:id/download: Download an artifact's contents, returning the application/octet-stream response for the caller to read and close
+func (c *Client) DownloadArtifact(ctx context.Context, id string) (*http.Response, error) {
+	return c.stream(ctx, "GET", "/api/v1/artifacts/"+url.PathEscape(id)+"/download", nil, nil)
+}
+
+// DeleteArtifact calls DELETE /api/v1/artifacts/:id: Remove an artifact
+func (c *Client) DeleteArtifact(ctx context.Context, id string) (*DeleteArtifactResponse, error) {
+	var out DeleteArtifactResponse
+	if err := c.do(ctx, "DELETE", "/api/v1/artifacts/"+url.PathEscape(id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListBlueprints calls GET /api/v1/blueprints: List the blueprints a host can launch
+func (c *Client) ListBlueprints(ctx context.Context, params *ListBlueprintsParams) (*ListBlueprintsResponse, error) {
+	var out ListBlueprintsResponse
+	if err := c.do(ctx, "GET", "/api/v1/blueprints", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListNetworks calls GET /api/v1/networks: List the interfaces a host's VMs can be bridged onto
+func (c *Client) ListNetworks(ctx context.Context, params *ListNetworksParams) (*ListNetworksResponse, error) {
+	var out ListNetworksResponse
+	if err := c.do(ctx, "GET", "/api/v1/networks", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetHostHealth calls GET /api/v1/host/health: Report the health of the master and every agent
+func (c *Client) GetHostHealth(ctx context.Context) (*GetHostHealthResponse, error) {
+	var out GetHostHealthResponse
+	if err := c.do(ctx, "GET", "/api/v1/host/health", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetHostVersion calls GET /api/v1/host/version: Report a host's multipass version
+func (c *Client) GetHostVersion(ctx context.Context, params *GetHostVersionParams) (*GetHostVersionResponse, error) {
+	var out GetHostVersionResponse
+	if err := c.do(ctx, "GET", "/api/v1/host/version", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetHostSettings calls GET /api/v1/host/settings: Read a host's multipass daemon settings
+func (c *Client) GetHostSettings(ctx context.Context, params *GetHostSettingsParams) (*GetHostSettingsResponse, error) {
+	var out GetHostSettingsResponse
+	if err := c.do(ctx, "GET", "/api/v1/host/settings", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetHostSettings calls PUT /api/v1/host/settings: Change a host's multipass daemon settings
+func (c *Client) SetHostSettings(ctx context.Context, body models.HostSettingsRequest) (*SetHostSettingsResponse, error) {
+	var out SetHostSettingsResponse
+	if err := c.do(ctx, "PUT", "/api/v1/host/settings", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetHostStorage calls GET /api/v1/host/storage: Report the disk space multipass uses on a host
+func (c *Client) GetHostStorage(ctx context.Context, params *GetHostStorageParams) (*GetHostStorageResponse, error) {
+	var out GetHostStorageResponse
+	if err := c.do(ctx, "GET", "/api/v1/host/storage", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PruneHost calls POST /api/v1/host/prune: Purge deleted VMs and clear the image cache of a host
+func (c *Client) PruneHost(ctx context.Context, body models.HostPruneRequest) (*PruneHostResponse, error) {
+	var out PruneHostResponse
+	if err := c.do(ctx, "POST", "/api/v1/host/prune", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateVM calls POST /api/v1/vm/create: Create a VM
+func (c *Client) CreateVM(ctx context.Context, body models.VMCreateRequest) (*CreateVMResponse, error) {
+	var out CreateVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/create", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateVMAsync calls POST /api/v1/vm/create: Create a VM, asking for a task to be answered at once
+func (c *Client) CreateVMAsync(ctx context.Context, body models.VMCreateRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/create", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateVMStream calls POST /api/v1/vm/create/stream: Create a VM, streaming its progress as server-sent events, returning the text/event-stream response for the caller to read and close
+func (c *Client) CreateVMStream(ctx context.Context, body models.VMCreateRequest) (*http.Response, error) {
+	return c.stream(ctx, "POST", "/api/v1/vm/create/stream", nil, body)
+}
+
+// CreateVMBatch calls POST /api/v1/vm/create/batch: Create several VMs at once
+func (c *Client) CreateVMBatch(ctx context.Context, body models.VMBatchCreateRequest) (*CreateVMBatchResponse, error) {
+	var out CreateVMBatchResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/create/batch", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateVMBatchAsync calls POST /api/v1/vm/create/batch: Create several VMs at once, asking for a task to be answered at once
+func (c *Client) CreateVMBatchAsync(ctx context.Context, body models.VMBatchCreateRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/create/batch", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListVMs calls GET /api/v1/vm/list: List the VMs of every host
+func (c *Client) ListVMs(ctx context.Context, params *ListVMsParams) (*ListVMsResponse, error) {
+	var out ListVMsResponse
+	if err := c.do(ctx, "GET", "/api/v1/vm/list", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetVMInfo calls GET /api/v1/vm/info/:vm_name: Get a VM's details
+func (c *Client) GetVMInfo(ctx context.Context, vmName string, params *GetVMInfoParams) (*models.VMInfo, error) {
+	var out models.VMInfo
+	if err := c.do(ctx, "GET", "/api/v1/vm/info/"+url.PathEscape(vmName), params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateVMMetadata calls PUT /api/v1/vm/metadata: Change a VM's owner, labels, description or expiry
+func (c *Client) UpdateVMMetadata(ctx context.Context, body models.VMMetadataRequest) (*UpdateVMMetadataResponse, error) {
+	var out UpdateVMMetadataResponse
+	if err := c.do(ctx, "PUT", "/api/v1/vm/metadata", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateVMMetadataAsync calls PUT /api/v1/vm/metadata: Change a VM's owner, labels, description or expiry, asking for a task to be answered at once
+func (c *Client) UpdateVMMetadataAsync(ctx context.Context, body models.VMMetadataRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "PUT", "/api/v1/vm/metadata", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StartVM calls POST /api/v1/vm/start: Start a VM
+func (c *Client) StartVM(ctx context.Context, body models.VMActionRequest) (*StartVMResponse, error) {
+	var out StartVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/start", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StartVMAsync calls POST /api/v1/vm/start: Start a VM, asking for a task to be answered at once
+func (c *Client) StartVMAsync(ctx context.Context, body models.VMActionRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/start", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StopVM calls POST /api/v1/vm/stop: Stop a VM, now or after delay_minutes
+func (c *Client) StopVM(ctx context.Context, body models.VMActionRequest) (*StopVMResponse, error) {
+	var out StopVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/stop", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StopVMAsync calls POST /api/v1/vm/stop: Stop a VM, now or after delay_minutes, asking for a task to be answered at once
+func (c *Client) StopVMAsync(ctx context.Context, body models.VMActionRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/stop", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CancelStopVM calls POST /api/v1/vm/stop/cancel: Cancel a delayed stop
+func (c *Client) CancelStopVM(ctx context.Context, body models.VMActionRequest) (*CancelStopVMResponse, error) {
+	var out CancelStopVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/stop/cancel", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CancelStopVMAsync calls POST /api/v1/vm/stop/cancel: Cancel a delayed stop, asking for a task to be answered at once
+func (c *Client) CancelStopVMAsync(ctx context.Context, body models.VMActionRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/stop/cancel", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SuspendVM calls POST /api/v1/vm/suspend: Suspend a VM
+func (c *Client) SuspendVM(ctx context.Context, body models.VMActionRequest) (*SuspendVMResponse, error) {
+	var out SuspendVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/suspend", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SuspendVMAsync calls POST /api/v1/vm/suspend: Suspend a VM, asking for a task to be answered at once
+func (c *Client) SuspendVMAsync(ctx context.Context, body models.VMActionRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/suspend", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ResumeVM calls POST /api/v1/vm/resume: Resume a suspended VM
+func (c *Client) ResumeVM(ctx context.Context, body models.VMActionRequest) (*ResumeVMResponse, error) {
+	var out ResumeVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/resume", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ResumeVMAsync calls POST /api/v1/vm/resume: Resume a suspended VM, asking for a task to be answered at once
+func (c *Client) ResumeVMAsync(ctx context.Context, body models.VMActionRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/resume", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RestartVM calls POST /api/v1/vm/restart: Restart a VM
+func (c *Client) RestartVM(ctx context.Context, body models.VMActionRequest) (*RestartVMResponse, error) {
+	var out RestartVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/restart", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RestartVMAsync calls POST /api/v1/vm/restart: Restart a VM, asking for a task to be answered at once
+func (c *Client) RestartVMAsync(ctx context.Context, body models.VMActionRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/restart", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteVM calls POST /api/v1/vm/delete: Delete a VM, or soft-delete it with soft_delete
+func (c *Client) DeleteVM(ctx context.Context, body models.VMActionRequest) (*DeleteVMResponse, error) {
+	var out DeleteVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/delete", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteVMAsync calls POST /api/v1/vm/delete: Delete a VM, or soft-delete it with soft_delete, asking for a task to be answered at once
+func (c *Client) DeleteVMAsync(ctx context.Context, body models.VMActionRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/delete", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RecoverVM calls POST /api/v1/vm/recover: Recover a soft-deleted VM
+func (c *Client) RecoverVM(ctx context.Context, body models.VMActionRequest) (*RecoverVMResponse, error) {
+	var out RecoverVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/recover", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RecoverVMAsync calls POST /api/v1/vm/recover: Recover a soft-deleted VM, asking for a task to be answered at once
+func (c *Client) RecoverVMAsync(ctx context.Context, body models.VMActionRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/recover", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PurgeVM calls POST /api/v1/vm/purge: Permanently remove a soft-deleted VM
+func (c *Client) PurgeVM(ctx context.Context, body models.VMActionRequest) (*PurgeVMResponse, error) {
+	var out PurgeVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/purge", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PurgeVMAsync calls POST /api/v1/vm/purge: Permanently remove a soft-deleted VM, asking for a task to be answered at once
+func (c *Client) PurgeVMAsync(ctx context.Context, body models.VMActionRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/purge", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// BulkVMAction calls POST /api/v1/vm/bulk: Take one action on many VMs
+func (c *Client) BulkVMAction(ctx context.Context, body models.VMBulkRequest) (*BulkVMActionResponse, error) {
+	var out BulkVMActionResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/bulk", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// BulkVMActionAsync calls POST /api/v1/vm/bulk: Take one action on many VMs, asking for a task to be answered at once
+func (c *Client) BulkVMActionAsync(ctx context.Context, body models.VMBulkRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/bulk", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ResizeVM calls POST /api/v1/vm/resize: Change a VM's CPUs, memory or disk
+func (c *Client) ResizeVM(ctx context.Context, body models.VMResizeRequest) (*ResizeVMResponse, error) {
+	var out ResizeVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/resize", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ResizeVMAsync calls POST /api/v1/vm/resize: Change a VM's CPUs, memory or disk, asking for a task to be answered at once
+func (c *Client) ResizeVMAsync(ctx context.Context, body models.VMResizeRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/resize", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CloneVM calls POST /api/v1/vm/clone: Clone a VM
+func (c *Client) CloneVM(ctx context.Context, body models.VMCloneRequest) (*CloneVMResponse, error) {
+	var out CloneVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/clone", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CloneVMAsync calls POST /api/v1/vm/clone: Clone a VM, asking for a task to be answered at once
+func (c *Client) CloneVMAsync(ctx context.Context, body models.VMCloneRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/clone", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// MountVM calls POST /api/v1/vm/mount: Mount a host directory into a VM
+func (c *Client) MountVM(ctx context.Context, body models.VMMountRequest) (*MountVMResponse, error) {
+	var out MountVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/mount", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// MountVMAsync calls POST /api/v1/vm/mount: Mount a host directory into a VM, asking for a task to be answered at once
+func (c *Client) MountVMAsync(ctx context.Context, body models.VMMountRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/mount", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UnmountVM calls POST /api/v1/vm/umount: Remove a mount from a VM, or every mount without a target
+func (c *Client) UnmountVM(ctx context.Context, body models.VMMountRequest) (*UnmountVMResponse, error) {
+	var out UnmountVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/umount", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UnmountVMAsync calls POST /api/v1/vm/umount: Remove a mount from a VM, or every mount without a target, asking for a task to be answered at once
+func (c *Client) UnmountVMAsync(ctx context.Context, body models.VMMountRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/umount", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListVMMounts calls GET /api/v1/vm/:vm_name/mounts: List the directories mounted into a VM
+func (c *Client) ListVMMounts(ctx context.Context, vmName string, params *ListVMMountsParams) (*ListVMMountsResponse, error) {
+	var out ListVMMountsResponse
+	if err := c.do(ctx, "GET", "/api/v1/vm/"+url.PathEscape(vmName)+"/mounts", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// TransferFile calls POST /api/v1/vm/transfer: Upload a file into a VM as a multipart form, or download one
+func (c *Client) TransferFile(ctx context.Context, body models.VMTransferRequest, filename string, file io.Reader) (*TransferFileResponse, error) {
+	var out TransferFileResponse
+	if err := c.upload(ctx, "POST", "/api/v1/vm/transfer", nil, body, "file", filename, file, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// TransferFileStream calls POST /api/v1/vm/transfer: Upload a file into a VM as a multipart form, or download one, returning the application/octet-stream response for the caller to read and close
+func (c *Client) TransferFileStream(ctx context.Context, body models.VMTransferRequest) (*http.Response, error) {
+	return c.stream(ctx, "POST", "/api/v1/vm/transfer", nil, body)
+}
+
+// ExecInVM calls POST /api/v1/vm/exec: Run a command in a VM; a non-zero exit code is not an error
+func (c *Client) ExecInVM(ctx context.Context, body models.VMExecRequest) (*models.VMExecResponse, error) {
+	var out models.VMExecResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/exec", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ExecInVMAsync calls POST /api/v1/vm/exec: Run a command in a VM; a non-zero exit code is not an error, asking for a task to be answered at once
+func (c *Client) ExecInVMAsync(ctx context.Context, body models.VMExecRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/exec", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetVMLogs calls GET /api/v1/vm/:vm_name/logs: Read the tail of a log inside a VM, or follow it as server-sent events
+func (c *Client) GetVMLogs(ctx context.Context, vmName string, params *GetVMLogsParams) (*GetVMLogsResponse, error) {
+	var out GetVMLogsResponse
+	if err := c.do(ctx, "GET", "/api/v1/vm/"+url.PathEscape(vmName)+"/logs", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetVMLogsStream calls GET /api/v1/vm/:vm_name/logs: Read the tail of a log inside a VM, or follow it as server-sent events, returning the text/event-stream response for the caller to read and close
+func (c *Client) GetVMLogsStream(ctx context.Context, vmName string, params *GetVMLogsParams) (*http.Response, error) {
+	return c.stream(ctx, "GET", "/api/v1/vm/"+url.PathEscape(vmName)+"/logs", params, nil)
+}
+
+// GetVMConnection calls GET /api/v1/vm/:vm_name/connection: Report a VM's addresses and an ssh command to reach it
+func (c *Client) GetVMConnection(ctx context.Context, vmName string, params *GetVMConnectionParams) (*GetVMConnectionResponse, error) {
+	var out GetVMConnectionResponse
+	if err := c.do(ctx, "GET", "/api/v1/vm/"+url.PathEscape(vmName)+"/connection", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ForwardPort calls POST /api/v1/vm/:vm_name/forward: Forward a host port to a port of a VM
+func (c *Client) ForwardPort(ctx context.Context, vmName string, body models.PortForwardRequest) (*ForwardPortResponse, error) {
+	var out ForwardPortResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/"+url.PathEscape(vmName)+"/forward", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ForwardPortAsync calls POST /api/v1/vm/:vm_name/forward: Forward a host port to a port of a VM, asking for a task to be answered at once
+func (c *Client) ForwardPortAsync(ctx context.Context, vmName string, body models.PortForwardRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/"+url.PathEscape(vmName)+"/forward", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// AuthorizeKey calls POST /api/v1/vm/:vm_name/authorize-key: Authorize an SSH key for a user of a VM
+func (c *Client) AuthorizeKey(ctx context.Context, vmName string, body models.AuthorizeKeyRequest) (*AuthorizeKeyResponse, error) {
+	var out AuthorizeKeyResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/"+url.PathEscape(vmName)+"/authorize-key", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// AuthorizeKeyAsync calls POST /api/v1/vm/:vm_name/authorize-key: Authorize an SSH key for a user of a VM, asking for a task to be answered at once
+func (c *Client) AuthorizeKeyAsync(ctx context.Context, vmName string, body models.AuthorizeKeyRequest) (*AsyncResponse, error) {
+	var out AsyncResponse
+	if err := c.doAsync(ctx, "POST", "/api/v1/vm/"+url.PathEscape(vmName)+"/authorize-key", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ShareVM calls POST /api/v1/vm/:vm_name/share: Share a VM with another user
+func (c *Client) ShareVM(ctx context.Context, vmName string, body models.VMShareRequest) (*ShareVMResponse, error) {
+	var out ShareVMResponse
+	if err := c.do(ctx, "POST", "/api/v1/vm/"+url.PathEscape(vmName)+"/share", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UnshareVM calls DELETE /api/v1/vm/:vm_name/share/:username: Stop sharing a VM with a user
+func (c *Client) UnshareVM(ctx context.Context, vmName string, username string, params *UnshareVMParams) (*UnshareVMResponse, error) {
+	var out UnshareVMResponse
+	if err := c.do(ctx, "DELETE", "/api/v1/vm/"+url.PathEscape(vmName)+"/share/"+url.PathEscape(username), params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListForwards calls GET /api/v1/forwards: List the port forwards of every host
+func (c *Client) ListForwards(ctx context.Context, params *ListForwardsParams) (*ListForwardsResponse, error) {
+	var out ListForwardsResponse
+	if err := c.do(ctx, "GET", "/api/v1/forwards", params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RemoveForward calls DELETE /api/v1/forwards/:id: Remove a port forward
+func (c *Client) RemoveForward(ctx context.Context, id string, params *RemoveForwardParams) (*RemoveForwardResponse, error) {
+	var out RemoveForwardResponse
+	if err := c.do(ctx, "DELETE", "/api/v1/forwards/"+url.PathEscape(id), params, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
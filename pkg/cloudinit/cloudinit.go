@@ -0,0 +1,129 @@
+package cloudinit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// templateNamePattern restricts template names to plain file names
+var templateNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// TemplatesDir gets the directory holding named cloud-init templates
+func TemplatesDir() string {
+	if dir := os.Getenv("CLOUD_INIT_TEMPLATES_DIR"); dir != "" {
+		return dir
+	}
+	return "./cloud-init"
+}
+
+// IsInline reports whether value is inline cloud-init YAML rather than a template name
+func IsInline(value string) bool {
+	return strings.Contains(value, "\n") || strings.HasPrefix(strings.TrimSpace(value), "#cloud-config")
+}
+
+// Resolve turns a cloud_init request value into YAML. Inline YAML is returned
+// unchanged; anything else is treated as the name of a template file
+// (<name>.yaml or <name>.yml) in TemplatesDir.
+func Resolve(value string) (string, error) {
+	if strings.TrimSpace(value) == "" {
+		return "", nil
+	}
+	if IsInline(value) {
+		return value, nil
+	}
+
+	name := strings.TrimSpace(value)
+	if !templateNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid cloud-init template name: %s", name)
+	}
+
+	for _, ext := range []string{".yaml", ".yml"} {
+		content, err := os.ReadFile(filepath.Join(TemplatesDir(), name+ext))
+		if err == nil {
+			return string(content), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read cloud-init template %s: %w", name, err)
+		}
+	}
+	return "", fmt.Errorf("cloud-init template not found: %s", name)
+}
+
+// WriteTempFile writes cloud-init YAML to a temporary file for multipass launch
+// --cloud-init and returns its path with a cleanup function. Snap-confined
+// multipass cannot read the system temp directory; point TMPDIR at a location
+// it can read (e.g. under $HOME) on such hosts.
+func WriteTempFile(content string) (string, func(), error) {
+	file, err := os.CreateTemp("", "batwa-cloud-init-*.yaml")
+	if err != nil {
+		return "", func() {}, err
+	}
+	cleanup := func() { os.Remove(file.Name()) }
+
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		cleanup()
+		return "", func() {}, err
+	}
+	if err := file.Close(); err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+
+	return file.Name(), cleanup, nil
+}
+
+// AddAuthorizedKeys adds keys to the default user's ssh_authorized_keys in
+// cloud-config YAML, creating the document when it is empty. Keys are
+// appended to an existing block-style list; other documents, such as shell
+// scripts or a flow-style list, are rejected rather than rewritten.
+func AddAuthorizedKeys(content string, keys []string) (string, error) {
+	if len(keys) == 0 {
+		return content, nil
+	}
+	listItems := func(indent string) string {
+		items := ""
+		for _, key := range keys {
+			items += fmt.Sprintf("%s- %q\n", indent, key)
+		}
+		return items
+	}
+
+	if strings.TrimSpace(content) == "" {
+		return "#cloud-config\nssh_authorized_keys:\n" + listItems("  "), nil
+	}
+	if !strings.HasPrefix(strings.TrimSpace(content), "#cloud-config") {
+		return "", fmt.Errorf("cloud-init is not a #cloud-config document")
+	}
+
+	lines := strings.SplitAfter(content, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "ssh_authorized_keys:") {
+			continue
+		}
+		if strings.TrimSpace(strings.TrimPrefix(line, "ssh_authorized_keys:")) != "" {
+			return "", fmt.Errorf("cloud-init ssh_authorized_keys must be a block list to add keys to")
+		}
+		// Match the indentation of the list's existing items
+		indent := "  "
+		if i+1 < len(lines) {
+			next := lines[i+1]
+			if trimmed := strings.TrimLeft(next, " "); strings.HasPrefix(trimmed, "- ") {
+				indent = next[:len(next)-len(trimmed)]
+			}
+		}
+		if !strings.HasSuffix(line, "\n") {
+			lines[i] += "\n"
+		}
+		lines[i] += listItems(indent)
+		return strings.Join(lines, ""), nil
+	}
+
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + "ssh_authorized_keys:\n" + listItems("  "), nil
+}
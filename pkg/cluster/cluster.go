@@ -0,0 +1,311 @@
+// Package cluster runs several masters as replicas sharing one database.
+// Every replica serves requests, so a load balancer can send any request to
+// any of them, and every replica syncs the state the others change. The
+// background jobs that must run once for the whole fleet, such as the
+// heartbeat monitor and the schedulers, run only on the leader: the replica
+// holding a lease in the database, which it renews while it runs. When the
+// leader stops or loses the database, another replica takes the lease once
+// it expires and starts the jobs.
+//
+// A master that is not in a cluster is its own leader: its jobs start with
+// it and nothing is synced.
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+var logger = logging.For("cluster")
+
+// Defaults of a cluster: how long the leader's lease lasts without being
+// renewed, and how often replicas sync the state the others changed
+const (
+	DefaultLeaseTTL     = 15 * time.Second
+	DefaultSyncInterval = 5 * time.Second
+)
+
+// leaseName names the lease the leader holds
+const leaseName = "leader"
+
+// Job is a background job that runs on the leader only
+type Job struct {
+	Name  string
+	Start func()
+	Stop  func()
+}
+
+// syncer refreshes state another replica may have changed
+type syncer struct {
+	name string
+	sync func() error
+}
+
+// Cluster elects the leader among the masters sharing a database, runs the
+// leader's jobs while this master leads and syncs shared state on every
+// replica
+type Cluster struct {
+	// db holds the lease, or is nil when the master runs alone
+	db           *storage.DB
+	replica      string
+	leaseTTL     time.Duration
+	syncInterval time.Duration
+	jobs         []Job
+	syncers      []syncer
+	leading      atomic.Bool
+	// jobMutex serializes starting and stopping the jobs
+	jobMutex   sync.Mutex
+	cancelFunc context.CancelFunc
+	done       chan struct{}
+}
+
+// Standalone creates the cluster of a master running alone, which always
+// leads
+func Standalone() *Cluster {
+	hostname, _ := os.Hostname()
+	return &Cluster{replica: hostname}
+}
+
+// New creates a cluster of the masters sharing db, in which this master is
+// replica. The leader renews its lease of leaseTTL a few times per lease,
+// and replicas sync every syncInterval.
+func New(db *storage.DB, replica string, leaseTTL, syncInterval time.Duration) *Cluster {
+	return &Cluster{db: db, replica: replica, leaseTTL: leaseTTL, syncInterval: syncInterval}
+}
+
+// NewFromEnv creates the cluster of the masters sharing db when
+// CLUSTER_ENABLED=true, or a standalone one otherwise. The replica is named
+// CLUSTER_REPLICA_ID, by default the hostname and a random suffix; the lease
+// lasts CLUSTER_LEASE_TTL (default 15s) and replicas sync every
+// CLUSTER_SYNC_INTERVAL (default 5s). Replicas must share a database, and
+// sessions kept in it or in Redis.
+func NewFromEnv(db *storage.DB) (*Cluster, error) {
+	if !strings.EqualFold(os.Getenv("CLUSTER_ENABLED"), "true") {
+		return Standalone(), nil
+	}
+	if db == nil {
+		return nil, fmt.Errorf("CLUSTER_ENABLED needs a database shared by the replicas: set STORAGE_DRIVER=postgres")
+	}
+	switch store := os.Getenv("SESSION_STORE"); store {
+	case "", "database", "redis":
+	default:
+		return nil, fmt.Errorf("SESSION_STORE=%s keeps sessions on one replica; use database or redis with CLUSTER_ENABLED", store)
+	}
+	if db.Driver() == storage.DriverSQLite {
+		logger.Warn("Clustering on SQLite: only replicas on this host can share the database", "database", db.String())
+	}
+
+	replica := os.Getenv("CLUSTER_REPLICA_ID")
+	if replica == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+		replica = hostname + "-" + hex.EncodeToString(suffix)
+	}
+	leaseTTL, err := durationFromEnv("CLUSTER_LEASE_TTL", DefaultLeaseTTL)
+	if err != nil {
+		return nil, err
+	}
+	syncInterval, err := durationFromEnv("CLUSTER_SYNC_INTERVAL", DefaultSyncInterval)
+	if err != nil {
+		return nil, err
+	}
+	return New(db, replica, leaseTTL, syncInterval), nil
+}
+
+// durationFromEnv reads a positive duration such as 15s from an environment
+// variable, falling back to fallback when it is unset
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s': use a positive duration such as 15s", name, value)
+	}
+	return duration, nil
+}
+
+// Enabled reports whether the master runs as one of several replicas
+func (c *Cluster) Enabled() bool {
+	return c.db != nil
+}
+
+// Replica names this master among the replicas
+func (c *Cluster) Replica() string {
+	return c.replica
+}
+
+// Leading reports whether this master is the leader
+func (c *Cluster) Leading() bool {
+	return c.db == nil || c.leading.Load()
+}
+
+// Leader gets the replica holding the lease, or "" when none does
+func (c *Cluster) Leader() (string, error) {
+	if c.db == nil {
+		return c.replica, nil
+	}
+	var holder string
+	var expiresAt int64
+	err := c.db.QueryRow(`SELECT holder, expires_at FROM leases WHERE name = ?`, leaseName).Scan(&holder, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if time.Now().UnixNano() >= expiresAt {
+		// The last leader stopped renewing it
+		return "", nil
+	}
+	return holder, nil
+}
+
+// Lead adds a job run only while this master leads. Add jobs before Start.
+func (c *Cluster) Lead(jobs ...Job) {
+	c.jobs = append(c.jobs, jobs...)
+}
+
+// Sync adds state to refresh every sync interval on every replica, such as a
+// cache of what is in the database. Add it before Start.
+func (c *Cluster) Sync(name string, sync func() error) {
+	c.syncers = append(c.syncers, syncer{name: name, sync: sync})
+}
+
+// Start starts the jobs at once when the master runs alone. In a cluster it
+// tries to take the lease, starting the jobs if it does, and keeps syncing
+// and renewing or retrying in the background.
+func (c *Cluster) Start() {
+	if c.db == nil {
+		c.startJobs()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancelFunc = cancel
+	c.done = make(chan struct{})
+	c.elect()
+	go c.loop(ctx)
+	logger.Info("Joined cluster", "replica", c.replica, "leading", c.Leading(), "lease_ttl", c.leaseTTL, "sync_interval", c.syncInterval)
+}
+
+// Stop stops the jobs if this master leads and, in a cluster, gives up the
+// lease so another replica can take over without waiting for it to expire
+func (c *Cluster) Stop() {
+	if c.db == nil {
+		c.stopJobs()
+		return
+	}
+	if c.cancelFunc == nil {
+		return
+	}
+	c.cancelFunc()
+	<-c.done
+	if c.leading.Load() {
+		logger.Info("Giving up leadership", "replica", c.replica)
+		c.stepDown()
+	}
+	if _, err := c.db.Exec(`DELETE FROM leases WHERE name = ? AND holder = ?`, leaseName, c.replica); err != nil {
+		logger.Error("Failed to give up the lease", "error", err)
+	}
+}
+
+// loop renews or retries the lease a few times per lease and syncs every
+// sync interval
+func (c *Cluster) loop(ctx context.Context) {
+	defer close(c.done)
+	lease := time.NewTicker(c.leaseTTL / 3)
+	defer lease.Stop()
+	syncs := time.NewTicker(c.syncInterval)
+	defer syncs.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-lease.C:
+			c.elect()
+		case <-syncs.C:
+			for _, s := range c.syncers {
+				if err := s.sync(); err != nil {
+					logger.Error("Failed to sync shared state", "state", s.name, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// elect takes or renews the lease, starting the jobs when this master becomes
+// the leader and stopping them when it no longer is. A leader that cannot
+// reach the database steps down at once, before its lease can expire and
+// another replica take over.
+func (c *Cluster) elect() {
+	now := time.Now()
+	result, err := c.db.Exec(`INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE leases.holder = excluded.holder OR leases.expires_at < ?`,
+		leaseName, c.replica, now.Add(c.leaseTTL).UnixNano(), now.UnixNano())
+	var held int64
+	if err == nil {
+		held, err = result.RowsAffected()
+	}
+	switch {
+	case err != nil:
+		logger.Error("Failed to renew the lease", "error", err)
+		if c.leading.Load() {
+			logger.Warn("Stepping down as leader: the lease could not be renewed", "replica", c.replica)
+			c.stepDown()
+		}
+	case held > 0 && !c.leading.Load():
+		logger.Info("Elected leader", "replica", c.replica)
+		c.leading.Store(true)
+		c.startJobs()
+	case held == 0 && c.leading.Load():
+		logger.Warn("Stepping down as leader: another replica holds the lease", "replica", c.replica)
+		c.stepDown()
+	}
+}
+
+// stepDown stops the jobs of a leader that is no longer one
+func (c *Cluster) stepDown() {
+	c.leading.Store(false)
+	c.stopJobs()
+}
+
+// startJobs starts the leader's jobs in order
+func (c *Cluster) startJobs() {
+	c.jobMutex.Lock()
+	defer c.jobMutex.Unlock()
+	for _, job := range c.jobs {
+		logger.Debug("Starting leader job", "job", job.Name)
+		job.Start()
+	}
+}
+
+// stopJobs stops the leader's jobs in the order they started
+func (c *Cluster) stopJobs() {
+	c.jobMutex.Lock()
+	defer c.jobMutex.Unlock()
+	for _, job := range c.jobs {
+		logger.Debug("Stopping leader job", "job", job.Name)
+		job.Stop()
+	}
+}
@@ -2,40 +2,140 @@ package communication
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/apierror"
+	"github.com/prashah/batwa/pkg/logging"
 	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/multipass"
+	"github.com/prashah/batwa/pkg/sse"
+	"github.com/prashah/batwa/pkg/tunnel"
 )
 
-// AgentCommunicator handles communication with remote agents
-type AgentCommunicator struct {
-	timeout time.Duration
-	client  *http.Client
+var logger = logging.For("communication")
+
+// AgentCommunicator is a transport to remote agents. HTTPCommunicator, which
+// calls the agent's HTTP API, is the default; other transports implement the
+// same methods and are picked per agent by the executor factory.
+type AgentCommunicator interface {
+	ExecuteCommand(ctx context.Context, agentID, command string, args []string, timeout *int) models.RemoteCommandResponse
+	ExecInVM(ctx context.Context, agentID string, payload models.VMExecRequest) models.RemoteCommandResponse
+	ExecInVMStream(ctx context.Context, agentID string, payload models.VMExecRequest, output io.Writer) models.RemoteCommandResponse
+	GetVMList(ctx context.Context, agentID string) (*models.VMList, error)
+	GetVMInfo(ctx context.Context, agentID, vmName string) (*models.VMDetail, error)
+	CreateVM(ctx context.Context, agentID string, payload models.VMCreateRequest) (*models.OperationResult, error)
+	CreateVMWithProgress(ctx context.Context, agentID string, payload models.VMCreateRequest, progress func(models.LaunchProgress)) (*models.OperationResult, error)
+	VMAction(ctx context.Context, agentID, vmName, action string) (*models.OperationResult, error)
+	VMActionWithRequest(ctx context.Context, agentID, action string, payload models.VMActionRequest) (*models.OperationResult, error)
+	StopVM(ctx context.Context, agentID, vmName string, delayMinutes int) (*models.OperationResult, error)
+	CancelStopVM(ctx context.Context, agentID, vmName string) (*models.OperationResult, error)
+	SuspendVM(ctx context.Context, agentID, vmName string) (*models.OperationResult, error)
+	ResumeVM(ctx context.Context, agentID, vmName string) (*models.OperationResult, error)
+	RestartVM(ctx context.Context, agentID, vmName string, force bool) (*models.OperationResult, error)
+	DeleteVM(ctx context.Context, agentID, vmName string, softDelete bool) (*models.OperationResult, error)
+	ResizeVM(ctx context.Context, agentID string, payload models.VMResizeRequest) (*models.OperationResult, error)
+	CloneVM(ctx context.Context, agentID string, payload models.VMCloneRequest) (*models.OperationResult, error)
+	MountVM(ctx context.Context, agentID string, payload models.VMMountRequest) (*models.OperationResult, error)
+	UnmountVM(ctx context.Context, agentID string, payload models.VMMountRequest) (*models.OperationResult, error)
+	ListMounts(ctx context.Context, agentID, vmName string) ([]models.VMMount, error)
+	ForwardPort(ctx context.Context, agentID string, payload models.PortForwardRequest) (*models.PortForward, error)
+	ListForwards(ctx context.Context, agentID string) ([]models.PortForward, error)
+	RemoveForward(ctx context.Context, agentID, id string) error
+	UploadFile(ctx context.Context, agentID, vmName, destPath, filename string, src io.Reader) (*models.OperationResult, error)
+	DownloadFile(ctx context.Context, agentID, vmName, srcPath string) (io.ReadCloser, error)
+	ListBlueprints(ctx context.Context, agentID string) ([]models.Blueprint, error)
+	ListNetworks(ctx context.Context, agentID string) ([]models.Network, error)
+	GetSettings(ctx context.Context, agentID string, keys []string) (map[string]string, error)
+	SetSettings(ctx context.Context, agentID string, settings map[string]string) error
+	GetVersion(ctx context.Context, agentID string) (*models.HostVersion, error)
+	GetUsage(ctx context.Context, agentID string) (map[string]models.VMInfoExtended, error)
+	GetStorage(ctx context.Context, agentID string) (*models.HostStorage, error)
+	PruneHost(ctx context.Context, agentID string) (*models.HostPruneResult, error)
+	RotateKey(ctx context.Context, agentID, apiKey string) error
+	HealthCheck(agentID string) bool
+	InFlight() map[string]int
+	MaxInFlight() int
+}
+
+// HTTPCommunicator talks to remote agents over their HTTP API, or over the
+// tunnel an agent opened when it has one
+type HTTPCommunicator struct {
+	registry *agents.AgentRegistry
+	timeout  time.Duration
+	client   *http.Client
+	// transferClient has no overall timeout so large file transfers can finish
+	transferClient *http.Client
+	maxInFlight    int
+	inFlight       map[string]int
+	inFlightMutex  sync.Mutex
+	// tunnels carries requests for agents that opened a tunnel to the master
+	tunnels *tunnel.Hub
+}
+
+// DefaultRequestTimeout bounds requests to agents, other than file transfers
+// and streams, unless configured otherwise
+const DefaultRequestTimeout = 30 * time.Second
+
+// NewHTTPCommunicatorFromEnv creates an HTTP agent communicator whose requests
+// time out after AGENT_REQUEST_TIMEOUT, a duration such as 45s (default 30s)
+func NewHTTPCommunicatorFromEnv(registry *agents.AgentRegistry) (*HTTPCommunicator, error) {
+	timeout := DefaultRequestTimeout
+	if value := os.Getenv("AGENT_REQUEST_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid AGENT_REQUEST_TIMEOUT '%s': use a positive duration such as 45s", value)
+		}
+		timeout = parsed
+	}
+	return NewHTTPCommunicator(registry, timeout), nil
 }
 
-// NewAgentCommunicator creates a new agent communicator
-func NewAgentCommunicator(timeout time.Duration) *AgentCommunicator {
-	return &AgentCommunicator{
-		timeout: timeout,
+// NewHTTPCommunicator creates an HTTP agent communicator that looks agents up
+// in registry
+func NewHTTPCommunicator(registry *agents.AgentRegistry, timeout time.Duration) *HTTPCommunicator {
+	return &HTTPCommunicator{
+		registry: registry,
+		timeout:  timeout,
 		client: &http.Client{
 			Timeout: timeout,
 		},
+		transferClient: &http.Client{},
+		maxInFlight:    maxInFlightFromEnv(),
+		inFlight:       make(map[string]int),
 	}
 }
 
+// agentUnavailable explains why an agent that is not online cannot take
+// requests
+func agentUnavailable(agent *models.AgentInfo) string {
+	if agent.Status == "degraded" {
+		reason := "multipass daemon not reachable"
+		if agent.Health != nil && agent.Health.Error != "" {
+			reason = agent.Health.Error
+		}
+		return fmt.Sprintf("Agent is degraded: %s (%s)", agent.AgentID, reason)
+	}
+	return fmt.Sprintf("Agent is offline: %s", agent.AgentID)
+}
+
 // getHeaders gets headers for agent requests
-func (c *AgentCommunicator) getHeaders(agentID string) map[string]string {
+func (c *HTTPCommunicator) getHeaders(agentID string) map[string]string {
 	headers := map[string]string{
 		"Content-Type": "application/json",
 	}
 
-	apiKey := agents.GlobalRegistry.GetAgentAPIKey(agentID)
+	apiKey := c.registry.GetAgentAPIKey(agentID)
 	if apiKey != nil {
 		headers["X-API-Key"] = *apiKey
 	}
@@ -44,8 +144,8 @@ func (c *AgentCommunicator) getHeaders(agentID string) map[string]string {
 }
 
 // ExecuteCommand executes a command on a remote agent
-func (c *AgentCommunicator) ExecuteCommand(agentID, command string, args []string, timeout *int) models.RemoteCommandResponse {
-	agent := agents.GlobalRegistry.GetAgent(agentID)
+func (c *HTTPCommunicator) ExecuteCommand(ctx context.Context, agentID, command string, args []string, timeout *int) models.RemoteCommandResponse {
+	agent := c.registry.GetAgent(agentID)
 	if agent == nil {
 		errMsg := fmt.Sprintf("Agent not found: %s", agentID)
 		return models.RemoteCommandResponse{
@@ -56,7 +156,7 @@ func (c *AgentCommunicator) ExecuteCommand(agentID, command string, args []strin
 	}
 
 	if agent.Status != "online" {
-		errMsg := fmt.Sprintf("Agent is offline: %s", agentID)
+		errMsg := agentUnavailable(agent)
 		return models.RemoteCommandResponse{
 			Success:    false,
 			ReturnCode: -1,
@@ -88,7 +188,7 @@ func (c *AgentCommunicator) ExecuteCommand(agentID, command string, args []strin
 		}
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to create request: %s", err)
 		return models.RemoteCommandResponse{
@@ -102,7 +202,7 @@ func (c *AgentCommunicator) ExecuteCommand(agentID, command string, args []strin
 		req.Header.Set(k, v)
 	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(agentID, c.client, req)
 	if err != nil {
 		errMsg := fmt.Sprintf("Request error: %s", err)
 		return models.RemoteCommandResponse{
@@ -123,24 +223,79 @@ func (c *AgentCommunicator) ExecuteCommand(agentID, command string, args []strin
 		}
 	}
 
-	log.Printf("Command executed on agent %s: %s %v", agentID, command, args)
+	logger.InfoContext(ctx, "Command executed on agent", "agent_id", agentID, "command", command, "args", args)
+	return result
+}
+
+// ExecInVM runs a command inside a VM on a remote agent
+func (c *HTTPCommunicator) ExecInVM(ctx context.Context, agentID string, payload models.VMExecRequest) models.RemoteCommandResponse {
+	failure := func(format string, args ...interface{}) models.RemoteCommandResponse {
+		errMsg := fmt.Sprintf(format, args...)
+		return models.RemoteCommandResponse{
+			Success:    false,
+			ReturnCode: -1,
+			Error:      &errMsg,
+		}
+	}
+
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return failure("Agent not found: %s", agentID)
+	}
+	if agent.Status != "online" {
+		return failure("%s", agentUnavailable(agent))
+	}
+
+	url := fmt.Sprintf("%s/api/vm/exec", agent.APIURL)
+	headers := c.getHeaders(agentID)
+
+	// The agent runs the command against its own local multipass
+	payload.AgentID = nil
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return failure("Failed to marshal request: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return failure("Failed to create request: %s", err)
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	// Allow the command its full timeout plus the usual request overhead
+	client := &http.Client{Timeout: multipass.ExecTimeout(payload) + c.timeout}
+	resp, err := c.do(agentID, client, req)
+	if err != nil {
+		return failure("Request error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var result models.RemoteCommandResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return failure("Failed to decode response: %s", err)
+	}
+
 	return result
 }
 
 // GetVMList gets list of VMs from a remote agent
-func (c *AgentCommunicator) GetVMList(agentID string) (map[string]interface{}, error) {
-	agent := agents.GlobalRegistry.GetAgent(agentID)
+func (c *HTTPCommunicator) GetVMList(ctx context.Context, agentID string) (*models.VMList, error) {
+	agent := c.registry.GetAgent(agentID)
 	if agent == nil {
 		return nil, fmt.Errorf("agent not found: %s", agentID)
 	}
 
 	url := fmt.Sprintf("%s/api/vm/list", agent.APIURL)
-	log.Printf("Fetching VM list from agent %s at %s", agentID, url)
+	logger.DebugContext(ctx, "Fetching VM list from agent", "agent_id", agentID, "url", url)
 	headers := c.getHeaders(agentID)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		log.Printf("Failed to create request for agent %s: %v", agentID, err)
+		logger.ErrorContext(ctx, "Failed to create request for agent", "agent_id", agentID, "error", err)
 		return nil, err
 	}
 
@@ -148,26 +303,35 @@ func (c *AgentCommunicator) GetVMList(agentID string) (map[string]interface{}, e
 		req.Header.Set(k, v)
 	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(agentID, c.client, req)
 	if err != nil {
-		log.Printf("Failed to connect to agent %s: %v", agentID, err)
+		logger.WarnContext(ctx, "Failed to connect to agent", "agent_id", agentID, "error", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	var result map[string]interface{}
+	if resp.StatusCode != http.StatusOK {
+		return nil, agentError(resp)
+	}
+
+	var result struct {
+		models.VMList
+	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		log.Printf("Failed to decode response from agent %s: %v", agentID, err)
+		logger.WarnContext(ctx, "Failed to decode response from agent", "agent_id", agentID, "error", err)
 		return nil, err
 	}
+	if result.VMs == nil {
+		result.VMs = []models.VMInfoExtended{}
+	}
 
-	log.Printf("Successfully fetched VM list from agent %s", agentID)
-	return result, nil
+	logger.DebugContext(ctx, "Fetched VM list from agent", "agent_id", agentID)
+	return &result.VMList, nil
 }
 
 // GetVMInfo gets VM info from a remote agent
-func (c *AgentCommunicator) GetVMInfo(agentID, vmName string) (map[string]interface{}, error) {
-	agent := agents.GlobalRegistry.GetAgent(agentID)
+func (c *HTTPCommunicator) GetVMInfo(ctx context.Context, agentID, vmName string) (*models.VMDetail, error) {
+	agent := c.registry.GetAgent(agentID)
 	if agent == nil {
 		return nil, fmt.Errorf("agent not found: %s", agentID)
 	}
@@ -175,7 +339,7 @@ func (c *AgentCommunicator) GetVMInfo(agentID, vmName string) (map[string]interf
 	url := fmt.Sprintf("%s/api/vm/info/%s", agent.APIURL, vmName)
 	headers := c.getHeaders(agentID)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -184,44 +348,47 @@ func (c *AgentCommunicator) GetVMInfo(agentID, vmName string) (map[string]interf
 		req.Header.Set(k, v)
 	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(agentID, c.client, req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	var result map[string]interface{}
+	if resp.StatusCode != http.StatusOK {
+		return nil, agentError(resp)
+	}
+
+	var result models.VMDetail
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	return &result, nil
 }
 
-// CreateVM creates a VM on a remote agent
-func (c *AgentCommunicator) CreateVM(agentID, name string, cpus int, memory, disk, image string) (map[string]interface{}, error) {
-	agent := agents.GlobalRegistry.GetAgent(agentID)
+// CreateVM creates a VM on a remote agent, as a job when the agent has a job
+// queue
+func (c *HTTPCommunicator) CreateVM(ctx context.Context, agentID string, payload models.VMCreateRequest) (*models.OperationResult, error) {
+	agent := c.registry.GetAgent(agentID)
 	if agent == nil {
 		return nil, fmt.Errorf("agent not found: %s", agentID)
 	}
 
+	// The agent always launches on its own local multipass
+	payload.AgentID = nil
+	if agent.Jobs {
+		return c.runJob(ctx, agentID, "create", payload, nil)
+	}
+
 	url := fmt.Sprintf("%s/api/vm/create", agent.APIURL)
 	headers := c.getHeaders(agentID)
 
-	payload := models.VMCreateRequest{
-		Name:   name,
-		CPUs:   cpus,
-		Memory: memory,
-		Disk:   disk,
-		Image:  image,
-	}
-
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
@@ -230,23 +397,225 @@ func (c *AgentCommunicator) CreateVM(agentID, name string, cpus int, memory, dis
 		req.Header.Set(k, v)
 	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(agentID, c.client, req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	return decodeOperation(resp)
+}
+
+// ExecInVMStream runs a command inside a VM on a remote agent through its
+// streaming endpoint, writing each line of output to output as the agent
+// reports it. Agents without the endpoint run the command with ExecInVM, and
+// its output is written once it finishes.
+func (c *HTTPCommunicator) ExecInVMStream(ctx context.Context, agentID string, payload models.VMExecRequest, output io.Writer) models.RemoteCommandResponse {
+	failure := func(format string, args ...interface{}) models.RemoteCommandResponse {
+		errMsg := fmt.Sprintf(format, args...)
+		return models.RemoteCommandResponse{
+			Success:    false,
+			ReturnCode: -1,
+			Error:      &errMsg,
+		}
+	}
+
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return failure("Agent not found: %s", agentID)
+	}
+	if agent.Status != "online" {
+		return failure("%s", agentUnavailable(agent))
+	}
+
+	// The agent runs the command against its own local multipass
+	payload.AgentID = nil
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return failure("Failed to marshal request: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/vm/exec/stream", agent.APIURL), bytes.NewBuffer(body))
+	if err != nil {
+		return failure("Failed to create request: %s", err)
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// The command's own timeout bounds the stream, which may stay open long
+	resp, err := c.do(agentID, c.transferClient, req)
+	if err != nil {
+		return failure("Request error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		result := c.ExecInVM(ctx, agentID, payload)
+		if output != nil {
+			if result.Stdout != nil {
+				io.WriteString(output, *result.Stdout)
+			}
+			if result.Stderr != nil {
+				io.WriteString(output, *result.Stderr)
+			}
+		}
+		return result
+	}
+	if resp.StatusCode != http.StatusOK {
+		return failure("%s", agentError(resp))
+	}
+
+	var result *models.RemoteCommandResponse
+	err = sse.Read(resp.Body, func(name, data string) bool {
+		switch name {
+		case "output":
+			var line struct {
+				Line string `json:"line"`
+			}
+			if json.Unmarshal([]byte(data), &line) == nil && output != nil {
+				io.WriteString(output, line.Line+"\n")
+			}
+		case "result":
+			json.Unmarshal([]byte(data), &result)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return failure("Stream error: %s", err)
+	}
+	if result == nil {
+		return failure("agent %s closed the exec stream without a result", agentID)
+	}
+	return *result
+}
+
+// CreateVMWithProgress creates a VM on a remote agent, calling progress for
+// each launch update the agent sends. Agents with a job queue run it as a job
+// whose progress is polled; others stream it from their streaming endpoint.
+func (c *HTTPCommunicator) CreateVMWithProgress(ctx context.Context, agentID string, payload models.VMCreateRequest, progress func(models.LaunchProgress)) (*models.OperationResult, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	// The agent always launches on its own local multipass
+	payload.AgentID = nil
+	if agent.Jobs {
+		return c.runJob(ctx, agentID, "create", payload, progress)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/vm/create/stream", agent.APIURL), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// Launches can run for many minutes, so the request has no overall timeout
+	resp, err := c.do(agentID, c.transferClient, req)
+	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, err := decodeOperation(resp)
+		if err != nil {
+			return nil, fmt.Errorf("agent returned %s", resp.Status)
+		}
+		return result, nil
+	}
 
+	var result *models.OperationResult
+	err = sse.Read(resp.Body, func(name, data string) bool {
+		switch name {
+		case "progress":
+			var update models.LaunchProgress
+			if json.Unmarshal([]byte(data), &update) == nil && progress != nil {
+				progress(update)
+			}
+		case "result":
+			json.Unmarshal([]byte(data), &result)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, fmt.Errorf("agent %s closed the launch stream without a result", agentID)
+	}
 	return result, nil
 }
 
-// VMAction performs an action on a VM (start/stop/delete)
-func (c *AgentCommunicator) VMAction(agentID, vmName, action string) (map[string]interface{}, error) {
-	agent := agents.GlobalRegistry.GetAgent(agentID)
+// agentError reads an agent's error response. Agents answer with a
+// models.ErrorResponse; older ones with only a detail or error, which is
+// coded as the master codes its own failures.
+func agentError(resp *http.Response) error {
+	var body struct {
+		models.ErrorResponse
+		Detail string `json:"detail"`
+		Legacy string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+	response := body.ErrorResponse
+	if response.Message == "" {
+		response.Message = body.Detail
+	}
+	if response.Message == "" {
+		response.Message = body.Legacy
+	}
+	if response.Message == "" {
+		response.Message = fmt.Sprintf("agent returned status %d", resp.StatusCode)
+	}
+	if response.Code == "" {
+		response.Code = apierror.Code(resp.StatusCode, response.Message)
+	}
+	return &response
+}
+
+// decodeOperation decodes an agent's reply to a VM operation. Agents report
+// some failures, such as a rejected request, with an error response, whose
+// message becomes the result's; older agents with only a detail or error.
+func decodeOperation(resp *http.Response) (*models.OperationResult, error) {
+	var result struct {
+		models.OperationResult
+		Detail string `json:"detail"`
+		Error  string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Message == "" && !result.Success {
+		result.Message = result.Detail
+		if result.Message == "" {
+			result.Message = result.Error
+		}
+	}
+	return &result.OperationResult, nil
+}
+
+// VMAction performs an action on a VM (start/stop/suspend/resume/delete/recover/purge)
+func (c *HTTPCommunicator) VMAction(ctx context.Context, agentID, vmName, action string) (*models.OperationResult, error) {
+	return c.VMActionWithRequest(ctx, agentID, action, models.VMActionRequest{Name: vmName})
+}
+
+// VMActionWithRequest performs an action on a VM, sending the full action request
+// so that options such as force are forwarded to the agent
+func (c *HTTPCommunicator) VMActionWithRequest(ctx context.Context, agentID, action string, payload models.VMActionRequest) (*models.OperationResult, error) {
+	agent := c.registry.GetAgent(agentID)
 	if agent == nil {
 		return nil, fmt.Errorf("agent not found: %s", agentID)
 	}
@@ -254,16 +623,100 @@ func (c *AgentCommunicator) VMAction(agentID, vmName, action string) (map[string
 	url := fmt.Sprintf("%s/api/vm/%s", agent.APIURL, action)
 	headers := c.getHeaders(agentID)
 
-	payload := models.VMActionRequest{
-		Name: vmName,
+	// The agent always targets its own local multipass
+	payload.AgentID = nil
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return decodeOperation(resp)
+}
+
+// StopVM stops a VM on a remote agent. A delayed stop goes to its own
+// endpoint so that agents without support reject it rather than stopping
+// the VM at once.
+func (c *HTTPCommunicator) StopVM(ctx context.Context, agentID, vmName string, delayMinutes int) (*models.OperationResult, error) {
+	if delayMinutes > 0 {
+		return c.VMActionWithRequest(ctx, agentID, "stop/delayed", models.VMActionRequest{Name: vmName, DelayMinutes: delayMinutes})
+	}
+	return c.VMAction(ctx, agentID, vmName, "stop")
+}
+
+// CancelStopVM cancels a delayed stop on a remote agent
+func (c *HTTPCommunicator) CancelStopVM(ctx context.Context, agentID, vmName string) (*models.OperationResult, error) {
+	return c.VMAction(ctx, agentID, vmName, "stop/cancel")
+}
+
+// SuspendVM suspends a VM on a remote agent
+func (c *HTTPCommunicator) SuspendVM(ctx context.Context, agentID, vmName string) (*models.OperationResult, error) {
+	return c.VMAction(ctx, agentID, vmName, "suspend")
+}
+
+// ResumeVM resumes a suspended VM on a remote agent
+func (c *HTTPCommunicator) ResumeVM(ctx context.Context, agentID, vmName string) (*models.OperationResult, error) {
+	return c.VMAction(ctx, agentID, vmName, "resume")
+}
+
+// RestartVM restarts a VM on a remote agent
+func (c *HTTPCommunicator) RestartVM(ctx context.Context, agentID, vmName string, force bool) (*models.OperationResult, error) {
+	return c.VMActionWithRequest(ctx, agentID, "restart", models.VMActionRequest{Name: vmName, Force: force})
+}
+
+// DeleteVM deletes a VM on a remote agent, leaving it recoverable if softDelete is set
+func (c *HTTPCommunicator) DeleteVM(ctx context.Context, agentID, vmName string, softDelete bool) (*models.OperationResult, error) {
+	return c.VMActionWithRequest(ctx, agentID, "delete", models.VMActionRequest{Name: vmName, SoftDelete: softDelete})
+}
+
+// ResizeVM resizes a VM on a remote agent
+func (c *HTTPCommunicator) ResizeVM(ctx context.Context, agentID string, payload models.VMResizeRequest) (*models.OperationResult, error) {
+	payload.AgentID = nil
+	return c.postLongRunning(ctx, agentID, "resize", payload)
+}
+
+// CloneVM clones a VM on a remote agent
+func (c *HTTPCommunicator) CloneVM(ctx context.Context, agentID string, payload models.VMCloneRequest) (*models.OperationResult, error) {
+	payload.AgentID = nil
+	return c.postLongRunning(ctx, agentID, "clone", payload)
+}
+
+// postLongRunning posts a VM operation that stops and starts VMs, and so may
+// run well beyond the usual request timeout. Agents with a job queue run it
+// as a job.
+func (c *HTTPCommunicator) postLongRunning(ctx context.Context, agentID, action string, payload interface{}) (*models.OperationResult, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
 	}
+	if agent.Jobs {
+		return c.runJob(ctx, agentID, action, payload, nil)
+	}
+
+	url := fmt.Sprintf("%s/api/vm/%s", agent.APIURL, action)
+	headers := c.getHeaders(agentID)
 
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
@@ -272,51 +725,673 @@ func (c *AgentCommunicator) VMAction(agentID, vmName, action string) (map[string
 		req.Header.Set(k, v)
 	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(agentID, c.transferClient, req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	return decodeOperation(resp)
+}
+
+// MountVM mounts a directory of the agent host into a VM on a remote agent
+func (c *HTTPCommunicator) MountVM(ctx context.Context, agentID string, payload models.VMMountRequest) (*models.OperationResult, error) {
+	return c.postMount(ctx, agentID, "mount", payload)
+}
+
+// UnmountVM removes a mount from a VM on a remote agent
+func (c *HTTPCommunicator) UnmountVM(ctx context.Context, agentID string, payload models.VMMountRequest) (*models.OperationResult, error) {
+	return c.postMount(ctx, agentID, "umount", payload)
+}
+
+// postMount sends a mount or umount request to a remote agent
+func (c *HTTPCommunicator) postMount(ctx context.Context, agentID, action string, payload models.VMMountRequest) (*models.OperationResult, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	url := fmt.Sprintf("%s/api/vm/%s", agent.APIURL, action)
+	headers := c.getHeaders(agentID)
+
+	// Paths are resolved on the agent host
+	payload.AgentID = nil
+
+	body, err := json.Marshal(payload)
+	if err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return decodeOperation(resp)
 }
 
-// HealthCheck checks health of a remote agent
-func (c *AgentCommunicator) HealthCheck(agentID string) bool {
-	agent := agents.GlobalRegistry.GetAgent(agentID)
+// ForwardPort starts a port forward on a remote agent
+func (c *HTTPCommunicator) ForwardPort(ctx context.Context, agentID string, payload models.PortForwardRequest) (*models.PortForward, error) {
+	agent := c.registry.GetAgent(agentID)
 	if agent == nil {
-		return false
+		return nil, fmt.Errorf("agent not found: %s", agentID)
 	}
 
-	url := fmt.Sprintf("%s/health", agent.APIURL)
+	url := fmt.Sprintf("%s/api/forwards", agent.APIURL)
 	headers := c.getHeaders(agentID)
 
-	req, err := http.NewRequest("GET", url, nil)
+	payload.AgentID = nil
+	body, err := json.Marshal(payload)
 	if err != nil {
-		return false
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
 	}
 
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
 
-	// Use a shorter timeout for health checks
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := c.do(agentID, c.client, req)
 	if err != nil {
-		log.Printf("Health check failed for agent %s: %v", agentID, err)
-		return false
+		return nil, err
 	}
 	defer resp.Body.Close()
-	io.Copy(io.Discard, resp.Body)
 
-	return resp.StatusCode == 200
+	if resp.StatusCode != http.StatusOK {
+		return nil, agentError(resp)
+	}
+
+	var result struct {
+		Forward *models.PortForward `json:"forward"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Forward == nil {
+		return nil, fmt.Errorf("agent %s reported no port forward", agentID)
+	}
+
+	return result.Forward, nil
 }
 
-// Global communicator instance
-var GlobalCommunicator = NewAgentCommunicator(30 * time.Second)
+// ListForwards lists the port forwards running on a remote agent
+func (c *HTTPCommunicator) ListForwards(ctx context.Context, agentID string) ([]models.PortForward, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	url := fmt.Sprintf("%s/api/forwards", agent.APIURL)
+	headers := c.getHeaders(agentID)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, agentError(resp)
+	}
+
+	var result struct {
+		Forwards []models.PortForward `json:"forwards"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Forwards, nil
+}
+
+// RemoveForward stops a port forward running on a remote agent
+func (c *HTTPCommunicator) RemoveForward(ctx context.Context, agentID, id string) error {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	url := fmt.Sprintf("%s/api/forwards/%s", agent.APIURL, id)
+	headers := c.getHeaders(agentID)
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return agentError(resp)
+	}
+	return nil
+}
+
+// ListMounts lists the mounts of a VM on a remote agent
+func (c *HTTPCommunicator) ListMounts(ctx context.Context, agentID, vmName string) ([]models.VMMount, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	url := fmt.Sprintf("%s/api/vm/%s/mounts", agent.APIURL, vmName)
+	headers := c.getHeaders(agentID)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, agentError(resp)
+	}
+
+	var result struct {
+		Mounts []models.VMMount `json:"mounts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Mounts, nil
+}
+
+// UploadFile streams a file to a remote agent, which copies it into the VM at
+// destPath, as a job when the agent has a job queue
+func (c *HTTPCommunicator) UploadFile(ctx context.Context, agentID, vmName, destPath, filename string, src io.Reader) (*models.OperationResult, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+	if agent.Jobs {
+		return c.uploadJob(ctx, agentID, vmName, destPath, filename, src)
+	}
+
+	url := fmt.Sprintf("%s/api/vm/transfer", agent.APIURL)
+	headers := c.getHeaders(agentID)
+
+	// Stream the multipart body instead of buffering the whole file
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		fields := map[string]string{
+			"name":      vmName,
+			"direction": "upload",
+			"path":      destPath,
+		}
+		for key, value := range fields {
+			if err := writer.WriteField(key, value); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		part, err := writer.CreateFormFile("file", filename)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(part, src); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(writer.Close())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := c.do(agentID, c.transferClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return decodeOperation(resp)
+}
+
+// DownloadFile streams a file out of a VM on a remote agent. The caller must
+// close the returned reader.
+func (c *HTTPCommunicator) DownloadFile(ctx context.Context, agentID, vmName, srcPath string) (io.ReadCloser, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	endpoint := fmt.Sprintf("%s/api/vm/transfer", agent.APIURL)
+	headers := c.getHeaders(agentID)
+
+	form := url.Values{}
+	form.Set("name", vmName)
+	form.Set("direction", "download")
+	form.Set("path", srcPath)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.do(agentID, c.transferClient, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, agentError(resp)
+	}
+
+	return resp.Body, nil
+}
+
+// ListBlueprints lists the blueprints available on a remote agent
+func (c *HTTPCommunicator) ListBlueprints(ctx context.Context, agentID string) ([]models.Blueprint, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	url := fmt.Sprintf("%s/api/blueprints", agent.APIURL)
+	headers := c.getHeaders(agentID)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, agentError(resp)
+	}
+
+	var result struct {
+		Blueprints []models.Blueprint `json:"blueprints"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Blueprints, nil
+}
+
+// ListNetworks lists the interfaces VMs on a remote agent can be bridged onto
+func (c *HTTPCommunicator) ListNetworks(ctx context.Context, agentID string) ([]models.Network, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/networks", agent.APIURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, agentError(resp)
+	}
+
+	var result struct {
+		Networks []models.Network `json:"networks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Networks, nil
+}
+
+// GetSettings reads multipass daemon settings on a remote agent's host; all
+// supported settings when keys is empty
+func (c *HTTPCommunicator) GetSettings(ctx context.Context, agentID string, keys []string) (map[string]string, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	endpoint := fmt.Sprintf("%s/api/host/settings", agent.APIURL)
+	if len(keys) > 0 {
+		endpoint += "?keys=" + url.QueryEscape(strings.Join(keys, ","))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, agentError(resp)
+	}
+
+	var result struct {
+		Settings map[string]string `json:"settings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Settings, nil
+}
+
+// GetVersion gets the multipass version of a remote agent's host
+func (c *HTTPCommunicator) GetVersion(ctx context.Context, agentID string) (*models.HostVersion, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/host/version", agent.APIURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, agentError(resp)
+	}
+
+	var result struct {
+		Version *models.HostVersion `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Version, nil
+}
+
+// GetUsage gets the CPU, load, disk and memory usage of a remote agent's VMs
+func (c *HTTPCommunicator) GetUsage(ctx context.Context, agentID string) (map[string]models.VMInfoExtended, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/vm/usage", agent.APIURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, agentError(resp)
+	}
+
+	var result struct {
+		Usage map[string]models.VMInfoExtended `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Usage, nil
+}
+
+// GetStorage gets the disk space multipass uses on a remote agent's host
+func (c *HTTPCommunicator) GetStorage(ctx context.Context, agentID string) (*models.HostStorage, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/host/storage", agent.APIURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, agentError(resp)
+	}
+
+	var result struct {
+		Storage *models.HostStorage `json:"storage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Storage, nil
+}
+
+// PruneHost has a remote agent purge deleted VMs and stale cached images
+func (c *HTTPCommunicator) PruneHost(ctx context.Context, agentID string) (*models.HostPruneResult, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/host/prune", agent.APIURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, agentError(resp)
+	}
+
+	var result struct {
+		Prune *models.HostPruneResult `json:"prune"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Prune, nil
+}
+
+// SetSettings changes multipass daemon settings on a remote agent's host
+func (c *HTTPCommunicator) SetSettings(ctx context.Context, agentID string, settings map[string]string) error {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"settings": settings})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%s/api/host/settings", agent.APIURL), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return agentError(resp)
+	}
+
+	var result struct {
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RotateKey sends a remote agent its new API key, authenticating with the
+// current one. The caller swaps the key in the registry once this succeeds.
+func (c *HTTPCommunicator) RotateKey(ctx context.Context, agentID, apiKey string) error {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return fmt.Errorf("agent not found: %s", agentID)
+	}
+	if agent.Status != "online" {
+		return fmt.Errorf("%s", agentUnavailable(agent))
+	}
+
+	body, err := json.Marshal(models.AgentKeyRotation{APIKey: apiKey})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/agent/rotate-key", agent.APIURL), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return agentError(resp)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// HealthCheck checks health of a remote agent
+func (c *HTTPCommunicator) HealthCheck(agentID string) bool {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return false
+	}
+
+	url := fmt.Sprintf("%s/health", agent.APIURL)
+	headers := c.getHeaders(agentID)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	// Use a shorter timeout for health checks
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Warn("Health check failed", "agent_id", agentID, "error", err)
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode == 200
+}
@@ -0,0 +1,146 @@
+package communication
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/prashah/batwa/pkg/requestid"
+	"github.com/prashah/batwa/pkg/tracing"
+)
+
+// DefaultMaxInFlight caps concurrent requests to a single agent unless
+// AGENT_MAX_IN_FLIGHT overrides it
+const DefaultMaxInFlight = 16
+
+// SaturatedError is returned when an agent already has the maximum number of
+// requests in flight
+type SaturatedError struct {
+	AgentID string
+	Limit   int
+}
+
+func (e *SaturatedError) Error() string {
+	return fmt.Sprintf("agent %s is saturated: %d requests already in flight", e.AgentID, e.Limit)
+}
+
+// AsSaturated reports whether err is (or wraps) a *SaturatedError
+func AsSaturated(err error) (*SaturatedError, bool) {
+	var saturated *SaturatedError
+	if errors.As(err, &saturated) {
+		return saturated, true
+	}
+	return nil, false
+}
+
+// acquire reserves an in-flight slot for an agent
+func (c *HTTPCommunicator) acquire(agentID string) (func(), error) {
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+
+	if c.inFlight[agentID] >= c.maxInFlight {
+		return nil, &SaturatedError{AgentID: agentID, Limit: c.maxInFlight}
+	}
+	c.inFlight[agentID]++
+
+	released := false
+	return func() {
+		c.inFlightMutex.Lock()
+		defer c.inFlightMutex.Unlock()
+		if released {
+			return
+		}
+		released = true
+		c.inFlight[agentID]--
+		if c.inFlight[agentID] == 0 {
+			delete(c.inFlight, agentID)
+		}
+	}, nil
+}
+
+// releasingBody frees the in-flight slot once the response body is closed, so
+// streamed responses count until they are fully consumed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// do sends a request to an agent within its in-flight limit, in a client
+// span that lasts until the response body is closed
+func (c *HTTPCommunicator) do(agentID string, client *http.Client, req *http.Request) (*http.Response, error) {
+	ctx, span := tracing.Start(req.Context(), "agent "+req.Method+" "+req.URL.Path, tracing.KindClient,
+		tracing.Attribute{Key: "agent.id", Value: agentID},
+		tracing.Attribute{Key: "http.request.method", Value: req.Method},
+		tracing.Attribute{Key: "url.path", Value: req.URL.Path})
+	req = req.WithContext(ctx)
+
+	acquired, err := c.acquire(agentID)
+	if err != nil {
+		span.SetError(err.Error())
+		span.End()
+		return nil, err
+	}
+	release := func() {
+		acquired()
+		span.End()
+	}
+
+	// Pass the ID of the request being served on, so the agent logs it too,
+	// and the span, so the agent's spans join the trace
+	id := requestid.FromContext(req.Context())
+	if id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+	if traceparent := tracing.Traceparent(ctx); traceparent != "" {
+		req.Header.Set(tracing.Header, traceparent)
+	}
+	resp, err := c.send(agentID, client, req)
+	if err != nil {
+		span.SetError(err.Error())
+		release()
+		if id != "" {
+			logger.WarnContext(ctx, "Request to agent failed", "agent_id", agentID, "error", err)
+		}
+		return nil, err
+	}
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetError(resp.Status)
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// InFlight returns the number of requests currently in flight per agent
+func (c *HTTPCommunicator) InFlight() map[string]int {
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+
+	counts := make(map[string]int, len(c.inFlight))
+	for agentID, count := range c.inFlight {
+		counts[agentID] = count
+	}
+	return counts
+}
+
+// MaxInFlight returns the per-agent in-flight limit
+func (c *HTTPCommunicator) MaxInFlight() int {
+	return c.maxInFlight
+}
+
+// maxInFlightFromEnv reads AGENT_MAX_IN_FLIGHT
+func maxInFlightFromEnv() int {
+	if value, err := strconv.Atoi(os.Getenv("AGENT_MAX_IN_FLIGHT")); err == nil && value > 0 {
+		return value
+	}
+	return DefaultMaxInFlight
+}
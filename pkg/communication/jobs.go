@@ -0,0 +1,209 @@
+package communication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// jobPollInterval is how often the master asks an agent whether a job is done
+const jobPollInterval = time.Second
+
+// jobPollFailures is how many polls in a row may fail before the master gives
+// up on a job
+const jobPollFailures = 5
+
+// errJobLost is returned when an agent no longer knows a job, typically
+// because it restarted
+var errJobLost = errors.New("job not found")
+
+// runJob queues a long operation on an agent and waits for its result,
+// calling progress, which may be nil, with each new launch update
+func (c *HTTPCommunicator) runJob(ctx context.Context, agentID, kind string, payload interface{}, progress func(models.LaunchProgress)) (*models.OperationResult, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(models.AgentJobRequest{Kind: kind, Payload: data})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/jobs", agent.APIURL), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+	return c.submitJob(ctx, agentID, c.client, req, progress)
+}
+
+// uploadJob streams a file to an agent as an upload job and waits for the
+// agent to copy it into the VM
+func (c *HTTPCommunicator) uploadJob(ctx context.Context, agentID, vmName, destPath, filename string, src io.Reader) (*models.OperationResult, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		fields := [][2]string{{"kind", "upload"}, {"name", vmName}, {"path", destPath}}
+		for _, field := range fields {
+			if err := writer.WriteField(field[0], field[1]); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		part, err := writer.CreateFormFile("file", filename)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(part, src); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(writer.Close())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/jobs", agent.APIURL), pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	// The file has to reach the agent before the job is queued, so the
+	// submission has no overall timeout
+	return c.submitJob(ctx, agentID, c.transferClient, req, nil)
+}
+
+// submitJob sends a job submission and waits for the queued job to finish
+func (c *HTTPCommunicator) submitJob(ctx context.Context, agentID string, client *http.Client, req *http.Request, progress func(models.LaunchProgress)) (*models.OperationResult, error) {
+	resp, err := c.do(agentID, client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		result, err := decodeOperation(resp)
+		if err != nil {
+			return nil, fmt.Errorf("agent returned %s", resp.Status)
+		}
+		return result, nil
+	}
+
+	var job models.AgentJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, err
+	}
+	return c.waitJob(ctx, agentID, job.ID, progress)
+}
+
+// waitJob polls an agent until a job finishes and returns its result.
+// Progress is reported when it changes. A few failed polls in a row are
+// tolerated so a brief network hiccup does not abandon a long launch.
+func (c *HTTPCommunicator) waitJob(ctx context.Context, agentID, jobID string, progress func(models.LaunchProgress)) (*models.OperationResult, error) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	var last *models.LaunchProgress
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		job, err := c.getJob(ctx, agentID, jobID)
+		if errors.Is(err, errJobLost) {
+			return nil, fmt.Errorf("agent %s lost job %s; it may have restarted", agentID, jobID)
+		}
+		if err != nil {
+			failures++
+			if failures >= jobPollFailures {
+				return nil, fmt.Errorf("failed to poll job %s on agent %s: %w", jobID, agentID, err)
+			}
+			continue
+		}
+		failures = 0
+
+		if job.Progress != nil && progress != nil && !sameProgress(last, job.Progress) {
+			progress(*job.Progress)
+			last = job.Progress
+		}
+		if job.Result != nil {
+			return job.Result, nil
+		}
+	}
+}
+
+// getJob gets a job from an agent's queue
+func (c *HTTPCommunicator) getJob(ctx context.Context, agentID, jobID string) (*models.AgentJob, error) {
+	agent := c.registry.GetAgent(agentID)
+	if agent == nil {
+		return nil, fmt.Errorf("agent not found: %s", agentID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/jobs/%s", agent.APIURL, jobID), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.getHeaders(agentID) {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.do(agentID, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errJobLost
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("agent returned %s", resp.Status)
+	}
+
+	var job models.AgentJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// sameProgress reports whether two launch updates are the same
+func sameProgress(a, b *models.LaunchProgress) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Stage != b.Stage || a.Message != b.Message {
+		return false
+	}
+	if a.Percent == nil || b.Percent == nil {
+		return a.Percent == b.Percent
+	}
+	return *a.Percent == *b.Percent
+}
@@ -0,0 +1,42 @@
+package communication
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/prashah/batwa/pkg/tunnel"
+)
+
+// UseTunnels sends requests for agents with a tunnel open in hub over the
+// tunnel instead of to their API URL
+func (c *HTTPCommunicator) UseTunnels(hub *tunnel.Hub) {
+	c.tunnels = hub
+}
+
+// send sends a request over the agent's tunnel when it has one open, and to
+// its API URL otherwise. Tunneled requests get the client's timeout.
+func (c *HTTPCommunicator) send(agentID string, client *http.Client, req *http.Request) (*http.Response, error) {
+	var session *tunnel.Session
+	if c.tunnels != nil {
+		session = c.tunnels.Session(agentID)
+	}
+	if session == nil {
+		if agent := c.registry.GetAgent(agentID); agent != nil && agent.Tunnel {
+			return nil, fmt.Errorf("agent %s has no tunnel open", agentID)
+		}
+		return client.Do(req)
+	}
+
+	if client.Timeout <= 0 {
+		return session.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), client.Timeout)
+	resp, err := session.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: cancel}
+	return resp, nil
+}
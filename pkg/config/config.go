@@ -0,0 +1,403 @@
+// Package config loads the master's configuration file. The file is YAML and
+// holds the same settings as the master's environment variables, grouped by
+// area, such as server.port for PORT. Environment variables take precedence
+// over the file, so a deployment can keep its settings in one file and
+// override a few per host.
+//
+// Loading checks every setting, from either source, and refuses keys it does
+// not know, so a typo or a bad value stops the master at startup instead of
+// being ignored. Settings taken from the file are then exported to the
+// environment, where the NewXFromEnv constructors that read them find them.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/prashah/batwa/pkg/quotas"
+)
+
+// EnvPath names the configuration file when --config is not given
+const EnvPath = "BATWA_CONFIG"
+
+// kind is how a setting's value is written and checked
+type kind int
+
+const (
+	// text is any string
+	text kind = iota
+	// list is a YAML list, or a comma separated string, exported comma
+	// separated
+	list
+	// words is a YAML list, or a space separated string, exported space
+	// separated
+	words
+	// pairs is a YAML mapping of keys to a value or a list of values,
+	// exported as comma separated key=value pairs
+	pairs
+	// boolean is true or false
+	boolean
+	// number is a whole number above zero
+	number
+	// count is a whole number, zero or above
+	count
+	// port is a TCP port
+	port
+	// duration is a positive Go duration such as 30s or 12h
+	duration
+	// seconds is a positive Go duration or a whole number of seconds,
+	// exported as seconds
+	seconds
+	// size is a multipass size such as 512M or 2G
+	size
+)
+
+// setting is one key of the file and the environment variable it sets
+type setting struct {
+	key  string
+	env  string
+	kind kind
+	// choices are the values allowed, when limited
+	choices []string
+	// secret settings may hold a vault: or file: reference instead of the
+	// secret itself
+	secret bool
+}
+
+// settings are the keys the file may hold. Settings read when packages are
+// loaded, before main can load the file, are left to the environment.
+var settings = []setting{
+	{key: "server.host", env: "HOST"},
+	{key: "server.port", env: "PORT", kind: port},
+	{key: "server.tls.cert", env: "TLS_CERT"},
+	{key: "server.tls.key", env: "TLS_KEY"},
+	{key: "server.tls.acme_domains", env: "ACME_DOMAINS", kind: list},
+	{key: "server.tls.acme_email", env: "ACME_EMAIL"},
+	{key: "server.tls.acme_directory", env: "ACME_DIRECTORY"},
+	{key: "server.tls.acme_cache_dir", env: "ACME_CACHE_DIR"},
+
+	{key: "cors.mode", env: "CORS_MODE", choices: []string{"same-origin", "cross-origin"}},
+	{key: "cors.allowed_origins", env: "CORS_ALLOWED_ORIGINS", kind: list},
+	{key: "cors.content_security_policy", env: "CONTENT_SECURITY_POLICY"},
+
+	{key: "allowlist.api", env: "API_ALLOWED_CIDRS", kind: list},
+	{key: "allowlist.agents", env: "AGENT_ALLOWED_CIDRS", kind: list},
+
+	{key: "auth.users_path", env: "USERS_PATH"},
+	{key: "auth.admin_username", env: "ADMIN_USERNAME"},
+	{key: "auth.session_ttl", env: "SESSION_TTL", kind: duration},
+	{key: "auth.session_max_age", env: "SESSION_MAX_AGE", kind: duration},
+	{key: "auth.jwt.secret", env: "JWT_SECRET", secret: true},
+	{key: "auth.jwt.access_ttl", env: "JWT_ACCESS_TTL", kind: duration},
+	{key: "auth.jwt.refresh_ttl", env: "JWT_REFRESH_TTL", kind: duration},
+	{key: "auth.oidc.issuer", env: "OIDC_ISSUER"},
+	{key: "auth.oidc.client_id", env: "OIDC_CLIENT_ID"},
+	{key: "auth.oidc.client_secret", env: "OIDC_CLIENT_SECRET", secret: true},
+	{key: "auth.oidc.redirect_url", env: "OIDC_REDIRECT_URL"},
+	{key: "auth.oidc.scopes", env: "OIDC_SCOPES", kind: words},
+	{key: "auth.oidc.username_claim", env: "OIDC_USERNAME_CLAIM"},
+	{key: "auth.oidc.groups_claim", env: "OIDC_GROUPS_CLAIM"},
+	{key: "auth.oidc.group_roles", env: "OIDC_GROUP_ROLES", kind: pairs},
+	{key: "auth.oidc.allowed_groups", env: "OIDC_ALLOWED_GROUPS", kind: list},
+
+	{key: "persistence.driver", env: "STORAGE_DRIVER", choices: []string{"sqlite", "postgres", "files"}},
+	{key: "persistence.dsn", env: "STORAGE_DSN", secret: true},
+	{key: "persistence.session_store", env: "SESSION_STORE", choices: []string{"database", "memory", "redis", "sqlite"}},
+	{key: "persistence.redis_url", env: "REDIS_URL", secret: true},
+	{key: "persistence.session_db_path", env: "SESSION_DB_PATH"},
+
+	{key: "cluster.enabled", env: "CLUSTER_ENABLED", kind: boolean},
+	{key: "cluster.replica_id", env: "CLUSTER_REPLICA_ID"},
+	{key: "cluster.lease_ttl", env: "CLUSTER_LEASE_TTL", kind: duration},
+	{key: "cluster.sync_interval", env: "CLUSTER_SYNC_INTERVAL", kind: duration},
+
+	{key: "agents.registration_token", env: "AGENT_REGISTRATION_TOKEN", secret: true},
+	{key: "agents.auto_approve", env: "AGENT_AUTO_APPROVE", kind: boolean},
+	{key: "agents.check_interval", env: "AGENT_CHECK_INTERVAL", kind: duration},
+	{key: "agents.offline_threshold", env: "AGENT_OFFLINE_THRESHOLD", kind: duration},
+	{key: "agents.max_in_flight", env: "AGENT_MAX_IN_FLIGHT", kind: number},
+	{key: "agents.retention_days", env: "AGENT_RETENTION_DAYS", kind: count},
+
+	{key: "vm_defaults.cpus", env: "VM_DEFAULT_CPUS", kind: number},
+	{key: "vm_defaults.memory", env: "VM_DEFAULT_MEMORY", kind: size},
+	{key: "vm_defaults.disk", env: "VM_DEFAULT_DISK", kind: size},
+
+	{key: "timeouts.agent_request", env: "AGENT_REQUEST_TIMEOUT", kind: duration},
+	{key: "timeouts.multipass_command", env: "MULTIPASS_TIMEOUT", kind: seconds},
+	{key: "timeouts.multipass_launch", env: "MULTIPASS_LAUNCH_TIMEOUT", kind: seconds},
+	{key: "timeouts.shutdown", env: "SHUTDOWN_TIMEOUT", kind: duration},
+
+	{key: "metrics.token", env: "METRICS_TOKEN", secret: true},
+
+	{key: "logging.format", env: "LOG_FORMAT", choices: []string{"text", "json"}},
+	{key: "logging.level", env: "LOG_LEVEL"},
+}
+
+// Config is what loading found: the file, the settings it set and those the
+// environment overrode
+type Config struct {
+	// Path is the file loaded, or "" when there is none
+	Path string
+	// FromFile lists the keys the file set that the environment did not
+	FromFile []string
+	// Overridden lists the keys the file set that the environment overrode
+	Overridden []string
+	// Warnings are problems that do not stop the master, such as secrets in
+	// a file others can read
+	Warnings []string
+}
+
+// Path finds the configuration file, named by --config or $BATWA_CONFIG. The
+// file must be loaded before other flags are registered, as flags such as
+// --tls-cert default to the environment it sets, so Path reads --config from
+// the command line itself. It also registers --config, so flag.Parse takes
+// it.
+func Path() string {
+	path := os.Getenv(EnvPath)
+	args := os.Args[1:]
+	for i := 0; i < len(args) && args[i] != "--"; i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if name != "config" {
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		path = value
+	}
+	flag.String("config", path, "YAML configuration file; environment variables override it (defaults to $"+EnvPath+")")
+	return path
+}
+
+// Load reads the configuration file at path, if any, and checks every
+// setting it or the environment holds. Settings the file sets and the
+// environment does not are exported to the environment. Every problem found
+// is reported at once.
+func Load(path string) (*Config, error) {
+	config := &Config{Path: path}
+	values := map[string]string{}
+	var problems []error
+	if path != "" {
+		var err error
+		if values, problems, err = readFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	secrets := []string{}
+	for _, s := range settings {
+		value, inFile := values[s.key]
+		envValue, inEnv := os.LookupEnv(s.env)
+		switch {
+		case inEnv:
+			if err := s.check(envValue); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %w", s.env, err))
+			}
+			if inFile {
+				config.Overridden = append(config.Overridden, s.key)
+			}
+		case inFile:
+			if err := s.check(value); err != nil {
+				problems = append(problems, fmt.Errorf("%s in %s: %w", s.key, path, err))
+				continue
+			}
+			if s.kind == seconds {
+				value = toSeconds(value)
+			}
+			os.Setenv(s.env, value)
+			config.FromFile = append(config.FromFile, s.key)
+			if s.secret && !isReference(value) {
+				secrets = append(secrets, s.key)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return nil, errors.Join(problems...)
+	}
+
+	if len(secrets) > 0 {
+		if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0o077 != 0 {
+			config.Warnings = append(config.Warnings, fmt.Sprintf(
+				"%s holds %s and can be read by other users; chmod 600 it or use vault: or file: references",
+				path, strings.Join(secrets, ", ")))
+		}
+	}
+	return config, nil
+}
+
+// readFile parses a configuration file into the values of its keys, with
+// the problems of keys it could not take
+func readFile(path string) (map[string]string, []error, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read configuration: %w", err)
+	}
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	known := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		known[s.key] = s
+	}
+	values := map[string]string{}
+	var problems []error
+	var walk func(prefix string, node map[string]interface{})
+	walk = func(prefix string, node map[string]interface{}) {
+		keys := make([]string, 0, len(node))
+		for key := range node {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			full := prefix + key
+			s, isSetting := known[full]
+			child, isSection := node[key].(map[string]interface{})
+			switch {
+			case isSetting:
+				value, err := s.format(node[key])
+				if err != nil {
+					problems = append(problems, fmt.Errorf("%s in %s: %w", full, path, err))
+				} else if value != "" {
+					values[full] = value
+				}
+			case isSection:
+				walk(full+".", child)
+			default:
+				problems = append(problems, fmt.Errorf("unknown setting %s in %s", full, path))
+			}
+		}
+	}
+	walk("", document)
+	return values, problems, nil
+}
+
+// format writes a value from the file in the form of the setting's
+// environment variable
+func (s setting) format(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		if s.kind != list && s.kind != words {
+			return "", errors.New("takes a single value, not a list")
+		}
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if _, nested := item.(map[string]interface{}); nested {
+				return "", errors.New("list items must be plain values")
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		if s.kind == words {
+			return strings.Join(items, " "), nil
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		if s.kind != pairs {
+			return "", errors.New("takes a single value, not a mapping")
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		entries := []string{}
+		for _, key := range keys {
+			values, isList := v[key].([]interface{})
+			if !isList {
+				values = []interface{}{v[key]}
+			}
+			for _, item := range values {
+				entries = append(entries, key+"="+fmt.Sprint(item))
+			}
+		}
+		return strings.Join(entries, ","), nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// check validates a value of the setting
+func (s setting) check(value string) error {
+	if value == "" {
+		return nil
+	}
+	if len(s.choices) > 0 {
+		for _, choice := range s.choices {
+			if value == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("'%s' is not one of %s", value, strings.Join(s.choices, ", "))
+	}
+
+	switch s.kind {
+	case boolean:
+		if !strings.EqualFold(value, "true") && !strings.EqualFold(value, "false") {
+			return fmt.Errorf("'%s' is not true or false", value)
+		}
+	case number, count:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || (n == 0 && s.kind == number) {
+			if s.kind == number {
+				return fmt.Errorf("'%s' is not a number above zero", value)
+			}
+			return fmt.Errorf("'%s' is not a whole number", value)
+		}
+	case port:
+		if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("'%s' is not a port between 1 and 65535", value)
+		}
+	case duration:
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("'%s' is not a positive duration such as 30s or 12h", value)
+		}
+	case seconds:
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return nil
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < time.Second {
+			return fmt.Errorf("'%s' is not a number of seconds or a duration of at least 1s", value)
+		}
+	case size:
+		if bytes, err := quotas.ParseSize(value); err != nil || bytes == 0 {
+			return fmt.Errorf("'%s' is not a size such as 512M or 2G", value)
+		}
+	case pairs:
+		for _, pair := range strings.Split(value, ",") {
+			if key, val, found := strings.Cut(pair, "="); !found || strings.TrimSpace(key) == "" || strings.TrimSpace(val) == "" {
+				return fmt.Errorf("'%s' is not a key=value pair", pair)
+			}
+		}
+	}
+	return nil
+}
+
+// toSeconds converts a checked seconds value, which may be a duration, to a
+// whole number of seconds
+func toSeconds(value string) string {
+	if _, err := strconv.Atoi(value); err == nil {
+		return value
+	}
+	d, _ := time.ParseDuration(value)
+	return strconv.Itoa(int(d / time.Second))
+}
+
+// isReference reports whether a secret's value points to Vault or a file
+// rather than holding the secret
+func isReference(value string) bool {
+	return strings.HasPrefix(value, "vault:") || strings.HasPrefix(value, "file:")
+}
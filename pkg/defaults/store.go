@@ -0,0 +1,220 @@
+package defaults
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/quotas"
+)
+
+var logger = logging.For("defaults")
+
+// Size is the resources a VM created from a plain image gets when its
+// request leaves them out
+type Size struct {
+	CPUs   int
+	Memory string
+	Disk   string
+}
+
+// DefaultSize is the size of new VMs unless configured otherwise
+var DefaultSize = Size{CPUs: 1, Memory: "1G", Disk: "5G"}
+
+// SizeFromEnv reads the size of new VMs from VM_DEFAULT_CPUS,
+// VM_DEFAULT_MEMORY and VM_DEFAULT_DISK, each falling back to DefaultSize
+func SizeFromEnv() (Size, error) {
+	size := DefaultSize
+	if value := os.Getenv("VM_DEFAULT_CPUS"); value != "" {
+		cpus, err := strconv.Atoi(value)
+		if err != nil || cpus <= 0 {
+			return size, fmt.Errorf("invalid VM_DEFAULT_CPUS '%s': use a positive number", value)
+		}
+		size.CPUs = cpus
+	}
+	for _, setting := range []struct {
+		name  string
+		field *string
+	}{{"VM_DEFAULT_MEMORY", &size.Memory}, {"VM_DEFAULT_DISK", &size.Disk}} {
+		if value := os.Getenv(setting.name); value != "" {
+			if bytes, err := quotas.ParseSize(value); err != nil || bytes == 0 {
+				return size, fmt.Errorf("invalid %s '%s': use a size such as 2G or 512M", setting.name, value)
+			}
+			*setting.field = value
+		}
+	}
+	return size, nil
+}
+
+// Store keeps the master's primary VM and default agent, saved to a JSON
+// file after every change, and the size of new VMs, which is configured.
+type Store struct {
+	path     string
+	defaults models.Defaults
+	size     Size
+	mutex    sync.RWMutex
+}
+
+// NewStore creates a defaults store persisted at path, loading the defaults
+// already saved there
+func NewStore(path string) *Store {
+	s := &Store{path: path, size: DefaultSize}
+	if err := s.load(); err != nil {
+		logger.Error("Failed to load defaults", "path", path, "error", err)
+	}
+	return s
+}
+
+// NewStoreFromEnv creates a defaults store persisted at DEFAULTS_PATH
+// (default ./data/defaults.json), giving new VMs the size from SizeFromEnv
+func NewStoreFromEnv() (*Store, error) {
+	path := os.Getenv("DEFAULTS_PATH")
+	if path == "" {
+		path = filepath.Join("data", "defaults.json")
+	}
+	size, err := SizeFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	s := NewStore(path)
+	s.size = size
+	return s, nil
+}
+
+// load reads the saved defaults
+func (s *Store) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.defaults)
+}
+
+// save writes the defaults to the file; the caller must hold the lock
+func (s *Store) save() {
+	data, err := json.MarshalIndent(s.defaults, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0o755)
+	}
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save defaults", "path", s.path, "error", err)
+	}
+}
+
+// Get returns the current defaults
+func (s *Store) Get() models.Defaults {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.defaults
+}
+
+// Set replaces the default targets on behalf of user. The default SSH keys
+// are kept; they are changed through SetSSHKeys.
+func (s *Store) Set(defaults models.Defaults, user string) models.Defaults {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	defaults.SSHKeys = s.defaults.SSHKeys
+	defaults.UpdatedBy = user
+	defaults.UpdatedAt = &now
+	s.defaults = defaults
+	s.save()
+	return s.defaults
+}
+
+// Size returns the size of new VMs
+func (s *Store) Size() Size {
+	return s.size
+}
+
+// SSHKeys returns the public keys authorized in every new VM
+func (s *Store) SSHKeys() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]string(nil), s.defaults.SSHKeys...)
+}
+
+// SetSSHKeys replaces the public keys authorized in every new VM on behalf
+// of user
+func (s *Store) SetSSHKeys(keys []string, user string) models.Defaults {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.defaults.SSHKeys = keys
+	s.defaults.UpdatedBy = user
+	s.defaults.UpdatedAt = &now
+	s.save()
+	return s.defaults
+}
+
+// Primary returns the primary VM's name and agent, and whether one is set
+func (s *Store) Primary() (string, *string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.defaults.PrimaryVM, s.defaults.PrimaryAgentID, s.defaults.PrimaryVM != ""
+}
+
+// DefaultAgent returns the agent new VMs are placed on, or nil when placement
+// is left to the scheduler
+func (s *Store) DefaultAgent() *string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.defaults.DefaultAgentID
+}
+
+// ForgetVM clears the primary VM if it is the given VM, which no longer exists
+func (s *Store) ForgetVM(agentID *string, vmName string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.defaults.PrimaryVM != vmName || !sameAgent(s.defaults.PrimaryAgentID, agentID) {
+		return
+	}
+	s.defaults.PrimaryVM = ""
+	s.defaults.PrimaryAgentID = nil
+	s.save()
+}
+
+// ForgetAgent clears any default that refers to an agent that was removed
+func (s *Store) ForgetAgent(agentID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changed := false
+	if s.defaults.PrimaryAgentID != nil && *s.defaults.PrimaryAgentID == agentID {
+		s.defaults.PrimaryVM = ""
+		s.defaults.PrimaryAgentID = nil
+		changed = true
+	}
+	if s.defaults.DefaultAgentID != nil && *s.defaults.DefaultAgentID == agentID {
+		s.defaults.DefaultAgentID = nil
+		changed = true
+	}
+	if changed {
+		s.save()
+	}
+}
+
+func sameAgent(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
@@ -0,0 +1,270 @@
+package digest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/auth"
+	"github.com/prashah/batwa/pkg/executor"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/metadata"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/notifications"
+)
+
+var logger = logging.For("digest")
+
+// Collector produces digest items of one kind. Subsystems register collectors
+// so that their resources show up in the digest.
+type Collector func(now time.Time) []models.DigestItem
+
+// stateRecord tracks how long a VM has been in its current state
+type stateRecord struct {
+	state string
+	since time.Time
+}
+
+// Reporter samples VM states and periodically compiles and delivers digests
+type Reporter struct {
+	executors      *executor.ExecutorFactory
+	auth           *auth.Service
+	metadata       *metadata.Store
+	notifier       *notifications.Notifier
+	collectors     []Collector
+	states         map[string]stateRecord
+	latest         *models.Digest
+	idleThreshold  time.Duration
+	sampleInterval time.Duration
+	digestInterval time.Duration
+	mutex          sync.RWMutex
+	cancelFunc     context.CancelFunc
+}
+
+// NewReporter creates a new digest reporter sampling the VMs reachable through
+// executors and attributing them to the owners recorded in store. Digests are
+// sent through notifier; admins of authService receive the fleet-wide
+// summaries.
+func NewReporter(executors *executor.ExecutorFactory, authService *auth.Service, store *metadata.Store, notifier *notifications.Notifier, idleThreshold, digestInterval time.Duration) *Reporter {
+	r := &Reporter{
+		executors:      executors,
+		auth:           authService,
+		metadata:       store,
+		notifier:       notifier,
+		states:         make(map[string]stateRecord),
+		idleThreshold:  idleThreshold,
+		sampleInterval: 15 * time.Minute,
+		digestInterval: digestInterval,
+	}
+	r.RegisterCollector(r.collectIdleVMs)
+	return r
+}
+
+// RegisterCollector adds a collector to every future digest
+func (r *Reporter) RegisterCollector(collector Collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.collectors = append(r.collectors, collector)
+}
+
+// Sample records the current state of every VM so idle time can be measured.
+// A VM first seen stopped counts as stopped since that first sighting.
+func (r *Reporter) Sample(now time.Time) {
+	vms := r.executors.ListAllVMs(context.Background())
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	seen := make(map[string]bool, len(vms))
+	for _, vm := range vms {
+		agentID := ""
+		if vm.AgentID != nil {
+			agentID = *vm.AgentID
+		}
+		key := agentID + "/" + vm.Name
+		seen[key] = true
+
+		if record, exists := r.states[key]; !exists || record.state != vm.State {
+			r.states[key] = stateRecord{state: vm.State, since: now}
+		}
+	}
+
+	for key := range r.states {
+		if !seen[key] {
+			delete(r.states, key)
+		}
+	}
+}
+
+// collectIdleVMs reports VMs that have been stopped longer than the idle threshold
+func (r *Reporter) collectIdleVMs(now time.Time) []models.DigestItem {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	items := []models.DigestItem{}
+	for key, record := range r.states {
+		if record.state != "Stopped" || now.Sub(record.since) < r.idleThreshold {
+			continue
+		}
+		agentID, name, _ := strings.Cut(key, "/")
+		items = append(items, models.DigestItem{
+			Kind:    "idle_vm",
+			AgentID: agentID,
+			VMName:  name,
+			Detail:  fmt.Sprintf("Stopped for %d days", int(now.Sub(record.since).Hours()/24)),
+		})
+	}
+	return items
+}
+
+// Generate compiles a digest from all collectors and stores it as the latest
+func (r *Reporter) Generate(now time.Time) *models.Digest {
+	r.mutex.RLock()
+	collectors := append([]Collector{}, r.collectors...)
+	r.mutex.RUnlock()
+
+	digest := &models.Digest{
+		GeneratedAt: now,
+		Users:       map[string][]models.DigestItem{},
+		Projects:    map[string][]models.DigestItem{},
+		Unowned:     []models.DigestItem{},
+	}
+
+	for _, collector := range collectors {
+		for _, item := range collector(now) {
+			// Attribute VM findings to their owner and project
+			if item.VMName != "" {
+				if meta := r.metadata.Get(item.AgentID, item.VMName); meta != nil {
+					if item.Owner == "" {
+						item.Owner = meta.Owner
+					}
+					if item.Project == "" {
+						item.Project = meta.Project
+					}
+				}
+			}
+
+			if item.Owner != "" {
+				digest.Users[item.Owner] = append(digest.Users[item.Owner], item)
+			} else {
+				digest.Unowned = append(digest.Unowned, item)
+			}
+			if item.Project != "" {
+				digest.Projects[item.Project] = append(digest.Projects[item.Project], item)
+			}
+		}
+	}
+
+	r.mutex.Lock()
+	r.latest = digest
+	r.mutex.Unlock()
+
+	return digest
+}
+
+// Latest gets the most recently generated digest, or nil if none has been generated
+func (r *Reporter) Latest() *models.Digest {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.latest
+}
+
+// Deliver sends each user their section of a digest, and admins the project
+// summaries and unowned findings
+func (r *Reporter) Deliver(digest *models.Digest) {
+	for user, items := range digest.Users {
+		r.notifier.Notify(user, "digest",
+			fmt.Sprintf("Resource digest: %d items need attention", len(items)),
+			formatItems(items))
+	}
+
+	adminItems := append([]models.DigestItem{}, digest.Unowned...)
+	for _, items := range digest.Projects {
+		adminItems = append(adminItems, items...)
+	}
+	if len(adminItems) == 0 {
+		return
+	}
+	for _, admin := range r.auth.Admins() {
+		r.notifier.Notify(admin, "digest",
+			fmt.Sprintf("Fleet digest: %d project and unowned items", len(adminItems)),
+			formatItems(adminItems))
+	}
+}
+
+// formatItems renders digest items as a plain-text list
+func formatItems(items []models.DigestItem) string {
+	lines := make([]string, 0, len(items))
+	for _, item := range items {
+		target := item.VMName
+		if item.AgentID != "" && item.VMName != "" {
+			target = item.AgentID + "/" + item.VMName
+		}
+		line := fmt.Sprintf("- [%s] %s", item.Kind, item.Detail)
+		if target != "" {
+			line = fmt.Sprintf("- [%s] %s: %s", item.Kind, target, item.Detail)
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// Start starts the sampling and digest loop
+func (r *Reporter) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancelFunc = cancel
+
+	go r.loop(ctx)
+	logger.Info("Started digest reporter", "interval", r.digestInterval, "idle_after", r.idleThreshold)
+}
+
+// Stop stops the sampling and digest loop
+func (r *Reporter) Stop() {
+	if r.cancelFunc != nil {
+		r.cancelFunc()
+		logger.Info("Stopped digest reporter")
+	}
+}
+
+// loop samples VM states and generates digests on their intervals
+func (r *Reporter) loop(ctx context.Context) {
+	sampleTicker := time.NewTicker(r.sampleInterval)
+	defer sampleTicker.Stop()
+	digestTicker := time.NewTicker(r.digestInterval)
+	defer digestTicker.Stop()
+
+	r.Sample(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-sampleTicker.C:
+			r.Sample(now)
+		case now := <-digestTicker.C:
+			r.Deliver(r.Generate(now))
+		}
+	}
+}
+
+// envDuration reads a whole number of units from an environment variable
+func envDuration(name string, unit, fallback time.Duration) time.Duration {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil && value > 0 {
+		return time.Duration(value) * unit
+	}
+	return fallback
+}
+
+// NewReporterFromEnv creates a reporter configured by DIGEST_IDLE_DAYS
+// (default 7) and DIGEST_INTERVAL_HOURS (default 24)
+func NewReporterFromEnv(executors *executor.ExecutorFactory, authService *auth.Service, store *metadata.Store, notifier *notifications.Notifier) *Reporter {
+	return NewReporter(executors, authService, store, notifier,
+		envDuration("DIGEST_IDLE_DAYS", 24*time.Hour, 7*24*time.Hour),
+		envDuration("DIGEST_INTERVAL_HOURS", time.Hour, 24*time.Hour),
+	)
+}
@@ -0,0 +1,225 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+var logger = logging.For("events")
+
+// Log is an append-only log of VM and agent events. Events are persisted as
+// JSON lines so cursors stay valid across restarts; the most recent events are
+// also kept in memory to answer polls without reading the file.
+type Log struct {
+	path     string
+	capacity int
+	file     *os.File
+	recent   []*models.Event
+	lastID   int64
+	// changed is closed and replaced whenever an event is appended
+	changed chan struct{}
+	mutex   sync.RWMutex
+}
+
+// NewLog opens the event log at path, keeping up to capacity recent events in
+// memory. Older lines are dropped from the file once it holds twice that many.
+func NewLog(path string, capacity int) (*Log, error) {
+	l := &Log{
+		path:     path,
+		capacity: capacity,
+		changed:  make(chan struct{}),
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// load reads the persisted events, compacting the file if it has grown past
+// twice the in-memory capacity
+func (l *Log) load() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.Open(l.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	lines := 0
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var event models.Event
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				continue
+			}
+			lines++
+			l.remember(&event)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	if lines > 2*l.capacity {
+		if err := l.compact(); err != nil {
+			return err
+		}
+	}
+
+	l.file, err = os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	return err
+}
+
+// compact rewrites the file with only the events held in memory
+func (l *Log) compact() error {
+	tmpPath := l.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, event := range l.recent {
+		if err := encoder.Encode(event); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, l.path)
+}
+
+// remember adds an event to the in-memory window; the caller must hold the
+// write lock
+func (l *Log) remember(event *models.Event) {
+	l.recent = append(l.recent, event)
+	if len(l.recent) > l.capacity {
+		l.recent = l.recent[len(l.recent)-l.capacity:]
+	}
+	if event.ID > l.lastID {
+		l.lastID = event.ID
+	}
+}
+
+// Append records an event, assigning its ID and time, and wakes any waiting
+// pollers
+func (l *Log) Append(event models.Event) *models.Event {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	event.ID = l.lastID + 1
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	l.remember(&event)
+
+	if line, err := json.Marshal(&event); err != nil {
+		logger.Error("Failed to encode event", "error", err)
+	} else if _, err := l.file.Write(append(line, '\n')); err != nil {
+		logger.Error("Failed to persist event", "event_id", event.ID, "error", err)
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return &event
+}
+
+// Cursor gets the ID of the latest event, or 0 if there are none
+func (l *Log) Cursor() int64 {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.lastID
+}
+
+// Since gets up to limit events after cursor. truncated reports that events
+// immediately after cursor are no longer retained, so the client missed some.
+func (l *Log) Since(cursor int64, limit int) (events []*models.Event, truncated bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.since(cursor, limit)
+}
+
+// since implements Since; the caller must hold the lock
+func (l *Log) since(cursor int64, limit int) ([]*models.Event, bool) {
+	events := []*models.Event{}
+	truncated := len(l.recent) > 0 && l.recent[0].ID > cursor+1
+	for _, event := range l.recent {
+		if event.ID <= cursor {
+			continue
+		}
+		events = append(events, event)
+		if limit > 0 && len(events) == limit {
+			break
+		}
+	}
+	return events, truncated
+}
+
+// Wait is Since, but blocks until at least one event follows cursor or ctx is
+// done. It returns an empty list when ctx ends first.
+func (l *Log) Wait(ctx context.Context, cursor int64, limit int) ([]*models.Event, bool) {
+	for {
+		l.mutex.RLock()
+		events, truncated := l.since(cursor, limit)
+		changed := l.changed
+		l.mutex.RUnlock()
+
+		if len(events) > 0 {
+			return events, truncated
+		}
+
+		select {
+		case <-ctx.Done():
+			return events, truncated
+		case <-changed:
+		}
+	}
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// NewLogFromEnv opens the log at EVENT_LOG_PATH (default ./data/events.log),
+// keeping EVENT_LOG_RETAIN (default 10000) events available to pollers
+func NewLogFromEnv() (*Log, error) {
+	path := os.Getenv("EVENT_LOG_PATH")
+	if path == "" {
+		path = filepath.Join("data", "events.log")
+	}
+	capacity := 10000
+	if value, err := strconv.Atoi(os.Getenv("EVENT_LOG_RETAIN")); err == nil && value > 0 {
+		capacity = value
+	}
+	return NewLog(path, capacity)
+}
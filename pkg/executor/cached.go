@@ -0,0 +1,127 @@
+package executor
+
+import (
+	"context"
+
+	"github.com/prashah/batwa/pkg/inventory"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// cachedExecutor serves ListVMs from the inventory cache and invalidates the
+// location's entry after every operation that changes its VMs, so listings
+// reflect user actions immediately instead of after the TTL expires
+type cachedExecutor struct {
+	VMExecutor
+	key   string
+	cache *inventory.Cache
+}
+
+// newCachedExecutor wraps an executor with inventory caching
+func newCachedExecutor(inner VMExecutor, agentID *string, cache *inventory.Cache) *cachedExecutor {
+	return &cachedExecutor{
+		VMExecutor: inner,
+		key:        inventory.Key(agentID),
+		cache:      cache,
+	}
+}
+
+// ListVMs lists VMs, using the cached listing while it is fresh
+func (e *cachedExecutor) ListVMs(ctx context.Context) (*models.VMList, error) {
+	if result, ok := e.cache.Get(e.key); ok {
+		return result, nil
+	}
+
+	result, err := e.VMExecutor.ListVMs(ctx)
+	if err == nil {
+		e.cache.Set(e.key, result)
+	}
+	return result, err
+}
+
+// GetUsage reports VM usage, using the cached report while it is fresh
+func (e *cachedExecutor) GetUsage(ctx context.Context) (map[string]models.VMInfoExtended, error) {
+	if usage, ok := e.cache.GetUsage(e.key); ok {
+		return usage, nil
+	}
+
+	usage, err := e.VMExecutor.GetUsage(ctx)
+	if err == nil {
+		e.cache.SetUsage(e.key, usage)
+	}
+	return usage, err
+}
+
+// invalidate drops the cached listing once a mutation has been attempted.
+// Failed operations can still leave partial changes behind, so the result
+// is not consulted.
+func (e *cachedExecutor) invalidate(result *models.OperationResult, err error) (*models.OperationResult, error) {
+	e.cache.Invalidate(e.key)
+	return result, err
+}
+
+// CreateVM creates a VM and invalidates the cached listing
+func (e *cachedExecutor) CreateVM(ctx context.Context, req models.VMCreateRequest) (*models.OperationResult, error) {
+	return e.invalidate(e.VMExecutor.CreateVM(ctx, req))
+}
+
+// CreateVMWithProgress creates a VM and invalidates the cached listing
+func (e *cachedExecutor) CreateVMWithProgress(ctx context.Context, req models.VMCreateRequest, progress func(models.LaunchProgress)) (*models.OperationResult, error) {
+	return e.invalidate(e.VMExecutor.CreateVMWithProgress(ctx, req, progress))
+}
+
+// StartVM starts a VM and invalidates the cached listing
+func (e *cachedExecutor) StartVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.invalidate(e.VMExecutor.StartVM(ctx, vmName))
+}
+
+// StopVM stops a VM and invalidates the cached listing
+func (e *cachedExecutor) StopVM(ctx context.Context, vmName string, delayMinutes int) (*models.OperationResult, error) {
+	return e.invalidate(e.VMExecutor.StopVM(ctx, vmName, delayMinutes))
+}
+
+// SuspendVM suspends a VM and invalidates the cached listing
+func (e *cachedExecutor) SuspendVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.invalidate(e.VMExecutor.SuspendVM(ctx, vmName))
+}
+
+// ResumeVM resumes a VM and invalidates the cached listing
+func (e *cachedExecutor) ResumeVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.invalidate(e.VMExecutor.ResumeVM(ctx, vmName))
+}
+
+// RestartVM restarts a VM and invalidates the cached listing
+func (e *cachedExecutor) RestartVM(ctx context.Context, vmName string, force bool) (*models.OperationResult, error) {
+	return e.invalidate(e.VMExecutor.RestartVM(ctx, vmName, force))
+}
+
+// DeleteVM deletes a VM and invalidates the cached listing
+func (e *cachedExecutor) DeleteVM(ctx context.Context, vmName string, softDelete bool) (*models.OperationResult, error) {
+	return e.invalidate(e.VMExecutor.DeleteVM(ctx, vmName, softDelete))
+}
+
+// RecoverVM recovers a VM and invalidates the cached listing
+func (e *cachedExecutor) RecoverVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.invalidate(e.VMExecutor.RecoverVM(ctx, vmName))
+}
+
+// PurgeVM purges a VM and invalidates the cached listing
+func (e *cachedExecutor) PurgeVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.invalidate(e.VMExecutor.PurgeVM(ctx, vmName))
+}
+
+// ResizeVM resizes a VM and invalidates the cached listing
+func (e *cachedExecutor) ResizeVM(ctx context.Context, req models.VMResizeRequest) (*models.OperationResult, error) {
+	return e.invalidate(e.VMExecutor.ResizeVM(ctx, req))
+}
+
+// CloneVM clones a VM and invalidates the cached listing
+func (e *cachedExecutor) CloneVM(ctx context.Context, req models.VMCloneRequest) (*models.OperationResult, error) {
+	return e.invalidate(e.VMExecutor.CloneVM(ctx, req))
+}
+
+// PruneHost prunes the host and invalidates the cached listing, which still
+// shows the purged VMs as deleted
+func (e *cachedExecutor) PruneHost(ctx context.Context) (*models.HostPruneResult, error) {
+	defer e.cache.Invalidate(e.key)
+	return e.VMExecutor.PruneHost(ctx)
+}
@@ -0,0 +1,133 @@
+package executor
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/prashah/batwa/pkg/bus"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// eventExecutor publishes an event after every VM operation that succeeds,
+// so subscribers see changes made through any route
+type eventExecutor struct {
+	VMExecutor
+	agentID string
+	events  *bus.Bus
+}
+
+// newEventExecutor wraps an executor with event publishing
+func newEventExecutor(inner VMExecutor, agentID *string, events *bus.Bus) *eventExecutor {
+	e := &eventExecutor{
+		VMExecutor: inner,
+		events:     events,
+	}
+	if agentID != nil {
+		e.agentID = *agentID
+	}
+	return e
+}
+
+// record publishes an event of eventType for vmName if the operation succeeded
+func (e *eventExecutor) record(eventType, vmName string, data map[string]string, result *models.OperationResult, err error) (*models.OperationResult, error) {
+	if err == nil && result != nil && result.Success {
+		e.events.Publish(models.Event{
+			Type:    eventType,
+			AgentID: e.agentID,
+			VMName:  vmName,
+			Data:    data,
+		})
+	}
+	return result, err
+}
+
+// CreateVM creates a VM and records vm.created
+func (e *eventExecutor) CreateVM(ctx context.Context, req models.VMCreateRequest) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.CreateVM(ctx, req)
+	return e.record("vm.created", req.Name, map[string]string{"image": req.Image}, result, err)
+}
+
+// CreateVMWithProgress creates a VM and records vm.created
+func (e *eventExecutor) CreateVMWithProgress(ctx context.Context, req models.VMCreateRequest, progress func(models.LaunchProgress)) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.CreateVMWithProgress(ctx, req, progress)
+	return e.record("vm.created", req.Name, map[string]string{"image": req.Image}, result, err)
+}
+
+// StartVM starts a VM and records vm.started
+func (e *eventExecutor) StartVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.StartVM(ctx, vmName)
+	return e.record("vm.started", vmName, nil, result, err)
+}
+
+// StopVM stops a VM and records vm.stopped, or vm.stop_scheduled for a
+// delayed stop
+func (e *eventExecutor) StopVM(ctx context.Context, vmName string, delayMinutes int) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.StopVM(ctx, vmName, delayMinutes)
+	if delayMinutes > 0 {
+		data := map[string]string{"delay_minutes": strconv.Itoa(delayMinutes)}
+		return e.record("vm.stop_scheduled", vmName, data, result, err)
+	}
+	return e.record("vm.stopped", vmName, nil, result, err)
+}
+
+// CancelStopVM cancels a delayed stop and records vm.stop_cancelled
+func (e *eventExecutor) CancelStopVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.CancelStopVM(ctx, vmName)
+	return e.record("vm.stop_cancelled", vmName, nil, result, err)
+}
+
+// SuspendVM suspends a VM and records vm.suspended
+func (e *eventExecutor) SuspendVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.SuspendVM(ctx, vmName)
+	return e.record("vm.suspended", vmName, nil, result, err)
+}
+
+// ResumeVM resumes a VM and records vm.resumed
+func (e *eventExecutor) ResumeVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.ResumeVM(ctx, vmName)
+	return e.record("vm.resumed", vmName, nil, result, err)
+}
+
+// RestartVM restarts a VM and records vm.restarted
+func (e *eventExecutor) RestartVM(ctx context.Context, vmName string, force bool) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.RestartVM(ctx, vmName, force)
+	return e.record("vm.restarted", vmName, nil, result, err)
+}
+
+// DeleteVM deletes a VM and records vm.deleted
+func (e *eventExecutor) DeleteVM(ctx context.Context, vmName string, softDelete bool) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.DeleteVM(ctx, vmName, softDelete)
+	data := map[string]string{"soft_delete": "false"}
+	if softDelete {
+		data["soft_delete"] = "true"
+	}
+	return e.record("vm.deleted", vmName, data, result, err)
+}
+
+// RecoverVM recovers a VM and records vm.recovered
+func (e *eventExecutor) RecoverVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.RecoverVM(ctx, vmName)
+	return e.record("vm.recovered", vmName, nil, result, err)
+}
+
+// PurgeVM purges a VM and records vm.purged
+func (e *eventExecutor) PurgeVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.PurgeVM(ctx, vmName)
+	return e.record("vm.purged", vmName, nil, result, err)
+}
+
+// ResizeVM resizes a VM and records vm.resized
+func (e *eventExecutor) ResizeVM(ctx context.Context, req models.VMResizeRequest) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.ResizeVM(ctx, req)
+	return e.record("vm.resized", req.Name, nil, result, err)
+}
+
+// CloneVM clones a VM and records vm.cloned against the source VM
+func (e *eventExecutor) CloneVM(ctx context.Context, req models.VMCloneRequest) (*models.OperationResult, error) {
+	result, err := e.VMExecutor.CloneVM(ctx, req)
+	var data map[string]string
+	if result != nil && result.VMName != "" {
+		data = map[string]string{"clone": result.VMName}
+	}
+	return e.record("vm.cloned", req.Name, data, result, err)
+}
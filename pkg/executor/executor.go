@@ -1,155 +1,305 @@
 package executor
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"strconv"
 
 	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/bus"
+	"github.com/prashah/batwa/pkg/cloudinit"
 	"github.com/prashah/batwa/pkg/communication"
+	"github.com/prashah/batwa/pkg/forward"
+	"github.com/prashah/batwa/pkg/inventory"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
 	"github.com/prashah/batwa/pkg/multipass"
 )
 
-// VMExecutor is the interface for VM executors
+var logger = logging.For("executor")
+
+// VMExecutor is the interface for VM executors. Operations that change a VM
+// always return a result, even alongside an error, so callers can report its
+// message. Every method gives up when ctx ends; multipass commands are also
+// bounded by their own timeout.
 type VMExecutor interface {
-	ListVMs() (map[string]interface{}, error)
-	GetVMInfo(vmName string) (map[string]interface{}, error)
-	CreateVM(name string, cpus int, memory, disk, image string) (map[string]interface{}, error)
-	StartVM(vmName string) (map[string]interface{}, error)
-	StopVM(vmName string) (map[string]interface{}, error)
-	DeleteVM(vmName string) (map[string]interface{}, error)
+	ListVMs(ctx context.Context) (*models.VMList, error)
+	GetVMInfo(ctx context.Context, vmName string) (*models.VMDetail, error)
+	CreateVM(ctx context.Context, req models.VMCreateRequest) (*models.OperationResult, error)
+	CreateVMWithProgress(ctx context.Context, req models.VMCreateRequest, progress func(models.LaunchProgress)) (*models.OperationResult, error)
+	StartVM(ctx context.Context, vmName string) (*models.OperationResult, error)
+	StopVM(ctx context.Context, vmName string, delayMinutes int) (*models.OperationResult, error)
+	CancelStopVM(ctx context.Context, vmName string) (*models.OperationResult, error)
+	SuspendVM(ctx context.Context, vmName string) (*models.OperationResult, error)
+	ResumeVM(ctx context.Context, vmName string) (*models.OperationResult, error)
+	RestartVM(ctx context.Context, vmName string, force bool) (*models.OperationResult, error)
+	DeleteVM(ctx context.Context, vmName string, softDelete bool) (*models.OperationResult, error)
+	RecoverVM(ctx context.Context, vmName string) (*models.OperationResult, error)
+	PurgeVM(ctx context.Context, vmName string) (*models.OperationResult, error)
+	ResizeVM(ctx context.Context, req models.VMResizeRequest) (*models.OperationResult, error)
+	CloneVM(ctx context.Context, req models.VMCloneRequest) (*models.OperationResult, error)
+	MountVM(ctx context.Context, vmName, source, target string) (*models.OperationResult, error)
+	UnmountVM(ctx context.Context, vmName, target string) (*models.OperationResult, error)
+	ListMounts(ctx context.Context, vmName string) ([]models.VMMount, error)
+	ForwardPort(ctx context.Context, req models.PortForwardRequest) (*models.PortForward, error)
+	ListForwards(ctx context.Context) ([]models.PortForward, error)
+	RemoveForward(ctx context.Context, id string) error
+	UploadFile(ctx context.Context, vmName, destPath, filename string, src io.Reader) (*models.OperationResult, error)
+	DownloadFile(ctx context.Context, vmName, srcPath string) (io.ReadCloser, error)
+	ExecInVM(ctx context.Context, req models.VMExecRequest) models.RemoteCommandResponse
+	ExecInVMStream(ctx context.Context, req models.VMExecRequest, output io.Writer) models.RemoteCommandResponse
+	ListBlueprints(ctx context.Context) ([]models.Blueprint, error)
+	ListNetworks(ctx context.Context) ([]models.Network, error)
+	GetSettings(ctx context.Context, keys []string) (map[string]string, error)
+	SetSettings(ctx context.Context, settings map[string]string) error
+	GetVersion(ctx context.Context) (*models.HostVersion, error)
+	GetUsage(ctx context.Context) (map[string]models.VMInfoExtended, error)
+	GetStorage(ctx context.Context) (*models.HostStorage, error)
+	PruneHost(ctx context.Context) (*models.HostPruneResult, error)
 	GetLocationInfo() map[string]interface{}
 }
 
 // LocalVMExecutor executes VM operations locally
-type LocalVMExecutor struct{}
+type LocalVMExecutor struct {
+	runner   *multipass.Runner
+	forwards *forward.Manager
+}
 
-// NewLocalVMExecutor creates a new local VM executor
-func NewLocalVMExecutor() *LocalVMExecutor {
-	return &LocalVMExecutor{}
+// NewLocalVMExecutor creates a new local VM executor that runs multipass
+// through runner and forwards ports through forwards
+func NewLocalVMExecutor(runner *multipass.Runner, forwards *forward.Manager) *LocalVMExecutor {
+	return &LocalVMExecutor{runner: runner, forwards: forwards}
 }
 
 // ListVMs lists all local VMs
-func (e *LocalVMExecutor) ListVMs() (map[string]interface{}, error) {
-	result := multipass.RunMultipassCommand([]string{"list", "--format", "json"})
-	if !result.Success {
-		return map[string]interface{}{
-			"success": false,
-			"error":   result.Error,
-		}, fmt.Errorf(result.Error)
+func (e *LocalVMExecutor) ListVMs(ctx context.Context) (*models.VMList, error) {
+	return e.runner.List(ctx)
+}
+
+// GetVMInfo gets information about a local VM
+func (e *LocalVMExecutor) GetVMInfo(ctx context.Context, vmName string) (*models.VMDetail, error) {
+	return e.runner.Info(ctx, vmName)
+}
+
+// CreateVM creates a new local VM
+func (e *LocalVMExecutor) CreateVM(ctx context.Context, req models.VMCreateRequest) (*models.OperationResult, error) {
+	return e.CreateVMWithProgress(ctx, req, nil)
+}
+
+// CreateVMWithProgress creates a new local VM, reporting launch progress as
+// multipass prints it
+func (e *LocalVMExecutor) CreateVMWithProgress(ctx context.Context, req models.VMCreateRequest, progress func(models.LaunchProgress)) (*models.OperationResult, error) {
+	cloudInitPath := ""
+	if req.CloudInit != "" {
+		path, cleanup, err := cloudinit.WriteTempFile(req.CloudInit)
+		if err != nil {
+			return &models.OperationResult{
+				Success: false,
+				Message: fmt.Sprintf("Failed to write cloud-init file: %s", err),
+			}, err
+		}
+		defer cleanup()
+		cloudInitPath = path
 	}
 
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(result.Output), &data); err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"error":   fmt.Sprintf("Failed to parse JSON: %s", err),
-		}, err
+	return e.runner.Launch(ctx, req, cloudInitPath, progress).Operation(""), nil
+}
+
+// StartVM starts a local VM
+func (e *LocalVMExecutor) StartVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.runner.RunVMCommand(ctx, vmName, []string{"start", vmName}).Operation(""), nil
+}
+
+// StopVM stops a local VM, or schedules the stop delayMinutes from now
+func (e *LocalVMExecutor) StopVM(ctx context.Context, vmName string, delayMinutes int) (*models.OperationResult, error) {
+	if delayMinutes > 0 {
+		args := []string{"stop", "--time", strconv.Itoa(delayMinutes), vmName}
+		return e.runner.RunVMCommand(ctx, vmName, args).Operation(fmt.Sprintf("VM will stop in %d minutes", delayMinutes)), nil
 	}
+	return e.runner.RunVMCommand(ctx, vmName, []string{"stop", vmName}).Operation(""), nil
+}
 
-	return map[string]interface{}{
-		"success": true,
-		"data":    data,
-	}, nil
+// CancelStopVM cancels a delayed stop of a local VM
+func (e *LocalVMExecutor) CancelStopVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.runner.RunVMCommand(ctx, vmName, []string{"stop", "--cancel", vmName}).Operation("Scheduled stop cancelled"), nil
 }
 
-// GetVMInfo gets information about a local VM
-func (e *LocalVMExecutor) GetVMInfo(vmName string) (map[string]interface{}, error) {
-	result := multipass.RunMultipassCommand([]string{"info", vmName, "--format", "json"})
-	if !result.Success {
-		return map[string]interface{}{
-			"success": false,
-			"error":   result.Error,
-		}, fmt.Errorf(result.Error)
+// SuspendVM suspends a local VM
+func (e *LocalVMExecutor) SuspendVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.runner.RunVMCommand(ctx, vmName, []string{"suspend", vmName}).Operation(""), nil
+}
+
+// ResumeVM resumes a suspended local VM
+func (e *LocalVMExecutor) ResumeVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	// multipass resumes suspended instances through start
+	return e.runner.RunVMCommand(ctx, vmName, []string{"start", vmName}).Operation(""), nil
+}
+
+// RestartVM restarts a local VM. With force, an unresponsive guest is
+// stopped forcibly and started again when multipass restart fails.
+func (e *LocalVMExecutor) RestartVM(ctx context.Context, vmName string, force bool) (*models.OperationResult, error) {
+	result := e.runner.RunVMCommand(ctx, vmName, []string{"restart", vmName})
+	if result.Success || !force {
+		return result.Operation(""), nil
 	}
 
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(result.Output), &data); err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"error":   fmt.Sprintf("Failed to parse JSON: %s", err),
-		}, err
+	logger.WarnContext(ctx, "Graceful restart failed, forcing stop and start", "vm", vmName, "error", result.Error)
+	stopResult := e.runner.RunVMCommand(ctx, vmName, []string{"stop", "--force", vmName})
+	if !stopResult.Success {
+		return stopResult.Operation(""), nil
 	}
 
-	return map[string]interface{}{
-		"success": true,
-		"data":    data,
-	}, nil
+	return e.runner.RunVMCommand(ctx, vmName, []string{"start", vmName}).Operation("VM force restarted"), nil
 }
 
-// CreateVM creates a new local VM
-func (e *LocalVMExecutor) CreateVM(name string, cpus int, memory, disk, image string) (map[string]interface{}, error) {
-	args := []string{
-		"launch",
-		image,
-		"--name", name,
-		"--cpus", fmt.Sprintf("%d", cpus),
-		"--memory", memory,
-		"--disk", disk,
-	}
-
-	result := multipass.RunMultipassCommand(args)
-	message := result.Output
+// DeleteVM deletes a local VM. A soft delete leaves the VM recoverable until it is purged.
+func (e *LocalVMExecutor) DeleteVM(ctx context.Context, vmName string, softDelete bool) (*models.OperationResult, error) {
+	result := e.runner.RunVMCommand(ctx, vmName, []string{"delete", vmName})
 	if !result.Success {
-		message = result.Error
+		return result.Operation(""), nil
 	}
+	e.forwards.RemoveVM(vmName)
 
-	return map[string]interface{}{
-		"success": result.Success,
-		"message": message,
-	}, nil
+	if softDelete {
+		return &models.OperationResult{
+			Success: true,
+			Message: "VM deleted; it can be recovered until purged",
+		}, nil
+	}
+
+	return e.runner.RunMultipassCommand(ctx, []string{"purge"}).Operation("VM deleted and purged"), nil
 }
 
-// StartVM starts a local VM
-func (e *LocalVMExecutor) StartVM(vmName string) (map[string]interface{}, error) {
-	result := multipass.RunMultipassCommand([]string{"start", vmName})
-	message := result.Output
-	if !result.Success {
-		message = result.Error
-	}
+// RecoverVM recovers a soft-deleted local VM
+func (e *LocalVMExecutor) RecoverVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.runner.RunVMCommand(ctx, vmName, []string{"recover", vmName}).Operation(""), nil
+}
 
-	return map[string]interface{}{
-		"success": result.Success,
-		"message": message,
+// PurgeVM permanently removes a soft-deleted local VM
+func (e *LocalVMExecutor) PurgeVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.runner.RunVMCommand(ctx, vmName, []string{"delete", "--purge", vmName}).Operation("VM purged"), nil
+}
+
+// ResizeVM changes the resources of a local VM, stopping and restarting it as needed
+func (e *LocalVMExecutor) ResizeVM(ctx context.Context, req models.VMResizeRequest) (*models.OperationResult, error) {
+	phases, success := e.runner.Resize(ctx, req)
+	return &models.OperationResult{
+		Success: success,
+		Phases:  phases,
 	}, nil
 }
 
-// StopVM stops a local VM
-func (e *LocalVMExecutor) StopVM(vmName string) (map[string]interface{}, error) {
-	result := multipass.RunMultipassCommand([]string{"stop", vmName})
-	message := result.Output
-	if !result.Success {
-		message = result.Error
-	}
+// CloneVM clones a local VM
+func (e *LocalVMExecutor) CloneVM(ctx context.Context, req models.VMCloneRequest) (*models.OperationResult, error) {
+	return e.runner.CloneResponse(ctx, e.runner.Clone(ctx, req)), nil
+}
 
-	return map[string]interface{}{
-		"success": result.Success,
-		"message": message,
-	}, nil
+// MountVM mounts a directory of this host into a local VM
+func (e *LocalVMExecutor) MountVM(ctx context.Context, vmName, source, target string) (*models.OperationResult, error) {
+	return e.runner.RunVMCommand(ctx, vmName, multipass.BuildMountArgs(vmName, source, target)).Operation("Directory mounted"), nil
 }
 
-// DeleteVM deletes a local VM
-func (e *LocalVMExecutor) DeleteVM(vmName string) (map[string]interface{}, error) {
-	result := multipass.RunMultipassCommand([]string{"delete", vmName})
-	if !result.Success {
-		return map[string]interface{}{
-			"success": false,
-			"message": result.Error,
-		}, nil
+// UnmountVM removes a mount (or all mounts when target is empty) from a local VM
+func (e *LocalVMExecutor) UnmountVM(ctx context.Context, vmName, target string) (*models.OperationResult, error) {
+	return e.runner.RunVMCommand(ctx, vmName, multipass.BuildUnmountArgs(vmName, target)).Operation("Directory unmounted"), nil
+}
+
+// ListMounts lists the mounts of a local VM
+func (e *LocalVMExecutor) ListMounts(ctx context.Context, vmName string) ([]models.VMMount, error) {
+	return e.runner.ListMounts(ctx, vmName)
+}
+
+// ForwardPort forwards a port of the master to a port of a local VM
+func (e *LocalVMExecutor) ForwardPort(ctx context.Context, req models.PortForwardRequest) (*models.PortForward, error) {
+	return e.forwards.Forward(ctx, req)
+}
+
+// ListForwards lists the port forwards running on the master
+func (e *LocalVMExecutor) ListForwards(ctx context.Context) ([]models.PortForward, error) {
+	return e.forwards.List(), nil
+}
+
+// RemoveForward stops a port forward running on the master
+func (e *LocalVMExecutor) RemoveForward(ctx context.Context, id string) error {
+	if !e.forwards.Remove(id) {
+		return fmt.Errorf("port forward '%s' not found", id)
 	}
+	return nil
+}
 
-	purgeResult := multipass.RunMultipassCommand([]string{"purge"})
-	message := "VM deleted and purged"
-	if !purgeResult.Success {
-		message = purgeResult.Error
+// UploadFile copies src into a local VM at destPath
+func (e *LocalVMExecutor) UploadFile(ctx context.Context, vmName, destPath, filename string, src io.Reader) (*models.OperationResult, error) {
+	if err := e.runner.UploadFile(ctx, vmName, destPath, src, nil); err != nil {
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
+		}, err
 	}
 
-	return map[string]interface{}{
-		"success": purgeResult.Success,
-		"message": message,
+	return &models.OperationResult{
+		Success: true,
+		Message: fmt.Sprintf("Uploaded %s to %s", filename, destPath),
 	}, nil
 }
 
+// DownloadFile copies srcPath out of a local VM
+func (e *LocalVMExecutor) DownloadFile(ctx context.Context, vmName, srcPath string) (io.ReadCloser, error) {
+	return e.runner.DownloadFile(ctx, vmName, srcPath, nil)
+}
+
+// ExecInVM runs a command inside a local VM
+func (e *LocalVMExecutor) ExecInVM(ctx context.Context, req models.VMExecRequest) models.RemoteCommandResponse {
+	return e.runner.Exec(ctx, req, nil)
+}
+
+// ExecInVMStream runs a command inside a local VM, writing its output to
+// output line by line as it runs
+func (e *LocalVMExecutor) ExecInVMStream(ctx context.Context, req models.VMExecRequest, output io.Writer) models.RemoteCommandResponse {
+	return e.runner.Exec(ctx, req, output)
+}
+
+// ListBlueprints lists the blueprints available to local multipass
+func (e *LocalVMExecutor) ListBlueprints(ctx context.Context) ([]models.Blueprint, error) {
+	return e.runner.ListBlueprints(ctx)
+}
+
+// ListNetworks lists the interfaces local VMs can be bridged onto
+func (e *LocalVMExecutor) ListNetworks(ctx context.Context) ([]models.Network, error) {
+	return e.runner.ListNetworks(ctx)
+}
+
+// GetSettings reads the local multipass daemon's settings
+func (e *LocalVMExecutor) GetSettings(ctx context.Context, keys []string) (map[string]string, error) {
+	return e.runner.GetSettings(ctx, keys)
+}
+
+// SetSettings changes the local multipass daemon's settings
+func (e *LocalVMExecutor) SetSettings(ctx context.Context, settings map[string]string) error {
+	return e.runner.SetSettings(ctx, settings)
+}
+
+// GetVersion reports the local multipass version
+func (e *LocalVMExecutor) GetVersion(ctx context.Context) (*models.HostVersion, error) {
+	return e.runner.LocalVersion(ctx)
+}
+
+// GetStorage reports the disk space multipass uses on this host
+func (e *LocalVMExecutor) GetStorage(ctx context.Context) (*models.HostStorage, error) {
+	return e.runner.Storage(ctx)
+}
+
+// PruneHost purges deleted VMs and stale cached images on this host
+func (e *LocalVMExecutor) PruneHost(ctx context.Context) (*models.HostPruneResult, error) {
+	return e.runner.Prune(ctx)
+}
+
+// GetUsage reports CPU, load, disk and memory usage of local VMs
+func (e *LocalVMExecutor) GetUsage(ctx context.Context) (map[string]models.VMInfoExtended, error) {
+	return e.runner.ListUsage(ctx)
+}
+
 // GetLocationInfo gets location information for local executor
 func (e *LocalVMExecutor) GetLocationInfo() map[string]interface{} {
 	return map[string]interface{}{
@@ -161,83 +311,129 @@ func (e *LocalVMExecutor) GetLocationInfo() map[string]interface{} {
 
 // RemoteVMExecutor executes VM operations on remote agents
 type RemoteVMExecutor struct {
-	agentID       string
-	communicator  *communication.AgentCommunicator
+	agentID      string
+	registry     *agents.AgentRegistry
+	communicator communication.AgentCommunicator
 }
 
 // NewRemoteVMExecutor creates a new remote VM executor
-func NewRemoteVMExecutor(agentID string, communicator *communication.AgentCommunicator) *RemoteVMExecutor {
+func NewRemoteVMExecutor(agentID string, registry *agents.AgentRegistry, communicator communication.AgentCommunicator) *RemoteVMExecutor {
 	return &RemoteVMExecutor{
 		agentID:      agentID,
+		registry:     registry,
 		communicator: communicator,
 	}
 }
 
 // ListVMs lists all VMs on the remote agent
-func (e *RemoteVMExecutor) ListVMs() (map[string]interface{}, error) {
-	result, err := e.communicator.GetVMList(e.agentID)
+func (e *RemoteVMExecutor) ListVMs(ctx context.Context) (*models.VMList, error) {
+	return e.communicator.GetVMList(ctx, e.agentID)
+}
+
+// GetVMInfo gets information about a VM on the remote agent
+func (e *RemoteVMExecutor) GetVMInfo(ctx context.Context, vmName string) (*models.VMDetail, error) {
+	return e.communicator.GetVMInfo(ctx, e.agentID, vmName)
+}
+
+// CreateVM creates a new VM on the remote agent
+func (e *RemoteVMExecutor) CreateVM(ctx context.Context, req models.VMCreateRequest) (*models.OperationResult, error) {
+	result, err := e.communicator.CreateVM(ctx, e.agentID, req)
 	if err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
 		}, err
 	}
 
-	return map[string]interface{}{
-		"success": true,
-		"data":    result,
-	}, nil
+	return result, nil
 }
 
-// GetVMInfo gets information about a VM on the remote agent
-func (e *RemoteVMExecutor) GetVMInfo(vmName string) (map[string]interface{}, error) {
-	result, err := e.communicator.GetVMInfo(e.agentID, vmName)
+// CreateVMWithProgress creates a VM on the remote agent, relaying the launch
+// progress the agent streams back
+func (e *RemoteVMExecutor) CreateVMWithProgress(ctx context.Context, req models.VMCreateRequest, progress func(models.LaunchProgress)) (*models.OperationResult, error) {
+	result, err := e.communicator.CreateVMWithProgress(ctx, e.agentID, req, progress)
 	if err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
 		}, err
 	}
 
-	return map[string]interface{}{
-		"success": true,
-		"data":    result,
-	}, nil
+	return result, nil
 }
 
-// CreateVM creates a new VM on the remote agent
-func (e *RemoteVMExecutor) CreateVM(name string, cpus int, memory, disk, image string) (map[string]interface{}, error) {
-	result, err := e.communicator.CreateVM(e.agentID, name, cpus, memory, disk, image)
+// StartVM starts a VM on the remote agent
+func (e *RemoteVMExecutor) StartVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	result, err := e.communicator.VMAction(ctx, e.agentID, vmName, "start")
 	if err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"message": err.Error(),
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
 		}, err
 	}
 
 	return result, nil
 }
 
-// StartVM starts a VM on the remote agent
-func (e *RemoteVMExecutor) StartVM(vmName string) (map[string]interface{}, error) {
-	result, err := e.communicator.VMAction(e.agentID, vmName, "start")
+// StopVM stops a VM on the remote agent, or schedules the stop
+func (e *RemoteVMExecutor) StopVM(ctx context.Context, vmName string, delayMinutes int) (*models.OperationResult, error) {
+	result, err := e.communicator.StopVM(ctx, e.agentID, vmName, delayMinutes)
+	if err != nil {
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
+		}, err
+	}
+
+	return result, nil
+}
+
+// CancelStopVM cancels a delayed stop on the remote agent
+func (e *RemoteVMExecutor) CancelStopVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	result, err := e.communicator.CancelStopVM(ctx, e.agentID, vmName)
+	if err != nil {
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
+		}, err
+	}
+
+	return result, nil
+}
+
+// SuspendVM suspends a VM on the remote agent
+func (e *RemoteVMExecutor) SuspendVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	result, err := e.communicator.SuspendVM(ctx, e.agentID, vmName)
+	if err != nil {
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
+		}, err
+	}
+
+	return result, nil
+}
+
+// ResumeVM resumes a suspended VM on the remote agent
+func (e *RemoteVMExecutor) ResumeVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	result, err := e.communicator.ResumeVM(ctx, e.agentID, vmName)
 	if err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"message": err.Error(),
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
 		}, err
 	}
 
 	return result, nil
 }
 
-// StopVM stops a VM on the remote agent
-func (e *RemoteVMExecutor) StopVM(vmName string) (map[string]interface{}, error) {
-	result, err := e.communicator.VMAction(e.agentID, vmName, "stop")
+// RestartVM restarts a VM on the remote agent
+func (e *RemoteVMExecutor) RestartVM(ctx context.Context, vmName string, force bool) (*models.OperationResult, error) {
+	result, err := e.communicator.RestartVM(ctx, e.agentID, vmName, force)
 	if err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"message": err.Error(),
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
 		}, err
 	}
 
@@ -245,21 +441,188 @@ func (e *RemoteVMExecutor) StopVM(vmName string) (map[string]interface{}, error)
 }
 
 // DeleteVM deletes a VM on the remote agent
-func (e *RemoteVMExecutor) DeleteVM(vmName string) (map[string]interface{}, error) {
-	result, err := e.communicator.VMAction(e.agentID, vmName, "delete")
+func (e *RemoteVMExecutor) DeleteVM(ctx context.Context, vmName string, softDelete bool) (*models.OperationResult, error) {
+	result, err := e.communicator.DeleteVM(ctx, e.agentID, vmName, softDelete)
+	if err != nil {
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
+		}, err
+	}
+
+	return result, nil
+}
+
+// RecoverVM recovers a soft-deleted VM on the remote agent
+func (e *RemoteVMExecutor) RecoverVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	result, err := e.communicator.VMAction(ctx, e.agentID, vmName, "recover")
 	if err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"message": err.Error(),
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
 		}, err
 	}
 
 	return result, nil
 }
 
+// PurgeVM permanently removes a soft-deleted VM on the remote agent
+func (e *RemoteVMExecutor) PurgeVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	result, err := e.communicator.VMAction(ctx, e.agentID, vmName, "purge")
+	if err != nil {
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
+		}, err
+	}
+
+	return result, nil
+}
+
+// ResizeVM changes the resources of a VM on the remote agent
+func (e *RemoteVMExecutor) ResizeVM(ctx context.Context, req models.VMResizeRequest) (*models.OperationResult, error) {
+	result, err := e.communicator.ResizeVM(ctx, e.agentID, req)
+	if err != nil {
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
+		}, err
+	}
+
+	return result, nil
+}
+
+// CloneVM clones a VM on the remote agent
+func (e *RemoteVMExecutor) CloneVM(ctx context.Context, req models.VMCloneRequest) (*models.OperationResult, error) {
+	result, err := e.communicator.CloneVM(ctx, e.agentID, req)
+	if err != nil {
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
+		}, err
+	}
+
+	return result, nil
+}
+
+// MountVM mounts a directory of the agent host into a VM on the remote agent
+func (e *RemoteVMExecutor) MountVM(ctx context.Context, vmName, source, target string) (*models.OperationResult, error) {
+	result, err := e.communicator.MountVM(ctx, e.agentID, models.VMMountRequest{Name: vmName, Source: source, Target: target})
+	if err != nil {
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
+		}, err
+	}
+
+	return result, nil
+}
+
+// UnmountVM removes a mount from a VM on the remote agent
+func (e *RemoteVMExecutor) UnmountVM(ctx context.Context, vmName, target string) (*models.OperationResult, error) {
+	result, err := e.communicator.UnmountVM(ctx, e.agentID, models.VMMountRequest{Name: vmName, Target: target})
+	if err != nil {
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
+		}, err
+	}
+
+	return result, nil
+}
+
+// ListMounts lists the mounts of a VM on the remote agent
+func (e *RemoteVMExecutor) ListMounts(ctx context.Context, vmName string) ([]models.VMMount, error) {
+	return e.communicator.ListMounts(ctx, e.agentID, vmName)
+}
+
+// ForwardPort forwards a port of the agent host to a port of one of its VMs
+func (e *RemoteVMExecutor) ForwardPort(ctx context.Context, req models.PortForwardRequest) (*models.PortForward, error) {
+	return e.communicator.ForwardPort(ctx, e.agentID, req)
+}
+
+// ListForwards lists the port forwards running on the remote agent
+func (e *RemoteVMExecutor) ListForwards(ctx context.Context) ([]models.PortForward, error) {
+	return e.communicator.ListForwards(ctx, e.agentID)
+}
+
+// RemoveForward stops a port forward running on the remote agent
+func (e *RemoteVMExecutor) RemoveForward(ctx context.Context, id string) error {
+	return e.communicator.RemoveForward(ctx, e.agentID, id)
+}
+
+// UploadFile streams src to the remote agent, which copies it into the VM
+func (e *RemoteVMExecutor) UploadFile(ctx context.Context, vmName, destPath, filename string, src io.Reader) (*models.OperationResult, error) {
+	result, err := e.communicator.UploadFile(ctx, e.agentID, vmName, destPath, filename, src)
+	if err != nil {
+		return &models.OperationResult{
+			Success: false,
+			Message: err.Error(),
+		}, err
+	}
+
+	return result, nil
+}
+
+// DownloadFile streams srcPath out of a VM on the remote agent
+func (e *RemoteVMExecutor) DownloadFile(ctx context.Context, vmName, srcPath string) (io.ReadCloser, error) {
+	return e.communicator.DownloadFile(ctx, e.agentID, vmName, srcPath)
+}
+
+// ExecInVM runs a command inside a VM on the remote agent
+func (e *RemoteVMExecutor) ExecInVM(ctx context.Context, req models.VMExecRequest) models.RemoteCommandResponse {
+	return e.communicator.ExecInVM(ctx, e.agentID, req)
+}
+
+// ExecInVMStream runs a command inside a VM on the remote agent, relaying its
+// output line by line as the agent streams it back
+func (e *RemoteVMExecutor) ExecInVMStream(ctx context.Context, req models.VMExecRequest, output io.Writer) models.RemoteCommandResponse {
+	return e.communicator.ExecInVMStream(ctx, e.agentID, req, output)
+}
+
+// ListBlueprints lists the blueprints available on the remote agent
+func (e *RemoteVMExecutor) ListBlueprints(ctx context.Context) ([]models.Blueprint, error) {
+	return e.communicator.ListBlueprints(ctx, e.agentID)
+}
+
+// ListNetworks lists the interfaces VMs on the remote agent can be bridged onto
+func (e *RemoteVMExecutor) ListNetworks(ctx context.Context) ([]models.Network, error) {
+	return e.communicator.ListNetworks(ctx, e.agentID)
+}
+
+// GetSettings reads the multipass daemon settings of the remote agent's host
+func (e *RemoteVMExecutor) GetSettings(ctx context.Context, keys []string) (map[string]string, error) {
+	return e.communicator.GetSettings(ctx, e.agentID, keys)
+}
+
+// SetSettings changes the multipass daemon settings of the remote agent's host
+func (e *RemoteVMExecutor) SetSettings(ctx context.Context, settings map[string]string) error {
+	return e.communicator.SetSettings(ctx, e.agentID, settings)
+}
+
+// GetVersion asks the remote agent for its multipass version
+func (e *RemoteVMExecutor) GetVersion(ctx context.Context) (*models.HostVersion, error) {
+	return e.communicator.GetVersion(ctx, e.agentID)
+}
+
+// GetStorage asks the remote agent how much disk multipass uses on its host
+func (e *RemoteVMExecutor) GetStorage(ctx context.Context) (*models.HostStorage, error) {
+	return e.communicator.GetStorage(ctx, e.agentID)
+}
+
+// PruneHost has the remote agent reclaim multipass disk space on its host
+func (e *RemoteVMExecutor) PruneHost(ctx context.Context) (*models.HostPruneResult, error) {
+	return e.communicator.PruneHost(ctx, e.agentID)
+}
+
+// GetUsage asks the remote agent how much of their resources its VMs use
+func (e *RemoteVMExecutor) GetUsage(ctx context.Context) (map[string]models.VMInfoExtended, error) {
+	return e.communicator.GetUsage(ctx, e.agentID)
+}
+
 // GetLocationInfo gets location information for remote executor
 func (e *RemoteVMExecutor) GetLocationInfo() map[string]interface{} {
-	agent := agents.GlobalRegistry.GetAgent(e.agentID)
+	agent := e.registry.GetAgent(e.agentID)
 	hostname := "unknown"
 	if agent != nil {
 		hostname = agent.Hostname
@@ -272,28 +635,279 @@ func (e *RemoteVMExecutor) GetLocationInfo() map[string]interface{} {
 	}
 }
 
+// errLocalUnavailable is returned by every operation of the unavailable executor
+var errLocalUnavailable = errors.New("multipass is not installed on the master; specify an agent_id")
+
+// UnavailableVMExecutor stands in for the local executor when multipass is absent
+// on the master, so local requests fail fast with a clear message
+type UnavailableVMExecutor struct{}
+
+func (e *UnavailableVMExecutor) failure() (*models.OperationResult, error) {
+	return &models.OperationResult{
+		Success: false,
+		Message: errLocalUnavailable.Error(),
+	}, errLocalUnavailable
+}
+
+// ListVMs always fails because there is no local multipass
+func (e *UnavailableVMExecutor) ListVMs(ctx context.Context) (*models.VMList, error) {
+	return nil, errLocalUnavailable
+}
+
+// GetVMInfo always fails because there is no local multipass
+func (e *UnavailableVMExecutor) GetVMInfo(ctx context.Context, vmName string) (*models.VMDetail, error) {
+	return nil, errLocalUnavailable
+}
+
+// CreateVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) CreateVM(ctx context.Context, req models.VMCreateRequest) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// CreateVMWithProgress always fails because there is no local multipass
+func (e *UnavailableVMExecutor) CreateVMWithProgress(ctx context.Context, req models.VMCreateRequest, progress func(models.LaunchProgress)) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// StartVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) StartVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// StopVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) StopVM(ctx context.Context, vmName string, delayMinutes int) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// CancelStopVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) CancelStopVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// SuspendVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) SuspendVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// ResumeVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) ResumeVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// RestartVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) RestartVM(ctx context.Context, vmName string, force bool) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// DeleteVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) DeleteVM(ctx context.Context, vmName string, softDelete bool) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// RecoverVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) RecoverVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// PurgeVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) PurgeVM(ctx context.Context, vmName string) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// ResizeVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) ResizeVM(ctx context.Context, req models.VMResizeRequest) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// CloneVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) CloneVM(ctx context.Context, req models.VMCloneRequest) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// MountVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) MountVM(ctx context.Context, vmName, source, target string) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// UnmountVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) UnmountVM(ctx context.Context, vmName, target string) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// ListMounts always fails because there is no local multipass
+func (e *UnavailableVMExecutor) ListMounts(ctx context.Context, vmName string) ([]models.VMMount, error) {
+	return nil, errLocalUnavailable
+}
+
+// ForwardPort always fails because there is no local multipass
+func (e *UnavailableVMExecutor) ForwardPort(ctx context.Context, req models.PortForwardRequest) (*models.PortForward, error) {
+	return nil, errLocalUnavailable
+}
+
+// ListForwards always fails because there is no local multipass
+func (e *UnavailableVMExecutor) ListForwards(ctx context.Context) ([]models.PortForward, error) {
+	return nil, errLocalUnavailable
+}
+
+// RemoveForward always fails because there is no local multipass
+func (e *UnavailableVMExecutor) RemoveForward(ctx context.Context, id string) error {
+	return errLocalUnavailable
+}
+
+// UploadFile always fails because there is no local multipass
+func (e *UnavailableVMExecutor) UploadFile(ctx context.Context, vmName, destPath, filename string, src io.Reader) (*models.OperationResult, error) {
+	return e.failure()
+}
+
+// DownloadFile always fails because there is no local multipass
+func (e *UnavailableVMExecutor) DownloadFile(ctx context.Context, vmName, srcPath string) (io.ReadCloser, error) {
+	return nil, errLocalUnavailable
+}
+
+// ExecInVM always fails because there is no local multipass
+func (e *UnavailableVMExecutor) ExecInVM(ctx context.Context, req models.VMExecRequest) models.RemoteCommandResponse {
+	errMsg := errLocalUnavailable.Error()
+	return models.RemoteCommandResponse{
+		Success:    false,
+		ReturnCode: -1,
+		Error:      &errMsg,
+	}
+}
+
+// ExecInVMStream always fails because there is no local multipass
+func (e *UnavailableVMExecutor) ExecInVMStream(ctx context.Context, req models.VMExecRequest, output io.Writer) models.RemoteCommandResponse {
+	return e.ExecInVM(ctx, req)
+}
+
+// ListBlueprints always fails because there is no local multipass
+func (e *UnavailableVMExecutor) ListBlueprints(ctx context.Context) ([]models.Blueprint, error) {
+	return nil, errLocalUnavailable
+}
+
+// ListNetworks always fails because there is no local multipass
+func (e *UnavailableVMExecutor) ListNetworks(ctx context.Context) ([]models.Network, error) {
+	return nil, errLocalUnavailable
+}
+
+// GetSettings always fails because there is no local multipass
+func (e *UnavailableVMExecutor) GetSettings(ctx context.Context, keys []string) (map[string]string, error) {
+	return nil, errLocalUnavailable
+}
+
+// SetSettings always fails because there is no local multipass
+func (e *UnavailableVMExecutor) SetSettings(ctx context.Context, settings map[string]string) error {
+	return errLocalUnavailable
+}
+
+// GetVersion always fails because there is no local multipass
+func (e *UnavailableVMExecutor) GetVersion(ctx context.Context) (*models.HostVersion, error) {
+	return nil, errLocalUnavailable
+}
+
+// GetUsage always fails because there is no local multipass
+func (e *UnavailableVMExecutor) GetUsage(ctx context.Context) (map[string]models.VMInfoExtended, error) {
+	return nil, errLocalUnavailable
+}
+
+// GetStorage always fails because there is no local multipass
+func (e *UnavailableVMExecutor) GetStorage(ctx context.Context) (*models.HostStorage, error) {
+	return nil, errLocalUnavailable
+}
+
+// PruneHost always fails because there is no local multipass
+func (e *UnavailableVMExecutor) PruneHost(ctx context.Context) (*models.HostPruneResult, error) {
+	return nil, errLocalUnavailable
+}
+
+// GetLocationInfo gets location information for the unavailable executor
+func (e *UnavailableVMExecutor) GetLocationInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"type":           "unavailable",
+		"agent_id":       nil,
+		"agent_hostname": nil,
+	}
+}
+
 // ExecutorFactory creates appropriate VM executors
 type ExecutorFactory struct {
-	communicator *communication.AgentCommunicator
+	registry     *agents.AgentRegistry
+	communicator communication.AgentCommunicator
+	transports   map[string]communication.AgentCommunicator
+	events       *bus.Bus
+	inventory    *inventory.Cache
+	runner       *multipass.Runner
+	forwards     *forward.Manager
+	localEnabled bool
 }
 
-// NewExecutorFactory creates a new executor factory
-func NewExecutorFactory(communicator *communication.AgentCommunicator) *ExecutorFactory {
+// NewExecutorFactory creates a new executor factory for the agents in registry,
+// reaching them through communicator unless they ask for another transport.
+// Successful VM operations are published to events, and VM listings are
+// cached in cache. VMs on this host are managed through runner, and their
+// ports are forwarded through forwards.
+func NewExecutorFactory(registry *agents.AgentRegistry, communicator communication.AgentCommunicator, events *bus.Bus, cache *inventory.Cache, runner *multipass.Runner, forwards *forward.Manager) *ExecutorFactory {
 	return &ExecutorFactory{
+		registry:     registry,
 		communicator: communicator,
+		transports:   make(map[string]communication.AgentCommunicator),
+		events:       events,
+		inventory:    cache,
+		runner:       runner,
+		forwards:     forwards,
+		localEnabled: true,
 	}
 }
 
+// RegisterTransport makes communicator the transport for agents that
+// register with transport name. It should be called at startup.
+func (f *ExecutorFactory) RegisterTransport(name string, communicator communication.AgentCommunicator) {
+	f.transports[name] = communicator
+}
+
+// Communicator gets the transport an agent is reached through: the one
+// registered under the agent's transport name, or the default
+func (f *ExecutorFactory) Communicator(agentID string) communication.AgentCommunicator {
+	agent := f.registry.GetAgent(agentID)
+	if agent == nil || agent.Transport == "" {
+		return f.communicator
+	}
+	if communicator, ok := f.transports[agent.Transport]; ok {
+		return communicator
+	}
+	logger.Warn("Agent asked for an unknown transport; using the default", "agent_id", agentID, "transport", agent.Transport)
+	return f.communicator
+}
+
+// DetectLocal checks whether multipass is installed on this host and disables
+// the local executor if it is not. It should be called once at startup.
+func (f *ExecutorFactory) DetectLocal() bool {
+	f.localEnabled = multipass.IsInstalled()
+	if !f.localEnabled {
+		logger.Warn("multipass not found on this host; local executor disabled, VMs will be scheduled to agents")
+	}
+	return f.localEnabled
+}
+
+// LocalEnabled reports whether VMs can be managed on the master host itself
+func (f *ExecutorFactory) LocalEnabled() bool {
+	return f.localEnabled
+}
+
 // GetExecutor gets an appropriate executor based on agent_id
 func (f *ExecutorFactory) GetExecutor(agentID *string) VMExecutor {
 	if agentID == nil {
-		log.Println("Creating local VM executor")
-		return NewLocalVMExecutor()
+		if !f.localEnabled {
+			return &UnavailableVMExecutor{}
+		}
+		logger.Debug("Creating local VM executor")
+		return f.decorate(NewLocalVMExecutor(f.runner, f.forwards), nil)
 	}
 
-	log.Printf("Creating remote VM executor for agent: %s", *agentID)
-	return NewRemoteVMExecutor(*agentID, f.communicator)
+	logger.Debug("Creating remote VM executor", "agent_id", *agentID)
+	return f.decorate(NewRemoteVMExecutor(*agentID, f.registry, f.Communicator(*agentID)), agentID)
 }
 
-// GlobalExecutorFactory is the global executor factory instance
-var GlobalExecutorFactory = NewExecutorFactory(communication.GlobalCommunicator)
+// decorate adds event recording and inventory caching to an executor
+func (f *ExecutorFactory) decorate(inner VMExecutor, agentID *string) VMExecutor {
+	return newCachedExecutor(newEventExecutor(inner, agentID, f.events), agentID, f.inventory)
+}
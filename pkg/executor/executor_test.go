@@ -0,0 +1,43 @@
+package executor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prashah/batwa/pkg/multipass"
+)
+
+// TestLocalVMExecutorRefusesOptionNames checks that a VM name multipass would
+// read as an option, such as --all, never reaches multipass
+func TestLocalVMExecutorRefusesOptionNames(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "multipass"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	ctx := context.Background()
+	e := NewLocalVMExecutor(multipass.NewRunner(nil), nil)
+	for _, name := range []string{"--all", "-h"} {
+		operations := map[string]func() (bool, error){
+			"delete":  func() (bool, error) { r, err := e.DeleteVM(ctx, name, false); return r.Success, err },
+			"purge":   func() (bool, error) { r, err := e.PurgeVM(ctx, name); return r.Success, err },
+			"stop":    func() (bool, error) { r, err := e.StopVM(ctx, name, 0); return r.Success, err },
+			"start":   func() (bool, error) { r, err := e.StartVM(ctx, name); return r.Success, err },
+			"restart": func() (bool, error) { r, err := e.RestartVM(ctx, name, false); return r.Success, err },
+		}
+		for operation, run := range operations {
+			if success, err := run(); success || err != nil {
+				t.Errorf("%s %q: success %v, error %v; want a failed result", operation, name, success, err)
+			}
+		}
+	}
+
+	if data, _ := os.ReadFile(calls); len(data) > 0 {
+		t.Errorf("multipass was run with an option as the VM name:\n%s", data)
+	}
+}
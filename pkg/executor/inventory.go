@@ -0,0 +1,176 @@
+package executor
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/inventory"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// hostQueryTimeout reads HOST_QUERY_TIMEOUT_SECONDS, the longest a fleet-wide
+// listing waits for any one host, defaulting to 10 seconds
+func hostQueryTimeout() time.Duration {
+	if value, err := strconv.Atoi(os.Getenv("HOST_QUERY_TIMEOUT_SECONDS")); err == nil && value > 0 {
+		return time.Duration(value) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// queryHosts calls query for the master (when multipass is available) and for
+// every online agent at once, each under its own timeout, and returns the
+// hosts in a stable order, master first, once every call has returned. query
+// gets a nil agentID for the master.
+func (f *ExecutorFactory) queryHosts(ctx context.Context, query func(ctx context.Context, host *models.HostListing, exec VMExecutor)) []*models.HostListing {
+	hosts := []*models.HostListing{}
+	if f.LocalEnabled() {
+		hosts = append(hosts, &models.HostListing{Hostname: "local"})
+	}
+	agents := f.registry.GetOnlineAgents()
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].AgentID < agents[j].AgentID
+	})
+	for _, agent := range agents {
+		agentID := agent.AgentID
+		hosts = append(hosts, &models.HostListing{AgentID: &agentID, Hostname: agent.Hostname})
+	}
+
+	timeout := hostQueryTimeout()
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host *models.HostListing) {
+			defer wg.Done()
+			hostCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			query(hostCtx, host, f.GetExecutor(host.AgentID))
+		}(host)
+	}
+	wg.Wait()
+	return hosts
+}
+
+// ListAllVMs lists VMs on the master (when multipass is available) and on every
+// online agent, annotating each with its location. Hosts that fail to answer
+// are left out.
+func (f *ExecutorFactory) ListAllVMs(ctx context.Context) []models.VMInfoExtended {
+	vms, _ := f.ListAllVMsByHost(ctx, false)
+	return vms
+}
+
+// ListAllVMsByHost lists VMs like ListAllVMs, querying every host at once, and
+// also reports each host queried: how many VMs it has, or why it could not be
+// listed. A slow host holds the listing up for at most the host query timeout.
+//
+// Hosts with a last known listing in the inventory cache are answered from it
+// at once; stale listings are refreshed in the background for the next call.
+// refresh skips the cache and queries every host live.
+func (f *ExecutorFactory) ListAllVMsByHost(ctx context.Context, refresh bool) ([]models.VMInfoExtended, []models.HostListing) {
+	lists := make(map[*models.HostListing][]models.VMInfoExtended)
+	var mutex sync.Mutex
+
+	hosts := f.queryHosts(ctx, func(ctx context.Context, host *models.HostListing, exec VMExecutor) {
+		key := inventory.Key(host.AgentID)
+		if refresh {
+			f.inventory.Invalidate(key)
+		}
+
+		list, fetchedAt, fresh, cached := f.inventory.Last(key)
+		if cached {
+			host.CachedAt = &fetchedAt
+			host.Stale = !fresh
+			if !fresh {
+				go f.refreshHost(host.AgentID, exec)
+			}
+		} else {
+			var err error
+			if list, err = exec.ListVMs(ctx); err != nil {
+				host.Error = err.Error()
+				return
+			}
+		}
+
+		host.VMCount = len(list.VMs)
+		mutex.Lock()
+		lists[host] = list.VMs
+		mutex.Unlock()
+	})
+
+	allVMs := []models.VMInfoExtended{}
+	listings := make([]models.HostListing, 0, len(hosts))
+	for _, host := range hosts {
+		hostname := host.Hostname
+		for _, vm := range lists[host] {
+			vm.AgentID = host.AgentID
+			vm.AgentHostname = &hostname
+			allVMs = append(allVMs, vm)
+		}
+		listings = append(listings, *host)
+	}
+	return allVMs, listings
+}
+
+// refreshHost lists a host's VMs again so its stale cached listing is
+// replaced. At most one refresh per host runs at a time; failures leave the
+// stale listing in place.
+func (f *ExecutorFactory) refreshHost(agentID *string, exec VMExecutor) {
+	key := inventory.Key(agentID)
+	if !f.inventory.BeginRefresh(key) {
+		return
+	}
+	defer f.inventory.EndRefresh(key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), hostQueryTimeout())
+	defer cancel()
+	if _, err := exec.ListVMs(ctx); err != nil {
+		logger.Warn("Failed to refresh VM inventory", "host", describeHost(agentID), "error", err)
+	}
+}
+
+// describeHost names a host in log messages
+func describeHost(agentID *string) string {
+	if agentID == nil {
+		return "the master"
+	}
+	return "agent " + *agentID
+}
+
+// UsageKey identifies a VM in the map UsageByVM returns; agentID is empty for
+// VMs on the master
+func UsageKey(agentID, vmName string) string {
+	return agentID + "/" + vmName
+}
+
+// UsageByVM gathers CPU, load, disk and memory usage from the master and
+// every online agent at once. Hosts that fail to report in time, such as
+// agents too old to serve usage, are left out. Reports still fresh in the
+// inventory cache are reused unless refresh is set.
+func (f *ExecutorFactory) UsageByVM(ctx context.Context, refresh bool) map[string]models.VMInfoExtended {
+	usage := make(map[string]models.VMInfoExtended)
+	var mutex sync.Mutex
+
+	f.queryHosts(ctx, func(ctx context.Context, host *models.HostListing, exec VMExecutor) {
+		if refresh {
+			f.inventory.Invalidate(inventory.Key(host.AgentID))
+		}
+		hostUsage, err := exec.GetUsage(ctx)
+		if err != nil {
+			return
+		}
+		agentID := ""
+		if host.AgentID != nil {
+			agentID = *host.AgentID
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		for name, vm := range hostUsage {
+			usage[UsageKey(agentID, name)] = vm
+		}
+	})
+
+	return usage
+}
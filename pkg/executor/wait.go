@@ -0,0 +1,45 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// statePollInterval is how often WaitForState looks the VM up
+const statePollInterval = time.Second
+
+// WaitForState polls a VM's info until it reports state or timeout passes,
+// and returns the last state seen. The error says why the VM is not in state;
+// lookups that fail along the way are retried until the timeout.
+func WaitForState(ctx context.Context, exec VMExecutor, vmName, state string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(statePollInterval)
+	defer ticker.Stop()
+
+	current := ""
+	var lookupErr error
+	for {
+		detail, err := exec.GetVMInfo(ctx, vmName)
+		if err == nil {
+			current, lookupErr = detail.State, nil
+			if strings.EqualFold(current, state) {
+				return current, nil
+			}
+		} else {
+			lookupErr = err
+		}
+
+		select {
+		case <-ctx.Done():
+			if lookupErr != nil {
+				return current, fmt.Errorf("could not check whether VM '%s' is %s: %w", vmName, state, lookupErr)
+			}
+			return current, fmt.Errorf("VM '%s' is %s, not %s, after %s", vmName, current, state, timeout)
+		case <-ticker.C:
+		}
+	}
+}
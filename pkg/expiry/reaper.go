@@ -0,0 +1,231 @@
+package expiry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/bus"
+	"github.com/prashah/batwa/pkg/executor"
+	"github.com/prashah/batwa/pkg/locks"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/maintenance"
+	"github.com/prashah/batwa/pkg/metadata"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/notifications"
+)
+
+var logger = logging.For("expiry")
+
+// Expiry actions
+const (
+	ActionStop   = "stop"
+	ActionDelete = "delete"
+)
+
+// Resolve works out when a VM expires from a TTL such as "8h" or an absolute
+// time, and validates the action to take. It returns a nil time when neither
+// is set. The action defaults to delete.
+func Resolve(ttl string, expiresAt *time.Time, action string, now time.Time) (*time.Time, string, error) {
+	if action == "" {
+		action = ActionDelete
+	}
+	if action != ActionStop && action != ActionDelete {
+		return nil, "", fmt.Errorf("expiry_action must be '%s' or '%s'", ActionStop, ActionDelete)
+	}
+
+	switch {
+	case ttl != "" && expiresAt != nil:
+		return nil, "", errors.New("set either ttl or expires_at, not both")
+	case ttl != "":
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			return nil, "", fmt.Errorf("invalid ttl '%s': use a positive duration such as 30m or 8h", ttl)
+		}
+		at := now.Add(duration)
+		return &at, action, nil
+	case expiresAt != nil:
+		if !expiresAt.After(now) {
+			return nil, "", errors.New("expires_at must be in the future")
+		}
+		return expiresAt, action, nil
+	}
+	return nil, action, nil
+}
+
+// Reaper stops or deletes VMs whose expiry time recorded in the metadata
+// store has passed
+type Reaper struct {
+	registry      *agents.AgentRegistry
+	executors     *executor.ExecutorFactory
+	maintenance   *maintenance.Scheduler
+	events        *bus.Bus
+	metadata      *metadata.Store
+	locks         *locks.VMLockManager
+	notifier      *notifications.Notifier
+	checkInterval time.Duration
+	cancelFunc    context.CancelFunc
+}
+
+// NewReaper creates a reaper acting through executors on the VMs whose
+// expiry is recorded in store, taking their locks from vmLocks and telling
+// their owners through notifier. VMs on agents that are offline or in a
+// maintenance window are left until a later pass.
+func NewReaper(registry *agents.AgentRegistry, executors *executor.ExecutorFactory, windows *maintenance.Scheduler, events *bus.Bus,
+	store *metadata.Store, vmLocks *locks.VMLockManager, notifier *notifications.Notifier) *Reaper {
+	return &Reaper{
+		registry:      registry,
+		executors:     executors,
+		maintenance:   windows,
+		events:        events,
+		metadata:      store,
+		locks:         vmLocks,
+		notifier:      notifier,
+		checkInterval: time.Minute,
+	}
+}
+
+// Start starts the reaper loop
+func (r *Reaper) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancelFunc = cancel
+
+	go r.reapLoop(ctx)
+	logger.Info("Started VM expiry reaper")
+}
+
+// Stop stops the reaper loop
+func (r *Reaper) Stop() {
+	if r.cancelFunc != nil {
+		r.cancelFunc()
+		logger.Info("Stopped VM expiry reaper")
+	}
+}
+
+// reapLoop periodically expires VMs
+func (r *Reaper) reapLoop(ctx context.Context) {
+	ticker := time.NewTicker(r.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Reap(time.Now())
+		}
+	}
+}
+
+// Reap applies the expiry action to every VM that expired before now
+func (r *Reaper) Reap(now time.Time) {
+	for _, meta := range r.metadata.List(nil) {
+		if meta.ExpiresAt == nil || meta.ExpiresAt.After(now) {
+			continue
+		}
+		if meta.AgentID == "" && !r.executors.LocalEnabled() {
+			continue
+		}
+		if meta.AgentID != "" {
+			agent := r.registry.GetAgent(meta.AgentID)
+			if agent == nil || agent.Status != "online" || r.maintenance.InMaintenance(agent) {
+				continue
+			}
+		}
+		r.expire(meta)
+	}
+}
+
+// expire stops or deletes one expired VM and records what was done
+func (r *Reaper) expire(meta *models.VMMetadata) {
+	var agentID *string
+	if meta.AgentID != "" {
+		id := meta.AgentID
+		agentID = &id
+	}
+	action := meta.ExpiryAction
+	if action == "" {
+		action = ActionDelete
+	}
+
+	// A VM busy with another operation is retried on the next pass
+	unlock, err := r.locks.TryLock(agentID, meta.Name, "expire")
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	exec := r.executors.GetExecutor(agentID)
+	var result *models.OperationResult
+	if action == ActionStop {
+		result, err = exec.StopVM(context.Background(), meta.Name, 0)
+	} else {
+		result, err = exec.DeleteVM(context.Background(), meta.Name, false)
+	}
+	if err != nil || !result.Success {
+		message := ""
+		if err != nil {
+			message = err.Error()
+		} else {
+			message = result.Message
+		}
+		logger.Error("Failed to reap expired VM", "action", action, "vm", meta.Name, "agent_id", meta.AgentID, "error", message)
+		return
+	}
+
+	expiredAt := meta.ExpiresAt.Format(time.RFC3339)
+	if action == ActionStop {
+		r.metadata.Update(meta.AgentID, meta.Name, func(m *models.VMMetadata) {
+			m.ExpiresAt = nil
+		})
+	} else {
+		r.metadata.Delete(meta.AgentID, meta.Name)
+	}
+
+	r.events.Publish(models.Event{
+		Type:    "vm.expired",
+		AgentID: meta.AgentID,
+		VMName:  meta.Name,
+		Data:    map[string]string{"action": action, "expires_at": expiredAt},
+	})
+	logger.Info("VM expired", "vm", meta.Name, "agent_id", meta.AgentID, "expired_at", expiredAt, "action", action)
+
+	if meta.Owner != "" {
+		r.notifier.Notify(meta.Owner, "expiry",
+			fmt.Sprintf("VM '%s' expired", meta.Name),
+			fmt.Sprintf("VM '%s' reached its expiry time (%s) and was %s.", meta.Name, expiredAt, pastTense(action)))
+	}
+}
+
+// pastTense describes an expiry action that has been carried out
+func pastTense(action string) string {
+	if action == ActionStop {
+		return "stopped"
+	}
+	return "deleted"
+}
+
+// CollectExpiring is a digest collector listing VMs that expire within a day
+func (r *Reaper) CollectExpiring(now time.Time) []models.DigestItem {
+	items := []models.DigestItem{}
+	for _, meta := range r.metadata.List(nil) {
+		if meta.ExpiresAt == nil || meta.ExpiresAt.Sub(now) > 24*time.Hour {
+			continue
+		}
+		action := meta.ExpiryAction
+		if action == "" {
+			action = ActionDelete
+		}
+		items = append(items, models.DigestItem{
+			Kind:    "expiring_vm",
+			AgentID: meta.AgentID,
+			VMName:  meta.Name,
+			Owner:   meta.Owner,
+			Project: meta.Project,
+			Detail:  fmt.Sprintf("Will be %s at %s", pastTense(action), meta.ExpiresAt.Format(time.RFC1123)),
+		})
+	}
+	return items
+}
@@ -0,0 +1,283 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/multipass"
+)
+
+var logger = logging.For("forward")
+
+// Default host port range for forwards, kept clear of well-known ports and of
+// the ports the master and agents listen on
+const (
+	defaultMinPort = 20000
+	defaultMaxPort = 29999
+)
+
+// dialTimeout bounds connecting to the guest for each forwarded connection
+const dialTimeout = 10 * time.Second
+
+// forwarder is one listening forward and the connections it is proxying
+type forwarder struct {
+	info     models.PortForward
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	mutex    sync.Mutex
+}
+
+// Manager runs TCP forwards from ports of this host to ports in its VMs.
+// Forwards live as long as the process; they are not persisted.
+type Manager struct {
+	runner      *multipass.Runner
+	bindAddress string
+	minPort     int
+	maxPort     int
+	forwards    map[string]*forwarder
+	mutex       sync.Mutex
+}
+
+// NewManager creates a manager that listens on bindAddress at ports between
+// minPort and maxPort, looking VMs up through runner
+func NewManager(runner *multipass.Runner, bindAddress string, minPort, maxPort int) *Manager {
+	return &Manager{
+		runner:      runner,
+		bindAddress: bindAddress,
+		minPort:     minPort,
+		maxPort:     maxPort,
+		forwards:    make(map[string]*forwarder),
+	}
+}
+
+// NewManagerFromEnv creates a manager listening on PORT_FORWARD_BIND (default
+// 0.0.0.0) at ports in PORT_FORWARD_RANGE (default 20000-29999)
+func NewManagerFromEnv(runner *multipass.Runner) *Manager {
+	bindAddress := os.Getenv("PORT_FORWARD_BIND")
+	if bindAddress == "" {
+		bindAddress = "0.0.0.0"
+	}
+	minPort, maxPort := defaultMinPort, defaultMaxPort
+	if value := os.Getenv("PORT_FORWARD_RANGE"); value != "" {
+		low, high, _ := strings.Cut(value, "-")
+		lowPort, errLow := strconv.Atoi(strings.TrimSpace(low))
+		highPort, errHigh := strconv.Atoi(strings.TrimSpace(high))
+		if errLow == nil && errHigh == nil && lowPort > 0 && lowPort <= highPort && highPort <= 65535 {
+			minPort, maxPort = lowPort, highPort
+		} else {
+			logger.Warn("Ignoring invalid PORT_FORWARD_RANGE", "value", value)
+		}
+	}
+	return NewManager(runner, bindAddress, minPort, maxPort)
+}
+
+// Forward starts forwarding a host port to a port of a VM on this host. The
+// VM must be running, since its address is looked up now.
+func (m *Manager) Forward(ctx context.Context, req models.PortForwardRequest) (*models.PortForward, error) {
+	if req.GuestPort < 1 || req.GuestPort > 65535 {
+		return nil, fmt.Errorf("guest_port must be between 1 and 65535")
+	}
+	if req.HostPort != 0 && (req.HostPort < m.minPort || req.HostPort > m.maxPort) {
+		return nil, fmt.Errorf("host_port must be between %d and %d", m.minPort, m.maxPort)
+	}
+
+	detail, err := m.runner.Info(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(detail.IPv4) == 0 {
+		return nil, fmt.Errorf("VM '%s' has no IPv4 address; is it running?", req.Name)
+	}
+
+	listener, err := m.listen(req.HostPort)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &forwarder{
+		info: models.PortForward{
+			ID:          uuid.NewString(),
+			VMName:      req.Name,
+			HostAddress: m.bindAddress,
+			HostPort:    listener.Addr().(*net.TCPAddr).Port,
+			GuestIP:     detail.IPv4[0],
+			GuestPort:   req.GuestPort,
+			CreatedBy:   req.CreatedBy,
+			CreatedAt:   time.Now(),
+		},
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	m.mutex.Lock()
+	m.forwards[f.info.ID] = f
+	m.mutex.Unlock()
+
+	logger.Info("Forwarding port", "bind", m.bindAddress, "host_port", f.info.HostPort, "vm", req.Name, "guest_ip", f.info.GuestIP, "guest_port", req.GuestPort)
+	go f.serve()
+
+	info := f.snapshot()
+	return &info, nil
+}
+
+// listen opens the requested port, or the first free one in range for port 0
+func (m *Manager) listen(port int) (net.Listener, error) {
+	if port != 0 {
+		listener, err := net.Listen("tcp", net.JoinHostPort(m.bindAddress, strconv.Itoa(port)))
+		if err != nil {
+			return nil, fmt.Errorf("host port %d is not available: %w", port, err)
+		}
+		return listener, nil
+	}
+	for candidate := m.minPort; candidate <= m.maxPort; candidate++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(m.bindAddress, strconv.Itoa(candidate)))
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("no free host port between %d and %d", m.minPort, m.maxPort)
+}
+
+// List lists the running forwards, oldest first
+func (m *Manager) List() []models.PortForward {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	forwards := make([]models.PortForward, 0, len(m.forwards))
+	for _, f := range m.forwards {
+		forwards = append(forwards, f.snapshot())
+	}
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].CreatedAt.Before(forwards[j].CreatedAt)
+	})
+	return forwards
+}
+
+// Remove stops a forward and closes its open connections
+func (m *Manager) Remove(id string) bool {
+	m.mutex.Lock()
+	f, exists := m.forwards[id]
+	delete(m.forwards, id)
+	m.mutex.Unlock()
+
+	if exists {
+		f.close()
+	}
+	return exists
+}
+
+// RemoveVM stops every forward to a VM, returning how many there were
+func (m *Manager) RemoveVM(vmName string) int {
+	m.mutex.Lock()
+	removed := []*forwarder{}
+	for id, f := range m.forwards {
+		if f.info.VMName == vmName {
+			removed = append(removed, f)
+			delete(m.forwards, id)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, f := range removed {
+		f.close()
+	}
+	return len(removed)
+}
+
+// snapshot copies the forward's description with its current connection count
+func (f *forwarder) snapshot() models.PortForward {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	info := f.info
+	// Each proxied connection tracks the client and the guest side
+	info.ActiveConnections = len(f.conns) / 2
+	return info
+}
+
+// serve accepts connections until the listener is closed
+func (f *forwarder) serve() {
+	target := net.JoinHostPort(f.info.GuestIP, strconv.Itoa(f.info.GuestPort))
+	for {
+		client, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.proxy(client, target)
+	}
+}
+
+// proxy copies data both ways between a client and the guest until either
+// side closes
+func (f *forwarder) proxy(client net.Conn, target string) {
+	guest, err := net.DialTimeout("tcp", target, dialTimeout)
+	if err != nil {
+		logger.Warn("Port forward failed", "vm", f.info.VMName, "target", target, "error", err)
+		client.Close()
+		return
+	}
+	if !f.track(client, guest) {
+		client.Close()
+		guest.Close()
+		return
+	}
+	defer f.untrack(client, guest)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go pipe(guest, client)
+	go pipe(client, guest)
+	<-done
+	client.Close()
+	guest.Close()
+	<-done
+}
+
+// track registers a connection pair, failing once the forward is closed
+func (f *forwarder) track(conns ...net.Conn) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.conns == nil {
+		return false
+	}
+	for _, conn := range conns {
+		f.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (f *forwarder) untrack(conns ...net.Conn) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, conn := range conns {
+		delete(f.conns, conn)
+	}
+}
+
+// close stops listening and drops every proxied connection
+func (f *forwarder) close() {
+	f.listener.Close()
+
+	f.mutex.Lock()
+	conns := f.conns
+	f.conns = nil
+	f.mutex.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+	logger.Info("Stopped forwarding port", "host_port", f.info.HostPort, "vm", f.info.VMName)
+}
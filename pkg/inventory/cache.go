@@ -0,0 +1,172 @@
+package inventory
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// entry is one cached VM listing; stale entries are kept as the last known
+// listing but no longer count as fresh
+type entry struct {
+	result    *models.VMList
+	fetchedAt time.Time
+	stale     bool
+}
+
+// usageEntry is one cached usage report
+type usageEntry struct {
+	usage     map[string]models.VMInfoExtended
+	fetchedAt time.Time
+}
+
+// Cache keeps the most recent VM listing of each location. Listings are fresh
+// for a short TTL; after that they are still served as the last known listing
+// while a refresh runs. Locations are keyed by agent ID; the master itself
+// uses an empty key.
+type Cache struct {
+	entries    map[string]entry
+	usage      map[string]usageEntry
+	refreshing map[string]bool
+	ttl        time.Duration
+	mutex      sync.RWMutex
+}
+
+// NewCache creates a new inventory cache
+func NewCache(ttl time.Duration) *Cache {
+	return &Cache{
+		entries:    make(map[string]entry),
+		usage:      make(map[string]usageEntry),
+		refreshing: make(map[string]bool),
+		ttl:        ttl,
+	}
+}
+
+// Key builds the cache key for a location (nil agentID means local)
+func Key(agentID *string) string {
+	if agentID == nil {
+		return ""
+	}
+	return *agentID
+}
+
+// Get gets the cached listing of a location if it is still fresh
+func (c *Cache) Get(key string) (*models.VMList, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	cached, exists := c.entries[key]
+	if !exists || !c.fresh(cached) {
+		return nil, false
+	}
+	return cached.result, true
+}
+
+// Last gets the last known listing of a location however old it is, when it
+// was fetched, and whether it is still fresh. Nothing is returned when the
+// cache is disabled.
+func (c *Cache) Last(key string) (*models.VMList, time.Time, bool, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	cached, exists := c.entries[key]
+	if !exists || c.ttl == 0 {
+		return nil, time.Time{}, false, false
+	}
+	return cached.result, cached.fetchedAt, c.fresh(cached), true
+}
+
+// fresh reports whether a listing can be served without a refresh
+func (c *Cache) fresh(cached entry) bool {
+	return !cached.stale && time.Since(cached.fetchedAt) <= c.ttl
+}
+
+// MarkStale keeps the listing of a location as its last known listing but
+// makes the next read refresh it
+func (c *Cache) MarkStale(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if cached, exists := c.entries[key]; exists {
+		cached.stale = true
+		c.entries[key] = cached
+	}
+}
+
+// BeginRefresh claims the background refresh of a location. It returns false
+// when a refresh is already running, so callers can skip starting another.
+func (c *Cache) BeginRefresh(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.refreshing[key] {
+		return false
+	}
+	c.refreshing[key] = true
+	return true
+}
+
+// EndRefresh releases a refresh claimed with BeginRefresh
+func (c *Cache) EndRefresh(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.refreshing, key)
+}
+
+// GetUsage gets the cached usage report of a location if it is still fresh
+func (c *Cache) GetUsage(key string) (map[string]models.VMInfoExtended, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	cached, exists := c.usage[key]
+	if !exists || time.Since(cached.fetchedAt) > c.ttl {
+		return nil, false
+	}
+	return cached.usage, true
+}
+
+// SetUsage stores the usage report of a location
+func (c *Cache) SetUsage(key string, usage map[string]models.VMInfoExtended) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.usage[key] = usageEntry{usage: usage, fetchedAt: time.Now()}
+}
+
+// Set stores the listing of a location
+func (c *Cache) Set(key string, result *models.VMList) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[key] = entry{result: result, fetchedAt: time.Now()}
+}
+
+// Invalidate drops the listing and usage of a location so the next read goes
+// live
+func (c *Cache) Invalidate(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, key)
+	delete(c.usage, key)
+}
+
+// InvalidateAll drops every cached listing and usage report
+func (c *Cache) InvalidateAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[string]entry)
+	c.usage = make(map[string]usageEntry)
+}
+
+// cacheTTL reads INVENTORY_CACHE_TTL_SECONDS, defaulting to 30 seconds
+func cacheTTL() time.Duration {
+	if value, err := strconv.Atoi(os.Getenv("INVENTORY_CACHE_TTL_SECONDS")); err == nil && value >= 0 {
+		return time.Duration(value) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// NewCacheFromEnv creates an inventory cache keeping listings for
+// INVENTORY_CACHE_TTL_SECONDS (default 30)
+func NewCacheFromEnv() *Cache {
+	return NewCache(cacheTTL())
+}
@@ -0,0 +1,30 @@
+package inventory
+
+import (
+	"github.com/prashah/batwa/pkg/metrics"
+)
+
+// RegisterMetrics exports the number of VMs in each state on each host, from
+// the last known listings, to a metrics registry. The master's VMs are
+// labelled with LocalAgent.
+func (c *Cache) RegisterMetrics(registry *metrics.Registry) {
+	registry.GaugeFunc(metrics.Namespace+"vms", "VMs by host and state, from the last known listing of each host",
+		[]string{"agent_id", "state"}, func() []metrics.Sample {
+			c.mutex.RLock()
+			defer c.mutex.RUnlock()
+			samples := []metrics.Sample{}
+			for key, cached := range c.entries {
+				if cached.result == nil {
+					continue
+				}
+				agentID := key
+				if agentID == "" {
+					agentID = LocalAgent
+				}
+				for _, vm := range cached.result.VMs {
+					samples = append(samples, metrics.Sample{Labels: []string{agentID, vm.State}, Value: 1})
+				}
+			}
+			return samples
+		})
+}
@@ -0,0 +1,268 @@
+package inventory
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// MaxLimit bounds the page size of a list query
+const MaxLimit = 1000
+
+// LocalAgent is the agent_id a query names the master's own VMs by
+const LocalAgent = "local"
+
+// VMSortFields are the fields VM lists can be sorted by
+var VMSortFields = []string{"name", "state", "agent_id", "owner", "project", "created_at", "expires_at"}
+
+// AgentSortFields are the fields agent lists can be sorted by
+var AgentSortFields = []string{"agent_id", "hostname", "status", "zone", "vm_count", "last_seen"}
+
+// Query filters, sorts and pages a VM or agent list. Filters left empty keep
+// every entry; States and AgentIDs keep entries matching any of theirs.
+type Query struct {
+	// States are VM states such as Running, or agent statuses such as
+	// online, compared without case
+	States []string
+	// AgentIDs are agent IDs; LocalAgent stands for the master
+	AgentIDs []string
+	// Label is key=value for entries carrying that label, or key for those
+	// carrying it with any value. VMs are matched by their metadata's
+	// labels, agents by their tags.
+	Label string
+	// Sort names a field to sort by, descending with a leading "-". Ties,
+	// and an empty Sort, fall back to agent ID and then name.
+	Sort string
+	// Limit is the page size, 0 for every entry; Offset skips entries
+	Limit  int
+	Offset int
+}
+
+// ParseQuery reads a query from the list parameters of a request: state,
+// agent_id (both comma separated), label, sort, limit and offset. get reads a
+// parameter; sortFields are the fields the list can be sorted by.
+func ParseQuery(get func(key string) string, sortFields []string) (Query, error) {
+	q := Query{
+		States:   splitList(get("state")),
+		AgentIDs: splitList(get("agent_id")),
+		Label:    get("label"),
+		Sort:     get("sort"),
+	}
+	var err error
+	if q.Limit, err = parseCount(get("limit")); err != nil || q.Limit > MaxLimit {
+		return q, fmt.Errorf("limit must be between 1 and %d, or 0 for every entry", MaxLimit)
+	}
+	if q.Offset, err = parseCount(get("offset")); err != nil {
+		return q, fmt.Errorf("offset must not be negative")
+	}
+	if field := strings.TrimPrefix(q.Sort, "-"); field != "" && !contains(sortFields, field) {
+		return q, fmt.Errorf("invalid sort %q: use one of %s, with - for descending", q.Sort, strings.Join(sortFields, ", "))
+	}
+	return q, nil
+}
+
+// parseCount parses an optional non-negative count, 0 when absent
+func parseCount(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid count %q", value)
+	}
+	return count, nil
+}
+
+// splitList splits a comma separated parameter, dropping empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// contains reports whether list holds value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesState reports whether a state is one of the query's
+func (q Query) matchesState(state string) bool {
+	if len(q.States) == 0 {
+		return true
+	}
+	for _, want := range q.States {
+		if strings.EqualFold(want, state) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAgent reports whether an agent ID, "" for the master, is one of the
+// query's
+func (q Query) matchesAgent(agentID string) bool {
+	if len(q.AgentIDs) == 0 {
+		return true
+	}
+	if agentID == "" {
+		agentID = LocalAgent
+	}
+	return contains(q.AgentIDs, agentID)
+}
+
+// matchesLabel reports whether labels carry the query's label
+func (q Query) matchesLabel(labels map[string]string) bool {
+	if q.Label == "" {
+		return true
+	}
+	key, value, withValue := strings.Cut(q.Label, "=")
+	got, ok := labels[key]
+	return ok && (!withValue || got == value)
+}
+
+// VMs filters, sorts and pages a VM list, returning the page and how many
+// VMs matched in all
+func (q Query) VMs(vms []models.VMListing) ([]models.VMListing, int) {
+	matched := []models.VMListing{}
+	for _, vm := range vms {
+		var labels map[string]string
+		if vm.Metadata != nil {
+			labels = vm.Metadata.Labels
+		}
+		if q.matchesState(vm.State) && q.matchesAgent(vmAgentID(vm)) && q.matchesLabel(labels) {
+			matched = append(matched, vm)
+		}
+	}
+
+	field, descending := sortField(q.Sort)
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if order := compareVMs(a, b, field); order != 0 {
+			return (order < 0) != descending
+		}
+		if order := strings.Compare(vmAgentID(a), vmAgentID(b)); order != 0 {
+			return order < 0
+		}
+		return a.Name < b.Name
+	})
+	return page(matched, q.Offset, q.Limit), len(matched)
+}
+
+// Agents filters, sorts and pages an agent list, returning the page and how
+// many agents matched in all
+func (q Query) Agents(agents []*models.AgentInfo) ([]*models.AgentInfo, int) {
+	matched := []*models.AgentInfo{}
+	for _, agent := range agents {
+		if q.matchesState(agent.Status) && q.matchesAgent(agent.AgentID) && q.matchesLabel(agent.Tags) {
+			matched = append(matched, agent)
+		}
+	}
+
+	field, descending := sortField(q.Sort)
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if order := compareAgents(a, b, field); order != 0 {
+			return (order < 0) != descending
+		}
+		return a.AgentID < b.AgentID
+	})
+	return page(matched, q.Offset, q.Limit), len(matched)
+}
+
+// sortField splits a sort parameter into its field and direction
+func sortField(sort string) (string, bool) {
+	if field, found := strings.CutPrefix(sort, "-"); found {
+		return field, true
+	}
+	return sort, false
+}
+
+// vmAgentID gets the agent of a VM, "" for the master
+func vmAgentID(vm models.VMListing) string {
+	if vm.AgentID == nil {
+		return ""
+	}
+	return *vm.AgentID
+}
+
+// compareVMs orders two VMs by a sort field
+func compareVMs(a, b models.VMListing, field string) int {
+	meta := func(vm models.VMListing) *models.VMMetadata {
+		if vm.Metadata == nil {
+			return &models.VMMetadata{}
+		}
+		return vm.Metadata
+	}
+	switch field {
+	case "name":
+		return strings.Compare(a.Name, b.Name)
+	case "state":
+		return strings.Compare(a.State, b.State)
+	case "agent_id":
+		return strings.Compare(vmAgentID(a), vmAgentID(b))
+	case "owner":
+		return strings.Compare(meta(a).Owner, meta(b).Owner)
+	case "project":
+		return strings.Compare(meta(a).Project, meta(b).Project)
+	case "created_at":
+		return compareTimes(meta(a).CreatedAt, meta(b).CreatedAt)
+	case "expires_at":
+		return compareTimes(meta(a).ExpiresAt, meta(b).ExpiresAt)
+	}
+	return 0
+}
+
+// compareAgents orders two agents by a sort field
+func compareAgents(a, b *models.AgentInfo, field string) int {
+	switch field {
+	case "agent_id":
+		return strings.Compare(a.AgentID, b.AgentID)
+	case "hostname":
+		return strings.Compare(a.Hostname, b.Hostname)
+	case "status":
+		return strings.Compare(a.Status, b.Status)
+	case "zone":
+		return strings.Compare(a.Zone, b.Zone)
+	case "vm_count":
+		return a.VMCount - b.VMCount
+	case "last_seen":
+		return compareTimes(a.LastSeen, b.LastSeen)
+	}
+	return 0
+}
+
+// compareTimes orders optional times, unset ones first
+func compareTimes(a, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	return a.Compare(*b)
+}
+
+// page gets the entries of a list from offset, at most limit of them when
+// limit is set
+func page[T any](items []T, offset, limit int) []T {
+	items = items[min(offset, len(items)):]
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
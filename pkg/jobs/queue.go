@@ -0,0 +1,167 @@
+// Package jobs runs an agent's long operations, such as launches and file
+// transfers, in the background. The master submits a job, gets its ID at
+// once and polls for the result instead of holding a request open until the
+// operation finishes.
+package jobs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/tracing"
+)
+
+var logger = logging.For("jobs")
+
+// Retention is how long a finished job's result stays available
+const Retention = time.Hour
+
+// DefaultConcurrency is how many jobs run at once unless the agent overrides it
+const DefaultConcurrency = 4
+
+// Runner performs a job's operation, reporting launch updates to progress
+type Runner func(ctx context.Context, progress func(models.LaunchProgress)) *models.OperationResult
+
+// Queue runs jobs in the background, a limited number at a time, and keeps
+// them until Retention after they finish
+type Queue struct {
+	jobs  map[string]*models.AgentJob
+	slots chan struct{}
+	mutex sync.RWMutex
+}
+
+// NewQueue creates a job queue running up to concurrency jobs at once
+func NewQueue(concurrency int) *Queue {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	return &Queue{
+		jobs:  make(map[string]*models.AgentJob),
+		slots: make(chan struct{}, concurrency),
+	}
+}
+
+// Submit queues a job of the given kind and returns it as queued. run is
+// called once a slot is free, outside any request, so it keeps going after
+// the submitting request has been answered. It gets ctx's values, such as
+// the request's ID and span, but not its cancellation.
+func (q *Queue) Submit(ctx context.Context, kind string, run Runner) models.AgentJob {
+	now := time.Now()
+	job := &models.AgentJob{
+		ID:        uuid.NewString(),
+		Kind:      kind,
+		State:     "queued",
+		CreatedAt: now,
+	}
+
+	q.mutex.Lock()
+	q.prune(now)
+	q.jobs[job.ID] = job
+	submitted := *job
+	q.mutex.Unlock()
+
+	go q.run(context.WithoutCancel(ctx), job, run)
+	return submitted
+}
+
+// Get gets a job by ID
+func (q *Queue) Get(id string) (models.AgentJob, bool) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	job, exists := q.jobs[id]
+	if !exists {
+		return models.AgentJob{}, false
+	}
+	return *job, true
+}
+
+// Drain waits for the queued and running jobs to finish until ctx ends and
+// returns how many had not. Their multipass commands are not stopped, but
+// their results are lost with the agent.
+func (q *Queue) Drain(ctx context.Context) int {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for q.unfinished() > 0 && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+	return q.unfinished()
+}
+
+// unfinished counts the jobs queued or running
+func (q *Queue) unfinished() int {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	count := 0
+	for _, job := range q.jobs {
+		if job.FinishedAt == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// run waits for a slot and runs a job in a span of its own, so the time spent
+// queued shows up in the submitting request's trace
+func (q *Queue) run(ctx context.Context, job *models.AgentJob, run Runner) {
+	ctx, span := tracing.Start(ctx, "job "+job.Kind, tracing.KindInternal,
+		tracing.Attribute{Key: "job.id", Value: job.ID})
+	defer span.End()
+
+	q.slots <- struct{}{}
+	defer func() { <-q.slots }()
+
+	q.update(job, func(j *models.AgentJob) {
+		now := time.Now()
+		j.State = "running"
+		j.StartedAt = &now
+	})
+
+	span.SetAttribute("job.queued_seconds", time.Since(job.CreatedAt).Seconds())
+	result := run(ctx, func(progress models.LaunchProgress) {
+		q.update(job, func(j *models.AgentJob) {
+			j.Progress = &progress
+		})
+	})
+	if result == nil {
+		result = &models.OperationResult{Success: false, Message: "job finished without a result"}
+	}
+	if !result.Success {
+		span.SetError(result.Message)
+	}
+
+	q.update(job, func(j *models.AgentJob) {
+		now := time.Now()
+		j.Result = result
+		j.FinishedAt = &now
+		j.State = "succeeded"
+		if !result.Success {
+			j.State = "failed"
+		}
+	})
+	logger.InfoContext(ctx, "Job finished", "job_id", job.ID, "kind", job.Kind, "state", job.State)
+}
+
+// update changes a job under the lock
+func (q *Queue) update(job *models.AgentJob, change func(*models.AgentJob)) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	change(job)
+}
+
+// prune drops jobs that finished more than Retention before now; the caller
+// must hold the lock
+func (q *Queue) prune(now time.Time) {
+	for id, job := range q.jobs {
+		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > Retention {
+			delete(q.jobs, id)
+		}
+	}
+}
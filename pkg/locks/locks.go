@@ -0,0 +1,68 @@
+package locks
+
+import (
+	"fmt"
+	"sync"
+)
+
+// BusyError is returned when a VM already has an operation in progress
+type BusyError struct {
+	VMName    string
+	Operation string
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("VM '%s' is busy: %s already in progress", e.VMName, e.Operation)
+}
+
+// VMLockManager serializes conflicting operations on the same VM
+type VMLockManager struct {
+	held  map[string]string
+	mutex sync.Mutex
+}
+
+// NewVMLockManager creates a new VM lock manager
+func NewVMLockManager() *VMLockManager {
+	return &VMLockManager{
+		held: make(map[string]string),
+	}
+}
+
+// lockKey builds the key for a VM on an agent (nil agentID means local)
+func lockKey(agentID *string, vmName string) string {
+	if agentID == nil {
+		return "local/" + vmName
+	}
+	return *agentID + "/" + vmName
+}
+
+// TryLock acquires the lock for a VM without blocking. It returns a release
+// function on success, or a *BusyError naming the operation holding the lock.
+func (m *VMLockManager) TryLock(agentID *string, vmName, operation string) (func(), error) {
+	key := lockKey(agentID, vmName)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if current, exists := m.held[key]; exists {
+		return nil, &BusyError{VMName: vmName, Operation: current}
+	}
+	m.held[key] = operation
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			delete(m.held, key)
+		})
+	}, nil
+}
+
+// GetOperation gets the operation currently holding the lock for a VM, if any
+func (m *VMLockManager) GetOperation(agentID *string, vmName string) (string, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	operation, exists := m.held[lockKey(agentID, vmName)]
+	return operation, exists
+}
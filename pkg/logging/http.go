@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Middleware returns middleware logging each request once it is answered,
+// with its method, path, status, latency and client address, and the
+// request's ID and trace from its context. Server errors are logged at error
+// level, everything else at info.
+func Middleware() fiber.Handler {
+	logger := For("http")
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		message := ""
+		if err != nil {
+			message = err.Error()
+			// Let the error handler set the status before it is logged
+			if handlerErr := c.App().ErrorHandler(c, err); handlerErr != nil {
+				c.Status(fiber.StatusInternalServerError)
+			}
+		}
+
+		status := c.Response().StatusCode()
+		level := slog.LevelInfo
+		if status >= fiber.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		args := []any{
+			"method", c.Method(),
+			"path", c.Path(),
+			"status", status,
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"ip", c.IP(),
+		}
+		if message != "" {
+			args = append(args, "error", message)
+		}
+		logger.Log(c.UserContext(), level, "request", args...)
+		return nil
+	}
+}
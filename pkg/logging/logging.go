@@ -0,0 +1,218 @@
+// Package logging is the structured, leveled logger of the master and
+// agents, built on log/slog. Each package logs through its own logger from
+// For, tagged with the package's name, so levels can be set per package, and
+// logs written with a request's context carry its request ID and trace. The
+// output is text for people or JSON for Loki or ELK, chosen by Configure.
+//
+// The standard log package is routed through it too, at info level.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// PackageKey is the attribute naming the package a log came from
+const PackageKey = "pkg"
+
+// root is the handler every logger writes through, swapped by Configure
+var root atomic.Pointer[slog.Handler]
+
+// levels holds the default level and per-package overrides
+var levels = &levelSet{fallback: slog.LevelInfo}
+
+// contextFields read request-scoped attributes, such as the request ID, from
+// the context a log is written with
+var (
+	contextFields []func(ctx context.Context) []slog.Attr
+	fieldsMutex   sync.RWMutex
+)
+
+func init() {
+	h, _ := newHandler("text", os.Stderr)
+	setRoot(h)
+}
+
+// For gets the logger of a package, named as its import path's last element
+// such as "routes". It writes through whatever Configure last set up, so it
+// can be kept in a package variable.
+func For(pkg string) *slog.Logger {
+	return slog.New(&handler{pkg: pkg})
+}
+
+// Configure sets the output format, "text" (the default) or "json", and the
+// levels: a default level optionally followed by per-package ones, such as
+// "info" or "warn,routes=debug,agents=debug". Levels are debug, info, warn
+// and error.
+func Configure(format, level string) error {
+	parsed, err := parseLevels(level)
+	if err != nil {
+		return err
+	}
+	handler, err := newHandler(format, os.Stderr)
+	if err != nil {
+		return err
+	}
+	levels.set(parsed)
+	setRoot(handler)
+	return nil
+}
+
+// ConfigureFromEnv configures logging from LOG_FORMAT and LOG_LEVEL
+func ConfigureFromEnv() error {
+	return Configure(os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+}
+
+// RegisterContextFields adds a reader of request-scoped attributes, which
+// every log written with a context carries
+func RegisterContextFields(fields func(ctx context.Context) []slog.Attr) {
+	fieldsMutex.Lock()
+	defer fieldsMutex.Unlock()
+	contextFields = append(contextFields, fields)
+}
+
+// Fatal logs an error and exits, for failures main cannot start past
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// newHandler creates the root handler of a format. Levels are checked per
+// package before a record reaches it, so it takes everything.
+func newHandler(format string, out io.Writer) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: formatDuration}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.NewTextHandler(out, options), nil
+	case "json":
+		return slog.NewJSONHandler(out, options), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q: use text or json", format)
+}
+
+// formatDuration writes durations as "720h0m0s" rather than JSON's count of
+// nanoseconds
+func formatDuration(_ []string, attr slog.Attr) slog.Attr {
+	if attr.Value.Kind() == slog.KindDuration {
+		return slog.String(attr.Key, attr.Value.Duration().String())
+	}
+	return attr
+}
+
+// setRoot swaps the root handler and routes the standard log package to it
+func setRoot(h slog.Handler) {
+	root.Store(&h)
+	standard := slog.New(&handler{pkg: "log"})
+	log.SetFlags(0)
+	log.SetOutput(&standardWriter{logger: standard})
+}
+
+// standardWriter turns lines from the standard log package into info logs
+type standardWriter struct {
+	logger *slog.Logger
+}
+
+func (w *standardWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// handler is the slog.Handler of a package's logger. It holds the attributes
+// and groups added to the logger and applies them to the current root handler
+// as each record is written, so Configure takes effect on existing loggers.
+type handler struct {
+	pkg string
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= levels.of(h.pkg)
+}
+
+func (h *handler) Handle(ctx context.Context, record slog.Record) error {
+	attrs := []slog.Attr{slog.String(PackageKey, h.pkg)}
+	if ctx != nil {
+		fieldsMutex.RLock()
+		for _, fields := range contextFields {
+			attrs = append(attrs, fields(ctx)...)
+		}
+		fieldsMutex.RUnlock()
+	}
+
+	out := (*root.Load()).WithAttrs(attrs)
+	for _, op := range h.ops {
+		out = op(out)
+	}
+	return out.Handle(ctx, record)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithGroup(name) })
+}
+
+// with copies the handler with one more operation
+func (h *handler) with(op func(slog.Handler) slog.Handler) slog.Handler {
+	ops := append(append([]func(slog.Handler) slog.Handler{}, h.ops...), op)
+	return &handler{pkg: h.pkg, ops: ops}
+}
+
+// levelSet is a default level and per-package overrides
+type levelSet struct {
+	fallback slog.Level
+	packages map[string]slog.Level
+	mutex    sync.RWMutex
+}
+
+// of gets the level of a package
+func (l *levelSet) of(pkg string) slog.Level {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if level, ok := l.packages[pkg]; ok {
+		return level
+	}
+	return l.fallback
+}
+
+// set replaces the levels with parsed ones
+func (l *levelSet) set(parsed *levelSet) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.fallback = parsed.fallback
+	l.packages = parsed.packages
+}
+
+// parseLevels reads a level spec such as "warn,routes=debug"
+func parseLevels(spec string) (*levelSet, error) {
+	parsed := &levelSet{fallback: slog.LevelInfo, packages: make(map[string]slog.Level)}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pkg, name, perPackage := strings.Cut(item, "=")
+		if !perPackage {
+			name = pkg
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+			return nil, fmt.Errorf("invalid log level %q: use debug, info, warn or error", name)
+		}
+		if perPackage {
+			parsed.packages[strings.TrimSpace(pkg)] = level
+		} else {
+			parsed.fallback = level
+		}
+	}
+	return parsed, nil
+}
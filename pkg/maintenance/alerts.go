@@ -0,0 +1,66 @@
+package maintenance
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prashah/batwa/pkg/bus"
+	"github.com/prashah/batwa/pkg/metadata"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/notifications"
+)
+
+// OfflineAlerts gets an agent.offline subscriber that notifies, through
+// notifier, the admins listed by admins when an agent misses its heartbeats and goes offline.
+// Agents going offline during one of their maintenance windows, or because
+// they were shut down, are expected to, so no alert is sent.
+func (s *Scheduler) OfflineAlerts(admins func() []string, notifier *notifications.Notifier) bus.Handler {
+	return func(event models.Event) {
+		if event.Data["previous"] != "online" || event.Data["reason"] == "shutdown" {
+			return
+		}
+		agent := s.registry.GetAgent(event.AgentID)
+		if agent == nil {
+			return
+		}
+		if w := s.ActiveWindow(agent); w != nil {
+			logger.Info("Agent went offline during a maintenance window; not alerting", "agent_id", agent.AgentID, "window", w.ID)
+			return
+		}
+
+		lastSeen := "never"
+		if agent.LastSeen != nil {
+			lastSeen = agent.LastSeen.Format("2006-01-02 15:04:05 MST")
+		}
+		for _, admin := range admins() {
+			notifier.Notify(admin, "agent_offline",
+				fmt.Sprintf("Agent '%s' is offline", agent.AgentID),
+				fmt.Sprintf("Agent '%s' (%s) stopped sending heartbeats; it was last seen %s.", agent.AgentID, agent.Hostname, lastSeen))
+		}
+	}
+}
+
+// RemindOwners gets a maintenance.upcoming subscriber that notifies, through
+// notifier, the owners recorded in store of VMs on the agent about to enter
+// maintenance
+func RemindOwners(store *metadata.Store, notifier *notifications.Notifier) bus.Handler {
+	return func(event models.Event) {
+		start, _ := time.Parse(time.RFC3339, event.Data["start"])
+		end, _ := time.Parse(time.RFC3339, event.Data["end"])
+
+		agentID := event.AgentID
+		owners := map[string][]string{}
+		for _, meta := range store.List(&agentID) {
+			if meta.Owner != "" {
+				owners[meta.Owner] = append(owners[meta.Owner], meta.Name)
+			}
+		}
+
+		for owner, vms := range owners {
+			notifier.Notify(owner, "maintenance",
+				fmt.Sprintf("Maintenance on agent '%s' at %s", agentID, start.Format(time.RFC1123)),
+				fmt.Sprintf("Agent '%s' enters maintenance from %s to %s. Affected VMs: %v. %s",
+					agentID, start.Format(time.RFC1123), end.Format(time.RFC1123), vms, event.Data["description"]))
+		}
+	}
+}
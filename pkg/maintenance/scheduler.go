@@ -0,0 +1,272 @@
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/bus"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+var logger = logging.For("maintenance")
+
+// Scheduler keeps maintenance windows, saved to a JSON file after every
+// change, and announces them before they start
+type Scheduler struct {
+	registry      *agents.AgentRegistry
+	events        *bus.Bus
+	path          string
+	windows       map[string]*models.MaintenanceWindow
+	reminded      map[string]time.Time
+	reminderLead  time.Duration
+	checkInterval time.Duration
+	mutex         sync.RWMutex
+	cancelFunc    context.CancelFunc
+}
+
+// NewScheduler creates a new maintenance scheduler for the agents in
+// registry, publishing upcoming windows to events, persisting its windows at
+// path and loading the windows already saved there
+func NewScheduler(registry *agents.AgentRegistry, events *bus.Bus, path string) *Scheduler {
+	s := &Scheduler{
+		registry:      registry,
+		events:        events,
+		path:          path,
+		windows:       make(map[string]*models.MaintenanceWindow),
+		reminded:      make(map[string]time.Time),
+		reminderLead:  time.Hour,
+		checkInterval: time.Minute,
+	}
+	if err := s.load(); err != nil {
+		logger.Error("Failed to load maintenance windows", "path", path, "error", err)
+	}
+	return s
+}
+
+// NewSchedulerFromEnv creates a maintenance scheduler persisting its windows
+// at MAINTENANCE_WINDOWS_PATH (default ./data/maintenance_windows.json)
+func NewSchedulerFromEnv(registry *agents.AgentRegistry, events *bus.Bus) *Scheduler {
+	path := os.Getenv("MAINTENANCE_WINDOWS_PATH")
+	if path == "" {
+		path = filepath.Join("data", "maintenance_windows.json")
+	}
+	return NewScheduler(registry, events, path)
+}
+
+// load reads the saved windows
+func (s *Scheduler) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.windows)
+}
+
+// save writes the windows to the file; the caller must hold the lock
+func (s *Scheduler) save() {
+	data, err := json.MarshalIndent(s.windows, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0o755)
+	}
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save maintenance windows", "path", s.path, "error", err)
+	}
+}
+
+// AddWindow validates and stores a new maintenance window
+func (s *Scheduler) AddWindow(w *models.MaintenanceWindow) error {
+	if err := Validate(w); err != nil {
+		return err
+	}
+
+	w.ID = uuid.NewString()
+	w.CreatedAt = time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.windows[w.ID] = w
+	s.save()
+
+	logger.Info("Added maintenance window", "window", w.ID, "target", target(w))
+	return nil
+}
+
+// RemoveWindow removes a maintenance window
+func (s *Scheduler) RemoveWindow(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.windows[id]; exists {
+		delete(s.windows, id)
+		s.save()
+		return true
+	}
+	return false
+}
+
+// ListWindows lists all maintenance windows ordered by creation time
+func (s *Scheduler) ListWindows() []*models.MaintenanceWindow {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	windows := make([]*models.MaintenanceWindow, 0, len(s.windows))
+	for _, w := range s.windows {
+		windows = append(windows, w)
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].CreatedAt.Before(windows[j].CreatedAt)
+	})
+	return windows
+}
+
+// WindowsFor lists the windows that cover an agent, directly or through its
+// zone, ordered by creation time
+func (s *Scheduler) WindowsFor(agent *models.AgentInfo) []*models.MaintenanceWindow {
+	windows := []*models.MaintenanceWindow{}
+	for _, w := range s.ListWindows() {
+		if appliesTo(w, agent) {
+			windows = append(windows, w)
+		}
+	}
+	return windows
+}
+
+// appliesTo reports whether a window covers an agent, directly or through its zone
+func appliesTo(w *models.MaintenanceWindow, agent *models.AgentInfo) bool {
+	if w.AgentID != "" {
+		return w.AgentID == agent.AgentID
+	}
+	return w.Zone != "" && agents.Zone(agent) == w.Zone
+}
+
+// target describes what a window applies to
+func target(w *models.MaintenanceWindow) string {
+	if w.AgentID != "" {
+		return fmt.Sprintf("agent '%s'", w.AgentID)
+	}
+	return fmt.Sprintf("zone '%s'", w.Zone)
+}
+
+// ActiveWindow gets the maintenance window an agent is currently in, or nil
+func (s *Scheduler) ActiveWindow(agent *models.AgentInfo) *models.MaintenanceWindow {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := time.Now()
+	for _, w := range s.windows {
+		if !appliesTo(w, agent) {
+			continue
+		}
+		if _, _, active := ActiveAt(w, now); active {
+			return w
+		}
+	}
+	return nil
+}
+
+// InMaintenance reports whether an agent is currently in a maintenance window.
+// The scheduler avoids such agents and non-critical jobs should skip them.
+func (s *Scheduler) InMaintenance(agent *models.AgentInfo) bool {
+	return s.ActiveWindow(agent) != nil
+}
+
+// StartReminders starts the loop that announces maintenance ahead of time
+func (s *Scheduler) StartReminders() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelFunc = cancel
+
+	go s.reminderLoop(ctx)
+	logger.Info("Started maintenance reminder loop")
+}
+
+// StopReminders stops the reminder loop
+func (s *Scheduler) StopReminders() {
+	if s.cancelFunc != nil {
+		s.cancelFunc()
+		logger.Info("Stopped maintenance reminder loop")
+	}
+}
+
+// reminderLoop periodically sends reminders for upcoming windows
+func (s *Scheduler) reminderLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sendReminders(time.Now())
+		}
+	}
+}
+
+// sendReminders publishes a maintenance.upcoming event for each agent whose
+// maintenance starts within the reminder lead
+func (s *Scheduler) sendReminders(now time.Time) {
+	type due struct {
+		window *models.MaintenanceWindow
+		start  time.Time
+		end    time.Time
+	}
+
+	s.mutex.Lock()
+	for key, start := range s.reminded {
+		if now.Sub(start) > maxDuration {
+			delete(s.reminded, key)
+		}
+	}
+
+	pending := []due{}
+	for _, w := range s.windows {
+		start, end, ok := NextOccurrence(w, now)
+		if !ok || start.Sub(now) > s.reminderLead {
+			continue
+		}
+		key := w.ID + "@" + start.Format(time.RFC3339)
+		if _, done := s.reminded[key]; done {
+			continue
+		}
+		s.reminded[key] = start
+		pending = append(pending, due{window: w, start: start, end: end})
+	}
+	s.mutex.Unlock()
+
+	for _, d := range pending {
+		for _, agent := range s.registry.GetAllAgents() {
+			if !appliesTo(d.window, agent) {
+				continue
+			}
+
+			s.events.Publish(models.Event{
+				Type:    "maintenance.upcoming",
+				AgentID: agent.AgentID,
+				Data: map[string]string{
+					"window_id":   d.window.ID,
+					"start":       d.start.Format(time.RFC3339),
+					"end":         d.end.Format(time.RFC3339),
+					"description": d.window.Description,
+				},
+			})
+		}
+	}
+}
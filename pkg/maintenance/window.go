@@ -0,0 +1,122 @@
+package maintenance
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// maxDuration bounds a single maintenance window
+const maxDuration = 7 * 24 * time.Hour
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Validate checks a maintenance window and normalizes its day names
+func Validate(w *models.MaintenanceWindow) error {
+	if w.AgentID == "" && w.Zone == "" {
+		return fmt.Errorf("either agent_id or zone is required")
+	}
+	if w.AgentID != "" && w.Zone != "" {
+		return fmt.Errorf("agent_id and zone are mutually exclusive")
+	}
+	if _, err := time.Parse("15:04", w.Start); err != nil {
+		return fmt.Errorf("start must be HH:MM: %s", w.Start)
+	}
+	duration := time.Duration(w.DurationMinutes) * time.Minute
+	if duration <= 0 || duration > maxDuration {
+		return fmt.Errorf("duration_minutes must be between 1 and %d", int(maxDuration.Minutes()))
+	}
+	if _, err := location(w); err != nil {
+		return fmt.Errorf("unknown timezone: %s", w.Timezone)
+	}
+
+	for i, day := range w.Days {
+		day = strings.ToLower(strings.TrimSpace(day))
+		if len(day) > 3 {
+			day = day[:3]
+		}
+		if _, ok := weekdays[day]; !ok {
+			return fmt.Errorf("unknown day: %s", w.Days[i])
+		}
+		w.Days[i] = day
+	}
+	return nil
+}
+
+// location gets the time zone a window is defined in (UTC by default)
+func location(w *models.MaintenanceWindow) (*time.Location, error) {
+	if w.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(w.Timezone)
+}
+
+// recursOn reports whether the window starts on the given weekday
+func recursOn(w *models.MaintenanceWindow, day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdays[d] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// occurrences lists window occurrences whose start falls within [from, to)
+func occurrences(w *models.MaintenanceWindow, from, to time.Time) [][2]time.Time {
+	loc, err := location(w)
+	if err != nil {
+		return nil
+	}
+	clock, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return nil
+	}
+	duration := time.Duration(w.DurationMinutes) * time.Minute
+
+	result := [][2]time.Time{}
+	day := from.In(loc)
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc)
+	for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+		if !recursOn(w, day.Weekday()) {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, loc)
+		if start.Before(from) || !start.Before(to) {
+			continue
+		}
+		result = append(result, [2]time.Time{start, start.Add(duration)})
+	}
+	return result
+}
+
+// ActiveAt gets the occurrence of the window covering t, if any
+func ActiveAt(w *models.MaintenanceWindow, t time.Time) (time.Time, time.Time, bool) {
+	for _, occ := range occurrences(w, t.Add(-maxDuration-24*time.Hour), t.Add(time.Minute)) {
+		if !t.Before(occ[0]) && t.Before(occ[1]) {
+			return occ[0], occ[1], true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// NextOccurrence gets the first occurrence of the window starting at or after t
+func NextOccurrence(w *models.MaintenanceWindow, t time.Time) (time.Time, time.Time, bool) {
+	occ := occurrences(w, t, t.Add(8*24*time.Hour))
+	if len(occ) == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	return occ[0][0], occ[0][1], true
+}
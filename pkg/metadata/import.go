@@ -0,0 +1,57 @@
+package metadata
+
+import (
+	"path"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// ApplyImportRules builds metadata for an imported VM on top of existing, the
+// VM's current metadata or nil. Defaults from the request apply first; the
+// first rule whose pattern matches the VM name then overrides owner and
+// project and adds its labels. Everything else recorded for the VM, such as
+// its shares and expiry, is kept.
+func ApplyImportRules(agentID, vmName string, existing *models.VMMetadata, req models.AgentImportRequest, now time.Time) *models.VMMetadata {
+	meta := &models.VMMetadata{AgentID: agentID, Name: vmName}
+	if existing != nil {
+		*meta = *existing
+		meta.SharedWith = append([]string(nil), existing.SharedWith...)
+	}
+	labels := map[string]string{}
+	for k, v := range meta.Labels {
+		labels[k] = v
+	}
+	meta.Labels = labels
+	meta.Source = "imported"
+	meta.ImportedAt = &now
+
+	if req.Owner != "" {
+		meta.Owner = req.Owner
+	}
+	if req.Project != "" {
+		meta.Project = req.Project
+	}
+	for k, v := range req.Labels {
+		meta.Labels[k] = v
+	}
+
+	for _, rule := range req.Rules {
+		matched, err := path.Match(rule.Pattern, vmName)
+		if err != nil || !matched {
+			continue
+		}
+		if rule.Owner != "" {
+			meta.Owner = rule.Owner
+		}
+		if rule.Project != "" {
+			meta.Project = rule.Project
+		}
+		for k, v := range rule.Labels {
+			meta.Labels[k] = v
+		}
+		break
+	}
+
+	return meta
+}
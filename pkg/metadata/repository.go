@@ -0,0 +1,148 @@
+package metadata
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+// Repository persists VM metadata. The store keeps every entry in memory and
+// writes each change through to the repository.
+type Repository interface {
+	Load() ([]*models.VMMetadata, error)
+	// Save saves a VM's entry, replacing any saved before
+	Save(meta *models.VMMetadata) error
+	Delete(agentID, vmName string) error
+}
+
+// FileRepository keeps VM metadata in a JSON file, rewritten on every change.
+// An empty path keeps it in memory only.
+type FileRepository struct {
+	path    string
+	entries map[string]*models.VMMetadata
+	mutex   sync.Mutex
+}
+
+// NewFileRepository keeps VM metadata in the JSON file at path
+func NewFileRepository(path string) *FileRepository {
+	return &FileRepository{path: path, entries: make(map[string]*models.VMMetadata)}
+}
+
+// Load reads the entries saved in the file
+func (r *FileRepository) Load() ([]*models.VMMetadata, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*models.VMMetadata
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, meta := range entries {
+		r.entries[key(meta.AgentID, meta.Name)] = meta
+	}
+	return entries, nil
+}
+
+// Save saves a VM's entry by rewriting the file
+func (r *FileRepository) Save(meta *models.VMMetadata) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entries[key(meta.AgentID, meta.Name)] = meta
+	return r.write()
+}
+
+// Delete deletes a VM's entry by rewriting the file
+func (r *FileRepository) Delete(agentID, vmName string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.entries, key(agentID, vmName))
+	return r.write()
+}
+
+// write writes all entries to the file; the caller must hold the lock
+func (r *FileRepository) write() error {
+	if r.path == "" {
+		return nil
+	}
+	entries := make([]*models.VMMetadata, 0, len(r.entries))
+	for _, meta := range r.entries {
+		entries = append(entries, meta)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// DatabaseRepository keeps VM metadata in the master's database
+type DatabaseRepository struct {
+	db *storage.DB
+}
+
+// NewDatabaseRepository keeps VM metadata in db
+func NewDatabaseRepository(db *storage.DB) *DatabaseRepository {
+	return &DatabaseRepository{db: db}
+}
+
+// Load loads every entry from the database
+func (r *DatabaseRepository) Load() ([]*models.VMMetadata, error) {
+	rows, err := r.db.Query(`SELECT data FROM vm_metadata`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*models.VMMetadata
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var meta models.VMMetadata
+		if err := json.Unmarshal([]byte(data), &meta); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &meta)
+	}
+	return entries, rows.Err()
+}
+
+// Save saves a VM's entry to the database
+func (r *DatabaseRepository) Save(meta *models.VMMetadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`INSERT INTO vm_metadata (agent_id, vm_name, data) VALUES (?, ?, ?)
+		ON CONFLICT (agent_id, vm_name) DO UPDATE SET data = excluded.data`,
+		meta.AgentID, meta.Name, string(data))
+	return err
+}
+
+// Delete deletes a VM's entry from the database
+func (r *DatabaseRepository) Delete(agentID, vmName string) error {
+	_, err := r.db.Exec(`DELETE FROM vm_metadata WHERE agent_id = ? AND vm_name = ?`, agentID, vmName)
+	return err
+}
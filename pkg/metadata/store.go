@@ -0,0 +1,172 @@
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+var logger = logging.For("metadata")
+
+// Store keeps master-side metadata for VMs, keyed by agent and VM name.
+// VMs on the master itself use an empty agent ID. Multipass has no tagging of
+// its own, so this store is the only record of who a VM belongs to; it is
+// saved to its Repository after every change.
+type Store struct {
+	repository Repository
+	entries    map[string]*models.VMMetadata
+	mutex      sync.RWMutex
+}
+
+// NewStore creates a metadata store persisted to repository, loading any
+// entries already saved there
+func NewStore(repository Repository) *Store {
+	s := &Store{
+		repository: repository,
+		entries:    make(map[string]*models.VMMetadata),
+	}
+	entries, err := repository.Load()
+	if err != nil {
+		logger.Error("Failed to load VM metadata", "error", err)
+	}
+	for _, meta := range entries {
+		s.entries[key(meta.AgentID, meta.Name)] = meta
+	}
+	return s
+}
+
+// NewStoreFromEnv creates a metadata store in db, or persisted at
+// METADATA_PATH (default ./data/metadata.json) when db is nil. The first time
+// a database is used, the entries in the file are copied into it.
+func NewStoreFromEnv(db *storage.DB) (*Store, error) {
+	path := os.Getenv("METADATA_PATH")
+	if path == "" {
+		path = filepath.Join("data", "metadata.json")
+	}
+	if db == nil {
+		return NewStore(NewFileRepository(path)), nil
+	}
+
+	repository := NewDatabaseRepository(db)
+	err := db.ImportOnce("vm_metadata", func() (int, error) {
+		entries, err := NewFileRepository(path).Load()
+		if err != nil {
+			return 0, err
+		}
+		for _, meta := range entries {
+			if err := repository.Save(meta); err != nil {
+				return 0, err
+			}
+		}
+		return len(entries), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(repository), nil
+}
+
+// save saves a VM's entry; the caller must hold the lock
+func (s *Store) save(meta *models.VMMetadata) {
+	if err := s.repository.Save(meta); err != nil {
+		logger.Error("Failed to save VM metadata", "agent", meta.AgentID, "vm", meta.Name, "error", err)
+	}
+}
+
+// key builds the store key for a VM
+func key(agentID, vmName string) string {
+	return agentID + "/" + vmName
+}
+
+// Get gets metadata for a VM, or nil if none is recorded
+func (s *Store) Get(agentID, vmName string) *models.VMMetadata {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.entries[key(agentID, vmName)]
+}
+
+// Set records metadata for a VM, replacing any existing entry
+func (s *Store) Set(meta *models.VMMetadata) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries[key(meta.AgentID, meta.Name)] = meta
+	s.save(meta)
+}
+
+// Restore records the metadata of a VM as a backup saved it, reporting
+// whether it could be saved
+func (s *Store) Restore(meta *models.VMMetadata) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.repository.Save(meta); err != nil {
+		return err
+	}
+	s.entries[key(meta.AgentID, meta.Name)] = meta
+	return nil
+}
+
+// Update applies fn to a copy of a VM's metadata, creating an empty entry if
+// none exists, and stores the result
+func (s *Store) Update(agentID, vmName string, fn func(meta *models.VMMetadata)) *models.VMMetadata {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	meta := &models.VMMetadata{AgentID: agentID, Name: vmName}
+	if existing, exists := s.entries[key(agentID, vmName)]; exists {
+		copied := *existing
+		copied.Labels = make(map[string]string, len(existing.Labels))
+		for k, v := range existing.Labels {
+			copied.Labels[k] = v
+		}
+		copied.SharedWith = append([]string(nil), existing.SharedWith...)
+		meta = &copied
+	}
+	fn(meta)
+
+	s.entries[key(agentID, vmName)] = meta
+	s.save(meta)
+	return meta
+}
+
+// Delete removes metadata for a VM
+func (s *Store) Delete(agentID, vmName string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	k := key(agentID, vmName)
+	if _, exists := s.entries[k]; exists {
+		delete(s.entries, k)
+		if err := s.repository.Delete(agentID, vmName); err != nil {
+			logger.Error("Failed to save VM metadata", "agent", agentID, "vm", vmName, "error", err)
+		}
+		return true
+	}
+	return false
+}
+
+// List lists all metadata entries, optionally restricted to one agent
+func (s *Store) List(agentID *string) []*models.VMMetadata {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entries := make([]*models.VMMetadata, 0, len(s.entries))
+	for _, meta := range s.entries {
+		if agentID != nil && meta.AgentID != *agentID {
+			continue
+		}
+		entries = append(entries, meta)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].AgentID != entries[j].AgentID {
+			return entries[i].AgentID < entries[j].AgentID
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prashah/batwa/pkg/secrets"
+)
+
+// ContentType is the media type of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// unmatchedRoute labels requests no route took, so stray paths cannot grow
+// the number of series
+const unmatchedRoute = "unmatched"
+
+// Middleware returns middleware counting requests and timing them in
+// registry by their route's pattern, such as /api/v1/vm/info/:vm_name, rather
+// than their path
+func Middleware(registry *Registry) fiber.Handler {
+	httpRequests := registry.Counter(Namespace+"http_requests_total",
+		"HTTP requests answered, by method, route and status", "method", "route", "status")
+	httpDuration := registry.Histogram(Namespace+"http_request_duration_seconds",
+		"Time taken to answer HTTP requests, by method and route", nil, "method", "route")
+
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		method := c.Method()
+		route := Route(c, err)
+		if err != nil {
+			// Let the error handler set the status before it is counted
+			if handlerErr := c.App().ErrorHandler(c, err); handlerErr != nil {
+				c.Status(fiber.StatusInternalServerError)
+			}
+			err = nil
+		}
+
+		httpRequests.Inc(method, route, strconv.Itoa(c.Response().StatusCode()))
+		httpDuration.Observe(time.Since(start).Seconds(), method, route)
+		return err
+	}
+}
+
+// Route gets the pattern of the route a request took, or "unmatched" when
+// err, what the rest of the stack returned, is the router's own answer to a
+// request no route took. c.Route() is then the last middleware that ran,
+// which Fiber gives the request's method, so it cannot tell by the route.
+func Route(c *fiber.Ctx, err error) string {
+	if errors.Is(err, fiber.ErrMethodNotAllowed) {
+		return unmatchedRoute
+	}
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) && fiberErr.Code == fiber.StatusNotFound &&
+		fiberErr.Message == "Cannot "+c.Method()+" "+html.EscapeString(c.Path()) {
+		return unmatchedRoute
+	}
+	return c.Route().Path
+}
+
+// Handler serves a registry in the Prometheus text format. When token is
+// set, scrapes must send it as a bearer token. Errors are left to the app's
+// error handler: apierror depends on multipass, which this package measures.
+func Handler(registry *Registry, token *secrets.Secret) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if expected := token.Value(); expected != "" {
+			sent, _ := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) != 1 {
+				return fiber.NewError(fiber.StatusUnauthorized, "Invalid or missing metrics token")
+			}
+		}
+
+		var body bytes.Buffer
+		if err := registry.Write(&body); err != nil {
+			return err
+		}
+		c.Set(fiber.HeaderContentType, ContentType)
+		return c.Send(body.Bytes())
+	}
+}
@@ -0,0 +1,333 @@
+// Package metrics keeps counters, gauges and histograms and serves them at
+// /metrics in the Prometheus text format, for the master and agents alike.
+// Each process creates its registry in main and hands it to the packages it
+// measures: code that measures something as it happens, such as multipass
+// commands, registers counters and histograms it updates; state read at
+// scrape time, such as the agents online, is registered with GaugeFunc.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Namespace prefixes the names of the metrics the master and agents export
+const Namespace = "batwa_"
+
+// DefaultBuckets are histogram bucket bounds in seconds, from a fast API
+// call to a slow VM launch
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// collector is a metric family the registry writes
+type collector interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry holds metric families by name
+type Registry struct {
+	collectors map[string]collector
+	mutex      sync.RWMutex
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// register adds a family, panicking on a name taken twice as that is a
+// programming error
+func (r *Registry) register(c collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.collectors[c.name()]; exists {
+		panic("metrics: " + c.name() + " registered twice")
+	}
+	r.collectors[c.name()] = c
+}
+
+// Write writes every family in the Prometheus text format, in name order
+func (r *Registry) Write(out io.Writer) error {
+	r.mutex.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := r.collectors
+	r.mutex.RUnlock()
+	sort.Strings(names)
+
+	w := bufio.NewWriter(out)
+	for _, name := range names {
+		collectors[name].write(w)
+	}
+	return w.Flush()
+}
+
+// family is what every kind of metric shares: its name, help text, label
+// names and series by their label values
+type family struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+	mutex      sync.Mutex
+}
+
+func (f *family) name() string {
+	return f.metricName
+}
+
+// header writes the family's HELP and TYPE lines
+func (f *family) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.metricName, escapeHelp(f.help), f.metricName, f.kind)
+}
+
+// key joins label values into a series key, checking their number
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.metricName, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats a series' labels, with extra name and value pairs
+// appended, as {name="value",...}
+func (f *family) labelPairs(key string, extra ...string) string {
+	pairs := []string{}
+	if len(f.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, f.labels[i]+"=\""+escapeLabel(value)+"\"")
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+escapeLabel(extra[i+1])+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a family of counters that only go up
+type Counter struct {
+	family
+	values map[string]float64
+}
+
+// Counter registers a counter family with the given label names
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: family{metricName: name, help: help, kind: "counter", labels: labels}, values: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the counter of the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds a non-negative amount to the counter of the label values
+func (c *Counter) Add(amount float64, values ...string) {
+	if amount < 0 {
+		return
+	}
+	key := c.key(values)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[key] += amount
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.header(w)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelPairs(key), formatValue(c.values[key]))
+	}
+}
+
+// Gauge is a family of values that go up and down
+type Gauge struct {
+	family
+	values map[string]float64
+}
+
+// Gauge registers a gauge family with the given label names
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{family: family{metricName: name, help: help, kind: "gauge", labels: labels}, values: make(map[string]float64)}
+	r.register(g)
+	return g
+}
+
+// Set sets the gauge of the label values
+func (g *Gauge) Set(value float64, values ...string) {
+	key := g.key(values)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[key] = value
+}
+
+// Add adds to the gauge of the label values, or takes away a negative amount
+func (g *Gauge) Add(amount float64, values ...string) {
+	key := g.key(values)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[key] += amount
+}
+
+// Inc adds one to the gauge of the label values
+func (g *Gauge) Inc(values ...string) {
+	g.Add(1, values...)
+}
+
+// Dec takes one from the gauge of the label values
+func (g *Gauge) Dec(values ...string) {
+	g.Add(-1, values...)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.header(w)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labelPairs(key), formatValue(g.values[key]))
+	}
+}
+
+// Sample is one value a GaugeFunc reports, with its label values
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// gaugeFunc is a gauge family read at scrape time
+type gaugeFunc struct {
+	family
+	collect func() []Sample
+}
+
+// GaugeFunc registers a gauge family whose samples collect reads at every
+// scrape, for state kept elsewhere such as the agent registry
+func (r *Registry) GaugeFunc(name, help string, labels []string, collect func() []Sample) {
+	r.register(&gaugeFunc{family: family{metricName: name, help: help, kind: "gauge", labels: labels}, collect: collect})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	values := make(map[string]float64)
+	for _, sample := range g.collect() {
+		values[g.key(sample.Labels)] += sample.Value
+	}
+	g.header(w)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labelPairs(key), formatValue(values[key]))
+	}
+}
+
+// Histogram is a family of histograms counting observations into buckets
+type Histogram struct {
+	family
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+// histogramSeries is the histogram of one set of label values
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram registers a histogram family with the given bucket upper bounds,
+// DefaultBuckets when nil, and label names
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		family:  family{metricName: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe counts a value, such as a duration in seconds, in the histogram of
+// the label values
+func (h *Histogram) Observe(value float64, values ...string) {
+	key := h.key(values)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	series, exists := h.series[key]
+	if !exists {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.header(w)
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelPairs(key, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelPairs(key, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelPairs(key), formatValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelPairs(key), series.count)
+	}
+}
+
+// sortedKeys lists a map's keys in order, so scrapes are stable
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatValue writes a sample value as Prometheus reads it
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// escapeLabel escapes a label value: backslashes, quotes and newlines
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// escapeHelp escapes help text: backslashes and newlines
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prashah/batwa/pkg/apierror"
+	"github.com/prashah/batwa/pkg/logging"
+)
+
+var logger = logging.For("middleware")
+
+// Allowlist limits requests to clients in a set of networks. A nil
+// Allowlist allows every client.
+type Allowlist struct {
+	networks []*net.IPNet
+}
+
+// NewAllowlist parses comma separated CIDRs, such as 10.0.0.0/8, or single
+// addresses. It returns nil, allowing every client, when value is empty.
+func NewAllowlist(value string) (*Allowlist, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", entry)
+		}
+		networks = append(networks, network)
+	}
+	if len(networks) == 0 {
+		return nil, nil
+	}
+	return &Allowlist{networks: networks}, nil
+}
+
+// AllowlistFromEnv parses the allowlist in an environment variable
+func AllowlistFromEnv(name string) (*Allowlist, error) {
+	allowlist, err := NewAllowlist(os.Getenv(name))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return allowlist, nil
+}
+
+// Allows reports whether a client address is in the allowlist
+func (a *Allowlist) Allows(addr string) bool {
+	if a == nil {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// String lists the allowed networks
+func (a *Allowlist) String() string {
+	if a == nil {
+		return "any"
+	}
+	networks := make([]string, len(a.networks))
+	for i, network := range a.networks {
+		networks[i] = network.String()
+	}
+	return strings.Join(networks, ",")
+}
+
+// Handler rejects requests from clients outside the allowlist with 403. The
+// client is the address the request came from; behind a reverse proxy that
+// is the proxy, so restrict clients at the proxy instead.
+func (a *Allowlist) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if a.Allows(c.IP()) {
+			return c.Next()
+		}
+		logger.WarnContext(c.UserContext(), "Rejected request: address not in allowlist", "path", c.Path(), "ip", c.IP())
+		return apierror.Respond(c, 403, fmt.Sprintf("Requests from %s are not allowed", c.IP()))
+	}
+}
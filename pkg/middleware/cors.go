@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/prashah/batwa/pkg/apierror"
+)
+
+// CORS modes
+const (
+	// SameOriginMode serves UI and API from one origin with CORS disabled
+	SameOriginMode = "same-origin"
+	// CrossOriginMode allows browser requests from an explicit origin allowlist
+	CrossOriginMode = "cross-origin"
+)
+
+// DefaultContentSecurityPolicy allows the bundled UI, its CDN scripts and fonts,
+// and same-origin API and websocket connections
+const DefaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net; " +
+	"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com https://cdn.jsdelivr.net; " +
+	"font-src 'self' https://fonts.gstatic.com; " +
+	"img-src 'self' data:; " +
+	"connect-src 'self'; " +
+	"frame-ancestors 'none'"
+
+// CORSConfig describes how cross-origin browser requests are handled
+type CORSConfig struct {
+	Mode                  string
+	AllowedOrigins        []string
+	ContentSecurityPolicy string
+}
+
+// NewCORSConfig builds and validates a CORS configuration. An empty mode
+// defaults to same-origin; origins is a comma separated allowlist.
+func NewCORSConfig(mode, origins string) (CORSConfig, error) {
+	cfg := CORSConfig{
+		Mode:                  strings.ToLower(strings.TrimSpace(mode)),
+		ContentSecurityPolicy: DefaultContentSecurityPolicy,
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = SameOriginMode
+	}
+
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			return cfg, fmt.Errorf("wildcard origins are not allowed; list each origin explicitly")
+		}
+		parsed, err := url.Parse(origin)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return cfg, fmt.Errorf("invalid origin: %s", origin)
+		}
+		cfg.AllowedOrigins = append(cfg.AllowedOrigins, origin)
+	}
+
+	switch cfg.Mode {
+	case SameOriginMode:
+	case CrossOriginMode:
+		if len(cfg.AllowedOrigins) == 0 {
+			return cfg, fmt.Errorf("cross-origin mode requires at least one allowed origin")
+		}
+	default:
+		return cfg, fmt.Errorf("unknown CORS mode: %s", cfg.Mode)
+	}
+
+	return cfg, nil
+}
+
+// CORSConfigFromEnv reads CORS_MODE, CORS_ALLOWED_ORIGINS and the optional
+// CONTENT_SECURITY_POLICY override
+func CORSConfigFromEnv() (CORSConfig, error) {
+	cfg, err := NewCORSConfig(os.Getenv("CORS_MODE"), os.Getenv("CORS_ALLOWED_ORIGINS"))
+	if err != nil {
+		return cfg, err
+	}
+	if csp := os.Getenv("CONTENT_SECURITY_POLICY"); csp != "" {
+		cfg.ContentSecurityPolicy = csp
+	}
+	return cfg, nil
+}
+
+// ApplyCORS installs the cross-origin handling for the configured mode
+func ApplyCORS(app *fiber.App, cfg CORSConfig) {
+	if cfg.Mode == CrossOriginMode {
+		app.Use(cors.New(cors.Config{
+			AllowOrigins:     strings.Join(cfg.AllowedOrigins, ","),
+			AllowCredentials: true,
+			AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
+			AllowHeaders:     "Origin,Content-Type,Accept,X-API-Key,X-Request-ID",
+			ExposeHeaders:    "X-Request-ID,X-Task-ID,X-Total-Count",
+		}))
+	} else {
+		app.Use(sameOrigin)
+	}
+
+	app.Use(func(c *fiber.Ctx) error {
+		if cfg.ContentSecurityPolicy != "" {
+			c.Set(fiber.HeaderContentSecurityPolicy, cfg.ContentSecurityPolicy)
+		}
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+		c.Set(fiber.HeaderReferrerPolicy, "same-origin")
+		return c.Next()
+	})
+}
+
+// sameOrigin rejects browser requests whose Origin does not match the requested host
+func sameOrigin(c *fiber.Ctx) error {
+	origin := c.Get(fiber.HeaderOrigin)
+	if origin == "" {
+		return c.Next()
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host != c.Hostname() {
+		return apierror.Respond(c, 403, "Cross-origin requests are not allowed")
+	}
+	return c.Next()
+}
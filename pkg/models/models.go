@@ -1,6 +1,9 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // LoginRequest represents a login request
 type LoginRequest struct {
@@ -8,20 +11,242 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
-// VMCreateRequest represents a VM creation request
+// TokenPair is a JWT access token with the refresh token that renews it.
+// ExpiresIn is the access token's lifetime in seconds.
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// TerminalTicketRequest asks for a ticket to open the terminal of a VM; no
+// VM name means the primary VM
+type TerminalTicketRequest struct {
+	VMName  string `json:"vm_name"`
+	AgentID string `json:"agent_id"`
+}
+
+// RefreshRequest exchanges a refresh token for a new token pair
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// User is a stored user account. Only the password's hash is kept;
+// MustChangePassword locks the account out of the API until the user sets a
+// password of their own.
+type User struct {
+	Username           string    `json:"username"`
+	PasswordHash       string    `json:"password_hash"`
+	Admin              bool      `json:"admin"`
+	MustChangePassword bool      `json:"must_change_password"`
+	CreatedAt          time.Time `json:"created_at"`
+	PasswordChangedAt  time.Time `json:"password_changed_at"`
+	// ServiceAccount marks an account for automation: it has no password and
+	// authenticates with API tokens only
+	ServiceAccount bool `json:"service_account,omitempty"`
+	// Identity names the external identity provider the user signs in
+	// through, such as "oidc"; such users have no password here
+	Identity string `json:"identity,omitempty"`
+	// Roles are the roles granted by the identity provider's groups, on top
+	// of user and admin
+	Roles []string `json:"roles,omitempty"`
+}
+
+// UserInfo is a user account as shown by the API, without its password hash
+type UserInfo struct {
+	Username           string    `json:"username"`
+	Admin              bool      `json:"admin"`
+	MustChangePassword bool      `json:"must_change_password"`
+	CreatedAt          time.Time `json:"created_at"`
+	PasswordChangedAt  time.Time `json:"password_changed_at"`
+	ServiceAccount     bool      `json:"service_account,omitempty"`
+	Identity           string    `json:"identity,omitempty"`
+	Roles              []string  `json:"roles,omitempty"`
+}
+
+// UserCreateRequest creates a user, who must change the password on first
+// login, or a service account, which has no password
+type UserCreateRequest struct {
+	Username       string `json:"username"`
+	Password       string `json:"password"`
+	Admin          bool   `json:"admin"`
+	ServiceAccount bool   `json:"service_account"`
+}
+
+// APIToken is a personal access token, or a token of a service account,
+// as shown by the API. The secret itself is only returned on creation.
+type APIToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	User       string     `json:"user"`
+	Scopes     []string   `json:"scopes"`
+	Prefix     string     `json:"prefix"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// TokenCreateRequest creates an API token for the current user, or for the
+// service account ServiceAccount (admin only). TTL (such as "720h") or
+// ExpiresAt sets its expiry.
+type TokenCreateRequest struct {
+	Name           string     `json:"name"`
+	Scopes         []string   `json:"scopes"`
+	TTL            string     `json:"ttl,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	ServiceAccount string     `json:"service_account,omitempty"`
+}
+
+// PasswordChangeRequest changes the current user's password
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// VMCreateRequest represents a VM creation request. CloudInit holds either
+// inline cloud-init YAML or the name of a cloud-init template.
 type VMCreateRequest struct {
+	Name      string   `json:"name"`
+	CPUs      int      `json:"cpus"`
+	Memory    string   `json:"memory"`
+	Disk      string   `json:"disk"`
+	Image     string   `json:"image"`
+	AgentID   *string  `json:"agent_id,omitempty"`
+	CloudInit string   `json:"cloud_init,omitempty"`
+	Networks  []string `json:"networks,omitempty"`
+	// Constraints are agent tags, such as {"gpu": "true"}, that the agent
+	// running the VM must carry; a "zone" constraint matches the agent's zone.
+	// Constrained VMs are never placed on the master.
+	Constraints map[string]string `json:"constraints,omitempty"`
+	// Zone places the VM on an agent in the named zone, like a "zone"
+	// constraint
+	Zone string `json:"zone,omitempty"`
+	// ExtraArgs are additional multipass launch flags from an allowlist,
+	// such as "--bridged" or "--timeout=600"
+	ExtraArgs []string `json:"extra_args,omitempty"`
+	// Master-side metadata recorded for the new VM
+	Project     string            `json:"project,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// TTL (a duration such as "8h") or ExpiresAt sets when the master's
+	// reaper applies ExpiryAction ("stop" or "delete", the default)
+	TTL          string     `json:"ttl,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	ExpiryAction string     `json:"expiry_action,omitempty"`
+	// Template names a VM template to launch from; the request's own fields
+	// override the template's
+	Template string `json:"template,omitempty"`
+	// ProvisionScript is run with bash as root once the VM is running;
+	// ProvisionTimeout bounds it in seconds
+	ProvisionScript  string `json:"provision_script,omitempty"`
+	ProvisionTimeout int    `json:"provision_timeout,omitempty"`
+}
+
+// HostSettingsRequest changes multipass daemon settings (`multipass set`) on
+// the master or on an agent
+type HostSettingsRequest struct {
+	AgentID  *string           `json:"agent_id,omitempty"`
+	Settings map[string]string `json:"settings"`
+}
+
+// Network is a host network interface that VMs can be bridged onto
+type Network struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+// Blueprint describes a multipass blueprint, a named recipe (e.g. docker,
+// minikube) that can be launched in place of an image
+type Blueprint struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+	Version string   `json:"version,omitempty"`
+}
+
+// VMBatchCreateRequest creates several VMs in one call, either from an explicit
+// list or as Count identical copies of the embedded request named
+// "<NamePrefix>-1" to "<NamePrefix>-<Count>"
+type VMBatchCreateRequest struct {
+	VMCreateRequest
+	Count      int               `json:"count,omitempty"`
+	NamePrefix string            `json:"name_prefix,omitempty"`
+	VMs        []VMCreateRequest `json:"vms,omitempty"`
+}
+
+// VMActionRequest represents a VM action request (start, stop, restart, delete).
+// DelayMinutes schedules a stop that many minutes ahead, warning logged-in users.
+type VMActionRequest struct {
+	Name         string  `json:"name"`
+	AgentID      *string `json:"agent_id,omitempty"`
+	Force        bool    `json:"force,omitempty"`
+	SoftDelete   bool    `json:"soft_delete,omitempty"`
+	DelayMinutes int     `json:"delay_minutes,omitempty"`
+}
+
+// VMBulkRequest applies one action to many VMs. Force and SoftDelete apply to
+// every target in addition to any set on the target itself.
+type VMBulkRequest struct {
+	Action     string            `json:"action"`
+	Targets    []VMActionRequest `json:"targets"`
+	Force      bool              `json:"force,omitempty"`
+	SoftDelete bool              `json:"soft_delete,omitempty"`
+}
+
+// VMResizeRequest represents a request to change a VM's resources. Zero or
+// empty fields are left unchanged.
+type VMResizeRequest struct {
 	Name    string  `json:"name"`
-	CPUs    int     `json:"cpus"`
-	Memory  string  `json:"memory"`
-	Disk    string  `json:"disk"`
-	Image   string  `json:"image"`
 	AgentID *string `json:"agent_id,omitempty"`
+	CPUs    int     `json:"cpus,omitempty"`
+	Memory  string  `json:"memory,omitempty"`
+	Disk    string  `json:"disk,omitempty"`
 }
 
-// VMActionRequest represents a VM action request (start, stop, delete)
-type VMActionRequest struct {
+// OperationPhase reports the outcome of one step of a multi-step VM operation
+// such as a resize or clone
+type OperationPhase struct {
+	Phase   string `json:"phase"`
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+}
+
+// VMCloneRequest represents a request to clone a VM. NewName is optional;
+// multipass picks "<name>-cloneN" when it is empty.
+type VMCloneRequest struct {
+	Name    string  `json:"name"`
+	AgentID *string `json:"agent_id,omitempty"`
+	NewName string  `json:"new_name,omitempty"`
+}
+
+// VMMountRequest represents a mount or unmount request. Source is a directory on
+// the host that runs the VM (the agent host for remote VMs); Target is the path
+// inside the VM. For unmount, an empty Target removes every mount of the VM.
+type VMMountRequest struct {
 	Name    string  `json:"name"`
 	AgentID *string `json:"agent_id,omitempty"`
+	Source  string  `json:"source,omitempty"`
+	Target  string  `json:"target,omitempty"`
+}
+
+// VMMount describes a host directory mounted into a VM
+type VMMount struct {
+	Source      string   `json:"source"`
+	Target      string   `json:"target"`
+	UIDMappings []string `json:"uid_mappings,omitempty"`
+	GIDMappings []string `json:"gid_mappings,omitempty"`
+}
+
+// VMTransferRequest describes a file transfer into (upload) or out of (download)
+// a VM. Path is the file path inside the VM; uploads carry the file as the
+// "file" part of a multipart body.
+type VMTransferRequest struct {
+	Name      string  `json:"name" form:"name"`
+	AgentID   *string `json:"agent_id,omitempty" form:"agent_id"`
+	Direction string  `json:"direction" form:"direction"`
+	Path      string  `json:"path" form:"path"`
 }
 
 // AgentRegisterRequest represents an agent registration request
@@ -31,25 +256,178 @@ type AgentRegisterRequest struct {
 	APIURL   string            `json:"api_url"`
 	APIKey   *string           `json:"api_key,omitempty"`
 	Tags     map[string]string `json:"tags,omitempty"`
+	Version  *HostVersion      `json:"version,omitempty"`
+	// Tunnel agents are reached over a tunnel they open to the master
+	// rather than at APIURL
+	Tunnel bool `json:"tunnel,omitempty"`
+	// Transport names the transport the master reaches the agent through;
+	// empty means the default HTTP transport
+	Transport string `json:"transport,omitempty"`
+	// Zone groups the agent with others, such as "office" or "dc1"
+	Zone string `json:"zone,omitempty"`
+	// Jobs reports that the agent runs long operations in its job queue
+	Jobs bool `json:"jobs,omitempty"`
 }
 
 // AgentInfo represents agent information
 type AgentInfo struct {
-	AgentID      string            `json:"agent_id"`
-	Hostname     string            `json:"hostname"`
-	APIURL       string            `json:"api_url"`
-	Status       string            `json:"status"`
-	LastSeen     *time.Time        `json:"last_seen,omitempty"`
-	Tags         map[string]string `json:"tags,omitempty"`
-	VMCount      int               `json:"vm_count"`
+	AgentID   string            `json:"agent_id"`
+	Hostname  string            `json:"hostname"`
+	APIURL    string            `json:"api_url"`
+	Status    string            `json:"status"`
+	LastSeen  *time.Time        `json:"last_seen,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	VMCount   int               `json:"vm_count"`
+	Version   *HostVersion      `json:"version,omitempty"`
+	Health    *HostHealth       `json:"health,omitempty"`
+	Resources *HostResources    `json:"resources,omitempty"`
+	// Tunnel and Transport say how the master reaches the agent
+	Tunnel    bool   `json:"tunnel,omitempty"`
+	Transport string `json:"transport,omitempty"`
+	// Jobs agents take long operations as jobs the master polls
+	Jobs bool `json:"jobs,omitempty"`
+	// Zone is the named group the agent belongs to, set at registration or
+	// by an admin
+	Zone string `json:"zone,omitempty"`
+	// Draining agents keep their VMs but are not given new ones
+	Draining  bool       `json:"draining"`
+	DrainedAt *time.Time `json:"drained_at,omitempty"`
 }
 
-// AgentHeartbeat represents an agent heartbeat
+// AgentApproval is an admin's decision on whether an agent may join the
+// fleet: "approved" or "rejected"
+type AgentApproval struct {
+	Decision  string    `json:"decision"`
+	DecidedBy string    `json:"decided_by"`
+	DecidedAt time.Time `json:"decided_at"`
+}
+
+// DepartedAgent is an agent archived after staying offline past the retention
+// period, with the VMs it was last known to run
+type DepartedAgent struct {
+	Agent      AgentInfo        `json:"agent"`
+	VMs        []VMInfoExtended `json:"vms"`
+	ArchivedAt time.Time        `json:"archived_at"`
+}
+
+// AgentZoneRequest moves an agent to a zone; an empty zone removes it from
+// its zone
+type AgentZoneRequest struct {
+	Zone string `json:"zone"`
+}
+
+// ZoneInfo summarizes the agents of a zone
+type ZoneInfo struct {
+	Name   string `json:"name"`
+	Agents int    `json:"agents"`
+	Online int    `json:"online"`
+	VMs    int    `json:"vms"`
+}
+
+// AgentKeyRotation carries the new API key the master pushes to an agent
+type AgentKeyRotation struct {
+	APIKey string `json:"api_key"`
+}
+
+// AgentDrainRequest drains an agent. VMAction says what happens to the VMs it
+// runs: "" leaves them alone and "stop" stops the running ones.
+type AgentDrainRequest struct {
+	VMAction string `json:"vm_action,omitempty"`
+}
+
+// AgentHeartbeat represents an agent heartbeat. VMs is the agent's full VM
+// listing with usage, or nil when the agent does not report it.
 type AgentHeartbeat struct {
-	AgentID   string    `json:"agent_id"`
-	Timestamp time.Time `json:"timestamp"`
-	Status    string    `json:"status"`
-	VMCount   int       `json:"vm_count"`
+	AgentID   string           `json:"agent_id"`
+	Timestamp time.Time        `json:"timestamp"`
+	Status    string           `json:"status"`
+	VMCount   int              `json:"vm_count"`
+	VMs       []VMInfoExtended `json:"vms"`
+	Version   *HostVersion     `json:"version,omitempty"`
+	Health    *HostHealth      `json:"health,omitempty"`
+	Resources *HostResources   `json:"resources,omitempty"`
+}
+
+// HostResources is the capacity an agent host has left for VMs. Memory and
+// disk sizes are in bytes; disk is the filesystem holding the multipass data
+// directory. Load holds the 1, 5 and 15 minute averages.
+type HostResources struct {
+	CPUCount    int       `json:"cpu_count"`
+	Load        []float64 `json:"load,omitempty"`
+	MemoryFree  int64     `json:"memory_free"`
+	MemoryTotal int64     `json:"memory_total"`
+	DiskFree    int64     `json:"disk_free"`
+	DiskTotal   int64     `json:"disk_total"`
+	CollectedAt time.Time `json:"collected_at"`
+}
+
+// ReadinessCheck is the outcome of one of the master's readiness checks
+type ReadinessCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// HostHealth reports whether multipass works on a host, as last checked with
+// `multipass version`. Status is "healthy", "degraded" when the daemon does not
+// answer, "unavailable" when multipass is not installed, or "unknown".
+type HostHealth struct {
+	Status          string       `json:"status"`
+	DaemonReachable bool         `json:"daemon_reachable"`
+	Error           string       `json:"error,omitempty"`
+	Version         *HostVersion `json:"version,omitempty"`
+	CheckedAt       time.Time    `json:"checked_at"`
+}
+
+// HostVersion reports the multipass release and driver on a host, as given by
+// `multipass version` and `multipass get local.driver`
+type HostVersion struct {
+	Multipass   string   `json:"multipass"`
+	Multipassd  string   `json:"multipassd,omitempty"`
+	Driver      string   `json:"driver,omitempty"`
+	Unsupported []string `json:"unsupported_features,omitempty"`
+}
+
+// HostStorage reports the disk multipass uses on a host: the filesystem
+// holding its data directory, each instance's disk files and the cached
+// images. Parts that could not be read are described in Errors.
+type HostStorage struct {
+	DataDir        string            `json:"data_dir"`
+	Filesystem     *ResourceUsage    `json:"filesystem,omitempty"`
+	InstancesBytes int64             `json:"instances_bytes"`
+	ImagesBytes    int64             `json:"images_bytes"`
+	Instances      []InstanceStorage `json:"instances"`
+	Images         []CachedImage     `json:"images"`
+	Errors         []string          `json:"errors,omitempty"`
+}
+
+// InstanceStorage is the space one instance's files take
+type InstanceStorage struct {
+	Name      string `json:"name"`
+	State     string `json:"state,omitempty"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// CachedImage is an image in the multipass image cache. Images the daemon no
+// longer tracks, such as interrupted downloads, are not Tracked.
+type CachedImage struct {
+	Name       string    `json:"name"`
+	Release    string    `json:"release,omitempty"`
+	SizeBytes  int64     `json:"size_bytes"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Tracked    bool      `json:"tracked"`
+}
+
+// HostPruneRequest asks to reclaim multipass disk space on a host
+type HostPruneRequest struct {
+	AgentID *string `json:"agent_id,omitempty"`
+}
+
+// HostPruneResult reports what a prune removed
+type HostPruneResult struct {
+	PurgedInstances []string `json:"purged_instances"`
+	RemovedImages   []string `json:"removed_images"`
+	FreedBytes      int64    `json:"freed_bytes"`
+	Errors          []string `json:"errors,omitempty"`
 }
 
 // RemoteCommandRequest represents a remote command execution request
@@ -59,6 +437,47 @@ type RemoteCommandRequest struct {
 	Timeout int      `json:"timeout"`
 }
 
+// VMExecRequest represents a request to run a command inside a VM. Timeout is in
+// seconds; zero uses the default. Env is injected into the command's environment
+// and User, if set, runs the command as that user inside the VM. Alias runs a
+// multipass alias defined on the VM's host instead of Command, with Args after
+// the alias's own. Artifacts lists paths in the VM to collect into the artifact
+// store once the command succeeds.
+type VMExecRequest struct {
+	Name       string            `json:"name"`
+	AgentID    *string           `json:"agent_id,omitempty"`
+	Command    string            `json:"command"`
+	Alias      string            `json:"alias,omitempty"`
+	Args       []string          `json:"args,omitempty"`
+	Timeout    int               `json:"timeout,omitempty"`
+	WorkingDir string            `json:"working_dir,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	User       string            `json:"user,omitempty"`
+	Artifacts  []string          `json:"artifacts,omitempty"`
+}
+
+// Artifact describes a file collected from a VM and kept in the artifact store
+type Artifact struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	VMName    string    `json:"vm_name"`
+	AgentID   string    `json:"agent_id,omitempty"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Backend   string    `json:"backend"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ArtifactResult reports the collection of one declared artifact path
+type ArtifactResult struct {
+	Path     string    `json:"path"`
+	Success  bool      `json:"success"`
+	Artifact *Artifact `json:"artifact,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
 // RemoteCommandResponse represents a remote command execution response
 type RemoteCommandResponse struct {
 	Success    bool    `json:"success"`
@@ -68,17 +487,536 @@ type RemoteCommandResponse struct {
 	Error      *string `json:"error,omitempty"`
 }
 
+// VMExecResponse is an exec result together with the artifacts it produced.
+// Execs that ask for no artifacts are answered without the artifacts field.
+type VMExecResponse struct {
+	RemoteCommandResponse
+	Artifacts []ArtifactResult `json:"artifacts"`
+}
+
 // VMInfoExtended represents extended VM info with agent information
 type VMInfoExtended struct {
-	Name          string   `json:"name"`
-	State         string   `json:"state"`
-	IPv4          []string `json:"ipv4,omitempty"`
-	Release       string   `json:"release,omitempty"`
-	AgentID       *string  `json:"agent_id,omitempty"`
-	AgentHostname *string  `json:"agent_hostname,omitempty"`
+	Name          string         `json:"name"`
+	State         string         `json:"state"`
+	IPv4          []string       `json:"ipv4,omitempty"`
+	Release       string         `json:"release,omitempty"`
+	AgentID       *string        `json:"agent_id"`
+	AgentHostname *string        `json:"agent_hostname"`
+	CPUCount      int            `json:"cpu_count,omitempty"`
+	Load          []float64      `json:"load,omitempty"`
+	DiskUsage     *ResourceUsage `json:"disk_usage,omitempty"`
+	MemoryUsage   *ResourceUsage `json:"memory_usage,omitempty"`
+}
+
+// ResourceUsage is how much of a VM resource is in use, in bytes
+type ResourceUsage struct {
+	Used  int64 `json:"used"`
+	Total int64 `json:"total"`
+}
+
+// VMListing is one entry of the VM list: what the VM's host reports, with the
+// master's metadata for it
+type VMListing struct {
+	VMInfoExtended
+	Metadata *VMMetadata `json:"metadata"`
+}
+
+// VMList is the result of listing the VMs on one host. Executors fill in only
+// the fields `multipass list` reports; the agent and usage fields are added by
+// callers that merge several hosts.
+type VMList struct {
+	VMs []VMInfoExtended `json:"list"`
+}
+
+// VMStateChange is a VM whose state changed between two listings of a host.
+// Previous is empty for a VM that appeared and State is empty for one that
+// disappeared.
+type VMStateChange struct {
+	Name     string `json:"name"`
+	Previous string `json:"previous"`
+	State    string `json:"state"`
+}
+
+// AgentVMReport is what an agent pushes to the master when its VMs change: the
+// changes it saw and its full listing afterwards
+type AgentVMReport struct {
+	AgentID string           `json:"agent_id"`
+	Changes []VMStateChange  `json:"changes"`
+	VMs     []VMInfoExtended `json:"vms"`
+}
+
+// AgentDeregisterRequest is what an agent sends the master as it shuts down,
+// so it is marked offline at once
+type AgentDeregisterRequest struct {
+	AgentID string `json:"agent_id"`
+}
+
+// HostListing reports how listing one host's VMs went in a fleet-wide
+// listing. AgentID is nil for the master; Error is set when the host did not
+// answer in time or failed. CachedAt is set when the host's VMs came from the
+// inventory cache, and Stale when that listing is being refreshed.
+type HostListing struct {
+	AgentID  *string    `json:"agent_id"`
+	Hostname string     `json:"hostname"`
+	VMCount  int        `json:"vm_count"`
+	CachedAt *time.Time `json:"cached_at,omitempty"`
+	Stale    bool       `json:"stale,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// VMDetail is what `multipass info` reports about one VM. Disk and memory
+// sizes are in bytes; stopped VMs report no usage.
+type VMDetail struct {
+	Name          string                   `json:"name"`
+	State         string                   `json:"state"`
+	IPv4          []string                 `json:"ipv4"`
+	Release       string                   `json:"release,omitempty"`
+	ImageRelease  string                   `json:"image_release,omitempty"`
+	ImageHash     string                   `json:"image_hash,omitempty"`
+	CPUCount      int                      `json:"cpu_count,omitempty"`
+	Load          []float64                `json:"load,omitempty"`
+	Disks         map[string]ResourceUsage `json:"disks,omitempty"`
+	Memory        *ResourceUsage           `json:"memory,omitempty"`
+	Mounts        []VMMount                `json:"mounts"`
+	SnapshotCount int                      `json:"snapshot_count"`
+}
+
+// VMInfo is a VM's details with the master's metadata for it
+type VMInfo struct {
+	*VMDetail
+	Metadata *VMMetadata `json:"metadata"`
+}
+
+// OperationResult reports the outcome of a VM operation on one host. Message
+// explains a failure, or carries multipass's output on success. Multi-step
+// operations report their Phases; clones also report the new VM, how it was
+// made and its state.
+type OperationResult struct {
+	Success bool             `json:"success"`
+	Message string           `json:"message,omitempty"`
+	Phases  []OperationPhase `json:"phases,omitempty"`
+	VMName  string           `json:"vm_name,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	State   string           `json:"state,omitempty"`
+	Warning string           `json:"warning,omitempty"`
+}
+
+// VMMetadata represents master-side metadata for a VM that multipass does not track
+type VMMetadata struct {
+	AgentID      string            `json:"agent_id"`
+	Name         string            `json:"name"`
+	Owner        string            `json:"owner,omitempty"`
+	Project      string            `json:"project,omitempty"`
+	Description  string            `json:"description,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Source       string            `json:"source,omitempty"`
+	CreatedBy    string            `json:"created_by,omitempty"`
+	CreatedAt    *time.Time        `json:"created_at,omitempty"`
+	ImportedAt   *time.Time        `json:"imported_at,omitempty"`
+	ExpiresAt    *time.Time        `json:"expires_at,omitempty"`
+	ExpiryAction string            `json:"expiry_action,omitempty"`
+	// SharedWith lists users the owner has granted access to the VM
+	SharedWith []string `json:"shared_with,omitempty"`
+}
+
+// VMShareRequest grants a user access to a VM
+type VMShareRequest struct {
+	AgentID  *string `json:"agent_id,omitempty"`
+	Username string  `json:"username"`
+}
+
+// VMMetadataRequest updates a VM's metadata. Nil fields are left unchanged;
+// labels with an empty value are removed.
+type VMMetadataRequest struct {
+	Name        string            `json:"name"`
+	AgentID     *string           `json:"agent_id,omitempty"`
+	Owner       *string           `json:"owner,omitempty"`
+	Project     *string           `json:"project,omitempty"`
+	Description *string           `json:"description,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// TTL or ExpiresAt reschedules expiry; a TTL of "0" cancels it
+	TTL          string     `json:"ttl,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	ExpiryAction string     `json:"expiry_action,omitempty"`
+}
+
+// ImportRule maps VMs whose names match Pattern (shell glob) to an owner, project and labels
+type ImportRule struct {
+	Pattern string            `json:"pattern"`
+	Owner   string            `json:"owner,omitempty"`
+	Project string            `json:"project,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// AgentImportRequest represents a request to import an agent's existing VMs
+type AgentImportRequest struct {
+	Owner     string            `json:"owner,omitempty"`
+	Project   string            `json:"project,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Rules     []ImportRule      `json:"rules,omitempty"`
+	Overwrite bool              `json:"overwrite,omitempty"`
+}
+
+// Notification represents a message delivered to a user
+type Notification struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Kind      string    `json:"kind"`
+	Subject   string    `json:"subject"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MaintenanceWindow represents a recurring maintenance window for an agent or a zone.
+// Days lists weekdays (mon..sun) the window recurs on; empty means every day.
+type MaintenanceWindow struct {
+	ID              string    `json:"id"`
+	AgentID         string    `json:"agent_id,omitempty"`
+	Zone            string    `json:"zone,omitempty"`
+	Days            []string  `json:"days,omitempty"`
+	Start           string    `json:"start"`
+	DurationMinutes int       `json:"duration_minutes"`
+	Timezone        string    `json:"timezone,omitempty"`
+	Description     string    `json:"description,omitempty"`
+	CreatedBy       string    `json:"created_by,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// StackCreateRequest describes a stack: a named group of VMs created together.
+// Each group launches Count VMs from the same template; the VMs are named
+// <stack>-<role>-<n>.
+type StackCreateRequest struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Groups      []StackGroup `json:"groups"`
+}
+
+// StackGroup is one template within a stack. The embedded create request
+// supplies the size, image, cloud-init and optional placement of its VMs.
+type StackGroup struct {
+	Role  string `json:"role"`
+	Count int    `json:"count"`
+	VMCreateRequest
+}
+
+// Stack is a named group of VMs that the master manages as one unit, whatever
+// agents its members were placed on
+type Stack struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Members     []StackMember `json:"members"`
+	CreatedBy   string        `json:"created_by,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+}
+
+// StackMember is one VM of a stack
+type StackMember struct {
+	AgentID string `json:"agent_id,omitempty"`
+	VMName  string `json:"vm_name"`
+	Role    string `json:"role"`
+}
+
+// PowerSchedule runs VM lifecycle actions on cron-style schedules. It targets
+// one VM by name, or every VM whose metadata labels match Selector.
+type PowerSchedule struct {
+	ID          string            `json:"id"`
+	Description string            `json:"description,omitempty"`
+	AgentID     string            `json:"agent_id,omitempty"`
+	VMName      string            `json:"vm_name,omitempty"`
+	Selector    map[string]string `json:"selector,omitempty"`
+	Rules       []ScheduleRule    `json:"rules"`
+	Timezone    string            `json:"timezone,omitempty"`
+	CreatedBy   string            `json:"created_by,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	LastRun     *ScheduleRun      `json:"last_run,omitempty"`
+}
+
+// ScheduleRule applies Action ("start", "stop", "suspend" or "restart") at the
+// times matched by Cron, such as "0 20 * * 1-5"
+type ScheduleRule struct {
+	Action string `json:"action"`
+	Cron   string `json:"cron"`
+}
+
+// ScheduleRun records the most recent execution of a power schedule
+type ScheduleRun struct {
+	Time    time.Time           `json:"time"`
+	Action  string              `json:"action"`
+	Results []ScheduleRunResult `json:"results"`
+}
+
+// ScheduleRunResult is the outcome of a scheduled action on one VM
+type ScheduleRunResult struct {
+	AgentID string `json:"agent_id,omitempty"`
+	VMName  string `json:"vm_name"`
+	Success bool   `json:"success"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// DigestItem represents one finding in a digest report
+type DigestItem struct {
+	Kind    string `json:"kind"`
+	AgentID string `json:"agent_id,omitempty"`
+	VMName  string `json:"vm_name,omitempty"`
+	Owner   string `json:"owner,omitempty"`
+	Project string `json:"project,omitempty"`
+	Detail  string `json:"detail"`
+}
+
+// Digest represents a periodic report of expiring, idle and orphaned resources,
+// grouped by owning user and by project
+type Digest struct {
+	GeneratedAt time.Time               `json:"generated_at"`
+	Users       map[string][]DigestItem `json:"users"`
+	Projects    map[string][]DigestItem `json:"projects"`
+	Unowned     []DigestItem            `json:"unowned"`
 }
 
 // Session represents a user session
 type Session struct {
-	Username string `json:"username"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AccessLogEntry is one persisted API access record. Token names the API token
+// or service account used, when the request was not made with a session.
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user,omitempty"`
+	Token     string    `json:"token,omitempty"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	Path      string    `json:"path"`
+	AgentID   string    `json:"agent_id,omitempty"`
+	VMName    string    `json:"vm_name,omitempty"`
+	Status    int       `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+	IP        string    `json:"ip"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// Event records a change to a VM or agent. IDs increase by one per event and
+// serve as cursors for clients following the event log.
+type Event struct {
+	ID      int64             `json:"id"`
+	Time    time.Time         `json:"time"`
+	Type    string            `json:"type"`
+	AgentID string            `json:"agent_id,omitempty"`
+	VMName  string            `json:"vm_name,omitempty"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+// LaunchProgress is one progress update from a running VM launch. Percent is
+// set for stages that report it, such as downloading the image.
+type LaunchProgress struct {
+	Stage   string `json:"stage"`
+	Percent *int   `json:"percent,omitempty"`
+	Message string `json:"message"`
+}
+
+// AgentJobRequest queues a long operation on an agent. Kind is "create",
+// "clone" or "resize" and Payload is the request the operation's own endpoint
+// takes. Uploads are queued with a multipart form instead.
+type AgentJobRequest struct {
+	Kind    string          `json:"kind"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// AgentJob is a long operation running in an agent's job queue. State is
+// "queued", "running", "succeeded" or "failed"; Result is set once it is
+// done, and Progress carries the latest launch update of a create.
+type AgentJob struct {
+	ID         string           `json:"id"`
+	Kind       string           `json:"kind"`
+	State      string           `json:"state"`
+	Progress   *LaunchProgress  `json:"progress,omitempty"`
+	Result     *OperationResult `json:"result,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+	StartedAt  *time.Time       `json:"started_at,omitempty"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+}
+
+// Task is a mutating VM operation the master runs on behalf of a user. State
+// is "pending", "running", "succeeded" or "failed". Status and Result are the
+// HTTP status and response body of the operation once it is done.
+type Task struct {
+	ID         string          `json:"id"`
+	Operation  string          `json:"operation"`
+	User       string          `json:"user"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	AgentID    string          `json:"agent_id,omitempty"`
+	VMName     string          `json:"vm_name,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	State      string          `json:"state"`
+	Status     int             `json:"status,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Logs       []TaskLog       `json:"logs"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// TaskLog is a line of a task's log
+type TaskLog struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Defaults are the targets the master falls back on, mirroring multipass's
+// primary instance. Lifecycle, exec and terminal requests that omit a VM name
+// act on the primary VM; new VMs without a placement go to the default agent.
+// A nil PrimaryAgentID means the primary VM is on the master, and a nil
+// DefaultAgentID leaves placement to the scheduler. SSHKeys are authorized
+// for the default user of every new VM through cloud-init.
+type Defaults struct {
+	PrimaryVM      string     `json:"primary_vm"`
+	PrimaryAgentID *string    `json:"primary_agent_id"`
+	DefaultAgentID *string    `json:"default_agent_id"`
+	SSHKeys        []string   `json:"ssh_keys"`
+	UpdatedBy      string     `json:"updated_by,omitempty"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty"`
+}
+
+// Quota caps what a user or an agent may have: the number of VMs, and the
+// CPUs and memory (a size such as "16G") of those VMs. Zero or empty limits
+// are unlimited.
+type Quota struct {
+	MaxVMs    int        `json:"max_vms,omitempty"`
+	MaxCPUs   int        `json:"max_cpus,omitempty"`
+	MaxMemory string     `json:"max_memory,omitempty"`
+	UpdatedBy string     `json:"updated_by,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// Quotas are the quotas set per user (by username) and per agent (by agent ID)
+type Quotas struct {
+	Users  map[string]Quota `json:"users"`
+	Agents map[string]Quota `json:"agents"`
+}
+
+// QuotaUsage is how much of its quota a user or agent has in use. Memory is
+// in bytes.
+type QuotaUsage struct {
+	VMs    int   `json:"vms"`
+	CPUs   int   `json:"cpus"`
+	Memory int64 `json:"memory"`
+}
+
+// QuotaViolation is one limit a new VM would exceed. Scope is "user" or
+// "agent", Subject the username or agent ID, and Resource "vms", "cpus" or
+// "memory" (in bytes).
+type QuotaViolation struct {
+	Scope     string `json:"scope"`
+	Subject   string `json:"subject"`
+	Resource  string `json:"resource"`
+	Limit     int64  `json:"limit"`
+	Used      int64  `json:"used"`
+	Requested int64  `json:"requested"`
+}
+
+// AuthorizeKeyRequest adds a public key to a user's authorized_keys in a VM
+type AuthorizeKeyRequest struct {
+	AgentID   *string `json:"agent_id,omitempty"`
+	PublicKey string  `json:"public_key"`
+	User      string  `json:"user,omitempty"`
+}
+
+// VMTemplate is a named launch profile defined by admins. Users create VMs
+// from it by name and may override any of its fields.
+type VMTemplate struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	CPUs        int               `json:"cpus,omitempty"`
+	Memory      string            `json:"memory,omitempty"`
+	Disk        string            `json:"disk,omitempty"`
+	Image       string            `json:"image,omitempty"`
+	CloudInit   string            `json:"cloud_init,omitempty"`
+	Networks    []string          `json:"networks,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	CreatedBy   string            `json:"created_by,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+// VMConnection describes how to reach a VM over SSH. Addresses of VMs on an
+// agent are on that agent's network; JumpHost and Reachability say so.
+type VMConnection struct {
+	Name         string   `json:"name"`
+	State        string   `json:"state"`
+	AgentID      *string  `json:"agent_id"`
+	IPv4         []string `json:"ipv4"`
+	IPv6         []string `json:"ipv6"`
+	User         string   `json:"user"`
+	SSHCommand   string   `json:"ssh_command,omitempty"`
+	JumpHost     string   `json:"jump_host,omitempty"`
+	Reachability string   `json:"reachability"`
+}
+
+// PortForwardRequest asks for a TCP forward from a port of the host running a
+// VM to a port inside it. A zero HostPort picks a free port.
+type PortForwardRequest struct {
+	Name      string  `json:"name"`
+	AgentID   *string `json:"agent_id,omitempty"`
+	GuestPort int     `json:"guest_port"`
+	HostPort  int     `json:"host_port,omitempty"`
+	CreatedBy string  `json:"created_by,omitempty"`
+}
+
+// PortForward is a running TCP forward. HostAddress and HostPort are where it
+// listens on the master or agent; connections go on to GuestIP:GuestPort.
+type PortForward struct {
+	ID                string    `json:"id"`
+	VMName            string    `json:"vm_name"`
+	AgentID           *string   `json:"agent_id"`
+	HostAddress       string    `json:"host_address"`
+	HostPort          int       `json:"host_port"`
+	GuestIP           string    `json:"guest_ip"`
+	GuestPort         int       `json:"guest_port"`
+	CreatedBy         string    `json:"created_by,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	ActiveConnections int       `json:"active_connections"`
+}
+
+// Error codes of ErrorResponse. The generic codes follow the HTTP status; the
+// others name a cause clients may act on.
+const (
+	ErrCodeInvalidRequest         = "invalid_request"
+	ErrCodeUnauthorized           = "unauthorized"
+	ErrCodeForbidden              = "forbidden"
+	ErrCodeNotFound               = "not_found"
+	ErrCodeConflict               = "conflict"
+	ErrCodeRequestTooLarge        = "request_too_large"
+	ErrCodeUpgradeRequired        = "upgrade_required"
+	ErrCodeInternal               = "internal_error"
+	ErrCodeNotImplemented         = "not_implemented"
+	ErrCodeUpstream               = "upstream_error"
+	ErrCodeUnavailable            = "unavailable"
+	ErrCodeTimeout                = "timeout"
+	ErrCodePasswordChangeRequired = "password_change_required"
+	ErrCodeQuotaExceeded          = "quota_exceeded"
+	ErrCodeAgentBusy              = "agent_busy"
+	ErrCodeVMNotFound             = "vm_not_found"
+	ErrCodeVMAlreadyExists        = "vm_already_exists"
+	ErrCodeVMAlreadyRunning       = "vm_already_running"
+	ErrCodeMultipassUnavailable   = "multipass_unavailable"
+	ErrCodeCommandNotAllowed      = "command_not_allowed"
+)
+
+// ErrorResponse is the body of every error response from the master and
+// agents. Details carries structured context, such as quota violations;
+// RequestID identifies the request in the server's logs.
+type ErrorResponse struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// Error returns the message, so an agent's error response can be passed on
+// as an error
+func (e *ErrorResponse) Error() string {
+	return e.Message
 }
@@ -0,0 +1,108 @@
+package multipass
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// blueprintCacheTTL bounds how often multipass find, which hits the network, runs
+const blueprintCacheTTL = 10 * time.Minute
+
+// blueprintCache holds the result of ListBlueprints
+type blueprintCache struct {
+	blueprints []models.Blueprint
+	fetchedAt  time.Time
+	mutex      sync.Mutex
+}
+
+// ParseBlueprints extracts blueprints from `multipass find --format json` output.
+// Newer multipass releases list them under "blueprints (deprecated)".
+func ParseBlueprints(output string) ([]models.Blueprint, error) {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(output), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %s", err)
+	}
+
+	blueprints := []models.Blueprint{}
+	for key, raw := range data {
+		if !strings.HasPrefix(key, "blueprints") {
+			continue
+		}
+		var entries map[string]struct {
+			Aliases []string `json:"aliases"`
+			Version string   `json:"version"`
+		}
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse blueprints: %s", err)
+		}
+		for name, entry := range entries {
+			blueprints = append(blueprints, models.Blueprint{
+				Name:    name,
+				Aliases: entry.Aliases,
+				Version: entry.Version,
+			})
+		}
+	}
+	sort.Slice(blueprints, func(i, j int) bool { return blueprints[i].Name < blueprints[j].Name })
+
+	return blueprints, nil
+}
+
+// ListBlueprints lists the blueprints available on this host
+func (r *Runner) ListBlueprints(ctx context.Context) ([]models.Blueprint, error) {
+	r.blueprints.mutex.Lock()
+	defer r.blueprints.mutex.Unlock()
+
+	if r.blueprints.blueprints != nil && time.Since(r.blueprints.fetchedAt) < blueprintCacheTTL {
+		return r.blueprints.blueprints, nil
+	}
+
+	result := r.RunMultipassCommand(ctx, []string{"find", "--format", "json"})
+	if !result.Success {
+		return nil, fmt.Errorf("%s", result.Error)
+	}
+	blueprints, err := ParseBlueprints(result.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	r.blueprints.blueprints = blueprints
+	r.blueprints.fetchedAt = time.Now()
+	return blueprints, nil
+}
+
+// MatchBlueprint reports whether image names one of the blueprints or its aliases
+func MatchBlueprint(blueprints []models.Blueprint, image string) bool {
+	for _, blueprint := range blueprints {
+		if blueprint.Name == image {
+			return true
+		}
+		for _, alias := range blueprint.Aliases {
+			if alias == image {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BlueprintNotes extracts the instructions a blueprint prints after launching,
+// dropping blank lines and the standard "Launched:" line
+func BlueprintNotes(output string) []string {
+	notes := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "Launched:") {
+			continue
+		}
+		notes = append(notes, line)
+	}
+	return notes
+}
@@ -0,0 +1,151 @@
+package multipass
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// Clone methods
+const (
+	// CloneMethodClone copies the VM, disk included, with multipass clone
+	CloneMethodClone = "clone"
+	// CloneMethodLaunch launches a fresh VM with the source's image and
+	// resources on multipass releases that predate clone; disk contents are
+	// not copied
+	CloneMethodLaunch = "launch"
+)
+
+var clonedNamePattern = regexp.MustCompile(`Cloned from \S+ to (\S+?)\.?\s*$`)
+
+// CloneResult reports the outcome of a clone
+type CloneResult struct {
+	Name    string
+	Method  string
+	Success bool
+	Phases  []models.OperationPhase
+}
+
+// Clone clones a VM on this host. multipass clone needs the source stopped,
+// so a running source is stopped first and started again afterwards.
+func (r *Runner) Clone(ctx context.Context, req models.VMCloneRequest) CloneResult {
+	log := &phaseLog{runner: r}
+	clone := CloneResult{Name: req.NewName, Method: CloneMethodClone}
+
+	if req.NewName != "" {
+		if err := ValidateVMName(req.NewName); err != nil {
+			log.fail("inspect", err)
+			clone.Phases = log.phases
+			return clone
+		}
+	}
+
+	state, err := r.GetState(ctx, req.Name)
+	if err != nil {
+		log.fail("inspect", err)
+		clone.Phases = log.phases
+		return clone
+	}
+
+	wasRunning := state != "Stopped"
+	if wasRunning && !log.run(ctx, "stop source", []string{"stop", req.Name}) {
+		clone.Phases = log.phases
+		return clone
+	}
+
+	args := []string{"clone", req.Name}
+	if req.NewName != "" {
+		args = append(args, "--name", req.NewName)
+	}
+	result := r.RunMultipassCommand(ctx, args)
+
+	switch {
+	case result.Success:
+		log.phases = append(log.phases, models.OperationPhase{Phase: "clone", Success: true, Message: strings.TrimSpace(result.Output)})
+		if match := clonedNamePattern.FindStringSubmatch(strings.TrimSpace(result.Output)); match != nil {
+			clone.Name = match[1]
+		}
+		clone.Success = true
+	case cloneUnsupported(result.Output):
+		clone.Method = CloneMethodLaunch
+		if clone.Name == "" {
+			clone.Name = req.Name + "-clone"
+		}
+		clone.Success = r.launchLike(ctx, log, req.Name, clone.Name)
+	default:
+		log.phases = append(log.phases, models.OperationPhase{Phase: "clone", Success: false, Message: strings.TrimSpace(result.Output + " " + result.Error)})
+	}
+
+	if wasRunning && !log.run(ctx, "start source", []string{"start", req.Name}) {
+		clone.Success = false
+	}
+
+	clone.Phases = log.phases
+	return clone
+}
+
+// cloneUnsupported reports whether multipass rejected clone as an unknown command
+func cloneUnsupported(output string) bool {
+	return strings.Contains(strings.ToLower(output), "unknown command")
+}
+
+// launchLike launches a new VM with the image and resources of an existing one
+func (r *Runner) launchLike(ctx context.Context, log *phaseLog, source, name string) bool {
+	image, err := r.imageRelease(ctx, source)
+	if err != nil {
+		log.fail("inspect image", err)
+		return false
+	}
+
+	req := models.VMCreateRequest{Name: name, Image: image}
+	for key, dest := range map[string]*string{"memory": &req.Memory, "disk": &req.Disk} {
+		result := r.RunMultipassCommand(ctx, []string{"get", fmt.Sprintf("local.%s.%s", source, key)})
+		if result.Success {
+			*dest = strings.TrimSpace(result.Output)
+		}
+	}
+	result := r.RunMultipassCommand(ctx, []string{"get", fmt.Sprintf("local.%s.cpus", source)})
+	if result.Success {
+		fmt.Sscanf(strings.TrimSpace(result.Output), "%d", &req.CPUs)
+	}
+
+	return log.run(ctx, "launch", BuildLaunchArgs(req, ""))
+}
+
+// imageRelease gets the image a VM was launched from, e.g. "22.04"
+func (r *Runner) imageRelease(ctx context.Context, vmName string) (string, error) {
+	detail, err := r.Info(ctx, vmName)
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(detail.ImageRelease)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("image of VM %s is unknown", vmName)
+	}
+	return fields[0], nil
+}
+
+// CloneResponse builds the result of a clone, including the new VM's state
+func (r *Runner) CloneResponse(ctx context.Context, clone CloneResult) *models.OperationResult {
+	response := &models.OperationResult{
+		Success: clone.Success,
+		VMName:  clone.Name,
+		Method:  clone.Method,
+		Phases:  clone.Phases,
+	}
+	if clone.Success {
+		if state, err := r.GetState(ctx, clone.Name); err == nil {
+			response.State = state
+		}
+		if clone.Method == CloneMethodLaunch {
+			response.Warning = "multipass clone is unavailable on this host; a fresh VM was launched with the same image and resources, without the source's disk contents"
+		}
+	} else {
+		response.Message = "Failed to clone VM"
+	}
+	return response
+}
@@ -0,0 +1,90 @@
+package multipass
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// DefaultCommands are the multipass subcommands an agent runs for raw
+// command requests by default: those that only read
+var DefaultCommands = []string{"version", "list", "info", "find", "networks", "get", "aliases"}
+
+// knownCommands are the multipass subcommands a command policy may allow.
+// shell is left out, as it needs a terminal.
+var knownCommands = map[string]bool{
+	"alias": true, "aliases": true, "authenticate": true, "clone": true,
+	"delete": true, "exec": true, "find": true, "get": true, "info": true,
+	"launch": true, "list": true, "mount": true, "networks": true,
+	"purge": true, "recover": true, "restart": true, "restore": true,
+	"resume": true, "set": true, "snapshot": true, "start": true,
+	"stop": true, "suspend": true, "transfer": true, "umount": true,
+	"unalias": true, "version": true,
+}
+
+// ErrCommandsDisabled is returned for raw command requests to an agent that
+// does not run them
+var ErrCommandsDisabled = errors.New("raw command execution is disabled on this agent")
+
+// CommandPolicy decides which raw multipass commands an agent runs, so a
+// leaked API key cannot run whatever it likes
+type CommandPolicy struct {
+	disabled bool
+	allowed  map[string]bool
+}
+
+// NewCommandPolicy allows the comma separated multipass subcommands in
+// commands, or none when disabled
+func NewCommandPolicy(commands string, disabled bool) (*CommandPolicy, error) {
+	policy := &CommandPolicy{disabled: disabled, allowed: make(map[string]bool)}
+	for _, command := range strings.Split(commands, ",") {
+		command = strings.TrimSpace(command)
+		if command == "" {
+			continue
+		}
+		if !knownCommands[command] {
+			return nil, fmt.Errorf("unknown multipass command: %s", command)
+		}
+		policy.allowed[command] = true
+	}
+	return policy, nil
+}
+
+// Allowed lists the allowed subcommands, or nothing when disabled
+func (p *CommandPolicy) Allowed() []string {
+	allowed := []string{}
+	if p.disabled {
+		return allowed
+	}
+	for command := range p.allowed {
+		allowed = append(allowed, command)
+	}
+	sort.Strings(allowed)
+	return allowed
+}
+
+// Validate checks a raw command request runs an allowed multipass subcommand
+// and does not act on every VM at once
+func (p *CommandPolicy) Validate(req models.RemoteCommandRequest) error {
+	if p.disabled {
+		return ErrCommandsDisabled
+	}
+	if req.Command != "" && req.Command != "multipass" {
+		return fmt.Errorf("only multipass commands can be run, not %q", req.Command)
+	}
+	if len(req.Args) == 0 {
+		return fmt.Errorf("no multipass command given")
+	}
+	if !p.allowed[req.Args[0]] {
+		return fmt.Errorf("multipass %s is not allowed on this agent; allowed: %s", req.Args[0], strings.Join(p.Allowed(), ", "))
+	}
+	for _, arg := range req.Args[1:] {
+		if arg == "--all" || strings.HasPrefix(arg, "--all=") {
+			return fmt.Errorf("--all is not allowed; name the VMs instead")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package multipass
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// defaultUser is the account multipass creates in Ubuntu images
+const defaultUser = "ubuntu"
+
+// ipv6Timeout bounds the in-guest lookup of IPv6 addresses, in seconds
+const ipv6Timeout = 10
+
+// DefaultUser returns the account to connect to VMs as, VM_DEFAULT_USER or
+// "ubuntu"
+func DefaultUser() string {
+	if user := strings.TrimSpace(os.Getenv("VM_DEFAULT_USER")); user != "" {
+		return user
+	}
+	return defaultUser
+}
+
+// IPv6Request builds the exec request that lists a VM's global IPv6
+// addresses. multipass info only reports IPv4, so they are read in the guest.
+func IPv6Request(vmName string) models.VMExecRequest {
+	return models.VMExecRequest{
+		Name:    vmName,
+		Command: "ip",
+		Args:    []string{"-6", "-o", "addr", "show", "scope", "global"},
+		Timeout: ipv6Timeout,
+	}
+}
+
+// ParseIPv6 reads the addresses from `ip -6 -o addr` output, dropping their
+// prefix lengths
+func ParseIPv6(output string) []string {
+	addresses := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "inet6" {
+				address, _, _ := strings.Cut(fields[i+1], "/")
+				addresses = append(addresses, address)
+				break
+			}
+		}
+	}
+	return addresses
+}
+
+// ValidUser reports whether user is a plain login name
+func ValidUser(user string) bool {
+	return userNamePattern.MatchString(user)
+}
+
+// SSHCommand builds an ssh command line for user at address. A non-empty
+// jumpHost connects through that host, for VMs only reachable from it.
+func SSHCommand(user, address, jumpHost string) string {
+	if jumpHost != "" {
+		return fmt.Sprintf("ssh -J %s %s@%s", jumpHost, user, address)
+	}
+	return fmt.Sprintf("ssh %s@%s", user, address)
+}
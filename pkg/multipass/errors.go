@@ -0,0 +1,26 @@
+package multipass
+
+import (
+	"strings"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// ErrorCode classifies a failure multipass reported by its cause, returning
+// "" for failures it does not recognise
+func ErrorCode(message string) string {
+	lower := strings.ToLower(message)
+	switch {
+	case message == errDaemonUnreachable || strings.Contains(lower, "multipass command not found"):
+		return models.ErrCodeMultipassUnavailable
+	case strings.Contains(lower, "does not exist") || strings.HasPrefix(lower, "vm not found"):
+		return models.ErrCodeVMNotFound
+	case strings.Contains(lower, "already exists"):
+		return models.ErrCodeVMAlreadyExists
+	case strings.Contains(lower, "already running"):
+		return models.ErrCodeVMAlreadyRunning
+	case strings.Contains(lower, "timed out"):
+		return models.ErrCodeTimeout
+	}
+	return ""
+}
@@ -0,0 +1,246 @@
+package multipass
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// DefaultExecTimeout applies when an exec request does not set a timeout
+const DefaultExecTimeout = 300
+
+var (
+	envNamePattern  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	userNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*[$]?$`)
+	aliasPattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+)
+
+// ValidateExecRequest checks the parts of an exec request that end up on the
+// command line inside the VM
+func ValidateExecRequest(req models.VMExecRequest) error {
+	if req.Name == "" || (req.Command == "" && req.Alias == "") {
+		return fmt.Errorf("name and command or alias are required")
+	}
+	if err := ValidateVMName(req.Name); err != nil {
+		return err
+	}
+	if req.Command != "" && req.Alias != "" {
+		return fmt.Errorf("set either command or alias, not both")
+	}
+	if req.Alias != "" && !aliasPattern.MatchString(req.Alias) {
+		return fmt.Errorf("invalid alias name: %q", req.Alias)
+	}
+	if req.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	for name := range req.Env {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name: %q", name)
+		}
+	}
+	if req.User != "" && !userNamePattern.MatchString(req.User) {
+		return fmt.Errorf("invalid user name: %q", req.User)
+	}
+	return nil
+}
+
+// BuildExecArgs builds the multipass exec arguments for a request. multipass
+// exec only knows about the working directory, so the user switch and the
+// environment are applied by wrapping the command in sudo and env.
+func BuildExecArgs(req models.VMExecRequest) []string {
+	args := []string{"exec", req.Name}
+	if req.WorkingDir != "" {
+		args = append(args, "--working-directory", req.WorkingDir)
+	}
+	args = append(args, "--")
+
+	if req.User != "" {
+		args = append(args, "sudo", "-H", "-u", req.User, "--")
+	}
+	if len(req.Env) > 0 {
+		names := make([]string, 0, len(req.Env))
+		for name := range req.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		args = append(args, "env")
+		for _, name := range names {
+			args = append(args, name+"="+req.Env[name])
+		}
+	}
+
+	args = append(args, req.Command)
+	return append(args, req.Args...)
+}
+
+// Alias is a multipass alias: a command run in an instance under a name of
+// its own on the host
+type Alias struct {
+	Instance         string `json:"instance"`
+	Command          string `json:"command"`
+	WorkingDirectory string `json:"working-directory"`
+}
+
+// ParseAliases extracts the aliases of the active context from
+// `multipass aliases --format json` output, by name. Releases before alias
+// contexts list them under "aliases" instead.
+func ParseAliases(output string) (map[string]Alias, error) {
+	var data struct {
+		ActiveContext string                      `json:"active-context"`
+		Contexts      map[string]map[string]Alias `json:"contexts"`
+		Aliases       []struct {
+			Alias
+			Name string `json:"alias"`
+		} `json:"aliases"`
+	}
+	if err := json.Unmarshal([]byte(output), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %s", err)
+	}
+	aliases := map[string]Alias{}
+	for name, alias := range data.Contexts[data.ActiveContext] {
+		aliases[name] = alias
+	}
+	for _, alias := range data.Aliases {
+		aliases[alias.Name] = alias.Alias
+	}
+	return aliases, nil
+}
+
+// ListAliases lists the multipass aliases defined on this host
+func (r *Runner) ListAliases(ctx context.Context) (map[string]Alias, error) {
+	result := r.RunMultipassCommand(ctx, []string{"aliases", "--format", "json"})
+	if !result.Success {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(result.Output+" "+result.Error))
+	}
+	return ParseAliases(result.Output)
+}
+
+// ResolveAlias replaces the alias of an exec request with the command it
+// stands for, placing the request's arguments after the alias's own. The
+// alias must run in the VM the request names, so access to the VM is all a
+// caller needs to run it.
+func (r *Runner) ResolveAlias(ctx context.Context, req models.VMExecRequest) (models.VMExecRequest, error) {
+	aliases, err := r.ListAliases(ctx)
+	if err != nil {
+		return req, fmt.Errorf("failed to list aliases: %s", err)
+	}
+	alias, exists := aliases[req.Alias]
+	if !exists {
+		return req, fmt.Errorf("alias '%s' is not defined on this host", req.Alias)
+	}
+	if alias.Instance != req.Name {
+		return req, fmt.Errorf("alias '%s' runs in VM '%s', not '%s'", req.Alias, alias.Instance, req.Name)
+	}
+	command := strings.Fields(alias.Command)
+	if len(command) == 0 {
+		return req, fmt.Errorf("alias '%s' has no command", req.Alias)
+	}
+
+	req.Command = command[0]
+	req.Args = append(command[1:], req.Args...)
+	req.Alias = ""
+	return req, nil
+}
+
+// ExecTimeout returns the effective timeout of an exec request
+func ExecTimeout(req models.VMExecRequest) time.Duration {
+	if req.Timeout > 0 {
+		return time.Duration(req.Timeout) * time.Second
+	}
+	return DefaultExecTimeout * time.Second
+}
+
+// Exec runs a command, or the command of an alias, inside a VM on this host,
+// keeping stdout and stderr apart and reporting the command's own exit code.
+// When output is not nil, lines from both streams are also written to it as
+// the command prints them.
+func (r *Runner) Exec(ctx context.Context, req models.VMExecRequest, output io.Writer) models.RemoteCommandResponse {
+	if err := ValidateVMName(req.Name); err != nil {
+		errMsg := err.Error()
+		return models.RemoteCommandResponse{Success: false, ReturnCode: -1, Error: &errMsg}
+	}
+	if req.Alias != "" {
+		resolved, err := r.ResolveAlias(ctx, req)
+		if err != nil {
+			errMsg := err.Error()
+			return models.RemoteCommandResponse{Success: false, ReturnCode: -1, Error: &errMsg}
+		}
+		req = resolved
+	}
+
+	ctx, span := startCommand(ctx, []string{"exec"})
+	ctx, cancel := context.WithTimeout(ctx, ExecTimeout(req))
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "multipass", BuildExecArgs(req)...)
+	cmd.WaitDelay = waitDelay
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if output != nil {
+		// Each stream is split on its own so their lines never interleave
+		var mutex sync.Mutex
+		relay := func(line string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			io.WriteString(output, line+"\n")
+		}
+		stdoutLines, stderrLines := NewLineWriter(relay), NewLineWriter(relay)
+		defer stdoutLines.Close()
+		defer stderrLines.Close()
+		cmd.Stdout = io.MultiWriter(&stdout, stdoutLines)
+		cmd.Stderr = io.MultiWriter(&stderr, stderrLines)
+	}
+
+	start := time.Now()
+	err := cmd.Run()
+	stdoutStr := stdout.String()
+	stderrStr := stderr.String()
+	response := models.RemoteCommandResponse{
+		Success: err == nil,
+		Stdout:  &stdoutStr,
+		Stderr:  &stderrStr,
+	}
+
+	if err == nil {
+		r.observeCommand([]string{"exec"}, start, true)
+		endCommand(span, true, "")
+		return response
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		errMsg := fmt.Sprintf("command timed out after %s", ExecTimeout(req))
+		response.ReturnCode = -1
+		response.Error = &errMsg
+	case errors.As(err, &exitErr):
+		response.ReturnCode = exitErr.ExitCode()
+	default:
+		errMsg := err.Error()
+		response.ReturnCode = -1
+		response.Error = &errMsg
+	}
+
+	// A command that exits non-zero failed in the guest, not in multipass
+	r.observeCommand([]string{"exec"}, start, response.ReturnCode != -1)
+	span.SetAttribute("process.exit_code", response.ReturnCode)
+	message := ""
+	if response.Error != nil {
+		message = *response.Error
+	}
+	endCommand(span, response.ReturnCode != -1, message)
+	return response
+}
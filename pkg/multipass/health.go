@@ -0,0 +1,162 @@
+package multipass
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// Host health states. A degraded host has the multipass client but its daemon
+// does not answer; an unavailable host has no multipass at all.
+const (
+	HealthUnknown     = "unknown"
+	HealthHealthy     = "healthy"
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+)
+
+// healthCheckInterval is how often a started HealthMonitor checks multipass
+const healthCheckInterval = 30 * time.Second
+
+// socketError is what the multipass client prints when multipassd is down
+const socketError = "cannot connect to the multipass socket"
+
+// errDaemonUnreachable replaces the client's error for commands that failed
+// because multipassd is down
+const errDaemonUnreachable = "the multipass daemon (multipassd) is not reachable on this host; is it running?"
+
+// CheckHealth runs `multipass version` to find out whether multipass and its
+// daemon answer on this host
+func (r *Runner) CheckHealth(ctx context.Context) models.HostHealth {
+	health := models.HostHealth{CheckedAt: time.Now()}
+	if !IsInstalled() {
+		health.Status = HealthUnavailable
+		health.Error = "multipass command not found. Is multipass installed?"
+		return health
+	}
+
+	result := r.RunMultipassCommand(ctx, []string{"version", "--format", "json"})
+	if !result.Success {
+		health.Status = HealthDegraded
+		health.Error = result.Error
+		return health
+	}
+	version, err := ParseVersion(result.Output)
+	if err != nil {
+		health.Status = HealthDegraded
+		health.Error = err.Error()
+		return health
+	}
+	health.Version = version
+	// The client reports its own version even when the daemon is down
+	if version.Multipassd == "" {
+		health.Status = HealthDegraded
+		health.Error = errDaemonUnreachable
+		return health
+	}
+	health.Status = HealthHealthy
+	health.DaemonReachable = true
+	return health
+}
+
+// HealthMonitor keeps the latest multipass health of this host, checking it
+// periodically once started
+type HealthMonitor struct {
+	runner *Runner
+	health models.HostHealth
+	cancel context.CancelFunc
+	mutex  sync.RWMutex
+}
+
+// NewHealthMonitor creates a monitor checking multipass through runner, whose
+// health is unknown until checked
+func NewHealthMonitor(runner *Runner) *HealthMonitor {
+	return &HealthMonitor{runner: runner, health: models.HostHealth{Status: HealthUnknown}}
+}
+
+// Check checks multipass now and records the result
+func (m *HealthMonitor) Check(ctx context.Context) models.HostHealth {
+	health := m.runner.CheckHealth(ctx)
+	m.record(health)
+	return health
+}
+
+// record stores a health result, logging when the status changes
+func (m *HealthMonitor) record(health models.HostHealth) {
+	m.mutex.Lock()
+	previous := m.health.Status
+	m.health = health
+	m.mutex.Unlock()
+
+	if previous != health.Status {
+		if health.Error != "" {
+			logger.Warn("multipass health changed", "status", health.Status, "error", health.Error)
+		} else {
+			logger.Info("multipass health changed", "status", health.Status)
+		}
+	}
+}
+
+// markUnreachable records that a command just failed to reach multipassd.
+// Every command a runner runs talks to the same daemon, so monitors fold it
+// into their health to show a down daemon before their next periodic check.
+func (r *Runner) markUnreachable() {
+	r.unreachableAt.Store(time.Now().UnixNano())
+}
+
+// Health gets the latest health, degraded if a command run through the
+// monitor's runner has failed to reach multipassd since the last check
+func (m *HealthMonitor) Health() models.HostHealth {
+	m.mutex.RLock()
+	health := m.health
+	m.mutex.RUnlock()
+
+	at := m.runner.unreachableAt.Load()
+	if at > health.CheckedAt.UnixNano() && health.Status != HealthDegraded {
+		health.Status = HealthDegraded
+		health.DaemonReachable = false
+		health.Error = errDaemonUnreachable
+		health.CheckedAt = time.Unix(0, at)
+	}
+	return health
+}
+
+// Start checks multipass now and then every healthCheckInterval until Stop
+func (m *HealthMonitor) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mutex.Lock()
+	m.cancel = cancel
+	m.mutex.Unlock()
+
+	m.Check(ctx)
+	go func() {
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.Check(ctx)
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic checks
+func (m *HealthMonitor) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
+
+// daemonUnreachable reports whether a command's output shows that the client
+// could not reach multipassd
+func daemonUnreachable(output string) bool {
+	return strings.Contains(output, socketError)
+}
@@ -0,0 +1,155 @@
+package multipass
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// flexInt decodes a byte count or CPU count that multipass reports either as
+// a number or as a numeric string, depending on the field and release. Empty
+// strings, which stopped instances report, decode as zero.
+type flexInt int64
+
+func (n *flexInt) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(string(data), `"`)
+	if text == "" || text == "null" {
+		*n = 0
+		return nil
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", data)
+	}
+	*n = flexInt(value)
+	return nil
+}
+
+// flexUsage is a used/total pair as multipass reports it
+type flexUsage struct {
+	Used  flexInt `json:"used"`
+	Total flexInt `json:"total"`
+}
+
+// usage converts a reported pair, or gives nil when nothing was reported
+func (u flexUsage) usage() *models.ResourceUsage {
+	if u.Total == 0 {
+		return nil
+	}
+	return &models.ResourceUsage{Used: int64(u.Used), Total: int64(u.Total)}
+}
+
+// infoEntry is one instance in `multipass info --format json` output
+type infoEntry struct {
+	State         string               `json:"state"`
+	IPv4          []string             `json:"ipv4"`
+	Release       string               `json:"release"`
+	ImageRelease  string               `json:"image_release"`
+	ImageHash     string               `json:"image_hash"`
+	CPUCount      flexInt              `json:"cpu_count"`
+	Load          []float64            `json:"load"`
+	Disks         map[string]flexUsage `json:"disks"`
+	Memory        flexUsage            `json:"memory"`
+	SnapshotCount flexInt              `json:"snapshot_count"`
+	Mounts        map[string]struct {
+		SourcePath  string   `json:"source_path"`
+		UIDMappings []string `json:"uid_mappings"`
+		GIDMappings []string `json:"gid_mappings"`
+	} `json:"mounts"`
+}
+
+// ParseList parses `multipass list --format json` output
+func ParseList(output string) (*models.VMList, error) {
+	var list models.VMList
+	if err := json.Unmarshal([]byte(output), &list); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %s", err)
+	}
+	if list.VMs == nil {
+		list.VMs = []models.VMInfoExtended{}
+	}
+	return &list, nil
+}
+
+// List lists the VMs on this host
+func (r *Runner) List(ctx context.Context) (*models.VMList, error) {
+	result := r.RunMultipassCommand(ctx, []string{"list", "--format", "json"})
+	if !result.Success {
+		return nil, fmt.Errorf("%s", result.Error)
+	}
+	return ParseList(result.Output)
+}
+
+// ParseInfo parses `multipass info --format json` output into the details of
+// each VM it describes
+func ParseInfo(output string) (map[string]models.VMDetail, error) {
+	var data struct {
+		Info map[string]infoEntry `json:"info"`
+	}
+	if err := json.Unmarshal([]byte(output), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %s", err)
+	}
+
+	details := make(map[string]models.VMDetail, len(data.Info))
+	for name, entry := range data.Info {
+		detail := models.VMDetail{
+			Name:          name,
+			State:         entry.State,
+			IPv4:          entry.IPv4,
+			Release:       entry.Release,
+			ImageRelease:  entry.ImageRelease,
+			ImageHash:     entry.ImageHash,
+			CPUCount:      int(entry.CPUCount),
+			Load:          entry.Load,
+			Memory:        entry.Memory.usage(),
+			SnapshotCount: int(entry.SnapshotCount),
+			Mounts:        make([]models.VMMount, 0, len(entry.Mounts)),
+		}
+		if detail.IPv4 == nil {
+			detail.IPv4 = []string{}
+		}
+		for device, disk := range entry.Disks {
+			if usage := disk.usage(); usage != nil {
+				if detail.Disks == nil {
+					detail.Disks = make(map[string]models.ResourceUsage)
+				}
+				detail.Disks[device] = *usage
+			}
+		}
+		for target, mount := range entry.Mounts {
+			detail.Mounts = append(detail.Mounts, models.VMMount{
+				Source:      mount.SourcePath,
+				Target:      target,
+				UIDMappings: mount.UIDMappings,
+				GIDMappings: mount.GIDMappings,
+			})
+		}
+		sort.Slice(detail.Mounts, func(i, j int) bool { return detail.Mounts[i].Target < detail.Mounts[j].Target })
+		details[name] = detail
+	}
+	return details, nil
+}
+
+// Info gets the details of a VM on this host
+func (r *Runner) Info(ctx context.Context, vmName string) (*models.VMDetail, error) {
+	if err := ValidateVMName(vmName); err != nil {
+		return nil, err
+	}
+	result := r.RunMultipassCommand(ctx, []string{"info", vmName, "--format", "json"})
+	if !result.Success {
+		return nil, fmt.Errorf("%s", result.Error)
+	}
+	details, err := ParseInfo(result.Output)
+	if err != nil {
+		return nil, err
+	}
+	detail, ok := details[vmName]
+	if !ok {
+		return nil, fmt.Errorf("VM not found: %s", vmName)
+	}
+	return &detail, nil
+}
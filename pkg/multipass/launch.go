@@ -0,0 +1,101 @@
+package multipass
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// extraLaunchFlags are the multipass launch flags accepted in a create
+// request's extra_args. A flag with a nil validator takes no value. Flags the
+// request models directly (--name, --cpus, --cloud-init, ...) are not
+// accepted, so extra arguments cannot contradict them.
+var extraLaunchFlags = map[string]func(value string) error{
+	"--bridged": nil,
+	"--mount": func(value string) error {
+		if value == "" || strings.HasPrefix(value, "-") {
+			return fmt.Errorf("--mount needs a <source>[:<target>] value")
+		}
+		return nil
+	},
+	"--timeout": func(value string) error {
+		if seconds, err := strconv.Atoi(value); err != nil || seconds <= 0 {
+			return fmt.Errorf("--timeout needs a positive number of seconds")
+		}
+		return nil
+	},
+}
+
+// ValidateExtraArgs checks extra launch arguments against the allowlist and
+// normalizes them, so "--timeout=600" and "--timeout", "600" both become
+// "--timeout", "600"
+func ValidateExtraArgs(args []string) ([]string, error) {
+	normalized := []string{}
+	for i := 0; i < len(args); i++ {
+		flag, value, hasValue := strings.Cut(args[i], "=")
+		validate, allowed := extraLaunchFlags[flag]
+		if !allowed {
+			return nil, fmt.Errorf("launch argument %q is not allowed in extra_args", args[i])
+		}
+
+		if validate == nil {
+			if hasValue {
+				return nil, fmt.Errorf("%s does not take a value", flag)
+			}
+			normalized = append(normalized, flag)
+			continue
+		}
+
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("%s needs a value", flag)
+			}
+			i++
+			value = args[i]
+		}
+		if err := validate(value); err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, flag, value)
+	}
+	return normalized, nil
+}
+
+// BuildLaunchArgs builds the multipass launch arguments for a VM creation request.
+// cloudInitPath is the path of a cloud-init file to pass, or empty for none.
+// Unset resources are left out so that blueprints can apply their own minimums.
+// Each entry of req.Networks becomes a --network flag, so it may be a bare
+// interface name or a full spec such as "name=en0,mode=manual".
+// req.ExtraArgs are appended as given.
+func BuildLaunchArgs(req models.VMCreateRequest, cloudInitPath string) []string {
+	args := []string{
+		"launch",
+		req.Image,
+		"--name", req.Name,
+	}
+
+	if req.CPUs > 0 {
+		args = append(args, "--cpus", fmt.Sprintf("%d", req.CPUs))
+	}
+	if req.Memory != "" {
+		args = append(args, "--memory", req.Memory)
+	}
+	if req.Disk != "" {
+		args = append(args, "--disk", req.Disk)
+	}
+
+	for _, network := range req.Networks {
+		args = append(args, "--network", network)
+	}
+
+	if cloudInitPath != "" {
+		args = append(args, "--cloud-init", cloudInitPath)
+	}
+
+	// Extra arguments are validated with ValidateExtraArgs before launch
+	args = append(args, req.ExtraArgs...)
+
+	return args
+}
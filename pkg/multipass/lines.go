@@ -0,0 +1,50 @@
+package multipass
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// LineWriter is an io.Writer that hands each complete line written to it to a
+// function, so streamed command output can be relayed line by line however
+// the writes happen to be split. Close reports a final unterminated line.
+type LineWriter struct {
+	onLine  func(line string)
+	pending []byte
+	mutex   sync.Mutex
+}
+
+// NewLineWriter creates a LineWriter that calls onLine for every line
+func NewLineWriter(onLine func(line string)) *LineWriter {
+	return &LineWriter{onLine: onLine}
+}
+
+// Write buffers p and reports the lines it completes
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		w.onLine(strings.TrimSuffix(string(w.pending[:i]), "\r"))
+		w.pending = w.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close reports whatever was written after the last newline
+func (w *LineWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.pending) > 0 {
+		w.onLine(strings.TrimSuffix(string(w.pending), "\r"))
+		w.pending = nil
+	}
+	return nil
+}
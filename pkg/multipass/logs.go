@@ -0,0 +1,100 @@
+package multipass
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// DefaultLogSource is the log shown when a request names none
+const DefaultLogSource = "cloud-init"
+
+// Log tailing limits. A followed log is cut off after LogFollowTimeout
+// seconds so a forgotten stream does not hold a command open forever.
+const (
+	DefaultLogTail   = 200
+	MaxLogTail       = 10000
+	LogFollowTimeout = 3600
+)
+
+// defaultLogSources maps source names to files inside the VM
+var defaultLogSources = map[string]string{
+	"cloud-init":       "/var/log/cloud-init-output.log",
+	"cloud-init-debug": "/var/log/cloud-init.log",
+	"syslog":           "/var/log/syslog",
+}
+
+// LogSources returns the logs that can be read from VMs, by name. VM_LOG_SOURCES
+// replaces the defaults with a comma separated list of name=path pairs.
+func LogSources() map[string]string {
+	value := strings.TrimSpace(os.Getenv("VM_LOG_SOURCES"))
+	if value == "" {
+		return defaultLogSources
+	}
+
+	sources := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		name, path, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		name, path = strings.TrimSpace(name), strings.TrimSpace(path)
+		if ok && name != "" && strings.HasPrefix(path, "/") {
+			sources[name] = path
+		}
+	}
+	if len(sources) == 0 {
+		return defaultLogSources
+	}
+	return sources
+}
+
+// LogSourceNames lists the configured log sources in name order
+func LogSourceNames() []string {
+	sources := LogSources()
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseLogTail reads a tail line count, falling back to DefaultLogTail
+func ParseLogTail(value string) (int, error) {
+	if value == "" {
+		return DefaultLogTail, nil
+	}
+	tail, err := strconv.Atoi(value)
+	if err != nil || tail < 1 || tail > MaxLogTail {
+		return 0, fmt.Errorf("tail must be between 1 and %d", MaxLogTail)
+	}
+	return tail, nil
+}
+
+// BuildLogRequest builds the exec request that reads the last tail lines of a
+// log source in a VM, and keeps reading new lines when follow is set. It also
+// returns the path of the log.
+func BuildLogRequest(vmName, source string, tail int, follow bool) (models.VMExecRequest, string, error) {
+	if source == "" {
+		source = DefaultLogSource
+	}
+	path, ok := LogSources()[source]
+	if !ok {
+		return models.VMExecRequest{}, "", fmt.Errorf("unknown log source '%s': use %s", source, strings.Join(LogSourceNames(), ", "))
+	}
+
+	req := models.VMExecRequest{
+		Name:    vmName,
+		Command: "tail",
+		Args:    []string{"-n", strconv.Itoa(tail)},
+	}
+	if follow {
+		// -F keeps following a log that is rotated or not created yet
+		req.Args = append(req.Args, "-F")
+		req.Timeout = LogFollowTimeout
+	}
+	req.Args = append(req.Args, path)
+	return req, path, nil
+}
@@ -0,0 +1,45 @@
+package multipass
+
+import (
+	"time"
+
+	"github.com/prashah/batwa/pkg/metrics"
+)
+
+// commandMetrics measure the multipass commands a Runner runs
+type commandMetrics struct {
+	duration *metrics.Histogram
+	failures *metrics.Counter
+}
+
+// newCommandMetrics exports how long the multipass commands run on this host
+// take and which of them fail in registry
+func newCommandMetrics(registry *metrics.Registry) *commandMetrics {
+	return &commandMetrics{
+		duration: registry.Histogram(metrics.Namespace+"multipass_command_duration_seconds",
+			"Time multipass commands run on this host took, by subcommand", nil, "command"),
+		failures: registry.Counter(metrics.Namespace+"multipass_command_failures_total",
+			"Multipass commands on this host that failed, by subcommand", "command"),
+	}
+}
+
+// observeCommand records how long a multipass command took and whether it
+// failed
+func (r *Runner) observeCommand(args []string, start time.Time, success bool) {
+	if r.metrics == nil {
+		return
+	}
+	command := commandName(args)
+	r.metrics.duration.Observe(time.Since(start).Seconds(), command)
+	if !success {
+		r.metrics.failures.Inc(command)
+	}
+}
+
+// commandName gets the subcommand of a multipass command's arguments
+func commandName(args []string) string {
+	if len(args) == 0 {
+		return "unknown"
+	}
+	return args[0]
+}
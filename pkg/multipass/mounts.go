@@ -0,0 +1,103 @@
+package multipass
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// CleanMountSource checks that source names an absolute host directory that
+// multipass cannot read as an option, and returns it cleaned
+func CleanMountSource(source string) (string, error) {
+	switch {
+	case source == "":
+		return "", errors.New("source is required")
+	case strings.HasPrefix(source, "-"):
+		return "", fmt.Errorf("invalid source '%s': it must not start with '-'", source)
+	case !filepath.IsAbs(source):
+		return "", fmt.Errorf("invalid source '%s': it must be an absolute path", source)
+	}
+	return filepath.Clean(source), nil
+}
+
+// MountPolicy decides which host directories may be mounted into VMs, so
+// whoever may mount cannot hand a VM the host's own files
+type MountPolicy struct {
+	roots []string
+}
+
+// NewMountPolicy allows mounting the directories under the comma separated
+// absolute paths in roots, or any directory when roots is empty
+func NewMountPolicy(roots string) (*MountPolicy, error) {
+	policy := &MountPolicy{}
+	for _, root := range strings.Split(roots, ",") {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		if !filepath.IsAbs(root) {
+			return nil, fmt.Errorf("mount root '%s' is not an absolute path", root)
+		}
+		policy.roots = append(policy.roots, filepath.Clean(root))
+	}
+	return policy, nil
+}
+
+// NewMountPolicyFromEnv allows mounting the directories under the comma
+// separated paths in MOUNT_ROOTS, or any directory when it is not set
+func NewMountPolicyFromEnv() (*MountPolicy, error) {
+	return NewMountPolicy(os.Getenv("MOUNT_ROOTS"))
+}
+
+// Roots lists the directories mounts must be under, or nothing when any
+// directory may be mounted
+func (p *MountPolicy) Roots() []string {
+	return append([]string{}, p.roots...)
+}
+
+// Source checks that source may be mounted and returns it cleaned
+func (p *MountPolicy) Source(source string) (string, error) {
+	cleaned, err := CleanMountSource(source)
+	if err != nil || len(p.roots) == 0 {
+		return cleaned, err
+	}
+	for _, root := range p.roots {
+		if cleaned == root || strings.HasPrefix(cleaned, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return cleaned, nil
+		}
+	}
+	return "", fmt.Errorf("invalid source '%s': only directories under %s may be mounted", source, strings.Join(p.roots, ", "))
+}
+
+// BuildMountArgs builds the multipass mount arguments. An empty target mounts
+// the source at the same path inside the VM.
+func BuildMountArgs(vmName, source, target string) []string {
+	spec := vmName
+	if target != "" {
+		spec = vmName + ":" + target
+	}
+	return []string{"mount", source, spec}
+}
+
+// BuildUnmountArgs builds the multipass umount arguments. An empty target
+// removes every mount of the VM.
+func BuildUnmountArgs(vmName, target string) []string {
+	if target == "" {
+		return []string{"umount", vmName}
+	}
+	return []string{"umount", vmName + ":" + target}
+}
+
+// ListMounts lists the mounts of a VM on this host
+func (r *Runner) ListMounts(ctx context.Context, vmName string) ([]models.VMMount, error) {
+	detail, err := r.Info(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return detail.Mounts, nil
+}
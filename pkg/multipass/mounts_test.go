@@ -0,0 +1,43 @@
+package multipass
+
+import "testing"
+
+func TestMountPolicySource(t *testing.T) {
+	open, err := NewMountPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rooted, err := NewMountPolicy("/srv/shared, /home/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy *MountPolicy
+		source string
+		want   string
+		ok     bool
+	}{
+		{open, "/data/project/", "/data/project", true},
+		{open, "", "", false},
+		{open, "relative/dir", "", false},
+		{open, "-rf", "", false},
+		{open, "--help", "", false},
+		{rooted, "/srv/shared", "/srv/shared", true},
+		{rooted, "/home/alice/code", "/home/alice/code", true},
+		{rooted, "/", "", false},
+		{rooted, "/etc", "", false},
+		{rooted, "/srv/shared-not", "", false},
+		{rooted, "/srv/shared/../../etc", "", false},
+	}
+	for _, test := range tests {
+		got, err := test.policy.Source(test.source)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("Source(%q) = %q, %v; want %q, ok %v", test.source, got, err, test.want, test.ok)
+		}
+	}
+
+	if _, err := NewMountPolicy("srv"); err == nil {
+		t.Error("NewMountPolicy accepted a relative root")
+	}
+}
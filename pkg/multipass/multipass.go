@@ -1,11 +1,21 @@
 package multipass
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"os/exec"
+	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/metrics"
+	"github.com/prashah/batwa/pkg/models"
 )
 
+var logger = logging.For("multipass")
+
 // CommandResult represents the result of a multipass command
 type CommandResult struct {
 	Success bool   `json:"success"`
@@ -13,14 +23,77 @@ type CommandResult struct {
 	Error   string `json:"error"`
 }
 
-// RunMultipassCommand runs a multipass command and returns the result
-func RunMultipassCommand(args []string) CommandResult {
+// Runner runs multipass commands on this host. Each master or agent creates
+// one, so the metrics its commands are measured in and what it knows of
+// multipassd belong to that process rather than to the package.
+type Runner struct {
+	metrics *commandMetrics
+	// unreachableAt is when a command last failed to reach multipassd, in
+	// Unix nanoseconds
+	unreachableAt atomic.Int64
+	version       versionCache
+	blueprints    blueprintCache
+}
+
+// NewRunner creates a runner whose commands are measured in registry, or not
+// measured when registry is nil
+func NewRunner(registry *metrics.Registry) *Runner {
+	r := &Runner{}
+	if registry != nil {
+		r.metrics = newCommandMetrics(registry)
+	}
+	return r
+}
+
+// instanceNamePattern is multipass's grammar for instance names: a letter,
+// then letters, digits and hyphens, not ending in a hyphen
+var instanceNamePattern = regexp.MustCompile(`^[A-Za-z](?:[A-Za-z0-9-]*[A-Za-z0-9])?$`)
+
+// ValidateVMName checks that name is a multipass instance name, so that a
+// name such as --all or -h cannot be read by multipass as an option
+func ValidateVMName(name string) error {
+	if name == "" {
+		return fmt.Errorf("VM name is required")
+	}
+	if !instanceNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid VM name '%s': names start with a letter and hold only letters, digits and hyphens", name)
+	}
+	return nil
+}
+
+// RunVMCommand runs a multipass command acting on the VM vmName, refusing to
+// run it when vmName is not an instance name
+func (r *Runner) RunVMCommand(ctx context.Context, vmName string, args []string) CommandResult {
+	if err := ValidateVMName(vmName); err != nil {
+		return CommandResult{Success: false, Error: err.Error()}
+	}
+	return r.RunMultipassCommand(ctx, args)
+}
+
+// RunMultipassCommand runs a multipass command and returns the result. The
+// command is killed when ctx ends or when it outlives CommandTimeout.
+func (r *Runner) RunMultipassCommand(ctx context.Context, args []string) CommandResult {
+	ctx, span := startCommand(ctx, args)
+	ctx, cancel := commandContext(ctx, args)
+	defer cancel()
+
 	cmdArgs := append([]string{}, args...)
-	cmd := exec.Command("multipass", cmdArgs...)
+	cmd := exec.CommandContext(ctx, "multipass", cmdArgs...)
+	cmd.WaitDelay = waitDelay
 
+	start := time.Now()
 	output, err := cmd.CombinedOutput()
-	outputStr := string(output)
+	if ctxErr := contextError(ctx, args); err != nil && ctxErr != nil {
+		err = ctxErr
+	}
+	result := r.commandResult(string(output), err)
+	r.observeCommand(args, start, result.Success)
+	endCommand(span, result.Success, result.Error)
+	return result
+}
 
+// commandResult builds the result of a finished multipass command
+func (r *Runner) commandResult(outputStr string, err error) CommandResult {
 	if err != nil {
 		// Check if it's just because multipass isn't found
 		if strings.Contains(err.Error(), "executable file not found") {
@@ -30,10 +103,26 @@ func RunMultipassCommand(args []string) CommandResult {
 				Error:   "multipass command not found. Is multipass installed?",
 			}
 		}
+		// Every command fails the same way while the daemon is down; say so
+		// plainly rather than passing on the client's socket error
+		if daemonUnreachable(outputStr) {
+			r.markUnreachable()
+			return CommandResult{
+				Success: false,
+				Output:  outputStr,
+				Error:   errDaemonUnreachable,
+			}
+		}
+		// multipass explains failures in its output, which beats the bare
+		// exit status
+		message := strings.TrimSpace(outputStr)
+		if message == "" {
+			message = err.Error()
+		}
 		return CommandResult{
 			Success: false,
 			Output:  outputStr,
-			Error:   err.Error(),
+			Error:   message,
 		}
 	}
 
@@ -44,50 +133,21 @@ func RunMultipassCommand(args []string) CommandResult {
 	}
 }
 
-// VMListResponse represents the JSON response from multipass list
-type VMListResponse struct {
-	List []VMInfo `json:"list"`
+// IsInstalled reports whether the multipass binary can be found on PATH
+func IsInstalled() bool {
+	_, err := exec.LookPath("multipass")
+	return err == nil
 }
 
-// VMInfo represents information about a VM
-type VMInfo struct {
-	Name    string   `json:"name"`
-	State   string   `json:"state"`
-	IPv4    []string `json:"ipv4,omitempty"`
-	Release string   `json:"release,omitempty"`
-}
-
-// GetVMIP gets the IP address of a multipass VM
-func GetVMIP(vmName string) *string {
-	result := RunMultipassCommand([]string{"info", vmName, "--format", "json"})
-	if !result.Success {
-		return nil
+// Operation converts the result of a command that changes a VM into an
+// operation result. On success the message is the command's output, or
+// message when one is given; on failure it is the command's error.
+func (r CommandResult) Operation(message string) *models.OperationResult {
+	if !r.Success {
+		return &models.OperationResult{Success: false, Message: r.Error}
 	}
-
-	var info map[string]interface{}
-	if err := json.Unmarshal([]byte(result.Output), &info); err != nil {
-		return nil
+	if message == "" {
+		message = r.Output
 	}
-
-	infoMap, ok := info["info"].(map[string]interface{})
-	if !ok {
-		return nil
-	}
-
-	vmInfo, ok := infoMap[vmName].(map[string]interface{})
-	if !ok {
-		return nil
-	}
-
-	ipv4List, ok := vmInfo["ipv4"].([]interface{})
-	if !ok || len(ipv4List) == 0 {
-		return nil
-	}
-
-	ip, ok := ipv4List[0].(string)
-	if !ok {
-		return nil
-	}
-
-	return &ip
+	return &models.OperationResult{Success: true, Message: message}
 }
@@ -0,0 +1,71 @@
+package multipass
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeMultipass puts a multipass on PATH that records its arguments, and
+// returns the file they are recorded in
+func fakeMultipass(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "multipass"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	return calls
+}
+
+func TestValidateVMName(t *testing.T) {
+	for _, name := range []string{"web", "ci-runner-2", "A"} {
+		if err := ValidateVMName(name); err != nil {
+			t.Errorf("ValidateVMName(%q) = %v, want nil", name, err)
+		}
+	}
+	for _, name := range []string{"", "--all", "-h", "--help", "-", "web-", "2web", "web vm", "web:/tmp", "a.b"} {
+		if err := ValidateVMName(name); err == nil {
+			t.Errorf("ValidateVMName(%q) = nil, want an error", name)
+		}
+	}
+}
+
+func TestRunVMCommandRefusesOptionNames(t *testing.T) {
+	calls := fakeMultipass(t)
+	runner := NewRunner(nil)
+
+	for _, name := range []string{"--all", "-h"} {
+		for _, args := range [][]string{
+			{"delete", name},
+			{"delete", "--purge", name},
+			{"stop", name},
+			{"start", name},
+			{"restart", name},
+			BuildMountArgs(name, "/srv", ""),
+		} {
+			result := runner.RunVMCommand(context.Background(), name, args)
+			if result.Success || !strings.Contains(result.Error, "invalid VM name") {
+				t.Errorf("multipass %v ran: %+v", args, result)
+			}
+		}
+		if _, err := runner.Info(context.Background(), name); err == nil {
+			t.Errorf("Info(%q) did not fail", name)
+		}
+	}
+
+	if data, _ := os.ReadFile(calls); len(data) > 0 {
+		t.Errorf("multipass was run with an option as the VM name:\n%s", data)
+	}
+
+	if result := runner.RunVMCommand(context.Background(), "web", []string{"start", "web"}); !result.Success {
+		t.Fatalf("multipass start web failed: %+v", result)
+	}
+	if data, _ := os.ReadFile(calls); strings.TrimSpace(string(data)) != "start web" {
+		t.Errorf("multipass ran with %q, want \"start web\"", data)
+	}
+}
@@ -0,0 +1,47 @@
+package multipass
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// ParseNetworks extracts the interfaces from `multipass networks --format json` output
+func ParseNetworks(output string) ([]models.Network, error) {
+	var data struct {
+		List []models.Network `json:"list"`
+	}
+	if err := json.Unmarshal([]byte(output), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %s", err)
+	}
+	if data.List == nil {
+		return []models.Network{}, nil
+	}
+	return data.List, nil
+}
+
+// ListNetworks lists the host interfaces VMs on this host can be bridged onto
+func (r *Runner) ListNetworks(ctx context.Context) ([]models.Network, error) {
+	result := r.RunMultipassCommand(ctx, []string{"networks", "--format", "json"})
+	if !result.Success {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(result.Output+" "+result.Error))
+	}
+	return ParseNetworks(result.Output)
+}
+
+// ValidateNetworks rejects network specs that could not form a single
+// --network argument
+func ValidateNetworks(networks []string) error {
+	for _, network := range networks {
+		if strings.TrimSpace(network) == "" {
+			return fmt.Errorf("network names must not be empty")
+		}
+		if strings.ContainsAny(network, " \t\n") {
+			return fmt.Errorf("invalid network %q: must not contain whitespace", network)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package multipass
+
+import (
+	"context"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// phaseLog records the steps of a multi-step operation
+type phaseLog struct {
+	runner *Runner
+	phases []models.OperationPhase
+}
+
+// run runs a multipass command as a named phase and reports whether it succeeded
+func (l *phaseLog) run(ctx context.Context, phase string, args []string) bool {
+	result := l.runner.RunMultipassCommand(ctx, args)
+	message := result.Output
+	if !result.Success {
+		message = result.Error
+	}
+	l.phases = append(l.phases, models.OperationPhase{Phase: phase, Success: result.Success, Message: message})
+	return result.Success
+}
+
+// fail records a phase that failed without running a command
+func (l *phaseLog) fail(phase string, err error) {
+	l.phases = append(l.phases, models.OperationPhase{Phase: phase, Success: false, Message: err.Error()})
+}
@@ -0,0 +1,42 @@
+package multipass
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// Provisioning limits, in seconds. Scripts usually install packages, so they
+// get longer than an ordinary exec by default.
+const (
+	DefaultProvisionTimeout = 900
+	MaxProvisionTimeout     = 3600
+)
+
+// ValidateProvision checks the provisioning fields of a create request
+func ValidateProvision(req models.VMCreateRequest) error {
+	if req.ProvisionTimeout < 0 || req.ProvisionTimeout > MaxProvisionTimeout {
+		return fmt.Errorf("provision_timeout must be between 0 and %d seconds", MaxProvisionTimeout)
+	}
+	if req.ProvisionTimeout > 0 && strings.TrimSpace(req.ProvisionScript) == "" {
+		return fmt.Errorf("provision_timeout needs a provision_script")
+	}
+	return nil
+}
+
+// ProvisionRequest builds the exec request that runs a provisioning script
+// as root with bash, stopping at the first failing command
+func ProvisionRequest(req models.VMCreateRequest) models.VMExecRequest {
+	timeout := req.ProvisionTimeout
+	if timeout == 0 {
+		timeout = DefaultProvisionTimeout
+	}
+	return models.VMExecRequest{
+		Name:    req.Name,
+		Command: "bash",
+		Args:    []string{"-e", "-c", req.ProvisionScript},
+		Timeout: timeout,
+		User:    "root",
+	}
+}
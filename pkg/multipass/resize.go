@@ -0,0 +1,63 @@
+package multipass
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// GetState gets the current state of a VM on this host (e.g. "Running")
+func (r *Runner) GetState(ctx context.Context, vmName string) (string, error) {
+	detail, err := r.Info(ctx, vmName)
+	if err != nil {
+		return "", err
+	}
+	return detail.State, nil
+}
+
+// Resize changes a VM's CPUs, memory and disk with multipass set. The VM is
+// stopped first if needed and started again afterwards if it was running.
+// Every step is reported; the first failure ends the resize, but a VM that was
+// stopped is still started again.
+func (r *Runner) Resize(ctx context.Context, req models.VMResizeRequest) ([]models.OperationPhase, bool) {
+	log := &phaseLog{runner: r}
+
+	state, err := r.GetState(ctx, req.Name)
+	if err != nil {
+		log.fail("inspect", err)
+		return log.phases, false
+	}
+
+	wasRunning := state != "Stopped"
+	if wasRunning && !log.run(ctx, "stop", []string{"stop", req.Name}) {
+		return log.phases, false
+	}
+
+	type setting struct{ key, value string }
+	settings := []setting{}
+	if req.CPUs > 0 {
+		settings = append(settings, setting{"cpus", fmt.Sprintf("%d", req.CPUs)})
+	}
+	if req.Memory != "" {
+		settings = append(settings, setting{"memory", req.Memory})
+	}
+	if req.Disk != "" {
+		settings = append(settings, setting{"disk", req.Disk})
+	}
+
+	success := true
+	for _, s := range settings {
+		arg := fmt.Sprintf("local.%s.%s=%s", req.Name, s.key, s.value)
+		if !log.run(ctx, "set "+s.key, []string{"set", arg}) {
+			success = false
+			break
+		}
+	}
+
+	if wasRunning && !log.run(ctx, "start", []string{"start", req.Name}) {
+		success = false
+	}
+
+	return log.phases, success
+}
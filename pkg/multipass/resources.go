@@ -0,0 +1,51 @@
+package multipass
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// HostResources reports the CPUs, load, free memory and free disk of this
+// host. Disk space is that of the filesystem holding the multipass data
+// directory, or the root filesystem when the directory cannot be found.
+// Figures the host will not report are left zero.
+func HostResources(ctx context.Context) (*models.HostResources, error) {
+	resources := &models.HostResources{CollectedAt: time.Now()}
+
+	count, err := cpu.CountsWithContext(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	resources.CPUCount = count
+
+	if avg, err := load.AvgWithContext(ctx); err == nil {
+		resources.Load = []float64{avg.Load1, avg.Load5, avg.Load15}
+	}
+
+	memory, err := mem.VirtualMemoryWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resources.MemoryFree = int64(memory.Available)
+	resources.MemoryTotal = int64(memory.Total)
+
+	diskPath := DataDir()
+	if _, err := os.Stat(diskPath); diskPath == "" || err != nil {
+		diskPath = "/"
+	}
+	usage, err := disk.UsageWithContext(ctx, diskPath)
+	if err != nil {
+		return nil, err
+	}
+	resources.DiskFree = int64(usage.Free)
+	resources.DiskTotal = int64(usage.Total)
+
+	return resources, nil
+}
@@ -0,0 +1,104 @@
+package multipass
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// settingKey matches multipass setting keys such as local.driver,
+// local.bridged-network or local.<instance>.cpus
+var settingKey = regexp.MustCompile(`^[a-z][a-z0-9-]*(\.[a-zA-Z0-9][a-zA-Z0-9_-]*)+$`)
+
+// IsSecretSetting reports whether a setting's value must never be echoed or
+// logged, such as the daemon's passphrase
+func IsSecretSetting(key string) bool {
+	return strings.HasSuffix(key, ".passphrase")
+}
+
+// ValidateSettings rejects keys multipass would not accept and values that
+// could not be passed as a single argument
+func ValidateSettings(settings map[string]string) error {
+	if len(settings) == 0 {
+		return fmt.Errorf("no settings given")
+	}
+	for key, value := range settings {
+		if !settingKey.MatchString(key) {
+			return fmt.Errorf("invalid setting key %q", key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("value of %s must be a single line", key)
+		}
+	}
+	return nil
+}
+
+// SettingKeys lists the setting keys the multipass daemon supports
+func (r *Runner) SettingKeys(ctx context.Context) ([]string, error) {
+	result := r.RunMultipassCommand(ctx, []string{"get", "--keys"})
+	if !result.Success {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(result.Output+" "+result.Error))
+	}
+
+	keys := []string{}
+	for _, line := range strings.Split(result.Output, "\n") {
+		if key := strings.TrimSpace(line); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// GetSettings reads the given settings, or every supported setting when keys
+// is empty. For a passphrase multipass only reports whether one is set.
+func (r *Runner) GetSettings(ctx context.Context, keys []string) (map[string]string, error) {
+	if len(keys) == 0 {
+		var err error
+		if keys, err = r.SettingKeys(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	settings := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if !settingKey.MatchString(key) {
+			return nil, fmt.Errorf("invalid setting key %q", key)
+		}
+		result := r.RunMultipassCommand(ctx, []string{"get", key})
+		if !result.Success {
+			return nil, fmt.Errorf("failed to get %s: %s", key, strings.TrimSpace(result.Output+" "+result.Error))
+		}
+		settings[key] = strings.TrimSpace(result.Output)
+	}
+	return settings, nil
+}
+
+// SetSettings applies settings in key order, stopping at the first failure.
+// Changing local.driver restarts the daemon, so it is applied last.
+func (r *Runner) SetSettings(ctx context.Context, settings map[string]string) error {
+	if err := ValidateSettings(settings); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if (keys[i] == "local.driver") != (keys[j] == "local.driver") {
+			return keys[j] == "local.driver"
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, key := range keys {
+		result := r.RunMultipassCommand(ctx, []string{"set", key + "=" + settings[key]})
+		if !result.Success {
+			return fmt.Errorf("failed to set %s: %s", key, strings.TrimSpace(result.Output+" "+result.Error))
+		}
+	}
+	return nil
+}
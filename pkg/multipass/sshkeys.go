@@ -0,0 +1,62 @@
+package multipass
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// publicKeyTypes are the OpenSSH public key types accepted for VMs
+var publicKeyTypes = map[string]bool{
+	"ssh-ed25519":                        true,
+	"ssh-rsa":                            true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// ValidatePublicKey checks that key is a single OpenSSH public key line, as
+// found in a .pub file, and returns it trimmed
+func ValidatePublicKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	if key == "" || strings.ContainsAny(key, "\r\n") {
+		return "", fmt.Errorf("public key must be a single line")
+	}
+	fields := strings.Fields(key)
+	if len(fields) < 2 || !publicKeyTypes[fields[0]] {
+		return "", fmt.Errorf("not an OpenSSH public key: expected a type such as ssh-ed25519 followed by the key")
+	}
+
+	// The key blob starts with its own type, length-prefixed
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil || len(blob) < 4 {
+		return "", fmt.Errorf("public key data is not valid base64")
+	}
+	length := int(binary.BigEndian.Uint32(blob))
+	if length > len(blob)-4 || string(blob[4:4+length]) != fields[0] {
+		return "", fmt.Errorf("public key data does not match its type %s", fields[0])
+	}
+	return key, nil
+}
+
+// AuthorizeKeyRequest builds the exec request that appends key to user's
+// ~/.ssh/authorized_keys in a VM, unless it is already there. The key is
+// passed through the environment so it is never parsed by the shell.
+func AuthorizeKeyRequest(vmName, user, key string) models.VMExecRequest {
+	script := `mkdir -p ~/.ssh && chmod 700 ~/.ssh && touch ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys && ` +
+		`if grep -qxF "$SSH_PUBLIC_KEY" ~/.ssh/authorized_keys; then echo "Key already authorized"; ` +
+		`else printf '%s\n' "$SSH_PUBLIC_KEY" >> ~/.ssh/authorized_keys && echo "Key authorized"; fi`
+	return models.VMExecRequest{
+		Name:    vmName,
+		Command: "bash",
+		Args:    []string{"-e", "-c", script},
+		Env:     map[string]string{"SSH_PUBLIC_KEY": key},
+		User:    user,
+		Timeout: 30,
+	}
+}
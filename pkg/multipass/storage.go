@@ -0,0 +1,266 @@
+package multipass
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"syscall"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// defaultDataDirs are where multipassd keeps its data on each OS
+var defaultDataDirs = map[string]string{
+	"linux":  "/var/snap/multipass/common/data/multipassd",
+	"darwin": "/var/root/Library/Application Support/multipassd",
+}
+
+// imageDBFile is the daemon's record of the images it has cached
+const imageDBFile = "multipassd-image-db.json"
+
+// DataDir returns the multipassd data directory, MULTIPASS_DATA_DIR or the
+// default location for this OS
+func DataDir() string {
+	if dir := os.Getenv("MULTIPASS_DATA_DIR"); dir != "" {
+		return dir
+	}
+	return defaultDataDirs[runtime.GOOS]
+}
+
+// vaultDir finds the vault holding instances and images. Daemons that
+// support several drivers keep one vault per driver, such as qemu/vault.
+func vaultDir(dataDir string) (string, error) {
+	candidates := []string{filepath.Join(dataDir, "vault")}
+	if driverVaults, err := filepath.Glob(filepath.Join(dataDir, "*", "vault")); err == nil {
+		candidates = append(candidates, driverVaults...)
+	}
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no multipass vault found in %s; set MULTIPASS_DATA_DIR", dataDir)
+}
+
+// Storage reports the disk space multipass uses on this host. It reads the
+// daemon's data directory, so it needs the same privileges as multipassd.
+func (r *Runner) Storage(ctx context.Context) (*models.HostStorage, error) {
+	dataDir := DataDir()
+	if dataDir == "" {
+		return nil, fmt.Errorf("no default multipass data directory on %s; set MULTIPASS_DATA_DIR", runtime.GOOS)
+	}
+	if _, err := os.Stat(dataDir); err != nil {
+		return nil, fmt.Errorf("cannot read multipass data directory: %w", err)
+	}
+
+	storage := &models.HostStorage{
+		DataDir:   dataDir,
+		Instances: []models.InstanceStorage{},
+		Images:    []models.CachedImage{},
+	}
+	if usage, err := filesystemUsage(dataDir); err == nil {
+		storage.Filesystem = usage
+	} else {
+		storage.Errors = append(storage.Errors, "filesystem usage: "+err.Error())
+	}
+
+	vault, err := vaultDir(dataDir)
+	if err != nil {
+		storage.Errors = append(storage.Errors, err.Error())
+		return storage, nil
+	}
+
+	states := map[string]string{}
+	if list, err := r.List(ctx); err == nil {
+		for _, vm := range list.VMs {
+			states[vm.Name] = vm.State
+		}
+	} else {
+		storage.Errors = append(storage.Errors, "instance states: "+err.Error())
+	}
+
+	instances, err := instanceSizes(vault)
+	if err != nil {
+		storage.Errors = append(storage.Errors, "instances: "+err.Error())
+	}
+	for name, size := range instances {
+		storage.Instances = append(storage.Instances, models.InstanceStorage{Name: name, State: states[name], SizeBytes: size})
+		storage.InstancesBytes += size
+	}
+	sort.Slice(storage.Instances, func(i, j int) bool {
+		return storage.Instances[i].Name < storage.Instances[j].Name
+	})
+
+	images, err := cachedImages(vault)
+	if err != nil {
+		storage.Errors = append(storage.Errors, "images: "+err.Error())
+	}
+	for _, image := range images {
+		storage.Images = append(storage.Images, image)
+		storage.ImagesBytes += image.SizeBytes
+	}
+	return storage, nil
+}
+
+// Prune reclaims disk space on this host: it purges deleted instances and
+// removes cached images the daemon no longer tracks. Tracked images are left
+// to the daemon, which expires images it has not used for a while.
+func (r *Runner) Prune(ctx context.Context) (*models.HostPruneResult, error) {
+	list, err := r.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &models.HostPruneResult{PurgedInstances: []string{}, RemovedImages: []string{}}
+	for _, vm := range list.VMs {
+		if vm.State == "Deleted" {
+			result.PurgedInstances = append(result.PurgedInstances, vm.Name)
+		}
+	}
+	sort.Strings(result.PurgedInstances)
+
+	vault, vaultErr := vaultDir(DataDir())
+	sizes := map[string]int64{}
+	if vaultErr == nil {
+		sizes, _ = instanceSizes(vault)
+	}
+
+	if len(result.PurgedInstances) > 0 {
+		purge := r.RunMultipassCommand(ctx, []string{"purge"})
+		if !purge.Success {
+			return nil, fmt.Errorf("%s", purge.Error)
+		}
+		for _, name := range result.PurgedInstances {
+			result.FreedBytes += sizes[name]
+		}
+	}
+
+	if vaultErr != nil {
+		result.Errors = append(result.Errors, "cached images were not pruned: "+vaultErr.Error())
+		return result, nil
+	}
+	images, err := cachedImages(vault)
+	if err != nil {
+		result.Errors = append(result.Errors, "cached images were not pruned: "+err.Error())
+		return result, nil
+	}
+	for _, image := range images {
+		if image.Tracked {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(vault, "images", image.Name)); err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			continue
+		}
+		result.RemovedImages = append(result.RemovedImages, image.Name)
+		result.FreedBytes += image.SizeBytes
+	}
+	return result, nil
+}
+
+// filesystemUsage reports the size and used space of the filesystem holding path
+func filesystemUsage(path string) (*models.ResourceUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, err
+	}
+	blockSize := int64(stat.Bsize)
+	total := int64(stat.Blocks) * blockSize
+	return &models.ResourceUsage{
+		Total: total,
+		Used:  total - int64(stat.Bfree)*blockSize,
+	}, nil
+}
+
+// instanceSizes gets the size of each instance directory in the vault
+func instanceSizes(vault string) (map[string]int64, error) {
+	entries, err := os.ReadDir(filepath.Join(vault, "instances"))
+	if err != nil {
+		return map[string]int64{}, err
+	}
+	sizes := make(map[string]int64, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			sizes[entry.Name()] = dirSize(filepath.Join(vault, "instances", entry.Name()))
+		}
+	}
+	return sizes, nil
+}
+
+// cachedImages lists the image directories in the vault, ordered by name.
+// When the image database cannot be read every image counts as tracked, so
+// that nothing the daemon may still need is pruned.
+func cachedImages(vault string) ([]models.CachedImage, error) {
+	entries, err := os.ReadDir(filepath.Join(vault, "images"))
+	if err != nil {
+		return nil, err
+	}
+	releases, dbErr := trackedImages(vault)
+
+	images := []models.CachedImage{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		image := models.CachedImage{
+			Name:      entry.Name(),
+			SizeBytes: dirSize(filepath.Join(vault, "images", entry.Name())),
+			Tracked:   true,
+		}
+		if info, err := entry.Info(); err == nil {
+			image.ModifiedAt = info.ModTime()
+		}
+		if dbErr == nil {
+			image.Release, image.Tracked = releases[entry.Name()]
+		}
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Name < images[j].Name
+	})
+	return images, dbErr
+}
+
+// trackedImages reads the daemon's image database, mapping the directory of
+// each image it tracks to the image's release
+func trackedImages(vault string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(vault, imageDBFile))
+	if err != nil {
+		return nil, err
+	}
+	var records map[string]struct {
+		Image struct {
+			Path            string `json:"path"`
+			OriginalRelease string `json:"original_release"`
+		} `json:"image"`
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", imageDBFile, err)
+	}
+
+	releases := make(map[string]string, len(records))
+	for _, record := range records {
+		if record.Image.Path != "" {
+			releases[filepath.Base(filepath.Dir(record.Image.Path))] = record.Image.OriginalRelease
+		}
+	}
+	return releases, nil
+}
+
+// dirSize adds up the sizes of the files under dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,141 @@
+package multipass
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// RunMultipassCommandStream runs a multipass command like RunMultipassCommand,
+// but writes each line of output to w as soon as it is printed instead of
+// buffering it all. Carriage returns also end a line because multipass redraws
+// progress in place; a line identical to the previous one is written only
+// once. The result's output is made of the same cleaned lines. w may be nil.
+func (r *Runner) RunMultipassCommandStream(ctx context.Context, args []string, w io.Writer) CommandResult {
+	ctx, span := startCommand(ctx, args)
+	ctx, cancel := commandContext(ctx, args)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "multipass", append([]string{}, args...)...)
+	cmd.WaitDelay = waitDelay
+
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		r.observeCommand(args, start, false)
+		result := r.commandResult("", err)
+		endCommand(span, false, result.Error)
+		return result
+	}
+
+	waitErr := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		writer.Close()
+		waitErr <- err
+	}()
+
+	var output strings.Builder
+	previous := ""
+	scanner := bufio.NewScanner(reader)
+	scanner.Split(scanLinesOrReturns)
+	for scanner.Scan() {
+		line := cleanProgressLine(scanner.Text())
+		if line == "" || line == previous {
+			continue
+		}
+		previous = line
+		output.WriteString(line)
+		output.WriteString("\n")
+		if w != nil {
+			io.WriteString(w, line+"\n")
+		}
+	}
+	// Keep draining if the scanner gave up so the command never blocks
+	io.Copy(io.Discard, reader)
+
+	err := <-waitErr
+	if ctxErr := contextError(ctx, args); err != nil && ctxErr != nil {
+		err = ctxErr
+	}
+	result := r.commandResult(output.String(), err)
+	r.observeCommand(args, start, result.Success)
+	endCommand(span, result.Success, result.Error)
+	return result
+}
+
+// scanLinesOrReturns is a bufio.SplitFunc that ends tokens at \n or \r
+func scanLinesOrReturns(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// cleanProgressLine strips terminal control sequences, spinner glyphs and
+// surrounding whitespace from a line of multipass output
+func cleanProgressLine(line string) string {
+	line = ansiSequence.ReplaceAllString(line, "")
+	line = strings.TrimFunc(line, func(r rune) bool {
+		return unicode.IsSpace(r) || (r >= 0x2800 && r <= 0x28FF) || r == '|' || r == '/' || r == '-' || r == '\\'
+	})
+	return line
+}
+
+var (
+	ansiSequence    = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+	progressPercent = regexp.MustCompile(`^(.*?)[:\s]*(\d{1,3})%$`)
+)
+
+// ParseLaunchProgress interprets a line of multipass launch output, such as
+// "Retrieving image: 45%" or "Waiting for initialization to complete"
+func ParseLaunchProgress(line string) models.LaunchProgress {
+	progress := models.LaunchProgress{Message: line}
+
+	stage := line
+	if match := progressPercent.FindStringSubmatch(line); match != nil {
+		stage = match[1]
+		if percent, err := strconv.Atoi(match[2]); err == nil && percent <= 100 {
+			progress.Percent = &percent
+		}
+	}
+	if i := strings.Index(stage, ":"); i >= 0 {
+		stage = stage[:i]
+	}
+	progress.Stage = strings.ToLower(strings.TrimRight(strings.TrimSpace(stage), ".…"))
+	return progress
+}
+
+// Launch runs multipass launch for req, reporting progress as it goes.
+// cloudInitPath is the path of a cloud-init file to pass, or empty for none.
+func (r *Runner) Launch(ctx context.Context, req models.VMCreateRequest, cloudInitPath string, progress func(models.LaunchProgress)) CommandResult {
+	if req.Name != "" {
+		if err := ValidateVMName(req.Name); err != nil {
+			return CommandResult{Success: false, Error: err.Error()}
+		}
+	}
+	var output io.Writer
+	if progress != nil {
+		output = NewLineWriter(func(line string) {
+			progress(ParseLaunchProgress(line))
+		})
+	}
+	return r.RunMultipassCommandStream(ctx, BuildLaunchArgs(req, cloudInitPath), output)
+}
@@ -0,0 +1,69 @@
+package multipass
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Default time limits for multipass commands. Launching and cloning download
+// images and boot instances, so they get far longer than everything else.
+const (
+	DefaultCommandTimeout = 2 * time.Minute
+	DefaultLaunchTimeout  = 20 * time.Minute
+)
+
+// waitDelay bounds how long a killed command may keep its output pipes open,
+// for instance through a child process that outlived it
+const waitDelay = 5 * time.Second
+
+// longCommands are the multipass commands that get the launch time limit
+var longCommands = map[string]bool{
+	"launch":   true,
+	"clone":    true,
+	"transfer": true,
+}
+
+// CommandTimeout returns the time limit of a multipass command. The limits
+// are read from MULTIPASS_TIMEOUT and MULTIPASS_LAUNCH_TIMEOUT in seconds.
+func CommandTimeout(args []string) time.Duration {
+	if len(args) > 0 && longCommands[args[0]] {
+		return envTimeout("MULTIPASS_LAUNCH_TIMEOUT", DefaultLaunchTimeout)
+	}
+	return envTimeout("MULTIPASS_TIMEOUT", DefaultCommandTimeout)
+}
+
+func envTimeout(name string, fallback time.Duration) time.Duration {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil && value > 0 {
+		return time.Duration(value) * time.Second
+	}
+	return fallback
+}
+
+// commandContext derives the context a multipass command runs under, limited
+// by the command's own timeout as well as any deadline ctx already has
+func commandContext(ctx context.Context, args []string) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithTimeout(ctx, CommandTimeout(args))
+}
+
+// contextError explains why a command was cut short by its context, or
+// returns nil when the context did not end it
+func contextError(ctx context.Context, args []string) error {
+	name := "multipass"
+	if len(args) > 0 {
+		name += " " + args[0]
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%s timed out", name)
+	case errors.Is(ctx.Err(), context.Canceled):
+		return fmt.Errorf("%s canceled", name)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package multipass
+
+import (
+	"context"
+
+	"github.com/prashah/batwa/pkg/tracing"
+)
+
+// startCommand begins the span of a multipass command. Only the subcommand is
+// recorded: arguments can hold settings such as the local passphrase.
+func startCommand(ctx context.Context, args []string) (context.Context, *tracing.Span) {
+	command := commandName(args)
+	return tracing.Start(ctx, "multipass "+command, tracing.KindInternal,
+		tracing.Attribute{Key: "multipass.command", Value: command})
+}
+
+// endCommand ends the span of a multipass command, failed with message
+// unless it succeeded
+func endCommand(span *tracing.Span, success bool, message string) {
+	if !success {
+		span.SetError(message)
+	}
+	span.End()
+}
@@ -0,0 +1,110 @@
+package multipass
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Transfer directions
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+)
+
+// defaultTransferLimitMB caps request bodies, and therefore uploads, at 1 GiB
+const defaultTransferLimitMB = 1024
+
+// TransferBodyLimit returns the maximum request body size in bytes, read from
+// TRANSFER_MAX_MB
+func TransferBodyLimit() int {
+	limit := defaultTransferLimitMB
+	if value, err := strconv.Atoi(os.Getenv("TRANSFER_MAX_MB")); err == nil && value > 0 {
+		limit = value
+	}
+	return limit * 1024 * 1024
+}
+
+// transferTempDir returns the directory for staging files. The multipass snap
+// cannot see a private /tmp, so TRANSFER_TMP_DIR can point somewhere it can read.
+func transferTempDir() string {
+	return os.Getenv("TRANSFER_TMP_DIR")
+}
+
+// UploadFile copies src into the VM at destPath, staging it in a temp file on
+// this host. multipass's output is streamed to output, which may be nil.
+func (r *Runner) UploadFile(ctx context.Context, vmName, destPath string, src io.Reader, output io.Writer) error {
+	staged, err := StageUpload(src)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged)
+	return r.UploadStaged(ctx, vmName, destPath, staged, output)
+}
+
+// StageUpload saves src to a temp file multipass can read and returns its
+// path. The caller must remove the file.
+func StageUpload(src io.Reader) (string, error) {
+	file, err := os.CreateTemp(transferTempDir(), "batwa-upload-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(file, src); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// UploadStaged copies a file staged by StageUpload into the VM at destPath.
+// multipass's output is streamed to output, which may be nil.
+func (r *Runner) UploadStaged(ctx context.Context, vmName, destPath, staged string, output io.Writer) error {
+	if err := ValidateVMName(vmName); err != nil {
+		return err
+	}
+	result := r.RunMultipassCommandStream(ctx, []string{"transfer", staged, vmName + ":" + destPath}, output)
+	if !result.Success {
+		return fmt.Errorf("%s", result.Error)
+	}
+	return nil
+}
+
+// DownloadFile copies srcPath out of the VM and returns it opened for reading.
+// The staging file is already unlinked, so closing the returned file frees it.
+// multipass's output is streamed to output, which may be nil.
+func (r *Runner) DownloadFile(ctx context.Context, vmName, srcPath string, output io.Writer) (*os.File, error) {
+	if err := ValidateVMName(vmName); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(transferTempDir(), "batwa-download-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	localPath := path.Join(dir, path.Base(srcPath))
+	result := r.RunMultipassCommandStream(ctx, []string{"transfer", vmName + ":" + srcPath, localPath}, output)
+	if !result.Success {
+		return nil, fmt.Errorf("%s", result.Error)
+	}
+
+	return os.Open(localPath)
+}
+
+// ResolveUploadPath appends filename to destPath when destPath names a directory
+// (ends with a slash), mirroring how cp treats a directory destination
+func ResolveUploadPath(destPath, filename string) string {
+	if strings.HasSuffix(destPath, "/") && filename != "" {
+		return destPath + path.Base(filename)
+	}
+	return destPath
+}
@@ -0,0 +1,52 @@
+package multipass
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// ParseUsage extracts per-VM CPU, load, disk and memory usage from
+// `multipass info --format json` output. Usage a VM does not report, as when
+// it is stopped, is left empty.
+func ParseUsage(output string) (map[string]models.VMInfoExtended, error) {
+	details, err := ParseInfo(output)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]models.VMInfoExtended, len(details))
+	for name, detail := range details {
+		vm := models.VMInfoExtended{
+			Name:        name,
+			State:       detail.State,
+			IPv4:        detail.IPv4,
+			Release:     detail.ImageRelease,
+			CPUCount:    detail.CPUCount,
+			Load:        detail.Load,
+			MemoryUsage: detail.Memory,
+		}
+
+		// Instances with several disks report them separately
+		if len(detail.Disks) > 0 {
+			vm.DiskUsage = &models.ResourceUsage{}
+			for _, disk := range detail.Disks {
+				vm.DiskUsage.Used += disk.Used
+				vm.DiskUsage.Total += disk.Total
+			}
+		}
+		usage[name] = vm
+	}
+	return usage, nil
+}
+
+// ListUsage reports the usage of every VM on this host
+func (r *Runner) ListUsage(ctx context.Context) (map[string]models.VMInfoExtended, error) {
+	result := r.RunMultipassCommand(ctx, []string{"info", "--all", "--format", "json"})
+	if !result.Success {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(result.Output+" "+result.Error))
+	}
+	return ParseUsage(result.Output)
+}
@@ -0,0 +1,149 @@
+package multipass
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// featureVersions are the oldest multipass releases providing features the
+// API relies on
+var featureVersions = map[string]string{
+	"snapshot": "1.13.0",
+	"clone":    "1.15.0",
+}
+
+// ParseVersion extracts the client and daemon versions from
+// `multipass version --format json` output
+func ParseVersion(output string) (*models.HostVersion, error) {
+	var data struct {
+		Multipass  string `json:"multipass"`
+		Multipassd string `json:"multipassd"`
+	}
+	if err := json.Unmarshal([]byte(output), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %s", err)
+	}
+	return &models.HostVersion{
+		Multipass:  data.Multipass,
+		Multipassd: data.Multipassd,
+	}, nil
+}
+
+// Version reports the multipass client and daemon versions on this host, and
+// the driver the daemon uses
+func (r *Runner) Version(ctx context.Context) (*models.HostVersion, error) {
+	result := r.RunMultipassCommand(ctx, []string{"version", "--format", "json"})
+	if !result.Success {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(result.Output+" "+result.Error))
+	}
+	version, err := ParseVersion(result.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	// The driver is informative only; older daemons may not report it
+	if driver := r.RunMultipassCommand(ctx, []string{"get", "local.driver"}); driver.Success {
+		version.Driver = strings.TrimSpace(driver.Output)
+	}
+	version.Unsupported = UnsupportedFeatures(version)
+	return version, nil
+}
+
+// localVersionTTL is how long LocalVersion reuses a result
+const localVersionTTL = 10 * time.Minute
+
+// versionCache holds the result of LocalVersion
+type versionCache struct {
+	version   *models.HostVersion
+	checkedAt time.Time
+	mutex     sync.Mutex
+}
+
+// LocalVersion is Version, cached for a few minutes so that heartbeats and
+// feature checks do not run multipass every time
+func (r *Runner) LocalVersion(ctx context.Context) (*models.HostVersion, error) {
+	r.version.mutex.Lock()
+	defer r.version.mutex.Unlock()
+
+	if r.version.version != nil && time.Since(r.version.checkedAt) < localVersionTTL {
+		return r.version.version, nil
+	}
+	version, err := r.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.version.version = version
+	r.version.checkedAt = time.Now()
+	return version, nil
+}
+
+// CompareVersions compares two multipass version strings numerically by
+// major, minor and patch, ignoring suffixes such as "+mac" or "-rc1"
+func CompareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := range pa {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionParts gets the major, minor and patch numbers of a version
+func versionParts(version string) [3]int {
+	var parts [3]int
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "+-~ "); i >= 0 {
+		version = version[:i]
+	}
+	for i, field := range strings.SplitN(version, ".", 3) {
+		parts[i], _ = strconv.Atoi(field)
+	}
+	return parts
+}
+
+// daemonVersion gets the version that decides which features work: the
+// daemon's, or the client's when the daemon did not answer
+func daemonVersion(version *models.HostVersion) string {
+	if version.Multipassd != "" {
+		return version.Multipassd
+	}
+	return version.Multipass
+}
+
+// Supports reports whether a host's multipass provides a feature. Hosts whose
+// version is unknown are assumed to support everything.
+func Supports(version *models.HostVersion, feature string) bool {
+	minimum, known := featureVersions[feature]
+	if !known || version == nil || daemonVersion(version) == "" {
+		return true
+	}
+	return CompareVersions(daemonVersion(version), minimum) >= 0
+}
+
+// UnsupportedFeatures lists the features a host's multipass is too old for
+func UnsupportedFeatures(version *models.HostVersion) []string {
+	unsupported := []string{}
+	for feature := range featureVersions {
+		if !Supports(version, feature) {
+			unsupported = append(unsupported, feature)
+		}
+	}
+	sort.Strings(unsupported)
+	return unsupported
+}
+
+// RequiredVersion gets the oldest multipass release providing a feature
+func RequiredVersion(feature string) string {
+	return featureVersions[feature]
+}
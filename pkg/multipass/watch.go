@@ -0,0 +1,108 @@
+package multipass
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// DiffVMs compares two listings of the same host and returns the VMs whose
+// state changed, sorted by name. VMs only in current have an empty Previous;
+// VMs only in previous have an empty State.
+func DiffVMs(previous, current []models.VMInfoExtended) []models.VMStateChange {
+	before := make(map[string]string, len(previous))
+	for _, vm := range previous {
+		before[vm.Name] = vm.State
+	}
+
+	changes := []models.VMStateChange{}
+	for _, vm := range current {
+		state, existed := before[vm.Name]
+		delete(before, vm.Name)
+		if !existed || state != vm.State {
+			changes = append(changes, models.VMStateChange{Name: vm.Name, Previous: state, State: vm.State})
+		}
+	}
+	for name, state := range before {
+		changes = append(changes, models.VMStateChange{Name: name, Previous: state})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// StateWatcher lists this host's VMs on an interval and reports the state
+// changes between listings. The first listing is reported with no changes, as
+// the baseline.
+type StateWatcher struct {
+	runner   *Runner
+	interval time.Duration
+	report   func(list *models.VMList, changes []models.VMStateChange) error
+	cancel   context.CancelFunc
+	mutex    sync.Mutex
+}
+
+// NewStateWatcher creates a watcher listing VMs through runner that calls
+// report with every listing that differs from the last one reported. When
+// report fails, the same changes are reported again after the next listing.
+func NewStateWatcher(runner *Runner, interval time.Duration, report func(list *models.VMList, changes []models.VMStateChange) error) *StateWatcher {
+	return &StateWatcher{runner: runner, interval: interval, report: report}
+}
+
+// Start lists VMs now and then every interval until Stop
+func (w *StateWatcher) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.mutex.Lock()
+	w.cancel = cancel
+	w.mutex.Unlock()
+
+	go func() {
+		var last *models.VMList
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			last = w.poll(ctx, last)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// poll lists VMs and reports any changes since last, returning the listing
+// that the next poll should compare against
+func (w *StateWatcher) poll(ctx context.Context, last *models.VMList) *models.VMList {
+	list, err := w.runner.List(ctx)
+	if err != nil {
+		return last
+	}
+
+	var changes []models.VMStateChange
+	if last != nil {
+		changes = DiffVMs(last.VMs, list.VMs)
+		if len(changes) == 0 {
+			return last
+		}
+	}
+	if err := w.report(list, changes); err != nil {
+		logger.Warn("Failed to report VM state changes", "error", err)
+		return last
+	}
+	return list
+}
+
+// Stop stops watching
+func (w *StateWatcher) Stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
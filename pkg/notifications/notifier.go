@@ -0,0 +1,102 @@
+package notifications
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+var logger = logging.For("notifications")
+
+// maxInboxSize caps the number of notifications kept per user
+const maxInboxSize = 100
+
+// Notifier delivers notifications to per-user inboxes and an optional webhook
+type Notifier struct {
+	inbox      map[string][]*models.Notification
+	webhookURL string
+	client     *http.Client
+	mutex      sync.RWMutex
+}
+
+// NewNotifier creates a new notifier. webhookURL may be empty.
+func NewNotifier(webhookURL string) *Notifier {
+	return &Notifier{
+		inbox:      make(map[string][]*models.Notification),
+		webhookURL: webhookURL,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify records a notification for a user and forwards it to the webhook, if configured
+func (n *Notifier) Notify(user, kind, subject, message string) *models.Notification {
+	notification := &models.Notification{
+		ID:        uuid.NewString(),
+		User:      user,
+		Kind:      kind,
+		Subject:   subject,
+		Message:   message,
+		CreatedAt: time.Now(),
+	}
+
+	n.mutex.Lock()
+	inbox := append(n.inbox[user], notification)
+	if len(inbox) > maxInboxSize {
+		inbox = inbox[len(inbox)-maxInboxSize:]
+	}
+	n.inbox[user] = inbox
+	n.mutex.Unlock()
+
+	logger.Info("Notification", "user", user, "kind", kind, "subject", subject)
+
+	if n.webhookURL != "" {
+		go n.sendWebhook(notification)
+	}
+	return notification
+}
+
+// List lists a user's notifications, newest first
+func (n *Notifier) List(user string) []*models.Notification {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	inbox := n.inbox[user]
+	notifications := make([]*models.Notification, 0, len(inbox))
+	for i := len(inbox) - 1; i >= 0; i-- {
+		notifications = append(notifications, inbox[i])
+	}
+	return notifications
+}
+
+// sendWebhook posts a notification to the configured webhook
+func (n *Notifier) sendWebhook(notification *models.Notification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		logger.Error("Failed to marshal notification", "error", err)
+		return
+	}
+
+	resp, err := n.client.Post(n.webhookURL, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		logger.Warn("Failed to deliver notification webhook", "error", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		logger.Warn("Notification webhook failed", "status", resp.StatusCode)
+	}
+}
+
+// NewNotifierFromEnv creates a notifier that also posts to NOTIFY_WEBHOOK_URL
+// when it is set
+func NewNotifierFromEnv() *Notifier {
+	return NewNotifier(os.Getenv("NOTIFY_WEBHOOK_URL"))
+}
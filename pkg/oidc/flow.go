@@ -0,0 +1,64 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// Flow is one sign-in in progress. It travels in a short-lived cookie between
+// sending the browser to the provider and its return, so any master replica
+// can finish the sign-in.
+type Flow struct {
+	// State ties the provider's redirect back to this browser
+	State string `json:"state"`
+	// Nonce ties the ID token to this sign-in
+	Nonce string `json:"nonce"`
+	// Verifier is the PKCE code verifier
+	Verifier string `json:"verifier"`
+}
+
+// NewFlow starts a sign-in with random state, nonce and code verifier
+func NewFlow() (Flow, error) {
+	var flow Flow
+	for _, field := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			return Flow{}, err
+		}
+		*field = base64.RawURLEncoding.EncodeToString(random)
+	}
+	return flow, nil
+}
+
+// challenge is the S256 PKCE code challenge of the verifier
+func (f Flow) challenge() string {
+	sum := sha256.Sum256([]byte(f.Verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Encode encodes the flow for its cookie
+func (f Flow) Encode() string {
+	data, _ := json.Marshal(f)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeFlow decodes a flow from its cookie and checks it matches the state
+// the provider returned
+func DecodeFlow(cookie, state string) (Flow, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cookie)
+	if err != nil {
+		return Flow{}, errors.New("sign-in expired or was started in another browser")
+	}
+	var flow Flow
+	if err := json.Unmarshal(data, &flow); err != nil || flow.State == "" {
+		return Flow{}, errors.New("sign-in expired or was started in another browser")
+	}
+	if subtle.ConstantTimeCompare([]byte(flow.State), []byte(state)) != 1 {
+		return Flow{}, errors.New("sign-in state does not match")
+	}
+	return flow, nil
+}
@@ -0,0 +1,244 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyRefreshInterval is how often an unknown key ID may refetch the JWKS, so
+// forged tokens cannot hammer the provider
+const keyRefreshInterval = time.Minute
+
+// clockSkew is how far the provider's clock may be ahead or behind
+const clockSkew = time.Minute
+
+// jwk is one key of a JSON Web Key Set
+type jwk struct {
+	KeyID string `json:"kid"`
+	Type  string `json:"kty"`
+	Use   string `json:"use"`
+	N     string `json:"n"`
+	E     string `json:"e"`
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+// keySet caches the provider's signing keys by key ID
+type keySet struct {
+	client  *http.Client
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	mutex   sync.Mutex
+}
+
+// newKeySet creates an empty key set, filled on first use
+func newKeySet(client *http.Client) *keySet {
+	return &keySet{client: client, keys: make(map[string]crypto.PublicKey)}
+}
+
+// key gets the key with an ID, refetching the set from uri when the ID is
+// unknown, as after the provider rotates its keys
+func (k *keySet) key(ctx context.Context, uri, id string) (crypto.PublicKey, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if key, found := k.lookup(id); found {
+		return key, nil
+	}
+	if time.Since(k.fetched) < keyRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", id)
+	}
+
+	k.fetched = time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch signing keys: %s answered %s", uri, resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to read signing keys: %w", err)
+	}
+
+	k.keys = make(map[string]crypto.PublicKey)
+	for _, raw := range set.Keys {
+		if raw.Use != "" && raw.Use != "sig" {
+			continue
+		}
+		if key, err := raw.publicKey(); err == nil {
+			k.keys[raw.KeyID] = key
+		}
+	}
+	if key, found := k.lookup(id); found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", id)
+}
+
+// lookup finds a cached key; a token without a key ID matches a set of one
+func (k *keySet) lookup(id string) (crypto.PublicKey, bool) {
+	if key, found := k.keys[id]; found {
+		return key, true
+	}
+	if id == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// publicKey decodes an RSA or EC key
+func (j jwk) publicKey() (crypto.PublicKey, error) {
+	switch j.Type {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", j.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", j.Type)
+}
+
+// hashes are the hashes of the signature algorithms accepted for ID tokens
+var hashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verifySignature checks a JWS signature over signed with key
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	hash, supported := hashes[alg]
+	if !supported {
+		return fmt.Errorf("unsupported ID token algorithm %s", alg)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			break
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			break
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid ID token signature")
+		}
+		return nil
+	}
+	return errors.New("ID token algorithm does not match its signing key")
+}
+
+// verifyIDToken checks an ID token's signature, issuer, audience, expiry and
+// nonce and returns its claims
+func (p *Provider) verifyIDToken(ctx context.Context, meta *metadata, token, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg   string `json:"alg"`
+		KeyID string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	key, err := p.keys.key(ctx, meta.JWKSURI, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed ID token claims")
+	}
+	if claims["iss"] != p.config.Issuer {
+		return nil, fmt.Errorf("ID token issued by %v, not %s", claims["iss"], p.config.Issuer)
+	}
+	audiences := stringList(claims["aud"])
+	if !anyIn([]string{p.config.ClientID}, audiences) {
+		return nil, errors.New("ID token is not for this client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.config.ClientID {
+		return nil, errors.New("ID token is authorized for another client")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Now().Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("ID token has expired")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
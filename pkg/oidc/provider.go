@@ -0,0 +1,362 @@
+// Package oidc signs users in through an OpenID Connect identity provider,
+// such as a corporate IdP, with the authorization code flow and PKCE. The
+// provider's groups are mapped to roles, so IdP group membership decides who
+// is an admin and which roles the authorization policy sees.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/secrets"
+)
+
+// Identity is the identity provider's name for users signed in through it
+const Identity = "oidc"
+
+// AdminRole is the role that grants admin rights when mapped from a group
+const AdminRole = "admin"
+
+// requestTimeout bounds each request to the identity provider
+const requestTimeout = 10 * time.Second
+
+// Config configures the identity provider and how its groups map to roles
+type Config struct {
+	Issuer   string
+	ClientID string
+	// ClientSecret is nil for public clients
+	ClientSecret *secrets.Secret
+	// RedirectURL is the callback registered with the provider, ending in
+	// /api/auth/oidc/callback
+	RedirectURL string
+	Scopes      []string
+	// UsernameClaim names the claim used as username, falling back to email
+	// and then sub
+	UsernameClaim string
+	GroupsClaim   string
+	// GroupRoles maps provider groups to the roles their members get
+	GroupRoles map[string][]string
+	// AllowedGroups, when set, limits sign-in to members of these groups
+	AllowedGroups []string
+}
+
+// User is a user as signed in by the provider
+type User struct {
+	Username string
+	Groups   []string
+	Admin    bool
+	// Roles are the roles mapped from the user's groups, apart from admin
+	Roles []string
+}
+
+// metadata is the part of the provider's discovery document used here
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to one OpenID Connect identity provider. Its discovery
+// document is fetched on first use, so the master starts while the provider
+// is unreachable.
+type Provider struct {
+	config   Config
+	client   *http.Client
+	metadata *metadata
+	keys     *keySet
+	mutex    sync.Mutex
+}
+
+// NewProvider creates a provider for config
+func NewProvider(config Config) (*Provider, error) {
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("OIDC needs an issuer, client ID and redirect URL")
+	}
+	if _, err := url.Parse(config.RedirectURL); err != nil {
+		return nil, fmt.Errorf("invalid OIDC redirect URL: %w", err)
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	client := &http.Client{Timeout: requestTimeout}
+	return &Provider{
+		config: config,
+		client: client,
+		keys:   newKeySet(client),
+	}, nil
+}
+
+// NewProviderFromEnv creates a provider from OIDC_ISSUER, OIDC_CLIENT_ID,
+// OIDC_CLIENT_SECRET and OIDC_REDIRECT_URL, with OIDC_SCOPES (default
+// "openid profile email"), OIDC_USERNAME_CLAIM (default preferred_username),
+// OIDC_GROUPS_CLAIM (default groups), OIDC_GROUP_ROLES such as
+// "vm-admins=admin,ops=operator" and OIDC_ALLOWED_GROUPS, comma separated.
+// OIDC_CLIENT_SECRET may reference a secret in Vault or a file, resolved by
+// resolver. It returns nil when OIDC_ISSUER is unset, leaving OIDC sign-in
+// disabled.
+func NewProviderFromEnv(resolver *secrets.Resolver) (*Provider, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	groupRoles, err := parseGroupRoles(os.Getenv("OIDC_GROUP_ROLES"))
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := resolver.Getenv("OIDC_CLIENT_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	return NewProvider(Config{
+		Issuer:        issuer,
+		ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  clientSecret,
+		RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:        strings.Fields(os.Getenv("OIDC_SCOPES")),
+		UsernameClaim: os.Getenv("OIDC_USERNAME_CLAIM"),
+		GroupsClaim:   os.Getenv("OIDC_GROUPS_CLAIM"),
+		GroupRoles:    groupRoles,
+		AllowedGroups: splitList(os.Getenv("OIDC_ALLOWED_GROUPS")),
+	})
+}
+
+// parseGroupRoles parses group=role pairs separated by commas; a group may be
+// listed more than once to get several roles
+func parseGroupRoles(value string) (map[string][]string, error) {
+	groupRoles := make(map[string][]string)
+	for _, pair := range splitList(value) {
+		group, role, found := strings.Cut(pair, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !found || group == "" || role == "" {
+			return nil, fmt.Errorf("invalid OIDC_GROUP_ROLES entry '%s': use group=role", pair)
+		}
+		groupRoles[group] = append(groupRoles[group], role)
+	}
+	return groupRoles, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// discover fetches the provider's discovery document once
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var meta metadata
+	wellKnown := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, "", &meta); err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+	}
+	if meta.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("OIDC provider reports issuer %s, not %s", meta.Issuer, p.config.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery document lacks authorization, token or JWKS endpoints")
+	}
+	p.metadata = &meta
+	return p.metadata, nil
+}
+
+// getJSON gets a JSON document, with a bearer token when one is given
+func (p *Provider) getJSON(ctx context.Context, url, bearer string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// AuthCodeURL gets the provider URL to send the browser to for a sign-in flow
+func (p *Provider) AuthCodeURL(ctx context.Context, flow Flow) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {flow.State},
+		"nonce":                 {flow.Nonce},
+		"code_challenge":        {flow.challenge()},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return meta.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// tokenResponse is the provider's answer to a code exchange
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// Exchange redeems the authorization code of a flow, verifies the ID token
+// and works out the user it signs in
+func (p *Provider) Exchange(ctx context.Context, code string, flow Flow) (User, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return User{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {flow.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return User{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if secret := p.config.ClientSecret.Value(); secret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(secret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+	defer resp.Body.Close()
+	var tokens tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return User{}, fmt.Errorf("failed to read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return User{}, fmt.Errorf("token endpoint answered %s: %s %s", resp.Status, tokens.Error, tokens.Description)
+	}
+
+	claims, err := p.verifyIDToken(ctx, meta, tokens.IDToken, flow.Nonce)
+	if err != nil {
+		return User{}, err
+	}
+	if _, found := claims[p.config.GroupsClaim]; !found && meta.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		// Some providers only release groups from the userinfo endpoint
+		var info map[string]interface{}
+		if err := p.getJSON(ctx, meta.UserinfoEndpoint, tokens.AccessToken, &info); err != nil {
+			return User{}, fmt.Errorf("failed to get user info: %w", err)
+		}
+		if info["sub"] != claims["sub"] {
+			return User{}, errors.New("user info is for another subject than the ID token")
+		}
+		for name, value := range info {
+			if _, found := claims[name]; !found {
+				claims[name] = value
+			}
+		}
+	}
+	return p.user(claims)
+}
+
+// user works out the username, groups and roles of verified claims
+func (p *Provider) user(claims map[string]interface{}) (User, error) {
+	var username string
+	for _, claim := range []string{p.config.UsernameClaim, "email", "sub"} {
+		if value, ok := claims[claim].(string); ok && value != "" {
+			username = value
+			break
+		}
+	}
+	if username == "" {
+		return User{}, errors.New("ID token names no user")
+	}
+
+	groups := stringList(claims[p.config.GroupsClaim])
+	if len(p.config.AllowedGroups) > 0 && !anyIn(groups, p.config.AllowedGroups) {
+		return User{}, fmt.Errorf("%s is not a member of an allowed group", username)
+	}
+
+	user := User{Username: username, Groups: groups, Roles: []string{}}
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		for _, role := range p.config.GroupRoles[group] {
+			switch {
+			case role == AdminRole:
+				user.Admin = true
+			case role != "user" && !seen[role]:
+				seen[role] = true
+				user.Roles = append(user.Roles, role)
+			}
+		}
+	}
+	sort.Strings(user.Roles)
+	return user, nil
+}
+
+// stringList reads a claim holding a list of strings, or a single string
+func stringList(claim interface{}) []string {
+	list := []string{}
+	switch value := claim.(type) {
+	case string:
+		list = append(list, value)
+	case []interface{}:
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+// anyIn reports whether any of values is in list
+func anyIn(values, list []string) bool {
+	for _, value := range values {
+		for _, item := range list {
+			if value == item {
+				return true
+			}
+		}
+	}
+	return false
+}
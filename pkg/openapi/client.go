@@ -0,0 +1,250 @@
+package openapi
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// initialisms are the words Go names write in capitals
+var initialisms = map[string]bool{
+	"api": true, "cpu": true, "id": true, "ip": true, "ipv4": true, "ipv6": true,
+	"json": true, "oidc": true, "ssh": true, "url": true, "vm": true,
+}
+
+// GoName turns a snake_case JSON name into an exported Go name, such as
+// agent_id into AgentID
+func GoName(name string) string {
+	var b strings.Builder
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' || r == '.' }) {
+		if initialisms[word] {
+			b.WriteString(strings.ToUpper(word))
+		} else if word == "vms" {
+			b.WriteString("VMs")
+		} else {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+// argName turns a path parameter into a Go argument name, such as vm_name
+// into vmName
+func argName(name string) string {
+	goName := GoName(name)
+	for i, r := range goName {
+		if i > 0 && r >= 'a' && r <= 'z' {
+			if i == 1 {
+				return strings.ToLower(goName[:1]) + goName[1:]
+			}
+			// An initialism opens the name: lower all of it
+			return strings.ToLower(goName[:i-1]) + goName[i-1:]
+		}
+	}
+	return strings.ToLower(goName)
+}
+
+// clientGenerator writes the Go client's methods and types
+type clientGenerator struct {
+	out     bytes.Buffer
+	types   bytes.Buffer
+	imports map[string]bool
+}
+
+// GenerateClient writes the source of pkg/client's generated file: a method
+// of Client for each operation, and types for the bodies handlers build as
+// maps
+func GenerateClient(operations []Operation) ([]byte, error) {
+	if err := Validate(operations); err != nil {
+		return nil, err
+	}
+	g := &clientGenerator{imports: map[string]bool{"context": true}}
+	fmt.Fprintf(&g.types, "// AsyncResponse is the 202 answer of an operation run as a task\n")
+	fmt.Fprintf(&g.types, "type AsyncResponse %s\n\n", g.goType(AsyncResponse))
+	for _, op := range operations {
+		if !op.NoClient {
+			g.operation(op)
+		}
+	}
+
+	var src bytes.Buffer
+	src.WriteString("// Code generated by cmd/openapi from the master's operations; DO NOT EDIT.\n\npackage client\n\nimport (\n")
+	// The standard library first, as gofmt users group imports
+	imports := []string{}
+	for path := range g.imports {
+		imports = append(imports, path)
+	}
+	sort.Slice(imports, func(i, j int) bool {
+		iStd, jStd := !strings.Contains(imports[i], "."), !strings.Contains(imports[j], ".")
+		if iStd != jStd {
+			return iStd
+		}
+		return imports[i] < imports[j]
+	})
+	for i, path := range imports {
+		if i > 0 && strings.Contains(path, ".") && !strings.Contains(imports[i-1], ".") {
+			src.WriteString("\n")
+		}
+		fmt.Fprintf(&src, "\t%q\n", path)
+	}
+	src.WriteString(")\n\n")
+	src.Write(g.types.Bytes())
+	src.Write(g.out.Bytes())
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generated client does not parse: %w", err)
+	}
+	return formatted, nil
+}
+
+// operation writes the methods of one operation
+func (g *clientGenerator) operation(op Operation) {
+	params := []string{"ctx context.Context"}
+	for _, name := range PathParams(op.Path) {
+		params = append(params, argName(name)+" string")
+	}
+	query := "nil"
+	if len(op.Query) > 0 {
+		fmt.Fprintf(&g.types, "// %sParams are the query parameters of %s\ntype %sParams struct {\n", op.ID, op.ID, op.ID)
+		for _, param := range op.Query {
+			if param.Description != "" {
+				fmt.Fprintf(&g.types, "\t// %s\n", param.Description)
+			}
+			fmt.Fprintf(&g.types, "\t%s %s `query:%q`\n", GoName(param.Name), g.goType(param.Type), param.Name)
+		}
+		g.types.WriteString("}\n\n")
+		params = append(params, "params *"+op.ID+"Params")
+		query = "params"
+	}
+	body := "nil"
+	if op.Request != nil {
+		requestType := g.goType(op.Request)
+		if _, ok := op.Request.(Fields); ok {
+			fmt.Fprintf(&g.types, "// %sRequest is the body of %s\ntype %sRequest %s\n\n", op.ID, op.ID, op.ID, requestType)
+			requestType = op.ID + "Request"
+		}
+		params = append(params, "body "+requestType)
+		body = "body"
+	}
+	path := g.pathExpression(op.Path)
+	summary := fmt.Sprintf("%s %s", op.Method, op.Path)
+	if op.Summary != "" {
+		summary += ": " + op.Summary
+	}
+
+	if op.Response != nil {
+		result, pointer := g.goType(op.Response), reflect.TypeOf(op.Response).Kind() == reflect.Struct
+		if _, ok := op.Response.(Fields); ok {
+			fmt.Fprintf(&g.types, "// %sResponse is the answer of %s\ntype %sResponse %s\n\n", op.ID, op.ID, op.ID, result)
+			result, pointer = op.ID+"Response", true
+		}
+		name, args := op.ID, strings.Join(params, ", ")
+		send := fmt.Sprintf("c.do(ctx, %q, %s, %s, %s, &out)", op.Method, path, query, body)
+		if op.Upload != "" {
+			g.imports["io"] = true
+			args += ", filename string, file io.Reader"
+			send = fmt.Sprintf("c.upload(ctx, %q, %s, %s, %s, %q, filename, file, &out)", op.Method, path, query, body, op.Upload)
+		}
+		fmt.Fprintf(&g.out, "// %s calls %s\n", name, summary)
+		if pointer {
+			fmt.Fprintf(&g.out, "func (c *Client) %s(%s) (*%s, error) {\n\tvar out %s\n\tif err := %s; err != nil {\n\t\treturn nil, err\n\t}\n\treturn &out, nil\n}\n\n",
+				name, args, result, result, send)
+		} else {
+			fmt.Fprintf(&g.out, "func (c *Client) %s(%s) (%s, error) {\n\tvar out %s\n\terr := %s\n\treturn out, err\n}\n\n",
+				name, args, result, result, send)
+		}
+	}
+	if op.Async {
+		fmt.Fprintf(&g.out, "// %sAsync calls %s, asking for a task to be answered at once\n", op.ID, summary)
+		fmt.Fprintf(&g.out, "func (c *Client) %sAsync(%s) (*AsyncResponse, error) {\n\tvar out AsyncResponse\n\tif err := c.doAsync(ctx, %q, %s, %s, %s, &out); err != nil {\n\t\treturn nil, err\n\t}\n\treturn &out, nil\n}\n\n",
+			op.ID, strings.Join(params, ", "), op.Method, path, query, body)
+	}
+	if op.Stream != "" && op.Stream != StreamWebsocket {
+		g.imports["net/http"] = true
+		name := op.ID
+		if op.Response != nil {
+			name += "Stream"
+		}
+		fmt.Fprintf(&g.out, "// %s calls %s, returning the %s response for the caller to read and close\n", name, summary, op.Stream)
+		fmt.Fprintf(&g.out, "func (c *Client) %s(%s) (*http.Response, error) {\n\treturn c.stream(ctx, %q, %s, %s, %s)\n}\n\n",
+			name, strings.Join(params, ", "), op.Method, path, query, body)
+	}
+}
+
+// pathExpression writes a Go expression building a Fiber path from the
+// method's arguments
+func (g *clientGenerator) pathExpression(path string) string {
+	names := PathParams(path)
+	if len(names) == 0 {
+		return fmt.Sprintf("%q", path)
+	}
+	g.imports["net/url"] = true
+	parts := []string{}
+	rest := path
+	for _, name := range names {
+		before, after, _ := strings.Cut(rest, ":"+name)
+		if before != "" {
+			parts = append(parts, fmt.Sprintf("%q", before))
+		}
+		parts = append(parts, "url.PathEscape("+argName(name)+")")
+		rest = after
+	}
+	if rest != "" {
+		parts = append(parts, fmt.Sprintf("%q", rest))
+	}
+	return strings.Join(parts, " + ")
+}
+
+// goType writes the Go type of a value as operations give it
+func (g *clientGenerator) goType(value interface{}) string {
+	switch v := value.(type) {
+	case Fields:
+		names := []string{}
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var b strings.Builder
+		b.WriteString("struct {\n")
+		for _, name := range names {
+			fmt.Fprintf(&b, "%s %s `json:%q`\n", GoName(name), g.goType(v[name]), name)
+		}
+		b.WriteString("}")
+		return b.String()
+	case []Fields:
+		if len(v) == 1 {
+			return "[]" + g.goType(v[0])
+		}
+		return "[]map[string]interface{}"
+	case nil:
+		return "interface{}"
+	}
+	return g.typeName(reflect.TypeOf(value))
+}
+
+// typeName writes the name of a Go type, importing its package
+func (g *clientGenerator) typeName(t reflect.Type) string {
+	if t.Name() != "" {
+		if t.PkgPath() == "" {
+			return t.Name()
+		}
+		g.imports[t.PkgPath()] = true
+		return t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:] + "." + t.Name()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + g.typeName(t.Elem())
+	case reflect.Slice:
+		return "[]" + g.typeName(t.Elem())
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), g.typeName(t.Elem()))
+	case reflect.Map:
+		return "map[" + g.typeName(t.Key()) + "]" + g.typeName(t.Elem())
+	case reflect.Interface:
+		return "interface{}"
+	}
+	return t.String()
+}
@@ -0,0 +1,324 @@
+// Package openapi describes the master's API as an OpenAPI 3 document. The
+// routes package lists its operations with Go values of their request and
+// response bodies, and the schemas are read off those values' types, so the
+// document follows the models as they change. The same operations generate
+// the Go client in pkg/client.
+package openapi
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// Version is the OpenAPI version of the documents built
+const Version = "3.0.3"
+
+// Access is what an operation demands of a request
+type Access string
+
+const (
+	// AccessPublic operations need nothing
+	AccessPublic Access = "public"
+	// AccessPending operations need a session, even of a user who has yet to
+	// change their password
+	AccessPending Access = "pending"
+	// AccessUser operations need a session of a user who has changed their
+	// password
+	AccessUser Access = "user"
+	// AccessAdmin operations need an admin's session
+	AccessAdmin Access = "admin"
+	// AccessAgent operations need the agents' registration token, if one is set
+	AccessAgent Access = "agent"
+)
+
+// Content types of streamed responses
+const (
+	StreamEvents    = "text/event-stream"
+	StreamFile      = "application/octet-stream"
+	StreamWebsocket = "websocket"
+)
+
+// Fields describes a JSON object by Go values of its fields, for the bodies
+// handlers build as maps. A []Fields holding one Fields describes an array of
+// such objects.
+type Fields map[string]interface{}
+
+// Param is a query parameter
+type Param struct {
+	Name        string
+	Description string
+	// Type is a value of the parameter's type: "", 0 or false
+	Type interface{}
+}
+
+// Operation is one route of the API
+type Operation struct {
+	// Method and Path route the operation; Path is in Fiber's form, such as
+	// /api/v1/vm/info/:vm_name
+	Method string
+	Path   string
+	// ID names the operation, and its method in the Go client
+	ID      string
+	Tag     string
+	Summary string
+	Access  Access
+	Query   []Param
+	// Request is a value of the JSON body's type, or nil for no body
+	Request interface{}
+	// Upload names the file part of a multipart body the operation also takes
+	Upload string
+	// Response is a value of the JSON answer's type, or nil when the
+	// operation only streams
+	Response interface{}
+	// Stream is the content type the operation streams, alone or instead of
+	// its JSON answer
+	Stream string
+	// Async operations answer 202 with a task for ?async=true
+	Async bool
+	// NoClient leaves the operation out of the Go client, for browser
+	// redirects and websockets
+	NoClient bool
+}
+
+// AsyncResponse is the 202 answer of an operation asked to run as a task
+var AsyncResponse = Fields{"success": true, "task_id": "", "task": models.Task{}}
+
+// pathParam matches the parameters of Fiber paths
+var pathParam = regexp.MustCompile(`:([A-Za-z0-9_]+)`)
+
+// PathParams lists the names of the parameters in a Fiber path
+func PathParams(path string) []string {
+	names := []string{}
+	for _, match := range pathParam.FindAllStringSubmatch(path, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// Document is an OpenAPI document
+type Document struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       Info                            `json:"info"`
+	Paths      map[string]map[string]*OpObject `json:"paths"`
+	Components Components                      `json:"components"`
+	Tags       []Tag                           `json:"tags,omitempty"`
+}
+
+// Info describes the API
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// Tag groups operations
+type Tag struct {
+	Name string `json:"name"`
+}
+
+// Components holds the schemas of named types and the security schemes
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes"`
+}
+
+// SecurityScheme is a way of authenticating
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// OpObject is an operation in the document
+type OpObject struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []ParamObject         `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security"`
+	Access      Access                `json:"x-access"`
+}
+
+// ParamObject is a path or query parameter in the document
+type ParamObject struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody is the body an operation takes
+type RequestBody struct {
+	Content map[string]MediaType `json:"content"`
+}
+
+// Response is one answer of an operation
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// MediaType is a body in one content type
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Build describes operations as a document
+func Build(info Info, operations []Operation) *Document {
+	doc := &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Paths:   make(map[string]map[string]*OpObject),
+		Components: Components{
+			Schemas: make(map[string]*Schema),
+			SecuritySchemes: map[string]*SecurityScheme{
+				"sessionCookie": {Type: "apiKey", In: "cookie", Name: "session_id", Description: "The session cookie set by /api/v1/auth/login"},
+				"bearerAuth":    {Type: "http", Scheme: "bearer", Description: "An API token or a JWT access token"},
+				"registrationToken": {Type: "apiKey", In: "header", Name: "X-Registration-Token",
+					Description: "The shared secret agents present, if the master sets one"},
+			},
+		},
+	}
+	schemas := newSchemaBuilder(doc.Components.Schemas)
+
+	tags := make(map[string]bool)
+	for _, op := range operations {
+		path := pathParam.ReplaceAllString(op.Path, "{$1}")
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]*OpObject)
+		}
+		doc.Paths[path][strings.ToLower(op.Method)] = schemas.operation(op)
+		if op.Tag != "" && !tags[op.Tag] {
+			tags[op.Tag] = true
+			doc.Tags = append(doc.Tags, Tag{Name: op.Tag})
+		}
+	}
+	return doc
+}
+
+// operation describes one operation
+func (b *schemaBuilder) operation(op Operation) *OpObject {
+	object := &OpObject{
+		OperationID: op.ID,
+		Summary:     op.Summary,
+		Responses:   make(map[string]*Response),
+		Security:    security(op.Access),
+		Access:      op.Access,
+	}
+	if op.Tag != "" {
+		object.Tags = []string{op.Tag}
+	}
+	for _, name := range PathParams(op.Path) {
+		object.Parameters = append(object.Parameters, ParamObject{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+	}
+	for _, param := range op.Query {
+		object.Parameters = append(object.Parameters, ParamObject{Name: param.Name, In: "query", Description: param.Description, Schema: b.schema(param.Type)})
+	}
+	if op.Async {
+		object.Parameters = append(object.Parameters, ParamObject{Name: "async", In: "query",
+			Description: "Answer 202 with a task at once and run the operation in the background", Schema: &Schema{Type: "boolean"}})
+	}
+
+	if op.Request != nil || op.Upload != "" {
+		object.RequestBody = &RequestBody{Content: make(map[string]MediaType)}
+		if op.Request != nil {
+			object.RequestBody.Content[fiber.MIMEApplicationJSON] = MediaType{Schema: b.schema(op.Request)}
+		}
+		if op.Upload != "" {
+			form := &Schema{Type: "object", Properties: map[string]*Schema{op.Upload: {Type: "string", Format: "binary"}}}
+			if op.Request != nil {
+				form = &Schema{AllOf: []*Schema{b.schema(op.Request), form}}
+			}
+			object.RequestBody.Content[fiber.MIMEMultipartForm] = MediaType{Schema: form}
+		}
+	}
+
+	ok := &Response{Description: "OK", Content: make(map[string]MediaType)}
+	if op.Response != nil {
+		ok.Content[fiber.MIMEApplicationJSON] = MediaType{Schema: b.schema(op.Response)}
+	}
+	switch op.Stream {
+	case "":
+	case StreamWebsocket:
+		object.Responses["101"] = &Response{Description: "Switching to a websocket"}
+	case StreamFile:
+		ok.Content[StreamFile] = MediaType{Schema: &Schema{Type: "string", Format: "binary"}}
+	default:
+		ok.Content[op.Stream] = MediaType{Schema: &Schema{Type: "string"}}
+	}
+	if len(ok.Content) > 0 {
+		object.Responses["200"] = ok
+	}
+	if op.Async {
+		object.Responses["202"] = &Response{Description: "Accepted as a task",
+			Content: map[string]MediaType{fiber.MIMEApplicationJSON: {Schema: b.schema(AsyncResponse)}}}
+	}
+	object.Responses["default"] = &Response{Description: "Error",
+		Content: map[string]MediaType{fiber.MIMEApplicationJSON: {Schema: b.schema(models.ErrorResponse{})}}}
+	return object
+}
+
+// security lists the ways to meet an access requirement
+func security(access Access) []map[string][]string {
+	switch access {
+	case AccessPublic:
+		return []map[string][]string{}
+	case AccessAgent:
+		return []map[string][]string{{"registrationToken": {}}}
+	}
+	return []map[string][]string{{"sessionCookie": {}}, {"bearerAuth": {}}}
+}
+
+// Uncovered lists the API routes of app that no operation describes, so
+// routes added without one are noticed
+func Uncovered(routes []fiber.Route, operations []Operation) []string {
+	described := make(map[string]bool)
+	for _, op := range operations {
+		described[op.Method+" "+op.Path] = true
+	}
+	seen := make(map[string]bool)
+	uncovered := []string{}
+	for _, route := range routes {
+		if route.Method == fiber.MethodHead || !(strings.HasPrefix(route.Path, "/api/") || route.Path == "/healthz") {
+			continue
+		}
+		key := route.Method + " " + route.Path
+		if !described[key] && !seen[key] {
+			seen[key] = true
+			uncovered = append(uncovered, key)
+		}
+	}
+	sort.Strings(uncovered)
+	return uncovered
+}
+
+// Validate checks operations have unique IDs and routes
+func Validate(operations []Operation) error {
+	ids := make(map[string]bool)
+	routes := make(map[string]bool)
+	for _, op := range operations {
+		route := op.Method + " " + op.Path
+		if op.ID == "" {
+			return fmt.Errorf("%s has no operation ID", route)
+		}
+		if ids[op.ID] {
+			return fmt.Errorf("duplicate operation ID %s", op.ID)
+		}
+		if routes[route] {
+			return fmt.Errorf("duplicate operation for %s", route)
+		}
+		ids[op.ID] = true
+		routes[route] = true
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Schema is a JSON schema in the document
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaBuilder reads schemas off Go types, putting those of named structs
+// into the document's components
+type schemaBuilder struct {
+	components map[string]*Schema
+	// names are the component names taken, by type
+	names map[reflect.Type]string
+	taken map[string]bool
+}
+
+// newSchemaBuilder creates a builder adding named schemas to components
+func newSchemaBuilder(components map[string]*Schema) *schemaBuilder {
+	return &schemaBuilder{components: components, names: make(map[reflect.Type]string), taken: make(map[string]bool)}
+}
+
+// schema describes a Go value: Fields and []Fields by their contents, any
+// other value by its type
+func (b *schemaBuilder) schema(value interface{}) *Schema {
+	switch v := value.(type) {
+	case Fields:
+		return b.fields(v)
+	case []Fields:
+		if len(v) == 1 {
+			return &Schema{Type: "array", Items: b.fields(v[0])}
+		}
+		return &Schema{Type: "array", Items: &Schema{Type: "object"}}
+	case nil:
+		return &Schema{}
+	}
+	return b.typeSchema(reflect.TypeOf(value))
+}
+
+// fields describes an object by the values of its fields
+func (b *schemaBuilder) fields(fields Fields) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for name, value := range fields {
+		schema.Properties[name] = b.schema(value)
+	}
+	return schema
+}
+
+// typeSchema describes a Go type
+func (b *schemaBuilder) typeSchema(t reflect.Type) *Schema {
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case durationType:
+		return &Schema{Type: "integer", Format: "int64"}
+	case rawMessageType:
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := b.typeSchema(t.Elem())
+		if schema.Ref == "" {
+			schema.Nullable = true
+		}
+		return schema
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: b.typeSchema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: b.typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + b.component(t)}
+	}
+	return &Schema{}
+}
+
+// component names the schema of a named struct, adding it to the components
+// the first time
+func (b *schemaBuilder) component(t reflect.Type) string {
+	if name, ok := b.names[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if b.taken[name] {
+		// Types of different packages may share a name
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	b.names[t] = name
+	b.taken[name] = true
+	// Set before building, so types referring to themselves end
+	b.components[name] = &Schema{}
+	*b.components[name] = *b.structSchema(t)
+	return name
+}
+
+// structSchema describes a struct by its JSON fields
+func (b *schemaBuilder) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for _, field := range jsonFields(t) {
+		schema.Properties[field.Name] = b.typeSchema(field.Type)
+	}
+	return schema
+}
+
+// jsonField is a field of a struct as encoding/json sees it
+type jsonField struct {
+	Name string
+	Type reflect.Type
+}
+
+// jsonFields lists the fields encoding/json encodes a struct with, taking the
+// fields of embedded structs in, in name order
+func jsonFields(t reflect.Type) []jsonField {
+	fields := []jsonField{}
+	seen := make(map[string]bool)
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		embedded := []reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" {
+				fieldType := field.Type
+				if fieldType.Kind() == reflect.Ptr {
+					fieldType = fieldType.Elem()
+				}
+				if fieldType.Kind() == reflect.Struct {
+					embedded = append(embedded, fieldType)
+					continue
+				}
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			if !seen[name] {
+				seen[name] = true
+				fields = append(fields, jsonField{Name: name, Type: field.Type})
+			}
+		}
+		// Fields of the outer struct hide those of embedded ones
+		for _, fieldType := range embedded {
+			walk(fieldType)
+		}
+	}
+	walk(t)
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
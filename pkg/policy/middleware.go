@@ -0,0 +1,143 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prashah/batwa/pkg/apierror"
+	"github.com/prashah/batwa/pkg/auth"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/metadata"
+)
+
+var logger = logging.For("policy")
+
+// Authorizer decides whether users may carry out actions: on VMs, whether the
+// VM is theirs or shared with them, and then what the policy engine says
+type Authorizer struct {
+	engine   Engine
+	auth     *auth.Service
+	metadata *metadata.Store
+	// failOpen allows requests when the engine cannot be reached
+	failOpen bool
+	// isolation limits users other than admins to the VMs they own or that
+	// are shared with them
+	isolation bool
+}
+
+// NewAuthorizer creates an authorizer consulting engine, with the sessions
+// and roles of authService and the VM owners in store. With isolation, users
+// other than admins only reach their own VMs and those shared with them.
+func NewAuthorizer(engine Engine, authService *auth.Service, store *metadata.Store, failOpen, isolation bool) *Authorizer {
+	return &Authorizer{engine: engine, auth: authService, metadata: store, failOpen: failOpen, isolation: isolation}
+}
+
+// NewAuthorizerFromEnv creates an authorizer consulting OPA at POLICY_OPA_URL,
+// or allowing every action when it is not set. An unreachable engine denies
+// actions unless POLICY_FAIL_OPEN=true. VM isolation is on unless
+// VM_ISOLATION=false, which lets every user see and act on every VM.
+func NewAuthorizerFromEnv(authService *auth.Service, store *metadata.Store) *Authorizer {
+	return NewAuthorizer(engineFromEnv(), authService, store, os.Getenv("POLICY_FAIL_OPEN") == "true", os.Getenv("VM_ISOLATION") != "false")
+}
+
+// Require returns a handler that evaluates the policy for action before the
+// route handler runs. Requests without a session pass through: the route's
+// auth level has already turned them away where a session is needed.
+func (a *Authorizer) Require(action string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		session, exists := a.auth.GetSession(auth.SessionID(c))
+		if !exists {
+			return c.Next()
+		}
+
+		input := Input{
+			User:    session.Username,
+			Roles:   a.auth.Roles(session.Username),
+			Action:  action,
+			Request: requestAttributes(c),
+		}
+
+		input.AgentID = c.Params("agent_id", c.Query("agent_id"))
+		if agentID, ok := input.Request["agent_id"].(string); ok && input.AgentID == "" {
+			input.AgentID = agentID
+		}
+		input.VMName = c.Params("vm_name")
+		if name, ok := input.Request["name"].(string); ok && input.VMName == "" && strings.HasPrefix(action, "vm.") {
+			input.VMName = name
+		}
+
+		err := a.Authorize(c.UserContext(), input)
+		if err == ErrUnavailable {
+			return apierror.RespondErr(c, 503, err)
+		}
+		if err != nil {
+			return apierror.RespondErr(c, 403, err)
+		}
+
+		return c.Next()
+	}
+}
+
+// Authorize evaluates the policy for input after filling in the VM's owner,
+// project, labels and shares. It returns nil when the action is allowed, a
+// *DeniedError when the VM is not the user's to act on or the policy refuses
+// it, and ErrUnavailable when the engine cannot decide and failing open is
+// disabled.
+func (a *Authorizer) Authorize(ctx context.Context, input Input) error {
+	if input.VMName != "" {
+		meta := a.metadata.Get(input.AgentID, input.VMName)
+		if meta != nil {
+			input.Owner = meta.Owner
+			input.Project = meta.Project
+			input.Labels = meta.Labels
+			input.SharedWith = meta.SharedWith
+		}
+		// A VM being created has no owner yet
+		if input.Action != "vm.create" && !a.CanAccessVM(input.User, hasRole(input.Roles, "admin"), meta) {
+			return &DeniedError{Reason: fmt.Sprintf("VM '%s' is neither yours nor shared with you", input.VMName)}
+		}
+	}
+
+	decision, err := a.engine.Evaluate(ctx, input)
+	if err != nil {
+		logger.ErrorContext(ctx, "Policy evaluation failed", "action", input.Action, "user", input.User, "error", err)
+		if a.failOpen {
+			return nil
+		}
+		return ErrUnavailable
+	}
+	if !decision.Allow {
+		return &DeniedError{Reason: decision.Reason}
+	}
+	return nil
+}
+
+// requestAttributes collects the request's JSON body or form fields. Uploaded
+// files are never included.
+func requestAttributes(c *fiber.Ctx) map[string]interface{} {
+	attributes := map[string]interface{}{}
+
+	contentType := c.Get(fiber.HeaderContentType)
+	switch {
+	case strings.HasPrefix(contentType, fiber.MIMEApplicationJSON):
+		json.Unmarshal(c.Body(), &attributes)
+	case strings.HasPrefix(contentType, fiber.MIMEMultipartForm):
+		if form, err := c.MultipartForm(); err == nil {
+			for key, values := range form.Value {
+				if len(values) > 0 {
+					attributes[key] = values[0]
+				}
+			}
+		}
+	case strings.HasPrefix(contentType, fiber.MIMEApplicationForm):
+		c.Request().PostArgs().VisitAll(func(key, value []byte) {
+			attributes[string(key)] = string(value)
+		})
+	}
+
+	return attributes
+}
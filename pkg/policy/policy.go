@@ -0,0 +1,168 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// Input is the document a policy is evaluated against
+type Input struct {
+	User    string            `json:"user"`
+	Roles   []string          `json:"roles"`
+	Action  string            `json:"action"`
+	AgentID string            `json:"agent_id,omitempty"`
+	VMName  string            `json:"vm_name,omitempty"`
+	Owner   string            `json:"owner,omitempty"`
+	Project string            `json:"project,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// SharedWith lists the users the VM's owner has shared it with
+	SharedWith []string               `json:"shared_with,omitempty"`
+	Request    map[string]interface{} `json:"request,omitempty"`
+}
+
+// Decision is the outcome of a policy evaluation
+type Decision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ErrUnavailable is returned by Authorizer.Authorize when the policy engine
+// cannot be consulted and failing open is disabled
+var ErrUnavailable = errors.New("Policy evaluation failed")
+
+// DeniedError is returned by Authorize when the policy refuses an action
+type DeniedError struct {
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	if e.Reason == "" {
+		return "Denied by policy"
+	}
+	return "Denied by policy: " + e.Reason
+}
+
+// Engine evaluates authorization policies
+type Engine interface {
+	Evaluate(ctx context.Context, input Input) (Decision, error)
+}
+
+// AllowAll is the engine used when no policy is configured
+type AllowAll struct{}
+
+// Evaluate always allows
+func (AllowAll) Evaluate(ctx context.Context, input Input) (Decision, error) {
+	return Decision{Allow: true}, nil
+}
+
+// OPAEngine evaluates policies on an Open Policy Agent server through its data
+// API. The rule at the configured path may return either a boolean or an
+// object with "allow" and an optional "reason".
+type OPAEngine struct {
+	url    string
+	client *http.Client
+}
+
+// NewOPAEngine creates an engine for the rule at dataURL, e.g.
+// http://localhost:8181/v1/data/batwa/authz
+func NewOPAEngine(dataURL string) *OPAEngine {
+	return &OPAEngine{
+		url:    strings.TrimSuffix(dataURL, "/"),
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Evaluate queries OPA with the input document
+func (e *OPAEngine) Evaluate(ctx context.Context, input Input) (Decision, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return Decision{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url, bytes.NewBuffer(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("policy server returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return Decision{}, err
+	}
+
+	// An undefined rule has no result and denies by default
+	if len(result.Result) == 0 {
+		return Decision{Allow: false, Reason: "no policy decision"}, nil
+	}
+
+	var allow bool
+	if err := json.Unmarshal(result.Result, &allow); err == nil {
+		return Decision{Allow: allow}, nil
+	}
+	var decision Decision
+	if err := json.Unmarshal(result.Result, &decision); err != nil {
+		return Decision{}, fmt.Errorf("unexpected policy result: %s", result.Result)
+	}
+	return decision, nil
+}
+
+// engineFromEnv uses OPA when POLICY_OPA_URL is set and allows everything otherwise
+func engineFromEnv() Engine {
+	if url := os.Getenv("POLICY_OPA_URL"); url != "" {
+		return NewOPAEngine(url)
+	}
+	return AllowAll{}
+}
+
+// CanAccessVM reports whether user may see and act on the VM described by
+// meta, which is nil for a VM without metadata. Admins reach every VM; other
+// users reach the VMs they own or that are shared with them, or every VM when
+// isolation is off.
+func (a *Authorizer) CanAccessVM(user string, admin bool, meta *models.VMMetadata) bool {
+	if admin || !a.isolation {
+		return true
+	}
+	if meta == nil {
+		return false
+	}
+	if meta.Owner == user {
+		return true
+	}
+	for _, shared := range meta.SharedWith {
+		if shared == user {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRole reports whether roles includes role
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package quotas
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+// The scopes a quota applies to
+const (
+	ScopeUser  = "user"
+	ScopeAgent = "agent"
+)
+
+// Repository persists quotas. The store keeps every quota in memory and
+// writes each change through to the repository.
+type Repository interface {
+	Load() (models.Quotas, error)
+	// Save saves the quota of a user or agent, replacing any saved before
+	Save(scope, subject string, quota models.Quota) error
+	Delete(scope, subject string) error
+}
+
+// FileRepository keeps quotas in a JSON file, rewritten on every change
+type FileRepository struct {
+	path   string
+	quotas models.Quotas
+	mutex  sync.Mutex
+}
+
+// NewFileRepository keeps quotas in the JSON file at path
+func NewFileRepository(path string) *FileRepository {
+	return &FileRepository{
+		path:   path,
+		quotas: models.Quotas{Users: map[string]models.Quota{}, Agents: map[string]models.Quota{}},
+	}
+}
+
+// Load reads the quotas saved in the file
+func (r *FileRepository) Load() (models.Quotas, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return r.quotas, nil
+	}
+	if err != nil {
+		return models.Quotas{}, err
+	}
+	var quotas models.Quotas
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		return models.Quotas{}, err
+	}
+	for user, quota := range quotas.Users {
+		r.quotas.Users[user] = quota
+	}
+	for agentID, quota := range quotas.Agents {
+		r.quotas.Agents[agentID] = quota
+	}
+	return quotas, nil
+}
+
+// Save saves a quota by rewriting the file
+func (r *FileRepository) Save(scope, subject string, quota models.Quota) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	quotas, err := r.scoped(scope)
+	if err != nil {
+		return err
+	}
+	quotas[subject] = quota
+	return r.write()
+}
+
+// Delete deletes a quota by rewriting the file
+func (r *FileRepository) Delete(scope, subject string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	quotas, err := r.scoped(scope)
+	if err != nil {
+		return err
+	}
+	delete(quotas, subject)
+	return r.write()
+}
+
+// scoped gets the quota map of scope
+func (r *FileRepository) scoped(scope string) (map[string]models.Quota, error) {
+	switch scope {
+	case ScopeUser:
+		return r.quotas.Users, nil
+	case ScopeAgent:
+		return r.quotas.Agents, nil
+	}
+	return nil, fmt.Errorf("unknown quota scope '%s'", scope)
+}
+
+// write writes the quotas to the file; the caller must hold the lock
+func (r *FileRepository) write() error {
+	data, err := json.MarshalIndent(r.quotas, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// DatabaseRepository keeps quotas in the master's database
+type DatabaseRepository struct {
+	db *storage.DB
+}
+
+// NewDatabaseRepository keeps quotas in db
+func NewDatabaseRepository(db *storage.DB) *DatabaseRepository {
+	return &DatabaseRepository{db: db}
+}
+
+// Load loads every quota from the database
+func (r *DatabaseRepository) Load() (models.Quotas, error) {
+	quotas := models.Quotas{Users: map[string]models.Quota{}, Agents: map[string]models.Quota{}}
+	rows, err := r.db.Query(`SELECT scope, subject, data FROM quotas`)
+	if err != nil {
+		return quotas, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var scope, subject, data string
+		if err := rows.Scan(&scope, &subject, &data); err != nil {
+			return quotas, err
+		}
+		var quota models.Quota
+		if err := json.Unmarshal([]byte(data), &quota); err != nil {
+			return quotas, err
+		}
+		switch scope {
+		case ScopeUser:
+			quotas.Users[subject] = quota
+		case ScopeAgent:
+			quotas.Agents[subject] = quota
+		}
+	}
+	return quotas, rows.Err()
+}
+
+// Save saves a quota to the database
+func (r *DatabaseRepository) Save(scope, subject string, quota models.Quota) error {
+	data, err := json.Marshal(quota)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`INSERT INTO quotas (scope, subject, data) VALUES (?, ?, ?)
+		ON CONFLICT (scope, subject) DO UPDATE SET data = excluded.data`,
+		scope, subject, string(data))
+	return err
+}
+
+// Delete deletes a quota from the database
+func (r *DatabaseRepository) Delete(scope, subject string) error {
+	_, err := r.db.Exec(`DELETE FROM quotas WHERE scope = ? AND subject = ?`, scope, subject)
+	return err
+}
@@ -0,0 +1,324 @@
+package quotas
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+var logger = logging.For("quotas")
+
+// VM is one VM counted against quotas. VMs on the master have an empty
+// AgentID; CPUs and Memory are zero when the VM does not report them.
+type VM struct {
+	Owner   string
+	AgentID string
+	CPUs    int
+	Memory  int64
+}
+
+// ExceededError is returned when a new VM would exceed one or more quotas
+type ExceededError struct {
+	Violations []models.QuotaViolation
+}
+
+func (e *ExceededError) Error() string {
+	parts := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		parts = append(parts, fmt.Sprintf("%s '%s' %s quota is %d, %d in use, %d requested",
+			v.Scope, v.Subject, v.Resource, v.Limit, v.Used, v.Requested))
+	}
+	return "Quota exceeded: " + strings.Join(parts, "; ")
+}
+
+// reservation is a VM being created, counted against quotas until its create
+// finishes and it shows up in the inventory
+type reservation struct {
+	user    string
+	agentID string
+	demand  models.QuotaUsage
+}
+
+// Store keeps the per-user and per-agent quotas, saved to a Repository after
+// every change, and the VMs being created that count against them
+type Store struct {
+	repository Repository
+	quotas     models.Quotas
+	pending    map[int]reservation
+	nextID     int
+	mutex      sync.RWMutex
+}
+
+// NewStore creates a quota store persisted to repository, loading the quotas
+// already saved there
+func NewStore(repository Repository) *Store {
+	s := &Store{
+		repository: repository,
+		quotas:     models.Quotas{Users: map[string]models.Quota{}, Agents: map[string]models.Quota{}},
+		pending:    make(map[int]reservation),
+	}
+	quotas, err := repository.Load()
+	if err != nil {
+		logger.Error("Failed to load quotas", "error", err)
+	}
+	for user, quota := range quotas.Users {
+		s.quotas.Users[user] = quota
+	}
+	for agentID, quota := range quotas.Agents {
+		s.quotas.Agents[agentID] = quota
+	}
+	return s
+}
+
+// NewStoreFromEnv creates a quota store in db, or persisted at QUOTAS_PATH
+// (default ./data/quotas.json) when db is nil. The first time a database is
+// used, the quotas in the file are copied into it.
+func NewStoreFromEnv(db *storage.DB) (*Store, error) {
+	path := os.Getenv("QUOTAS_PATH")
+	if path == "" {
+		path = filepath.Join("data", "quotas.json")
+	}
+	if db == nil {
+		return NewStore(NewFileRepository(path)), nil
+	}
+
+	repository := NewDatabaseRepository(db)
+	err := db.ImportOnce("quotas", func() (int, error) {
+		quotas, err := NewFileRepository(path).Load()
+		if err != nil {
+			return 0, err
+		}
+		for user, quota := range quotas.Users {
+			if err := repository.Save(ScopeUser, user, quota); err != nil {
+				return 0, err
+			}
+		}
+		for agentID, quota := range quotas.Agents {
+			if err := repository.Save(ScopeAgent, agentID, quota); err != nil {
+				return 0, err
+			}
+		}
+		return len(quotas.Users) + len(quotas.Agents), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(repository), nil
+}
+
+// Get returns a copy of every quota
+func (s *Store) Get() models.Quotas {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	quotas := models.Quotas{
+		Users:  make(map[string]models.Quota, len(s.quotas.Users)),
+		Agents: make(map[string]models.Quota, len(s.quotas.Agents)),
+	}
+	for user, quota := range s.quotas.Users {
+		quotas.Users[user] = quota
+	}
+	for agentID, quota := range s.quotas.Agents {
+		quotas.Agents[agentID] = quota
+	}
+	return quotas
+}
+
+// Applies reports whether a quota is set for user or for agentID, so callers
+// can skip counting usage when neither has one
+func (s *Store) Applies(user, agentID string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, userQuota := s.quotas.Users[user]
+	_, agentQuota := s.quotas.Agents[agentID]
+	return (user != "" && userQuota) || (agentID != "" && agentQuota)
+}
+
+// Validate checks that a quota's limits are usable
+func Validate(quota models.Quota) error {
+	if quota.MaxVMs < 0 || quota.MaxCPUs < 0 {
+		return fmt.Errorf("max_vms and max_cpus must not be negative")
+	}
+	if quota.MaxMemory != "" {
+		if _, err := ParseSize(quota.MaxMemory); err != nil {
+			return fmt.Errorf("max_memory: %v", err)
+		}
+	}
+	return nil
+}
+
+// SetUser sets the quota of a user on behalf of by
+func (s *Store) SetUser(user string, quota models.Quota, by string) models.Quota {
+	return s.set(ScopeUser, s.quotas.Users, user, quota, by)
+}
+
+// SetAgent sets the quota of an agent on behalf of by
+func (s *Store) SetAgent(agentID string, quota models.Quota, by string) models.Quota {
+	return s.set(ScopeAgent, s.quotas.Agents, agentID, quota, by)
+}
+
+// set stores a quota in the quota map of scope
+func (s *Store) set(scope string, quotas map[string]models.Quota, subject string, quota models.Quota, by string) models.Quota {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	quota.UpdatedBy = by
+	quota.UpdatedAt = &now
+	quotas[subject] = quota
+	if err := s.repository.Save(scope, subject, quota); err != nil {
+		logger.Error("Failed to save quota", "scope", scope, "subject", subject, "error", err)
+	}
+	return quota
+}
+
+// RemoveUser removes the quota of a user, reporting whether it had one
+func (s *Store) RemoveUser(user string) bool {
+	return s.remove(ScopeUser, s.quotas.Users, user)
+}
+
+// RemoveAgent removes the quota of an agent, reporting whether it had one
+func (s *Store) RemoveAgent(agentID string) bool {
+	return s.remove(ScopeAgent, s.quotas.Agents, agentID)
+}
+
+// remove deletes a quota from the quota map of scope
+func (s *Store) remove(scope string, quotas map[string]models.Quota, subject string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := quotas[subject]; !exists {
+		return false
+	}
+	delete(quotas, subject)
+	if err := s.repository.Delete(scope, subject); err != nil {
+		logger.Error("Failed to save quota", "scope", scope, "subject", subject, "error", err)
+	}
+	return true
+}
+
+// Tally adds up the VMs each user and each agent has in use
+func Tally(vms []VM) (users, agents map[string]models.QuotaUsage) {
+	users = make(map[string]models.QuotaUsage)
+	agents = make(map[string]models.QuotaUsage)
+	for _, vm := range vms {
+		if vm.Owner != "" {
+			users[vm.Owner] = add(users[vm.Owner], models.QuotaUsage{VMs: 1, CPUs: vm.CPUs, Memory: vm.Memory})
+		}
+		if vm.AgentID != "" {
+			agents[vm.AgentID] = add(agents[vm.AgentID], models.QuotaUsage{VMs: 1, CPUs: vm.CPUs, Memory: vm.Memory})
+		}
+	}
+	return users, agents
+}
+
+// add sums two usages
+func add(a, b models.QuotaUsage) models.QuotaUsage {
+	return models.QuotaUsage{VMs: a.VMs + b.VMs, CPUs: a.CPUs + b.CPUs, Memory: a.Memory + b.Memory}
+}
+
+// Reserve checks that a new VM of size demand, owned by user and placed on
+// agentID (empty for the master), fits the quotas given the VMs in use and
+// the VMs still being created. On success the VM counts against the quotas
+// until release is called, which the caller must do once the create is over.
+// Otherwise an *ExceededError lists every limit the VM would exceed.
+func (s *Store) Reserve(user, agentID string, demand models.QuotaUsage, inUse []VM) (func(), error) {
+	users, agents := Tally(inUse)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, pending := range s.pending {
+		if pending.user != "" {
+			users[pending.user] = add(users[pending.user], pending.demand)
+		}
+		if pending.agentID != "" {
+			agents[pending.agentID] = add(agents[pending.agentID], pending.demand)
+		}
+	}
+
+	violations := []models.QuotaViolation{}
+	if quota, ok := s.quotas.Users[user]; ok && user != "" {
+		violations = append(violations, check(ScopeUser, user, quota, users[user], demand)...)
+	}
+	if quota, ok := s.quotas.Agents[agentID]; ok && agentID != "" {
+		violations = append(violations, check(ScopeAgent, agentID, quota, agents[agentID], demand)...)
+	}
+	if len(violations) > 0 {
+		return nil, &ExceededError{Violations: violations}
+	}
+
+	id := s.nextID
+	s.nextID++
+	s.pending[id] = reservation{user: user, agentID: agentID, demand: demand}
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.pending, id)
+	}, nil
+}
+
+// check compares usage plus demand against each limit of quota
+func check(scope, subject string, quota models.Quota, used, demand models.QuotaUsage) []models.QuotaViolation {
+	violations := []models.QuotaViolation{}
+	exceeds := func(resource string, limit, used, requested int64) {
+		if limit > 0 && used+requested > limit {
+			violations = append(violations, models.QuotaViolation{
+				Scope:     scope,
+				Subject:   subject,
+				Resource:  resource,
+				Limit:     limit,
+				Used:      used,
+				Requested: requested,
+			})
+		}
+	}
+
+	exceeds("vms", int64(quota.MaxVMs), int64(used.VMs), int64(demand.VMs))
+	exceeds("cpus", int64(quota.MaxCPUs), int64(used.CPUs), int64(demand.CPUs))
+	if maxMemory, err := ParseSize(quota.MaxMemory); err == nil {
+		exceeds("memory", maxMemory, used.Memory, demand.Memory)
+	}
+	return violations
+}
+
+// sizeUnits are the multiples multipass accepts in sizes such as "2G"
+var sizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// ParseSize converts a multipass size such as "512M", "2G" or "2GiB" to
+// bytes. An empty size is zero.
+func ParseSize(size string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(size))
+	if value == "" {
+		return 0, nil
+	}
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	if value == "" {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+
+	unit := ""
+	if last := value[len(value)-1:]; sizeUnits[last] > 1 {
+		unit = last
+		value = value[:len(value)-1]
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(number * float64(sizeUnits[unit])), nil
+}
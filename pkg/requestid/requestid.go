@@ -0,0 +1,99 @@
+// Package requestid gives every request an ID, returned in the X-Request-ID
+// header and carried in the request's context, where logs written with it
+// pick it up.
+// The master forwards it to agents, which take it as their own, so one
+// operation can be followed through the logs of both.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/prashah/batwa/pkg/logging"
+)
+
+// Header carries request IDs in requests and responses
+const Header = fiber.HeaderXRequestID
+
+// LocalsKey is the fiber.Ctx local holding the request's ID
+const LocalsKey = "request_id"
+
+// maxLength bounds the IDs taken from callers
+const maxLength = 128
+
+type contextKey struct{}
+
+func init() {
+	logging.RegisterContextFields(func(ctx context.Context) []slog.Attr {
+		if id := FromContext(ctx); id != "" {
+			return []slog.Attr{slog.String(LocalsKey, id)}
+		}
+		return nil
+	})
+}
+
+// New returns middleware that gives each request an ID: the one the caller
+// sent, such as the master calling an agent, or a new one
+func New() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Get(Header)
+		if valid(id) {
+			// Fiber's strings point into buffers reused by later requests
+			id = utils.CopyString(id)
+		} else {
+			id = generate()
+		}
+		c.Set(Header, id)
+		c.Locals(LocalsKey, id)
+		c.SetUserContext(NewContext(c.UserContext(), id))
+		return c.Next()
+	}
+}
+
+// Get gets the ID of a request, or "" outside the middleware
+func Get(c *fiber.Ctx) string {
+	id, _ := c.Locals(LocalsKey).(string)
+	return id
+}
+
+// NewContext returns a context carrying a request ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext gets the request ID a context carries, or ""
+func FromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// valid reports whether a caller's ID is safe to log and pass on: short and
+// made of letters, digits, dots, dashes, underscores and colons
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '-', r == '_', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// generate makes a random request ID
+func generate() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,228 @@
+// Package retention archives agents that have been offline past the
+// retention period, keeping a history of departed agents and the VMs they
+// were last known to run.
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/bus"
+	"github.com/prashah/batwa/pkg/inventory"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/metadata"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+var logger = logging.For("retention")
+
+// DefaultRetentionDays is how long an agent may stay offline before it is
+// archived unless AGENT_RETENTION_DAYS overrides it
+const DefaultRetentionDays = 30
+
+// History keeps the departed agents, saved to a JSON file after every change
+type History struct {
+	path     string
+	departed []models.DepartedAgent
+	mutex    sync.RWMutex
+}
+
+// NewHistory creates an agent history persisted at path, loading the
+// departed agents already saved there
+func NewHistory(path string) *History {
+	h := &History{path: path}
+	if err := h.load(); err != nil {
+		logger.Error("Failed to load agent history", "path", path, "error", err)
+	}
+	return h
+}
+
+// NewHistoryFromEnv creates an agent history persisted at AGENT_HISTORY_PATH
+// (default ./data/agent_history.json)
+func NewHistoryFromEnv() *History {
+	path := os.Getenv("AGENT_HISTORY_PATH")
+	if path == "" {
+		path = filepath.Join("data", "agent_history.json")
+	}
+	return NewHistory(path)
+}
+
+// load reads the saved history
+func (h *History) load() error {
+	data, err := os.ReadFile(h.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &h.departed)
+}
+
+// save writes the history to the file; the caller must hold the lock
+func (h *History) save() {
+	data, err := json.MarshalIndent(h.departed, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(h.path), 0o755)
+	}
+	if err == nil {
+		tmp := h.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, h.path)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save agent history", "path", h.path, "error", err)
+	}
+}
+
+// Add records a departed agent
+func (h *History) Add(departed models.DepartedAgent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.departed = append(h.departed, departed)
+	h.save()
+}
+
+// List gets the departed agents, most recently archived first
+func (h *History) List() []models.DepartedAgent {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	departed := make([]models.DepartedAgent, len(h.departed))
+	copy(departed, h.departed)
+	sort.SliceStable(departed, func(i, j int) bool {
+		return departed[i].ArchivedAt.After(departed[j].ArchivedAt)
+	})
+	return departed
+}
+
+// Collector archives agents that have been offline longer than the retention
+// period: they are unregistered and recorded in the history with their last
+// known VMs
+type Collector struct {
+	registry      *agents.AgentRegistry
+	history       *History
+	events        *bus.Bus
+	inventory     *inventory.Cache
+	metadata      *metadata.Store
+	retention     time.Duration
+	checkInterval time.Duration
+	cancelFunc    context.CancelFunc
+}
+
+// NewCollectorFromEnv creates a collector archiving agents offline for
+// AGENT_RETENTION_DAYS (default 30) days into history, with the VMs cache or
+// store last knew them to run. 0 disables archiving.
+func NewCollectorFromEnv(registry *agents.AgentRegistry, history *History, events *bus.Bus, cache *inventory.Cache, store *metadata.Store) *Collector {
+	days := DefaultRetentionDays
+	if value := os.Getenv("AGENT_RETENTION_DAYS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			days = parsed
+		} else {
+			logger.Warn("Invalid AGENT_RETENTION_DAYS, using the default", "value", value, "default", DefaultRetentionDays)
+		}
+	}
+	return &Collector{
+		registry:      registry,
+		history:       history,
+		events:        events,
+		inventory:     cache,
+		metadata:      store,
+		retention:     time.Duration(days) * 24 * time.Hour,
+		checkInterval: time.Hour,
+	}
+}
+
+// Start starts the collector loop
+func (c *Collector) Start() {
+	if c.retention <= 0 {
+		logger.Info("Agent retention disabled; offline agents are never archived")
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancelFunc = cancel
+
+	go c.collectLoop(ctx)
+	logger.Info("Started stale agent collector", "retention", c.retention)
+}
+
+// Stop stops the collector loop
+func (c *Collector) Stop() {
+	if c.cancelFunc != nil {
+		c.cancelFunc()
+		logger.Info("Stopped stale agent collector")
+	}
+}
+
+// collectLoop periodically archives stale agents
+func (c *Collector) collectLoop(ctx context.Context) {
+	c.Collect(time.Now())
+
+	ticker := time.NewTicker(c.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Collect(time.Now())
+		}
+	}
+}
+
+// Collect archives every agent that is not online and was last seen more
+// than the retention period before now
+func (c *Collector) Collect(now time.Time) {
+	cutoff := now.Add(-c.retention)
+	for _, agent := range c.registry.GetAllAgents() {
+		if agent.Status == "online" || agent.LastSeen == nil || agent.LastSeen.After(cutoff) {
+			continue
+		}
+		c.archive(*agent, now)
+	}
+}
+
+// archive unregisters an agent and records it in the history
+func (c *Collector) archive(agent models.AgentInfo, now time.Time) {
+	departed := models.DepartedAgent{
+		Agent:      agent,
+		VMs:        c.lastKnownVMs(agent.AgentID),
+		ArchivedAt: now,
+	}
+	if !c.registry.UnregisterAgent(agent.AgentID) {
+		return
+	}
+	c.history.Add(departed)
+	c.events.Publish(models.Event{
+		Type:    "agent.archived",
+		AgentID: agent.AgentID,
+		Data:    map[string]string{"last_seen": agent.LastSeen.Format(time.RFC3339)},
+	})
+	logger.Info("Archived agent", "agent_id", agent.AgentID, "offline_since", agent.LastSeen.Format(time.RFC3339))
+}
+
+// lastKnownVMs gets the VMs an agent was last known to run: its cached
+// listing, or the VMs the metadata store has records for when nothing is
+// cached
+func (c *Collector) lastKnownVMs(agentID string) []models.VMInfoExtended {
+	if list, _, _, ok := c.inventory.Last(agentID); ok {
+		vms := make([]models.VMInfoExtended, len(list.VMs))
+		copy(vms, list.VMs)
+		return vms
+	}
+
+	vms := []models.VMInfoExtended{}
+	for _, meta := range c.metadata.List(&agentID) {
+		vms = append(vms, models.VMInfoExtended{Name: meta.Name, State: "Unknown"})
+	}
+	return vms
+}
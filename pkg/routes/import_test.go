@@ -0,0 +1,103 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/auth"
+	"github.com/prashah/batwa/pkg/bus"
+	"github.com/prashah/batwa/pkg/communication"
+	"github.com/prashah/batwa/pkg/executor"
+	"github.com/prashah/batwa/pkg/inventory"
+	"github.com/prashah/batwa/pkg/metadata"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/multipass"
+	"github.com/prashah/batwa/pkg/policy"
+)
+
+// TestImportAgentRefusesUsers checks that a user who is not an admin cannot
+// import, and so cannot take ownership of, an agent's VMs that have no
+// metadata yet
+func TestImportAgentRefusesUsers(t *testing.T) {
+	dir := t.TempDir()
+	authService, err := auth.NewService(auth.NewFileUserRepository(filepath.Join(dir, "users.json")),
+		auth.NewMemorySessionStore(), time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []struct {
+		name  string
+		admin bool
+	}{{"alice", false}, {"root", true}} {
+		if _, err := authService.CreateUser(user.name, "Firstpass1!", user.admin); err != nil {
+			t.Fatal(err)
+		}
+		if err := authService.ChangePassword(user.name, "Firstpass1!", "Secondpass2!"); err != nil {
+			t.Fatal(err)
+		}
+		authService.SetSession(user.name+"-session", &models.Session{Username: user.name})
+	}
+
+	// An agent running two VMs nobody owns
+	listed := 0
+	agentServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/vm/list" {
+			http.NotFound(w, r)
+			return
+		}
+		listed++
+		json.NewEncoder(w).Encode(models.VMList{VMs: []models.VMInfoExtended{{Name: "db"}, {Name: "web"}}})
+	}))
+	defer agentServer.Close()
+
+	registry := agents.NewAgentRegistry()
+	if _, err := registry.RegisterAgent(models.AgentRegisterRequest{AgentID: "a1", Hostname: "a1", APIURL: agentServer.URL}, ""); err != nil {
+		t.Fatal(err)
+	}
+	metadataStore := metadata.NewStore(metadata.NewFileRepository(filepath.Join(dir, "metadata.json")))
+	communicator := communication.NewHTTPCommunicator(registry, 5*time.Second)
+	server := &Server{
+		Auth:      authService,
+		Registry:  registry,
+		Executors: executor.NewExecutorFactory(registry, communicator, bus.New(), inventory.NewCache(time.Minute), multipass.NewRunner(nil), nil),
+		Metadata:  metadataStore,
+		Policy:    policy.NewAuthorizer(policy.AllowAll{}, authService, metadataStore, false, true),
+	}
+	app := fiber.New()
+	server.SetupRoutes(app)
+
+	importAs := func(user string) int {
+		req := httptest.NewRequest("POST", "/api/v1/agent/import/a1", nil)
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: user + "-session"})
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := importAs("alice"); status != fiber.StatusForbidden {
+		t.Fatalf("import by a user answered %d, want 403", status)
+	}
+	if listed != 0 {
+		t.Errorf("import by a user listed the agent's VMs")
+	}
+	for _, name := range []string{"db", "web"} {
+		if meta := metadataStore.Get("a1", name); meta != nil {
+			t.Errorf("import by a user gave %s to %q", name, meta.Owner)
+		}
+	}
+
+	if status := importAs("root"); status != fiber.StatusOK {
+		t.Fatalf("import by an admin answered %d, want 200", status)
+	}
+	if meta := metadataStore.Get("a1", "web"); meta == nil || meta.Owner != "root" {
+		t.Errorf("import by an admin did not give web to root: %+v", meta)
+	}
+}
@@ -0,0 +1,525 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prashah/batwa/pkg/apiversion"
+	"github.com/prashah/batwa/pkg/inventory"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/openapi"
+)
+
+// APIVersion is the version of the API the OpenAPI document describes
+const APIVersion = "1.0.0"
+
+// Parts of answers several operations share
+var (
+	// okAnswer is the answer of operations that only report success
+	okAnswer = openapi.Fields{"success": true, "message": ""}
+	// agentAnswer reports a change to an agent
+	agentAnswer = openapi.Fields{"success": true, "message": "", "agent": &models.AgentInfo{}}
+	// createAnswer reports a created VM
+	createAnswer = openapi.Fields{
+		"success":          true,
+		"message":          "",
+		"vm_name":          "",
+		"agent_id":         (*string)(nil),
+		"agent_hostname":   (*string)(nil),
+		"state":            "",
+		"blueprint":        "",
+		"blueprint_output": []string{},
+		"expires_at":       (*time.Time)(nil),
+		"expiry_action":    "",
+		"provision":        &models.RemoteCommandResponse{},
+		"warnings":         []string{},
+	}
+	// batchEntry reports one VM of a batch, with the HTTP status creating it
+	// alone would have been answered with
+	batchEntry = with(createAnswer, openapi.Fields{"name": "", "status": 0, "error": &models.ErrorResponse{}})
+	// batchAnswer reports VMs created together
+	batchAnswer = openapi.Fields{"success": true, "succeeded": 0, "failed": 0, "results": []openapi.Fields{batchEntry}}
+	// bulkEntry reports one VM of a bulk action
+	bulkEntry = openapi.Fields{"name": "", "agent_id": "", "success": true, "message": "", "error": &models.ErrorResponse{}}
+	// bulkAnswer reports an action taken on many VMs
+	bulkAnswer = openapi.Fields{"success": true, "action": "", "succeeded": 0, "failed": 0, "results": []openapi.Fields{bulkEntry}}
+	// metadataAnswer reports a change to a VM's metadata
+	metadataAnswer = openapi.Fields{"success": true, "message": "", "metadata": &models.VMMetadata{}}
+	// tokenAnswer is a JWT pair
+	tokenAnswer = openapi.Fields{"success": true, "access_token": "", "refresh_token": "", "token_type": "", "expires_in": 0}
+)
+
+// Query parameters several operations share
+var (
+	agentParam = openapi.Param{Name: "agent_id", Description: "The agent to ask; the master when empty", Type: ""}
+	vmParam    = openapi.Param{Name: "vm_name", Description: "Only entries of this VM", Type: ""}
+)
+
+// listParams are the parameters inventory.ParseQuery reads from requests
+// for a list sortable by sortFields
+func listParams(sortFields []string) []openapi.Param {
+	return []openapi.Param{
+		{Name: "state", Description: "Only entries in one of these comma separated states", Type: ""},
+		{Name: "agent_id", Description: "Only entries of these comma separated agents; local for the master", Type: ""},
+		{Name: "label", Description: "Only entries with this key=value label, or with the key set", Type: ""},
+		{Name: "sort", Description: "Sort by " + strings.Join(sortFields, ", ") + "; prefix - for descending", Type: ""},
+		{Name: "limit", Description: fmt.Sprintf("Entries per page, at most %d; every entry when 0", inventory.MaxLimit), Type: 0},
+		{Name: "offset", Description: "Entries to skip", Type: 0},
+	}
+}
+
+// with merges the fields of answers, later ones winning
+func with(answers ...openapi.Fields) openapi.Fields {
+	merged := openapi.Fields{}
+	for _, answer := range answers {
+		for name, value := range answer {
+			merged[name] = value
+		}
+	}
+	return merged
+}
+
+// Operations describes the master's API: every route SetupRoutes registers
+// and the terminal websocket, with the types of their bodies
+func Operations() []openapi.Operation {
+	const (
+		public  = openapi.AccessPublic
+		pending = openapi.AccessPending
+		user    = openapi.AccessUser
+		admin   = openapi.AccessAdmin
+		agent   = openapi.AccessAgent
+	)
+	get, post, put, del := fiber.MethodGet, fiber.MethodPost, fiber.MethodPut, fiber.MethodDelete
+
+	return []openapi.Operation{
+		// Health
+		{Method: get, Path: "/healthz", ID: "Healthz", Tag: "Health", Access: public,
+			Summary:  "Report liveness and whether VMs can be managed on the master itself",
+			Response: openapi.Fields{"status": "", "mode": "", "local_executor": false, "online_agents": 0}},
+		{Method: get, Path: "/readyz", ID: "Readyz", Tag: "Health", Access: public,
+			Summary:  "Report whether the master is ready to serve; answers 503 with the failed checks when not",
+			Response: openapi.Fields{"status": "", "checks": map[string]models.ReadinessCheck{}}},
+		{Method: get, Path: "/api/v1/openapi.json", ID: "GetOpenAPI", Tag: "Health", Access: public,
+			Summary: "Get this OpenAPI document", Response: map[string]interface{}{}},
+
+		// Admin
+		{Method: get, Path: "/api/v1/admin/status", ID: "AdminStatus", Tag: "Admin", Access: admin,
+			Summary: "Report the master's executors and each agent's requests in flight",
+			Response: openapi.Fields{"success": true, "local_executor": false, "max_in_flight": 0,
+				"agents": []openapi.Fields{{"agent_id": "", "hostname": "", "status": "", "in_flight": 0}}}},
+		{Method: post, Path: "/api/v1/admin/secrets/reload", ID: "ReloadSecrets", Tag: "Admin", Access: admin,
+			Summary:  "Reload secrets from Vault or their files",
+			Response: openapi.Fields{"success": true, "reloaded": []string{}, "failed": map[string]string{}}},
+		{Method: post, Path: "/api/v1/admin/backup", ID: "CreateBackup", Tag: "Admin", Access: admin,
+			Summary: "Download an archive of the users, agents, templates, VM metadata and finished tasks", Stream: openapi.StreamFile},
+
+		// Authentication
+		{Method: post, Path: "/api/v1/auth/login", ID: "Login", Tag: "Auth", Access: public,
+			Summary: "Log in, setting the session cookie", Request: models.LoginRequest{},
+			Response: openapi.Fields{"success": true, "message": "", "must_change_password": false}},
+		{Method: post, Path: "/api/v1/auth/logout", ID: "Logout", Tag: "Auth", Access: public,
+			Summary: "Log out, ending the session", Response: okAnswer},
+		{Method: post, Path: "/api/v1/auth/token", ID: "IssueJWT", Tag: "Auth", Access: public,
+			Summary: "Exchange a username and password for a JWT pair", Request: models.LoginRequest{},
+			Response: with(tokenAnswer, openapi.Fields{"must_change_password": false})},
+		{Method: post, Path: "/api/v1/auth/refresh", ID: "RefreshJWT", Tag: "Auth", Access: public,
+			Summary: "Exchange a refresh token for a new JWT pair", Request: models.RefreshRequest{}, Response: tokenAnswer},
+		{Method: get, Path: "/api/v1/auth/oidc/login", ID: "OIDCLogin", Tag: "Auth", Access: public, NoClient: true,
+			Summary: "Redirect the browser to the identity provider"},
+		{Method: get, Path: "/api/v1/auth/oidc/callback", ID: "OIDCCallback", Tag: "Auth", Access: public, NoClient: true,
+			Summary: "Finish an OIDC login and redirect the browser to the UI",
+			Query:   []openapi.Param{{Name: "code", Type: ""}, {Name: "state", Type: ""}, {Name: "error", Type: ""}}},
+		{Method: get, Path: "/api/v1/auth/check", ID: "CheckAuth", Tag: "Auth", Access: public,
+			Summary:  "Report whether the request is logged in, and as whom",
+			Response: openapi.Fields{"authenticated": false, "username": "", "admin": false, "must_change_password": false, "oidc": false}},
+		{Method: post, Path: "/api/v1/auth/change-password", ID: "ChangePassword", Tag: "Auth", Access: pending,
+			Summary: "Change the current user's password", Request: models.PasswordChangeRequest{}, Response: okAnswer},
+
+		// Users
+		{Method: post, Path: "/api/v1/users", ID: "CreateUser", Tag: "Users", Access: admin,
+			Summary: "Create a user or service account", Request: models.UserCreateRequest{},
+			Response: openapi.Fields{"success": true, "user": models.UserInfo{}}},
+		{Method: get, Path: "/api/v1/users", ID: "ListUsers", Tag: "Users", Access: admin,
+			Summary: "List the users", Response: openapi.Fields{"success": true, "users": []models.UserInfo{}}},
+		{Method: del, Path: "/api/v1/users/:username", ID: "DeleteUser", Tag: "Users", Access: admin,
+			Summary: "Delete a user", Response: okAnswer},
+
+		// API tokens
+		{Method: post, Path: "/api/v1/tokens", ID: "CreateToken", Tag: "Tokens", Access: user,
+			Summary: "Create an API token; its secret is only answered now", Request: models.TokenCreateRequest{},
+			Response: openapi.Fields{"success": true, "message": "", "secret": "", "token": models.APIToken{}}},
+		{Method: get, Path: "/api/v1/tokens", ID: "ListTokens", Tag: "Tokens", Access: user,
+			Summary:  "List API tokens: the user's own, or for admins every token",
+			Query:    []openapi.Param{{Name: "user", Description: "Only tokens of this user (admins)", Type: ""}},
+			Response: openapi.Fields{"success": true, "tokens": []models.APIToken{}}},
+		{Method: del, Path: "/api/v1/tokens/:id", ID: "DeleteToken", Tag: "Tokens", Access: user,
+			Summary: "Revoke an API token", Response: okAnswer},
+
+		// Agents
+		{Method: post, Path: "/api/v1/agent/register", ID: "RegisterAgent", Tag: "Agents", Access: agent,
+			Summary: "Register an agent with the master", Request: models.AgentRegisterRequest{}, Response: agentAnswer},
+		{Method: del, Path: "/api/v1/agent/unregister/:agent_id", ID: "UnregisterAgent", Tag: "Agents", Access: user,
+			Summary: "Unregister an agent", Response: okAnswer},
+		{Method: get, Path: "/api/v1/agent/list", ID: "ListAgents", Tag: "Agents", Access: user,
+			Summary: "List the registered agents; X-Total-Count has how many matched",
+			Query:   listParams(inventory.AgentSortFields), Response: []*models.AgentInfo{}},
+		{Method: get, Path: "/api/v1/agent/history", ID: "AgentHistory", Tag: "Agents", Access: user,
+			Summary:  "List agents archived after staying offline past the retention period",
+			Response: openapi.Fields{"agents": []models.DepartedAgent{}}},
+		{Method: get, Path: "/api/v1/agent/info/:agent_id", ID: "GetAgentInfo", Tag: "Agents", Access: user,
+			Summary: "Get an agent", Response: openapi.Fields{"success": true, "agent": &models.AgentInfo{}}},
+		{Method: post, Path: "/api/v1/agent/heartbeat", ID: "AgentHeartbeat", Tag: "Agents", Access: agent,
+			Summary: "Report an agent is alive, with its health", Request: models.AgentHeartbeat{}, Response: okAnswer},
+		{Method: post, Path: "/api/v1/agent/vm-state", ID: "AgentVMState", Tag: "Agents", Access: agent,
+			Summary: "Report changes to an agent's VMs", Request: models.AgentVMReport{}, Response: okAnswer},
+		{Method: post, Path: "/api/v1/agent/deregister", ID: "DeregisterAgent", Tag: "Agents", Access: agent,
+			Summary: "Mark an agent that is shutting down offline", Request: models.AgentDeregisterRequest{}, Response: okAnswer},
+		{Method: get, Path: "/api/v1/agent/tunnel", ID: "AgentTunnel", Tag: "Agents", Access: agent, NoClient: true,
+			Summary: "Open the websocket tunnel a tunnel agent is reached over", Stream: openapi.StreamWebsocket,
+			Query: []openapi.Param{{Name: "agent_id", Type: ""}}},
+		{Method: post, Path: "/api/v1/agent/import/:agent_id", ID: "ImportAgent", Tag: "Agents", Access: admin,
+			Summary: "Import an agent's existing VMs into the metadata store", Request: models.AgentImportRequest{},
+			Response: openapi.Fields{"success": true, "message": "", "imported": []*models.VMMetadata{}, "skipped": []string{}}},
+		{Method: post, Path: "/api/v1/agent/:agent_id/drain", ID: "DrainAgent", Tag: "Agents", Access: admin,
+			Summary: "Stop placing new VMs on an agent, optionally stopping its VMs", Request: models.AgentDrainRequest{},
+			Response: with(agentAnswer, openapi.Fields{"stopped": 0, "failed": 0, "results": []openapi.Fields{bulkEntry}})},
+		{Method: post, Path: "/api/v1/agent/:agent_id/undrain", ID: "UndrainAgent", Tag: "Agents", Access: admin,
+			Summary: "Place new VMs on a drained agent again", Response: agentAnswer},
+		{Method: post, Path: "/api/v1/agent/:agent_id/rotate-key", ID: "RotateAgentKey", Tag: "Agents", Access: admin,
+			Summary: "Rotate the API key the master calls an agent with", Response: okAnswer},
+		{Method: put, Path: "/api/v1/agent/:agent_id/zone", ID: "SetAgentZone", Tag: "Agents", Access: admin,
+			Summary: "Move an agent to a zone", Request: models.AgentZoneRequest{}, Response: agentAnswer},
+		{Method: post, Path: "/api/v1/agent/approve/:agent_id", ID: "ApproveAgent", Tag: "Agents", Access: admin,
+			Summary:  "Approve an agent awaiting approval",
+			Response: with(agentAnswer, openapi.Fields{"approval": &models.AgentApproval{}})},
+		{Method: post, Path: "/api/v1/agent/reject/:agent_id", ID: "RejectAgent", Tag: "Agents", Access: admin,
+			Summary:  "Reject an agent awaiting approval",
+			Response: with(okAnswer, openapi.Fields{"approval": &models.AgentApproval{}})},
+
+		// Terminal
+		{Method: post, Path: "/api/v1/terminal/ticket", ID: "IssueTerminalTicket", Tag: "Terminal", Access: user,
+			Summary: "Issue a one-time ticket to open a VM's terminal", Request: models.TerminalTicketRequest{},
+			Response: openapi.Fields{"success": true, "ticket": "", "vm_name": "", "agent_id": "", "expires_in": 0}},
+		{Method: get, Path: "/ws", ID: "Terminal", Tag: "Terminal", Access: public, NoClient: true,
+			Summary: "Open a VM's terminal over a websocket, with a ticket", Stream: openapi.StreamWebsocket,
+			Query: []openapi.Param{{Name: "ticket", Type: ""}, {Name: "vm_name", Type: ""}, {Name: "agent_id", Type: ""}}},
+
+		// Tasks
+		{Method: get, Path: "/api/v1/tasks", ID: "ListTasks", Tag: "Tasks", Access: user,
+			Summary: "Search the task history, newest first",
+			Query: []openapi.Param{
+				{Name: "user", Type: ""}, {Name: "agent", Type: ""}, {Name: "vm", Type: ""}, {Name: "state", Type: ""},
+				{Name: "since", Description: "Only tasks created since this RFC 3339 time", Type: ""},
+				{Name: "limit", Description: "Tasks per page: 100 by default, at most 1000", Type: 0},
+				{Name: "offset", Type: 0},
+			},
+			Response: openapi.Fields{"success": true, "tasks": []models.Task{}, "total": 0, "limit": 0, "offset": 0}},
+		{Method: get, Path: "/api/v1/tasks/:id", ID: "GetTask", Tag: "Tasks", Access: user,
+			Summary: "Get a task with its logs and outcome", Response: openapi.Fields{"success": true, "task": models.Task{}}},
+
+		// Zones
+		{Method: get, Path: "/api/v1/zones", ID: "ListZones", Tag: "Zones", Access: user,
+			Summary: "List the zones that have agents", Response: openapi.Fields{"zones": []models.ZoneInfo{}}},
+		{Method: get, Path: "/api/v1/zones/:zone/agents", ID: "ListZoneAgents", Tag: "Zones", Access: user,
+			Summary: "List the agents in a zone", Response: openapi.Fields{"zone": "", "agents": []*models.AgentInfo{}}},
+		{Method: post, Path: "/api/v1/zones/:zone/vm/create", ID: "CreateZoneVM", Tag: "Zones", Access: user, Async: true,
+			Summary: "Create a VM on the best agent of a zone", Request: models.VMCreateRequest{}, Response: createAnswer},
+
+		// Defaults
+		{Method: get, Path: "/api/v1/defaults", ID: "GetDefaults", Tag: "Defaults", Access: user,
+			Summary: "Get the primary VM and the default agent", Response: openapi.Fields{"success": true, "defaults": models.Defaults{}}},
+		{Method: put, Path: "/api/v1/defaults", ID: "SetDefaults", Tag: "Defaults", Access: admin,
+			Summary: "Set the primary VM and the default agent", Request: models.Defaults{},
+			Response: openapi.Fields{"success": true, "defaults": models.Defaults{}}},
+		{Method: put, Path: "/api/v1/defaults/ssh-keys", ID: "SetDefaultSSHKeys", Tag: "Defaults", Access: admin,
+			Summary: "Set the SSH keys authorized in every new VM", Request: openapi.Fields{"ssh_keys": []string{}},
+			Response: openapi.Fields{"success": true, "defaults": models.Defaults{}}},
+
+		// Quotas
+		{Method: get, Path: "/api/v1/quotas", ID: "ListQuotas", Tag: "Quotas", Access: user,
+			Summary: "List the quotas with what each user and agent uses",
+			Response: openapi.Fields{"success": true, "quotas": models.Quotas{},
+				"usage": openapi.Fields{"users": map[string]models.QuotaUsage{}, "agents": map[string]models.QuotaUsage{}}}},
+		{Method: put, Path: "/api/v1/quotas/users/:username", ID: "SetUserQuota", Tag: "Quotas", Access: admin,
+			Summary: "Set the quota of a user", Request: models.Quota{}, Response: openapi.Fields{"success": true, "quota": models.Quota{}}},
+		{Method: del, Path: "/api/v1/quotas/users/:username", ID: "DeleteUserQuota", Tag: "Quotas", Access: admin,
+			Summary: "Remove the quota of a user", Response: okAnswer},
+		{Method: put, Path: "/api/v1/quotas/agents/:agent_id", ID: "SetAgentQuota", Tag: "Quotas", Access: admin,
+			Summary: "Set the quota of an agent", Request: models.Quota{}, Response: openapi.Fields{"success": true, "quota": models.Quota{}}},
+		{Method: del, Path: "/api/v1/quotas/agents/:agent_id", ID: "DeleteAgentQuota", Tag: "Quotas", Access: admin,
+			Summary: "Remove the quota of an agent", Response: okAnswer},
+
+		// Maintenance
+		{Method: post, Path: "/api/v1/maintenance/windows", ID: "CreateMaintenanceWindow", Tag: "Maintenance", Access: admin,
+			Summary: "Schedule a recurring maintenance window for an agent or zone", Request: models.MaintenanceWindow{},
+			Response: openapi.Fields{"success": true, "window": models.MaintenanceWindow{}}},
+		{Method: get, Path: "/api/v1/maintenance/windows", ID: "ListMaintenanceWindows", Tag: "Maintenance", Access: user,
+			Summary: "List maintenance windows with their current or next occurrence",
+			Query:   []openapi.Param{{Name: "agent_id", Description: "Only windows covering this agent", Type: ""}},
+			Response: openapi.Fields{"success": true, "windows": []openapi.Fields{{
+				"window": &models.MaintenanceWindow{}, "active": false,
+				"current_start": time.Time{}, "current_end": time.Time{}, "next_start": time.Time{}, "next_end": time.Time{},
+			}}}},
+		{Method: del, Path: "/api/v1/maintenance/windows/:id", ID: "DeleteMaintenanceWindow", Tag: "Maintenance", Access: admin,
+			Summary: "Remove a maintenance window", Response: okAnswer},
+
+		// Power schedules
+		{Method: post, Path: "/api/v1/schedules", ID: "CreateSchedule", Tag: "Schedules", Access: user,
+			Summary: "Create a power schedule", Request: models.PowerSchedule{},
+			Response: openapi.Fields{"success": true, "schedule": models.PowerSchedule{}}},
+		{Method: get, Path: "/api/v1/schedules", ID: "ListSchedules", Tag: "Schedules", Access: user,
+			Summary: "List power schedules with their next run",
+			Response: openapi.Fields{"success": true, "schedules": []openapi.Fields{{
+				"schedule": &models.PowerSchedule{}, "next_run": time.Time{}, "next_action": "",
+			}}}},
+		{Method: del, Path: "/api/v1/schedules/:id", ID: "DeleteSchedule", Tag: "Schedules", Access: user,
+			Summary: "Remove a power schedule", Response: okAnswer},
+		{Method: post, Path: "/api/v1/schedules/:id/run", ID: "RunSchedule", Tag: "Schedules", Access: user,
+			Summary: "Run one of a schedule's actions now", Request: openapi.Fields{"action": ""},
+			Response: openapi.Fields{"success": true, "run": &models.ScheduleRun{}}},
+
+		// Stacks
+		{Method: post, Path: "/api/v1/stacks", ID: "CreateStack", Tag: "Stacks", Access: user,
+			Summary: "Create a stack of VMs", Request: models.StackCreateRequest{},
+			Response: with(batchAnswer, openapi.Fields{"stack": &models.Stack{}})},
+		{Method: get, Path: "/api/v1/stacks", ID: "ListStacks", Tag: "Stacks", Access: user,
+			Summary: "List stacks", Response: openapi.Fields{"success": true, "stacks": []*models.Stack{}}},
+		{Method: get, Path: "/api/v1/stacks/:name", ID: "GetStack", Tag: "Stacks", Access: user,
+			Summary: "Get a stack's members with their current state",
+			Response: openapi.Fields{"success": true, "name": "", "description": "", "created_by": "", "created_at": time.Time{},
+				"states":  map[string]int{},
+				"members": []openapi.Fields{{"vm_name": "", "role": "", "agent_id": "", "state": "", "agent_hostname": (*string)(nil)}}}},
+		{Method: post, Path: "/api/v1/stacks/:name/:action", ID: "StackAction", Tag: "Stacks", Access: user,
+			Summary: "Start, stop, suspend, restart or resume every VM of a stack", Response: bulkAnswer},
+		{Method: del, Path: "/api/v1/stacks/:name", ID: "DeleteStack", Tag: "Stacks", Access: user,
+			Summary:  "Delete a stack and its VMs",
+			Response: openapi.Fields{"success": true, "succeeded": 0, "failed": 0, "results": []openapi.Fields{bulkEntry}}},
+
+		// Templates
+		{Method: post, Path: "/api/v1/templates", ID: "CreateTemplate", Tag: "Templates", Access: admin,
+			Summary: "Define a VM template", Request: models.VMTemplate{},
+			Response: openapi.Fields{"success": true, "template": models.VMTemplate{}}},
+		{Method: get, Path: "/api/v1/templates", ID: "ListTemplates", Tag: "Templates", Access: user,
+			Summary: "List the VM templates", Response: openapi.Fields{"success": true, "templates": []*models.VMTemplate{}}},
+		{Method: get, Path: "/api/v1/templates/:name", ID: "GetTemplate", Tag: "Templates", Access: user,
+			Summary: "Get a VM template", Response: openapi.Fields{"success": true, "template": &models.VMTemplate{}}},
+		{Method: put, Path: "/api/v1/templates/:name", ID: "UpdateTemplate", Tag: "Templates", Access: admin,
+			Summary: "Replace a VM template", Request: models.VMTemplate{},
+			Response: openapi.Fields{"success": true, "template": models.VMTemplate{}}},
+		{Method: del, Path: "/api/v1/templates/:name", ID: "DeleteTemplate", Tag: "Templates", Access: admin,
+			Summary: "Remove a VM template", Response: okAnswer},
+
+		// Notifications and events
+		{Method: get, Path: "/api/v1/notifications", ID: "ListNotifications", Tag: "Events", Access: user,
+			Summary: "List the current user's notifications", Response: openapi.Fields{"success": true, "notifications": []*models.Notification{}}},
+		{Method: get, Path: "/api/v1/events/poll", ID: "PollEvents", Tag: "Events", Access: user,
+			Summary: "Long-poll for the events after a cursor",
+			Query: []openapi.Param{
+				{Name: "cursor", Description: "The cursor of the previous poll; empty starts from now", Type: ""},
+				{Name: "limit", Type: 0},
+				{Name: "timeout", Description: "Seconds to wait for an event", Type: 0},
+			},
+			Response: openapi.Fields{"success": true, "events": []*models.Event{}, "cursor": "", "truncated": false}},
+		{Method: get, Path: "/api/v1/events/stream", ID: "StreamEvents", Tag: "Events", Access: user,
+			Summary: "Stream events as server-sent events", Stream: openapi.StreamEvents,
+			Query: []openapi.Param{
+				{Name: "cursor", Description: "Resume after this event ID", Type: ""},
+				{Name: "types", Description: "Comma separated event types to stream", Type: ""},
+			}},
+
+		// Access logs
+		{Method: get, Path: "/api/v1/access-logs", ID: "ListAccessLogs", Tag: "Access Logs", Access: admin,
+			Summary: "Search the access log, newest first",
+			Query: []openapi.Param{
+				{Name: "user", Type: ""}, {Name: "token", Type: ""}, {Name: "route", Type: ""}, agentParam, vmParam,
+				{Name: "status", Type: 0}, {Name: "limit", Type: 0},
+			},
+			Response: openapi.Fields{"success": true, "entries": []*models.AccessLogEntry{}}},
+
+		// Digest
+		{Method: get, Path: "/api/v1/digest/latest", ID: "GetLatestDigest", Tag: "Digest", Access: user,
+			Summary:  "Get the latest digest: all of it for admins, the user's items for others",
+			Response: openapi.Fields{"success": true, "digest": &models.Digest{}, "generated_at": time.Time{}, "items": []models.DigestItem{}}},
+		{Method: post, Path: "/api/v1/digest/generate", ID: "GenerateDigest", Tag: "Digest", Access: admin,
+			Summary: "Compile and deliver a digest now", Response: openapi.Fields{"success": true, "digest": &models.Digest{}}},
+
+		// Artifacts
+		{Method: get, Path: "/api/v1/artifacts", ID: "ListArtifacts", Tag: "Artifacts", Access: user,
+			Summary: "List the artifacts collected from VMs", Query: []openapi.Param{agentParam, vmParam},
+			Response: openapi.Fields{"success": true, "artifacts": []*models.Artifact{}}},
+		{Method: get, Path: "/api/v1/artifacts/:id", ID: "GetArtifact", Tag: "Artifacts", Access: user,
+			Summary: "Get an artifact's metadata", Response: openapi.Fields{"success": true, "artifact": &models.Artifact{}}},
+		{Method: get, Path: "/api/v1/artifacts/:id/download", ID: "DownloadArtifact", Tag: "Artifacts", Access: user,
+			Summary: "Download an artifact's contents", Stream: openapi.StreamFile},
+		{Method: del, Path: "/api/v1/artifacts/:id", ID: "DeleteArtifact", Tag: "Artifacts", Access: user,
+			Summary: "Remove an artifact", Response: okAnswer},
+
+		// Host
+		{Method: get, Path: "/api/v1/blueprints", ID: "ListBlueprints", Tag: "Host", Access: user,
+			Summary: "List the blueprints a host can launch", Query: []openapi.Param{agentParam},
+			Response: openapi.Fields{"success": true, "blueprints": []models.Blueprint{}}},
+		{Method: get, Path: "/api/v1/networks", ID: "ListNetworks", Tag: "Host", Access: user,
+			Summary: "List the interfaces a host's VMs can be bridged onto", Query: []openapi.Param{agentParam},
+			Response: openapi.Fields{"success": true, "networks": []models.Network{}}},
+		{Method: get, Path: "/api/v1/host/health", ID: "GetHostHealth", Tag: "Host", Access: user,
+			Summary: "Report the health of the master and every agent",
+			Response: openapi.Fields{"success": true, "hosts": []openapi.Fields{{
+				"agent_id": (*string)(nil), "hostname": "", "status": "", "health": &models.HostHealth{},
+			}}}},
+		{Method: get, Path: "/api/v1/host/version", ID: "GetHostVersion", Tag: "Host", Access: user,
+			Summary: "Report a host's multipass version", Query: []openapi.Param{agentParam},
+			Response: openapi.Fields{"success": true, "version": &models.HostVersion{}}},
+		{Method: get, Path: "/api/v1/host/settings", ID: "GetHostSettings", Tag: "Host", Access: admin,
+			Summary:  "Read a host's multipass daemon settings",
+			Query:    []openapi.Param{agentParam, {Name: "keys", Description: "Comma separated settings to read", Type: ""}},
+			Response: openapi.Fields{"success": true, "settings": map[string]string{}}},
+		{Method: put, Path: "/api/v1/host/settings", ID: "SetHostSettings", Tag: "Host", Access: admin,
+			Summary: "Change a host's multipass daemon settings", Request: models.HostSettingsRequest{},
+			Response: openapi.Fields{"success": true, "settings": map[string]string{}, "warning": ""}},
+		{Method: get, Path: "/api/v1/host/storage", ID: "GetHostStorage", Tag: "Host", Access: user,
+			Summary: "Report the disk space multipass uses on a host", Query: []openapi.Param{agentParam},
+			Response: openapi.Fields{"success": true, "storage": &models.HostStorage{}}},
+		{Method: post, Path: "/api/v1/host/prune", ID: "PruneHost", Tag: "Host", Access: admin,
+			Summary: "Purge deleted VMs and clear the image cache of a host", Request: models.HostPruneRequest{},
+			Response: openapi.Fields{"success": true, "prune": &models.HostPruneResult{}}},
+
+		// VMs
+		{Method: post, Path: "/api/v1/vm/create", ID: "CreateVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Create a VM", Request: models.VMCreateRequest{}, Response: createAnswer},
+		{Method: post, Path: "/api/v1/vm/create/stream", ID: "CreateVMStream", Tag: "VMs", Access: user,
+			Summary: "Create a VM, streaming its progress as server-sent events", Request: models.VMCreateRequest{},
+			Stream: openapi.StreamEvents},
+		{Method: post, Path: "/api/v1/vm/create/batch", ID: "CreateVMBatch", Tag: "VMs", Access: user, Async: true,
+			Summary: "Create several VMs at once", Request: models.VMBatchCreateRequest{}, Response: batchAnswer},
+		{Method: get, Path: "/api/v1/vm/list", ID: "ListVMs", Tag: "VMs", Access: user,
+			Summary: "List the VMs of every host",
+			Query: append([]openapi.Param{
+				{Name: "refresh", Description: "Ask every host instead of the inventory cache", Type: false},
+				{Name: "usage", Description: "Include disk and memory usage", Type: false},
+			}, listParams(inventory.VMSortFields)...),
+			Response: openapi.Fields{"success": true, "vms": []models.VMListing{}, "hosts": []models.HostListing{},
+				"total": 0, "limit": 0, "offset": 0}},
+		{Method: get, Path: "/api/v1/vm/info/:vm_name", ID: "GetVMInfo", Tag: "VMs", Access: user,
+			Summary: "Get a VM's details", Query: []openapi.Param{agentParam}, Response: models.VMInfo{}},
+		{Method: put, Path: "/api/v1/vm/metadata", ID: "UpdateVMMetadata", Tag: "VMs", Access: user, Async: true,
+			Summary: "Change a VM's owner, labels, description or expiry", Request: models.VMMetadataRequest{},
+			Response: openapi.Fields{"success": true, "metadata": &models.VMMetadata{}}},
+		{Method: post, Path: "/api/v1/vm/start", ID: "StartVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Start a VM", Request: models.VMActionRequest{},
+			Response: with(okAnswer, openapi.Fields{"state": "", "warnings": []string{}})},
+		{Method: post, Path: "/api/v1/vm/stop", ID: "StopVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Stop a VM, now or after delay_minutes", Request: models.VMActionRequest{},
+			Response: with(okAnswer, openapi.Fields{"delay_minutes": 0})},
+		{Method: post, Path: "/api/v1/vm/stop/cancel", ID: "CancelStopVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Cancel a delayed stop", Request: models.VMActionRequest{}, Response: okAnswer},
+		{Method: post, Path: "/api/v1/vm/suspend", ID: "SuspendVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Suspend a VM", Request: models.VMActionRequest{}, Response: okAnswer},
+		{Method: post, Path: "/api/v1/vm/resume", ID: "ResumeVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Resume a suspended VM", Request: models.VMActionRequest{}, Response: okAnswer},
+		{Method: post, Path: "/api/v1/vm/restart", ID: "RestartVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Restart a VM", Request: models.VMActionRequest{}, Response: okAnswer},
+		{Method: post, Path: "/api/v1/vm/delete", ID: "DeleteVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Delete a VM, or soft-delete it with soft_delete", Request: models.VMActionRequest{}, Response: okAnswer},
+		{Method: post, Path: "/api/v1/vm/recover", ID: "RecoverVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Recover a soft-deleted VM", Request: models.VMActionRequest{}, Response: okAnswer},
+		{Method: post, Path: "/api/v1/vm/purge", ID: "PurgeVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Permanently remove a soft-deleted VM", Request: models.VMActionRequest{}, Response: okAnswer},
+		{Method: post, Path: "/api/v1/vm/bulk", ID: "BulkVMAction", Tag: "VMs", Access: user, Async: true,
+			Summary: "Take one action on many VMs", Request: models.VMBulkRequest{}, Response: bulkAnswer},
+		{Method: post, Path: "/api/v1/vm/resize", ID: "ResizeVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Change a VM's CPUs, memory or disk", Request: models.VMResizeRequest{},
+			Response: with(okAnswer, openapi.Fields{"phases": []models.OperationPhase{}})},
+		{Method: post, Path: "/api/v1/vm/clone", ID: "CloneVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Clone a VM", Request: models.VMCloneRequest{},
+			Response: with(okAnswer, openapi.Fields{"vm_name": "", "state": "", "method": "", "phases": []models.OperationPhase{},
+				"agent_id": (*string)(nil), "agent_hostname": (*string)(nil), "warnings": []string{}})},
+		{Method: post, Path: "/api/v1/vm/mount", ID: "MountVM", Tag: "VMs", Access: admin, Async: true,
+			Summary: "Mount a host directory into a VM", Request: models.VMMountRequest{}, Response: okAnswer},
+		{Method: post, Path: "/api/v1/vm/umount", ID: "UnmountVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Remove a mount from a VM, or every mount without a target", Request: models.VMMountRequest{}, Response: okAnswer},
+		{Method: get, Path: "/api/v1/vm/:vm_name/mounts", ID: "ListVMMounts", Tag: "VMs", Access: user,
+			Summary: "List the directories mounted into a VM", Query: []openapi.Param{agentParam},
+			Response: openapi.Fields{"success": true, "vm_name": "", "mounts": []models.VMMount{}}},
+		{Method: post, Path: "/api/v1/vm/transfer", ID: "TransferFile", Tag: "VMs", Access: user,
+			Summary: "Upload a file into a VM as a multipart form, or download one", Request: models.VMTransferRequest{},
+			Upload: "file", Response: okAnswer, Stream: openapi.StreamFile},
+		{Method: post, Path: "/api/v1/vm/exec", ID: "ExecInVM", Tag: "VMs", Access: user, Async: true,
+			Summary: "Run a command in a VM; a non-zero exit code is not an error", Request: models.VMExecRequest{},
+			Response: models.VMExecResponse{}},
+		{Method: get, Path: "/api/v1/vm/:vm_name/logs", ID: "GetVMLogs", Tag: "VMs", Access: user,
+			Summary: "Read the tail of a log inside a VM, or follow it as server-sent events",
+			Query: []openapi.Param{
+				agentParam,
+				{Name: "source", Description: "The log to read; cloud-init's output by default", Type: ""},
+				{Name: "tail", Description: "How many lines to read", Type: ""},
+				{Name: "follow", Description: "Stream lines as they are written", Type: false},
+			},
+			Response: openapi.Fields{"success": true, "vm_name": "", "source": "", "path": "", "log": ""},
+			Stream:   openapi.StreamEvents},
+		{Method: get, Path: "/api/v1/vm/:vm_name/connection", ID: "GetVMConnection", Tag: "VMs", Access: user,
+			Summary:  "Report a VM's addresses and an ssh command to reach it",
+			Query:    []openapi.Param{agentParam, {Name: "user", Description: "The user to ssh in as", Type: ""}},
+			Response: openapi.Fields{"success": true, "connection": models.VMConnection{}}},
+		{Method: post, Path: "/api/v1/vm/:vm_name/forward", ID: "ForwardPort", Tag: "VMs", Access: user, Async: true,
+			Summary: "Forward a host port to a port of a VM", Request: models.PortForwardRequest{},
+			Response: openapi.Fields{"success": true, "forward": &models.PortForward{}, "address": ""}},
+		{Method: post, Path: "/api/v1/vm/:vm_name/authorize-key", ID: "AuthorizeKey", Tag: "VMs", Access: user, Async: true,
+			Summary: "Authorize an SSH key for a user of a VM", Request: models.AuthorizeKeyRequest{},
+			Response: with(okAnswer, openapi.Fields{"user": ""})},
+		{Method: post, Path: "/api/v1/vm/:vm_name/share", ID: "ShareVM", Tag: "VMs", Access: user,
+			Summary: "Share a VM with another user", Request: models.VMShareRequest{}, Response: metadataAnswer},
+		{Method: del, Path: "/api/v1/vm/:vm_name/share/:username", ID: "UnshareVM", Tag: "VMs", Access: user,
+			Summary: "Stop sharing a VM with a user", Query: []openapi.Param{agentParam}, Response: metadataAnswer},
+
+		// Port forwards
+		{Method: get, Path: "/api/v1/forwards", ID: "ListForwards", Tag: "Forwards", Access: user,
+			Summary: "List the port forwards of every host", Query: []openapi.Param{agentParam},
+			Response: openapi.Fields{"success": true, "forwards": []models.PortForward{}, "errors": map[string]string{}}},
+		{Method: del, Path: "/api/v1/forwards/:id", ID: "RemoveForward", Tag: "Forwards", Access: user,
+			Summary: "Remove a port forward", Query: []openapi.Param{agentParam}, Response: okAnswer},
+	}
+}
+
+// specDescription introduces the API in its OpenAPI document
+const specDescription = "Manage multipass VMs on the master and its agents. Errors are answered with an ErrorResponse. " +
+	"The unversioned /api paths of earlier releases are deprecated aliases of " + apiversion.Prefix + "."
+
+// Spec builds the OpenAPI document of the master's API
+func Spec() *openapi.Document {
+	return openapi.Build(openapi.Info{
+		Title:       "Multipass VM Manager",
+		Description: specDescription,
+		Version:     APIVersion,
+	}, Operations())
+}
+
+var (
+	specOnce sync.Once
+	specJSON []byte
+)
+
+// OpenAPI serves the OpenAPI document of the API
+func (s *Server) OpenAPI(c *fiber.Ctx) error {
+	specOnce.Do(func() {
+		var err error
+		if specJSON, err = json.Marshal(Spec()); err != nil {
+			logger.Error("Failed to encode the OpenAPI document", "error", err)
+		}
+	})
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(specJSON)
+}
+
+// checkOperations warns of routes the OpenAPI document leaves out
+func checkOperations(app *fiber.App) {
+	if err := openapi.Validate(Operations()); err != nil {
+		logger.Warn("Invalid OpenAPI operations", "error", err)
+	}
+	for _, route := range openapi.Uncovered(app.GetRoutes(true), Operations()) {
+		logger.Warn("Route is missing from the OpenAPI document", "route", route)
+	}
+}
@@ -1,19 +1,79 @@
 package routes
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/gofiber/websocket/v2"
+	"github.com/prashah/batwa/pkg/accesslog"
 	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/apierror"
+	"github.com/prashah/batwa/pkg/apiversion"
+	"github.com/prashah/batwa/pkg/artifacts"
 	"github.com/prashah/batwa/pkg/auth"
+	"github.com/prashah/batwa/pkg/backup"
+	"github.com/prashah/batwa/pkg/bus"
+	"github.com/prashah/batwa/pkg/cloudinit"
+	"github.com/prashah/batwa/pkg/cluster"
+	"github.com/prashah/batwa/pkg/communication"
+	"github.com/prashah/batwa/pkg/defaults"
+	"github.com/prashah/batwa/pkg/digest"
+	"github.com/prashah/batwa/pkg/events"
 	"github.com/prashah/batwa/pkg/executor"
+	"github.com/prashah/batwa/pkg/expiry"
+	"github.com/prashah/batwa/pkg/inventory"
+	"github.com/prashah/batwa/pkg/locks"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/maintenance"
+	"github.com/prashah/batwa/pkg/metadata"
+	"github.com/prashah/batwa/pkg/middleware"
 	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/multipass"
+	"github.com/prashah/batwa/pkg/notifications"
+	"github.com/prashah/batwa/pkg/oidc"
+	"github.com/prashah/batwa/pkg/policy"
+	"github.com/prashah/batwa/pkg/quotas"
+	"github.com/prashah/batwa/pkg/requestid"
+	"github.com/prashah/batwa/pkg/retention"
+	"github.com/prashah/batwa/pkg/scheduler"
+	"github.com/prashah/batwa/pkg/schedules"
+	"github.com/prashah/batwa/pkg/secrets"
+	"github.com/prashah/batwa/pkg/sse"
+	"github.com/prashah/batwa/pkg/stacks"
+	"github.com/prashah/batwa/pkg/tasks"
+	"github.com/prashah/batwa/pkg/templates"
+	"github.com/prashah/batwa/pkg/tokens"
+	"github.com/prashah/batwa/pkg/tracing"
+	"github.com/prashah/batwa/pkg/tunnel"
+	wshandler "github.com/prashah/batwa/pkg/websocket"
+	"github.com/valyala/fasthttp"
 )
 
+var logger = logging.For("routes")
+
+// agentSaturated responds 503 with a Retry-After hint when an agent has too
+// many requests in flight
+func agentSaturated(c *fiber.Ctx, err *communication.SaturatedError) error {
+	c.Set(fiber.HeaderRetryAfter, "2")
+	return apierror.RespondCode(c, 503, models.ErrCodeAgentBusy, err.Error())
+}
+
 // generateSessionID generates a random session ID
 func generateSessionID() (string, error) {
 	b := make([]byte, 32)
@@ -23,71 +83,601 @@ func generateSessionID() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
+// Server holds the master's dependencies and serves its HTTP API. Every
+// dependency is constructed in main and passed in explicitly.
+type Server struct {
+	Auth         *auth.Service
+	Registry     *agents.AgentRegistry
+	Communicator communication.AgentCommunicator
+	Executors    *executor.ExecutorFactory
+	Scheduler    *scheduler.Scheduler
+	Maintenance  *maintenance.Scheduler
+	Schedules    *schedules.Scheduler
+	Stacks       *stacks.Store
+	Templates    *templates.Store
+	Defaults     *defaults.Store
+	Quotas       *quotas.Store
+	Digest       *digest.Reporter
+	Bus          *bus.Bus
+	Events       *events.Log
+	Tunnels      *tunnel.Hub
+	History      *retention.History
+	Tasks        *tasks.Store
+	Tokens       *tokens.Store
+	Metadata     *metadata.Store
+	Inventory    *inventory.Cache
+	Locks        *locks.VMLockManager
+	Notifier     *notifications.Notifier
+	Artifacts    *artifacts.Store
+	AccessLog    *accesslog.Store
+	// Health watches multipass on the master host
+	Health *multipass.HealthMonitor
+	// Mounts limits the master's directories that may be mounted into VMs
+	Mounts *multipass.MountPolicy
+	// Policy authorizes mutations of VMs, agents, users and tokens
+	Policy *policy.Authorizer
+	// Cluster tells whether this master leads the replicas sharing its
+	// database
+	Cluster *cluster.Cluster
+	// Backups archives the users, agents, templates, VM metadata and tasks
+	Backups *backup.Stores
+	// OIDC signs users in through an identity provider, or is nil when OIDC
+	// is not configured
+	OIDC *oidc.Provider
+	// RegistrationToken is the shared secret agents present when registering
+	// and sending heartbeats; nil leaves those endpoints open
+	RegistrationToken *secrets.Secret
+	// Secrets reloads secrets loaded from Vault or files
+	Secrets *secrets.Resolver
+	// APIAllowlist limits the clients of the UI and API, and AgentAllowlist
+	// those of the agent endpoints; nil allows every client
+	APIAllowlist   *middleware.Allowlist
+	AgentAllowlist *middleware.Allowlist
+
+	// app replays asynchronous task requests
+	app *fiber.App
+}
+
 // SetupRoutes sets up all the routes for the application
-func SetupRoutes(app *fiber.App) {
+func (s *Server) SetupRoutes(app *fiber.App) {
+	s.app = app
+
+	// Every route belongs to a group that sets what it demands of a request:
+	// nothing, any session, a session of a user who has changed their
+	// password, an admin's session, or an agent's registration token. Agent
+	// routes are open to the clients in AgentAllowlist, the others to those
+	// in APIAllowlist. API routes are registered under the version prefix;
+	// apiversion.Shim serves the unversioned /api paths by them.
+	api := app.Group(apiversion.Prefix)
+	public := s.group(api, auth.Public)
+	pending := s.group(api, auth.Pending)
+	user := s.group(api, auth.User)
+	admin := s.group(api, auth.Admin)
+	agent := routeGroup{router: api, middleware: []fiber.Handler{s.AgentAllowlist.Handler(), s.agentToken}}
+
+	// Health Routes
+	s.group(app, auth.Public).Get("/healthz", s.Healthz)
+	s.group(app, auth.Public).Get("/readyz", s.Readyz)
+	public.Get("/openapi.json", s.OpenAPI)
+
+	// Admin Routes
+	admin.Get("/admin/status", s.AdminStatus)
+	admin.Post("/admin/secrets/reload", s.ReloadSecrets)
+	admin.Post("/admin/backup", s.CreateBackup)
+
 	// Authentication Routes
-	app.Post("/api/auth/login", Login)
-	app.Post("/api/auth/logout", Logout)
-	app.Get("/api/auth/check", CheckAuth)
+	public.Post("/auth/login", s.Login)
+	public.Post("/auth/logout", s.Logout)
+	public.Post("/auth/token", s.IssueJWT)
+	public.Post("/auth/refresh", s.RefreshJWT)
+	public.Get("/auth/oidc/login", s.OIDCLogin)
+	public.Get("/auth/oidc/callback", s.OIDCCallback)
+	public.Get("/auth/check", s.CheckAuth)
+	pending.Post("/auth/change-password", s.ChangePassword)
+
+	// User Routes
+	admin.Post("/users", s.Policy.Require("user.create"), s.CreateUser)
+	admin.Get("/users", s.ListUsers)
+	admin.Delete("/users/:username", s.Policy.Require("user.delete"), s.DeleteUser)
+
+	// API Token Routes
+	user.Post("/tokens", s.Policy.Require("token.create"), s.CreateToken)
+	user.Get("/tokens", s.ListTokens)
+	user.Delete("/tokens/:id", s.Policy.Require("token.delete"), s.DeleteToken)
 
 	// Agent Management Routes
-	app.Post("/api/agent/register", RegisterAgent)
-	app.Delete("/api/agent/unregister/:agent_id", UnregisterAgent)
-	app.Get("/api/agent/list", ListAgents)
-	app.Get("/api/agent/info/:agent_id", GetAgentInfo)
-	app.Post("/api/agent/heartbeat", AgentHeartbeat)
+	agent.Post("/agent/register", s.RegisterAgent)
+	user.Delete("/agent/unregister/:agent_id", s.Policy.Require("agent.unregister"), s.UnregisterAgent)
+	user.Get("/agent/list", s.ListAgents)
+	user.Get("/agent/history", s.AgentHistory)
+	user.Get("/agent/info/:agent_id", s.GetAgentInfo)
+	agent.Post("/agent/heartbeat", s.AgentHeartbeat)
+	agent.Post("/agent/vm-state", s.AgentVMState)
+	agent.Post("/agent/deregister", s.DeregisterAgent)
+	agent.Get("/agent/tunnel", s.AgentTunnel)
+	admin.Post("/agent/import/:agent_id", s.Policy.Require("agent.import"), s.ImportAgent)
+	admin.Post("/agent/:agent_id/drain", s.Policy.Require("agent.drain"), s.DrainAgent)
+	admin.Post("/agent/:agent_id/undrain", s.Policy.Require("agent.drain"), s.UndrainAgent)
+	admin.Post("/agent/:agent_id/rotate-key", s.Policy.Require("agent.rotate_key"), s.RotateAgentKey)
+	admin.Put("/agent/:agent_id/zone", s.Policy.Require("agent.zone"), s.SetAgentZone)
+	admin.Post("/agent/approve/:agent_id", s.Policy.Require("agent.approve"), s.ApproveAgent)
+	admin.Post("/agent/reject/:agent_id", s.Policy.Require("agent.approve"), s.RejectAgent)
+
+	// Terminal Routes
+	user.Post("/terminal/ticket", s.IssueTerminalTicket)
+
+	// Task Routes
+	user.Get("/tasks", s.ListTasks)
+	user.Get("/tasks/:id", s.GetTask)
+
+	// Zone Routes
+	user.Get("/zones", s.ListZones)
+	user.Get("/zones/:zone/agents", s.ListZoneAgents)
+	user.Post("/zones/:zone/vm/create", s.Policy.Require("vm.create"), s.task("vm.create"), s.CreateZoneVM)
+
+	// Default Target Routes
+	user.Get("/defaults", s.GetDefaults)
+	admin.Put("/defaults", s.Policy.Require("defaults.update"), s.SetDefaults)
+	admin.Put("/defaults/ssh-keys", s.Policy.Require("defaults.update"), s.SetDefaultSSHKeys)
+
+	// Quota Routes
+	user.Get("/quotas", s.ListQuotas)
+	admin.Put("/quotas/users/:username", s.Policy.Require("quota.update"), s.SetUserQuota)
+	admin.Delete("/quotas/users/:username", s.Policy.Require("quota.update"), s.DeleteUserQuota)
+	admin.Put("/quotas/agents/:agent_id", s.Policy.Require("quota.update"), s.SetAgentQuota)
+	admin.Delete("/quotas/agents/:agent_id", s.Policy.Require("quota.update"), s.DeleteAgentQuota)
+
+	// Maintenance Routes
+	admin.Post("/maintenance/windows", s.CreateMaintenanceWindow)
+	user.Get("/maintenance/windows", s.ListMaintenanceWindows)
+	admin.Delete("/maintenance/windows/:id", s.DeleteMaintenanceWindow)
+
+	// Power Schedule Routes
+	user.Post("/schedules", s.Policy.Require("schedule.create"), s.CreateSchedule)
+	user.Get("/schedules", s.ListSchedules)
+	user.Delete("/schedules/:id", s.Policy.Require("schedule.delete"), s.DeleteSchedule)
+	user.Post("/schedules/:id/run", s.Policy.Require("schedule.run"), s.RunSchedule)
+
+	// Stack Routes
+	user.Post("/stacks", s.Policy.Require("stack.create"), s.CreateStack)
+	user.Get("/stacks", s.ListStacks)
+	user.Get("/stacks/:name", s.GetStack)
+	user.Post("/stacks/:name/:action", s.Policy.Require("stack.action"), s.StackAction)
+	user.Delete("/stacks/:name", s.Policy.Require("stack.delete"), s.DeleteStack)
+
+	// Template Routes
+	admin.Post("/templates", s.Policy.Require("template.create"), s.CreateTemplate)
+	user.Get("/templates", s.ListTemplates)
+	user.Get("/templates/:name", s.GetTemplate)
+	admin.Put("/templates/:name", s.Policy.Require("template.update"), s.UpdateTemplate)
+	admin.Delete("/templates/:name", s.Policy.Require("template.delete"), s.DeleteTemplate)
+
+	// Notification Routes
+	user.Get("/notifications", s.ListNotifications)
+
+	// Event Routes
+	user.Get("/events/poll", s.PollEvents)
+	user.Get("/events/stream", s.StreamEvents)
+
+	// Access Log Routes
+	admin.Get("/access-logs", s.ListAccessLogs)
+
+	// Digest Routes
+	user.Get("/digest/latest", s.GetLatestDigest)
+	admin.Post("/digest/generate", s.GenerateDigest)
+
+	// Artifact Routes
+	user.Get("/artifacts", s.ListArtifacts)
+	user.Get("/artifacts/:id", s.GetArtifact)
+	user.Get("/artifacts/:id/download", s.DownloadArtifact)
+	user.Delete("/artifacts/:id", s.Policy.Require("artifact.delete"), s.DeleteArtifact)
+
+	// Blueprint Routes
+	user.Get("/blueprints", s.ListBlueprints)
+
+	// Network Routes
+	user.Get("/networks", s.ListNetworks)
+
+	// Host Routes
+	user.Get("/host/health", s.GetHostHealth)
+	user.Get("/host/version", s.GetHostVersion)
+	admin.Get("/host/settings", s.GetHostSettings)
+	admin.Put("/host/settings", s.Policy.Require("host.settings"), s.SetHostSettings)
+	user.Get("/host/storage", s.GetHostStorage)
+	admin.Post("/host/prune", s.Policy.Require("host.prune"), s.PruneHost)
 
 	// VM Management Routes
-	app.Post("/api/vm/create", CreateVM)
-	app.Get("/api/vm/list", ListVMs)
-	app.Get("/api/vm/info/:vm_name", GetVMInfo)
-	app.Post("/api/vm/start", StartVM)
-	app.Post("/api/vm/stop", StopVM)
-	app.Post("/api/vm/delete", DeleteVM)
+	user.Post("/vm/create", s.Policy.Require("vm.create"), s.task("vm.create"), s.CreateVM)
+	user.Post("/vm/create/stream", s.Policy.Require("vm.create"), s.CreateVMStream)
+	user.Post("/vm/create/batch", s.Policy.Require("vm.create"), s.task("vm.create"), s.CreateVMBatch)
+	user.Get("/vm/list", s.ListVMs)
+	user.Get("/vm/info/:vm_name", s.GetVMInfo)
+	user.Put("/vm/metadata", s.Policy.Require("vm.metadata"), s.task("vm.metadata"), s.UpdateVMMetadata)
+	user.Post("/vm/start", s.primaryTarget, s.Policy.Require("vm.start"), s.task("vm.start"), s.StartVM)
+	user.Post("/vm/stop", s.primaryTarget, s.Policy.Require("vm.stop"), s.task("vm.stop"), s.StopVM)
+	user.Post("/vm/stop/cancel", s.primaryTarget, s.Policy.Require("vm.stop"), s.task("vm.stop_cancel"), s.CancelStopVM)
+	user.Post("/vm/suspend", s.primaryTarget, s.Policy.Require("vm.suspend"), s.task("vm.suspend"), s.SuspendVM)
+	user.Post("/vm/resume", s.primaryTarget, s.Policy.Require("vm.resume"), s.task("vm.resume"), s.ResumeVM)
+	user.Post("/vm/restart", s.primaryTarget, s.Policy.Require("vm.restart"), s.task("vm.restart"), s.RestartVM)
+	user.Post("/vm/delete", s.Policy.Require("vm.delete"), s.task("vm.delete"), s.DeleteVM)
+	user.Post("/vm/recover", s.Policy.Require("vm.recover"), s.task("vm.recover"), s.RecoverVM)
+	user.Post("/vm/purge", s.Policy.Require("vm.purge"), s.task("vm.purge"), s.PurgeVM)
+	user.Post("/vm/bulk", s.task("vm.bulk"), s.BulkVMAction)
+	user.Post("/vm/resize", s.Policy.Require("vm.resize"), s.task("vm.resize"), s.ResizeVM)
+	user.Post("/vm/clone", s.Policy.Require("vm.clone"), s.task("vm.clone"), s.CloneVM)
+	admin.Post("/vm/mount", s.Policy.Require("vm.mount"), s.task("vm.mount"), s.MountVM)
+	user.Post("/vm/umount", s.Policy.Require("vm.umount"), s.task("vm.umount"), s.UnmountVM)
+	user.Get("/vm/:vm_name/mounts", s.ListVMMounts)
+	user.Post("/vm/transfer", s.Policy.Require("vm.transfer"), s.TransferFile)
+	user.Post("/vm/exec", s.primaryTarget, s.Policy.Require("vm.exec"), s.task("vm.exec"), s.ExecInVM)
+	user.Get("/vm/:vm_name/logs", s.Policy.Require("vm.logs"), s.GetVMLogs)
+	user.Get("/vm/:vm_name/connection", s.GetVMConnection)
+	user.Post("/vm/:vm_name/forward", s.Policy.Require("vm.forward"), s.task("vm.forward"), s.ForwardPort)
+	user.Post("/vm/:vm_name/authorize-key", s.Policy.Require("vm.authorize_key"), s.task("vm.authorize_key"), s.AuthorizeKey)
+	user.Post("/vm/:vm_name/share", s.Policy.Require("vm.share"), s.ShareVM)
+	user.Delete("/vm/:vm_name/share/:username", s.Policy.Require("vm.share"), s.UnshareVM)
+	user.Get("/forwards", s.ListForwards)
+	user.Delete("/forwards/:id", s.Policy.Require("forward.delete"), s.RemoveForward)
+
+	checkOperations(app)
+}
+
+// routeGroup registers routes behind shared middleware, such as an auth
+// requirement. Fiber's own groups apply their middleware to every route under
+// the group's prefix, so groups sharing /api would leak requirements into one
+// another; routeGroup puts the middleware in front of each of its routes
+// instead.
+type routeGroup struct {
+	router     fiber.Router
+	middleware []fiber.Handler
+}
+
+// group creates a route group for clients in APIAllowlist, requiring level
+// of each request's session
+func (s *Server) group(router fiber.Router, level auth.Level) routeGroup {
+	return routeGroup{router: router, middleware: []fiber.Handler{s.APIAllowlist.Handler(), s.Auth.Require(level)}}
+}
+
+// chain puts the group's middleware in front of a route's handlers
+func (g routeGroup) chain(handlers []fiber.Handler) []fiber.Handler {
+	return append(append([]fiber.Handler{}, g.middleware...), handlers...)
+}
+
+// Get registers a GET route in the group
+func (g routeGroup) Get(path string, handlers ...fiber.Handler) {
+	g.router.Get(path, g.chain(handlers)...)
+}
+
+// Post registers a POST route in the group
+func (g routeGroup) Post(path string, handlers ...fiber.Handler) {
+	g.router.Post(path, g.chain(handlers)...)
+}
+
+// Put registers a PUT route in the group
+func (g routeGroup) Put(path string, handlers ...fiber.Handler) {
+	g.router.Put(path, g.chain(handlers)...)
+}
+
+// Delete registers a DELETE route in the group
+func (g routeGroup) Delete(path string, handlers ...fiber.Handler) {
+	g.router.Delete(path, g.chain(handlers)...)
+}
+
+// ==================== Health Routes ====================
+
+// Healthz reports server liveness and whether VMs can be managed on the master itself
+func (s *Server) Healthz(c *fiber.Ctx) error {
+	localEnabled := s.Executors.LocalEnabled()
+	mode := "standalone"
+	if !localEnabled {
+		mode = "control-plane"
+	}
+
+	return c.JSON(fiber.Map{
+		"status":         "ok",
+		"mode":           mode,
+		"local_executor": localEnabled,
+		"online_agents":  len(s.Registry.GetOnlineAgents()),
+	})
+}
+
+// Readyz reports whether the master can serve: multipass answers on the
+// master when it manages VMs itself, users and sessions can be stored, and
+// the heartbeat monitor is running. It answers 503 when any check fails, so
+// load balancers and orchestrators hold traffic back.
+func (s *Server) Readyz(c *fiber.Ctx) error {
+	checks := map[string]models.ReadinessCheck{}
+	ready := true
+	check := func(name string, ok bool, detail string) {
+		checks[name] = models.ReadinessCheck{OK: ok, Detail: detail}
+		ready = ready && ok
+	}
+
+	if s.Executors.LocalEnabled() {
+		health := s.Health.Health()
+		detail := health.Status
+		if health.Error != "" {
+			detail += ": " + health.Error
+		}
+		check("multipass", health.Status == multipass.HealthHealthy, detail)
+	} else {
+		check("multipass", true, "not used: the master manages VMs through agents only")
+	}
+
+	if err := s.Auth.CheckStorage(); err != nil {
+		check("storage", false, err.Error())
+	} else {
+		check("storage", true, "users and sessions can be stored")
+	}
+
+	if s.Cluster.Enabled() {
+		leader, err := s.Cluster.Leader()
+		switch {
+		case err != nil:
+			check("cluster", false, "replica "+s.Cluster.Replica()+": "+err.Error())
+		case leader == "":
+			check("cluster", true, "replica "+s.Cluster.Replica()+": no leader yet")
+		default:
+			check("cluster", true, "replica "+s.Cluster.Replica()+", led by "+leader)
+		}
+	}
+
+	running, checked := s.Registry.HeartbeatMonitorRunning()
+	switch {
+	case !s.Cluster.Leading():
+		check("heartbeat_monitor", true, "runs on the leader")
+	case running:
+		check("heartbeat_monitor", true, "last checked agents at "+checked.UTC().Format(time.RFC3339))
+	case checked.IsZero():
+		check("heartbeat_monitor", false, "not running")
+	default:
+		check("heartbeat_monitor", false, "stuck: last checked agents at "+checked.UTC().Format(time.RFC3339))
+	}
+
+	if !ready {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"status": "not ready", "checks": checks})
+	}
+	return c.JSON(fiber.Map{"status": "ready", "checks": checks})
 }
 
 // ==================== Authentication Routes ====================
 
+// AdminStatus reports the master's view of its agents, including how many
+// requests are in flight to each (admin only)
+func (s *Server) AdminStatus(c *fiber.Ctx) error {
+	inFlight := s.Communicator.InFlight()
+	agentStatus := []fiber.Map{}
+	for _, agent := range s.Registry.GetAllAgents() {
+		agentStatus = append(agentStatus, fiber.Map{
+			"agent_id":  agent.AgentID,
+			"hostname":  agent.Hostname,
+			"status":    agent.Status,
+			"in_flight": inFlight[agent.AgentID],
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success":        true,
+		"local_executor": s.Executors.LocalEnabled(),
+		"max_in_flight":  s.Communicator.MaxInFlight(),
+		"agents":         agentStatus,
+	})
+}
+
+// CreateBackup answers with an archive of the master's users, agents,
+// templates, VM metadata and finished tasks, to restore on a fresh master
+// with --restore (admin only)
+func (s *Server) CreateBackup(c *fiber.Ctx) error {
+	session, _ := s.Auth.GetSession(auth.SessionID(c))
+	var archive bytes.Buffer
+	manifest, err := s.Backups.Write(&archive, session.Username)
+	if err != nil {
+		return apierror.RespondErr(c, 500, fmt.Errorf("failed to create backup: %w", err))
+	}
+	s.Bus.Publish(models.Event{Type: "backup.created", Data: map[string]string{"by": session.Username}})
+	logger.Info("Created backup", "by", session.Username, "bytes", archive.Len())
+
+	c.Attachment("batwa-backup-" + manifest.CreatedAt.Format("20060102T150405Z") + ".tar.gz")
+	return c.Send(archive.Bytes())
+}
+
+// ReloadSecrets loads the secrets kept in Vault or files again, as SIGHUP
+// does (admin only)
+func (s *Server) ReloadSecrets(c *fiber.Ctx) error {
+	session, _ := s.Auth.GetSession(auth.SessionID(c))
+	reloaded, failed := s.Secrets.Reload()
+	s.Bus.Publish(models.Event{Type: "secrets.reloaded", Data: map[string]string{"by": session.Username, "reloaded": strings.Join(reloaded, ","), "failed": strconv.Itoa(len(failed))}})
+
+	if len(failed) > 0 {
+		return apierror.RespondDetails(c, 500, models.ErrCodeInternal, fmt.Sprintf("%d secrets failed to reload", len(failed)), fiber.Map{
+			"reloaded": reloaded,
+			"failed":   failed,
+		})
+	}
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"reloaded": reloaded,
+		"failed":   failed,
+	})
+}
+
 // Login handles user login
-func Login(c *fiber.Ctx) error {
+func (s *Server) Login(c *fiber.Ctx) error {
 	var req models.LoginRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return apierror.Respond(c, 400, "Invalid request")
 	}
 
-	password, exists := auth.Users[req.Username]
-	if !exists || password != req.Password {
-		return c.Status(401).JSON(fiber.Map{"detail": "Invalid credentials"})
+	if !s.Auth.VerifyPassword(req.Username, req.Password) {
+		return apierror.Respond(c, 401, "Invalid credentials")
 	}
+	mustChange := s.Auth.MustChangePassword(req.Username)
 
-	// Create session
-	sessionID, err := generateSessionID()
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to create session"})
+	if err := s.startSession(c, req.Username); err != nil {
+		return apierror.Respond(c, 500, "Failed to create session")
 	}
 
-	auth.SetSession(sessionID, &models.Session{Username: req.Username})
+	return c.JSON(fiber.Map{
+		"success":              true,
+		"message":              "Login successful",
+		"must_change_password": mustChange,
+	})
+}
 
-	// Set cookie
+// startSession starts a session for username and sets its cookie
+func (s *Server) startSession(c *fiber.Ctx, username string) error {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		return err
+	}
+	s.Auth.SetSession(sessionID, &models.Session{Username: username})
 	c.Cookie(&fiber.Cookie{
 		Name:     "session_id",
 		Value:    sessionID,
 		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: "Lax",
+		MaxAge:   int(s.Auth.SessionMaxAge().Seconds()),
+	})
+	return nil
+}
+
+// oidcFlowCookie holds the sign-in flow between OIDCLogin and OIDCCallback
+const oidcFlowCookie = "oidc_flow"
+
+// oidcFlowPath scopes the flow cookie to the API, so it reaches the callback
+// registered with the provider whether that is the versioned path or the
+// unversioned one it had before
+const oidcFlowPath = "/api"
+
+// OIDCLogin starts a sign-in through the identity provider, sending the
+// browser there
+func (s *Server) OIDCLogin(c *fiber.Ctx) error {
+	if s.OIDC == nil {
+		return apierror.Respond(c, 404, "OIDC sign-in is not configured")
+	}
+	flow, err := oidc.NewFlow()
+	if err != nil {
+		return apierror.Respond(c, 500, "Failed to start sign-in")
+	}
+	target, err := s.OIDC.AuthCodeURL(c.Context(), flow)
+	if err != nil {
+		logger.ErrorContext(c.UserContext(), "OIDC sign-in unavailable", "error", err)
+		return apierror.Respond(c, 502, "Identity provider is unavailable")
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    flow.Encode(),
+		Path:     oidcFlowPath,
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
 		SameSite: "Lax",
-		MaxAge:   86400, // 24 hours
+		MaxAge:   600,
+	})
+	return c.Redirect(target)
+}
+
+// OIDCCallback finishes a sign-in when the identity provider sends the
+// browser back: it redeems the code, creates or updates the user from the
+// provider's groups and starts a session. Failures send the browser to the
+// login page with an error.
+func (s *Server) OIDCCallback(c *fiber.Ctx) error {
+	if s.OIDC == nil {
+		return apierror.Respond(c, 404, "OIDC sign-in is not configured")
+	}
+	failed := func(reason string) error {
+		return c.Redirect("/login?error=" + url.QueryEscape(reason))
+	}
+	cookie := c.Cookies(oidcFlowCookie)
+	c.Cookie(&fiber.Cookie{Name: oidcFlowCookie, Path: oidcFlowPath, MaxAge: -1})
+	if reason := c.Query("error"); reason != "" {
+		return failed("Sign-in was refused: " + reason)
+	}
+	flow, err := oidc.DecodeFlow(cookie, c.Query("state"))
+	if err != nil {
+		return failed(err.Error())
+	}
+
+	user, err := s.OIDC.Exchange(c.Context(), c.Query("code"), flow)
+	if err != nil {
+		logger.WarnContext(c.UserContext(), "OIDC sign-in failed", "error", err)
+		return failed("Sign-in through the identity provider failed")
+	}
+	info, created, err := s.Auth.SyncExternalUser(oidc.Identity, user.Username, user.Admin, user.Roles)
+	if err != nil {
+		logger.WarnContext(c.UserContext(), "OIDC sign-in refused", "user", user.Username, "error", err)
+		return failed(err.Error())
+	}
+	if created {
+		s.Bus.Publish(models.Event{Type: "user.created", Data: map[string]string{"username": info.Username, "by": oidc.Identity}})
+	}
+
+	if err := s.startSession(c, info.Username); err != nil {
+		return failed("Failed to create session")
+	}
+	return c.Redirect("/")
+}
+
+// IssueJWT checks a username and password like Login, but answers with a JWT
+// access and refresh token pair instead of setting a session cookie
+func (s *Server) IssueJWT(c *fiber.Ctx) error {
+	if !s.Auth.JWTEnabled() {
+		return apierror.Respond(c, 404, auth.ErrJWTDisabled.Error())
+	}
+	var req models.LoginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	if !s.Auth.VerifyPassword(req.Username, req.Password) {
+		return apierror.Respond(c, 401, "Invalid credentials")
+	}
+	tokens, err := s.Auth.IssueTokens(req.Username)
+	if err != nil {
+		return apierror.Respond(c, 500, "Failed to issue tokens")
+	}
+	return c.JSON(fiber.Map{
+		"success":              true,
+		"access_token":         tokens.AccessToken,
+		"refresh_token":        tokens.RefreshToken,
+		"token_type":           tokens.TokenType,
+		"expires_in":           tokens.ExpiresIn,
+		"must_change_password": s.Auth.MustChangePassword(req.Username),
 	})
+}
+
+// RefreshJWT exchanges a refresh token for a new JWT pair
+func (s *Server) RefreshJWT(c *fiber.Ctx) error {
+	if !s.Auth.JWTEnabled() {
+		return apierror.Respond(c, 404, auth.ErrJWTDisabled.Error())
+	}
+	var req models.RefreshRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
 
+	tokens, err := s.Auth.RefreshTokens(req.RefreshToken)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		return apierror.Respond(c, 401, "Invalid or expired refresh token")
+	}
+	if err != nil {
+		return apierror.Respond(c, 500, "Failed to issue tokens")
+	}
 	return c.JSON(fiber.Map{
-		"success": true,
-		"message": "Login successful",
+		"success":       true,
+		"access_token":  tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"token_type":    tokens.TokenType,
+		"expires_in":    tokens.ExpiresIn,
 	})
 }
 
 // Logout handles user logout
-func Logout(c *fiber.Ctx) error {
-	sessionID := c.Cookies("session_id")
+func (s *Server) Logout(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
 	if sessionID != "" {
-		auth.DeleteSession(sessionID)
+		s.Auth.DeleteSession(sessionID)
 	}
 
 	c.ClearCookie("session_id")
@@ -98,291 +688,3822 @@ func Logout(c *fiber.Ctx) error {
 }
 
 // CheckAuth checks if user is authenticated
-func CheckAuth(c *fiber.Ctx) error {
-	sessionID := c.Cookies("session_id")
-	if auth.CheckAuth(sessionID) {
-		session, _ := auth.GetSession(sessionID)
+func (s *Server) CheckAuth(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+	if s.Auth.CheckAuth(sessionID) {
+		session, _ := s.Auth.GetSession(sessionID)
 		return c.JSON(fiber.Map{
-			"authenticated": true,
-			"username":      session.Username,
+			"authenticated":        true,
+			"username":             session.Username,
+			"admin":                s.Auth.IsAdmin(sessionID),
+			"must_change_password": s.Auth.MustChangePassword(session.Username),
 		})
 	}
 
 	return c.JSON(fiber.Map{
 		"authenticated": false,
+		"oidc":          s.OIDC != nil,
 	})
 }
 
-// ==================== Agent Management Routes ====================
+// ChangePassword changes the current user's password, which lifts a required
+// password change
+func (s *Server) ChangePassword(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
 
-// RegisterAgent registers a new agent
-func RegisterAgent(c *fiber.Ctx) error {
-	var req models.AgentRegisterRequest
+	var req models.PasswordChangeRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return apierror.Respond(c, 400, "Invalid request")
 	}
 
-	agentInfo := agents.GlobalRegistry.RegisterAgent(req)
+	session, _ := s.Auth.GetSession(sessionID)
+	if err := s.Auth.ChangePassword(session.Username, req.CurrentPassword, req.NewPassword); err != nil {
+		if errors.Is(err, auth.ErrUserNotFound) {
+			return apierror.RespondErr(c, 404, err)
+		}
+		return apierror.RespondErr(c, 400, err)
+	}
 
 	return c.JSON(fiber.Map{
 		"success": true,
-		"message": fmt.Sprintf("Agent '%s' registered successfully", req.AgentID),
-		"agent":   agentInfo,
+		"message": "Password changed",
 	})
 }
 
-// UnregisterAgent unregisters an agent
-func UnregisterAgent(c *fiber.Ctx) error {
-	sessionID := c.Cookies("session_id")
-	if !auth.CheckAuth(sessionID) {
-		return c.Status(401).JSON(fiber.Map{"detail": "Not authenticated"})
-	}
+// ==================== Terminal Routes ====================
 
-	agentID := c.Params("agent_id")
-	success := agents.GlobalRegistry.UnregisterAgent(agentID)
+// IssueTerminalTicket issues a short-lived single-use ticket for opening the
+// /ws terminal of a VM, for clients such as scripts using API tokens that
+// cannot send credentials with the websocket request itself
+func (s *Server) IssueTerminalTicket(c *fiber.Ctx) error {
+	session, _ := s.Auth.GetSession(auth.SessionID(c))
 
-	if success {
-		return c.JSON(fiber.Map{
-			"success": true,
-			"message": fmt.Sprintf("Agent '%s' unregistered successfully", agentID),
-		})
+	var req models.TerminalTicketRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	vmName, agentID := wshandler.ResolveTarget(s.Defaults, req.VMName, req.AgentID)
+	if vmName == "" {
+		return apierror.Respond(c, 400, "vm_name is required when no primary VM is set")
+	}
+	if err := s.authorizeTerminal(c, session.Username, agentID, vmName); err != nil {
+		return terminalDenied(c, err)
 	}
 
-	return c.Status(404).JSON(fiber.Map{"detail": fmt.Sprintf("Agent '%s' not found", agentID)})
+	ticket, err := s.Auth.IssueTicket(session.Username, agentID, vmName)
+	if err != nil {
+		return apierror.Respond(c, 500, "Failed to issue ticket")
+	}
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"ticket":     ticket,
+		"vm_name":    vmName,
+		"agent_id":   agentID,
+		"expires_in": int(auth.TicketTTL.Seconds()),
+	})
 }
 
-// ListAgents lists all registered agents
-func ListAgents(c *fiber.Ctx) error {
-	sessionID := c.Cookies("session_id")
-	if !auth.CheckAuth(sessionID) {
-		return c.Status(401).JSON(fiber.Map{"detail": "Not authenticated"})
+// AuthorizeTerminal guards the /ws terminal endpoint: the websocket request
+// must carry a session (cookie or JWT) of a user who has changed their
+// password, or a ticket from IssueTerminalTicket for the same VM, and the
+// user must be allowed to open a terminal on the VM.
+func (s *Server) AuthorizeTerminal(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
 	}
+	vmName, agentID := wshandler.ResolveTarget(s.Defaults, c.Query("vm_name"), c.Query("agent_id"))
 
-	agentsList := agents.GlobalRegistry.GetAllAgents()
-	return c.JSON(agentsList)
-}
+	var username string
+	if ticket := c.Query("ticket"); ticket != "" {
+		user, err := s.Auth.RedeemTicket(ticket, agentID, vmName)
+		if err != nil {
+			return apierror.RespondErr(c, 401, err)
+		}
+		username = user
+	} else {
+		session, exists := s.Auth.GetSession(auth.SessionID(c))
+		if !exists {
+			return apierror.Respond(c, 401, "Not authenticated")
+		}
+		username = session.Username
+	}
+	if s.Auth.MustChangePassword(username) {
+		return apierror.RespondDetails(c, 403, models.ErrCodePasswordChangeRequired, "Password change required", fiber.Map{"must_change_password": true})
+	}
 
-// GetAgentInfo gets information about a specific agent
-func GetAgentInfo(c *fiber.Ctx) error {
-	sessionID := c.Cookies("session_id")
-	if !auth.CheckAuth(sessionID) {
-		return c.Status(401).JSON(fiber.Map{"detail": "Not authenticated"})
+	if vmName != "" {
+		if err := s.authorizeTerminal(c, username, agentID, vmName); err != nil {
+			return terminalDenied(c, err)
+		}
 	}
+	c.Locals(accesslog.LocalsUser, username)
+	return c.Next()
+}
 
-	agentID := c.Params("agent_id")
-	agent := agents.GlobalRegistry.GetAgent(agentID)
+// authorizeTerminal checks username may open a terminal on a VM: it must be
+// theirs or shared with them, and the policy must allow vm.terminal
+func (s *Server) authorizeTerminal(c *fiber.Ctx, username, agentID, vmName string) error {
+	return s.Policy.Authorize(c.UserContext(), policy.Input{
+		User:    username,
+		Roles:   s.Auth.Roles(username),
+		Action:  "vm.terminal",
+		AgentID: agentID,
+		VMName:  vmName,
+	})
+}
 
-	if agent != nil {
-		return c.JSON(fiber.Map{
-			"success": true,
-			"agent":   agent,
-		})
-	}
+// terminalDenied responds to a terminal request authorizeTerminal refused
+func terminalDenied(c *fiber.Ctx, err error) error {
+	return apierror.RespondErr(c, policyStatus(err), err)
+}
 
-	return c.Status(404).JSON(fiber.Map{"detail": fmt.Sprintf("Agent '%s' not found", agentID)})
+// policyStatus is the status for an action the policy refused: 503 when it
+// could not be evaluated, else 403
+func policyStatus(err error) int {
+	if err == policy.ErrUnavailable {
+		return 503
+	}
+	return 403
 }
 
-// AgentHeartbeat receives heartbeat from an agent
-func AgentHeartbeat(c *fiber.Ctx) error {
-	var heartbeat models.AgentHeartbeat
-	if err := c.BodyParser(&heartbeat); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+// ==================== User Routes ====================
+
+// CreateUser adds a user (admin only). The user must change the password at
+// first login. A service account is created without a password and acts
+// through API tokens only.
+func (s *Server) CreateUser(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.UserCreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
 	}
 
-	// Get client IP for auto-registration
-	clientIP := c.IP()
+	var user models.UserInfo
+	var err error
+	switch {
+	case req.ServiceAccount && req.Password != "":
+		return apierror.Respond(c, 400, "Service accounts have no password")
+	case req.ServiceAccount:
+		user, err = s.Auth.CreateServiceAccount(req.Username, req.Admin)
+	default:
+		user, err = s.Auth.CreateUser(req.Username, req.Password, req.Admin)
+	}
+	if errors.Is(err, auth.ErrUserExists) {
+		return apierror.Respond(c, 409, fmt.Sprintf("User '%s' already exists", req.Username))
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
 
-	agents.GlobalRegistry.UpdateHeartbeatWithIP(heartbeat, clientIP)
+	session, _ := s.Auth.GetSession(sessionID)
+	s.Bus.Publish(models.Event{Type: "user.created", Data: map[string]string{"username": user.Username, "by": session.Username}})
 	return c.JSON(fiber.Map{
 		"success": true,
-		"message": "Heartbeat received",
+		"user":    user,
 	})
 }
 
-// ==================== VM Management Routes ====================
+// ListUsers lists the users (admin only)
+func (s *Server) ListUsers(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"success": true,
+		"users":   s.Auth.ListUsers(),
+	})
+}
 
-// CreateVM creates a new multipass VM (local or remote)
-func CreateVM(c *fiber.Ctx) error {
-	sessionID := c.Cookies("session_id")
-	if !auth.CheckAuth(sessionID) {
-		return c.Status(401).JSON(fiber.Map{"detail": "Not authenticated"})
-	}
+// DeleteUser removes a user and ends their sessions (admin only). Admins
+// cannot delete themselves, and the last admin cannot be deleted.
+func (s *Server) DeleteUser(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
 
-	var req models.VMCreateRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	username := c.Params("username")
+	session, _ := s.Auth.GetSession(sessionID)
+	if username == session.Username {
+		return apierror.Respond(c, 400, "You cannot delete your own account")
 	}
 
-	// Set defaults
-	if req.CPUs == 0 {
-		req.CPUs = 1
-	}
-	if req.Memory == "" {
-		req.Memory = "1G"
+	err := s.Auth.DeleteUser(username)
+	if errors.Is(err, auth.ErrUserNotFound) {
+		return apierror.Respond(c, 404, fmt.Sprintf("User '%s' not found", username))
 	}
-	if req.Disk == "" {
-		req.Disk = "5G"
+	if errors.Is(err, auth.ErrLastAdmin) {
+		return apierror.RespondErr(c, 400, err)
 	}
-	if req.Image == "" {
-		req.Image = "22.04"
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
 	}
 
-	// Get the appropriate executor
-	exec := executor.GlobalExecutorFactory.GetExecutor(req.AgentID)
-
-	// Create VM using executor
-	result, _ := exec.CreateVM(req.Name, req.CPUs, req.Memory, req.Disk, req.Image)
+	s.Bus.Publish(models.Event{Type: "user.deleted", Data: map[string]string{"username": username, "by": session.Username}})
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("User '%s' deleted", username),
+	})
+}
 
-	if success, ok := result["success"].(bool); ok && success {
-		// Wait a moment for VM to initialize
-		time.Sleep(2 * time.Second)
+// ==================== API Token Routes ====================
 
-		// Get location info
-		location := exec.GetLocationInfo()
+// CreateToken issues an API token for the current user, or for a service
+// account (admin only). The secret is in the response and cannot be shown
+// again.
+func (s *Server) CreateToken(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
 
-		return c.JSON(fiber.Map{
-			"success":        true,
-			"message":        result["message"],
-			"vm_name":        req.Name,
-			"agent_id":       location["agent_id"],
-			"agent_hostname": location["agent_hostname"],
-		})
+	var req models.TokenCreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
 	}
 
-	message := "Failed to create VM"
-	if msg, ok := result["message"].(string); ok {
-		message = msg
+	session, _ := s.Auth.GetSession(sessionID)
+	user := session.Username
+	if req.ServiceAccount != "" {
+		if !s.Auth.IsAdmin(sessionID) {
+			return apierror.Respond(c, 403, "Admin privileges required to issue service account tokens")
+		}
+		if !s.Auth.IsServiceAccount(req.ServiceAccount) {
+			return apierror.Respond(c, 404, fmt.Sprintf("Service account '%s' not found", req.ServiceAccount))
+		}
+		user = req.ServiceAccount
 	}
-	return c.Status(500).JSON(fiber.Map{"detail": message})
-}
 
-// ListVMs lists all multipass VMs (from local and all agents)
-func ListVMs(c *fiber.Ctx) error {
-	sessionID := c.Cookies("session_id")
-	if !auth.CheckAuth(sessionID) {
-		return c.Status(401).JSON(fiber.Map{"detail": "Not authenticated"})
+	expiresAt, err := tokens.ResolveExpiry(req.TTL, req.ExpiresAt, time.Now())
+	if err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+	token, secret, err := s.Tokens.Create(req.Name, user, session.Username, req.Scopes, expiresAt)
+	if err != nil {
+		return apierror.RespondErr(c, 400, err)
 	}
 
-	allVMs := []map[string]interface{}{}
+	s.Bus.Publish(models.Event{Type: "token.created", Data: map[string]string{"token_id": token.ID, "name": token.Name, "user": user, "by": session.Username}})
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Store the secret now; it cannot be shown again",
+		"secret":  secret,
+		"token":   token,
+	})
+}
 
-	// Get local VMs
-	localExecutor := executor.GlobalExecutorFactory.GetExecutor(nil)
-	result, err := localExecutor.ListVMs()
-	if err == nil {
-		if success, ok := result["success"].(bool); ok && success {
-			if data, ok := result["data"].(map[string]interface{}); ok {
-				if list, ok := data["list"].([]interface{}); ok {
-					for _, vm := range list {
-						if vmMap, ok := vm.(map[string]interface{}); ok {
-							allVMs = append(allVMs, map[string]interface{}{
-								"name":           vmMap["name"],
-								"state":          vmMap["state"],
-								"ipv4":           vmMap["ipv4"],
-								"release":        vmMap["release"],
-								"agent_id":       nil,
-								"agent_hostname": "local",
-							})
-						}
-					}
-				}
-			}
-		}
-	}
+// ListTokens lists the current user's API tokens. Admins see every token, or
+// those of ?user=.
+func (s *Server) ListTokens(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
 
-	// Get VMs from all online agents
-	agentsList := agents.GlobalRegistry.GetOnlineAgents()
-	for _, agent := range agentsList {
-		agentID := agent.AgentID
-		agentExecutor := executor.GlobalExecutorFactory.GetExecutor(&agentID)
-		result, err := agentExecutor.ListVMs()
-		if err == nil {
-			if success, ok := result["success"].(bool); ok && success {
-				if data, ok := result["data"].(map[string]interface{}); ok {
-					if list, ok := data["list"].([]interface{}); ok {
-						for _, vm := range list {
-							if vmMap, ok := vm.(map[string]interface{}); ok {
-								allVMs = append(allVMs, map[string]interface{}{
-									"name":           vmMap["name"],
-									"state":          vmMap["state"],
-									"ipv4":           vmMap["ipv4"],
-									"release":        vmMap["release"],
-									"agent_id":       agent.AgentID,
-									"agent_hostname": agent.Hostname,
-								})
-							}
-						}
-					}
-				}
-			}
-		}
+	session, _ := s.Auth.GetSession(sessionID)
+	user := session.Username
+	if s.Auth.IsAdmin(sessionID) {
+		user = c.Query("user")
 	}
 
 	return c.JSON(fiber.Map{
 		"success": true,
-		"vms":     allVMs,
+		"tokens":  s.Tokens.List(user),
 	})
 }
 
-// GetVMInfo gets detailed info about a specific VM
-func GetVMInfo(c *fiber.Ctx) error {
-	sessionID := c.Cookies("session_id")
-	if !auth.CheckAuth(sessionID) {
-		return c.Status(401).JSON(fiber.Map{"detail": "Not authenticated"})
-	}
-
-	vmName := c.Params("vm_name")
-	agentID := c.Query("agent_id")
+// DeleteToken revokes an API token. Users may revoke their own tokens,
+// admins any token.
+func (s *Server) DeleteToken(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
 
-	// Create executor based on agent_id
-	var vmExecutor executor.VMExecutor
-	if agentID != "" {
-		log.Printf("Getting VM info for %s from agent %s", vmName, agentID)
-		vmExecutor = executor.GlobalExecutorFactory.GetExecutor(&agentID)
-	} else {
-		log.Printf("Getting local VM info for %s", vmName)
-		vmExecutor = executor.GlobalExecutorFactory.GetExecutor(nil)
+	id := utils.CopyString(c.Params("id"))
+	session, _ := s.Auth.GetSession(sessionID)
+	token, exists := s.Tokens.Get(id)
+	if !exists || (token.User != session.Username && !s.Auth.IsAdmin(sessionID)) {
+		return apierror.Respond(c, 404, fmt.Sprintf("API token '%s' not found", id))
 	}
 
-	result, err := vmExecutor.GetVMInfo(vmName)
-	if err != nil {
-		log.Printf("Error getting VM info for %s: %v", vmName, err)
-		return c.Status(500).JSON(fiber.Map{"detail": err.Error()})
+	if err := s.Tokens.Delete(id); err != nil {
+		return apierror.Respond(c, 404, fmt.Sprintf("API token '%s' not found", id))
 	}
+	s.Auth.DeleteSession(auth.TokenSessionPrefix + id)
 
-	if success, ok := result["success"].(bool); ok && success {
-		if data, ok := result["data"].(map[string]interface{}); ok {
-			if info, ok := data["info"].(map[string]interface{}); ok {
-				if vmInfo, ok := info[vmName]; ok {
-					return c.JSON(vmInfo)
-				}
+	s.Bus.Publish(models.Event{Type: "token.revoked", Data: map[string]string{"token_id": id, "name": token.Name, "user": token.User, "by": session.Username}})
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("API token '%s' revoked", token.Name),
+	})
+}
+
+// ==================== Agent Management Routes ====================
+
+// RegisterAgent registers a new agent. An agent registering again presents
+// the API key it registered in X-API-Key.
+func (s *Server) RegisterAgent(c *fiber.Ctx) error {
+	var req models.AgentRegisterRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if err := agents.ValidateZone(req.Zone); err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+
+	s.warnUnsupported(req.AgentID, req.Version)
+	agentInfo, err := s.Registry.RegisterAgent(req, c.Get("X-API-Key"))
+	if errors.Is(err, agents.ErrAgentRejected) {
+		return apierror.Respond(c, 403, fmt.Sprintf("Agent '%s' was rejected by an admin", req.AgentID))
+	}
+	if errors.Is(err, agents.ErrAgentKeyMismatch) {
+		return apierror.Respond(c, 403, fmt.Sprintf("Agent '%s' is registered with an API key; present it in X-API-Key, or have an admin unregister the agent", req.AgentID))
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	message := fmt.Sprintf("Agent '%s' registered successfully", req.AgentID)
+	if agentInfo.Status == "pending" {
+		message = fmt.Sprintf("Agent '%s' registered and awaits approval by an admin", req.AgentID)
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": message,
+		"agent":   agentInfo,
+	})
+}
+
+// agentToken rejects agent requests that do not carry the registration token
+// in the X-Registration-Token header, when one is configured
+func (s *Server) agentToken(c *fiber.Ctx) error {
+	expected := s.RegistrationToken.Value()
+	if expected == "" {
+		return c.Next()
+	}
+	token := c.Get("X-Registration-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		logger.WarnContext(c.UserContext(), "Rejected agent request: invalid or missing registration token", "path", c.Path(), "ip", c.IP())
+		return apierror.Respond(c, 401, "Invalid or missing registration token")
+	}
+	return c.Next()
+}
+
+// warnUnsupported logs the features an agent's multipass is too old for when
+// the agent first reports its version, or reports a different one
+func (s *Server) warnUnsupported(agentID string, version *models.HostVersion) {
+	if version == nil {
+		return
+	}
+	if agent := s.Registry.GetAgent(agentID); agent != nil && agent.Version != nil && agent.Version.Multipassd == version.Multipassd {
+		return
+	}
+	if unsupported := multipass.UnsupportedFeatures(version); len(unsupported) > 0 {
+		logger.Warn("Agent's multipass does not support some features",
+			"agent_id", agentID, "multipassd", version.Multipassd, "unsupported", strings.Join(unsupported, ", "))
+	}
+}
+
+// UnregisterAgent unregisters an agent
+func (s *Server) UnregisterAgent(c *fiber.Ctx) error {
+	agentID := c.Params("agent_id")
+	success := s.Registry.UnregisterAgent(agentID)
+
+	if success {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": fmt.Sprintf("Agent '%s' unregistered successfully", agentID),
+		})
+	}
+
+	return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", agentID))
+}
+
+// totalCountHeader carries the number of entries a list query matched, for
+// lists answered as a bare array
+const totalCountHeader = "X-Total-Count"
+
+// ListAgents lists the registered agents, filtered by state (their status),
+// agent_id and label (their tags), sorted and paged as inventory.ParseQuery
+// reads them. The answer stays an array; the number of matching agents is
+// sent in X-Total-Count.
+func (s *Server) ListAgents(c *fiber.Ctx) error {
+	query, err := inventory.ParseQuery(func(key string) string { return c.Query(key) }, inventory.AgentSortFields)
+	if err != nil {
+		return apierror.Respond(c, 400, err.Error())
+	}
+
+	agentsList, total := query.Agents(s.Registry.GetAllAgents())
+	c.Set(totalCountHeader, strconv.Itoa(total))
+	return c.JSON(agentsList)
+}
+
+// AgentHistory lists the agents archived after staying offline past the
+// retention period, with the VMs they were last known to run
+func (s *Server) AgentHistory(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"agents": s.History.List()})
+}
+
+// GetAgentInfo gets information about a specific agent
+func (s *Server) GetAgentInfo(c *fiber.Ctx) error {
+	agentID := c.Params("agent_id")
+	agent := s.Registry.GetAgent(agentID)
+
+	if agent != nil {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"agent":   agent,
+		})
+	}
+
+	return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", agentID))
+}
+
+// DrainAgent stops placing new VMs on an agent (admin only). With vm_action
+// "stop" it also stops the VMs running there and reports a result per VM.
+func (s *Server) DrainAgent(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.AgentDrainRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+	}
+	switch req.VMAction {
+	case "", "stop":
+	case "migrate":
+		return apierror.Respond(c, 400, "multipass cannot move VMs between hosts; drain with vm_action \"stop\" and recreate the VMs elsewhere")
+	default:
+		return apierror.Respond(c, 400, fmt.Sprintf("Unsupported vm_action: %q", req.VMAction))
+	}
+
+	agentID := c.Params("agent_id")
+	agent := s.Registry.SetDraining(agentID, true)
+	if agent == nil {
+		return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", agentID))
+	}
+	s.Bus.Publish(models.Event{Type: "agent.drained", AgentID: agentID})
+
+	response := fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("Agent '%s' is draining", agentID),
+		"agent":   agent,
+	}
+	if req.VMAction != "stop" {
+		return c.JSON(response)
+	}
+
+	list, err := s.Executors.GetExecutor(&agentID).ListVMs(c.UserContext())
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.Respond(c, 502, fmt.Sprintf("Agent '%s' is draining, but its VMs could not be listed: %s", agentID, err))
+	}
+	targets := []models.VMActionRequest{}
+	for _, vm := range list.VMs {
+		if vm.State == "Running" {
+			targets = append(targets, models.VMActionRequest{Name: vm.Name, AgentID: &agentID})
+		}
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	results, succeeded := s.runBulk(c, session, "stop", targets)
+	response["success"] = succeeded == len(results)
+	response["stopped"] = succeeded
+	response["failed"] = len(results) - succeeded
+	response["results"] = results
+	return c.JSON(response)
+}
+
+// UndrainAgent lets new VMs be placed on a drained agent again (admin only)
+func (s *Server) UndrainAgent(c *fiber.Ctx) error {
+	agentID := c.Params("agent_id")
+	agent := s.Registry.SetDraining(agentID, false)
+	if agent == nil {
+		return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", agentID))
+	}
+	s.Bus.Publish(models.Event{Type: "agent.undrained", AgentID: agentID})
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("Agent '%s' accepts new VMs again", agentID),
+		"agent":   agent,
+	})
+}
+
+// SetAgentZone moves an agent to a zone, or out of its zone when the zone is
+// empty (admin only)
+func (s *Server) SetAgentZone(c *fiber.Ctx) error {
+	var req models.AgentZoneRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if err := agents.ValidateZone(req.Zone); err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+
+	agentID := c.Params("agent_id")
+	agent := s.Registry.SetZone(agentID, req.Zone)
+	if agent == nil {
+		return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", agentID))
+	}
+	s.Bus.Publish(models.Event{Type: "agent.zone_changed", AgentID: agentID, Data: map[string]string{"zone": req.Zone}})
+
+	message := fmt.Sprintf("Agent '%s' moved to zone '%s'", agentID, req.Zone)
+	if req.Zone == "" {
+		message = fmt.Sprintf("Agent '%s' removed from its zone", agentID)
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": message,
+		"agent":   agent,
+	})
+}
+
+// RotateAgentKey gives an agent a new random API key (admin only). The key is
+// sent to the agent with its current key and swapped in the registry only
+// once the agent has taken it, so a failed push leaves the old key working.
+func (s *Server) RotateAgentKey(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	agentID := c.Params("agent_id")
+	if s.Registry.GetAgent(agentID) == nil {
+		return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", agentID))
+	}
+
+	apiKey, err := generateSessionID()
+	if err != nil {
+		return apierror.Respond(c, 500, "Failed to generate API key")
+	}
+	err = s.Executors.Communicator(agentID).RotateKey(c.UserContext(), agentID, apiKey)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.Respond(c, 502, fmt.Sprintf("Failed to send the new key to agent '%s': %s", agentID, err))
+	}
+	if !s.Registry.SetAgentAPIKey(agentID, apiKey) {
+		return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' was unregistered during the rotation", agentID))
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	s.Bus.Publish(models.Event{Type: "agent.key_rotated", AgentID: agentID, Data: map[string]string{"by": session.Username}})
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("API key of agent '%s' rotated", agentID),
+	})
+}
+
+// ApproveAgent lets an agent join the fleet (admin only). Agents may be
+// approved before they first register.
+func (s *Server) ApproveAgent(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+	if !s.Registry.ApprovalRequired() {
+		return apierror.Respond(c, 400, "Agent approval is not enabled")
+	}
+
+	agentID := c.Params("agent_id")
+	session, _ := s.Auth.GetSession(sessionID)
+	agent, approval := s.Registry.Approve(agentID, session.Username)
+	s.Bus.Publish(models.Event{Type: "agent.approved", AgentID: agentID, Data: map[string]string{"by": session.Username}})
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"message":  fmt.Sprintf("Agent '%s' approved", agentID),
+		"approval": approval,
+		"agent":    agent,
+	})
+}
+
+// RejectAgent keeps an agent out of the fleet (admin only), unregistering it
+// if it is registered
+func (s *Server) RejectAgent(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+	if !s.Registry.ApprovalRequired() {
+		return apierror.Respond(c, 400, "Agent approval is not enabled")
+	}
+
+	agentID := c.Params("agent_id")
+	session, _ := s.Auth.GetSession(sessionID)
+	_, approval := s.Registry.Reject(agentID, session.Username)
+	s.Bus.Publish(models.Event{Type: "agent.rejected", AgentID: agentID, Data: map[string]string{"by": session.Username}})
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"message":  fmt.Sprintf("Agent '%s' rejected", agentID),
+		"approval": approval,
+	})
+}
+
+// AgentHeartbeat receives heartbeat from a registered agent, which must
+// present its API key, if it registered one
+func (s *Server) AgentHeartbeat(c *fiber.Ctx) error {
+	var heartbeat models.AgentHeartbeat
+	if err := c.BodyParser(&heartbeat); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if s.Registry.GetAgent(heartbeat.AgentID) != nil && !s.agentKeyValid(c, heartbeat.AgentID) {
+		return apierror.Respond(c, 403, "Invalid or missing API key")
+	}
+
+	s.warnUnsupported(heartbeat.AgentID, heartbeat.Version)
+	err := s.Registry.UpdateHeartbeat(heartbeat)
+	if errors.Is(err, agents.ErrAgentNotRegistered) {
+		return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found; register before sending heartbeats", heartbeat.AgentID))
+	}
+	if errors.Is(err, agents.ErrAgentRejected) {
+		return apierror.Respond(c, 403, fmt.Sprintf("Agent '%s' was rejected by an admin", heartbeat.AgentID))
+	}
+
+	if agent := s.Registry.GetAgent(heartbeat.AgentID); agent != nil && agent.Status == "pending" {
+		// Agents awaiting approval are not part of the fleet; cache nothing
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "Heartbeat received; agent awaits approval",
+		})
+	}
+
+	if heartbeat.VMs != nil {
+		s.cacheHeartbeatInventory(heartbeat.AgentID, heartbeat.VMs)
+	} else if list, _, _, ok := s.Inventory.Last(heartbeat.AgentID); ok && len(list.VMs) != heartbeat.VMCount {
+		// A VM count that disagrees with the cached listing means VMs changed
+		// behind the master's back; refresh the listing on the next read
+		s.Inventory.MarkStale(heartbeat.AgentID)
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Heartbeat received",
+	})
+}
+
+// agentKeyValid reports whether a request from an agent carries the agent's
+// API key in X-API-Key, or the agent registered without one
+func (s *Server) agentKeyValid(c *fiber.Ctx, agentID string) bool {
+	key := s.Registry.GetAgentAPIKey(agentID)
+	return key == nil || subtle.ConstantTimeCompare([]byte(c.Get("X-API-Key")), []byte(*key)) == 1
+}
+
+// DeregisterAgent marks an agent that is shutting down offline at once. The
+// agent must present its API key, if it registered one, and keeps its
+// registration for when it starts again.
+func (s *Server) DeregisterAgent(c *fiber.Ctx) error {
+	var req models.AgentDeregisterRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if s.Registry.GetAgent(req.AgentID) == nil {
+		return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", req.AgentID))
+	}
+	if !s.agentKeyValid(c, req.AgentID) {
+		return apierror.Respond(c, 403, "Invalid or missing API key")
+	}
+
+	s.Registry.SignOff(req.AgentID)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("Agent '%s' marked offline", req.AgentID),
+	})
+}
+
+// AgentTunnel accepts the websocket a registered agent opens so the master can
+// reach it without connecting to it. The agent must present its API key, if
+// it registered one, and the tunnel lasts until either side closes it.
+func (s *Server) AgentTunnel(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return apierror.Respond(c, 426, "Agent tunnels must be opened as a websocket")
+	}
+
+	agentID := c.Query("agent_id")
+	agent := s.Registry.GetAgent(agentID)
+	if agent == nil {
+		return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found; register before opening a tunnel", agentID))
+	}
+	if agent.Status == "pending" {
+		return apierror.Respond(c, 403, fmt.Sprintf("Agent '%s' awaits approval by an admin", agentID))
+	}
+	if !s.agentKeyValid(c, agentID) {
+		return apierror.Respond(c, 403, "Invalid or missing API key")
+	}
+
+	return websocket.New(func(conn *websocket.Conn) {
+		s.Tunnels.Serve(agentID, conn)
+	})(c)
+}
+
+// cacheHeartbeatInventory stores the VM listing and usage an agent sent with
+// its heartbeat in the inventory cache, so listings stay warm without
+// querying the agent
+func (s *Server) cacheHeartbeatInventory(agentID string, vms []models.VMInfoExtended) {
+	list := &models.VMList{VMs: make([]models.VMInfoExtended, 0, len(vms))}
+	usage := make(map[string]models.VMInfoExtended)
+	for _, vm := range vms {
+		list.VMs = append(list.VMs, models.VMInfoExtended{
+			Name:    vm.Name,
+			State:   vm.State,
+			IPv4:    vm.IPv4,
+			Release: vm.Release,
+		})
+		if vm.CPUCount > 0 || vm.DiskUsage != nil || vm.MemoryUsage != nil {
+			usage[vm.Name] = vm
+		}
+	}
+	s.Inventory.Set(agentID, list)
+	s.Inventory.SetUsage(agentID, usage)
+}
+
+// AgentVMState receives the VM state changes an agent saw. The agent must
+// present its API key, if it registered one. Its listing replaces its
+// inventory cache entry and every change is recorded as a
+// vm.state_changed event.
+func (s *Server) AgentVMState(c *fiber.Ctx) error {
+	var report models.AgentVMReport
+	if err := c.BodyParser(&report); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	agent := s.Registry.GetAgent(report.AgentID)
+	if agent == nil {
+		return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", report.AgentID))
+	}
+	if !s.agentKeyValid(c, report.AgentID) {
+		return apierror.Respond(c, 403, "Invalid or missing API key")
+	}
+	if agent.Status == "pending" {
+		return apierror.Respond(c, 403, fmt.Sprintf("Agent '%s' awaits approval by an admin", report.AgentID))
+	}
+
+	if report.VMs == nil {
+		report.VMs = []models.VMInfoExtended{}
+	}
+	s.Inventory.Set(report.AgentID, &models.VMList{VMs: report.VMs})
+
+	for _, change := range report.Changes {
+		s.Bus.Publish(models.Event{
+			Type:    "vm.state_changed",
+			AgentID: report.AgentID,
+			VMName:  change.Name,
+			Data:    map[string]string{"previous": change.Previous, "state": change.State},
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("Recorded %d VM state changes", len(report.Changes)),
+	})
+}
+
+// ImportAgent imports an agent's existing VMs into the metadata store (admin
+// only). Importing gives the VMs owners, so it is not left to users: a VM
+// without metadata is reachable by admins alone.
+func (s *Server) ImportAgent(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	agentID := c.Params("agent_id")
+	agent := s.Registry.GetAgent(agentID)
+	if agent == nil {
+		return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", agentID))
+	}
+
+	var req models.AgentImportRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+	}
+
+	// Imported VMs belong to the importing admin unless another owner is given
+	if req.Owner == "" {
+		session, _ := s.Auth.GetSession(sessionID)
+		req.Owner = session.Username
+	}
+
+	agentExecutor := s.Executors.GetExecutor(&agentID)
+	list, err := agentExecutor.ListVMs(c.UserContext())
+	if err != nil {
+		return apierror.Respond(c, 502, fmt.Sprintf("Failed to list VMs on agent '%s': %s", agentID, err))
+	}
+
+	now := time.Now()
+	imported := []*models.VMMetadata{}
+	skipped := []string{}
+	for _, vm := range list.VMs {
+		name := vm.Name
+		if name == "" {
+			continue
+		}
+		existing := s.Metadata.Get(agentID, name)
+		if existing != nil && !req.Overwrite {
+			skipped = append(skipped, name)
+			continue
+		}
+
+		meta := metadata.ApplyImportRules(agentID, name, existing, req, now)
+		s.Metadata.Set(meta)
+		imported = append(imported, meta)
+	}
+
+	logger.InfoContext(c.UserContext(), "Imported VMs from agent", "agent_id", agentID, "imported", len(imported), "skipped", len(skipped))
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"message":  fmt.Sprintf("Imported %d VMs from agent '%s'", len(imported), agentID),
+		"imported": imported,
+		"skipped":  skipped,
+	})
+}
+
+// ==================== Default Target Routes ====================
+
+// GetDefaults reports the primary VM and the default agent
+func (s *Server) GetDefaults(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"defaults": s.Defaults.Get(),
+	})
+}
+
+// SetDefaults replaces the primary VM and the default agent. An empty
+// primary_vm or a null default_agent_id clears that default.
+func (s *Server) SetDefaults(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.Defaults
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if req.PrimaryAgentID != nil && *req.PrimaryAgentID == "" {
+		req.PrimaryAgentID = nil
+	}
+	if req.DefaultAgentID != nil && *req.DefaultAgentID == "" {
+		req.DefaultAgentID = nil
+	}
+
+	if req.DefaultAgentID != nil && s.Registry.GetAgent(*req.DefaultAgentID) == nil {
+		return apierror.Respond(c, 400, fmt.Sprintf("Agent '%s' not found", *req.DefaultAgentID))
+	}
+	if req.PrimaryVM == "" {
+		req.PrimaryAgentID = nil
+	} else {
+		if req.PrimaryAgentID != nil && s.Registry.GetAgent(*req.PrimaryAgentID) == nil {
+			return apierror.Respond(c, 400, fmt.Sprintf("Agent '%s' not found", *req.PrimaryAgentID))
+		}
+		_, err := s.Executors.GetExecutor(req.PrimaryAgentID).GetVMInfo(c.UserContext(), req.PrimaryVM)
+		if saturated, ok := communication.AsSaturated(err); ok {
+			return agentSaturated(c, saturated)
+		}
+		if err != nil {
+			return apierror.Respond(c, 400, fmt.Sprintf("Cannot make '%s' the primary VM: %s", req.PrimaryVM, err))
+		}
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"defaults": s.Defaults.Set(req, session.Username),
+	})
+}
+
+// SetDefaultSSHKeys replaces the public keys that cloud-init authorizes for
+// the default user of every new VM (admin only). VMs that already exist are
+// not changed; use authorize-key for them.
+func (s *Server) SetDefaultSSHKeys(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req struct {
+		SSHKeys []string `json:"ssh_keys"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	keys := []string{}
+	seen := make(map[string]bool)
+	for i, key := range req.SSHKeys {
+		key, err := multipass.ValidatePublicKey(key)
+		if err != nil {
+			return apierror.Respond(c, 400, fmt.Sprintf("ssh_keys[%d]: %s", i, err))
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"defaults": s.Defaults.SetSSHKeys(keys, session.Username),
+	})
+}
+
+// primaryTarget fills in the primary VM when a JSON request names no VM, so
+// that policy checks and the handler both see the VM that will be acted on.
+// A request naming another agent than the primary VM's is left alone.
+func (s *Server) primaryTarget(c *fiber.Ctx) error {
+	vmName, primaryAgentID, ok := s.Defaults.Primary()
+	if !ok {
+		return c.Next()
+	}
+
+	body := map[string]interface{}{}
+	if len(c.Body()) > 0 {
+		if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+			return c.Next()
+		}
+		if err := json.Unmarshal(c.Body(), &body); err != nil {
+			return c.Next()
+		}
+	}
+	if name, _ := body["name"].(string); name != "" {
+		return c.Next()
+	}
+	agentID, _ := body["agent_id"].(string)
+	if agentID != "" && (primaryAgentID == nil || *primaryAgentID != agentID) {
+		return c.Next()
+	}
+
+	body["name"] = vmName
+	delete(body, "agent_id")
+	if primaryAgentID != nil {
+		body["agent_id"] = *primaryAgentID
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return c.Next()
+	}
+	c.Request().SetBody(data)
+	c.Request().Header.SetContentType(fiber.MIMEApplicationJSON)
+	return c.Next()
+}
+
+// defaultAgent returns the default agent for new VMs while it is online, not
+// draining and carries the tags constraints require, or nil when the scheduler
+// should place them
+func (s *Server) defaultAgent(constraints map[string]string) *string {
+	agentID := s.Defaults.DefaultAgent()
+	if agentID == nil {
+		return nil
+	}
+	if agent := s.Registry.GetAgent(*agentID); agent == nil || agent.Status != "online" || agent.Draining || !scheduler.Satisfies(agent, constraints) {
+		return nil
+	}
+	id := *agentID
+	return &id
+}
+
+// ==================== Task Routes ====================
+
+// Headers marking the master's replay of a request as the run of a task. The
+// token is a secret of the task store, so clients cannot forge a run.
+const (
+	taskHeader      = "X-Batwa-Task"
+	taskTokenHeader = "X-Batwa-Task-Token"
+)
+
+// localsTask holds the ID of the task a request runs
+const localsTask = "task_id"
+
+// localsTaskReplay marks the master's replay of an asynchronous request, set
+// on the replay itself so clients cannot send it
+const localsTaskReplay = "task_replay"
+
+// UnlessTaskReplay runs handler for every request but the master's replays of
+// asynchronous requests, which were counted when they were answered 202. It
+// keeps middleware that counts requests, such as metrics and the access log,
+// from counting them twice.
+func UnlessTaskReplay(handler fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if replay, _ := c.Locals(localsTaskReplay).(bool); replay {
+			return c.Next()
+		}
+		return handler(c)
+	}
+}
+
+// task records a mutating VM operation as a task. The request runs as usual
+// and its response carries the task ID in X-Task-ID, unless the client asks
+// for an asynchronous answer with "Prefer: respond-async" or ?async=true: it
+// is then answered 202 with the task at once, and the request is replayed in
+// the background as the task's run.
+func (s *Server) task(operation string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if id := c.Get(taskHeader); id != "" && subtle.ConstantTimeCompare([]byte(c.Get(taskTokenHeader)), []byte(s.Tasks.Token())) == 1 {
+			return s.runTask(c, id)
+		}
+
+		sessionID := auth.SessionID(c)
+		if !s.Auth.CheckAuth(sessionID) {
+			return c.Next()
+		}
+		session, _ := s.Auth.GetSession(sessionID)
+		// Fiber's strings point into buffers reused by later requests
+		agentID, vmName := accesslog.RequestTarget(c)
+		task := s.Tasks.Create(models.Task{
+			Operation: operation,
+			User:      session.Username,
+			Method:    utils.CopyString(c.Method()),
+			Path:      utils.CopyString(c.OriginalURL()),
+			AgentID:   utils.CopyString(agentID),
+			VMName:    utils.CopyString(vmName),
+			RequestID: requestid.Get(c),
+		})
+		c.Set("X-Task-ID", task.ID)
+
+		if !wantsAsync(c) {
+			return s.runTask(c, task.ID)
+		}
+
+		req := &fasthttp.Request{}
+		c.Request().CopyTo(req)
+		req.Header.Set(taskHeader, task.ID)
+		req.Header.Set(taskTokenHeader, s.Tasks.Token())
+		// The replay keeps the request's ID, so its logs line up with the 202,
+		// and continues its trace
+		req.Header.Set(requestid.Header, requestid.Get(c))
+		if traceparent := tracing.Traceparent(c.UserContext()); traceparent != "" {
+			req.Header.Set(tracing.Header, traceparent)
+		}
+		remoteAddr := c.Context().RemoteAddr()
+		go func() {
+			replay := &fasthttp.RequestCtx{}
+			replay.Init(req, remoteAddr, nil)
+			replay.SetUserValue(localsTaskReplay, true)
+			s.app.Handler()(replay)
+		}()
+
+		c.Location(apiversion.Path("/tasks/" + task.ID))
+		return c.Status(202).JSON(fiber.Map{
+			"success": true,
+			"task_id": task.ID,
+			"task":    task,
+		})
+	}
+}
+
+// wantsAsync reports whether a client asked for a 202 and a task instead of
+// waiting for the operation
+func wantsAsync(c *fiber.Ctx) bool {
+	if async, err := strconv.ParseBool(c.Query("async")); err == nil && async {
+		return true
+	}
+	for _, preference := range strings.Split(c.Get("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+			return true
+		}
+	}
+	return false
+}
+
+// runTask runs the rest of a request as a task and records its outcome
+func (s *Server) runTask(c *fiber.Ctx, id string) error {
+	s.Tasks.Start(id)
+	c.Locals(localsTask, id)
+
+	err := c.Next()
+	if err != nil {
+		// Let the error handler set the status before it is recorded
+		if handlerErr := c.App().ErrorHandler(c, err); handlerErr != nil {
+			c.Status(fiber.StatusInternalServerError)
+		}
+		err = nil
+	}
+	s.Tasks.Finish(id, c.Response().StatusCode(), c.Response().Body())
+	if task, ok := s.Tasks.Get(id); ok {
+		s.Bus.Publish(models.Event{
+			Type:    "task.completed",
+			AgentID: task.AgentID,
+			VMName:  task.VMName,
+			Data: map[string]string{
+				"task_id":   task.ID,
+				"operation": task.Operation,
+				"state":     task.State,
+				"user":      task.User,
+			},
+		})
+	}
+	return err
+}
+
+// taskProgress gets a launch progress callback that logs to the task the
+// request runs, or nil outside a task
+func (s *Server) taskProgress(c *fiber.Ctx) func(models.LaunchProgress) {
+	id, ok := c.Locals(localsTask).(string)
+	if !ok {
+		return nil
+	}
+	return func(progress models.LaunchProgress) {
+		message := progress.Stage
+		if progress.Message != "" {
+			message += ": " + progress.Message
+		}
+		if progress.Percent != nil {
+			message += fmt.Sprintf(" (%d%%)", *progress.Percent)
+		}
+		s.Tasks.Log(id, message)
+	}
+}
+
+// ListTasks searches the task history, newest first. Filters: user, agent,
+// vm, state and since (RFC 3339); pages with limit (default 100, at most 1000)
+// and offset. Users only see their own tasks.
+func (s *Server) ListTasks(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	query := tasks.Query{
+		User:    c.Query("user"),
+		AgentID: c.Query("agent"),
+		VMName:  c.Query("vm"),
+		State:   c.Query("state"),
+		Limit:   c.QueryInt("limit", 100),
+		Offset:  c.QueryInt("offset"),
+	}
+	if query.Limit <= 0 || query.Limit > 1000 {
+		return apierror.Respond(c, 400, "limit must be between 1 and 1000")
+	}
+	if query.Offset < 0 {
+		return apierror.Respond(c, 400, "offset must not be negative")
+	}
+	if since := c.Query("since"); since != "" {
+		parsed, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return apierror.Respond(c, 400, "Invalid since: expected RFC 3339 time")
+		}
+		query.Since = parsed
+	}
+	if !s.Auth.IsAdmin(sessionID) {
+		session, _ := s.Auth.GetSession(sessionID)
+		query.User = session.Username
+	}
+
+	list, total := s.Tasks.Search(query)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"tasks":   list,
+		"total":   total,
+		"limit":   query.Limit,
+		"offset":  query.Offset,
+	})
+}
+
+// GetTask reports a task's state, logs and, once it is done, the status and
+// response of its operation. Users see their own tasks; admins see all.
+func (s *Server) GetTask(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	id := c.Params("id")
+	task, ok := s.Tasks.Get(id)
+	session, _ := s.Auth.GetSession(sessionID)
+	if !ok || (task.User != session.Username && !s.Auth.IsAdmin(sessionID)) {
+		return apierror.Respond(c, 404, fmt.Sprintf("Task '%s' not found", id))
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"task":    task,
+	})
+}
+
+// ==================== Zone Routes ====================
+
+// ListZones lists the zones that have agents, with how many of their agents
+// are online and how many VMs they run
+func (s *Server) ListZones(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"zones": s.Registry.Zones()})
+}
+
+// ListZoneAgents lists the agents in a zone
+func (s *Server) ListZoneAgents(c *fiber.Ctx) error {
+	zone := c.Params("zone")
+	return c.JSON(fiber.Map{
+		"zone":   zone,
+		"agents": s.Registry.GetZoneAgents(zone),
+	})
+}
+
+// CreateZoneVM creates a VM like CreateVM, placed on an agent in the zone
+// named in the path
+func (s *Server) CreateZoneVM(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.VMCreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	req.Zone = c.Params("zone")
+
+	session, _ := s.Auth.GetSession(sessionID)
+	result := s.createVM(c.UserContext(), req, session.Username, s.taskProgress(c))
+	if result.saturated != nil {
+		return agentSaturated(c, result.saturated)
+	}
+	if result.failure != nil {
+		return apierror.RespondErr(c, result.status, result.failure)
+	}
+	return c.JSON(result.response)
+}
+
+// ==================== Quota Routes ====================
+
+// ListQuotas reports the quota of every user and agent along with what each
+// has in use
+func (s *Server) ListQuotas(c *fiber.Ctx) error {
+	users, agents := quotas.Tally(s.quotaVMs(c.UserContext()))
+	return c.JSON(fiber.Map{
+		"success": true,
+		"quotas":  s.Quotas.Get(),
+		"usage": fiber.Map{
+			"users":  users,
+			"agents": agents,
+		},
+	})
+}
+
+// SetUserQuota sets the quota of a user (admin only)
+func (s *Server) SetUserQuota(c *fiber.Ctx) error {
+	return s.setQuota(c, "user", c.Params("username"))
+}
+
+// SetAgentQuota sets the quota of an agent (admin only)
+func (s *Server) SetAgentQuota(c *fiber.Ctx) error {
+	return s.setQuota(c, "agent", c.Params("agent_id"))
+}
+
+// setQuota sets the quota of a user or an agent
+func (s *Server) setQuota(c *fiber.Ctx, scope, subject string) error {
+	sessionID := auth.SessionID(c)
+
+	var quota models.Quota
+	if err := c.BodyParser(&quota); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if err := quotas.Validate(quota); err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	if scope == "agent" {
+		if s.Registry.GetAgent(subject) == nil {
+			return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", subject))
+		}
+		quota = s.Quotas.SetAgent(subject, quota, session.Username)
+	} else {
+		quota = s.Quotas.SetUser(subject, quota, session.Username)
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"quota":   quota,
+	})
+}
+
+// DeleteUserQuota removes the quota of a user (admin only)
+func (s *Server) DeleteUserQuota(c *fiber.Ctx) error {
+	return s.deleteQuota(c, "user", c.Params("username"), s.Quotas.RemoveUser)
+}
+
+// DeleteAgentQuota removes the quota of an agent (admin only)
+func (s *Server) DeleteAgentQuota(c *fiber.Ctx) error {
+	return s.deleteQuota(c, "agent", c.Params("agent_id"), s.Quotas.RemoveAgent)
+}
+
+// deleteQuota removes the quota of a user or an agent with remove
+func (s *Server) deleteQuota(c *fiber.Ctx, scope, subject string, remove func(string) bool) error {
+	if !remove(subject) {
+		return apierror.Respond(c, 404, fmt.Sprintf("No quota is set for %s '%s'", scope, subject))
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("Quota for %s '%s' removed", scope, subject),
+	})
+}
+
+// quotaVMs lists the VMs that count against quotas from the inventory, with
+// their owners from the metadata store. Deleted VMs do not count, and VMs
+// that report no usage, such as stopped ones, count only towards max_vms.
+func (s *Server) quotaVMs(ctx context.Context) []quotas.VM {
+	usage := s.Executors.UsageByVM(ctx, false)
+	vms := []quotas.VM{}
+	for _, vm := range s.Executors.ListAllVMs(ctx) {
+		if vm.State == "Deleted" {
+			continue
+		}
+		agentID := ""
+		if vm.AgentID != nil {
+			agentID = *vm.AgentID
+		}
+		counted := quotas.VM{AgentID: agentID}
+		if meta := s.Metadata.Get(agentID, vm.Name); meta != nil {
+			counted.Owner = meta.Owner
+		}
+		if vmUsage, ok := usage[vmKey(vm)]; ok {
+			counted.CPUs = vmUsage.CPUCount
+			if vmUsage.MemoryUsage != nil {
+				counted.Memory = vmUsage.MemoryUsage.Total
+			}
+		}
+		vms = append(vms, counted)
+	}
+	return vms
+}
+
+// reserveQuota checks a new VM against the quotas of its owner and agent and
+// counts it against them until release is called
+func (s *Server) reserveQuota(ctx context.Context, req models.VMCreateRequest, user string) (func(), error) {
+	agentID := inventory.Key(req.AgentID)
+	if !s.Quotas.Applies(user, agentID) {
+		return func() {}, nil
+	}
+
+	memory, err := quotas.ParseSize(req.Memory)
+	if err != nil {
+		return nil, err
+	}
+	demand := models.QuotaUsage{VMs: 1, CPUs: req.CPUs, Memory: memory}
+	return s.Quotas.Reserve(user, agentID, demand, s.quotaVMs(ctx))
+}
+
+// quotaExceeded builds the error for a VM that would exceed quotas, with the
+// violated quotas in its details
+func quotaExceeded(err *quotas.ExceededError) *models.ErrorResponse {
+	return &models.ErrorResponse{
+		Code:    models.ErrCodeQuotaExceeded,
+		Message: err.Error(),
+		Details: fiber.Map{"violations": err.Violations},
+	}
+}
+
+// ==================== Maintenance Routes ====================
+
+// CreateMaintenanceWindow schedules a recurring maintenance window for an agent or zone
+func (s *Server) CreateMaintenanceWindow(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var window models.MaintenanceWindow
+	if err := c.BodyParser(&window); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	if session, ok := s.Auth.GetSession(sessionID); ok {
+		window.CreatedBy = session.Username
+	}
+
+	if err := s.Maintenance.AddWindow(&window); err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"window":  window,
+	})
+}
+
+// ListMaintenanceWindows lists maintenance windows with their next occurrence.
+// With ?agent_id= it lists only the windows covering that agent.
+func (s *Server) ListMaintenanceWindows(c *fiber.Ctx) error {
+	list := s.Maintenance.ListWindows()
+	if agentID := c.Query("agent_id"); agentID != "" {
+		agent := s.Registry.GetAgent(agentID)
+		if agent == nil {
+			return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", agentID))
+		}
+		list = s.Maintenance.WindowsFor(agent)
+	}
+
+	now := time.Now()
+	windows := []fiber.Map{}
+	for _, window := range list {
+		entry := fiber.Map{
+			"window": window,
+			"active": false,
+		}
+		if start, end, active := maintenance.ActiveAt(window, now); active {
+			entry["active"] = true
+			entry["current_start"] = start
+			entry["current_end"] = end
+		}
+		if start, end, ok := maintenance.NextOccurrence(window, now); ok {
+			entry["next_start"] = start
+			entry["next_end"] = end
+		}
+		windows = append(windows, entry)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"windows": windows,
+	})
+}
+
+// DeleteMaintenanceWindow removes a maintenance window
+func (s *Server) DeleteMaintenanceWindow(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if !s.Maintenance.RemoveWindow(id) {
+		return apierror.Respond(c, 404, fmt.Sprintf("Maintenance window '%s' not found", id))
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("Maintenance window '%s' deleted", id),
+	})
+}
+
+// ==================== Power Schedule Routes ====================
+
+// CreateSchedule attaches a cron-style power schedule to a VM or to the VMs
+// matching a label selector. Users other than admins may only schedule VMs
+// they own.
+func (s *Server) CreateSchedule(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var schedule models.PowerSchedule
+	if err := c.BodyParser(&schedule); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	schedule.CreatedBy = session.Username
+	if schedule.VMName != "" && !s.Auth.IsAdmin(sessionID) {
+		meta := s.Metadata.Get(schedule.AgentID, schedule.VMName)
+		if meta == nil || meta.Owner != session.Username {
+			return apierror.Respond(c, 403, "Only the VM's owner or an admin can schedule it")
+		}
+	}
+
+	if err := s.Schedules.Add(&schedule); err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"schedule": schedule,
+	})
+}
+
+// ListSchedules lists power schedules with their next run; admins see every
+// schedule, other users their own
+func (s *Server) ListSchedules(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	session, _ := s.Auth.GetSession(sessionID)
+	admin := s.Auth.IsAdmin(sessionID)
+	now := time.Now()
+	entries := []fiber.Map{}
+	for _, schedule := range s.Schedules.List() {
+		if !admin && schedule.CreatedBy != session.Username {
+			continue
+		}
+		entry := fiber.Map{"schedule": schedule}
+		if next, action, ok := schedules.NextRun(schedule, now); ok {
+			entry["next_run"] = next
+			entry["next_action"] = action
+		}
+		entries = append(entries, entry)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"schedules": entries,
+	})
+}
+
+// scheduleForSession gets a schedule the session may manage, or writes an
+// error response and returns nil
+func (s *Server) scheduleForSession(c *fiber.Ctx, sessionID string) *models.PowerSchedule {
+	id := c.Params("id")
+	schedule := s.Schedules.Get(id)
+	if schedule == nil {
+		apierror.Respond(c, 404, fmt.Sprintf("Schedule '%s' not found", id))
+		return nil
+	}
+	session, _ := s.Auth.GetSession(sessionID)
+	if schedule.CreatedBy != session.Username && !s.Auth.IsAdmin(sessionID) {
+		apierror.Respond(c, 403, "Only the schedule's creator or an admin can manage it")
+		return nil
+	}
+	return schedule
+}
+
+// DeleteSchedule removes a power schedule
+func (s *Server) DeleteSchedule(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	schedule := s.scheduleForSession(c, sessionID)
+	if schedule == nil {
+		return nil
+	}
+	s.Schedules.Remove(schedule.ID)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("Schedule '%s' deleted", schedule.ID),
+	})
+}
+
+// RunSchedule runs one of a schedule's actions immediately
+func (s *Server) RunSchedule(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	schedule := s.scheduleForSession(c, sessionID)
+	if schedule == nil {
+		return nil
+	}
+
+	var req struct {
+		Action string `json:"action"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	known := false
+	for _, rule := range schedule.Rules {
+		known = known || rule.Action == req.Action
+	}
+	if !known {
+		return apierror.Respond(c, 400, fmt.Sprintf("Schedule '%s' has no '%s' rule", schedule.ID, req.Action))
+	}
+
+	run := s.Schedules.Run(schedule.ID, req.Action)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"run":     run,
+	})
+}
+
+// ==================== Template Routes ====================
+
+// CreateTemplate defines a named VM template (admin only)
+func (s *Server) CreateTemplate(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var template models.VMTemplate
+	if err := c.BodyParser(&template); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	if s.Templates.Get(template.Name) != nil {
+		return apierror.Respond(c, 409, fmt.Sprintf("Template '%s' already exists", template.Name))
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	template.CreatedBy = session.Username
+	if err := s.Templates.Add(&template); err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"template": template,
+	})
+}
+
+// ListTemplates lists the VM templates users can launch from
+func (s *Server) ListTemplates(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"templates": s.Templates.List(),
+	})
+}
+
+// GetTemplate gets one VM template
+func (s *Server) GetTemplate(c *fiber.Ctx) error {
+	name := c.Params("name")
+	template := s.Templates.Get(name)
+	if template == nil {
+		return apierror.Respond(c, 404, fmt.Sprintf("Template '%s' not found", name))
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"template": template,
+	})
+}
+
+// UpdateTemplate replaces a VM template (admin only). VMs already launched
+// from it are not changed.
+func (s *Server) UpdateTemplate(c *fiber.Ctx) error {
+	var template models.VMTemplate
+	if err := c.BodyParser(&template); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	// Params point into a buffer fiber reuses, and the name outlives the request
+	name := utils.CopyString(c.Params("name"))
+	template.Name = name
+
+	found, err := s.Templates.Update(&template)
+	if !found {
+		return apierror.Respond(c, 404, fmt.Sprintf("Template '%s' not found", name))
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"template": template,
+	})
+}
+
+// DeleteTemplate removes a VM template (admin only)
+func (s *Server) DeleteTemplate(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if !s.Templates.Remove(name) {
+		return apierror.Respond(c, 404, fmt.Sprintf("Template '%s' not found", name))
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("Template '%s' deleted", name),
+	})
+}
+
+// ==================== Stack Routes ====================
+
+// stackActions are the group-level lifecycle actions of a stack
+var stackActions = map[string]bool{
+	"start":   true,
+	"stop":    true,
+	"suspend": true,
+	"resume":  true,
+	"restart": true,
+}
+
+// CreateStack creates every VM of a stack concurrently and records the ones
+// that launched as its members. Members are labelled stack=<name> and
+// stack-role=<role>, so schedules and list filters can select them.
+func (s *Server) CreateStack(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.StackCreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	reqs, members, err := stacks.Expand(req)
+	if err == nil {
+		err = validateBatch(reqs)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+	if err := s.placeBatch(reqs); err != nil {
+		return apierror.RespondErr(c, placementStatus(err), err)
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	stack := &models.Stack{
+		Name:        req.Name,
+		Description: req.Description,
+		Members:     []models.StackMember{},
+		CreatedBy:   session.Username,
+		CreatedAt:   time.Now(),
+	}
+	if err := s.Stacks.Reserve(stack); err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+
+	results, succeeded := s.createVMs(c.UserContext(), reqs, session.Username)
+	launched := []models.StackMember{}
+	for i, result := range results {
+		if result["status"] != 200 {
+			continue
+		}
+		member := members[i]
+		if reqs[i].AgentID != nil {
+			member.AgentID = *reqs[i].AgentID
+		}
+		launched = append(launched, member)
+	}
+
+	if succeeded == 0 {
+		s.Stacks.Remove(req.Name)
+		return apierror.RespondDetails(c, 500, models.ErrCodeInternal, fmt.Sprintf("No VMs of stack '%s' could be created", req.Name), fiber.Map{"results": results})
+	}
+	s.Stacks.SetMembers(req.Name, launched)
+
+	return c.JSON(fiber.Map{
+		"success":   succeeded == len(results),
+		"stack":     s.Stacks.Get(req.Name),
+		"succeeded": succeeded,
+		"failed":    len(results) - succeeded,
+		"results":   results,
+	})
+}
+
+// ListStacks lists stacks; admins see every stack, other users their own
+func (s *Server) ListStacks(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	session, _ := s.Auth.GetSession(sessionID)
+	admin := s.Auth.IsAdmin(sessionID)
+	list := []*models.Stack{}
+	for _, stack := range s.Stacks.List() {
+		if admin || stack.CreatedBy == session.Username {
+			list = append(list, stack)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"stacks":  list,
+	})
+}
+
+// stackForSession gets a stack the session may manage, or writes an error
+// response and returns nil
+func (s *Server) stackForSession(c *fiber.Ctx, sessionID string) *models.Stack {
+	name := c.Params("name")
+	stack := s.Stacks.Get(name)
+	if stack == nil {
+		apierror.Respond(c, 404, fmt.Sprintf("Stack '%s' not found", name))
+		return nil
+	}
+	session, _ := s.Auth.GetSession(sessionID)
+	if stack.CreatedBy != session.Username && !s.Auth.IsAdmin(sessionID) {
+		apierror.Respond(c, 403, "Only the stack's creator or an admin can manage it")
+		return nil
+	}
+	return stack
+}
+
+// stackTargets turns a stack's members into bulk action targets
+func stackTargets(stack *models.Stack) []models.VMActionRequest {
+	targets := make([]models.VMActionRequest, len(stack.Members))
+	for i, member := range stack.Members {
+		targets[i].Name = member.VMName
+		if member.AgentID != "" {
+			agentID := member.AgentID
+			targets[i].AgentID = &agentID
+		}
+	}
+	return targets
+}
+
+// GetStack reports a stack's members with their current state. Members whose
+// VM no longer shows up in any listing are reported as "Missing".
+func (s *Server) GetStack(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	stack := s.stackForSession(c, sessionID)
+	if stack == nil {
+		return nil
+	}
+
+	states := make(map[string]models.VMInfoExtended)
+	for _, vm := range s.Executors.ListAllVMs(c.UserContext()) {
+		states[vmKey(vm)] = vm
+	}
+
+	members := []fiber.Map{}
+	counts := make(map[string]int)
+	for _, member := range stack.Members {
+		entry := fiber.Map{
+			"vm_name":  member.VMName,
+			"role":     member.Role,
+			"agent_id": member.AgentID,
+			"state":    "Missing",
+		}
+		if vm, ok := states[executor.UsageKey(member.AgentID, member.VMName)]; ok {
+			entry["state"] = vm.State
+			entry["ipv4"] = vm.IPv4
+			entry["agent_hostname"] = vm.AgentHostname
+		}
+		if state, ok := entry["state"].(string); ok {
+			counts[state]++
+		}
+		members = append(members, entry)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":     true,
+		"name":        stack.Name,
+		"description": stack.Description,
+		"created_by":  stack.CreatedBy,
+		"created_at":  stack.CreatedAt,
+		"states":      counts,
+		"members":     members,
+	})
+}
+
+// StackAction starts, stops, suspends, resumes or restarts every member of a
+// stack; each member is authorized and reported separately
+func (s *Server) StackAction(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	action := c.Params("action")
+	if !stackActions[action] {
+		return apierror.Respond(c, 400, fmt.Sprintf("Unsupported stack action: %q", action))
+	}
+	stack := s.stackForSession(c, sessionID)
+	if stack == nil {
+		return nil
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	results, succeeded := s.runBulk(c, session, action, stackTargets(stack))
+
+	return c.JSON(fiber.Map{
+		"success":   succeeded == len(results),
+		"action":    action,
+		"succeeded": succeeded,
+		"failed":    len(results) - succeeded,
+		"results":   results,
+	})
+}
+
+// DeleteStack deletes every member of a stack. The stack is removed once all
+// of its VMs are gone; members that could not be deleted stay in the stack so
+// the request can be retried.
+func (s *Server) DeleteStack(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	stack := s.stackForSession(c, sessionID)
+	if stack == nil {
+		return nil
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	results, succeeded := s.runBulk(c, session, "delete", stackTargets(stack))
+
+	remaining := []models.StackMember{}
+	for i, result := range results {
+		if result["success"] != true {
+			remaining = append(remaining, stack.Members[i])
+		}
+	}
+	if len(remaining) == 0 {
+		s.Stacks.Remove(stack.Name)
+	} else {
+		s.Stacks.SetMembers(stack.Name, remaining)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":   len(remaining) == 0,
+		"succeeded": succeeded,
+		"failed":    len(results) - succeeded,
+		"results":   results,
+	})
+}
+
+// ==================== Notification Routes ====================
+
+// ListNotifications lists the current user's notifications
+func (s *Server) ListNotifications(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	session, _ := s.Auth.GetSession(sessionID)
+	return c.JSON(fiber.Map{
+		"success":       true,
+		"notifications": s.Notifier.List(session.Username),
+	})
+}
+
+// ==================== Event Routes ====================
+
+// maxPollTimeout caps how long a poll may wait for events
+const maxPollTimeout = 60 * time.Second
+
+// PollEvents long-polls the event log. It returns the events after cursor as
+// soon as there are any, or an empty list once timeout (seconds, default 25)
+// passes. Without a cursor it returns the current cursor immediately, so a
+// client can start following from now. Pass the returned cursor to the next
+// poll; "truncated" means events after the given cursor were already dropped.
+func (s *Server) PollEvents(c *fiber.Ctx) error {
+	if c.Query("cursor") == "" {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"events":  []*models.Event{},
+			"cursor":  strconv.FormatInt(s.Events.Cursor(), 10),
+		})
+	}
+	cursor, err := strconv.ParseInt(c.Query("cursor"), 10, 64)
+	if err != nil || cursor < 0 {
+		return apierror.Respond(c, 400, "Invalid cursor")
+	}
+
+	timeout := time.Duration(c.QueryInt("timeout", 25)) * time.Second
+	if timeout < 0 {
+		timeout = 0
+	}
+	if timeout > maxPollTimeout {
+		timeout = maxPollTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), timeout)
+	defer cancel()
+	list, truncated := s.Events.Wait(ctx, cursor, c.QueryInt("limit", 100))
+
+	next := cursor
+	if len(list) > 0 {
+		next = list[len(list)-1].ID
+	}
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"events":    list,
+		"cursor":    strconv.FormatInt(next, 10),
+		"truncated": truncated,
+	})
+}
+
+// streamPoll is how long an event stream waits for new events before
+// checking that its client is still there and logged in
+const streamPoll = 15 * time.Second
+
+// StreamEvents streams the event log as server-sent events, one "message"
+// per event with the event as JSON data and its ID as the SSE id. The stream
+// starts from now, or after the ID in Last-Event-ID or ?cursor=, so a
+// reconnecting EventSource resumes where it left off; a "truncated" event
+// means some events after that ID were already dropped. ?types= limits the
+// stream to a comma-separated list of event types.
+func (s *Server) StreamEvents(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	cursor := s.Events.Cursor()
+	resume := c.Get("Last-Event-ID")
+	if resume == "" {
+		resume = c.Query("cursor")
+	}
+	if resume != "" {
+		parsed, err := strconv.ParseInt(resume, 10, 64)
+		if err != nil || parsed < 0 {
+			return apierror.Respond(c, 400, "Invalid cursor")
+		}
+		cursor = parsed
+	}
+
+	types := map[string]bool{}
+	for _, eventType := range strings.Split(c.Query("types"), ",") {
+		if eventType = strings.TrimSpace(eventType); eventType != "" {
+			types[eventType] = true
+		}
+	}
+
+	return sse.Stream(c, func(w *sse.Writer) {
+		// Tell the client to reconnect quickly if the stream drops
+		w.Retry(3 * time.Second)
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), streamPoll)
+			list, truncated := s.Events.Wait(ctx, cursor, 100)
+			cancel()
+
+			if truncated {
+				w.Event("truncated", fiber.Map{})
+			}
+			for _, event := range list {
+				cursor = event.ID
+				if len(types) > 0 && !types[event.Type] {
+					continue
+				}
+				w.Message(strconv.FormatInt(event.ID, 10), event)
+			}
+
+			// A failed write, including a keepalive comment, means the
+			// client went away; a logout ends the stream too
+			select {
+			case <-w.Done():
+				return
+			default:
+			}
+			if !s.Auth.CheckAuth(sessionID) {
+				return
+			}
+		}
+	})
+}
+
+// ==================== Access Log Routes ====================
+
+// ListAccessLogs searches the persisted access logs (admin only). Filters:
+// user, token, agent_id, vm_name, route, status, since and until (RFC 3339),
+// and limit (default 100).
+func (s *Server) ListAccessLogs(c *fiber.Ctx) error {
+	query := accesslog.Query{
+		User:    c.Query("user"),
+		Token:   c.Query("token"),
+		AgentID: c.Query("agent_id"),
+		VMName:  c.Query("vm_name"),
+		Route:   c.Query("route"),
+		Status:  c.QueryInt("status"),
+		Limit:   c.QueryInt("limit", 100),
+	}
+	for param, dest := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := c.Query(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return apierror.Respond(c, 400, fmt.Sprintf("Invalid %s: expected RFC 3339 time", param))
+			}
+			*dest = parsed
+		}
+	}
+
+	entries, err := s.AccessLog.Search(query)
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"entries": entries,
+	})
+}
+
+// ==================== Digest Routes ====================
+
+// GetLatestDigest gets the latest digest: the full report for admins, or the
+// caller's own section otherwise
+func (s *Server) GetLatestDigest(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	latest := s.Digest.Latest()
+	if latest == nil {
+		return apierror.Respond(c, 404, "No digest has been generated yet")
+	}
+
+	if s.Auth.IsAdmin(sessionID) {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"digest":  latest,
+		})
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	items := latest.Users[session.Username]
+	if items == nil {
+		items = []models.DigestItem{}
+	}
+	return c.JSON(fiber.Map{
+		"success":      true,
+		"generated_at": latest.GeneratedAt,
+		"items":        items,
+	})
+}
+
+// GenerateDigest compiles and delivers a digest immediately
+func (s *Server) GenerateDigest(c *fiber.Ctx) error {
+	now := time.Now()
+	s.Digest.Sample(now)
+	report := s.Digest.Generate(now)
+	s.Digest.Deliver(report)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"digest":  report,
+	})
+}
+
+// ==================== Blueprint Routes ====================
+
+// ListBlueprints lists the blueprints available on the master, or on the agent
+// given by agent_id
+func (s *Server) ListBlueprints(c *fiber.Ctx) error {
+	var agentID *string
+	if id := c.Query("agent_id"); id != "" {
+		agentID = &id
+	}
+
+	exec := s.Executors.GetExecutor(agentID)
+	blueprints, err := exec.ListBlueprints(c.UserContext())
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"blueprints": blueprints,
+	})
+}
+
+// ==================== Network Routes ====================
+
+// ListNetworks lists the host interfaces that VMs on the master, or on the
+// agent given by agent_id, can be bridged onto with the networks create field
+func (s *Server) ListNetworks(c *fiber.Ctx) error {
+	var agentID *string
+	if id := c.Query("agent_id"); id != "" {
+		agentID = &id
+	}
+
+	exec := s.Executors.GetExecutor(agentID)
+	networks, err := exec.ListNetworks(c.UserContext())
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"networks": networks,
+	})
+}
+
+// ==================== Host Routes ====================
+
+// GetHostVersion reports the multipass version and driver of the master, or
+// of the agent given by agent_id, and the API features it is too old for
+func (s *Server) GetHostVersion(c *fiber.Ctx) error {
+	var agentID *string
+	if id := c.Query("agent_id"); id != "" {
+		agentID = &id
+	}
+
+	version, err := s.Executors.GetExecutor(agentID).GetVersion(c.UserContext())
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	// The master decides which features its routes need, so re-evaluate
+	// rather than trusting the agent's own assessment
+	version.Unsupported = multipass.UnsupportedFeatures(version)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"version": version,
+	})
+}
+
+// GetHostHealth reports whether multipass answers on the master and on each
+// registered agent. The master checks itself periodically; agents report
+// their health in heartbeats, so offline agents show their last report.
+func (s *Server) GetHostHealth(c *fiber.Ctx) error {
+	local := s.Health.Health()
+	if !s.Executors.LocalEnabled() {
+		local = models.HostHealth{Status: multipass.HealthUnavailable, Error: "multipass is not installed on the master"}
+	}
+	hosts := []fiber.Map{{
+		"agent_id": nil,
+		"hostname": "local",
+		"status":   local.Status,
+		"health":   local,
+	}}
+
+	agents := s.Registry.GetAllAgents()
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].AgentID < agents[j].AgentID
+	})
+	for _, agent := range agents {
+		// Agents older than the health report only say whether they are up
+		status := multipass.HealthUnknown
+		switch {
+		case agent.Status == "offline":
+			status = "offline"
+		case agent.Health != nil:
+			status = agent.Health.Status
+		}
+		hosts = append(hosts, fiber.Map{
+			"agent_id": agent.AgentID,
+			"hostname": agent.Hostname,
+			"status":   status,
+			"health":   agent.Health,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"hosts":   hosts,
+	})
+}
+
+// hostVersion gets the last known multipass version of the master or an
+// agent, or nil when it is unknown
+func (s *Server) hostVersion(ctx context.Context, agentID *string) *models.HostVersion {
+	if agentID == nil {
+		if !s.Executors.LocalEnabled() {
+			return nil
+		}
+		version, err := s.Executors.GetExecutor(nil).GetVersion(ctx)
+		if err != nil {
+			return nil
+		}
+		return version
+	}
+	if agent := s.Registry.GetAgent(*agentID); agent != nil {
+		return agent.Version
+	}
+	return nil
+}
+
+// requireFeature fails when the host a request targets runs a multipass
+// release too old for feature. Hosts of unknown version are let through.
+func (s *Server) requireFeature(ctx context.Context, agentID *string, feature string) error {
+	version := s.hostVersion(ctx, agentID)
+	if multipass.Supports(version, feature) {
+		return nil
+	}
+	host := "the master"
+	if agentID != nil {
+		host = fmt.Sprintf("agent '%s'", *agentID)
+	}
+	running := version.Multipassd
+	if running == "" {
+		running = version.Multipass
+	}
+	return fmt.Errorf("%s requires multipass %s or newer, but %s runs %s",
+		feature, multipass.RequiredVersion(feature), host, running)
+}
+
+// GetHostStorage reports the disk space multipass uses on the master or an
+// agent: the filesystem holding its data, each instance and the image cache
+func (s *Server) GetHostStorage(c *fiber.Ctx) error {
+	var agentID *string
+	if id := c.Query("agent_id"); id != "" {
+		agentID = &id
+	}
+
+	storage, err := s.Executors.GetExecutor(agentID).GetStorage(c.UserContext())
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"storage": storage,
+	})
+}
+
+// PruneHost reclaims disk on the master or an agent by purging deleted VMs
+// and removing cached images multipass no longer tracks (admin only)
+func (s *Server) PruneHost(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.HostPruneRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+	}
+
+	result, err := s.Executors.GetExecutor(req.AgentID).PruneHost(c.UserContext())
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	// Purged VMs can no longer be recovered, so drop what the master kept
+	// about them
+	for _, name := range result.PurgedInstances {
+		s.forgetVM(req.AgentID, name)
+	}
+
+	host := "the master"
+	if req.AgentID != nil {
+		host = fmt.Sprintf("agent '%s'", *req.AgentID)
+	}
+	session, _ := s.Auth.GetSession(sessionID)
+	logger.InfoContext(c.UserContext(), "Pruned host", "host", host, "user", session.Username,
+		"vms_purged", len(result.PurgedInstances), "images_removed", len(result.RemovedImages), "bytes_freed", result.FreedBytes)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"prune":   result,
+	})
+}
+
+// GetHostSettings reads the multipass daemon settings of the master, or of
+// the agent given by agent_id. keys limits the result to a comma-separated
+// list of settings.
+func (s *Server) GetHostSettings(c *fiber.Ctx) error {
+	var agentID *string
+	if id := c.Query("agent_id"); id != "" {
+		agentID = &id
+	}
+	var keys []string
+	if value := c.Query("keys"); value != "" {
+		keys = strings.Split(value, ",")
+	}
+
+	settings, err := s.Executors.GetExecutor(agentID).GetSettings(c.UserContext(), keys)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"settings": settings,
+	})
+}
+
+// SetHostSettings changes multipass daemon settings, such as local.driver,
+// local.bridged-network or local.passphrase, on the master or an agent
+func (s *Server) SetHostSettings(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.HostSettingsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if err := multipass.ValidateSettings(req.Settings); err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+
+	err := s.Executors.GetExecutor(req.AgentID).SetSettings(c.UserContext(), req.Settings)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	// Report what changed without echoing secrets such as the passphrase
+	applied := make(map[string]string, len(req.Settings))
+	for key, value := range req.Settings {
+		if multipass.IsSecretSetting(key) {
+			value = "********"
+		}
+		applied[key] = value
+	}
+	host := "the master"
+	if req.AgentID != nil {
+		host = fmt.Sprintf("agent '%s'", *req.AgentID)
+	}
+	session, _ := s.Auth.GetSession(sessionID)
+	logger.InfoContext(c.UserContext(), "Host settings changed", "settings", sortedKeys(applied), "host", host, "user", session.Username)
+
+	response := fiber.Map{
+		"success":  true,
+		"settings": applied,
+	}
+	if _, ok := req.Settings["local.driver"]; ok {
+		response["warning"] = "Changing local.driver restarts the multipass daemon; existing VMs are not migrated"
+	}
+	return c.JSON(response)
+}
+
+// sortedKeys lists the keys of a settings map in order
+func sortedKeys(settings map[string]string) []string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ==================== VM Management Routes ====================
+
+// CreateVM creates a new multipass VM (local or remote)
+func (s *Server) CreateVM(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.VMCreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	result := s.createVM(c.UserContext(), req, session.Username, s.taskProgress(c))
+	if result.saturated != nil {
+		return agentSaturated(c, result.saturated)
+	}
+	if result.failure != nil {
+		return apierror.RespondErr(c, result.status, result.failure)
+	}
+	return c.JSON(result.response)
+}
+
+// CreateVMStream creates a VM like CreateVM but responds with server-sent
+// events: "progress" events as multipass reports launch stages, then one
+// "result" event carrying the HTTP status CreateVM would have returned and
+// its response body.
+func (s *Server) CreateVMStream(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.VMCreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	ctx := c.UserContext()
+	return sse.Stream(c, func(w *sse.Writer) {
+		result := s.createVM(ctx, req, session.Username, func(progress models.LaunchProgress) {
+			w.Event("progress", progress)
+		})
+		response := fiber.Map{"status": result.status}
+		if result.saturated != nil {
+			response["success"] = false
+			response["error"] = apierror.New(503, result.saturated.Error())
+		} else if result.failure != nil {
+			response["success"] = false
+			response["error"] = result.failure
+		}
+		for key, value := range result.response {
+			response[key] = value
+		}
+		w.Event("result", response)
+	})
+}
+
+// createResult is the outcome of creating one VM: the response of a VM that
+// was created, or why it was not
+type createResult struct {
+	status    int
+	response  fiber.Map
+	failure   *models.ErrorResponse
+	saturated *communication.SaturatedError
+}
+
+// createFailed is the outcome of a VM that could not be created
+func createFailed(status int, message string) createResult {
+	failure := apierror.New(status, message)
+	return createResult{status: apierror.Status(status, failure.Code), failure: failure}
+}
+
+// createVM places and launches one VM on behalf of user; it is shared by
+// single, batch and streamed creation. A non-nil progress is called with
+// launch updates.
+func (s *Server) createVM(ctx context.Context, req models.VMCreateRequest, user string, progress func(models.LaunchProgress)) createResult {
+	if req.Template != "" {
+		template := s.Templates.Get(req.Template)
+		if template == nil {
+			return createFailed(400, fmt.Sprintf("Template '%s' not found", req.Template))
+		}
+		req = templates.Apply(template, req)
+	}
+	if req.Image == "" {
+		req.Image = "22.04"
+	}
+	if err := multipass.ValidateNetworks(req.Networks); err != nil {
+		return createFailed(400, err.Error())
+	}
+	if err := multipass.ValidateProvision(req); err != nil {
+		return createFailed(400, err.Error())
+	}
+	extraArgs, err := multipass.ValidateExtraArgs(req.ExtraArgs)
+	if err != nil {
+		return createFailed(400, err.Error())
+	}
+	req.ExtraArgs = extraArgs
+	expiresAt, expiryAction, err := expiry.Resolve(req.TTL, req.ExpiresAt, req.ExpiryAction, time.Now())
+	if err != nil {
+		return createFailed(400, err.Error())
+	}
+	req.TTL, req.ExpiresAt, req.ExpiryAction = "", expiresAt, expiryAction
+
+	// Resolve cloud-init templates on the master so agents only ever see YAML
+	cloudInit, err := cloudinit.Resolve(req.CloudInit)
+	if err != nil {
+		return createFailed(400, err.Error())
+	}
+	req.CloudInit = cloudInit
+
+	req.Constraints = scheduler.Constraints(req)
+	if err := s.checkPlacement(req); err != nil {
+		return createFailed(placementStatus(err), err.Error())
+	}
+
+	// Unplaced VMs go to the default agent while it is online and satisfies
+	// their constraints
+	if req.AgentID == nil {
+		req.AgentID = s.defaultAgent(req.Constraints)
+	}
+
+	// Without multipass on the master, or with constraints only agents can
+	// satisfy, schedule the VM onto an agent
+	if req.AgentID == nil && s.needsAgent(req) {
+		agent, err := s.Scheduler.SelectAgent(req.Constraints)
+		if err != nil {
+			err = s.unplaceable(err)
+			return createFailed(placementStatus(err), err.Error())
+		}
+		agentID := agent.AgentID
+		req.AgentID = &agentID
+	}
+
+	// Get the appropriate executor
+	exec := s.Executors.GetExecutor(req.AgentID)
+
+	// Blueprints bring their own resources and cloud-init, so only plain
+	// images get the default sizing
+	warnings := []string{}
+	blueprint := false
+	if blueprints, err := exec.ListBlueprints(ctx); err == nil {
+		blueprint = multipass.MatchBlueprint(blueprints, req.Image)
+	}
+	if blueprint {
+		if req.CloudInit != "" {
+			req.CloudInit = ""
+			warnings = append(warnings, fmt.Sprintf("cloud-init is ignored for blueprint '%s'", req.Image))
+		}
+	} else {
+		size := s.Defaults.Size()
+		if req.CPUs == 0 {
+			req.CPUs = size.CPUs
+		}
+		if req.Memory == "" {
+			req.Memory = size.Memory
+		}
+		if req.Disk == "" {
+			req.Disk = size.Disk
+		}
+	}
+
+	// Default SSH keys travel in cloud-init, which blueprints do not take
+	if keys := s.Defaults.SSHKeys(); len(keys) > 0 {
+		if blueprint {
+			warnings = append(warnings, fmt.Sprintf("default SSH keys are not added to blueprint '%s'", req.Image))
+		} else if cloudInit, err := cloudinit.AddAuthorizedKeys(req.CloudInit, keys); err != nil {
+			warnings = append(warnings, "default SSH keys were not added: "+err.Error())
+		} else {
+			req.CloudInit = cloudInit
+		}
+	}
+
+	// Explicit placements are honoured during maintenance, but flagged
+	if req.AgentID != nil {
+		if agent := s.Registry.GetAgent(*req.AgentID); agent != nil {
+			if window := s.Maintenance.ActiveWindow(agent); window != nil {
+				warnings = append(warnings, fmt.Sprintf("Agent '%s' is in a maintenance window (%s)", agent.AgentID, window.Description))
+			}
+		}
+	}
+
+	// Count the VM against its owner's and agent's quotas while it is created
+	release, err := s.reserveQuota(ctx, req, user)
+	if err != nil {
+		var exceeded *quotas.ExceededError
+		if errors.As(err, &exceeded) {
+			return createResult{status: 403, failure: quotaExceeded(exceeded)}
+		}
+		return createFailed(400, err.Error())
+	}
+	defer release()
+
+	// Reject concurrent operations on the same VM
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "create")
+	if err != nil {
+		return createFailed(409, err.Error())
+	}
+	defer unlock()
+
+	// Create VM using executor
+	var result *models.OperationResult
+	if progress != nil {
+		for _, warning := range warnings {
+			progress(models.LaunchProgress{Stage: "warning", Message: warning})
+		}
+		result, err = exec.CreateVMWithProgress(ctx, req, progress)
+	} else {
+		result, err = exec.CreateVM(ctx, req)
+	}
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return createResult{status: 503, saturated: saturated}
+	}
+
+	if result.Success {
+		// multipass usually returns once the VM is up, but may report success
+		// while it is still starting
+		state, err := executor.WaitForState(ctx, exec, req.Name, "Running", vmStateTimeout)
+		if err != nil {
+			warnings = append(warnings, err.Error())
+		}
+
+		// Get location info
+		location := exec.GetLocationInfo()
+
+		s.recordCreatedVM(req, user)
+
+		response := fiber.Map{
+			"success":        true,
+			"message":        result.Message,
+			"vm_name":        req.Name,
+			"agent_id":       location["agent_id"],
+			"agent_hostname": location["agent_hostname"],
+			"state":          state,
+		}
+		if blueprint {
+			response["blueprint"] = req.Image
+			response["blueprint_output"] = multipass.BlueprintNotes(result.Message)
+		}
+		if req.ExpiresAt != nil {
+			response["expires_at"] = req.ExpiresAt
+			response["expiry_action"] = req.ExpiryAction
+		}
+		// A failed script leaves the VM in place for inspection, so the
+		// create itself still succeeds
+		if strings.TrimSpace(req.ProvisionScript) != "" {
+			provision := s.provisionVM(ctx, exec, req, progress)
+			response["provision"] = provision
+			if provision.Error != nil {
+				warnings = append(warnings, "Provisioning failed: "+*provision.Error)
+			} else if !provision.Success {
+				warnings = append(warnings, fmt.Sprintf("Provisioning failed with exit code %d", provision.ReturnCode))
+			}
+		}
+		if len(warnings) > 0 {
+			response["warnings"] = warnings
+		}
+		return createResult{status: 200, response: response}
+	}
+
+	message := "Failed to create VM"
+	if result.Message != "" {
+		message = result.Message
+	}
+	return createFailed(500, message)
+}
+
+// vmStateTimeout bounds the wait for a created or started VM to report Running
+const vmStateTimeout = 30 * time.Second
+
+// maxBatchSize caps the number of VMs one batch request may create
+const maxBatchSize = 50
+
+// batchConcurrency caps how many launches of a batch run at once
+const batchConcurrency = 8
+
+// CreateVMBatch creates several VMs concurrently and reports a result per VM.
+// The body is either a JSON array of create requests or an object with "vms",
+// or "count" and "name_prefix" plus the shared create fields.
+func (s *Server) CreateVMBatch(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+	session, _ := s.Auth.GetSession(sessionID)
+
+	var reqs []models.VMCreateRequest
+	if body := bytes.TrimSpace(c.Body()); len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+	} else {
+		var batch models.VMBatchCreateRequest
+		if err := c.BodyParser(&batch); err != nil {
+			return apierror.Respond(c, 400, "Invalid request")
+		}
+		reqs = batch.VMs
+		if len(reqs) == 0 && batch.Count > 0 {
+			if batch.NamePrefix == "" {
+				return apierror.Respond(c, 400, "name_prefix is required with count")
+			}
+			if batch.Count > maxBatchSize {
+				return apierror.Respond(c, 400, fmt.Sprintf("a batch may create at most %d VMs", maxBatchSize))
+			}
+			for i := 1; i <= batch.Count; i++ {
+				req := batch.VMCreateRequest
+				req.Name = fmt.Sprintf("%s-%d", batch.NamePrefix, i)
+				reqs = append(reqs, req)
+			}
+		}
+	}
+
+	if err := validateBatch(reqs); err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+	if err := s.placeBatch(reqs); err != nil {
+		return apierror.RespondErr(c, placementStatus(err), err)
+	}
+
+	results, succeeded := s.createVMs(c.UserContext(), reqs, session.Username)
+
+	return c.JSON(fiber.Map{
+		"success":   succeeded == len(results),
+		"succeeded": succeeded,
+		"failed":    len(results) - succeeded,
+		"results":   results,
+	})
+}
+
+// provisionVM runs a create request's provisioning script once the VM is
+// running. With a non-nil progress, each line the script prints is reported
+// as a "provision" update while it runs.
+func (s *Server) provisionVM(ctx context.Context, exec executor.VMExecutor, req models.VMCreateRequest, progress func(models.LaunchProgress)) models.RemoteCommandResponse {
+	detail, err := exec.GetVMInfo(ctx, req.Name)
+	if err == nil && detail.State != "Running" {
+		err = fmt.Errorf("VM is %s", detail.State)
+	}
+	if err != nil {
+		message := err.Error() + ", so the script was not run"
+		return models.RemoteCommandResponse{Success: false, ReturnCode: -1, Error: &message}
+	}
+
+	execReq := multipass.ProvisionRequest(req)
+	if progress == nil {
+		return exec.ExecInVM(ctx, execReq)
+	}
+
+	progress(models.LaunchProgress{Stage: "provisioning", Message: "Running provision script"})
+	lines := multipass.NewLineWriter(func(line string) {
+		progress(models.LaunchProgress{Stage: "provision", Message: line})
+	})
+	result := exec.ExecInVMStream(ctx, execReq, lines)
+	lines.Close()
+	return result
+}
+
+// validateBatch checks that a batch is within size and names its VMs uniquely
+func validateBatch(reqs []models.VMCreateRequest) error {
+	if len(reqs) == 0 {
+		return fmt.Errorf("no VMs to create")
+	}
+	if len(reqs) > maxBatchSize {
+		return fmt.Errorf("a batch may create at most %d VMs", maxBatchSize)
+	}
+
+	seen := make(map[string]bool)
+	for _, req := range reqs {
+		if req.Name == "" {
+			return fmt.Errorf("every VM needs a name")
+		}
+		if seen[inventory.Key(req.AgentID)+"/"+req.Name] {
+			return fmt.Errorf("duplicate VM name in batch: %s", req.Name)
+		}
+		seen[inventory.Key(req.AgentID)+"/"+req.Name] = true
+	}
+	return nil
+}
+
+// placeBatch assigns agents to the VMs of a batch that have no placement.
+// They are spread across agents up front; scheduling them one at a time would
+// put them all on the same least-loaded agent.
+func (s *Server) placeBatch(reqs []models.VMCreateRequest) error {
+	unplaced := []int{}
+	for i := range reqs {
+		reqs[i].Constraints = scheduler.Constraints(reqs[i])
+		if err := s.checkPlacement(reqs[i]); err != nil {
+			return err
+		}
+		if reqs[i].AgentID == nil {
+			reqs[i].AgentID = s.defaultAgent(reqs[i].Constraints)
+		}
+		if reqs[i].AgentID == nil && s.needsAgent(reqs[i]) {
+			unplaced = append(unplaced, i)
+		}
+	}
+	if len(unplaced) == 0 {
+		return nil
+	}
+
+	constraints := make([]map[string]string, len(unplaced))
+	for n, i := range unplaced {
+		constraints[n] = reqs[i].Constraints
+	}
+	placements, err := s.Scheduler.SelectAgents(constraints)
+	if err != nil {
+		return s.unplaceable(err)
+	}
+	for n, i := range unplaced {
+		agentID := placements[n].AgentID
+		reqs[i].AgentID = &agentID
+	}
+	return nil
+}
+
+// needsAgent reports whether an unplaced VM must be scheduled onto an agent:
+// the master has no multipass, or the VM has constraints, which only agent
+// tags can satisfy
+func (s *Server) needsAgent(req models.VMCreateRequest) bool {
+	return !s.Executors.LocalEnabled() || len(req.Constraints) > 0
+}
+
+// checkPlacement verifies that a VM placed on a specific agent may go there:
+// the agent is not draining and satisfies the VM's constraints. Unknown agents
+// are left for the executor to report.
+func (s *Server) checkPlacement(req models.VMCreateRequest) error {
+	if req.AgentID == nil {
+		return nil
+	}
+	agent := s.Registry.GetAgent(*req.AgentID)
+	if agent == nil {
+		return nil
+	}
+	if agent.Draining {
+		return &drainingError{agentID: agent.AgentID}
+	}
+	if !scheduler.Satisfies(agent, req.Constraints) {
+		return &scheduler.UnsatisfiedError{AgentID: agent.AgentID, Constraints: req.Constraints}
+	}
+	return nil
+}
+
+// drainingError is returned for a VM placed on a draining agent
+type drainingError struct {
+	agentID string
+}
+
+func (e *drainingError) Error() string {
+	return fmt.Sprintf("Agent '%s' is draining and does not accept new VMs", e.agentID)
+}
+
+// unplaceable explains why the scheduler could not place a VM
+func (s *Server) unplaceable(err error) error {
+	if errors.Is(err, scheduler.ErrNoAgentAvailable) && !s.Executors.LocalEnabled() {
+		return fmt.Errorf("Multipass is not installed on the master and %w", err)
+	}
+	return err
+}
+
+// placementStatus is the status for a VM that could not be placed: 409 when
+// no agent satisfies its constraints or its agent is draining, 503 when no
+// agent is available at all
+func placementStatus(err error) int {
+	var unsatisfied *scheduler.UnsatisfiedError
+	var draining *drainingError
+	if errors.As(err, &unsatisfied) || errors.As(err, &draining) {
+		return 409
+	}
+	return 503
+}
+
+// createVMs launches the VMs of a batch concurrently on behalf of user and
+// reports a result per VM, in order, along with how many succeeded
+func (s *Server) createVMs(ctx context.Context, reqs []models.VMCreateRequest, user string) ([]fiber.Map, int) {
+	results := make([]fiber.Map, len(reqs))
+	semaphore := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		go func(i int, req models.VMCreateRequest) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			result := s.createVM(ctx, req, user, nil)
+			entry := fiber.Map{
+				"name":   req.Name,
+				"status": result.status,
+			}
+			for key, value := range result.response {
+				entry[key] = value
+			}
+			if result.saturated != nil {
+				entry["error"] = apierror.New(503, result.saturated.Error())
+			} else if result.failure != nil {
+				entry["error"] = result.failure
+			}
+			if _, ok := entry["success"]; !ok {
+				entry["success"] = false
+			}
+			results[i] = entry
+		}(i, req)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, result := range results {
+		if result["status"] == 200 {
+			succeeded++
+		}
+	}
+	return results, succeeded
+}
+
+// vmKey identifies a VM across hosts, as executor.UsageKey does
+func vmKey(vm models.VMInfoExtended) string {
+	if vm.AgentID == nil {
+		return executor.UsageKey("", vm.Name)
+	}
+	return executor.UsageKey(*vm.AgentID, vm.Name)
+}
+
+// ListVMs lists all multipass VMs (from local and all agents). Users other
+// than admins only see the VMs they own or that are shared with them. The
+// list is filtered by state, agent_id and label, sorted and paged as
+// inventory.ParseQuery reads them, with the number of matching VMs in total.
+func (s *Server) ListVMs(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	query, err := inventory.ParseQuery(func(key string) string { return c.Query(key) }, inventory.VMSortFields)
+	if err != nil {
+		return apierror.Respond(c, 400, err.Error())
+	}
+
+	// Listings come from the inventory cache; ?refresh=true queries every
+	// host live instead
+	refresh := c.QueryBool("refresh", false)
+
+	// Utilization needs `multipass info` on every host; ?usage=false skips it.
+	// It is gathered alongside the listing so slow hosts are waited on once.
+	var usage map[string]models.VMInfoExtended
+	wantUsage, ctx := c.QueryBool("usage", true), c.UserContext()
+	usageDone := make(chan struct{})
+	go func() {
+		defer close(usageDone)
+		if wantUsage {
+			usage = s.Executors.UsageByVM(ctx, refresh)
+		}
+	}()
+	vms, hosts := s.Executors.ListAllVMsByHost(ctx, refresh)
+	<-usageDone
+
+	session, _ := s.Auth.GetSession(sessionID)
+	admin := s.Auth.IsAdmin(sessionID)
+	allVMs := []models.VMListing{}
+	for _, vm := range vms {
+		agentID := ""
+		if vm.AgentID != nil {
+			agentID = *vm.AgentID
+		}
+		meta := s.Metadata.Get(agentID, vm.Name)
+		if !s.Policy.CanAccessVM(session.Username, admin, meta) {
+			continue
+		}
+		if vmUsage, ok := usage[vmKey(vm)]; ok {
+			vm.CPUCount = vmUsage.CPUCount
+			vm.Load = vmUsage.Load
+			vm.DiskUsage = vmUsage.DiskUsage
+			vm.MemoryUsage = vmUsage.MemoryUsage
+		}
+		allVMs = append(allVMs, models.VMListing{VMInfoExtended: vm, Metadata: meta})
+	}
+
+	list, total := query.VMs(allVMs)
+	c.Set(totalCountHeader, strconv.Itoa(total))
+	return c.JSON(fiber.Map{
+		"success": true,
+		"vms":     list,
+		"hosts":   hosts,
+		"total":   total,
+		"limit":   query.Limit,
+		"offset":  query.Offset,
+	})
+}
+
+// GetVMInfo gets detailed info about a specific VM
+func (s *Server) GetVMInfo(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	vmName := c.Params("vm_name")
+	agentID := c.Query("agent_id")
+	if !s.canAccessVM(sessionID, agentID, vmName) {
+		return vmNotAccessible(c, vmName)
+	}
+
+	// Create executor based on agent_id
+	var vmExecutor executor.VMExecutor
+	if agentID != "" {
+		logger.DebugContext(c.UserContext(), "Getting VM info", "vm", vmName, "agent_id", agentID)
+		vmExecutor = s.Executors.GetExecutor(&agentID)
+	} else {
+		logger.DebugContext(c.UserContext(), "Getting local VM info", "vm", vmName)
+		vmExecutor = s.Executors.GetExecutor(nil)
+	}
+
+	detail, err := vmExecutor.GetVMInfo(c.UserContext(), vmName)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		logger.ErrorContext(c.UserContext(), "Error getting VM info", "vm", vmName, "error", err)
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	return c.JSON(models.VMInfo{VMDetail: detail, Metadata: s.Metadata.Get(agentID, vmName)})
+}
+
+// GetVMConnection reports a VM's addresses and an ssh command to reach it.
+// IPv6 addresses are looked up inside running VMs; a VM on an agent is only
+// reachable from the agent's network, so its command jumps through the agent.
+func (s *Server) GetVMConnection(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	vmName := c.Params("vm_name")
+	if !s.canAccessVM(sessionID, c.Query("agent_id"), vmName) {
+		return vmNotAccessible(c, vmName)
+	}
+	var agentID *string
+	if id := c.Query("agent_id"); id != "" {
+		agentID = &id
+	}
+	user := c.Query("user", multipass.DefaultUser())
+	if !multipass.ValidUser(user) {
+		return apierror.Respond(c, 400, fmt.Sprintf("invalid user: %q", user))
+	}
+
+	var agent *models.AgentInfo
+	if agentID != nil {
+		if agent = s.Registry.GetAgent(*agentID); agent == nil {
+			return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", *agentID))
+		}
+	}
+
+	exec := s.Executors.GetExecutor(agentID)
+	detail, err := exec.GetVMInfo(c.UserContext(), vmName)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	conn := models.VMConnection{
+		Name:         vmName,
+		State:        detail.State,
+		AgentID:      agentID,
+		IPv4:         detail.IPv4,
+		IPv6:         []string{},
+		User:         user,
+		Reachability: "Addresses are on the master's network",
+	}
+	if conn.IPv4 == nil {
+		conn.IPv4 = []string{}
+	}
+	if detail.State == "Running" {
+		// Best effort: images without iproute2 simply report no IPv6
+		if result := exec.ExecInVM(c.UserContext(), multipass.IPv6Request(vmName)); result.Success && result.Stdout != nil {
+			conn.IPv6 = multipass.ParseIPv6(*result.Stdout)
+		}
+	}
+	if agent != nil {
+		conn.JumpHost = agentHost(agent)
+		conn.Reachability = fmt.Sprintf("Addresses are on the network of agent '%s' (%s); connect from that host or jump through it", agent.AgentID, agent.Hostname)
+	}
+
+	switch {
+	case len(conn.IPv4) > 0:
+		conn.SSHCommand = multipass.SSHCommand(user, conn.IPv4[0], conn.JumpHost)
+	case len(conn.IPv6) > 0:
+		conn.SSHCommand = multipass.SSHCommand(user, conn.IPv6[0], conn.JumpHost)
+	default:
+		conn.Reachability = "The VM has no address; it may be stopped or still booting"
+	}
+
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"connection": conn,
+	})
+}
+
+// agentHost is the address an agent is reached at, taken from its API URL
+func agentHost(agent *models.AgentInfo) string {
+	if parsed, err := url.Parse(agent.APIURL); err == nil && parsed.Hostname() != "" {
+		return parsed.Hostname()
+	}
+	return agent.Hostname
+}
+
+// AuthorizeKey appends a public key to a user's ~/.ssh/authorized_keys in a
+// running VM, so the key's owner can ssh in directly
+func (s *Server) AuthorizeKey(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.AuthorizeKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	key, err := multipass.ValidatePublicKey(req.PublicKey)
+	if err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+	if req.User == "" {
+		req.User = multipass.DefaultUser()
+	}
+	if !multipass.ValidUser(req.User) {
+		return apierror.Respond(c, 400, fmt.Sprintf("invalid user: %q", req.User))
+	}
+
+	vmName := c.Params("vm_name")
+	result := s.Executors.GetExecutor(req.AgentID).ExecInVM(c.UserContext(), multipass.AuthorizeKeyRequest(vmName, req.User, key))
+	if !result.Success {
+		return apierror.Respond(c, 500, execFailure(result, "Failed to authorize key"))
+	}
+
+	message := fmt.Sprintf("Key authorized for %s on VM '%s'", req.User, vmName)
+	if result.Stdout != nil && strings.Contains(*result.Stdout, "already authorized") {
+		message = fmt.Sprintf("Key was already authorized for %s on VM '%s'", req.User, vmName)
+	}
+	session, _ := s.Auth.GetSession(sessionID)
+	logger.InfoContext(c.UserContext(), "SSH key authorized", "key", keyComment(key), "guest_user", req.User, "vm", vmName, "user", session.Username)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": message,
+		"user":    req.User,
+	})
+}
+
+// keyComment names a public key in logs by its comment, or its type
+func keyComment(key string) string {
+	fields := strings.Fields(key)
+	if len(fields) > 2 {
+		return strings.Join(fields[2:], " ")
+	}
+	return fields[0]
+}
+
+// ForwardPort forwards a TCP port of the host running a VM, the master or an
+// agent, to a port inside the VM
+func (s *Server) ForwardPort(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.PortForwardRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	// The forward outlives the request, so it cannot share fiber's buffer
+	req.Name = utils.CopyString(c.Params("vm_name"))
+
+	var agent *models.AgentInfo
+	if req.AgentID != nil {
+		if agent = s.Registry.GetAgent(*req.AgentID); agent == nil {
+			return apierror.Respond(c, 404, fmt.Sprintf("Agent '%s' not found", *req.AgentID))
+		}
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	req.CreatedBy = session.Username
+	forwarded, err := s.Executors.GetExecutor(req.AgentID).ForwardPort(c.UserContext(), req)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+	forwarded.AgentID = req.AgentID
+
+	// Point the caller at the host the forward listens on
+	host := forwarded.HostAddress
+	if host == "0.0.0.0" || host == "::" || host == "" {
+		if agent != nil {
+			host = agentHost(agent)
+		} else {
+			host = c.Hostname()
+			if name, _, err := net.SplitHostPort(host); err == nil {
+				host = name
+			}
+		}
+	}
+
+	logger.InfoContext(c.UserContext(), "Port forwarded", "host_port", forwarded.HostPort, "vm", req.Name, "guest_port", req.GuestPort, "user", session.Username)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"forward": forwarded,
+		"address": net.JoinHostPort(host, strconv.Itoa(forwarded.HostPort)),
+	})
+}
+
+// ListForwards lists port forwards on the master and every online agent, or
+// on the agent given by agent_id. Admins see every forward, other users the
+// ones they created.
+func (s *Server) ListForwards(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	hosts := []*string{}
+	if id := c.Query("agent_id"); id != "" {
+		hosts = append(hosts, &id)
+	} else {
+		if s.Executors.LocalEnabled() {
+			hosts = append(hosts, nil)
+		}
+		for _, agent := range s.Registry.GetOnlineAgents() {
+			agentID := agent.AgentID
+			hosts = append(hosts, &agentID)
+		}
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	admin := s.Auth.IsAdmin(sessionID)
+	forwards := []models.PortForward{}
+	failures := fiber.Map{}
+	for _, agentID := range hosts {
+		list, err := s.Executors.GetExecutor(agentID).ListForwards(c.UserContext())
+		if err != nil {
+			host := "local"
+			if agentID != nil {
+				host = *agentID
+			}
+			failures[host] = err.Error()
+			continue
+		}
+		for _, forwarded := range list {
+			if !admin && forwarded.CreatedBy != session.Username {
+				continue
+			}
+			forwarded.AgentID = agentID
+			forwards = append(forwards, forwarded)
+		}
+	}
+
+	response := fiber.Map{
+		"success":  true,
+		"forwards": forwards,
+	}
+	if len(failures) > 0 {
+		response["errors"] = failures
+	}
+	return c.JSON(response)
+}
+
+// RemoveForward stops a port forward on the master, or on the agent given by
+// agent_id. Only its creator or an admin may remove it.
+func (s *Server) RemoveForward(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var agentID *string
+	if id := c.Query("agent_id"); id != "" {
+		agentID = &id
+	}
+	id := c.Params("id")
+
+	exec := s.Executors.GetExecutor(agentID)
+	list, err := exec.ListForwards(c.UserContext())
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+	var found *models.PortForward
+	for i := range list {
+		if list[i].ID == id {
+			found = &list[i]
+		}
+	}
+	if found == nil {
+		return apierror.Respond(c, 404, fmt.Sprintf("Port forward '%s' not found", id))
+	}
+	session, _ := s.Auth.GetSession(sessionID)
+	if found.CreatedBy != session.Username && !s.Auth.IsAdmin(sessionID) {
+		return apierror.Respond(c, 403, "Only the forward's creator or an admin can remove it")
+	}
+
+	if err := exec.RemoveForward(c.UserContext(), id); err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("Port forward %d to '%s' removed", found.HostPort, found.VMName),
+	})
+}
+
+// UpdateVMMetadata changes a VM's owner, project, description, labels or expiry.
+// Only the VM's owner or an admin may edit it, and only an admin may hand
+// the VM to another owner.
+func (s *Server) UpdateVMMetadata(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.VMMetadataRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if req.Name == "" {
+		return apierror.Respond(c, 400, "name is required")
+	}
+
+	agentID := ""
+	if req.AgentID != nil {
+		agentID = *req.AgentID
+	}
+	session, _ := s.Auth.GetSession(sessionID)
+	admin := s.Auth.IsAdmin(sessionID)
+	if existing := s.Metadata.Get(agentID, req.Name); !admin && existing != nil && existing.Owner != "" && existing.Owner != session.Username {
+		return apierror.Respond(c, 403, "Only the VM's owner or an admin can change its metadata")
+	}
+	if !admin && req.Owner != nil && *req.Owner != session.Username {
+		return apierror.Respond(c, 403, "Admin privileges required to change the owner")
+	}
+
+	// A TTL of "0" cancels expiry; otherwise a TTL or time reschedules it
+	cancelExpiry := req.TTL == "0"
+	var expiresAt *time.Time
+	expiryAction := ""
+	if !cancelExpiry && (req.TTL != "" || req.ExpiresAt != nil || req.ExpiryAction != "") {
+		var err error
+		expiresAt, expiryAction, err = expiry.Resolve(req.TTL, req.ExpiresAt, req.ExpiryAction, time.Now())
+		if err != nil {
+			return apierror.RespondErr(c, 400, err)
+		}
+	}
+
+	meta := s.Metadata.Update(agentID, req.Name, func(meta *models.VMMetadata) {
+		if req.Owner != nil {
+			meta.Owner = *req.Owner
+		}
+		if req.Project != nil {
+			meta.Project = *req.Project
+		}
+		if req.Description != nil {
+			meta.Description = *req.Description
+		}
+		switch {
+		case cancelExpiry:
+			meta.ExpiresAt = nil
+			meta.ExpiryAction = ""
+		case expiresAt != nil:
+			meta.ExpiresAt = expiresAt
+			meta.ExpiryAction = expiryAction
+		case expiryAction != "" && meta.ExpiresAt != nil:
+			meta.ExpiryAction = expiryAction
+		}
+		for key, value := range req.Labels {
+			if value == "" {
+				delete(meta.Labels, key)
+				continue
+			}
+			if meta.Labels == nil {
+				meta.Labels = make(map[string]string)
+			}
+			meta.Labels[key] = value
+		}
+	})
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"metadata": meta,
+	})
+}
+
+// recordCreatedVM stores the metadata of a VM user has just created
+func (s *Server) recordCreatedVM(req models.VMCreateRequest, user string) {
+	agentID := ""
+	if req.AgentID != nil {
+		agentID = *req.AgentID
+	}
+	now := time.Now()
+	meta := &models.VMMetadata{
+		AgentID:     agentID,
+		Name:        req.Name,
+		Owner:       user,
+		Project:     req.Project,
+		Description: req.Description,
+		Labels:      req.Labels,
+		Source:      "created",
+		CreatedBy:   user,
+		CreatedAt:   &now,
+	}
+	if req.ExpiresAt != nil {
+		meta.ExpiresAt = req.ExpiresAt
+		meta.ExpiryAction = req.ExpiryAction
+	}
+	s.Metadata.Set(meta)
+}
+
+// recordClonedVM stores the metadata of a clone user has just made. The clone
+// keeps the source's project, description and labels but belongs to user and
+// is not shared with anyone.
+func (s *Server) recordClonedVM(req models.VMCloneRequest, clone, user string) {
+	agentID := ""
+	if req.AgentID != nil {
+		agentID = *req.AgentID
+	}
+	now := time.Now()
+	meta := &models.VMMetadata{
+		AgentID:   agentID,
+		Name:      clone,
+		Owner:     user,
+		Source:    "cloned",
+		CreatedBy: user,
+		CreatedAt: &now,
+	}
+	if source := s.Metadata.Get(agentID, req.Name); source != nil {
+		meta.Project = source.Project
+		meta.Description = source.Description
+		meta.Labels = make(map[string]string, len(source.Labels))
+		for key, value := range source.Labels {
+			meta.Labels[key] = value
+		}
+	}
+	s.Metadata.Set(meta)
+}
+
+// forgetVM drops the metadata of a VM that no longer exists
+func (s *Server) forgetVM(agentID *string, vmName string) {
+	key := ""
+	if agentID != nil {
+		key = *agentID
+	}
+	s.Metadata.Delete(key, vmName)
+	s.Defaults.ForgetVM(agentID, vmName)
+}
+
+// canAccessVM reports whether the session's user may see and act on a VM
+func (s *Server) canAccessVM(sessionID, agentID, vmName string) bool {
+	session, exists := s.Auth.GetSession(sessionID)
+	if !exists {
+		return false
+	}
+	return s.Policy.CanAccessVM(session.Username, s.Auth.IsAdmin(sessionID), s.Metadata.Get(agentID, vmName))
+}
+
+// vmNotAccessible responds to a request for a VM that is neither the user's
+// nor shared with them
+func vmNotAccessible(c *fiber.Ctx, vmName string) error {
+	return apierror.Respond(c, 403, fmt.Sprintf("VM '%s' is neither yours nor shared with you", vmName))
+}
+
+// ==================== VM Sharing Routes ====================
+
+// ShareVM grants another user access to a VM: they see it and may act on it
+// as its owner does, but cannot share it further or change its metadata. Only
+// the VM's owner or an admin may share it.
+func (s *Server) ShareVM(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.VMShareRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if req.Username == "" {
+		return apierror.Respond(c, 400, "username is required")
+	}
+	if !s.Auth.HasUser(req.Username) {
+		return apierror.Respond(c, 404, fmt.Sprintf("User '%s' not found", req.Username))
+	}
+
+	vmName := utils.CopyString(c.Params("vm_name"))
+	agentID := ""
+	if req.AgentID != nil {
+		agentID = *req.AgentID
+	}
+	session, _ := s.Auth.GetSession(sessionID)
+	existing := s.Metadata.Get(agentID, vmName)
+	if !s.Auth.IsAdmin(sessionID) && (existing == nil || existing.Owner != session.Username) {
+		return apierror.Respond(c, 403, "Only the VM's owner or an admin can share it")
+	}
+	if existing != nil && existing.Owner == req.Username {
+		return apierror.Respond(c, 400, fmt.Sprintf("User '%s' already owns VM '%s'", req.Username, vmName))
+	}
+
+	meta := s.Metadata.Update(agentID, vmName, func(meta *models.VMMetadata) {
+		for _, shared := range meta.SharedWith {
+			if shared == req.Username {
+				return
+			}
+		}
+		meta.SharedWith = append(meta.SharedWith, req.Username)
+		sort.Strings(meta.SharedWith)
+	})
+
+	s.Bus.Publish(models.Event{Type: "vm.shared", AgentID: agentID, VMName: vmName, Data: map[string]string{"username": req.Username, "by": session.Username}})
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"message":  fmt.Sprintf("VM '%s' shared with %s", vmName, req.Username),
+		"metadata": meta,
+	})
+}
+
+// UnshareVM revokes a user's access to a VM shared with them. The VM's owner
+// or an admin may revoke anyone's access; a user may also give up their own.
+func (s *Server) UnshareVM(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	vmName := utils.CopyString(c.Params("vm_name"))
+	username := utils.CopyString(c.Params("username"))
+	agentID := utils.CopyString(c.Query("agent_id"))
+	session, _ := s.Auth.GetSession(sessionID)
+	existing := s.Metadata.Get(agentID, vmName)
+	owner := existing != nil && existing.Owner == session.Username
+	if !s.Auth.IsAdmin(sessionID) && !owner && username != session.Username {
+		return apierror.Respond(c, 403, "Only the VM's owner or an admin can revoke access to it")
+	}
+
+	shared := false
+	if existing != nil {
+		for _, user := range existing.SharedWith {
+			shared = shared || user == username
+		}
+	}
+	if !shared {
+		return apierror.Respond(c, 404, fmt.Sprintf("VM '%s' is not shared with %s", vmName, username))
+	}
+
+	meta := s.Metadata.Update(agentID, vmName, func(meta *models.VMMetadata) {
+		kept := []string{}
+		for _, user := range meta.SharedWith {
+			if user != username {
+				kept = append(kept, user)
 			}
 		}
+		meta.SharedWith = kept
+	})
+
+	s.Bus.Publish(models.Event{Type: "vm.unshared", AgentID: agentID, VMName: vmName, Data: map[string]string{"username": username, "by": session.Username}})
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"message":  fmt.Sprintf("VM '%s' is no longer shared with %s", vmName, username),
+		"metadata": meta,
+	})
+}
+
+// StartVM starts a stopped VM
+func (s *Server) StartVM(c *fiber.Ctx) error {
+	var req models.VMActionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "start")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+	defer unlock()
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.StartVM(c.UserContext(), req.Name)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+
+	if result.Success {
+		message := fmt.Sprintf("VM '%s' started", req.Name)
+		if result.Message != "" {
+			message = result.Message
+		}
+		response := fiber.Map{
+			"success": true,
+			"message": message,
+		}
+		state, err := executor.WaitForState(c.UserContext(), exec, req.Name, "Running", vmStateTimeout)
+		response["state"] = state
+		if err != nil {
+			response["warnings"] = []string{err.Error()}
+		}
+		return c.JSON(response)
+	}
+
+	message := "Failed to start VM"
+	if result.Message != "" {
+		message = result.Message
+	}
+	return apierror.Respond(c, 500, message)
+}
+
+// StopVM stops a running VM
+func (s *Server) StopVM(c *fiber.Ctx) error {
+	var req models.VMActionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if req.DelayMinutes < 0 {
+		return apierror.Respond(c, 400, "delay_minutes cannot be negative")
+	}
+
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "stop")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+	defer unlock()
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.StopVM(c.UserContext(), req.Name, req.DelayMinutes)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+
+	if result.Success {
+		message := fmt.Sprintf("VM '%s' stopped", req.Name)
+		if req.DelayMinutes > 0 {
+			message = fmt.Sprintf("VM '%s' will stop in %d minutes", req.Name, req.DelayMinutes)
+		} else if result.Message != "" {
+			message = result.Message
+		}
+		return c.JSON(fiber.Map{
+			"success":       true,
+			"message":       message,
+			"delay_minutes": req.DelayMinutes,
+		})
+	}
+
+	message := "Failed to stop VM"
+	if result.Message != "" {
+		message = result.Message
+	}
+	return apierror.Respond(c, 500, message)
+}
+
+// CancelStopVM cancels a delayed stop scheduled with delay_minutes
+func (s *Server) CancelStopVM(c *fiber.Ctx) error {
+	var req models.VMActionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "stop")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+	defer unlock()
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.CancelStopVM(c.UserContext(), req.Name)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+
+	if result.Success {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": fmt.Sprintf("Scheduled stop of VM '%s' cancelled", req.Name),
+		})
+	}
+
+	message := "Failed to cancel VM stop"
+	if result.Message != "" {
+		message = result.Message
+	}
+	return apierror.Respond(c, 500, message)
+}
+
+// SuspendVM suspends a running VM
+func (s *Server) SuspendVM(c *fiber.Ctx) error {
+	var req models.VMActionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "suspend")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+	defer unlock()
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.SuspendVM(c.UserContext(), req.Name)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+
+	if result.Success {
+		message := fmt.Sprintf("VM '%s' suspended", req.Name)
+		if result.Message != "" {
+			message = result.Message
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": message,
+		})
+	}
+
+	message := "Failed to suspend VM"
+	if result.Message != "" {
+		message = result.Message
+	}
+	return apierror.Respond(c, 500, message)
+}
+
+// ResumeVM resumes a suspended VM
+func (s *Server) ResumeVM(c *fiber.Ctx) error {
+	var req models.VMActionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "resume")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+	defer unlock()
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.ResumeVM(c.UserContext(), req.Name)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+
+	if result.Success {
+		message := fmt.Sprintf("VM '%s' resumed", req.Name)
+		if result.Message != "" {
+			message = result.Message
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": message,
+		})
+	}
+
+	message := "Failed to resume VM"
+	if result.Message != "" {
+		message = result.Message
+	}
+	return apierror.Respond(c, 500, message)
+}
+
+// RestartVM restarts a VM, optionally forcing a stop and start
+func (s *Server) RestartVM(c *fiber.Ctx) error {
+	var req models.VMActionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "restart")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+	defer unlock()
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.RestartVM(c.UserContext(), req.Name, req.Force)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+
+	if result.Success {
+		message := fmt.Sprintf("VM '%s' restarted", req.Name)
+		if result.Message != "" {
+			message = result.Message
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": message,
+		})
+	}
+
+	message := "Failed to restart VM"
+	if result.Message != "" {
+		message = result.Message
+	}
+	return apierror.Respond(c, 500, message)
+}
+
+// DeleteVM deletes a VM
+func (s *Server) DeleteVM(c *fiber.Ctx) error {
+	var req models.VMActionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "delete")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+	defer unlock()
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.DeleteVM(c.UserContext(), req.Name, req.SoftDelete)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+
+	if result.Success {
+		if !req.SoftDelete {
+			s.forgetVM(req.AgentID, req.Name)
+		}
+		message := fmt.Sprintf("VM '%s' deleted", req.Name)
+		if result.Message != "" {
+			message = result.Message
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": message,
+		})
 	}
 
-	// If the structure doesn't match, return the result as is
-	return c.JSON(result)
+	message := "Failed to delete VM"
+	if result.Message != "" {
+		message = result.Message
+	}
+	return apierror.Respond(c, 500, message)
 }
 
-// StartVM starts a stopped VM
-func StartVM(c *fiber.Ctx) error {
-	sessionID := c.Cookies("session_id")
-	if !auth.CheckAuth(sessionID) {
-		return c.Status(401).JSON(fiber.Map{"detail": "Not authenticated"})
+// RecoverVM recovers a soft-deleted VM
+func (s *Server) RecoverVM(c *fiber.Ctx) error {
+	var req models.VMActionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "recover")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+	defer unlock()
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.RecoverVM(c.UserContext(), req.Name)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+
+	if result.Success {
+		message := fmt.Sprintf("VM '%s' recovered", req.Name)
+		if result.Message != "" {
+			message = result.Message
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": message,
+		})
+	}
+
+	message := "Failed to recover VM"
+	if result.Message != "" {
+		message = result.Message
 	}
+	return apierror.Respond(c, 500, message)
+}
 
+// PurgeVM permanently removes a soft-deleted VM
+func (s *Server) PurgeVM(c *fiber.Ctx) error {
 	var req models.VMActionRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return apierror.Respond(c, 400, "Invalid request")
 	}
 
-	exec := executor.GlobalExecutorFactory.GetExecutor(req.AgentID)
-	result, _ := exec.StartVM(req.Name)
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "purge")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+	defer unlock()
 
-	if success, ok := result["success"].(bool); ok && success {
-		time.Sleep(2 * time.Second)
-		message := fmt.Sprintf("VM '%s' started", req.Name)
-		if msg, ok := result["message"].(string); ok && msg != "" {
-			message = msg
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.PurgeVM(c.UserContext(), req.Name)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+
+	if result.Success {
+		s.forgetVM(req.AgentID, req.Name)
+		message := fmt.Sprintf("VM '%s' purged", req.Name)
+		if result.Message != "" {
+			message = result.Message
 		}
 		return c.JSON(fiber.Map{
 			"success": true,
@@ -390,75 +4511,702 @@ func StartVM(c *fiber.Ctx) error {
 		})
 	}
 
-	message := "Failed to start VM"
-	if msg, ok := result["message"].(string); ok {
-		message = msg
+	message := "Failed to purge VM"
+	if result.Message != "" {
+		message = result.Message
 	}
-	return c.Status(500).JSON(fiber.Map{"detail": message})
+	return apierror.Respond(c, 500, message)
 }
 
-// StopVM stops a running VM
-func StopVM(c *fiber.Ctx) error {
-	sessionID := c.Cookies("session_id")
-	if !auth.CheckAuth(sessionID) {
-		return c.Status(401).JSON(fiber.Map{"detail": "Not authenticated"})
+// bulkActions are the actions accepted by BulkVMAction
+var bulkActions = map[string]bool{
+	"start":   true,
+	"stop":    true,
+	"suspend": true,
+	"resume":  true,
+	"restart": true,
+	"delete":  true,
+	"recover": true,
+	"purge":   true,
+}
+
+// runVMAction runs a lifecycle action through an executor
+func runVMAction(ctx context.Context, exec executor.VMExecutor, action string, req models.VMActionRequest) (*models.OperationResult, error) {
+	switch action {
+	case "start":
+		return exec.StartVM(ctx, req.Name)
+	case "stop":
+		return exec.StopVM(ctx, req.Name, req.DelayMinutes)
+	case "suspend":
+		return exec.SuspendVM(ctx, req.Name)
+	case "resume":
+		return exec.ResumeVM(ctx, req.Name)
+	case "restart":
+		return exec.RestartVM(ctx, req.Name, req.Force)
+	case "delete":
+		return exec.DeleteVM(ctx, req.Name, req.SoftDelete)
+	case "recover":
+		return exec.RecoverVM(ctx, req.Name)
+	case "purge":
+		return exec.PurgeVM(ctx, req.Name)
 	}
+	err := fmt.Errorf("unknown action %q", action)
+	return &models.OperationResult{Success: false, Message: err.Error()}, err
+}
 
-	var req models.VMActionRequest
+// BulkVMAction applies one lifecycle action to a list of VMs concurrently and
+// reports the outcome of each. Every target is authorized and locked on its
+// own, so one denied or busy VM does not stop the rest.
+func (s *Server) BulkVMAction(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.VMBulkRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if !bulkActions[req.Action] {
+		return apierror.Respond(c, 400, fmt.Sprintf("Unsupported bulk action: %q", req.Action))
+	}
+	if len(req.Targets) == 0 {
+		return apierror.Respond(c, 400, "no targets given")
+	}
+	if len(req.Targets) > maxBatchSize {
+		return apierror.Respond(c, 400, fmt.Sprintf("a bulk request may target at most %d VMs", maxBatchSize))
+	}
+
+	session, _ := s.Auth.GetSession(sessionID)
+	for i := range req.Targets {
+		req.Targets[i].Force = req.Targets[i].Force || req.Force
+		req.Targets[i].SoftDelete = req.Targets[i].SoftDelete || req.SoftDelete
 	}
+	results, succeeded := s.runBulk(c, session, req.Action, req.Targets)
+
+	return c.JSON(fiber.Map{
+		"success":   succeeded == len(results),
+		"action":    req.Action,
+		"succeeded": succeeded,
+		"failed":    len(results) - succeeded,
+		"results":   results,
+	})
+}
 
-	exec := executor.GlobalExecutorFactory.GetExecutor(req.AgentID)
-	result, _ := exec.StopVM(req.Name)
+// runBulk applies action to targets concurrently and reports a result per
+// target, in order, along with how many succeeded
+func (s *Server) runBulk(c *fiber.Ctx, session *models.Session, action string, targets []models.VMActionRequest) ([]fiber.Map, int) {
+	results := make([]fiber.Map, len(targets))
+	semaphore := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target models.VMActionRequest) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
 
-	if success, ok := result["success"].(bool); ok && success {
-		message := fmt.Sprintf("VM '%s' stopped", req.Name)
-		if msg, ok := result["message"].(string); ok && msg != "" {
-			message = msg
+			results[i] = s.bulkVMAction(c, session, action, target)
+		}(i, target)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, result := range results {
+		if result["success"] == true {
+			succeeded++
+		}
+	}
+	return results, succeeded
+}
+
+// bulkVMAction runs one target of a bulk request and describes the outcome
+func (s *Server) bulkVMAction(c *fiber.Ctx, session *models.Session, action string, target models.VMActionRequest) fiber.Map {
+	entry := fiber.Map{"name": target.Name, "success": false}
+	if target.AgentID != nil {
+		entry["agent_id"] = *target.AgentID
+	}
+	if target.Name == "" {
+		entry["error"] = apierror.New(400, "name is required")
+		return entry
+	}
+
+	agentID := ""
+	if target.AgentID != nil {
+		agentID = *target.AgentID
+	}
+	err := s.Policy.Authorize(c.UserContext(), policy.Input{
+		User:    session.Username,
+		Roles:   s.Auth.Roles(session.Username),
+		Action:  "vm." + action,
+		AgentID: agentID,
+		VMName:  target.Name,
+		Request: map[string]interface{}{
+			"name":        target.Name,
+			"agent_id":    agentID,
+			"force":       target.Force,
+			"soft_delete": target.SoftDelete,
+		},
+	})
+	if err != nil {
+		entry["error"] = apierror.New(policyStatus(err), err.Error())
+		return entry
+	}
+
+	unlock, err := s.Locks.TryLock(target.AgentID, target.Name, action)
+	if err != nil {
+		entry["error"] = apierror.New(409, err.Error())
+		return entry
+	}
+	defer unlock()
+
+	exec := s.Executors.GetExecutor(target.AgentID)
+	result, err := runVMAction(c.UserContext(), exec, action, target)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		entry["error"] = &models.ErrorResponse{Code: models.ErrCodeAgentBusy, Message: saturated.Error()}
+		return entry
+	}
+
+	if result.Success {
+		if action == "purge" || (action == "delete" && !target.SoftDelete) {
+			s.forgetVM(target.AgentID, target.Name)
+		}
+		entry["success"] = true
+		entry["message"] = fmt.Sprintf("VM '%s' %s", target.Name, pastTense(action))
+		if result.Message != "" {
+			entry["message"] = result.Message
 		}
+		return entry
+	}
+
+	message := fmt.Sprintf("Failed to %s VM", action)
+	if result.Message != "" {
+		message = result.Message
+	}
+	entry["error"] = apierror.New(500, message)
+	return entry
+}
+
+// pastTense describes a completed bulk action
+func pastTense(action string) string {
+	switch action {
+	case "stop":
+		return "stopped"
+	case "delete", "purge":
+		return action + "d"
+	}
+	return action + "ed"
+}
+
+// ResizeVM changes a VM's CPUs, memory and/or disk. The VM is stopped for the
+// change and started again if it was running; each phase is reported.
+func (s *Server) ResizeVM(c *fiber.Ctx) error {
+	var req models.VMResizeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if req.Name == "" {
+		return apierror.Respond(c, 400, "name is required")
+	}
+	if req.CPUs < 0 || (req.CPUs == 0 && req.Memory == "" && req.Disk == "") {
+		return apierror.Respond(c, 400, "at least one of cpus, memory or disk is required")
+	}
+
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "resize")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+	defer unlock()
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.ResizeVM(c.UserContext(), req)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+
+	if result.Success {
 		return c.JSON(fiber.Map{
 			"success": true,
-			"message": message,
+			"message": fmt.Sprintf("VM '%s' resized", req.Name),
+			"phases":  result.Phases,
 		})
 	}
 
-	message := "Failed to stop VM"
-	if msg, ok := result["message"].(string); ok {
-		message = msg
+	return operationFailed(c, result, "Failed to resize VM")
+}
+
+// operationFailed responds to a failed VM operation with its message, or
+// fallback, and the phases it went through
+func operationFailed(c *fiber.Ctx, result *models.OperationResult, fallback string) error {
+	message := fallback
+	if result.Message != "" {
+		message = result.Message
 	}
-	return c.Status(500).JSON(fiber.Map{"detail": message})
+	var details interface{}
+	if len(result.Phases) > 0 {
+		details = fiber.Map{"phases": result.Phases}
+	}
+	code := apierror.Code(500, message)
+	return apierror.RespondDetails(c, apierror.Status(500, code), code, message, details)
 }
 
-// DeleteVM deletes a VM
-func DeleteVM(c *fiber.Ctx) error {
-	sessionID := c.Cookies("session_id")
-	if !auth.CheckAuth(sessionID) {
-		return c.Status(401).JSON(fiber.Map{"detail": "Not authenticated"})
+// CloneVM clones a VM on the host it lives on and reports the new VM's name,
+// state and placement
+func (s *Server) CloneVM(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.VMCloneRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if req.Name == "" {
+		return apierror.Respond(c, 400, "name is required")
+	}
+	if err := s.requireFeature(c.UserContext(), req.AgentID, "clone"); err != nil {
+		return apierror.RespondErr(c, 501, err)
 	}
 
-	var req models.VMActionRequest
+	// The source is stopped while it is copied
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "clone")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+	defer unlock()
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.CloneVM(c.UserContext(), req)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+
+	if result.Success {
+		session, _ := s.Auth.GetSession(sessionID)
+		s.recordClonedVM(req, result.VMName, session.Username)
+		location := exec.GetLocationInfo()
+		response := fiber.Map{
+			"success":        true,
+			"message":        fmt.Sprintf("VM '%s' cloned to '%s'", req.Name, result.VMName),
+			"vm_name":        result.VMName,
+			"state":          result.State,
+			"method":         result.Method,
+			"phases":         result.Phases,
+			"agent_id":       location["agent_id"],
+			"agent_hostname": location["agent_hostname"],
+		}
+		if result.Warning != "" {
+			response["warnings"] = []string{result.Warning}
+		}
+		return c.JSON(response)
+	}
+
+	return operationFailed(c, result, "Failed to clone VM")
+}
+
+// MountVM mounts a host directory into a VM (admin only), as a mount hands the
+// VM the host's files. For VMs on an agent the source path refers to the
+// agent host.
+func (s *Server) MountVM(c *fiber.Ctx) error {
+	var req models.VMMountRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if req.Name == "" {
+		return apierror.Respond(c, 400, "name is required")
+	}
+	// The source of a remote VM is a path on its agent, which checks it
+	// against its own mount roots
+	var err error
+	if req.AgentID == nil {
+		req.Source, err = s.Mounts.Source(req.Source)
+	} else {
+		req.Source, err = multipass.CleanMountSource(req.Source)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "mount")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
 	}
+	defer unlock()
 
-	exec := executor.GlobalExecutorFactory.GetExecutor(req.AgentID)
-	result, _ := exec.DeleteVM(req.Name)
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.MountVM(c.UserContext(), req.Name, req.Source, req.Target)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
 
-	if success, ok := result["success"].(bool); ok && success {
-		message := fmt.Sprintf("VM '%s' deleted", req.Name)
-		if msg, ok := result["message"].(string); ok && msg != "" {
-			message = msg
+	if result.Success {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": fmt.Sprintf("'%s' mounted into VM '%s'", req.Source, req.Name),
+		})
+	}
+
+	message := "Failed to mount directory"
+	if result.Message != "" {
+		message = result.Message
+	}
+	return apierror.Respond(c, 500, message)
+}
+
+// UnmountVM removes a mount from a VM, or every mount when no target is given
+func (s *Server) UnmountVM(c *fiber.Ctx) error {
+	var req models.VMMountRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if req.Name == "" {
+		return apierror.Respond(c, 400, "name is required")
+	}
+
+	unlock, err := s.Locks.TryLock(req.AgentID, req.Name, "umount")
+	if err != nil {
+		return apierror.RespondErr(c, 409, err)
+	}
+	defer unlock()
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+	result, err := exec.UnmountVM(c.UserContext(), req.Name, req.Target)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+
+	if result.Success {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": fmt.Sprintf("Unmounted from VM '%s'", req.Name),
+		})
+	}
+
+	message := "Failed to unmount directory"
+	if result.Message != "" {
+		message = result.Message
+	}
+	return apierror.Respond(c, 500, message)
+}
+
+// ListVMMounts lists the directories mounted into a VM
+func (s *Server) ListVMMounts(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	vmName := c.Params("vm_name")
+	if !s.canAccessVM(sessionID, c.Query("agent_id"), vmName) {
+		return vmNotAccessible(c, vmName)
+	}
+	var agentID *string
+	if id := c.Query("agent_id"); id != "" {
+		agentID = &id
+	}
+
+	exec := s.Executors.GetExecutor(agentID)
+	mounts, err := exec.ListMounts(c.UserContext(), vmName)
+	if saturated, ok := communication.AsSaturated(err); ok {
+		return agentSaturated(c, saturated)
+	}
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"vm_name": vmName,
+		"mounts":  mounts,
+	})
+}
+
+// TransferFile uploads a file into a VM or downloads one out of it. Uploads are
+// multipart requests with the file in the "file" part; downloads stream the
+// file back as an attachment.
+func (s *Server) TransferFile(c *fiber.Ctx) error {
+	var req models.VMTransferRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if req.Name == "" || req.Path == "" {
+		return apierror.Respond(c, 400, "name and path are required")
+	}
+	if req.AgentID != nil && *req.AgentID == "" {
+		req.AgentID = nil
+	}
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+
+	switch req.Direction {
+	case multipass.TransferUpload:
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			return apierror.Respond(c, 400, "file is required for uploads")
+		}
+		src, err := fileHeader.Open()
+		if err != nil {
+			return apierror.RespondErr(c, 500, err)
+		}
+		defer src.Close()
+
+		destPath := multipass.ResolveUploadPath(req.Path, fileHeader.Filename)
+		result, err := exec.UploadFile(c.UserContext(), req.Name, destPath, fileHeader.Filename, src)
+		if saturated, ok := communication.AsSaturated(err); ok {
+			return agentSaturated(c, saturated)
+		}
+		if result.Success {
+			return c.JSON(fiber.Map{
+				"success": true,
+				"message": fmt.Sprintf("Uploaded %s to VM '%s' at %s", fileHeader.Filename, req.Name, destPath),
+			})
+		}
+
+		message := "Failed to upload file"
+		if result.Message != "" {
+			message = result.Message
+		}
+		return apierror.Respond(c, 500, message)
+	case multipass.TransferDownload:
+		file, err := exec.DownloadFile(c.UserContext(), req.Name, req.Path)
+		if saturated, ok := communication.AsSaturated(err); ok {
+			return agentSaturated(c, saturated)
+		}
+		if err != nil {
+			return apierror.RespondErr(c, 500, err)
+		}
+		c.Attachment(path.Base(req.Path))
+		return c.SendStream(file)
+	default:
+		return apierror.Respond(c, 400, "direction must be upload or download")
+	}
+}
+
+// ExecInVM runs a non-interactive command inside a VM and returns its output
+// and exit code. A non-zero exit code is not an HTTP error; check return_code.
+func (s *Server) ExecInVM(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	var req models.VMExecRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Respond(c, 400, "Invalid request")
+	}
+	if err := multipass.ValidateExecRequest(req); err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+
+	exec := s.Executors.GetExecutor(req.AgentID)
+	logger.InfoContext(c.UserContext(), "Executing in VM", "vm", req.Name, "command", req.Command, "alias", req.Alias, "args", req.Args)
+	result := exec.ExecInVM(c.UserContext(), req)
+	if len(req.Artifacts) == 0 {
+		return c.JSON(result)
+	}
+
+	response := models.VMExecResponse{RemoteCommandResponse: result, Artifacts: []models.ArtifactResult{}}
+	if result.Success {
+		session, _ := s.Auth.GetSession(sessionID)
+		response.Artifacts = s.collectArtifacts(c.UserContext(), exec, req, session.Username)
+	}
+	return c.JSON(response)
+}
+
+// GetVMLogs reads the tail of a log inside a VM, by default cloud-init's
+// output. ?source picks another configured log and ?tail the number of lines.
+// With ?follow=true the lines are streamed as server-sent "line" events as the
+// log grows, ending with an "end" event once the stream stops.
+func (s *Server) GetVMLogs(c *fiber.Ctx) error {
+	vmName := c.Params("vm_name")
+	var agentID *string
+	if id := c.Query("agent_id"); id != "" {
+		agentID = &id
+	}
+
+	tail, err := multipass.ParseLogTail(c.Query("tail"))
+	if err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+	source := c.Query("source", multipass.DefaultLogSource)
+	follow := c.QueryBool("follow", false)
+	req, logPath, err := multipass.BuildLogRequest(vmName, source, tail, follow)
+	if err != nil {
+		return apierror.RespondErr(c, 400, err)
+	}
+
+	exec := s.Executors.GetExecutor(agentID)
+	if !follow {
+		result := exec.ExecInVM(c.UserContext(), req)
+		if !result.Success {
+			return apierror.Respond(c, 500, execFailure(result, "Failed to read log"))
+		}
+		logText := ""
+		if result.Stdout != nil {
+			logText = *result.Stdout
 		}
 		return c.JSON(fiber.Map{
 			"success": true,
-			"message": message,
+			"vm_name": vmName,
+			"source":  source,
+			"path":    logPath,
+			"log":     logText,
 		})
 	}
 
-	message := "Failed to delete VM"
-	if msg, ok := result["message"].(string); ok {
-		message = msg
+	ctx, cancel := context.WithCancel(c.UserContext())
+	return sse.Stream(c, func(w *sse.Writer) {
+		defer cancel()
+		// Stop tailing once the client has gone away
+		go func() {
+			select {
+			case <-w.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		w.Event("source", fiber.Map{"vm_name": vmName, "source": source, "path": logPath})
+		output := multipass.NewLineWriter(func(line string) {
+			w.Event("line", fiber.Map{"line": line})
+		})
+		result := exec.ExecInVMStream(ctx, req, output)
+		end := fiber.Map{"success": result.Success}
+		if !result.Success && ctx.Err() == nil {
+			end["error"] = apierror.New(500, execFailure(result, "Failed to read log"))
+		}
+		w.Event("end", end)
+	})
+}
+
+// execFailure describes why an exec failed: its error, else what it printed
+// on stderr, else fallback
+func execFailure(result models.RemoteCommandResponse, fallback string) string {
+	if result.Error != nil && *result.Error != "" {
+		return *result.Error
+	}
+	if result.Stderr != nil && strings.TrimSpace(*result.Stderr) != "" {
+		return strings.TrimSpace(*result.Stderr)
+	}
+	return fallback
+}
+
+// collectArtifacts pulls each declared artifact path out of the VM into the
+// artifact store. A missing or unreadable path fails only its own entry.
+func (s *Server) collectArtifacts(ctx context.Context, exec executor.VMExecutor, req models.VMExecRequest, username string) []models.ArtifactResult {
+	agentID := ""
+	if req.AgentID != nil {
+		agentID = *req.AgentID
+	}
+
+	results := make([]models.ArtifactResult, 0, len(req.Artifacts))
+	for _, artifactPath := range req.Artifacts {
+		result := models.ArtifactResult{Path: artifactPath}
+
+		contents, err := exec.DownloadFile(ctx, req.Name, artifactPath)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		artifact, err := s.Artifacts.Save(models.Artifact{
+			Path:      artifactPath,
+			VMName:    req.Name,
+			AgentID:   agentID,
+			CreatedBy: username,
+		}, contents)
+		contents.Close()
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Success = true
+			result.Artifact = artifact
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// ==================== Artifact Routes ====================
+
+// artifactForSession gets an artifact if the session may see it: admins see
+// every artifact, other users only the ones they collected
+func (s *Server) artifactForSession(c *fiber.Ctx, sessionID string) (*models.Artifact, error) {
+	artifact, err := s.Artifacts.Get(c.Params("id"))
+	if err == artifacts.ErrNotFound {
+		return nil, apierror.Respond(c, 404, "Artifact not found")
+	}
+	if err != nil {
+		return nil, apierror.RespondErr(c, 500, err)
+	}
+	session, _ := s.Auth.GetSession(sessionID)
+	if !s.Auth.IsAdmin(sessionID) && artifact.CreatedBy != session.Username {
+		return nil, apierror.Respond(c, 404, "Artifact not found")
+	}
+	return artifact, nil
+}
+
+// ListArtifacts lists stored artifacts, optionally filtered by vm_name and
+// agent_id. Non-admins only see artifacts they collected.
+func (s *Server) ListArtifacts(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	session, _ := s.Auth.GetSession(sessionID)
+	isAdmin := s.Auth.IsAdmin(sessionID)
+	vmName := c.Query("vm_name")
+	agentID := c.Query("agent_id")
+
+	list, err := s.Artifacts.List(func(artifact *models.Artifact) bool {
+		return (isAdmin || artifact.CreatedBy == session.Username) &&
+			(vmName == "" || artifact.VMName == vmName) &&
+			(agentID == "" || artifact.AgentID == agentID)
+	})
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"artifacts": list,
+	})
+}
+
+// GetArtifact gets an artifact's metadata
+func (s *Server) GetArtifact(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	artifact, err := s.artifactForSession(c, sessionID)
+	if artifact == nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"artifact": artifact,
+	})
+}
+
+// DownloadArtifact streams an artifact's contents as an attachment
+func (s *Server) DownloadArtifact(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	artifact, err := s.artifactForSession(c, sessionID)
+	if artifact == nil {
+		return err
+	}
+
+	contents, err := s.Artifacts.Open(artifact.ID)
+	if err != nil {
+		return apierror.RespondErr(c, 500, err)
+	}
+	c.Attachment(artifact.Name)
+	return c.SendStream(contents, int(artifact.Size))
+}
+
+// DeleteArtifact removes an artifact and its contents
+func (s *Server) DeleteArtifact(c *fiber.Ctx) error {
+	sessionID := auth.SessionID(c)
+
+	artifact, err := s.artifactForSession(c, sessionID)
+	if artifact == nil {
+		return err
+	}
+
+	if err := s.Artifacts.Delete(artifact.ID); err != nil {
+		return apierror.RespondErr(c, 500, err)
 	}
-	return c.Status(500).JSON(fiber.Map{"detail": message})
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("Artifact %s deleted", artifact.ID),
+	})
 }
@@ -0,0 +1,133 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/maintenance"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// ErrNoAgentAvailable is returned when no agent can accept a new VM
+var ErrNoAgentAvailable = errors.New("no online agent is available that is not draining or in a maintenance window")
+
+// UnsatisfiedError is returned when agents are available but none carries the
+// tags a VM's placement constraints require. AgentID is set when the VM was
+// placed on a specific agent that lacks them.
+type UnsatisfiedError struct {
+	AgentID     string
+	Constraints map[string]string
+}
+
+func (e *UnsatisfiedError) Error() string {
+	if e.AgentID != "" {
+		return fmt.Sprintf("agent '%s' does not have tags %s", e.AgentID, FormatConstraints(e.Constraints))
+	}
+	return fmt.Sprintf("no online agent that is not draining or in a maintenance window has tags %s", FormatConstraints(e.Constraints))
+}
+
+// FormatConstraints renders constraints as sorted key=value pairs
+func FormatConstraints(constraints map[string]string) string {
+	pairs := make([]string, 0, len(constraints))
+	for key, value := range constraints {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// Satisfies reports whether an agent's tags carry every key=value pair of
+// constraints. The "zone" key matches the agent's zone.
+func Satisfies(agent *models.AgentInfo, constraints map[string]string) bool {
+	for key, value := range constraints {
+		if key == "zone" {
+			if agents.Zone(agent) != value {
+				return false
+			}
+			continue
+		}
+		if tag, ok := agent.Tags[key]; !ok || tag != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Constraints gets the placement constraints of a VM, with its zone, if it
+// names one, as the "zone" constraint
+func Constraints(req models.VMCreateRequest) map[string]string {
+	if req.Zone == "" {
+		return req.Constraints
+	}
+	constraints := make(map[string]string, len(req.Constraints)+1)
+	for key, value := range req.Constraints {
+		constraints[key] = value
+	}
+	constraints["zone"] = req.Zone
+	return constraints
+}
+
+// Scheduler places new VMs on agents
+type Scheduler struct {
+	registry    *agents.AgentRegistry
+	maintenance *maintenance.Scheduler
+}
+
+// New creates a scheduler placing VMs on the agents in registry, avoiding
+// draining agents and agents in the maintenance windows kept by windows
+func New(registry *agents.AgentRegistry, windows *maintenance.Scheduler) *Scheduler {
+	return &Scheduler{
+		registry:    registry,
+		maintenance: windows,
+	}
+}
+
+// SelectAgent picks the agent for a new VM that has no explicit placement:
+// the least loaded online agent that is not draining or in a maintenance
+// window and whose tags satisfy constraints
+func (s *Scheduler) SelectAgent(constraints map[string]string) (*models.AgentInfo, error) {
+	selected, err := s.SelectAgents([]map[string]string{constraints})
+	if err != nil {
+		return nil, err
+	}
+	return selected[0], nil
+}
+
+// SelectAgents picks an agent for each of a batch of new VMs, given the
+// placement constraints of each. Each pick counts towards the agent's load, so
+// a batch is spread across agents instead of landing on whichever was least
+// loaded before it started.
+func (s *Scheduler) SelectAgents(constraints []map[string]string) ([]*models.AgentInfo, error) {
+	candidates := []*models.AgentInfo{}
+	for _, agent := range s.registry.GetSchedulableAgents() {
+		if !s.maintenance.InMaintenance(agent) {
+			candidates = append(candidates, agent)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoAgentAvailable
+	}
+
+	pending := make(map[string]int)
+	selected := make([]*models.AgentInfo, 0, len(constraints))
+	for _, vmConstraints := range constraints {
+		var best *models.AgentInfo
+		for _, agent := range candidates {
+			if !Satisfies(agent, vmConstraints) {
+				continue
+			}
+			if best == nil || agent.VMCount+pending[agent.AgentID] < best.VMCount+pending[best.AgentID] {
+				best = agent
+			}
+		}
+		if best == nil {
+			return nil, &UnsatisfiedError{Constraints: vmConstraints}
+		}
+		pending[best.AgentID]++
+		selected = append(selected, best)
+	}
+	return selected, nil
+}
@@ -0,0 +1,425 @@
+package schedules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/auth"
+	"github.com/prashah/batwa/pkg/executor"
+	"github.com/prashah/batwa/pkg/locks"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/maintenance"
+	"github.com/prashah/batwa/pkg/metadata"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+var logger = logging.For("schedules")
+
+// actions are the lifecycle actions a schedule rule may run
+var actions = map[string]bool{
+	"start":   true,
+	"stop":    true,
+	"suspend": true,
+	"restart": true,
+}
+
+// maxCatchUp bounds how far back a tick looks for missed minutes, so a
+// master that was down overnight does not replay the night's actions
+const maxCatchUp = 5 * time.Minute
+
+// Scheduler keeps power schedules and runs their actions when they fall due.
+// Schedules are saved to a JSON file after every change.
+type Scheduler struct {
+	path        string
+	registry    *agents.AgentRegistry
+	executors   *executor.ExecutorFactory
+	maintenance *maintenance.Scheduler
+	auth        *auth.Service
+	metadata    *metadata.Store
+	locks       *locks.VMLockManager
+	schedules   map[string]*models.PowerSchedule
+	lastTick    time.Time
+	mutex       sync.RWMutex
+	cancelFunc  context.CancelFunc
+}
+
+// NewScheduler creates a power scheduler persisted at path, acting through
+// executors on the VMs recorded in store and taking their locks from
+// vmLocks. Agents that are offline or in maintenance are skipped.
+func NewScheduler(path string, registry *agents.AgentRegistry, executors *executor.ExecutorFactory, windows *maintenance.Scheduler, authService *auth.Service,
+	store *metadata.Store, vmLocks *locks.VMLockManager) *Scheduler {
+	s := &Scheduler{
+		path:        path,
+		registry:    registry,
+		executors:   executors,
+		maintenance: windows,
+		auth:        authService,
+		metadata:    store,
+		locks:       vmLocks,
+		schedules:   make(map[string]*models.PowerSchedule),
+	}
+	if err := s.load(); err != nil {
+		logger.Error("Failed to load power schedules", "path", path, "error", err)
+	}
+	return s
+}
+
+// NewSchedulerFromEnv creates a power scheduler persisted at SCHEDULES_PATH
+// (default ./data/schedules.json)
+func NewSchedulerFromEnv(registry *agents.AgentRegistry, executors *executor.ExecutorFactory, windows *maintenance.Scheduler, authService *auth.Service,
+	store *metadata.Store, vmLocks *locks.VMLockManager) *Scheduler {
+	path := os.Getenv("SCHEDULES_PATH")
+	if path == "" {
+		path = filepath.Join("data", "schedules.json")
+	}
+	return NewScheduler(path, registry, executors, windows, authService, store, vmLocks)
+}
+
+// load reads the saved schedules
+func (s *Scheduler) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var schedules []*models.PowerSchedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return err
+	}
+	for _, schedule := range schedules {
+		s.schedules[schedule.ID] = schedule
+	}
+	return nil
+}
+
+// save writes all schedules to the file; the caller must hold the lock
+func (s *Scheduler) save() {
+	schedules := make([]*models.PowerSchedule, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		schedules = append(schedules, schedule)
+	}
+	data, err := json.MarshalIndent(schedules, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0o755)
+	}
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save power schedules", "path", s.path, "error", err)
+	}
+}
+
+// Validate checks a power schedule
+func Validate(schedule *models.PowerSchedule) error {
+	if schedule.VMName == "" && len(schedule.Selector) == 0 {
+		return fmt.Errorf("either vm_name or selector is required")
+	}
+	if schedule.VMName != "" && len(schedule.Selector) > 0 {
+		return fmt.Errorf("vm_name and selector are mutually exclusive")
+	}
+	if len(schedule.Rules) == 0 {
+		return fmt.Errorf("at least one rule is required")
+	}
+	for _, rule := range schedule.Rules {
+		if !actions[rule.Action] {
+			return fmt.Errorf("unsupported action '%s': use start, stop, suspend or restart", rule.Action)
+		}
+		if _, err := ParseCron(rule.Cron); err != nil {
+			return err
+		}
+	}
+	if _, err := location(schedule); err != nil {
+		return fmt.Errorf("unknown timezone: %s", schedule.Timezone)
+	}
+	return nil
+}
+
+// location gets the time zone a schedule's rules are written in (UTC by default)
+func location(schedule *models.PowerSchedule) (*time.Location, error) {
+	if schedule.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(schedule.Timezone)
+}
+
+// Add validates and stores a new schedule
+func (s *Scheduler) Add(schedule *models.PowerSchedule) error {
+	if err := Validate(schedule); err != nil {
+		return err
+	}
+
+	schedule.ID = uuid.NewString()
+	schedule.CreatedAt = time.Now()
+	schedule.LastRun = nil
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.schedules[schedule.ID] = schedule
+	s.save()
+
+	logger.Info("Added power schedule", "schedule", schedule.ID, "rules", len(schedule.Rules))
+	return nil
+}
+
+// Get gets a schedule by ID
+func (s *Scheduler) Get(id string) *models.PowerSchedule {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.schedules[id]
+}
+
+// Remove removes a schedule
+func (s *Scheduler) Remove(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.schedules[id]; exists {
+		delete(s.schedules, id)
+		s.save()
+		return true
+	}
+	return false
+}
+
+// List lists all schedules ordered by creation time
+func (s *Scheduler) List() []*models.PowerSchedule {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	schedules := make([]*models.PowerSchedule, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+	})
+	return schedules
+}
+
+// NextRun gets the next time any rule of a schedule fires, and its action
+func NextRun(schedule *models.PowerSchedule, now time.Time) (time.Time, string, bool) {
+	loc, err := location(schedule)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+
+	var next time.Time
+	action := ""
+	for _, rule := range schedule.Rules {
+		cron, err := ParseCron(rule.Cron)
+		if err != nil {
+			continue
+		}
+		if t, ok := cron.Next(now.In(loc)); ok && (next.IsZero() || t.Before(next)) {
+			next = t
+			action = rule.Action
+		}
+	}
+	return next, action, !next.IsZero()
+}
+
+// Start starts the loop that runs due schedules
+func (s *Scheduler) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelFunc = cancel
+
+	go s.scheduleLoop(ctx)
+	logger.Info("Started power schedule loop")
+}
+
+// Stop stops the schedule loop
+func (s *Scheduler) Stop() {
+	if s.cancelFunc != nil {
+		s.cancelFunc()
+		logger.Info("Stopped power schedule loop")
+	}
+}
+
+// scheduleLoop checks for due rules every minute, on the minute
+func (s *Scheduler) scheduleLoop(ctx context.Context) {
+	s.lastTick = time.Now().Truncate(time.Minute)
+
+	for {
+		wait := time.Until(time.Now().Truncate(time.Minute).Add(time.Minute))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+			s.tick(time.Now())
+		}
+	}
+}
+
+// tick runs every rule that fell due in the minutes since the previous tick
+func (s *Scheduler) tick(now time.Time) {
+	now = now.Truncate(time.Minute)
+	from := s.lastTick.Add(time.Minute)
+	if now.Sub(from) > maxCatchUp {
+		from = now.Add(-maxCatchUp)
+	}
+	s.lastTick = now
+
+	for _, schedule := range s.List() {
+		loc, err := location(schedule)
+		if err != nil {
+			continue
+		}
+		for _, rule := range schedule.Rules {
+			cron, err := ParseCron(rule.Cron)
+			if err != nil {
+				continue
+			}
+			for t := from; !t.After(now); t = t.Add(time.Minute) {
+				if cron.Matches(t.In(loc)) {
+					s.Run(schedule.ID, rule.Action)
+					break
+				}
+			}
+		}
+	}
+}
+
+// target identifies one VM a schedule acts on
+type target struct {
+	agentID string
+	vmName  string
+}
+
+// targets resolves the VMs a schedule applies to. Schedules created by users
+// other than admins only ever touch VMs those users own.
+func (s *Scheduler) targets(schedule *models.PowerSchedule) []target {
+	admin := false
+	for _, role := range s.auth.Roles(schedule.CreatedBy) {
+		admin = admin || role == "admin"
+	}
+
+	if schedule.VMName != "" {
+		meta := s.metadata.Get(schedule.AgentID, schedule.VMName)
+		if !admin && (meta == nil || meta.Owner != schedule.CreatedBy) {
+			return nil
+		}
+		return []target{{agentID: schedule.AgentID, vmName: schedule.VMName}}
+	}
+
+	var agentFilter *string
+	if schedule.AgentID != "" {
+		agentFilter = &schedule.AgentID
+	}
+	targets := []target{}
+	for _, meta := range s.metadata.List(agentFilter) {
+		if !admin && meta.Owner != schedule.CreatedBy {
+			continue
+		}
+		matches := true
+		for key, value := range schedule.Selector {
+			if meta.Labels[key] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			targets = append(targets, target{agentID: meta.AgentID, vmName: meta.Name})
+		}
+	}
+	return targets
+}
+
+// Run applies action to every VM a schedule targets now and records the
+// outcome as the schedule's last run
+func (s *Scheduler) Run(id, action string) *models.ScheduleRun {
+	schedule := s.Get(id)
+	if schedule == nil {
+		return nil
+	}
+
+	run := &models.ScheduleRun{
+		Time:    time.Now(),
+		Action:  action,
+		Results: []models.ScheduleRunResult{},
+	}
+	for _, t := range s.targets(schedule) {
+		run.Results = append(run.Results, s.apply(t, action))
+	}
+	logger.Info("Power schedule ran", "schedule", id, "action", action, "vms", len(run.Results))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if current, exists := s.schedules[id]; exists {
+		updated := *current
+		updated.LastRun = run
+		s.schedules[id] = &updated
+		s.save()
+	}
+	return run
+}
+
+// apply runs one scheduled action on one VM
+func (s *Scheduler) apply(t target, action string) models.ScheduleRunResult {
+	result := models.ScheduleRunResult{AgentID: t.agentID, VMName: t.vmName}
+
+	var agentID *string
+	if t.agentID != "" {
+		agent := s.registry.GetAgent(t.agentID)
+		switch {
+		case agent == nil || agent.Status != "online":
+			result.Skipped = true
+			result.Error = "agent is offline"
+			return result
+		case s.maintenance.InMaintenance(agent):
+			result.Skipped = true
+			result.Error = "agent is in a maintenance window"
+			return result
+		}
+		agentID = &t.agentID
+	}
+
+	unlock, err := s.locks.TryLock(agentID, t.vmName, action)
+	if err != nil {
+		result.Skipped = true
+		result.Error = err.Error()
+		return result
+	}
+	defer unlock()
+
+	exec := s.executors.GetExecutor(agentID)
+	ctx := context.Background()
+	var response *models.OperationResult
+	switch action {
+	case "start":
+		response, err = exec.StartVM(ctx, t.vmName)
+	case "stop":
+		response, err = exec.StopVM(ctx, t.vmName, 0)
+	case "suspend":
+		response, err = exec.SuspendVM(ctx, t.vmName)
+	case "restart":
+		response, err = exec.RestartVM(ctx, t.vmName, false)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if response.Success {
+		result.Success = true
+		return result
+	}
+	result.Error = fmt.Sprintf("Failed to %s VM", action)
+	if response.Message != "" {
+		result.Error = response.Message
+	}
+	return result
+}
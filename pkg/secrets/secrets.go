@@ -0,0 +1,192 @@
+// Package secrets loads secrets such as API keys, registration tokens and
+// client secrets from HashiCorp Vault or from files, optionally encrypted at
+// rest, instead of taking them in plaintext from flags and the environment.
+//
+// Wherever a secret is configured, its value may be a reference:
+//
+//	vault:secret/data/batwa#registration_token   a field of a Vault KV secret
+//	file:/etc/batwa/oidc-client-secret           a file, plain or encrypted
+//
+// Anything else is taken literally. Secrets are resolved again on Reload, so
+// rotated values are picked up without a restart.
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/prashah/batwa/pkg/logging"
+)
+
+var logger = logging.For("secrets")
+
+// Reference prefixes
+const (
+	vaultPrefix = "vault:"
+	filePrefix  = "file:"
+)
+
+// Secret is a secret's current value. A nil Secret is an unset one.
+type Secret struct {
+	name  string
+	ref   string
+	value string
+	mutex sync.RWMutex
+}
+
+// Static creates a secret with a fixed value, or nil for an empty value
+func Static(value string) *Secret {
+	if value == "" {
+		return nil
+	}
+	return &Secret{value: value}
+}
+
+// Value gets the secret's current value, or "" when it is unset
+func (s *Secret) Value() string {
+	if s == nil {
+		return ""
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.value
+}
+
+// Resolver resolves secret references and reloads the secrets it resolved
+type Resolver struct {
+	vault   *vaultClient
+	cipher  *Cipher
+	secrets []*Secret
+	mutex   sync.Mutex
+}
+
+// NewResolverFromEnv creates a resolver that reads Vault at VAULT_ADDR with
+// the token in VAULT_TOKEN or VAULT_TOKEN_FILE (and VAULT_NAMESPACE, if
+// set), and decrypts files with the key in SECRETS_KEY_FILE. Both are
+// optional; references to an unconfigured source fail when resolved.
+func NewResolverFromEnv() (*Resolver, error) {
+	r := &Resolver{}
+	if addr := os.Getenv("VAULT_ADDR"); addr != "" {
+		r.vault = newVaultClient(addr, os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_TOKEN_FILE"), os.Getenv("VAULT_NAMESPACE"))
+	}
+	if path := os.Getenv("SECRETS_KEY_FILE"); path != "" {
+		cipher, err := LoadCipher(path)
+		if err != nil {
+			return nil, err
+		}
+		r.cipher = cipher
+	}
+	return r, nil
+}
+
+// Cipher gets the cipher files are encrypted with, or nil when
+// SECRETS_KEY_FILE is unset
+func (r *Resolver) Cipher() *Cipher {
+	return r.cipher
+}
+
+// Getenv resolves the secret configured in an environment variable. It
+// returns nil when the variable is unset.
+func (r *Resolver) Getenv(name string) (*Secret, error) {
+	return r.Secret(name, os.Getenv(name))
+}
+
+// ResolveEnv resolves the secret configured in an environment variable once,
+// for secrets only read at startup. It returns "" when the variable is unset.
+func (r *Resolver) ResolveEnv(name string) (string, error) {
+	value, err := r.resolve(os.Getenv(name))
+	if err != nil {
+		return "", fmt.Errorf("failed to load %s: %w", name, err)
+	}
+	return value, nil
+}
+
+// Secret resolves the secret ref, configured as name, and keeps it for
+// Reload. It returns nil when ref is empty.
+func (r *Resolver) Secret(name, ref string) (*Secret, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	value, err := r.resolve(ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", name, err)
+	}
+	secret := &Secret{name: name, ref: ref, value: value}
+	if isReference(ref) {
+		r.mutex.Lock()
+		r.secrets = append(r.secrets, secret)
+		r.mutex.Unlock()
+	}
+	return secret, nil
+}
+
+// isReference reports whether ref points at a secret rather than being one
+func isReference(ref string) bool {
+	return strings.HasPrefix(ref, vaultPrefix) || strings.HasPrefix(ref, filePrefix)
+}
+
+// resolve gets the value ref points at
+func (r *Resolver) resolve(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, vaultPrefix):
+		if r.vault == nil {
+			return "", errors.New("a vault: secret needs VAULT_ADDR")
+		}
+		path, field, found := strings.Cut(strings.TrimPrefix(ref, vaultPrefix), "#")
+		if !found || path == "" || field == "" {
+			return "", fmt.Errorf("invalid Vault reference '%s': use vault:<path>#<field>", ref)
+		}
+		return r.vault.read(path, field)
+	case strings.HasPrefix(ref, filePrefix):
+		return r.readFile(strings.TrimPrefix(ref, filePrefix))
+	}
+	return ref, nil
+}
+
+// readFile reads a secret file, decrypting it when it is encrypted
+func (r *Resolver) readFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	content := strings.TrimSpace(string(data))
+	if !IsSealed(content) {
+		return content, nil
+	}
+	if r.cipher == nil {
+		return "", fmt.Errorf("%s is encrypted; set SECRETS_KEY_FILE to decrypt it", path)
+	}
+	return r.cipher.Open(content)
+}
+
+// Reload resolves every secret again. A secret that fails to resolve keeps
+// its value; the names of those that were reloaded and the errors of those
+// that failed are returned.
+func (r *Resolver) Reload() ([]string, map[string]string) {
+	r.mutex.Lock()
+	secrets := append([]*Secret(nil), r.secrets...)
+	r.mutex.Unlock()
+	if r.vault != nil {
+		r.vault.reloadToken()
+	}
+
+	reloaded := []string{}
+	failed := make(map[string]string)
+	for _, secret := range secrets {
+		value, err := r.resolve(secret.ref)
+		if err != nil {
+			logger.Error("Failed to reload secret", "secret", secret.name, "error", err)
+			failed[secret.name] = err.Error()
+			continue
+		}
+		secret.mutex.Lock()
+		secret.value = value
+		secret.mutex.Unlock()
+		reloaded = append(reloaded, secret.name)
+	}
+	logger.Info("Reloaded secrets", "reloaded", len(reloaded), "failed", len(failed))
+	return reloaded, failed
+}
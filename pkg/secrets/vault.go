@@ -0,0 +1,104 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultTimeout bounds each request to Vault
+const vaultTimeout = 10 * time.Second
+
+// vaultClient reads KV secrets from Vault with a token. The token is read
+// from its file again on reload, so a Vault Agent sidecar can renew it.
+type vaultClient struct {
+	addr      string
+	namespace string
+	tokenFile string
+	token     string
+	client    *http.Client
+	mutex     sync.Mutex
+}
+
+// newVaultClient creates a client for the Vault at addr
+func newVaultClient(addr, token, tokenFile, namespace string) *vaultClient {
+	v := &vaultClient{
+		addr:      strings.TrimSuffix(addr, "/"),
+		namespace: namespace,
+		tokenFile: tokenFile,
+		token:     token,
+		client:    &http.Client{Timeout: vaultTimeout},
+	}
+	v.reloadToken()
+	return v
+}
+
+// reloadToken reads the token file again, if there is one
+func (v *vaultClient) reloadToken() {
+	if v.tokenFile == "" {
+		return
+	}
+	data, err := os.ReadFile(v.tokenFile)
+	if err != nil {
+		return
+	}
+	v.mutex.Lock()
+	v.token = strings.TrimSpace(string(data))
+	v.mutex.Unlock()
+}
+
+// read gets a field of the secret at path. KV version 2 secrets are read
+// from their data path, such as secret/data/batwa.
+func (v *vaultClient) read(path, field string) (string, error) {
+	v.mutex.Lock()
+	token := v.token
+	v.mutex.Unlock()
+	if token == "" {
+		return "", errors.New("a vault: secret needs VAULT_TOKEN or VAULT_TOKEN_FILE")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach Vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Vault answered %s for %s", resp.Status, path)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&secret); err != nil {
+		return "", fmt.Errorf("failed to read Vault secret %s: %w", path, err)
+	}
+	data := secret.Data
+	// KV version 2 nests the secret's fields under data.data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, versioned := data["metadata"]; versioned {
+			data = nested
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no field %s", path, field)
+	}
+	return value, nil
+}
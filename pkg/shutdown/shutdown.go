@@ -0,0 +1,82 @@
+// Package shutdown stops the master and agents gracefully. On SIGTERM or
+// SIGINT they stop accepting connections and let in-flight work finish, all
+// within one deadline, instead of dying mid-request and leaving terminal
+// shells and half-recorded tasks behind.
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prashah/batwa/pkg/logging"
+)
+
+var logger = logging.For("shutdown")
+
+// DefaultTimeout is how long shutting down may take unless SHUTDOWN_TIMEOUT
+// overrides it
+const DefaultTimeout = 30 * time.Second
+
+// TimeoutFromEnv reads SHUTDOWN_TIMEOUT, a positive duration such as 30s
+// (default DefaultTimeout)
+func TimeoutFromEnv() (time.Duration, error) {
+	value := os.Getenv("SHUTDOWN_TIMEOUT")
+	if value == "" {
+		return DefaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid SHUTDOWN_TIMEOUT '%s': use a positive duration such as 30s or 2m", value)
+	}
+	return timeout, nil
+}
+
+// Step is one part of shutting down, such as draining the HTTP server. Run
+// gets the context whose deadline bounds the whole shutdown.
+type Step struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// OnSignal waits in the background for SIGTERM or SIGINT, then runs steps in
+// order within timeout and closes the returned channel. main blocks on it
+// once its server stops listening, so its deferred cleanup runs after the
+// steps. A second signal exits at once.
+func OnSignal(timeout time.Duration, steps ...Step) <-chan struct{} {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
+
+	go func() {
+		received := <-signals
+		logger.Info("Shutting down gracefully", "signal", received.String(), "timeout", timeout)
+		go func() {
+			received := <-signals
+			logging.Fatal(logger, "Exiting without finishing shutdown", "signal", received.String())
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		Run(ctx, steps...)
+		close(done)
+	}()
+	return done
+}
+
+// Run runs steps in order, logging those that fail. A step that fails or
+// runs out of time does not stop the ones after it, which still get to
+// clean up.
+func Run(ctx context.Context, steps ...Step) {
+	for _, step := range steps {
+		started := time.Now()
+		if err := step.Run(ctx); err != nil {
+			logger.Warn("Shutdown step failed", "step", step.Name, "error", err)
+			continue
+		}
+		logger.Debug("Shutdown step finished", "step", step.Name, "took", time.Since(started))
+	}
+}
@@ -0,0 +1,170 @@
+package sse
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Writer writes server-sent events. It is safe for concurrent use, so a
+// keepalive goroutine can share it with the producer of events.
+type Writer struct {
+	w     *bufio.Writer
+	mutex sync.Mutex
+	gone  chan struct{}
+	once  sync.Once
+}
+
+// NewWriter creates a writer sending events to w
+func NewWriter(w *bufio.Writer) *Writer {
+	return &Writer{w: w, gone: make(chan struct{})}
+}
+
+// Done is closed once a write fails, meaning the client has gone away.
+// Keepalive comments notice this even while no events are sent.
+func (s *Writer) Done() <-chan struct{} {
+	return s.gone
+}
+
+// failed records a write error and passes it on
+func (s *Writer) failed(err error) error {
+	if err != nil {
+		s.once.Do(func() { close(s.gone) })
+	}
+	return err
+}
+
+// Event sends an event named name with data encoded as JSON, and flushes it.
+// An error means the client has gone away.
+func (s *Writer) Event(name string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, payload); err != nil {
+		return s.failed(err)
+	}
+	return s.failed(s.w.Flush())
+}
+
+// Message sends an unnamed event with data encoded as JSON and the given ID,
+// which a reconnecting EventSource passes back in Last-Event-ID, and flushes
+// it. An error means the client has gone away.
+func (s *Writer) Message(id string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := fmt.Fprintf(s.w, "id: %s\ndata: %s\n\n", id, payload); err != nil {
+		return s.failed(err)
+	}
+	return s.failed(s.w.Flush())
+}
+
+// Retry tells the client how long to wait before reconnecting if the stream
+// drops
+func (s *Writer) Retry(delay time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := fmt.Fprintf(s.w, "retry: %d\n\n", delay.Milliseconds()); err != nil {
+		return s.failed(err)
+	}
+	return s.failed(s.w.Flush())
+}
+
+// Comment sends a comment line, which clients ignore; it keeps idle
+// connections from being closed by proxies
+func (s *Writer) Comment(text string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := fmt.Fprintf(s.w, ": %s\n\n", text); err != nil {
+		return s.failed(err)
+	}
+	return s.failed(s.w.Flush())
+}
+
+// keepaliveInterval is how often Stream sends a comment while fn is quiet
+const keepaliveInterval = 15 * time.Second
+
+// Stream responds with an event stream and runs fn to produce its events once
+// the headers are sent. Comments are sent periodically while fn runs so that
+// long silences (such as cloud-init running) do not trip proxy timeouts.
+func Stream(c *fiber.Ctx, fn func(w *Writer)) error {
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		writer := NewWriter(w)
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		// The writer is only valid until this function returns
+		defer func() {
+			close(done)
+			<-stopped
+		}()
+
+		go func() {
+			defer close(stopped)
+			ticker := time.NewTicker(keepaliveInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					writer.Comment("keepalive")
+				}
+			}
+		}()
+
+		fn(writer)
+	})
+	return nil
+}
+
+// Read parses a stream of server-sent events, calling fn with the name and
+// data of each until the stream ends or fn returns false. Events without a
+// name are reported as "message".
+func Read(r io.Reader, fn func(name, data string) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	name := ""
+	data := []string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				if name == "" {
+					name = "message"
+				}
+				if !fn(name, strings.Join(data, "\n")) {
+					return nil
+				}
+			}
+			name = ""
+			data = data[:0]
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,146 @@
+package stacks
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+// Repository persists stacks. The store keeps every stack in memory and
+// writes each change through to the repository.
+type Repository interface {
+	Load() ([]*models.Stack, error)
+	// Save saves a stack, replacing any of the same name
+	Save(stack *models.Stack) error
+	Delete(name string) error
+}
+
+// FileRepository keeps stacks in a JSON file, rewritten on every change
+type FileRepository struct {
+	path   string
+	stacks map[string]*models.Stack
+	mutex  sync.Mutex
+}
+
+// NewFileRepository keeps stacks in the JSON file at path
+func NewFileRepository(path string) *FileRepository {
+	return &FileRepository{path: path, stacks: make(map[string]*models.Stack)}
+}
+
+// Load reads the stacks saved in the file
+func (r *FileRepository) Load() ([]*models.Stack, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []*models.Stack
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for _, stack := range saved {
+		r.stacks[stack.Name] = stack
+	}
+	return saved, nil
+}
+
+// Save saves a stack by rewriting the file
+func (r *FileRepository) Save(stack *models.Stack) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stacks[stack.Name] = stack
+	return r.write()
+}
+
+// Delete deletes a stack by rewriting the file
+func (r *FileRepository) Delete(name string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.stacks, name)
+	return r.write()
+}
+
+// write writes the stacks to the file, ordered by name; the caller must hold
+// the lock
+func (r *FileRepository) write() error {
+	stacks := make([]*models.Stack, 0, len(r.stacks))
+	for _, stack := range r.stacks {
+		stacks = append(stacks, stack)
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		return stacks[i].Name < stacks[j].Name
+	})
+
+	data, err := json.MarshalIndent(stacks, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// DatabaseRepository keeps stacks in the master's database
+type DatabaseRepository struct {
+	db *storage.DB
+}
+
+// NewDatabaseRepository keeps stacks in db
+func NewDatabaseRepository(db *storage.DB) *DatabaseRepository {
+	return &DatabaseRepository{db: db}
+}
+
+// Load loads every stack from the database
+func (r *DatabaseRepository) Load() ([]*models.Stack, error) {
+	rows, err := r.db.Query(`SELECT data FROM stacks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var saved []*models.Stack
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var stack models.Stack
+		if err := json.Unmarshal([]byte(data), &stack); err != nil {
+			return nil, err
+		}
+		saved = append(saved, &stack)
+	}
+	return saved, rows.Err()
+}
+
+// Save saves a stack to the database
+func (r *DatabaseRepository) Save(stack *models.Stack) error {
+	data, err := json.Marshal(stack)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`INSERT INTO stacks (name, data) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data`,
+		stack.Name, string(data))
+	return err
+}
+
+// Delete deletes a stack from the database
+func (r *DatabaseRepository) Delete(name string) error {
+	_, err := r.db.Exec(`DELETE FROM stacks WHERE name = ?`, name)
+	return err
+}
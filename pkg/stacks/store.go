@@ -0,0 +1,212 @@
+package stacks
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+var logger = logging.For("stacks")
+
+// maxStackSize caps the number of VMs in one stack
+const maxStackSize = 50
+
+// validName matches stack and role names, which become part of VM names
+var validName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]*$`)
+
+// Store keeps stacks and their membership. Stacks are saved to a Repository
+// after every change.
+type Store struct {
+	repository Repository
+	stacks     map[string]*models.Stack
+	mutex      sync.RWMutex
+}
+
+// NewStore creates a stack store persisted to repository, loading any stacks
+// already saved there
+func NewStore(repository Repository) *Store {
+	s := &Store{repository: repository}
+	stacks, err := s.load()
+	if err != nil {
+		logger.Error("Failed to load stacks", "error", err)
+	}
+	s.stacks = stacks
+	return s
+}
+
+// NewStoreFromEnv creates a stack store in db, or persisted at STACKS_PATH
+// (default ./data/stacks.json) when db is nil. The first time a database is
+// used, the stacks in the file are copied into it.
+func NewStoreFromEnv(db *storage.DB) (*Store, error) {
+	path := os.Getenv("STACKS_PATH")
+	if path == "" {
+		path = filepath.Join("data", "stacks.json")
+	}
+	if db == nil {
+		return NewStore(NewFileRepository(path)), nil
+	}
+
+	repository := NewDatabaseRepository(db)
+	err := db.ImportOnce("stacks", func() (int, error) {
+		stacks, err := NewFileRepository(path).Load()
+		if err != nil {
+			return 0, err
+		}
+		for _, stack := range stacks {
+			if err := repository.Save(stack); err != nil {
+				return 0, err
+			}
+		}
+		return len(stacks), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(repository), nil
+}
+
+// load reads the saved stacks
+func (s *Store) load() (map[string]*models.Stack, error) {
+	stacks := make(map[string]*models.Stack)
+	saved, err := s.repository.Load()
+	for _, stack := range saved {
+		stacks[stack.Name] = stack
+	}
+	return stacks, err
+}
+
+// Reload reads the saved stacks again, picking up the changes another master
+// sharing the database made
+func (s *Store) Reload() error {
+	stacks, err := s.load()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stacks = stacks
+	return nil
+}
+
+// save saves a stack; the caller must hold the lock
+func (s *Store) save(stack *models.Stack) {
+	if err := s.repository.Save(stack); err != nil {
+		logger.Error("Failed to save stack", "stack", stack.Name, "error", err)
+	}
+}
+
+// Expand validates a stack request and expands it into one create request
+// per VM, along with the members those VMs will become
+func Expand(req models.StackCreateRequest) ([]models.VMCreateRequest, []models.StackMember, error) {
+	if !validName.MatchString(req.Name) {
+		return nil, nil, fmt.Errorf("stack name must start with a letter and contain only letters, digits and hyphens")
+	}
+	if len(req.Groups) == 0 {
+		return nil, nil, fmt.Errorf("at least one group is required")
+	}
+
+	reqs := []models.VMCreateRequest{}
+	members := []models.StackMember{}
+	roles := make(map[string]bool)
+	for _, group := range req.Groups {
+		if !validName.MatchString(group.Role) {
+			return nil, nil, fmt.Errorf("group role must start with a letter and contain only letters, digits and hyphens")
+		}
+		if roles[group.Role] {
+			return nil, nil, fmt.Errorf("duplicate group role: %s", group.Role)
+		}
+		roles[group.Role] = true
+		if group.Count <= 0 {
+			return nil, nil, fmt.Errorf("group '%s' needs a positive count", group.Role)
+		}
+
+		for i := 1; i <= group.Count; i++ {
+			vm := group.VMCreateRequest
+			vm.Name = fmt.Sprintf("%s-%s-%d", req.Name, group.Role, i)
+			labels := make(map[string]string, len(vm.Labels)+2)
+			for key, value := range vm.Labels {
+				labels[key] = value
+			}
+			labels["stack"] = req.Name
+			labels["stack-role"] = group.Role
+			vm.Labels = labels
+			reqs = append(reqs, vm)
+			members = append(members, models.StackMember{VMName: vm.Name, Role: group.Role})
+		}
+	}
+
+	if len(reqs) > maxStackSize {
+		return nil, nil, fmt.Errorf("a stack may have at most %d VMs", maxStackSize)
+	}
+	return reqs, members, nil
+}
+
+// Reserve records a new stack with no members yet, failing if the name is taken
+func (s *Store) Reserve(stack *models.Stack) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.stacks[stack.Name]; exists {
+		return fmt.Errorf("stack '%s' already exists", stack.Name)
+	}
+	s.stacks[stack.Name] = stack
+	s.save(stack)
+	return nil
+}
+
+// Get gets a stack by name
+func (s *Store) Get(name string) *models.Stack {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.stacks[name]
+}
+
+// List lists all stacks ordered by name
+func (s *Store) List() []*models.Stack {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	stacks := make([]*models.Stack, 0, len(s.stacks))
+	for _, stack := range s.stacks {
+		stacks = append(stacks, stack)
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		return stacks[i].Name < stacks[j].Name
+	})
+	return stacks
+}
+
+// SetMembers replaces the members of a stack
+func (s *Store) SetMembers(name string, members []models.StackMember) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if current, exists := s.stacks[name]; exists {
+		updated := *current
+		updated.Members = members
+		s.stacks[name] = &updated
+		s.save(&updated)
+	}
+}
+
+// Remove removes a stack
+func (s *Store) Remove(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.stacks[name]; exists {
+		delete(s.stacks, name)
+		if err := s.repository.Delete(name); err != nil {
+			logger.Error("Failed to delete stack", "stack", name, "error", err)
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// migration upgrades the schema by one version. Statements are written for
+// both SQLite and Postgres; {{id}} stands for an auto-increment primary key.
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// migrations are applied in order, each once. Never change one that has been
+// released: add another.
+var migrations = []migration{
+	{version: 1, name: "initial schema", statements: []string{
+		`CREATE TABLE users (
+			username TEXT PRIMARY KEY,
+			data     TEXT NOT NULL
+		)`,
+		`CREATE TABLE sessions (
+			id         TEXT PRIMARY KEY,
+			username   TEXT NOT NULL,
+			data       TEXT NOT NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX sessions_username ON sessions (username)`,
+		`CREATE INDEX sessions_expires_at ON sessions (expires_at)`,
+		`CREATE TABLE agents (
+			agent_id TEXT PRIMARY KEY,
+			data     TEXT NOT NULL,
+			api_key  TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE vm_metadata (
+			agent_id TEXT NOT NULL,
+			vm_name  TEXT NOT NULL,
+			data     TEXT NOT NULL,
+			PRIMARY KEY (agent_id, vm_name)
+		)`,
+		`CREATE TABLE templates (
+			name TEXT PRIMARY KEY,
+			data TEXT NOT NULL
+		)`,
+		`CREATE TABLE quotas (
+			scope   TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			data    TEXT NOT NULL,
+			PRIMARY KEY (scope, subject)
+		)`,
+		`CREATE TABLE tasks (
+			id          TEXT PRIMARY KEY,
+			finished_at BIGINT NOT NULL,
+			data        TEXT NOT NULL
+		)`,
+		`CREATE INDEX tasks_finished_at ON tasks (finished_at)`,
+		`CREATE TABLE audit_log (
+			id       {{id}},
+			time     BIGINT NOT NULL,
+			username TEXT NOT NULL DEFAULT '',
+			token    TEXT NOT NULL DEFAULT '',
+			agent_id TEXT NOT NULL DEFAULT '',
+			vm_name  TEXT NOT NULL DEFAULT '',
+			route    TEXT NOT NULL DEFAULT '',
+			status   INTEGER NOT NULL DEFAULT 0,
+			data     TEXT NOT NULL
+		)`,
+		`CREATE INDEX audit_log_time ON audit_log (time)`,
+		`CREATE INDEX audit_log_username ON audit_log (username)`,
+		`CREATE TABLE legacy_imports (
+			name        TEXT PRIMARY KEY,
+			imported_at BIGINT NOT NULL
+		)`,
+	}},
+	{version: 2, name: "agent approvals and leases", statements: []string{
+		`CREATE TABLE agent_approvals (
+			agent_id TEXT PRIMARY KEY,
+			data     TEXT NOT NULL
+		)`,
+		`CREATE TABLE leases (
+			name       TEXT PRIMARY KEY,
+			holder     TEXT NOT NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+	}},
+	{version: 3, name: "API tokens and stacks", statements: []string{
+		`CREATE TABLE api_tokens (
+			id       TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			data     TEXT NOT NULL
+		)`,
+		`CREATE INDEX api_tokens_username ON api_tokens (username)`,
+		`CREATE TABLE stacks (
+			name TEXT PRIMARY KEY,
+			data TEXT NOT NULL
+		)`,
+	}},
+}
+
+// migrate applies the migrations the database has not seen, in one
+// transaction. On Postgres an advisory lock keeps masters starting together
+// from migrating at once.
+func (db *DB) migrate() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *Tx) error {
+		if db.driver == DriverPostgres {
+			var locked string
+			if err := tx.QueryRow(`SELECT pg_advisory_xact_lock(4242001)::text`).Scan(&locked); err != nil {
+				return err
+			}
+		}
+
+		var current int
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+			return err
+		}
+		latest := migrations[len(migrations)-1].version
+		if current > latest {
+			return fmt.Errorf("the schema is at version %d, newer than this master knows (%d); upgrade the master", current, latest)
+		}
+
+		for _, m := range migrations {
+			if m.version <= current {
+				continue
+			}
+			for _, statement := range m.statements {
+				if _, err := tx.Exec(db.dialect(statement)); err != nil {
+					return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+				}
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+				m.version, m.name, time.Now().UnixNano())
+			if err != nil {
+				return err
+			}
+			logger.Info("Applied schema migration", "version", m.version, "name", m.name, "database", db.String())
+		}
+		return nil
+	})
+}
+
+// dialect fills in the parts of a statement that differ between databases
+func (db *DB) dialect(statement string) string {
+	id := "INTEGER PRIMARY KEY AUTOINCREMENT"
+	if db.driver == DriverPostgres {
+		id = "BIGSERIAL PRIMARY KEY"
+	}
+	return strings.ReplaceAll(statement, "{{id}}", id)
+}
+
+// SchemaVersion gets the version of the database's schema
+func (db *DB) SchemaVersion() (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
@@ -0,0 +1,7 @@
+//go:build postgres
+
+package storage
+
+// The Postgres driver is only linked into builds tagged postgres, so the
+// default build carries no driver it does not use.
+import _ "github.com/jackc/pgx/v5/stdlib"
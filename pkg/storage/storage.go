@@ -0,0 +1,258 @@
+// Package storage is the database the master keeps its state in: users,
+// sessions, agents and their approvals, VM metadata, templates, quotas, tasks
+// and the audit log. SQLite, in a file next to the master, is the default;
+// Postgres lets several masters share their state. Each package that
+// persists state defines its own repository interface, implemented both on
+// this database and on the JSON files the master used before it, and the
+// schema is created and upgraded by the migrations in this package as the
+// database is opened.
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prashah/batwa/pkg/logging"
+	_ "modernc.org/sqlite"
+)
+
+var logger = logging.For("storage")
+
+// The drivers STORAGE_DRIVER names
+const (
+	// DriverFiles keeps state in JSON files, as the master did before it had
+	// a database
+	DriverFiles = "files"
+	// DriverSQLite keeps state in a SQLite database file
+	DriverSQLite = "sqlite"
+	// DriverPostgres keeps state in a Postgres database
+	DriverPostgres = "postgres"
+)
+
+// DefaultSQLitePath is where the SQLite database is kept unless STORAGE_DSN
+// says otherwise
+var DefaultSQLitePath = filepath.Join("data", "batwa.db")
+
+// DB is the master's database. Queries are written with ? placeholders,
+// which are rewritten for Postgres.
+type DB struct {
+	db     *sql.DB
+	driver string
+	// location names the database in logs, without credentials
+	location string
+}
+
+// Open opens the database of driver at dsn, a file path for SQLite or a
+// connection URL for Postgres, and brings its schema up to date
+func Open(driver, dsn string) (*DB, error) {
+	var db *DB
+	var err error
+	switch driver {
+	case DriverSQLite:
+		db, err = openSQLite(dsn)
+	case DriverPostgres:
+		db, err = openPostgres(dsn)
+	default:
+		return nil, fmt.Errorf("unknown storage driver '%s': use sqlite or postgres", driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := db.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate %s: %w", db, err)
+	}
+	return db, nil
+}
+
+// OpenFromEnv opens the database STORAGE_DRIVER names: sqlite (the default)
+// at STORAGE_DSN (default ./data/batwa.db), or postgres at the STORAGE_DSN
+// connection URL. With STORAGE_DRIVER=files it returns nil, and state stays
+// in JSON files.
+func OpenFromEnv() (*DB, error) {
+	driver := os.Getenv("STORAGE_DRIVER")
+	dsn := os.Getenv("STORAGE_DSN")
+	switch driver {
+	case DriverFiles:
+		return nil, nil
+	case "", DriverSQLite:
+		if dsn == "" {
+			dsn = DefaultSQLitePath
+		}
+		return Open(DriverSQLite, dsn)
+	case DriverPostgres:
+		if dsn == "" {
+			return nil, fmt.Errorf("STORAGE_DSN is required with STORAGE_DRIVER=postgres")
+		}
+		return Open(DriverPostgres, dsn)
+	}
+	return nil, fmt.Errorf("unknown STORAGE_DRIVER '%s': use sqlite, postgres or files", driver)
+}
+
+// openSQLite opens, creating if needed, the SQLite database at path
+func openSQLite(path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	// Create the file first, so it and SQLite's journal files are private
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite takes one writer at a time
+	db.SetMaxOpenConns(1)
+	return &DB{db: db, driver: DriverSQLite, location: path}, nil
+}
+
+// openPostgres connects to the Postgres database at a connection URL. The
+// driver is not built in by default: build the master with -tags postgres.
+func openPostgres(dsn string) (*DB, error) {
+	name := ""
+	for _, driver := range sql.Drivers() {
+		if driver == "pgx" || driver == "postgres" {
+			name = driver
+			break
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("this build has no Postgres driver: build the master with -tags postgres")
+	}
+
+	location := "postgres"
+	if parsed, err := url.Parse(dsn); err == nil && parsed.Host != "" {
+		location = "postgres://" + parsed.Host + parsed.Path
+	}
+	db, err := sql.Open(name, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(16)
+	db.SetConnMaxIdleTime(5 * time.Minute)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", location, err)
+	}
+	return &DB{db: db, driver: DriverPostgres, location: location}, nil
+}
+
+// Driver names the database's driver, sqlite or postgres
+func (db *DB) Driver() string {
+	return db.driver
+}
+
+// String names the database for logs, without credentials
+func (db *DB) String() string {
+	return db.location
+}
+
+// Exec runs a statement
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.db.Exec(db.rebind(query), args...)
+}
+
+// Query runs a query returning rows
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.db.Query(db.rebind(query), args...)
+}
+
+// QueryRow runs a query returning at most one row
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	return db.db.QueryRow(db.rebind(query), args...)
+}
+
+// Transaction runs fn in a transaction, committed if fn returns nil and
+// rolled back otherwise
+func (db *DB) Transaction(fn func(tx *Tx) error) error {
+	sqlTx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(&Tx{tx: sqlTx, db: db}); err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+// Ping checks that the database can be reached
+func (db *DB) Ping() error {
+	return db.db.Ping()
+}
+
+// Close closes the database
+func (db *DB) Close() error {
+	return db.db.Close()
+}
+
+// rebind rewrites ? placeholders as $1, $2... for Postgres
+func (db *DB) rebind(query string) string {
+	if db.driver != DriverPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Tx is a transaction on the database
+type Tx struct {
+	tx *sql.Tx
+	db *DB
+}
+
+// Exec runs a statement in the transaction
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.tx.Exec(tx.db.rebind(query), args...)
+}
+
+// QueryRow runs a query returning at most one row in the transaction
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.tx.QueryRow(tx.db.rebind(query), args...)
+}
+
+// ImportOnce runs load the first time a database sees name, to bring in the
+// JSON file a store kept before the master had a database. load returns how
+// many records it imported. A store emptied later is not imported again.
+func (db *DB) ImportOnce(name string, load func() (int, error)) error {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM legacy_imports WHERE name = ?`, name).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	imported, err := load()
+	if err != nil {
+		return fmt.Errorf("failed to import %s: %w", name, err)
+	}
+	_, err = db.Exec(`INSERT INTO legacy_imports (name, imported_at) VALUES (?, ?)
+		ON CONFLICT (name) DO NOTHING`, name, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
+		logger.Info("Imported records kept before the database", "store", name, "records", imported, "database", db.String())
+	}
+	return nil
+}
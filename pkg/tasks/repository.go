@@ -0,0 +1,157 @@
+package tasks
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+// Repository persists finished tasks. The store keeps every task in memory
+// and saves each one through to the repository as it finishes.
+type Repository interface {
+	Load() ([]models.Task, error)
+	// Save saves a finished task, replacing any of the same ID
+	Save(task *models.Task) error
+	// Prune deletes the tasks that finished before cutoff
+	Prune(cutoff time.Time) error
+}
+
+// FileRepository keeps finished tasks in a JSON file, rewritten on every
+// change
+type FileRepository struct {
+	path  string
+	tasks map[string]models.Task
+	mutex sync.Mutex
+}
+
+// NewFileRepository keeps finished tasks in the JSON file at path
+func NewFileRepository(path string) *FileRepository {
+	return &FileRepository{path: path, tasks: make(map[string]models.Task)}
+}
+
+// Load reads the tasks saved in the file
+func (r *FileRepository) Load() ([]models.Task, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []models.Task
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for _, task := range saved {
+		r.tasks[task.ID] = task
+	}
+	return saved, nil
+}
+
+// Save saves a task by rewriting the file
+func (r *FileRepository) Save(task *models.Task) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.tasks[task.ID] = copyTask(task)
+	return r.write()
+}
+
+// Prune deletes old tasks by rewriting the file
+func (r *FileRepository) Prune(cutoff time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id, task := range r.tasks {
+		if task.FinishedAt != nil && task.FinishedAt.Before(cutoff) {
+			delete(r.tasks, id)
+		}
+	}
+	return r.write()
+}
+
+// write writes the tasks to the file, oldest first; the caller must hold the
+// lock
+func (r *FileRepository) write() error {
+	finished := make([]models.Task, 0, len(r.tasks))
+	for _, task := range r.tasks {
+		finished = append(finished, task)
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].CreatedAt.Before(finished[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(finished, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// DatabaseRepository keeps finished tasks in the master's database
+type DatabaseRepository struct {
+	db *storage.DB
+}
+
+// NewDatabaseRepository keeps finished tasks in db
+func NewDatabaseRepository(db *storage.DB) *DatabaseRepository {
+	return &DatabaseRepository{db: db}
+}
+
+// Load loads every task from the database
+func (r *DatabaseRepository) Load() ([]models.Task, error) {
+	rows, err := r.db.Query(`SELECT data FROM tasks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var saved []models.Task
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var task models.Task
+		if err := json.Unmarshal([]byte(data), &task); err != nil {
+			return nil, err
+		}
+		saved = append(saved, task)
+	}
+	return saved, rows.Err()
+}
+
+// Save saves a task to the database
+func (r *DatabaseRepository) Save(task *models.Task) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	var finishedAt int64
+	if task.FinishedAt != nil {
+		finishedAt = task.FinishedAt.UnixNano()
+	}
+	_, err = r.db.Exec(`INSERT INTO tasks (id, finished_at, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET finished_at = excluded.finished_at, data = excluded.data`,
+		task.ID, finishedAt, string(data))
+	return err
+}
+
+// Prune deletes the tasks that finished before cutoff
+func (r *DatabaseRepository) Prune(cutoff time.Time) error {
+	_, err := r.db.Exec(`DELETE FROM tasks WHERE finished_at < ?`, cutoff.UnixNano())
+	return err
+}
@@ -0,0 +1,370 @@
+// Package tasks tracks the mutating VM operations the master runs, so clients
+// can start an operation, get a task ID at once and follow its progress
+// instead of waiting on a blocking request. Finished tasks are kept as a
+// history of what happened to each VM.
+package tasks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+var logger = logging.For("tasks")
+
+// DefaultRetentionDays is how long a finished task is kept unless
+// TASK_RETENTION_DAYS overrides it
+const DefaultRetentionDays = 30
+
+// Query filters tasks. Zero values match everything.
+type Query struct {
+	User    string
+	AgentID string
+	VMName  string
+	State   string
+	Since   time.Time
+	Limit   int
+	Offset  int
+}
+
+// matches reports whether a task satisfies the query
+func (q Query) matches(task *models.Task) bool {
+	switch {
+	case q.User != "" && task.User != q.User,
+		q.AgentID != "" && task.AgentID != q.AgentID,
+		q.VMName != "" && task.VMName != q.VMName,
+		q.State != "" && task.State != q.State,
+		!q.Since.IsZero() && task.CreatedAt.Before(q.Since):
+		return false
+	}
+	return true
+}
+
+// Store keeps tasks in memory and saves the finished ones to a Repository, so
+// the history survives master restarts
+type Store struct {
+	repository Repository
+	retention  time.Duration
+	tasks      map[string]*models.Task
+	// token marks the master's own replays of a request as the run of a task
+	token string
+	mutex sync.RWMutex
+}
+
+// NewStore creates a task store persisted to repository, keeping finished
+// tasks for retention and loading the ones already saved there
+func NewStore(repository Repository, retention time.Duration) *Store {
+	token := make([]byte, 32)
+	rand.Read(token)
+	s := &Store{
+		repository: repository,
+		retention:  retention,
+		tasks:      make(map[string]*models.Task),
+		token:      hex.EncodeToString(token),
+	}
+	if err := s.load(); err != nil {
+		logger.Error("Failed to load tasks", "error", err)
+	}
+	return s
+}
+
+// NewStoreFromEnv creates a task store in db, or persisted at TASKS_PATH
+// (default ./data/tasks.json) when db is nil, keeping finished tasks for
+// TASK_RETENTION_DAYS (default 30) days. The first time a database is used,
+// the tasks in the file are copied into it.
+func NewStoreFromEnv(db *storage.DB) (*Store, error) {
+	path := os.Getenv("TASKS_PATH")
+	if path == "" {
+		path = filepath.Join("data", "tasks.json")
+	}
+	days := DefaultRetentionDays
+	if value := os.Getenv("TASK_RETENTION_DAYS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			days = parsed
+		} else {
+			logger.Warn("Invalid TASK_RETENTION_DAYS, using the default", "value", value, "default", DefaultRetentionDays)
+		}
+	}
+	retention := time.Duration(days) * 24 * time.Hour
+	if db == nil {
+		return NewStore(NewFileRepository(path), retention), nil
+	}
+
+	repository := NewDatabaseRepository(db)
+	err := db.ImportOnce("tasks", func() (int, error) {
+		tasks, err := NewFileRepository(path).Load()
+		if err != nil {
+			return 0, err
+		}
+		for i := range tasks {
+			if err := repository.Save(&tasks[i]); err != nil {
+				return 0, err
+			}
+		}
+		return len(tasks), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(repository, retention), nil
+}
+
+// load reads the saved tasks, dropping those past retention
+func (s *Store) load() error {
+	saved, err := s.repository.Load()
+	if err != nil {
+		return err
+	}
+	for i := range saved {
+		task := saved[i]
+		if task.Logs == nil {
+			task.Logs = []models.TaskLog{}
+		}
+		s.tasks[task.ID] = &task
+	}
+	s.prune(time.Now())
+	return nil
+}
+
+// save saves a finished task; the caller must hold the lock. Tasks still
+// running are not saved: they cannot resume after a restart.
+func (s *Store) save(task *models.Task) {
+	if err := s.repository.Save(task); err != nil {
+		logger.Error("Failed to save task", "task", task.ID, "error", err)
+	}
+}
+
+// Token gets the secret that marks a request as the run of a task. It is
+// generated at startup and never leaves the master.
+func (s *Store) Token() string {
+	return s.token
+}
+
+// Create records a pending task
+func (s *Store) Create(task models.Task) models.Task {
+	now := time.Now()
+	task.ID = uuid.NewString()
+	task.State = "pending"
+	task.CreatedAt = now
+	task.Logs = []models.TaskLog{}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.prune(now)
+	s.tasks[task.ID] = &task
+	return task
+}
+
+// Start marks a task as running
+func (s *Store) Start(id string) {
+	s.update(id, func(task *models.Task) {
+		now := time.Now()
+		task.State = "running"
+		task.StartedAt = &now
+	})
+}
+
+// Log appends a line to a task's log
+func (s *Store) Log(id, message string) {
+	s.update(id, func(task *models.Task) {
+		task.Logs = append(task.Logs, models.TaskLog{Time: time.Now(), Message: message})
+	})
+}
+
+// Finish records the HTTP status and response body of a task's operation. The
+// task failed if the status is an error or the body reports "success": false.
+func (s *Store) Finish(id string, status int, body []byte) {
+	state := "succeeded"
+	var reply struct {
+		Success *bool `json:"success"`
+	}
+	var result json.RawMessage
+	if json.Valid(body) {
+		result = append(json.RawMessage(nil), body...)
+		if json.Unmarshal(body, &reply) == nil && reply.Success != nil && !*reply.Success {
+			state = "failed"
+		}
+	} else if len(body) > 0 {
+		result, _ = json.Marshal(string(body))
+	}
+	if status >= 400 {
+		state = "failed"
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	task, exists := s.tasks[id]
+	if !exists {
+		return
+	}
+	now := time.Now()
+	if task.StartedAt == nil {
+		task.StartedAt = &now
+	}
+	task.FinishedAt = &now
+	task.State = state
+	task.Status = status
+	task.Result = result
+	s.save(task)
+}
+
+// Restore stores a finished task as a backup saved it, reporting whether it
+// could be saved. Unfinished tasks are not restored: they cannot resume.
+func (s *Store) Restore(task models.Task) error {
+	if task.FinishedAt == nil {
+		return fmt.Errorf("task %s has not finished", task.ID)
+	}
+	if task.Logs == nil {
+		task.Logs = []models.TaskLog{}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.repository.Save(&task); err != nil {
+		return err
+	}
+	s.tasks[task.ID] = &task
+	return nil
+}
+
+// Get gets a task by ID
+func (s *Store) Get(id string) (models.Task, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	task, exists := s.tasks[id]
+	if !exists {
+		return models.Task{}, false
+	}
+	return copyTask(task), true
+}
+
+// Search gets a page of the tasks matching the query, newest first, and how
+// many tasks match in all
+func (s *Store) Search(q Query) ([]models.Task, int) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	matched := []*models.Task{}
+	for _, task := range s.tasks {
+		if q.matches(task) {
+			matched = append(matched, task)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].CreatedAt.After(matched[j].CreatedAt)
+	})
+
+	total := len(matched)
+	if q.Offset > 0 {
+		matched = matched[min(q.Offset, total):]
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+	list := make([]models.Task, len(matched))
+	for i, task := range matched {
+		list[i] = copyTask(task)
+	}
+	return list, total
+}
+
+// Shutdown waits for the tasks still pending or running to finish until ctx
+// ends, then records those that did not as failed, since they cannot resume
+// after a restart, and saves the store. It returns how many were
+// interrupted.
+func (s *Store) Shutdown(ctx context.Context) int {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for s.unfinished() > 0 && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	interrupted := 0
+	now := time.Now()
+	for _, task := range s.tasks {
+		if task.FinishedAt != nil {
+			continue
+		}
+		if task.StartedAt == nil {
+			task.StartedAt = &now
+		}
+		task.FinishedAt = &now
+		task.State = "failed"
+		task.Logs = append(task.Logs, models.TaskLog{Time: now, Message: "Interrupted: the master shut down before the task finished"})
+		s.save(task)
+		interrupted++
+	}
+	if interrupted > 0 {
+		logger.Warn("Tasks interrupted by shutdown", "tasks", interrupted)
+	}
+	return interrupted
+}
+
+// unfinished counts the tasks still pending or running
+func (s *Store) unfinished() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	count := 0
+	for _, task := range s.tasks {
+		if task.FinishedAt == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// update changes a task under the lock
+func (s *Store) update(id string, change func(*models.Task)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if task, exists := s.tasks[id]; exists {
+		change(task)
+	}
+}
+
+// prune drops tasks that finished more than the retention period before now,
+// from memory and the repository, and returns how many were dropped; the
+// caller must hold the lock
+func (s *Store) prune(now time.Time) int {
+	removed := 0
+	cutoff := now.Add(-s.retention)
+	for id, task := range s.tasks {
+		if task.FinishedAt != nil && task.FinishedAt.Before(cutoff) {
+			delete(s.tasks, id)
+			removed++
+		}
+	}
+	if removed > 0 {
+		if err := s.repository.Prune(cutoff); err != nil {
+			logger.Error("Failed to prune tasks", "error", err)
+		}
+	}
+	return removed
+}
+
+// copyTask copies a task so callers never share its log with the store
+func copyTask(task *models.Task) models.Task {
+	copied := *task
+	copied.Logs = make([]models.TaskLog, len(task.Logs))
+	copy(copied.Logs, task.Logs)
+	return copied
+}
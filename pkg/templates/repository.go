@@ -0,0 +1,141 @@
+package templates
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+// Repository persists VM templates. The store keeps every template in memory
+// and writes each change through to the repository.
+type Repository interface {
+	Load() ([]*models.VMTemplate, error)
+	// Save saves a template, replacing any of the same name
+	Save(template *models.VMTemplate) error
+	Delete(name string) error
+}
+
+// FileRepository keeps templates in a JSON file, rewritten on every change
+type FileRepository struct {
+	path      string
+	templates map[string]*models.VMTemplate
+	mutex     sync.Mutex
+}
+
+// NewFileRepository keeps templates in the JSON file at path
+func NewFileRepository(path string) *FileRepository {
+	return &FileRepository{path: path, templates: make(map[string]*models.VMTemplate)}
+}
+
+// Load reads the templates saved in the file
+func (r *FileRepository) Load() ([]*models.VMTemplate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var templates []*models.VMTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, err
+	}
+	for _, template := range templates {
+		r.templates[template.Name] = template
+	}
+	return templates, nil
+}
+
+// Save saves a template by rewriting the file
+func (r *FileRepository) Save(template *models.VMTemplate) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.templates[template.Name] = template
+	return r.write()
+}
+
+// Delete deletes a template by rewriting the file
+func (r *FileRepository) Delete(name string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.templates, name)
+	return r.write()
+}
+
+// write writes all templates to the file; the caller must hold the lock
+func (r *FileRepository) write() error {
+	templates := make([]*models.VMTemplate, 0, len(r.templates))
+	for _, template := range r.templates {
+		templates = append(templates, template)
+	}
+	data, err := json.MarshalIndent(templates, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// DatabaseRepository keeps templates in the master's database
+type DatabaseRepository struct {
+	db *storage.DB
+}
+
+// NewDatabaseRepository keeps templates in db
+func NewDatabaseRepository(db *storage.DB) *DatabaseRepository {
+	return &DatabaseRepository{db: db}
+}
+
+// Load loads every template from the database
+func (r *DatabaseRepository) Load() ([]*models.VMTemplate, error) {
+	rows, err := r.db.Query(`SELECT data FROM templates`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []*models.VMTemplate
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var template models.VMTemplate
+		if err := json.Unmarshal([]byte(data), &template); err != nil {
+			return nil, err
+		}
+		templates = append(templates, &template)
+	}
+	return templates, rows.Err()
+}
+
+// Save saves a template to the database
+func (r *DatabaseRepository) Save(template *models.VMTemplate) error {
+	data, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`INSERT INTO templates (name, data) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data`,
+		template.Name, string(data))
+	return err
+}
+
+// Delete deletes a template from the database
+func (r *DatabaseRepository) Delete(name string) error {
+	_, err := r.db.Exec(`DELETE FROM templates WHERE name = ?`, name)
+	return err
+}
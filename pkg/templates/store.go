@@ -0,0 +1,258 @@
+package templates
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/cloudinit"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/multipass"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+var logger = logging.For("templates")
+
+// maxCPUs caps the CPUs a template may ask for
+const maxCPUs = 64
+
+var (
+	// validName matches template names, which are used in URLs
+	validName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9._-]*$`)
+	// validSize matches multipass memory and disk sizes such as 512M, 2G or 10GiB
+	validSize = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([KMGkmg](i?B)?)?$`)
+)
+
+// Store keeps VM templates. Templates are saved to a Repository after every
+// change.
+type Store struct {
+	repository Repository
+	templates  map[string]*models.VMTemplate
+	mutex      sync.RWMutex
+}
+
+// NewStore creates a template store persisted to repository, loading any
+// templates already saved there
+func NewStore(repository Repository) *Store {
+	s := &Store{
+		repository: repository,
+		templates:  make(map[string]*models.VMTemplate),
+	}
+	templates, err := repository.Load()
+	if err != nil {
+		logger.Error("Failed to load templates", "error", err)
+	}
+	for _, template := range templates {
+		s.templates[template.Name] = template
+	}
+	return s
+}
+
+// NewStoreFromEnv creates a template store in db, or persisted at
+// TEMPLATES_PATH (default ./data/templates.json) when db is nil. The first
+// time a database is used, the templates in the file are copied into it.
+func NewStoreFromEnv(db *storage.DB) (*Store, error) {
+	path := os.Getenv("TEMPLATES_PATH")
+	if path == "" {
+		path = filepath.Join("data", "templates.json")
+	}
+	if db == nil {
+		return NewStore(NewFileRepository(path)), nil
+	}
+
+	repository := NewDatabaseRepository(db)
+	err := db.ImportOnce("templates", func() (int, error) {
+		templates, err := NewFileRepository(path).Load()
+		if err != nil {
+			return 0, err
+		}
+		for _, template := range templates {
+			if err := repository.Save(template); err != nil {
+				return 0, err
+			}
+		}
+		return len(templates), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(repository), nil
+}
+
+// save saves a template; the caller must hold the lock
+func (s *Store) save(template *models.VMTemplate) {
+	if err := s.repository.Save(template); err != nil {
+		logger.Error("Failed to save template", "template", template.Name, "error", err)
+	}
+}
+
+// Validate checks a template's fields. Named cloud-init templates must exist
+// when the template is saved, not only when it is launched.
+func Validate(template *models.VMTemplate) error {
+	if !validName.MatchString(template.Name) {
+		return fmt.Errorf("template name must start with a letter and contain only letters, digits, '.', '_' and '-'")
+	}
+	if template.CPUs < 0 {
+		return fmt.Errorf("cpus cannot be negative")
+	}
+	if template.CPUs > maxCPUs {
+		return fmt.Errorf("cpus must be at most %d", maxCPUs)
+	}
+	if template.Memory != "" && !validSize.MatchString(template.Memory) {
+		return fmt.Errorf("invalid memory size: %s", template.Memory)
+	}
+	if template.Disk != "" && !validSize.MatchString(template.Disk) {
+		return fmt.Errorf("invalid disk size: %s", template.Disk)
+	}
+	if strings.ContainsAny(template.Image, " \t\n") {
+		return fmt.Errorf("invalid image: %q", template.Image)
+	}
+	if err := multipass.ValidateNetworks(template.Networks); err != nil {
+		return err
+	}
+	if _, err := cloudinit.Resolve(template.CloudInit); err != nil {
+		return err
+	}
+	for key := range template.Labels {
+		if strings.TrimSpace(key) == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid label key: %q", key)
+		}
+	}
+	return nil
+}
+
+// Add validates and stores a new template, failing if the name is taken
+func (s *Store) Add(template *models.VMTemplate) error {
+	if err := Validate(template); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.templates[template.Name]; exists {
+		return fmt.Errorf("template '%s' already exists", template.Name)
+	}
+	template.CreatedAt = time.Now()
+	template.UpdatedAt = template.CreatedAt
+	s.templates[template.Name] = template
+	s.save(template)
+	return nil
+}
+
+// Update validates and replaces an existing template, keeping its creation
+// details. It returns false when there is no template by that name.
+func (s *Store) Update(template *models.VMTemplate) (bool, error) {
+	if err := Validate(template); err != nil {
+		return true, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current, exists := s.templates[template.Name]
+	if !exists {
+		return false, nil
+	}
+	template.CreatedBy = current.CreatedBy
+	template.CreatedAt = current.CreatedAt
+	template.UpdatedAt = time.Now()
+	s.templates[template.Name] = template
+	s.save(template)
+	return true, nil
+}
+
+// Restore validates and stores a template as a backup saved it, keeping its
+// creation details, and reports whether it could be saved
+func (s *Store) Restore(template *models.VMTemplate) error {
+	if err := Validate(template); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.repository.Save(template); err != nil {
+		return err
+	}
+	s.templates[template.Name] = template
+	return nil
+}
+
+// Get gets a template by name
+func (s *Store) Get(name string) *models.VMTemplate {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.templates[name]
+}
+
+// List lists all templates ordered by name
+func (s *Store) List() []*models.VMTemplate {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	templates := make([]*models.VMTemplate, 0, len(s.templates))
+	for _, template := range s.templates {
+		templates = append(templates, template)
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name < templates[j].Name
+	})
+	return templates
+}
+
+// Remove removes a template
+func (s *Store) Remove(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.templates[name]; exists {
+		delete(s.templates, name)
+		if err := s.repository.Delete(name); err != nil {
+			logger.Error("Failed to save templates", "template", name, "error", err)
+		}
+		return true
+	}
+	return false
+}
+
+// Apply fills in the fields a create request leaves empty from a template.
+// Labels are merged, with the request's own labels taking precedence, and the
+// VM is labelled template=<name>.
+func Apply(template *models.VMTemplate, req models.VMCreateRequest) models.VMCreateRequest {
+	if req.CPUs == 0 {
+		req.CPUs = template.CPUs
+	}
+	if req.Memory == "" {
+		req.Memory = template.Memory
+	}
+	if req.Disk == "" {
+		req.Disk = template.Disk
+	}
+	if req.Image == "" {
+		req.Image = template.Image
+	}
+	if req.CloudInit == "" {
+		req.CloudInit = template.CloudInit
+	}
+	if len(req.Networks) == 0 {
+		req.Networks = template.Networks
+	}
+
+	labels := make(map[string]string, len(template.Labels)+len(req.Labels)+1)
+	for key, value := range template.Labels {
+		labels[key] = value
+	}
+	labels["template"] = template.Name
+	for key, value := range req.Labels {
+		labels[key] = value
+	}
+	req.Labels = labels
+	req.Template = ""
+	return req
+}
@@ -0,0 +1,260 @@
+// Package tlsconfig lets the master and agents serve HTTPS and WSS
+// themselves, from a certificate and key on disk or from certificates
+// obtained from Let's Encrypt or another ACME CA, instead of behind a TLS
+// terminating reverse proxy.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/prashah/batwa/pkg/logging"
+)
+
+var logger = logging.For("tlsconfig")
+
+// reloadInterval is how often the certificate files are checked for
+// renewal, so a renewed certificate is served without a restart
+const reloadInterval = time.Minute
+
+// challengeAddr is where ACME HTTP-01 challenges are answered; plain HTTP
+// requests there are redirected to HTTPS
+const challengeAddr = ":80"
+
+// Config is how a server serves TLS: from CertFile and KeyFile, from ACME
+// certificates for ACMEDomains, or not at all when neither is set
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// ACMEDomains are the names to get certificates for; the server must be
+	// reachable at them on port 443, or on port 80 for HTTP-01 challenges
+	ACMEDomains []string
+	// ACMEEmail is given to the CA for expiry and problem notices
+	ACMEEmail string
+	// ACMEDirectory is the CA's directory URL, Let's Encrypt's by default
+	ACMEDirectory string
+	// ACMECacheDir keeps the account key and certificates across restarts
+	ACMECacheDir string
+}
+
+// Flags are the command-line flags that configure TLS
+type Flags struct {
+	cert, key, acmeDomains, acmeEmail, acmeDirectory, acmeCacheDir *string
+}
+
+// RegisterFlags registers --tls-cert, --tls-key, --acme-domains,
+// --acme-email, --acme-directory and --acme-cache-dir on the default flag
+// set. They default to $TLS_CERT, $TLS_KEY, $ACME_DOMAINS, $ACME_EMAIL,
+// $ACME_DIRECTORY and $ACME_CACHE_DIR, the last falling back to cacheDir.
+func RegisterFlags(cacheDir string) *Flags {
+	if dir := os.Getenv("ACME_CACHE_DIR"); dir != "" {
+		cacheDir = dir
+	}
+	return &Flags{
+		cert:          flag.String("tls-cert", os.Getenv("TLS_CERT"), "PEM certificate (chain) file to serve HTTPS with (defaults to $TLS_CERT)"),
+		key:           flag.String("tls-key", os.Getenv("TLS_KEY"), "PEM private key file of --tls-cert (defaults to $TLS_KEY)"),
+		acmeDomains:   flag.String("acme-domains", os.Getenv("ACME_DOMAINS"), "Comma separated domains to serve HTTPS for with certificates from Let's Encrypt (defaults to $ACME_DOMAINS)"),
+		acmeEmail:     flag.String("acme-email", os.Getenv("ACME_EMAIL"), "Contact email for the ACME account (defaults to $ACME_EMAIL)"),
+		acmeDirectory: flag.String("acme-directory", os.Getenv("ACME_DIRECTORY"), "ACME directory URL of a CA other than Let's Encrypt (defaults to $ACME_DIRECTORY)"),
+		acmeCacheDir:  flag.String("acme-cache-dir", cacheDir, "Directory ACME account keys and certificates are kept in (defaults to $ACME_CACHE_DIR)"),
+	}
+}
+
+// Config gets the configuration the flags were parsed to, once flag.Parse
+// has run
+func (f *Flags) Config() (Config, error) {
+	config := Config{
+		CertFile:      *f.cert,
+		KeyFile:       *f.key,
+		ACMEEmail:     *f.acmeEmail,
+		ACMEDirectory: *f.acmeDirectory,
+		ACMECacheDir:  *f.acmeCacheDir,
+	}
+	for _, domain := range strings.Split(*f.acmeDomains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			config.ACMEDomains = append(config.ACMEDomains, domain)
+		}
+	}
+	return config, config.Validate()
+}
+
+// Validate checks the certificate files come as a pair and are not mixed
+// with ACME
+func (c Config) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("--tls-cert and --tls-key must be given together")
+	}
+	if c.CertFile != "" && len(c.ACMEDomains) > 0 {
+		return errors.New("use either --tls-cert and --tls-key or --acme-domains, not both")
+	}
+	if len(c.ACMEDomains) > 0 && c.ACMECacheDir == "" {
+		return errors.New("--acme-domains needs an --acme-cache-dir")
+	}
+	return nil
+}
+
+// Enabled reports whether TLS is configured
+func (c Config) Enabled() bool {
+	return c.CertFile != "" || len(c.ACMEDomains) > 0
+}
+
+// Scheme is the URL scheme the server is reached with, https or http
+func (c Config) Scheme() string {
+	if c.Enabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// ServerName is the name the certificate is for: the first ACME domain or
+// the first DNS name of the certificate file. It is empty without TLS, or
+// when the certificate names only IP addresses.
+func (c Config) ServerName() string {
+	if len(c.ACMEDomains) > 0 {
+		return c.ACMEDomains[0]
+	}
+	if c.CertFile == "" {
+		return ""
+	}
+	pair, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil || len(pair.Certificate) == 0 {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil || len(leaf.DNSNames) == 0 {
+		return ""
+	}
+	return leaf.DNSNames[0]
+}
+
+// Listen serves app on addr, over TLS when it is configured
+func (c Config) Listen(app *fiber.App, addr string) error {
+	if !c.Enabled() {
+		return app.Listen(addr)
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	ln, err := tls.Listen("tcp", addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	return app.Listener(ln)
+}
+
+// tlsConfig builds the server's TLS configuration
+func (c Config) tlsConfig() (*tls.Config, error) {
+	if c.CertFile != "" {
+		certs, err := newCertReloader(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.certificate,
+		}, nil
+	}
+
+	if err := os.MkdirAll(c.ACMECacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create ACME cache directory: %w", err)
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(c.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(c.ACMEDomains...),
+		Email:      c.ACMEEmail,
+	}
+	if c.ACMEDirectory != "" {
+		manager.Client = &acme.Client{DirectoryURL: c.ACMEDirectory}
+	}
+	// TLS-ALPN-01 challenges are answered on the TLS port itself; HTTP-01
+	// needs port 80, which may be taken or not allowed
+	go func() {
+		if err := http.ListenAndServe(challengeAddr, manager.HTTPHandler(nil)); err != nil {
+			logger.Warn("Not answering ACME HTTP-01 challenges", "address", challengeAddr, "error", err)
+		}
+	}()
+	tlsConfig := manager.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+	return tlsConfig, nil
+}
+
+// certReloader serves a certificate from files, loading it again when the
+// files change, as when certbot or cert-manager renews it
+type certReloader struct {
+	certFile, keyFile string
+	cert              *tls.Certificate
+	modified          time.Time
+	checked           time.Time
+	mutex             sync.Mutex
+}
+
+// newCertReloader loads the certificate, failing if it cannot be used
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load loads the certificate and key pair
+func (r *certReloader) load() error {
+	modified, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	r.cert = &cert
+	r.modified = modified
+	return nil
+}
+
+// lastModified gets when the later of the two files changed
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// certificate gets the certificate for a handshake, reloading it first when
+// the files changed. A renewal that fails to load keeps the old certificate.
+func (r *certReloader) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.checked) >= reloadInterval {
+		r.checked = time.Now()
+		if modified, err := r.lastModified(); err == nil && modified.After(r.modified) {
+			if err := r.load(); err != nil {
+				logger.Warn("Keeping the current TLS certificate", "error", err)
+			} else {
+				logger.Info("Reloaded TLS certificate", "path", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
@@ -0,0 +1,49 @@
+package tokens
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prashah/batwa/pkg/accesslog"
+	"github.com/prashah/batwa/pkg/apierror"
+	"github.com/prashah/batwa/pkg/auth"
+	"github.com/prashah/batwa/pkg/models"
+)
+
+// New returns middleware that authenticates API requests carrying an
+// Authorization: Bearer token. The request then runs under a session of the
+// token's user, so handlers treat it like a logged-in request. Requests
+// without a bearer token are left to the session cookie, and those with a JWT
+// to the auth service.
+func New(store *Store, authService *auth.Service) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		secret, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !found || !strings.HasPrefix(c.Path(), "/api/") || auth.IsJWT(secret) {
+			return c.Next()
+		}
+
+		token, err := store.Authenticate(strings.TrimSpace(secret))
+		if errors.Is(err, ErrExpired) {
+			authService.DeleteSession(auth.TokenSessionPrefix + token.ID)
+		}
+		if err != nil || !authService.HasUser(token.User) {
+			return apierror.Respond(c, 401, "Invalid or expired API token")
+		}
+		c.Locals(accesslog.LocalsToken, token.Name)
+		if isReserved(apiArea(c.Path())) {
+			return apierror.Respond(c, 403, "API tokens cannot be used for /api/auth, /api/tokens or /api/users")
+		}
+		if !Allows(token.Scopes, c.Method(), c.Path()) {
+			return apierror.Respond(c, 403, fmt.Sprintf("API token lacks the %s scope", RequiredScope(c.Method(), c.Path())))
+		}
+
+		sessionID := auth.TokenSessionPrefix + token.ID
+		if _, exists := authService.GetSession(sessionID); !exists {
+			authService.SetSession(sessionID, &models.Session{Username: token.User})
+		}
+		c.Locals(auth.LocalsSession, sessionID)
+		return c.Next()
+	}
+}
@@ -0,0 +1,145 @@
+package tokens
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+// Repository persists API tokens. The store keeps every token in memory and
+// writes each change through to the repository.
+type Repository interface {
+	Load() ([]*StoredToken, error)
+	// Save saves a token, replacing any of the same ID
+	Save(token *StoredToken) error
+	Delete(id string) error
+}
+
+// FileRepository keeps tokens in a JSON file, rewritten on every change
+type FileRepository struct {
+	path   string
+	tokens map[string]StoredToken
+	mutex  sync.Mutex
+}
+
+// NewFileRepository keeps tokens in the JSON file at path
+func NewFileRepository(path string) *FileRepository {
+	return &FileRepository{path: path, tokens: make(map[string]StoredToken)}
+}
+
+// Load reads the tokens saved in the file
+func (r *FileRepository) Load() ([]*StoredToken, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []*StoredToken
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for _, token := range saved {
+		r.tokens[token.ID] = *token
+	}
+	return saved, nil
+}
+
+// Save saves a token by rewriting the file
+func (r *FileRepository) Save(token *StoredToken) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.tokens[token.ID] = *token
+	return r.write()
+}
+
+// Delete deletes a token by rewriting the file
+func (r *FileRepository) Delete(id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.tokens, id)
+	return r.write()
+}
+
+// write writes the tokens to the file, oldest first; the caller must hold
+// the lock
+func (r *FileRepository) write() error {
+	list := make([]StoredToken, 0, len(r.tokens))
+	for _, token := range r.tokens {
+		list = append(list, token)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// DatabaseRepository keeps tokens in the master's database
+type DatabaseRepository struct {
+	db *storage.DB
+}
+
+// NewDatabaseRepository keeps tokens in db
+func NewDatabaseRepository(db *storage.DB) *DatabaseRepository {
+	return &DatabaseRepository{db: db}
+}
+
+// Load loads every token from the database
+func (r *DatabaseRepository) Load() ([]*StoredToken, error) {
+	rows, err := r.db.Query(`SELECT data FROM api_tokens`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var saved []*StoredToken
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var token StoredToken
+		if err := json.Unmarshal([]byte(data), &token); err != nil {
+			return nil, err
+		}
+		saved = append(saved, &token)
+	}
+	return saved, rows.Err()
+}
+
+// Save saves a token to the database
+func (r *DatabaseRepository) Save(token *StoredToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`INSERT INTO api_tokens (id, username, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET username = excluded.username, data = excluded.data`,
+		token.ID, token.User, string(data))
+	return err
+}
+
+// Delete deletes a token from the database
+func (r *DatabaseRepository) Delete(id string) error {
+	_, err := r.db.Exec(`DELETE FROM api_tokens WHERE id = ?`, id)
+	return err
+}
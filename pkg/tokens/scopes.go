@@ -0,0 +1,85 @@
+package tokens
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prashah/batwa/pkg/apiversion"
+)
+
+// Scopes limit what a token may do. "read" allows GET requests to the whole
+// API and "write" allows every request; "<area>:read" and "<area>:write" do
+// the same for one area of the API, the path segment after /api/, such as
+// "vm:write" for /api/vm/... or "tasks:read" for /api/tasks.
+var scopePattern = regexp.MustCompile(`^(?:[a-z][a-z-]*:)?(?:read|write)$`)
+
+// reserved are the API areas tokens can never reach, so a leaked token cannot
+// mint more tokens, manage users or take over a session
+var reserved = []string{"auth", "tokens", "users"}
+
+// ValidateScopes checks that at least one scope is given and that each is
+// well formed
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required, such as \"read\" or \"vm:write\"")
+	}
+	for _, scope := range scopes {
+		if !scopePattern.MatchString(scope) {
+			return fmt.Errorf("invalid scope %q: use read, write, <area>:read or <area>:write", scope)
+		}
+		if area, _, found := strings.Cut(scope, ":"); found && isReserved(area) {
+			return fmt.Errorf("invalid scope %q: tokens cannot reach /api/%s", scope, area)
+		}
+	}
+	return nil
+}
+
+// isReserved reports whether an API area is out of reach of tokens
+func isReserved(area string) bool {
+	for _, r := range reserved {
+		if area == r {
+			return true
+		}
+	}
+	return false
+}
+
+// apiArea gets the area of an API path, the segment after /api/ or the
+// version prefix
+func apiArea(path string) string {
+	area, _, _ := strings.Cut(strings.TrimPrefix(apiversion.Trim(path), "/"), "/")
+	return area
+}
+
+// RequiredScope gets the scope a request needs: read for GET and HEAD
+// requests, write for the rest, in the area of its path
+func RequiredScope(method, path string) string {
+	access := "write"
+	if method == fiber.MethodGet || method == fiber.MethodHead {
+		access = "read"
+	}
+	return apiArea(path) + ":" + access
+}
+
+// Allows reports whether scopes permit a request. Write scopes include read
+// access to the same area.
+func Allows(scopes []string, method, path string) bool {
+	area := apiArea(path)
+	if isReserved(area) {
+		return false
+	}
+	read := method == fiber.MethodGet || method == fiber.MethodHead
+	for _, scope := range scopes {
+		scopeArea, access, found := strings.Cut(scope, ":")
+		if !found {
+			scopeArea, access = area, scope
+		}
+		if scopeArea == area && (access == "write" || read) {
+			return true
+		}
+	}
+	return false
+}
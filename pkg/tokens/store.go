@@ -0,0 +1,329 @@
+// Package tokens issues API tokens so scripts and CI pipelines can call the
+// master's API with an Authorization: Bearer header instead of logging in for
+// a session cookie. A token acts as the user or service account it belongs
+// to, limited to its scopes, until it expires or is revoked.
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/storage"
+)
+
+var logger = logging.For("tokens")
+
+// DefaultTTL is how long a token lasts when it is created without an expiry
+const DefaultTTL = 90 * 24 * time.Hour
+
+// secretPrefix starts every token secret, so leaked tokens are easy to spot
+const secretPrefix = "batwa_"
+
+// lastUsedInterval is how stale a token's saved last use may get before using
+// it saves the store again
+const lastUsedInterval = time.Minute
+
+var (
+	// ErrInvalid is returned for a secret that matches no token
+	ErrInvalid = errors.New("invalid API token")
+	// ErrExpired is returned for a token past its expiry
+	ErrExpired = errors.New("API token has expired")
+	// ErrNotFound is returned for an unknown token ID
+	ErrNotFound = errors.New("API token not found")
+)
+
+// StoredToken is a token as saved, with the hash of its secret
+type StoredToken struct {
+	models.APIToken
+	Hash string `json:"hash"`
+	// savedUse is the last use already written to the repository
+	savedUse time.Time
+}
+
+// Store keeps API tokens, saved to a Repository after every change. Only a
+// hash of each secret is kept.
+type Store struct {
+	repository Repository
+	tokens     map[string]*StoredToken
+	mutex      sync.RWMutex
+}
+
+// NewStore creates a token store persisted to repository, loading the tokens
+// already saved there
+func NewStore(repository Repository) *Store {
+	s := &Store{repository: repository}
+	tokens, err := s.load()
+	if err != nil {
+		logger.Error("Failed to load API tokens", "error", err)
+	}
+	s.tokens = tokens
+	return s
+}
+
+// NewStoreFromEnv creates a token store in db, or persisted at TOKENS_PATH
+// (default ./data/tokens.json) when db is nil. The first time a database is
+// used, the tokens in the file are copied into it.
+func NewStoreFromEnv(db *storage.DB) (*Store, error) {
+	path := os.Getenv("TOKENS_PATH")
+	if path == "" {
+		path = filepath.Join("data", "tokens.json")
+	}
+	if db == nil {
+		return NewStore(NewFileRepository(path)), nil
+	}
+
+	repository := NewDatabaseRepository(db)
+	err := db.ImportOnce("tokens", func() (int, error) {
+		tokens, err := NewFileRepository(path).Load()
+		if err != nil {
+			return 0, err
+		}
+		for _, token := range tokens {
+			if err := repository.Save(token); err != nil {
+				return 0, err
+			}
+		}
+		return len(tokens), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(repository), nil
+}
+
+// load reads the saved tokens
+func (s *Store) load() (map[string]*StoredToken, error) {
+	tokens := make(map[string]*StoredToken)
+	saved, err := s.repository.Load()
+	for _, token := range saved {
+		if token.LastUsedAt != nil {
+			token.savedUse = *token.LastUsedAt
+		}
+		tokens[token.ID] = token
+	}
+	return tokens, err
+}
+
+// Reload reads the saved tokens again, picking up those another master
+// sharing the database created or revoked. Uses of a token not saved yet are
+// kept.
+func (s *Store) Reload() error {
+	tokens, err := s.load()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, token := range tokens {
+		current, exists := s.tokens[id]
+		if exists && current.LastUsedAt != nil &&
+			(token.LastUsedAt == nil || current.LastUsedAt.After(*token.LastUsedAt)) {
+			token.LastUsedAt = current.LastUsedAt
+		}
+	}
+	s.tokens = tokens
+	return nil
+}
+
+// save saves a token; the caller must hold the lock
+func (s *Store) save(token *StoredToken) {
+	if err := s.repository.Save(token); err != nil {
+		logger.Error("Failed to save API token", "token_id", token.ID, "error", err)
+	}
+}
+
+// remove deletes a saved token; the caller must hold the lock
+func (s *Store) remove(id string) {
+	if err := s.repository.Delete(id); err != nil {
+		logger.Error("Failed to delete API token", "token_id", id, "error", err)
+	}
+}
+
+// hashSecret hashes a token secret for storage and lookup
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidateName checks that a token name is 1-64 characters
+func ValidateName(name string) error {
+	if name == "" || len(name) > 64 {
+		return errors.New("name must be 1-64 characters")
+	}
+	return nil
+}
+
+// Create issues a token for user with the given scopes, expiring at expiresAt,
+// and returns it along with its secret, which is not kept and cannot be shown
+// again
+func (s *Store) Create(name, user, createdBy string, scopes []string, expiresAt time.Time) (models.APIToken, string, error) {
+	if err := ValidateName(name); err != nil {
+		return models.APIToken{}, "", err
+	}
+	if err := ValidateScopes(scopes); err != nil {
+		return models.APIToken{}, "", err
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return models.APIToken{}, "", err
+	}
+	secret := secretPrefix + base64.RawURLEncoding.EncodeToString(random)
+
+	token := &StoredToken{
+		APIToken: models.APIToken{
+			ID:        uuid.NewString(),
+			Name:      name,
+			User:      user,
+			Scopes:    append([]string(nil), scopes...),
+			Prefix:    secret[:len(secretPrefix)+6],
+			CreatedBy: createdBy,
+			CreatedAt: time.Now(),
+			ExpiresAt: expiresAt,
+		},
+		Hash: hashSecret(secret),
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens[token.ID] = token
+	s.save(token)
+	logger.Info("Created API token", "token_id", token.ID, "name", name, "user", user)
+	return copyToken(token), secret, nil
+}
+
+// Authenticate finds the token a secret belongs to and records its use. An
+// expired token is returned along with ErrExpired.
+func (s *Store) Authenticate(secret string) (models.APIToken, error) {
+	hash := hashSecret(secret)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var found *StoredToken
+	for _, token := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) == 1 {
+			found = token
+		}
+	}
+	if found == nil {
+		return models.APIToken{}, ErrInvalid
+	}
+	now := time.Now()
+	if !now.Before(found.ExpiresAt) {
+		return copyToken(found), ErrExpired
+	}
+
+	found.LastUsedAt = &now
+	if now.Sub(found.savedUse) > lastUsedInterval {
+		found.savedUse = now
+		s.save(found)
+	}
+	return copyToken(found), nil
+}
+
+// Get gets a token by ID
+func (s *Store) Get(id string) (models.APIToken, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	token, exists := s.tokens[id]
+	if !exists {
+		return models.APIToken{}, false
+	}
+	return copyToken(token), true
+}
+
+// List lists the tokens of user, or every token if user is empty, newest
+// first
+func (s *Store) List(user string) []models.APIToken {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	list := []models.APIToken{}
+	for _, token := range s.tokens {
+		if user == "" || token.User == user {
+			list = append(list, copyToken(token))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Delete revokes a token
+func (s *Store) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	token, exists := s.tokens[id]
+	if !exists {
+		return ErrNotFound
+	}
+	delete(s.tokens, id)
+	s.remove(id)
+	logger.Info("Revoked API token", "token_id", id, "name", token.Name, "user", token.User)
+	return nil
+}
+
+// DeleteUser revokes every token of a user and returns their IDs
+func (s *Store) DeleteUser(user string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed := []string{}
+	for id, token := range s.tokens {
+		if token.User == user {
+			delete(s.tokens, id)
+			s.remove(id)
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) > 0 {
+		logger.Info("Revoked API tokens of deleted user", "count", len(removed), "user", user)
+	}
+	return removed
+}
+
+// ResolveExpiry works out when a new token expires from a TTL such as "720h"
+// or an absolute time, defaulting to DefaultTTL from now
+func ResolveExpiry(ttl string, expiresAt *time.Time, now time.Time) (time.Time, error) {
+	switch {
+	case ttl != "" && expiresAt != nil:
+		return time.Time{}, errors.New("set either ttl or expires_at, not both")
+	case ttl != "":
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			return time.Time{}, fmt.Errorf("invalid ttl '%s': use a positive duration such as 24h or 720h", ttl)
+		}
+		return now.Add(duration), nil
+	case expiresAt != nil:
+		if !expiresAt.After(now) {
+			return time.Time{}, errors.New("expires_at must be in the future")
+		}
+		return *expiresAt, nil
+	}
+	return now.Add(DefaultTTL), nil
+}
+
+// copyToken copies a token so callers never share its scopes with the store
+func copyToken(token *StoredToken) models.APIToken {
+	copied := token.APIToken
+	copied.Scopes = append([]string(nil), token.Scopes...)
+	if token.LastUsedAt != nil {
+		lastUsed := *token.LastUsedAt
+		copied.LastUsedAt = &lastUsed
+	}
+	return copied
+}
@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/prashah/batwa/pkg/metrics"
+	"github.com/prashah/batwa/pkg/requestid"
+)
+
+// Middleware returns middleware serving each request in a server span of
+// tracer, the child of the caller's span when it sent a traceparent header.
+// The span is named by the route's pattern once the request has been routed.
+func Middleware(tracer *Tracer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !tracer.Enabled() {
+			return c.Next()
+		}
+
+		ctx := c.UserContext()
+		if remote, ok := ParseTraceparent(c.Get(Header)); ok {
+			ctx = ContextWithRemote(ctx, remote)
+		}
+		method := c.Method()
+		ctx, span := tracer.Start(ctx, method, KindServer,
+			Attribute{Key: "http.request.method", Value: method},
+			// Fiber's strings point into buffers reused by later requests
+			Attribute{Key: "url.path", Value: utils.CopyString(c.Path())},
+			Attribute{Key: "request.id", Value: requestid.Get(c)})
+		defer span.End()
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+		route := metrics.Route(c, err)
+		span.SetName(method + " " + route)
+		span.SetAttribute("http.route", route)
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			// The error handler has yet to answer; use the status it will
+			status = fiber.StatusInternalServerError
+			var fiberErr *fiber.Error
+			if errors.As(err, &fiberErr) {
+				status = fiberErr.Code
+			}
+		}
+		span.SetAttribute("http.response.status_code", status)
+		if status >= fiber.StatusInternalServerError {
+			span.SetError(utils.StatusMessage(status))
+		}
+		return err
+	}
+}
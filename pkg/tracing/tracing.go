@@ -0,0 +1,327 @@
+// Package tracing records OpenTelemetry spans for the master and agents and
+// exports them over OTLP, to see where slow VM operations spend their time.
+// Spans travel in a request's context: HTTP handlers start one per request,
+// calls to agents carry it to the agent in a W3C traceparent header, and
+// multipass commands run as its children, so one operation is a single trace
+// across the master and the agent that ran it. Work outside a request, such
+// as heartbeats, carries no span and is not traced.
+//
+// Tracing is off unless OTEL_EXPORTER_OTLP_ENDPOINT (or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) is set; spans are then nil and every
+// method on them does nothing.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/logging"
+)
+
+// Header carries a span's context in requests between the master and agents
+const Header = "traceparent"
+
+// Kind is what a span stands for, as OTLP numbers it
+type Kind int
+
+const (
+	// KindInternal is work inside a process, such as a multipass command
+	KindInternal Kind = 1
+	// KindServer is a request being served
+	KindServer Kind = 2
+	// KindClient is a request sent, such as the master calling an agent
+	KindClient Kind = 3
+)
+
+// SpanContext identifies a span within its trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether the IDs are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent formats the context as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent reads a W3C traceparent header value
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	if len(value) != 55 || value[2] != '-' || value[35] != '-' || value[52] != '-' || value[:2] == "ff" {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(value[3:35])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(value[36:52])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(value[53:], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Attribute is a key and value recorded on a span. Values are strings,
+// bools, ints or float64s.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is a timed operation within a trace. A nil span, which Start returns
+// when tracing is off, ignores every call.
+type Span struct {
+	tracer     *Tracer
+	context    SpanContext
+	parent     [8]byte
+	name       string
+	kind       Kind
+	start      time.Time
+	end        time.Time
+	attributes []Attribute
+	failed     bool
+	message    string
+	mutex      sync.Mutex
+}
+
+// Context gets the span's IDs
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetName renames the span, such as once a request's route is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.name = name
+}
+
+// SetAttribute records a key and value on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attributes = append(s.attributes, Attribute{Key: key, Value: value})
+}
+
+// SetError marks the span failed, with a message saying why
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failed = true
+	s.message = message
+}
+
+// End finishes the span and queues it for export. Only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if !s.end.IsZero() {
+		s.mutex.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mutex.Unlock()
+	if s.context.Sampled {
+		s.tracer.exporter.enqueue(s)
+	}
+}
+
+type contextKey struct{}
+
+func init() {
+	logging.RegisterContextFields(func(ctx context.Context) []slog.Attr {
+		span := SpanFromContext(ctx)
+		if span == nil {
+			return nil
+		}
+		return []slog.Attr{
+			slog.String("trace_id", hex.EncodeToString(span.context.TraceID[:])),
+			slog.String("span_id", hex.EncodeToString(span.context.SpanID[:])),
+		}
+	})
+}
+
+// ContextWithSpan returns a context carrying a span, whose children Start
+// begins
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, contextKey{}, span)
+}
+
+// SpanFromContext gets the span a context carries, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(contextKey{}).(*Span)
+	return span
+}
+
+// remoteKey carries the span context a request arrived with, until the
+// server span is started under it
+type remoteKey struct{}
+
+// ContextWithRemote returns a context carrying a span context received from
+// another process, such as the master calling an agent
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Traceparent gets the traceparent header value of the span a context
+// carries, or "" without one
+func Traceparent(ctx context.Context) string {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.context.Traceparent()
+	}
+	if ctx != nil {
+		if sc, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+			return sc.Traceparent()
+		}
+	}
+	return ""
+}
+
+// Start begins a span as a child of the span ctx carries, with the tracer
+// that started it, returning a context carrying the new span. Without a span
+// in ctx it begins none and returns a nil span. The span must be ended.
+func Start(ctx context.Context, name string, kind Kind, attributes ...Attribute) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, kind, attributes...)
+}
+
+// Tracer starts spans and exports them. The zero Tracer is off.
+type Tracer struct {
+	exporter *exporter
+	// ratio is the share of new traces sampled; traces started elsewhere
+	// follow their caller's decision
+	ratio float64
+}
+
+// NewTracerFromEnv creates a tracer exporting over OTLP/HTTP to
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or OTEL_EXPORTER_OTLP_ENDPOINT with
+// /v1/traces appended, as service (overridden by OTEL_SERVICE_NAME). Headers
+// in OTEL_EXPORTER_OTLP_HEADERS, such as an API key, are sent with every
+// export, and OTEL_TRACES_SAMPLER_ARG is the share of new traces sampled
+// (default 1). With neither endpoint set, the tracer is off.
+func NewTracerFromEnv(service string) (*Tracer, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return &Tracer{}, nil
+	}
+
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		service = name
+	}
+	headers, err := parseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		return nil, err
+	}
+	ratio := 1.0
+	if value := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); value != "" {
+		ratio, err = strconv.ParseFloat(value, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be between 0 and 1, got %q", value)
+		}
+	}
+	return &Tracer{exporter: newExporter(endpoint, service, headers), ratio: ratio}, nil
+}
+
+// Enabled reports whether the tracer records spans
+func (t *Tracer) Enabled() bool {
+	return t.exporter != nil
+}
+
+// String describes where the tracer exports spans, for startup logs
+func (t *Tracer) String() string {
+	if !t.Enabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%s as %s (sampling %g of new traces)", t.exporter.endpoint, t.exporter.service, t.ratio)
+}
+
+// Start begins a span as a child of the span ctx carries, or of the remote
+// span context it carries, or as the root of a new trace
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind, attributes ...Attribute) (context.Context, *Span) {
+	if !t.Enabled() {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attributes: attributes}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.context.TraceID = parent.context.TraceID
+		span.context.Sampled = parent.context.Sampled
+		span.parent = parent.context.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		span.context.TraceID = remote.TraceID
+		span.context.Sampled = remote.Sampled
+		span.parent = remote.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = t.sample()
+	}
+	rand.Read(span.context.SpanID[:])
+	return ContextWithSpan(ctx, span), span
+}
+
+// sample decides whether a new trace is recorded
+func (t *Tracer) sample() bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	return err == nil && float64(n.Int64()) < t.ratio*math.MaxInt64
+}
+
+// Flush exports the spans ended so far, waiting at most until ctx ends
+func (t *Tracer) Flush(ctx context.Context) {
+	if t.Enabled() {
+		t.exporter.flush(ctx)
+	}
+}
@@ -0,0 +1,257 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gorillaws "github.com/gorilla/websocket"
+)
+
+// pingInterval is how often an agent pings the master over its tunnel
+const pingInterval = 30 * time.Second
+
+// relay is the agent's end of a tunnel, replaying the master's requests and
+// websockets against the agent's own API
+type relay struct {
+	link     *link
+	localURL string
+	client   *http.Client
+	tls      *tls.Config
+	streams  map[uint64]*relayStream
+	mutex    sync.Mutex
+}
+
+// relayStream is a request or websocket the master opened
+type relayStream struct {
+	// body feeds the request body to the local request
+	body   *io.PipeWriter
+	ws     *gorillaws.Conn
+	cancel context.CancelFunc
+}
+
+// Serve answers the requests and websockets the master sends over conn by
+// passing them to the agent's API at localURL, such as http://127.0.0.1:8001.
+// tlsConfig, when the API is served over HTTPS, verifies its certificate. It
+// returns when conn fails.
+func Serve(conn Conn, localURL string, tlsConfig *tls.Config) error {
+	r := &relay{
+		link:     &link{conn: conn},
+		localURL: strings.TrimSuffix(localURL, "/"),
+		client:   &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		tls:      tlsConfig,
+		streams:  make(map[uint64]*relayStream),
+	}
+	defer r.closeAll()
+
+	done := make(chan struct{})
+	defer close(done)
+	go r.keepAlive(done)
+
+	for {
+		f, err := r.link.receive()
+		if err != nil {
+			return err
+		}
+
+		switch f.Type {
+		case frameRequest:
+			r.startRequest(f)
+		case frameWSOpen:
+			r.startWebSocket(f)
+		case frameData:
+			r.write(f)
+		case frameEnd:
+			r.endInput(f.Stream)
+		case frameCancel:
+			r.remove(f.Stream)
+		}
+	}
+}
+
+// keepAlive pings the master until done is closed
+func (r *relay) keepAlive(done chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			r.link.send(frame{Type: framePing})
+		}
+	}
+}
+
+// startRequest starts passing a request to the local API
+func (r *relay) startRequest(f frame) {
+	ctx, cancel := context.WithCancel(context.Background())
+	st := &relayStream{cancel: cancel}
+
+	var body io.Reader = http.NoBody
+	var bodyReader *io.PipeReader
+	if f.Body {
+		bodyReader, st.body = io.Pipe()
+		body = bodyReader
+	}
+
+	r.mutex.Lock()
+	r.streams[f.Stream] = st
+	r.mutex.Unlock()
+
+	go func() {
+		defer r.remove(f.Stream)
+		if bodyReader != nil {
+			// Unblock the frames still feeding a body nobody reads anymore
+			defer bodyReader.CloseWithError(io.ErrClosedPipe)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, f.Method, r.localURL+f.Path, body)
+		if err != nil {
+			r.link.send(frame{Stream: f.Stream, Type: frameError, Error: err.Error()})
+			return
+		}
+		req.Header = f.Header
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			r.link.send(frame{Stream: f.Stream, Type: frameError, Error: err.Error()})
+			return
+		}
+		defer resp.Body.Close()
+
+		if r.link.send(frame{Stream: f.Stream, Type: frameResponse, Status: resp.StatusCode, Header: resp.Header}) != nil {
+			return
+		}
+		buf := make([]byte, chunkSize)
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				if r.link.send(frame{Stream: f.Stream, Type: frameData, Data: buf[:n]}) != nil {
+					return
+				}
+			}
+			if err == io.EOF {
+				r.link.send(frame{Stream: f.Stream, Type: frameEnd})
+				return
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					r.link.send(frame{Stream: f.Stream, Type: frameError, Error: err.Error()})
+				}
+				return
+			}
+		}
+	}()
+}
+
+// startWebSocket opens a websocket to the local API and relays its messages
+func (r *relay) startWebSocket(f frame) {
+	ctx, cancel := context.WithCancel(context.Background())
+	st := &relayStream{cancel: cancel}
+	r.mutex.Lock()
+	r.streams[f.Stream] = st
+	r.mutex.Unlock()
+
+	go func() {
+		defer r.remove(f.Stream)
+
+		wsURL := "ws" + strings.TrimPrefix(r.localURL, "http") + f.Path
+		dialer := gorillaws.Dialer{EnableCompression: true, TLSClientConfig: r.tls}
+		ws, _, err := dialer.DialContext(ctx, wsURL, f.Header)
+		if err != nil {
+			r.link.send(frame{Stream: f.Stream, Type: frameError, Error: err.Error()})
+			return
+		}
+		defer ws.Close()
+
+		r.mutex.Lock()
+		_, open := r.streams[f.Stream]
+		st.ws = ws
+		r.mutex.Unlock()
+		if !open || r.link.send(frame{Stream: f.Stream, Type: frameWSOpened}) != nil {
+			return
+		}
+
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				if ctx.Err() == nil {
+					r.link.send(frame{Stream: f.Stream, Type: frameEnd})
+				}
+				return
+			}
+			if r.link.send(frame{Stream: f.Stream, Type: frameData, MessageType: messageType, Data: data}) != nil {
+				return
+			}
+		}
+	}()
+}
+
+// write passes a data frame to a request body or websocket
+func (r *relay) write(f frame) {
+	r.mutex.Lock()
+	st := r.streams[f.Stream]
+	r.mutex.Unlock()
+	if st == nil {
+		return
+	}
+	if st.body != nil {
+		st.body.Write(f.Data)
+	} else if st.ws != nil {
+		st.ws.WriteMessage(f.MessageType, f.Data)
+	}
+}
+
+// endInput ends a request body, or closes a websocket the master closed
+func (r *relay) endInput(id uint64) {
+	r.mutex.Lock()
+	st := r.streams[id]
+	r.mutex.Unlock()
+	if st == nil {
+		return
+	}
+	if st.body != nil {
+		st.body.Close()
+	} else {
+		r.remove(id)
+	}
+}
+
+// remove ends a stream
+func (r *relay) remove(id uint64) {
+	r.mutex.Lock()
+	st, exists := r.streams[id]
+	delete(r.streams, id)
+	r.mutex.Unlock()
+	if !exists {
+		return
+	}
+	st.cancel()
+	if st.body != nil {
+		st.body.CloseWithError(context.Canceled)
+	}
+	if st.ws != nil {
+		st.ws.Close()
+	}
+}
+
+// closeAll ends every stream once the tunnel is gone
+func (r *relay) closeAll() {
+	r.mutex.Lock()
+	ids := make([]uint64, 0, len(r.streams))
+	for id := range r.streams {
+		ids = append(ids, id)
+	}
+	r.mutex.Unlock()
+	for _, id := range ids {
+		r.remove(id)
+	}
+}
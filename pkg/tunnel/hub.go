@@ -0,0 +1,357 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prashah/batwa/pkg/logging"
+)
+
+var logger = logging.For("tunnel")
+
+// ErrClosed is returned for streams on a tunnel that has closed
+var ErrClosed = errors.New("agent tunnel closed")
+
+// wsOpenTimeout is how long the master waits for an agent to open a websocket
+const wsOpenTimeout = 10 * time.Second
+
+// Hub keeps the tunnels agents have open to the master
+type Hub struct {
+	sessions map[string]*Session
+	mutex    sync.RWMutex
+}
+
+// NewHub creates an empty tunnel hub
+func NewHub() *Hub {
+	return &Hub{sessions: make(map[string]*Session)}
+}
+
+// Session gets the open tunnel of an agent, or nil if it has none
+func (h *Hub) Session(agentID string) *Session {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.sessions[agentID]
+}
+
+// Serve runs the tunnel an agent opened over conn until it closes, replacing
+// any tunnel the agent had open before
+func (h *Hub) Serve(agentID string, conn Conn) {
+	session := &Session{
+		agentID: agentID,
+		link:    &link{conn: conn},
+		streams: make(map[uint64]*stream),
+		closed:  make(chan struct{}),
+	}
+
+	h.mutex.Lock()
+	previous := h.sessions[agentID]
+	h.sessions[agentID] = session
+	h.mutex.Unlock()
+	if previous != nil {
+		previous.link.conn.Close()
+	}
+
+	logger.Info("Agent opened a tunnel", "agent_id", agentID)
+	err := session.run()
+	logger.Info("Agent tunnel closed", "agent_id", agentID, "error", err)
+
+	h.mutex.Lock()
+	if h.sessions[agentID] == session {
+		delete(h.sessions, agentID)
+	}
+	h.mutex.Unlock()
+}
+
+// Session is an agent's open tunnel
+type Session struct {
+	agentID string
+	link    *link
+	streams map[uint64]*stream
+	nextID  uint64
+	mutex   sync.Mutex
+	closed  chan struct{}
+}
+
+// stream is one request or websocket on a tunnel
+type stream struct {
+	// opened receives the response, ws_opened or error frame that answers
+	// the stream's first frame
+	opened chan frame
+	// body receives the response body of an HTTP stream
+	body *io.PipeWriter
+	// messages receives the messages of a websocket stream
+	messages chan frame
+	// done is closed once the stream is over
+	done chan struct{}
+}
+
+// run dispatches the frames the agent sends until the connection fails, then
+// ends every open stream
+func (s *Session) run() error {
+	defer func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		close(s.closed)
+		for id, st := range s.streams {
+			s.finish(id, st, ErrClosed)
+		}
+	}()
+
+	for {
+		f, err := s.link.receive()
+		if err != nil {
+			return err
+		}
+
+		s.mutex.Lock()
+		st := s.streams[f.Stream]
+		s.mutex.Unlock()
+		if st == nil {
+			continue
+		}
+
+		switch f.Type {
+		case frameResponse, frameWSOpened:
+			st.opened <- f
+		case frameData:
+			if st.body != nil {
+				st.body.Write(f.Data)
+			} else if st.messages != nil {
+				select {
+				case st.messages <- f:
+				case <-st.done:
+				}
+			}
+		case frameEnd:
+			s.end(f.Stream, nil)
+		case frameError:
+			select {
+			case st.opened <- f:
+			default:
+			}
+			s.end(f.Stream, errors.New(f.Error))
+		}
+	}
+}
+
+// open starts a stream
+func (s *Session) open(st *stream) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.closed:
+		return 0, ErrClosed
+	default:
+	}
+	s.nextID++
+	s.streams[s.nextID] = st
+	return s.nextID, nil
+}
+
+// end removes a stream, ending its body or messages with err
+func (s *Session) end(id uint64, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if st, exists := s.streams[id]; exists {
+		s.finish(id, st, err)
+	}
+}
+
+// finish removes a stream; the caller must hold the lock
+func (s *Session) finish(id uint64, st *stream, err error) {
+	delete(s.streams, id)
+	close(st.done)
+	if st.body != nil {
+		st.body.CloseWithError(err)
+	}
+}
+
+// cancel tells the agent to abandon a stream and removes it
+func (s *Session) cancel(id uint64, err error) {
+	s.mutex.Lock()
+	_, exists := s.streams[id]
+	s.mutex.Unlock()
+	if exists {
+		s.link.send(frame{Stream: id, Type: frameCancel})
+		s.end(id, err)
+	}
+}
+
+// RoundTrip sends an HTTP request to the agent's API over the tunnel. Only
+// the path and query of the request URL are used. The response body streams
+// as the agent sends it; closing it early abandons the request.
+func (s *Session) RoundTrip(req *http.Request) (*http.Response, error) {
+	bodyReader, bodyWriter := io.Pipe()
+	st := &stream{
+		opened: make(chan frame, 1),
+		body:   bodyWriter,
+		done:   make(chan struct{}),
+	}
+	id, err := s.open(st)
+	if err != nil {
+		return nil, err
+	}
+
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	err = s.link.send(frame{
+		Stream: id,
+		Type:   frameRequest,
+		Method: req.Method,
+		Path:   req.URL.RequestURI(),
+		Header: req.Header,
+		Body:   hasBody,
+	})
+	if err == nil && hasBody {
+		err = s.sendBody(id, req.Body)
+	}
+	if err != nil {
+		s.cancel(id, err)
+		return nil, err
+	}
+
+	ctx := req.Context()
+	var answer frame
+	select {
+	case answer = <-st.opened:
+	case <-ctx.Done():
+		s.cancel(id, ctx.Err())
+		return nil, ctx.Err()
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+	if answer.Type == frameError {
+		return nil, fmt.Errorf("agent %s: %s", s.agentID, answer.Error)
+	}
+
+	// Abandon the request if the caller gives up before the body is read
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.cancel(id, ctx.Err())
+		case <-st.done:
+		}
+	}()
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", answer.Status, http.StatusText(answer.Status)),
+		StatusCode:    answer.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        answer.Header,
+		Body:          &streamBody{PipeReader: bodyReader, close: func() { s.cancel(id, nil) }},
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// sendBody sends a request body as data frames followed by an end frame
+func (s *Session) sendBody(id uint64, body io.ReadCloser) error {
+	defer body.Close()
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if sendErr := s.link.send(frame{Stream: id, Type: frameData, Data: buf[:n]}); sendErr != nil {
+				return sendErr
+			}
+		}
+		if err == io.EOF {
+			return s.link.send(frame{Stream: id, Type: frameEnd})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// streamBody is a response body that abandons its stream when closed
+type streamBody struct {
+	*io.PipeReader
+	close func()
+	once  sync.Once
+}
+
+func (b *streamBody) Close() error {
+	b.once.Do(b.close)
+	return b.PipeReader.Close()
+}
+
+// DialWebSocket opens a websocket to the agent's API over the tunnel. path
+// includes the query.
+func (s *Session) DialWebSocket(path string, header http.Header) (*WebSocket, error) {
+	st := &stream{
+		opened:   make(chan frame, 1),
+		messages: make(chan frame, 64),
+		done:     make(chan struct{}),
+	}
+	id, err := s.open(st)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.link.send(frame{Stream: id, Type: frameWSOpen, Path: path, Header: header}); err != nil {
+		s.end(id, err)
+		return nil, err
+	}
+
+	select {
+	case answer := <-st.opened:
+		if answer.Type == frameError {
+			return nil, fmt.Errorf("agent %s: %s", s.agentID, answer.Error)
+		}
+	case <-time.After(wsOpenTimeout):
+		s.cancel(id, nil)
+		return nil, fmt.Errorf("agent %s did not open the websocket in time", s.agentID)
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+	return &WebSocket{session: s, id: id, stream: st}, nil
+}
+
+// WebSocket is a websocket to an agent carried over its tunnel
+type WebSocket struct {
+	session *Session
+	id      uint64
+	stream  *stream
+	once    sync.Once
+}
+
+// ReadMessage reads the next message the agent sent
+func (w *WebSocket) ReadMessage() (int, []byte, error) {
+	select {
+	case f := <-w.stream.messages:
+		return f.MessageType, f.Data, nil
+	case <-w.stream.done:
+		// Deliver messages that arrived before the stream ended
+		select {
+		case f := <-w.stream.messages:
+			return f.MessageType, f.Data, nil
+		default:
+			return 0, nil, io.EOF
+		}
+	}
+}
+
+// WriteMessage sends a message to the agent
+func (w *WebSocket) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-w.stream.done:
+		return io.ErrClosedPipe
+	default:
+	}
+	return w.session.link.send(frame{Stream: w.id, Type: frameData, MessageType: messageType, Data: data})
+}
+
+// Close closes the websocket
+func (w *WebSocket) Close() error {
+	w.once.Do(func() {
+		w.session.link.send(frame{Stream: w.id, Type: frameEnd})
+		w.session.end(w.id, nil)
+	})
+	return nil
+}
@@ -0,0 +1,90 @@
+// Package tunnel carries the master's requests to an agent over a websocket
+// the agent opened, for agents the master cannot connect to. HTTP requests
+// and websockets are multiplexed over the one connection as numbered streams
+// of JSON frames.
+package tunnel
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Frame types
+const (
+	// frameRequest starts an HTTP request to the agent's API
+	frameRequest = "request"
+	// frameResponse carries the status and headers of the agent's answer
+	frameResponse = "response"
+	// frameData carries request or response body bytes, or a websocket message
+	frameData = "data"
+	// frameEnd ends a body or closes a websocket
+	frameEnd = "end"
+	// frameError ends a stream that failed
+	frameError = "error"
+	// frameCancel abandons a stream the master no longer wants
+	frameCancel = "cancel"
+	// frameWSOpen opens a websocket to the agent's API
+	frameWSOpen = "ws_open"
+	// frameWSOpened reports that the agent opened the websocket
+	frameWSOpened = "ws_opened"
+	// framePing keeps the connection alive through NAT and proxies
+	framePing = "ping"
+)
+
+// chunkSize is the most body bytes sent in one frame
+const chunkSize = 32 * 1024
+
+// frame is one message on the tunnel
+type frame struct {
+	Stream      uint64      `json:"stream,omitempty"`
+	Type        string      `json:"type"`
+	Method      string      `json:"method,omitempty"`
+	Path        string      `json:"path,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        bool        `json:"body,omitempty"`
+	Status      int         `json:"status,omitempty"`
+	MessageType int         `json:"message_type,omitempty"`
+	Data        []byte      `json:"data,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// Conn is the websocket the tunnel runs over. Both the master's fiber
+// websockets and the agent's gorilla websockets satisfy it.
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+// link sends and receives frames on a Conn, serializing writes
+type link struct {
+	conn  Conn
+	mutex sync.Mutex
+}
+
+// send writes one frame
+func (l *link) send(f frame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.conn.WriteMessage(textMessage, data)
+}
+
+// receive reads the next frame
+func (l *link) receive() (frame, error) {
+	var f frame
+	_, data, err := l.conn.ReadMessage()
+	if err != nil {
+		return f, err
+	}
+	err = json.Unmarshal(data, &f)
+	return f, err
+}
+
+// textMessage is the websocket text message type, the same in every
+// websocket library the tunnel is used with
+const textMessage = 1
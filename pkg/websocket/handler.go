@@ -1,21 +1,22 @@
 package websocket
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
-	"log"
-	"os"
-	"os/exec"
-	"syscall"
-	"unsafe"
-
-	"github.com/creack/pty"
+	"net/url"
+
 	"github.com/gofiber/websocket/v2"
 	gorillaws "github.com/gorilla/websocket"
 	"github.com/prashah/batwa/pkg/agents"
+	"github.com/prashah/batwa/pkg/defaults"
+	"github.com/prashah/batwa/pkg/executor"
+	"github.com/prashah/batwa/pkg/logging"
+	"github.com/prashah/batwa/pkg/models"
+	"github.com/prashah/batwa/pkg/requestid"
+	"github.com/prashah/batwa/pkg/tunnel"
 )
 
+var logger = logging.For("websocket")
+
 // ResizeMessage represents a terminal resize message
 type ResizeMessage struct {
 	Type string `json:"type"`
@@ -23,71 +24,153 @@ type ResizeMessage struct {
 	Rows uint16 `json:"rows"`
 }
 
+// TerminalHandler connects terminal websockets to local VMs or proxies them
+// to the agent running the VM
+type TerminalHandler struct {
+	registry  *agents.AgentRegistry
+	executors *executor.ExecutorFactory
+	defaults  *defaults.Store
+	tunnels   *tunnel.Hub
+	sessions  *Sessions
+}
+
+// NewTerminalHandler creates a terminal handler for the agents in registry,
+// reaching agents that opened a tunnel through tunnels, and serving each
+// connection as one of sessions. Connections that name no VM open the
+// primary VM kept in defaultsStore.
+func NewTerminalHandler(registry *agents.AgentRegistry, executors *executor.ExecutorFactory, defaultsStore *defaults.Store, tunnels *tunnel.Hub, sessions *Sessions) *TerminalHandler {
+	return &TerminalHandler{
+		registry:  registry,
+		executors: executors,
+		defaults:  defaultsStore,
+		tunnels:   tunnels,
+		sessions:  sessions,
+	}
+}
+
+// remoteConn is a websocket to an agent, dialed directly or over its tunnel
+type remoteConn interface {
+	ReadMessage() (int, []byte, error)
+	WriteMessage(int, []byte) error
+	Close() error
+}
+
+// dialAgent opens the terminal websocket of vmName on an agent, passing on
+// the ID of the request that asked for it
+func (h *TerminalHandler) dialAgent(agent *models.AgentInfo, vmName, requestID string) (remoteConn, error) {
+	path := "/ws?vm_name=" + url.QueryEscape(vmName)
+
+	// Add API key header if needed
+	headers := make(map[string][]string)
+	apiKey := h.registry.GetAgentAPIKey(agent.AgentID)
+	if apiKey != nil {
+		headers["X-API-Key"] = []string{*apiKey}
+	}
+	if requestID != "" {
+		headers[requestid.Header] = []string{requestID}
+	}
+
+	if h.tunnels != nil {
+		if session := h.tunnels.Session(agent.AgentID); session != nil {
+			logger.Debug("Connecting to remote agent websocket over its tunnel", "agent_id", agent.AgentID, "request_id", requestID)
+			return session.DialWebSocket(path, headers)
+		}
+	}
+	if agent.Tunnel {
+		return nil, fmt.Errorf("agent %s has no tunnel open", agent.AgentID)
+	}
+
+	// Build websocket URL for agent
+	agentWSURL := agent.APIURL
+	if len(agentWSURL) > 7 && agentWSURL[:7] == "http://" {
+		agentWSURL = "ws://" + agentWSURL[7:]
+	} else if len(agentWSURL) > 8 && agentWSURL[:8] == "https://" {
+		agentWSURL = "wss://" + agentWSURL[8:]
+	}
+	agentWSURL += path
+
+	logger.Debug("Connecting to remote agent websocket", "agent_id", agent.AgentID, "url", agentWSURL, "request_id", requestID)
+
+	// Connect to remote agent's websocket
+	dialer := gorillaws.Dialer{EnableCompression: true}
+	remoteWS, _, err := dialer.Dial(agentWSURL, headers)
+	if err != nil {
+		return nil, err
+	}
+	tuneCompression(remoteWS)
+	return remoteWS, nil
+}
+
+// ResolveTarget gets the VM a terminal request for vmName on agentID opens.
+// Like multipass shell, no name means the primary VM kept in defaultsStore,
+// unless another agent than the primary VM's was asked for.
+func ResolveTarget(defaultsStore *defaults.Store, vmName, agentID string) (string, string) {
+	if vmName != "" || defaultsStore == nil {
+		return vmName, agentID
+	}
+	name, primaryAgentID, ok := defaultsStore.Primary()
+	primaryAgent := ""
+	if primaryAgentID != nil {
+		primaryAgent = *primaryAgentID
+	}
+	if ok && (agentID == "" || agentID == primaryAgent) {
+		return name, primaryAgent
+	}
+	return vmName, agentID
+}
+
 // HandleTerminalConnection handles WebSocket connection for terminal access to a VM
-func HandleTerminalConnection(c *websocket.Conn) {
-	vmName := c.Query("vm_name")
-	agentID := c.Query("agent_id")
+func (h *TerminalHandler) HandleTerminalConnection(c *websocket.Conn) {
+	vmName, agentID := ResolveTarget(h.defaults, c.Query("vm_name"), c.Query("agent_id"))
 
-	log.Printf("[WebSocket] Connection request for VM: %s on agent: %s", vmName, agentID)
+	logger.Info("Terminal connection requested", "vm", vmName, "agent_id", agentID, "request_id", c.Locals(requestid.LocalsKey))
 
 	if vmName == "" {
-		log.Println("[WebSocket] Error: No VM name provided")
-		c.WriteMessage(websocket.TextMessage, []byte("Error: VM name is required\r\n"))
-		c.Close()
+		logger.Warn("Terminal connection without a VM name", "request_id", c.Locals(requestid.LocalsKey))
+		writeTerminalError(c, "Error: VM name is required\r\n")
 		return
 	}
 
 	// Route to appropriate handler based on agent_id
 	if agentID != "" {
-		handleRemoteTerminal(c, vmName, agentID)
+		h.handleRemoteTerminal(c, vmName, agentID)
+	} else if h.executors.LocalEnabled() {
+		h.sessions.ServeLocalTerminal(c, vmName)
 	} else {
-		handleLocalTerminal(c, vmName)
+		writeTerminalError(c, "Error: multipass is not installed on the master; select a VM on an agent\r\n")
 	}
 }
 
 // handleRemoteTerminal handles terminal connection to a remote VM via agent
-func handleRemoteTerminal(c *websocket.Conn, vmName, agentID string) {
-	agent := agents.GlobalRegistry.GetAgent(agentID)
+func (h *TerminalHandler) handleRemoteTerminal(c *websocket.Conn, vmName, agentID string) {
+	agent := h.registry.GetAgent(agentID)
 	if agent == nil {
-		c.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Agent '%s' not found\r\n", agentID)))
-		c.Close()
+		writeTerminalError(c, fmt.Sprintf("Error: Agent '%s' not found\r\n", agentID))
 		return
 	}
 
 	if agent.Status != "online" {
-		c.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Agent '%s' is offline\r\n", agentID)))
-		c.Close()
+		writeTerminalError(c, fmt.Sprintf("Error: Agent '%s' is offline\r\n", agentID))
 		return
 	}
 
-	// Build websocket URL for agent
-	agentWSURL := agent.APIURL
-	if len(agentWSURL) > 7 && agentWSURL[:7] == "http://" {
-		agentWSURL = "ws://" + agentWSURL[7:]
-	} else if len(agentWSURL) > 8 && agentWSURL[:8] == "https://" {
-		agentWSURL = "wss://" + agentWSURL[8:]
-	}
-	agentWSURL = fmt.Sprintf("%s/ws?vm_name=%s", agentWSURL, vmName)
-
-	// Add API key header if needed
-	headers := make(map[string][]string)
-	apiKey := agents.GlobalRegistry.GetAgentAPIKey(agentID)
-	if apiKey != nil {
-		headers["X-API-Key"] = []string{*apiKey}
+	if !h.sessions.begin(c) {
+		return
 	}
+	defer h.sessions.end(c)
 
-	log.Printf("[WebSocket] Connecting to remote agent websocket: %s", agentWSURL)
-
-	// Connect to remote agent's websocket
-	dialer := gorillaws.Dialer{}
-	remoteWS, _, err := dialer.Dial(agentWSURL, headers)
+	requestID, _ := c.Locals(requestid.LocalsKey).(string)
+	remoteWS, err := h.dialAgent(agent, vmName, requestID)
 	if err != nil {
-		log.Printf("[WebSocket] Error connecting to remote agent: %v", err)
-		c.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("\r\n[Connection Error] %s\r\n", err)))
-		c.Close()
+		logger.Warn("Failed to connect to remote agent terminal", "agent_id", agentID, "vm", vmName, "request_id", requestID, "error", err)
+		writeTerminalError(c, fmt.Sprintf("\r\n[Connection Error] %s\r\n", err))
 		return
 	}
 	defer remoteWS.Close()
+	h.sessions.count("remote", 1)
+	defer h.sessions.count("remote", -1)
+
+	tuneCompression(c)
 
 	// Create bidirectional proxy
 	done := make(chan bool, 2)
@@ -98,11 +181,11 @@ func handleRemoteTerminal(c *websocket.Conn, vmName, agentID string) {
 		for {
 			msgType, msg, err := c.ReadMessage()
 			if err != nil {
-				log.Printf("Forward to remote ended: %v", err)
+				logger.Debug("Forward to remote ended", "agent_id", agentID, "vm", vmName, "error", err)
 				return
 			}
 			if err := remoteWS.WriteMessage(msgType, msg); err != nil {
-				log.Printf("Error writing to remote: %v", err)
+				logger.Warn("Error writing to remote terminal", "agent_id", agentID, "vm", vmName, "error", err)
 				return
 			}
 		}
@@ -114,11 +197,11 @@ func handleRemoteTerminal(c *websocket.Conn, vmName, agentID string) {
 		for {
 			msgType, msg, err := remoteWS.ReadMessage()
 			if err != nil {
-				log.Printf("Forward from remote ended: %v", err)
+				logger.Debug("Forward from remote ended", "agent_id", agentID, "vm", vmName, "error", err)
 				return
 			}
 			if err := c.WriteMessage(msgType, msg); err != nil {
-				log.Printf("Error writing to client: %v", err)
+				logger.Warn("Error writing to terminal client", "agent_id", agentID, "vm", vmName, "error", err)
 				return
 			}
 		}
@@ -129,94 +212,3 @@ func handleRemoteTerminal(c *websocket.Conn, vmName, agentID string) {
 	c.Close()
 	remoteWS.Close()
 }
-
-// handleLocalTerminal handles terminal connection to a local VM
-func handleLocalTerminal(c *websocket.Conn, vmName string) {
-	log.Printf("[WebSocket] Creating PTY for %s", vmName)
-
-	// Start multipass shell with PTY
-	cmd := exec.Command("multipass", "shell", vmName)
-	ptmx, err := pty.Start(cmd)
-	if err != nil {
-		log.Printf("[WebSocket] Error creating PTY: %v", err)
-		c.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("\r\n[Connection Error] %s\r\nMake sure the VM '%s' is running.\r\n", err, vmName)))
-		c.Close()
-		return
-	}
-	defer ptmx.Close()
-
-	log.Printf("[WebSocket] Process started with PID: %d", cmd.Process.Pid)
-
-	done := make(chan bool, 2)
-
-	// Read from PTY and forward to websocket
-	go func() {
-		defer func() { done <- true }()
-		buf := make([]byte, 4096)
-		for {
-			n, err := ptmx.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("PTY read error: %v", err)
-				}
-				return
-			}
-			if n > 0 {
-				if err := c.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-					log.Printf("WebSocket write error: %v", err)
-					return
-				}
-			}
-		}
-	}()
-
-	// Read from websocket and forward to PTY
-	go func() {
-		defer func() { done <- true }()
-		for {
-			msgType, msg, err := c.ReadMessage()
-			if err != nil {
-				log.Printf("WebSocket read error: %v", err)
-				return
-			}
-
-			if msgType == websocket.TextMessage {
-				// Check if it's a resize command
-				var resizeMsg ResizeMessage
-				if err := json.Unmarshal(msg, &resizeMsg); err == nil && resizeMsg.Type == "resize" {
-					// Set terminal size
-					setWinSize(ptmx, resizeMsg.Rows, resizeMsg.Cols)
-					continue
-				}
-
-				// Send keystrokes to the shell
-				if _, err := ptmx.Write(msg); err != nil {
-					log.Printf("PTY write error: %v", err)
-					return
-				}
-			}
-		}
-	}()
-
-	// Wait for either direction to close
-	<-done
-
-	// Cleanup
-	cmd.Process.Kill()
-	cmd.Wait()
-	c.Close()
-}
-
-// setWinSize sets the terminal window size
-func setWinSize(ptmx *os.File, rows, cols uint16) {
-	ws := &struct {
-		Row uint16
-		Col uint16
-		X   uint16
-		Y   uint16
-	}{
-		Row: rows,
-		Col: cols,
-	}
-	syscall.Syscall(syscall.SYS_IOCTL, ptmx.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(ws)))
-}
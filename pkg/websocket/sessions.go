@@ -0,0 +1,112 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/prashah/batwa/pkg/metrics"
+)
+
+// closeWait bounds how long Shutdown waits for sessions it closed to clean
+// up, which ends their shells
+const closeWait = 5 * time.Second
+
+// Sessions holds the terminal sessions a master or agent is serving.
+// Websockets are hijacked from the HTTP server, so shutting it down neither
+// waits for nor ends them; Shutdown does.
+type Sessions struct {
+	conns    map[*websocket.Conn]struct{}
+	closing  bool
+	finished sync.WaitGroup
+	mutex    sync.Mutex
+	// open counts the sessions open, by whether they run on this host or are
+	// proxied to an agent; nil when they are not measured
+	open *metrics.Gauge
+}
+
+// NewSessions creates an empty set of terminal sessions, exporting the number
+// open in registry, or not exporting it when registry is nil
+func NewSessions(registry *metrics.Registry) *Sessions {
+	s := &Sessions{conns: make(map[*websocket.Conn]struct{})}
+	if registry != nil {
+		s.open = registry.Gauge(metrics.Namespace+"terminal_sessions", "Terminal websocket sessions open, by kind", "kind")
+	}
+	return s
+}
+
+// count adds delta to the sessions of kind open
+func (s *Sessions) count(kind string, delta float64) {
+	if s.open != nil {
+		s.open.Add(delta, kind)
+	}
+}
+
+// begin tracks a session until end is called, or refuses it with an error
+// sent to the client once shutdown has begun
+func (s *Sessions) begin(c *websocket.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closing {
+		writeTerminalError(c, "Error: the server is shutting down\r\n")
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.finished.Add(1)
+	return true
+}
+
+// end stops tracking a session once it has cleaned up
+func (s *Sessions) end(c *websocket.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.conns, c)
+	s.finished.Done()
+}
+
+// Shutdown refuses new terminal sessions and waits for the open ones to end
+// until ctx ends. Sessions still open are then closed with a going-away
+// close frame, which kills their shells, and it returns how many were.
+func (s *Sessions) Shutdown(ctx context.Context) int {
+	s.mutex.Lock()
+	s.closing = true
+	s.mutex.Unlock()
+
+	if s.wait(ctx) {
+		return 0
+	}
+
+	s.mutex.Lock()
+	closed := len(s.conns)
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for c := range s.conns {
+		// WriteControl and Close are safe alongside the session's own writes
+		c.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		c.Close()
+	}
+	s.mutex.Unlock()
+	if closed > 0 {
+		logger.Info("Closed terminal sessions still open at shutdown", "sessions", closed)
+	}
+
+	cleanup, cancel := context.WithTimeout(context.Background(), closeWait)
+	defer cancel()
+	s.wait(cleanup)
+	return closed
+}
+
+// wait waits for every session to end, reporting false if ctx ends first
+func (s *Sessions) wait(ctx context.Context) bool {
+	finished := make(chan struct{})
+	go func() {
+		s.finished.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
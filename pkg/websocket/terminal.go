@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"github.com/creack/pty"
+	"github.com/gofiber/websocket/v2"
+)
+
+// UpgradeConfig negotiates permessage-deflate with clients that support it.
+// Terminal output is highly repetitive, so it compresses well on slow links.
+var UpgradeConfig = websocket.Config{
+	EnableCompression: true,
+}
+
+// ptyReadSize is large enough that bursts of output (e.g. cat of a big file)
+// leave the PTY in few frames instead of many small ones
+const ptyReadSize = 32 * 1024
+
+// compressor is implemented by both the fasthttp and gorilla websocket conns
+type compressor interface {
+	EnableWriteCompression(enable bool)
+	SetCompressionLevel(level int) error
+}
+
+// tuneCompression favours latency over ratio for interactive sessions. It is a
+// no-op on connections where compression was not negotiated.
+func tuneCompression(conn compressor) {
+	conn.EnableWriteCompression(true)
+	conn.SetCompressionLevel(flate.BestSpeed)
+}
+
+// writeTerminalError sends an error as terminal data and closes the connection
+func writeTerminalError(c *websocket.Conn, message string) {
+	c.WriteMessage(websocket.BinaryMessage, []byte(message))
+	c.Close()
+}
+
+// ServeLocalTerminal attaches the websocket to a `multipass shell` running on
+// this host, as one of the sessions. Binary frames from the client are
+// keystrokes; text frames are either a resize control message or, for older
+// clients, keystrokes.
+func (s *Sessions) ServeLocalTerminal(c *websocket.Conn, vmName string) {
+	if !s.begin(c) {
+		return
+	}
+	defer s.end(c)
+
+	logger.Debug("Creating PTY", "vm", vmName)
+	tuneCompression(c)
+
+	// Start multipass shell with PTY
+	cmd := exec.Command("multipass", "shell", vmName)
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		logger.Warn("Error creating PTY", "vm", vmName, "error", err)
+		writeTerminalError(c, fmt.Sprintf("\r\n[Connection Error] %s\r\nMake sure the VM '%s' is running.\r\n", err, vmName))
+		return
+	}
+	defer ptmx.Close()
+	s.count("local", 1)
+	defer s.count("local", -1)
+
+	logger.Info("Terminal session started", "vm", vmName, "pid", cmd.Process.Pid)
+
+	done := make(chan bool, 2)
+
+	// Read from PTY and forward to websocket
+	go func() {
+		defer func() { done <- true }()
+		buf := make([]byte, ptyReadSize)
+		for {
+			n, err := ptmx.Read(buf)
+			if err != nil {
+				if err != io.EOF {
+					logger.Warn("PTY read error", "vm", vmName, "error", err)
+				}
+				return
+			}
+			if n > 0 {
+				if err := c.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					logger.Debug("WebSocket write error", "vm", vmName, "error", err)
+					return
+				}
+			}
+		}
+	}()
+
+	// Read from websocket and forward to PTY
+	go func() {
+		defer func() { done <- true }()
+		for {
+			msgType, msg, err := c.ReadMessage()
+			if err != nil {
+				logger.Debug("WebSocket read error", "vm", vmName, "error", err)
+				return
+			}
+
+			if msgType == websocket.TextMessage {
+				// Check if it's a resize command
+				var resizeMsg ResizeMessage
+				if err := json.Unmarshal(msg, &resizeMsg); err == nil && resizeMsg.Type == "resize" {
+					setWinSize(ptmx, resizeMsg.Rows, resizeMsg.Cols)
+					continue
+				}
+			} else if msgType != websocket.BinaryMessage {
+				continue
+			}
+
+			// Send keystrokes to the shell
+			if _, err := ptmx.Write(msg); err != nil {
+				logger.Warn("PTY write error", "vm", vmName, "error", err)
+				return
+			}
+		}
+	}()
+
+	// Wait for either direction to close
+	<-done
+
+	// Cleanup: the shell leads its own session, so kill its process group
+	// rather than leaving the processes it started behind
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	cmd.Wait()
+	c.Close()
+}
+
+// setWinSize sets the terminal window size
+func setWinSize(ptmx *os.File, rows, cols uint16) {
+	ws := &struct {
+		Row uint16
+		Col uint16
+		X   uint16
+		Y   uint16
+	}{
+		Row: rows,
+		Col: cols,
+	}
+	syscall.Syscall(syscall.SYS_IOCTL, ptmx.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(ws)))
+}
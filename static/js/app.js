@@ -20,13 +20,38 @@ let activeTerminalTab = null;
 document.addEventListener('DOMContentLoaded', () => {
   loadUser();
   loadData();
-  setInterval(loadData, 10000); // Refresh every 10 seconds
+  followEvents();
+  setInterval(loadData, 60000); // Catch changes no event reports, such as agent load
 });
 
+// Reload when the master streams an event, polling instead while the stream
+// is down. EventSource reconnects by itself and resumes after the last event.
+function followEvents() {
+  let pending = null;
+  let fallback = null;
+  const reload = () => {
+    clearTimeout(pending);
+    pending = setTimeout(loadData, 500); // Batch bursts such as bulk actions
+  };
+
+  const source = new EventSource('/api/v1/events/stream');
+  source.onmessage = reload;
+  source.addEventListener('truncated', reload);
+  source.onopen = () => {
+    clearInterval(fallback);
+    fallback = null;
+  };
+  source.onerror = () => {
+    if (!fallback) {
+      fallback = setInterval(loadData, 10000);
+    }
+  };
+}
+
 // Load user info
 async function loadUser() {
   try {
-    const res = await fetch('/api/auth/check');
+    const res = await fetch('/api/v1/auth/check');
     const data = await res.json();
     if (data.authenticated) {
       const username = data.username;
@@ -55,7 +80,7 @@ window.refreshData = async function() {
 // Load VMs
 async function loadVMs() {
   try {
-    const res = await fetch('/api/vm/list');
+    const res = await fetch('/api/v1/vm/list');
     const data = await res.json();
     allVMs = data.vms || [];
 
@@ -73,7 +98,7 @@ async function loadVMs() {
 // Load agents
 async function loadAgents() {
   try {
-    const res = await fetch('/api/agent/list');
+    const res = await fetch('/api/v1/agent/list');
     if (res.ok) {
       allAgents = await res.json();
 
@@ -211,6 +236,7 @@ function createVMCard(vm) {
             Connect
           </button>
           <button class="btn-sm btn-secondary" onclick="stopVM('${vm.name}', '${agentId}')">Stop</button>
+          <button class="btn-sm btn-secondary" onclick="suspendVM('${vm.name}', '${agentId}')">Suspend</button>
         ` : `
           <button class="btn-sm btn-success" onclick="startVM('${vm.name}', '${agentId}')">Start</button>
         `}
@@ -344,7 +370,7 @@ window.showVMDetailsModal = async function(vmName, agentId) {
   currentVMDetails = { vmName, agentId };
 
   try {
-    let url = `/api/vm/info/${vmName}`;
+    let url = `/api/v1/vm/info/${vmName}`;
     if (agentId && agentId !== 'null') {
       url += `?agent_id=${agentId}`;
     }
@@ -477,7 +503,8 @@ window.showTerminalModal = function(vmName, agentId) {
     fit.fit();
 
     // Connect WebSocket
-    let wsUrl = `ws://${location.host}/ws?vm_name=${vmName}`;
+    const wsScheme = location.protocol === 'https:' ? 'wss' : 'ws';
+    let wsUrl = `${wsScheme}://${location.host}/ws?vm_name=${vmName}`;
     if (agentId && agentId !== 'null') {
       wsUrl += `&agent_id=${agentId}`;
     }
@@ -515,9 +542,11 @@ window.showTerminalModal = function(vmName, agentId) {
       term.write('\r\n\x1b[33mConnection closed\x1b[0m\r\n');
     };
 
+    // Keystrokes go out as binary frames; text frames are reserved for control messages
+    const encoder = new TextEncoder();
     term.onData(data => {
       if (ws && ws.readyState === WebSocket.OPEN) {
-        ws.send(data);
+        ws.send(encoder.encode(data));
       }
     });
 
@@ -551,7 +580,7 @@ window.startVM = async function(vmName, agentId) {
       payload.agent_id = agentId;
     }
 
-    await fetch('/api/vm/start', {
+    await fetch('/api/v1/vm/start', {
       method: 'POST',
       headers: {'Content-Type': 'application/json'},
       body: JSON.stringify(payload)
@@ -572,7 +601,7 @@ window.stopVM = async function(vmName, agentId) {
       payload.agent_id = agentId;
     }
 
-    await fetch('/api/vm/stop', {
+    await fetch('/api/v1/vm/stop', {
       method: 'POST',
       headers: {'Content-Type': 'application/json'},
       body: JSON.stringify(payload)
@@ -584,6 +613,25 @@ window.stopVM = async function(vmName, agentId) {
   }
 }
 
+window.suspendVM = async function(vmName, agentId) {
+  try {
+    const payload = { name: vmName };
+    if (agentId && agentId !== 'null') {
+      payload.agent_id = agentId;
+    }
+
+    await fetch('/api/v1/vm/suspend', {
+      method: 'POST',
+      headers: {'Content-Type': 'application/json'},
+      body: JSON.stringify(payload)
+    });
+
+    loadVMs();
+  } catch (err) {
+    alert('Error suspending VM: ' + err.message);
+  }
+}
+
 window.deleteVM = async function(vmName, agentId) {
   if (!confirm(`Delete VM "${vmName}"? This cannot be undone.`)) return;
 
@@ -593,7 +641,7 @@ window.deleteVM = async function(vmName, agentId) {
       payload.agent_id = agentId;
     }
 
-    await fetch('/api/vm/delete', {
+    await fetch('/api/v1/vm/delete', {
       method: 'POST',
       headers: {'Content-Type': 'application/json'},
       body: JSON.stringify(payload)
@@ -627,7 +675,7 @@ document.getElementById('createVMForm').addEventListener('submit', async (e) =>
       payload.agent_id = agentId;
     }
 
-    const res = await fetch('/api/vm/create', {
+    const res = await fetch('/api/v1/vm/create', {
       method: 'POST',
       headers: {'Content-Type': 'application/json'},
       body: JSON.stringify(payload)
@@ -643,7 +691,7 @@ document.getElementById('createVMForm').addEventListener('submit', async (e) =>
         loadVMs();
       }, 2000);
     } else {
-      status.textContent = 'Error: ' + (data.detail || 'Failed to create VM');
+      status.textContent = 'Error: ' + (data.message || 'Failed to create VM');
       status.style.color = 'var(--danger)';
     }
   } catch (err) {
@@ -655,7 +703,7 @@ document.getElementById('createVMForm').addEventListener('submit', async (e) =>
 // Logout
 window.logout = async function() {
   try {
-    await fetch('/api/auth/logout', { method: 'POST' });
+    await fetch('/api/v1/auth/logout', { method: 'POST' });
     window.location.href = '/login';
   } catch (err) {
     console.error('Logout error:', err);
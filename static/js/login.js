@@ -9,7 +9,7 @@ document.getElementById('loginForm').addEventListener('submit', async (e) => {
   errorEl.innerHTML = '';
 
   try {
-    const res = await fetch('/api/auth/login', {
+    const res = await fetch('/api/v1/auth/login', {
       method: 'POST',
       headers: {'Content-Type': 'application/json'},
       body: JSON.stringify({
@@ -19,10 +19,15 @@ document.getElementById('loginForm').addEventListener('submit', async (e) => {
     });
 
     if (res.ok) {
-      window.location.href = '/';
+      const data = await res.json();
+      if (data.must_change_password) {
+        showChangePassword(document.getElementById('password').value);
+      } else {
+        window.location.href = '/';
+      }
     } else {
       const data = await res.json();
-      errorEl.innerHTML = `<div class="error">${data.detail || 'Login failed'}</div>`;
+      errorEl.innerHTML = `<div class="error">${data.message || 'Login failed'}</div>`;
     }
   } catch (err) {
     errorEl.innerHTML = `<div class="error">Error: ${err.message}</div>`;
@@ -31,3 +36,80 @@ document.getElementById('loginForm').addEventListener('submit', async (e) => {
     btn.textContent = 'Sign In';
   }
 });
+
+// Users created with a temporary password must pick their own before the API
+// lets them in
+function showChangePassword(currentPassword) {
+  document.getElementById('loginForm').style.display = 'none';
+  document.getElementById('changePasswordForm').style.display = '';
+  document.getElementById('changePasswordInfo').style.display = '';
+  document.querySelector('.subtitle').textContent = 'Change your password';
+  if (currentPassword) {
+    document.getElementById('currentPassword').value = currentPassword;
+    document.getElementById('newPassword').focus();
+  } else {
+    document.getElementById('currentPassword').focus();
+  }
+}
+
+document.getElementById('changePasswordForm').addEventListener('submit', async (e) => {
+  e.preventDefault();
+
+  const btn = e.target.querySelector('button');
+  const errorEl = document.getElementById('error');
+  const newPassword = document.getElementById('newPassword').value;
+
+  errorEl.innerHTML = '';
+  if (newPassword !== document.getElementById('confirmPassword').value) {
+    errorEl.innerHTML = '<div class="error">Passwords do not match</div>';
+    return;
+  }
+
+  btn.disabled = true;
+  btn.textContent = 'Saving...';
+
+  try {
+    const res = await fetch('/api/v1/auth/change-password', {
+      method: 'POST',
+      headers: {'Content-Type': 'application/json'},
+      body: JSON.stringify({
+        current_password: document.getElementById('currentPassword').value,
+        new_password: newPassword
+      })
+    });
+
+    if (res.ok) {
+      window.location.href = '/';
+    } else {
+      const data = await res.json();
+      errorEl.innerHTML = `<div class="error">${data.message || 'Password change failed'}</div>`;
+    }
+  } catch (err) {
+    errorEl.innerHTML = `<div class="error">Error: ${err.message}</div>`;
+  } finally {
+    btn.disabled = false;
+    btn.textContent = 'Change Password';
+  }
+});
+
+// A failed sign-in through the identity provider comes back with an error
+const ssoError = new URLSearchParams(window.location.search).get('error');
+if (ssoError) {
+  const el = document.createElement('div');
+  el.className = 'error';
+  el.textContent = ssoError;
+  document.getElementById('error').appendChild(el);
+}
+
+// A signed-in user sent back here still has to change their password; others
+// may sign in through the identity provider when one is configured
+fetch('/api/v1/auth/check')
+  .then(res => res.json())
+  .then(data => {
+    if (data.authenticated && data.must_change_password) {
+      showChangePassword('');
+    } else if (data.oidc) {
+      document.getElementById('ssoLogin').style.display = '';
+    }
+  })
+  .catch(() => {});